@@ -0,0 +1,109 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"fmt"
+	"github.com/aquasecurity/esquery"
+	"github.com/jackc/pgx/v4"
+	"strconv"
+	"strings"
+)
+
+// ActivityHeatmap represents the amount of messages by day of the week and hour of the day,
+// used to establish working patterns and spot after-hours activity.
+type ActivityHeatmap struct {
+	Address  string `json:"address,omitempty"`
+	Timezone string `json:"timezone"` // The display timezone of the project the days and hours are in.
+	// Counts contains the amount of messages by day of the week (Monday first) and hour of the day (0 to 23).
+	Counts [7][24]int `json:"counts"`
+	Total  int        `json:"total"`
+}
+
+// activityHeatmapScript returns the cell (day of the week * 24 + hour) of the received date in the timezone.
+const activityHeatmapScript = `
+ZonedDateTime date = doc['received'].value.withZoneSameInstant(ZoneId.of(params.timezone));
+return (date.getDayOfWeek().getValue() - 1) * 24 + date.getHour();
+`
+
+// GetActivityHeatmap returns the amount of messages of the project by day of the week and hour of the day
+// in the display timezone of the project (see SetProjectTimezone).
+// If the address is not empty only the messages sent or received by the address are counted.
+// Messages without a date and messages flagged as bulk mail (see Message.IsBulk) are not counted.
+func GetActivityHeatmap(projectUUID string, address string, userUUID string, database *pgx.Conn) (ActivityHeatmap, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return ActivityHeatmap{}, err
+	}
+
+	timezone, err := getProjectTimezone(projectUUID, database)
+
+	if err != nil {
+		return ActivityHeatmap{}, err
+	}
+
+	// Addresses are indexed in lowercase, see initializeAddressValues.
+	address = strings.ToLower(strings.TrimSpace(address))
+
+	query := esquery.
+		Bool().
+		Filter(
+			esquery.Term("project_uuid", projectUUID),
+			esquery.Range("received").Gt(0),
+		).
+		MustNot(esquery.Term("is_bulk", true))
+
+	if address != "" {
+		query = query.
+			Should(
+				esquery.Term("from_addresses", address),
+				esquery.Term("recipient_addresses", address),
+			).
+			MinimumShouldMatch(1)
+	}
+
+	aggregations, total, err := runAggregationSearch(
+		query,
+		esquery.CustomAgg("activity", map[string]interface{}{
+			"terms": map[string]interface{}{
+				"script": map[string]interface{}{
+					"lang":   "painless",
+					"source": activityHeatmapScript,
+					"params": map[string]interface{}{
+						"timezone": timezone,
+					},
+				},
+				"value_type": "long",
+				"size":       7 * 24,
+			},
+		}),
+	)
+
+	if err != nil {
+		return ActivityHeatmap{}, err
+	}
+
+	buckets, err := aggregations.Buckets("activity")
+
+	if err != nil {
+		return ActivityHeatmap{}, err
+	}
+
+	activityHeatmap := ActivityHeatmap{
+		Address:  address,
+		Timezone: timezone,
+		Total:    total,
+	}
+
+	for _, bucket := range buckets {
+		cell, err := strconv.Atoi(bucket.KeyString())
+
+		if err != nil || cell < 0 || cell >= 7*24 {
+			return ActivityHeatmap{}, fmt.Errorf("invalid activity heatmap cell: %s", bucket.KeyString())
+		}
+
+		activityHeatmap.Counts[cell/24][cell%24] = bucket.DocCount
+	}
+
+	return activityHeatmap, nil
+}
@@ -0,0 +1,170 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aquasecurity/esquery"
+)
+
+// aggregationResult represents the aggregations of an Elasticsearch response (or of a bucket), by name.
+type aggregationResult map[string]json.RawMessage
+
+// aggregationBucket represents a bucket of a bucket aggregation (terms, histogram, etc.).
+type aggregationBucket struct {
+	Key          interface{}
+	KeyAsString  string
+	DocCount     int
+	Aggregations aggregationResult
+}
+
+// UnmarshalJSON decodes the bucket, the remaining fields are the sub-aggregations.
+func (bucket *aggregationBucket) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	if key, ok := fields["key"]; ok {
+		if err := json.Unmarshal(key, &bucket.Key); err != nil {
+			return err
+		}
+	}
+
+	if keyAsString, ok := fields["key_as_string"]; ok {
+		if err := json.Unmarshal(keyAsString, &bucket.KeyAsString); err != nil {
+			return err
+		}
+	}
+
+	if docCount, ok := fields["doc_count"]; ok {
+		if err := json.Unmarshal(docCount, &bucket.DocCount); err != nil {
+			return err
+		}
+	}
+
+	delete(fields, "key")
+	delete(fields, "key_as_string")
+	delete(fields, "doc_count")
+
+	bucket.Aggregations = fields
+
+	return nil
+}
+
+// KeyString returns the bucket key as a string.
+func (bucket aggregationBucket) KeyString() string {
+	if bucket.KeyAsString != "" {
+		return bucket.KeyAsString
+	}
+
+	return fmt.Sprint(bucket.Key)
+}
+
+// Buckets returns the buckets of the bucket aggregation.
+func (result aggregationResult) Buckets(name string) ([]aggregationBucket, error) {
+	rawAggregation, ok := result[name]
+
+	if !ok {
+		return nil, fmt.Errorf("missing aggregation: %s", name)
+	}
+
+	var bucketAggregation struct {
+		Buckets []aggregationBucket `json:"buckets"`
+	}
+
+	if err := json.Unmarshal(rawAggregation, &bucketAggregation); err != nil {
+		return nil, err
+	}
+
+	return bucketAggregation.Buckets, nil
+}
+
+// Bucket returns the single bucket of a filter or missing aggregation.
+func (result aggregationResult) Bucket(name string) (aggregationBucket, error) {
+	rawAggregation, ok := result[name]
+
+	if !ok {
+		return aggregationBucket{}, fmt.Errorf("missing aggregation: %s", name)
+	}
+
+	var bucket aggregationBucket
+
+	if err := json.Unmarshal(rawAggregation, &bucket); err != nil {
+		return aggregationBucket{}, err
+	}
+
+	return bucket, nil
+}
+
+// Value returns the value of the metric aggregation (min, max, sum, cardinality, etc.).
+// Returns zero if the aggregation has no value (e.g. min of no documents).
+func (result aggregationResult) Value(name string) (float64, error) {
+	rawAggregation, ok := result[name]
+
+	if !ok {
+		return 0, fmt.Errorf("missing aggregation: %s", name)
+	}
+
+	var metricAggregation struct {
+		Value *float64 `json:"value"`
+	}
+
+	if err := json.Unmarshal(rawAggregation, &metricAggregation); err != nil {
+		return 0, err
+	}
+
+	if metricAggregation.Value == nil {
+		return 0, nil
+	}
+
+	return *metricAggregation.Value, nil
+}
+
+// runAggregationSearch runs the aggregations on all messages matching the query.
+// Returns the aggregations and the total amount of matching messages.
+func runAggregationSearch(query esquery.Mappable, aggregations ...esquery.Aggregation) (aggregationResult, int, error) {
+	response, err := esquery.Search().
+		Query(query).
+		Aggs(aggregations...).
+		Size(0).
+		Run(
+			Elasticsearch,
+			Elasticsearch.Search.WithContext(context.Background()),
+			Elasticsearch.Search.WithIndex("messages"),
+			Elasticsearch.Search.WithTrackTotalHits(true),
+		)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	defer func() {
+		if err := response.Body.Close(); err != nil {
+			Logger.Errorf("Failed to close Elasticsearch response: %s", err)
+		}
+	}()
+
+	if response.IsError() {
+		return nil, 0, fmt.Errorf("failed to run aggregations: %s", response.String())
+	}
+
+	var searchResponse struct {
+		Hits struct {
+			Total struct {
+				Value int `json:"value"`
+			} `json:"total"`
+		} `json:"hits"`
+		Aggregations aggregationResult `json:"aggregations"`
+	}
+
+	if err := json.NewDecoder(response.Body).Decode(&searchResponse); err != nil {
+		return nil, 0, err
+	}
+
+	return searchResponse.Aggregations, searchResponse.Hits.Total.Value, nil
+}
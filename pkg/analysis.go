@@ -0,0 +1,93 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// analysisClient defines the HTTP client used to call the external analysis APIs (sentiment and embeddings).
+var analysisClient = &http.Client{
+	Timeout: time.Minute,
+}
+
+// postAnalysisRequest posts the JSON request to the analysis API and decodes the JSON response, retrying on failure.
+// The API key is sent as bearer token if set.
+func postAnalysisRequest(ctx context.Context, url string, apiKey string, request interface{}, response interface{}) error {
+	payload, err := json.Marshal(request)
+
+	if err != nil {
+		return err
+	}
+
+	return retry(ctx, ExternalServiceRetryOptions, func() error {
+		body, err := postAnalysisPayload(ctx, url, apiKey, payload)
+
+		if err != nil {
+			return err
+		}
+
+		if err := json.Unmarshal(body, response); err != nil {
+			return retryPermanent(fmt.Errorf("failed to decode the response of %s: %s", url, err))
+		}
+
+		return nil
+	})
+}
+
+// postAnalysisPayload posts the payload to the analysis API and returns the response body.
+// Throttled responses honor the Retry-After header, client errors other than 429 Too Many Requests are permanent.
+func postAnalysisPayload(ctx context.Context, url string, apiKey string, payload []byte) ([]byte, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+
+	if err != nil {
+		return nil, retryPermanent(err)
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+
+	if apiKey != "" {
+		request.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+
+	response, err := analysisClient.Do(request)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err := response.Body.Close(); err != nil {
+			Logger.Errorf("Failed to close response body: %s", err)
+		}
+	}()
+
+	body, err := ioutil.ReadAll(response.Body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode == http.StatusTooManyRequests || response.StatusCode == http.StatusServiceUnavailable {
+		throttledError := fmt.Errorf("throttled by %s: %d", request.URL.Host, response.StatusCode)
+
+		if after := parseRetryAfter(response.Header); after > 0 {
+			return nil, retryAfter(throttledError, after)
+		}
+
+		return nil, throttledError
+	} else if response.StatusCode >= 500 {
+		return nil, fmt.Errorf("unexpected status code: %d", response.StatusCode)
+	} else if response.StatusCode >= 400 {
+		return nil, retryPermanent(fmt.Errorf("unexpected status code: %d", response.StatusCode))
+	}
+
+	return body, nil
+}
@@ -0,0 +1,68 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"github.com/aquasecurity/esquery"
+	"github.com/jackc/pgx/v4"
+	"sort"
+	"strings"
+)
+
+// Appointment represents the structured fields of an appointment (IPM.Appointment), see GetAppointments.
+type Appointment struct {
+	Start     int      `json:"start"` // Unix timestamp.
+	End       int      `json:"end"`   // Unix timestamp, the start if the appointment has no end.
+	Location  string   `json:"location,omitempty"`
+	Organizer string   `json:"organizer,omitempty"`
+	Attendees []string `json:"attendees,omitempty"`
+}
+
+// messageClassAppointment defines the message class of appointments.
+const messageClassAppointment = "IPM.Appointment"
+
+// GetAppointments returns the appointments of the project overlapping the period (Unix timestamps) ordered by their start,
+// e.g. to show the meetings of the custodian in a calendar. Appointments without a start (indexed before the appointment fields) are omitted.
+func GetAppointments(projectUUID string, from int, to int, userUUID string, database *pgx.Conn) ([]Message, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return nil, err
+	}
+
+	query := esquery.Bool().Filter(
+		esquery.Term("project_uuid", projectUUID),
+		esquery.Range("appointment.start").Lt(to),
+		esquery.Range("appointment.end").Gte(from),
+	)
+
+	var appointments []Message
+
+	err := forEachMessageBatch(query, func(messages []Message) error {
+		appointments = append(appointments, messages...)
+
+		return nil
+	}, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(appointments, func(i, j int) bool {
+		return appointments[i].Appointment.Start < appointments[j].Appointment.Start
+	})
+
+	return appointments, nil
+}
+
+// splitAppointmentAttendees returns the attendees of the semicolon separated attendee list.
+func splitAppointmentAttendees(attendeeList string) []string {
+	var attendees []string
+
+	for _, attendee := range strings.Split(attendeeList, ";") {
+		if attendee = strings.TrimSpace(attendee); attendee != "" {
+			attendees = append(attendees, attendee)
+		}
+	}
+
+	return attendees
+}
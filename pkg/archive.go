@@ -0,0 +1,346 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"archive/zip"
+	"bufio"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"golang.org/x/crypto/pbkdf2"
+	"hash"
+	"io"
+	"os"
+	"time"
+)
+
+// ArchiveOptions represents the protection of an export ZIP file delivered on portable media.
+// The zero value creates a single unencrypted ZIP file.
+type ArchiveOptions struct {
+	// Passphrase encrypts the files with WinZip AES-256 (supported by 7-Zip, WinZip and macOS Archive Utility), see GenerateArchivePassphrase.
+	// Stored encrypted with the TokenEncryptionKey in the job parameters.
+	Passphrase string `json:"-"`
+	// VolumeSize splits the ZIP file into volumes of this size in bytes, zero for a single file.
+	// The volumes are joined by concatenating them, e.g. "cat export.zip.* > export.zip" or 7-Zip.
+	VolumeSize int64 `json:"volume_size"`
+}
+
+// archiveOptionsJSON represents the stored ArchiveOptions.
+type archiveOptionsJSON struct {
+	EncryptedPassphrase string `json:"encrypted_passphrase,omitempty"`
+	VolumeSize          int64  `json:"volume_size"`
+}
+
+// ErrArchivePassphraseNotStored is returned when a passphrase can't be stored because the TokenEncryptionKey isn't configured.
+var ErrArchivePassphraseNotStored = errors.New("archive passphrase requires the token encryption key")
+
+// archivePassphraseSize defines the random bytes of a generated passphrase.
+const archivePassphraseSize = 24
+
+// GenerateArchivePassphrase returns a random passphrase to encrypt an export with, see ArchiveOptions.
+// The passphrase must be delivered to the recipient separately from the export.
+func GenerateArchivePassphrase() (string, error) {
+	passphrase := make([]byte, archivePassphraseSize)
+
+	if _, err := io.ReadFull(rand.Reader, passphrase); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(passphrase), nil
+}
+
+// MarshalJSON stores the passphrase encrypted so it isn't readable from the job parameters.
+func (options ArchiveOptions) MarshalJSON() ([]byte, error) {
+	stored := archiveOptionsJSON{
+		VolumeSize: options.VolumeSize,
+	}
+
+	if options.Passphrase != "" {
+		if TokenEncryptionKey == nil {
+			return nil, ErrArchivePassphraseNotStored
+		}
+
+		encryptedPassphrase, err := encryptValue(TokenEncryptionKey, options.Passphrase)
+
+		if err != nil {
+			return nil, err
+		}
+
+		stored.EncryptedPassphrase = encryptedPassphrase
+	}
+
+	return json.Marshal(stored)
+}
+
+// UnmarshalJSON decrypts the passphrase stored by MarshalJSON.
+func (options *ArchiveOptions) UnmarshalJSON(data []byte) error {
+	var stored archiveOptionsJSON
+
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return err
+	}
+
+	options.VolumeSize = stored.VolumeSize
+	options.Passphrase = ""
+
+	if stored.EncryptedPassphrase != "" {
+		if TokenEncryptionKey == nil {
+			return ErrArchivePassphraseNotStored
+		}
+
+		passphrase, err := decryptValue(TokenEncryptionKey, stored.EncryptedPassphrase)
+
+		if err != nil {
+			return err
+		}
+
+		options.Passphrase = passphrase
+	}
+
+	return nil
+}
+
+// The WinZip AES-256 format (AE-2), see https://www.winzip.com/en/support/aes-encryption/.
+const (
+	aesZipMethod       = 99     // The compression method of encrypted files, the actual method is in the extra field.
+	aesZipExtraID      = 0x9901 // The header ID of the AES extra field.
+	aesZipVersion      = 2      // AE-2, the CRC is omitted since the authentication code covers the content.
+	aesZipStrength     = 3      // AES-256.
+	aesZipKeySize      = 32
+	aesZipSaltSize     = 16
+	aesZipVerifierSize = 2
+	aesZipMACSize      = 10
+	aesZipIterations   = 1000
+	zipFlagEncrypted   = 0x1
+	zipFlagUTF8        = 0x800
+)
+
+// aesZipFile encrypts a file of a ZIP file to a temporary file, since the sizes must be known before it is added to the ZIP file.
+// The content is compressed before it is encrypted.
+type aesZipFile struct {
+	name         string
+	filePath     string
+	file         *os.File
+	bufferWriter *bufio.Writer
+	flateWriter  *flate.Writer
+	mac          hash.Hash
+	size         int64 // Uncompressed.
+}
+
+// newAESZipFile creates the temporary file at the file path for the encrypted file with the name in the ZIP file.
+func newAESZipFile(name string, passphrase string, filePath string) (*aesZipFile, error) {
+	salt := make([]byte, aesZipSaltSize)
+
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+
+	encryptionKey, authenticationKey, verifier := deriveAESZipKeys(passphrase, salt)
+
+	block, err := aes.NewCipher(encryptionKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Create(filePath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	encryptedFile := &aesZipFile{
+		name:         name,
+		filePath:     filePath,
+		file:         file,
+		bufferWriter: bufio.NewWriter(file),
+		mac:          hmac.New(sha1.New, authenticationKey),
+	}
+
+	if _, err := encryptedFile.bufferWriter.Write(salt); err != nil {
+		encryptedFile.remove()
+
+		return nil, err
+	}
+
+	if _, err := encryptedFile.bufferWriter.Write(verifier); err != nil {
+		encryptedFile.remove()
+
+		return nil, err
+	}
+
+	encryptedFile.flateWriter, err = flate.NewWriter(&aesZipWriter{
+		stream: newAESZipStream(block),
+		mac:    encryptedFile.mac,
+		writer: encryptedFile.bufferWriter,
+	}, flate.DefaultCompression)
+
+	if err != nil {
+		encryptedFile.remove()
+
+		return nil, err
+	}
+
+	return encryptedFile, nil
+}
+
+// deriveAESZipKeys returns the encryption key, authentication key and password verifier of the passphrase and salt.
+func deriveAESZipKeys(passphrase string, salt []byte) ([]byte, []byte, []byte) {
+	keys := pbkdf2.Key([]byte(passphrase), salt, aesZipIterations, 2*aesZipKeySize+aesZipVerifierSize, sha1.New)
+
+	return keys[:aesZipKeySize], keys[aesZipKeySize : 2*aesZipKeySize], keys[2*aesZipKeySize:]
+}
+
+// Write compresses and encrypts the content.
+func (encryptedFile *aesZipFile) Write(data []byte) (int, error) {
+	written, err := encryptedFile.flateWriter.Write(data)
+
+	encryptedFile.size += int64(written)
+
+	return written, err
+}
+
+// addToZip completes the encrypted file, copies it into the ZIP file and removes the temporary file.
+func (encryptedFile *aesZipFile) addToZip(zipWriter *zip.Writer) error {
+	defer encryptedFile.remove()
+
+	if err := encryptedFile.flateWriter.Close(); err != nil {
+		return err
+	}
+
+	if _, err := encryptedFile.bufferWriter.Write(encryptedFile.mac.Sum(nil)[:aesZipMACSize]); err != nil {
+		return err
+	}
+
+	if err := encryptedFile.bufferWriter.Flush(); err != nil {
+		return err
+	}
+
+	fileInfo, err := encryptedFile.file.Stat()
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := encryptedFile.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	fileHeader := &zip.FileHeader{
+		Name:               encryptedFile.name,
+		Method:             aesZipMethod,
+		Flags:              zipFlagEncrypted | zipFlagUTF8,
+		CompressedSize64:   uint64(fileInfo.Size()),
+		UncompressedSize64: uint64(encryptedFile.size),
+		Extra:              getAESZipExtra(),
+	}
+
+	// CreateRaw doesn't convert the Modified field to the MS-DOS time.
+	fileHeader.SetModTime(time.Now())
+
+	zipFile, err := zipWriter.CreateRaw(fileHeader)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(zipFile, encryptedFile.file)
+
+	return err
+}
+
+// remove closes and removes the temporary file.
+func (encryptedFile *aesZipFile) remove() {
+	if err := encryptedFile.file.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
+		Logger.Errorf("Failed to close file: %s", err)
+	}
+
+	if err := os.Remove(encryptedFile.filePath); err != nil && !os.IsNotExist(err) {
+		Logger.Errorf("Failed to remove encrypted ZIP file: %s", err)
+	}
+}
+
+// getAESZipExtra returns the AES extra field of an encrypted file.
+func getAESZipExtra() []byte {
+	extra := make([]byte, 11)
+
+	binary.LittleEndian.PutUint16(extra[0:], aesZipExtraID)
+	binary.LittleEndian.PutUint16(extra[2:], 7)
+	binary.LittleEndian.PutUint16(extra[4:], aesZipVersion)
+	copy(extra[6:], "AE")
+	extra[8] = aesZipStrength
+	binary.LittleEndian.PutUint16(extra[9:], zip.Deflate)
+
+	return extra
+}
+
+// aesZipWriter encrypts the written data and authenticates the ciphertext.
+type aesZipWriter struct {
+	stream cipher.Stream
+	mac    hash.Hash
+	writer io.Writer
+}
+
+// Write encrypts the data.
+func (aesWriter *aesZipWriter) Write(data []byte) (int, error) {
+	ciphertext := make([]byte, len(data))
+
+	aesWriter.stream.XORKeyStream(ciphertext, data)
+	aesWriter.mac.Write(ciphertext)
+
+	return aesWriter.writer.Write(ciphertext)
+}
+
+// aesZipStream is the AES counter mode of WinZip, which uses a little-endian counter starting at one (unlike cipher.NewCTR).
+type aesZipStream struct {
+	block     cipher.Block
+	counter   [aes.BlockSize]byte
+	keyStream [aes.BlockSize]byte
+	used      int // The used bytes of the key stream.
+}
+
+// newAESZipStream creates the counter mode stream of the block cipher.
+func newAESZipStream(block cipher.Block) *aesZipStream {
+	stream := &aesZipStream{
+		block: block,
+		used:  aes.BlockSize,
+	}
+
+	stream.counter[0] = 1
+
+	return stream
+}
+
+// XORKeyStream implements cipher.Stream.
+func (stream *aesZipStream) XORKeyStream(dst []byte, src []byte) {
+	for i := range src {
+		if stream.used == aes.BlockSize {
+			stream.block.Encrypt(stream.keyStream[:], stream.counter[:])
+			stream.incrementCounter()
+			stream.used = 0
+		}
+
+		dst[i] = src[i] ^ stream.keyStream[stream.used]
+		stream.used++
+	}
+}
+
+// incrementCounter increments the little-endian counter.
+func (stream *aesZipStream) incrementCounter() {
+	for i := range stream.counter {
+		stream.counter[i]++
+
+		if stream.counter[i] != 0 {
+			return
+		}
+	}
+}
@@ -0,0 +1,380 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// The known-answer vector was created by libarchive (bsdtar --options zip:compression=store,zip:encryption=aes256).
+const (
+	aesZipVectorPassphrase = "correct-horse"
+	aesZipVectorPlaintext  = "Go Forensics known-answer vector for WinZip AES-256.\n"
+	aesZipVectorSalt       = "7e880bf6ca320c08e59def28cccdcdaf"
+	aesZipVectorVerifier   = "2482"
+	aesZipVectorCiphertext = "4f3ee616d24f6af35a0a24cb29cdaebc1ce6c535e3f6efe0ffceb8eace9a7a0b6894d1cfbc5ae151636779c2c0696b6f34ec36b934"
+	aesZipVectorMAC        = "e2343e9fa57cbed9f6e4"
+)
+
+// TestAESZipKnownAnswer tests the key derivation, counter mode and authentication code against the known-answer vector.
+func TestAESZipKnownAnswer(t *testing.T) {
+	salt := mustDecodeHex(t, aesZipVectorSalt)
+
+	encryptionKey, authenticationKey, verifier := deriveAESZipKeys(aesZipVectorPassphrase, salt)
+
+	if got := hex.EncodeToString(verifier); got != aesZipVectorVerifier {
+		t.Fatalf("verifier = %s, want %s", got, aesZipVectorVerifier)
+	}
+
+	block, err := aes.NewCipher(encryptionKey)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ciphertext bytes.Buffer
+
+	mac := hmac.New(sha1.New, authenticationKey)
+	aesWriter := &aesZipWriter{
+		stream: newAESZipStream(block),
+		mac:    mac,
+		writer: &ciphertext,
+	}
+
+	// Written in parts which don't line up with the AES blocks.
+	plaintext := []byte(aesZipVectorPlaintext)
+
+	for _, part := range [][]byte{plaintext[:7], plaintext[7:23], plaintext[23:]} {
+		if _, err := aesWriter.Write(part); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := hex.EncodeToString(ciphertext.Bytes()); got != aesZipVectorCiphertext {
+		t.Fatalf("ciphertext = %s, want %s", got, aesZipVectorCiphertext)
+	}
+
+	if got := hex.EncodeToString(mac.Sum(nil)[:aesZipMACSize]); got != aesZipVectorMAC {
+		t.Fatalf("authentication code = %s, want %s", got, aesZipVectorMAC)
+	}
+}
+
+// TestZipUploaderEncryptedVolumes tests that the joined volumes of an encrypted export are a valid ZIP file which decrypts to the added files.
+func TestZipUploaderEncryptedVolumes(t *testing.T) {
+	objectDirectory := useTestObjectStore(t)
+
+	const passphrase = "test passphrase"
+
+	projectUUID := NewUUID()
+	files := map[string][]byte{
+		"messages/1.eml":  mustRandomBytes(t, 3000),
+		"messages/2.eml":  bytes.Repeat([]byte("compressible "), 500),
+		"attachments/3":   {},
+		"unicode/ümlaut":  []byte("content"),
+		"reports/summary": mustRandomBytes(t, 700),
+	}
+
+	zipUploader := NewZipUploader("export.zip", projectUUID, ArchiveOptions{
+		Passphrase: passphrase,
+		VolumeSize: 1024,
+	})
+
+	for name, content := range files {
+		zipFile, err := zipUploader.Create(name)
+
+		if err != nil {
+			zipUploader.Abort()
+			t.Fatal(err)
+		}
+
+		if _, err := zipFile.Write(content); err != nil {
+			zipUploader.Abort()
+			t.Fatal(err)
+		}
+	}
+
+	objectName, err := zipUploader.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := projectUUID + "/export.zip.001"; objectName != want {
+		t.Fatalf("object name = %s, want %s", objectName, want)
+	}
+
+	// Joined like "cat export.zip.* > export.zip".
+	volumePaths, err := filepath.Glob(filepath.Join(objectDirectory, projectUUID, "export.zip.*"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(volumePaths) < 2 {
+		t.Fatalf("volumes = %d, want multiple", len(volumePaths))
+	}
+
+	var joined []byte
+
+	for i, volumePath := range volumePaths {
+		volume, err := os.ReadFile(volumePath)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if i < len(volumePaths)-1 && len(volume) != 1024 {
+			t.Fatalf("volume %s is %d bytes, want 1024", volumePath, len(volume))
+		}
+
+		joined = append(joined, volume...)
+	}
+
+	zipReader, err := zip.NewReader(bytes.NewReader(joined), int64(len(joined)))
+
+	if err != nil {
+		t.Fatalf("joined volumes aren't a valid ZIP file: %s", err)
+	}
+
+	if len(zipReader.File) != len(files) {
+		t.Fatalf("files = %d, want %d", len(zipReader.File), len(files))
+	}
+
+	for _, zipFile := range zipReader.File {
+		want, ok := files[zipFile.Name]
+
+		if !ok {
+			t.Fatalf("unexpected file %s", zipFile.Name)
+		}
+
+		if zipFile.Method != aesZipMethod || zipFile.Flags&zipFlagEncrypted == 0 {
+			t.Fatalf("file %s isn't encrypted (method %d, flags %#x)", zipFile.Name, zipFile.Method, zipFile.Flags)
+		}
+
+		if got := readAESZipFile(t, zipFile, passphrase); !bytes.Equal(got, want) {
+			t.Fatalf("file %s doesn't match the added content", zipFile.Name)
+		}
+	}
+
+	t.Run("libarchive", func(t *testing.T) {
+		bsdtar, err := exec.LookPath("bsdtar")
+
+		if err != nil {
+			t.Skip("bsdtar isn't installed")
+		}
+
+		zipPath := filepath.Join(t.TempDir(), "export.zip")
+
+		if err := os.WriteFile(zipPath, joined, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		for name, want := range files {
+			command := exec.Command(bsdtar, "--passphrase", passphrase, "-xOf", zipPath, name)
+
+			// The names are UTF-8, which bsdtar can't convert in the C locale.
+			command.Env = append(os.Environ(), "LC_ALL=C.UTF-8")
+
+			output, err := command.Output()
+
+			if err != nil {
+				t.Fatalf("bsdtar failed to extract %s: %s", name, err)
+			}
+
+			if !bytes.Equal(output, want) {
+				t.Fatalf("bsdtar extracted %s with different content", name)
+			}
+		}
+	})
+}
+
+// TestZipUploaderAbort tests that aborting removes the uploaded volumes.
+func TestZipUploaderAbort(t *testing.T) {
+	objectDirectory := useTestObjectStore(t)
+	projectUUID := NewUUID()
+
+	zipUploader := NewZipUploader("export.zip", projectUUID, ArchiveOptions{VolumeSize: 512})
+
+	zipFile, err := zipUploader.Create("data")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := zipFile.Write(mustRandomBytes(t, 2048)); err != nil {
+		t.Fatal(err)
+	}
+
+	zipUploader.Abort()
+
+	volumePaths, err := filepath.Glob(filepath.Join(objectDirectory, projectUUID, "export.zip.*"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(volumePaths) != 0 {
+		t.Fatalf("volumes after abort = %v, want none", volumePaths)
+	}
+}
+
+// useTestObjectStore stores the objects and temporary files of the test in temporary directories.
+// Returns the directory of the objects.
+func useTestObjectStore(t *testing.T) string {
+	t.Helper()
+
+	objectDirectory := t.TempDir()
+
+	objectStore, err := NewFileBlobStore(objectDirectory)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previousObjectStore, previousTempDirectory, previousTempQuota := ObjectStore, TempDirectory, TempQuota
+
+	t.Cleanup(func() {
+		ObjectStore, TempDirectory, TempQuota = previousObjectStore, previousTempDirectory, previousTempQuota
+	})
+
+	ObjectStore, TempDirectory, TempQuota = objectStore, t.TempDir(), 0
+
+	return objectDirectory
+}
+
+// readAESZipFile authenticates, decrypts and decompresses the WinZip AES encrypted file.
+func readAESZipFile(t *testing.T, zipFile *zip.File, passphrase string) []byte {
+	t.Helper()
+
+	actualMethod, err := getAESZipActualMethod(zipFile.Extra)
+
+	if err != nil {
+		t.Fatalf("file %s: %s", zipFile.Name, err)
+	}
+
+	rawReader, err := zipFile.OpenRaw()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := io.ReadAll(rawReader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(raw) < aesZipSaltSize+aesZipVerifierSize+aesZipMACSize {
+		t.Fatalf("file %s is too small to be encrypted", zipFile.Name)
+	}
+
+	salt := raw[:aesZipSaltSize]
+	storedVerifier := raw[aesZipSaltSize : aesZipSaltSize+aesZipVerifierSize]
+	ciphertext := raw[aesZipSaltSize+aesZipVerifierSize : len(raw)-aesZipMACSize]
+	storedMAC := raw[len(raw)-aesZipMACSize:]
+
+	encryptionKey, authenticationKey, verifier := deriveAESZipKeys(passphrase, salt)
+
+	if !bytes.Equal(storedVerifier, verifier) {
+		t.Fatalf("file %s has a different password verifier", zipFile.Name)
+	}
+
+	mac := hmac.New(sha1.New, authenticationKey)
+	mac.Write(ciphertext)
+
+	if !hmac.Equal(mac.Sum(nil)[:aesZipMACSize], storedMAC) {
+		t.Fatalf("file %s has an invalid authentication code", zipFile.Name)
+	}
+
+	block, err := aes.NewCipher(encryptionKey)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Counter mode decrypts like it encrypts.
+	compressed := make([]byte, len(ciphertext))
+	newAESZipStream(block).XORKeyStream(compressed, ciphertext)
+
+	switch actualMethod {
+	case zip.Store:
+		return compressed
+	case zip.Deflate:
+		content, err := io.ReadAll(flate.NewReader(bytes.NewReader(compressed)))
+
+		if err != nil {
+			t.Fatalf("file %s: %s", zipFile.Name, err)
+		}
+
+		return content
+	default:
+		t.Fatalf("file %s has unsupported method %d", zipFile.Name, actualMethod)
+
+		return nil
+	}
+}
+
+// getAESZipActualMethod returns the compression method of the AES extra field.
+func getAESZipActualMethod(extra []byte) (uint16, error) {
+	for len(extra) >= 4 {
+		headerID := binary.LittleEndian.Uint16(extra[0:])
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+
+		if len(extra) < 4+size {
+			break
+		}
+
+		if headerID == aesZipExtraID && size == 7 {
+			if extra[8] != aesZipStrength {
+				return 0, fmt.Errorf("AES strength %d, want %d", extra[8], aesZipStrength)
+			}
+
+			return binary.LittleEndian.Uint16(extra[9:]), nil
+		}
+
+		extra = extra[4+size:]
+	}
+
+	return 0, fmt.Errorf("missing AES extra field")
+}
+
+// mustDecodeHex returns the bytes of the hex string.
+func mustDecodeHex(t *testing.T, value string) []byte {
+	t.Helper()
+
+	decoded, err := hex.DecodeString(value)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return decoded
+}
+
+// mustRandomBytes returns random (incompressible) bytes.
+func mustRandomBytes(t *testing.T, size int) []byte {
+	t.Helper()
+
+	randomBytes := make([]byte, size)
+
+	if _, err := rand.Read(randomBytes); err != nil {
+		t.Fatal(err)
+	}
+
+	return randomBytes
+}
@@ -3,16 +3,332 @@
 // Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
 package core
 
-import "errors"
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/aquasecurity/esquery"
+	"github.com/jackc/pgx/v4"
+	"github.com/minio/minio-go/v7"
+	"io"
+	"os"
+)
 
 // Attachment represents an attachment.
 type Attachment struct {
 	UUID string `json:"uuid"`
 	Name string `json:"name"`
+	Size int64  `json:"size,omitempty"` // In bytes.
+	Hash string `json:"hash,omitempty"` // SHA-256 (hex) of the content, empty for attachments stored before deduplication.
+	// IsSuppressed is set if the hash is in a hash list of the project, see ImportHashList.
+	IsSuppressed bool `json:"is_suppressed,omitempty"`
 }
 
+// ErrAttachmentNotFound is returned if the message has no attachment with the UUID.
+var ErrAttachmentNotFound = errors.New("attachment not found")
+
 // GetAllAttachments returns all attachments from all messages.
 func GetAllAttachments(projectUUID string) ([]Attachment, error) {
 	// TODO - Implement this.
 	return nil, errors.New("not implemented yet")
 }
+
+// getAttachmentObjectName returns the MinIO object of the attachment.
+// Attachments are stored once per project keyed by their hash, attachments stored before deduplication are keyed by their UUID.
+func getAttachmentObjectName(attachment Attachment, projectUUID string) string {
+	if attachment.Hash != "" {
+		return fmt.Sprintf("%s/%s", projectUUID, getAttachmentFileName(attachment.Hash))
+	}
+
+	return fmt.Sprintf("%s/%s", projectUUID, attachment.UUID)
+}
+
+// getAttachmentFileName returns the file name of the attachment content in the project, see UploadFile.
+func getAttachmentFileName(hash string) string {
+	return fmt.Sprintf("attachments/%s", hash)
+}
+
+// WriteAttachmentToWriter writes the content of the attachment of the message to the writer, e.g. to preview or download it.
+// Returns ErrAttachmentNotFound if the message has no attachment with the UUID.
+func WriteAttachmentToWriter(messageUUID string, attachmentUUID string, projectUUID string, userUUID string, writer io.Writer, database *pgx.Conn) error {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return err
+	}
+
+	message, err := getMessageByUUID(messageUUID, projectUUID, database)
+
+	if err != nil {
+		return err
+	}
+
+	for _, attachment := range message.Attachments {
+		if attachment.UUID == attachmentUUID {
+			return WriteFileToWriter(getAttachmentObjectName(attachment, projectUUID), writer)
+		}
+	}
+
+	return ErrAttachmentNotFound
+}
+
+// storeAttachment stores the attachment file in MinIO keyed by its hash and returns the hash.
+// The content is only uploaded if the project doesn't reference it yet, otherwise its reference count is incremented.
+func storeAttachment(filePath string, size int64, projectUUID string, database *pgx.Conn) (string, error) {
+	hash, err := getFileSHA256(filePath)
+
+	if err != nil {
+		return "", err
+	}
+
+	referenceCount, err := addAttachmentReference(hash, size, projectUUID, database)
+
+	if err != nil {
+		return "", err
+	}
+
+	if referenceCount > 1 {
+		return hash, nil
+	}
+
+	if _, err := UploadFile(getAttachmentFileName(hash), filePath, projectUUID); err != nil {
+		if releaseErr := releaseAttachmentReference(hash, projectUUID, database); releaseErr != nil {
+			Logger.Errorf("Failed to release attachment reference: %s", releaseErr)
+		}
+
+		return "", err
+	}
+
+	return hash, nil
+}
+
+// getFileSHA256 returns the SHA-256 (hex) of the file.
+func getFileSHA256(filePath string) (string, error) {
+	inputFile, err := os.Open(filePath)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer func() {
+		if err := inputFile.Close(); err != nil {
+			Logger.Errorf("Failed to close file: %s", err)
+		}
+	}()
+
+	sha256Hash := sha256.New()
+
+	if _, err := io.Copy(sha256Hash, inputFile); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(sha256Hash.Sum(nil)), nil
+}
+
+// addAttachmentReference increments the reference count of the attachment content and returns it.
+func addAttachmentReference(hash string, size int64, projectUUID string, database *pgx.Conn) (int, error) {
+	preparedStatement := `
+	INSERT INTO attachment_objects(projectUUID, hash, size, referenceCount) VALUES ($1, $2, $3, 1)
+	ON CONFLICT (projectUUID, hash) DO UPDATE SET referenceCount = attachment_objects.referenceCount + 1
+	RETURNING referenceCount
+	`
+	var referenceCount int
+
+	err := database.QueryRow(context.Background(), preparedStatement, projectUUID, hash, size).Scan(&referenceCount)
+
+	return referenceCount, err
+}
+
+// releaseAttachmentReference decrements the reference count of the attachment content, which is removed once it is unreferenced.
+func releaseAttachmentReference(hash string, projectUUID string, database *pgx.Conn) error {
+	preparedStatement := `
+	UPDATE attachment_objects SET referenceCount = referenceCount - 1 WHERE projectUUID = $1 AND hash = $2
+	RETURNING referenceCount
+	`
+	var referenceCount int
+
+	if err := database.QueryRow(context.Background(), preparedStatement, projectUUID, hash).Scan(&referenceCount); err != nil {
+		return err
+	}
+
+	if referenceCount > 0 {
+		return nil
+	}
+
+	preparedStatement = `
+	DELETE FROM attachment_objects WHERE projectUUID = $1 AND hash = $2 AND referenceCount <= 0
+	`
+	if _, err := database.Exec(context.Background(), preparedStatement, projectUUID, hash); err != nil {
+		return err
+	}
+
+	return RemoveObject(getAttachmentObjectName(Attachment{Hash: hash}, projectUUID))
+}
+
+// AttachmentStorageStatistics represents the deduplication of the attachments of a project.
+type AttachmentStorageStatistics struct {
+	Objects      int   `json:"objects"`       // The unique attachment contents stored.
+	References   int   `json:"references"`    // The attachments referencing the contents.
+	StoredSize   int64 `json:"stored_size"`   // In bytes.
+	ReferredSize int64 `json:"referred_size"` // In bytes, the size without deduplication.
+}
+
+// GetAttachmentStorageStatistics returns the deduplication of the attachments stored by hash.
+// Attachments stored before deduplication aren't counted, see MigrateAttachmentStorage.
+func GetAttachmentStorageStatistics(projectUUID string, userUUID string, database *pgx.Conn) (AttachmentStorageStatistics, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionManageProject, database); err != nil {
+		return AttachmentStorageStatistics{}, err
+	}
+
+	preparedStatement := `
+	SELECT COUNT(*), COALESCE(SUM(referenceCount), 0), COALESCE(SUM(size), 0), COALESCE(SUM(size * referenceCount), 0)
+	FROM attachment_objects WHERE projectUUID = $1
+	`
+	var statistics AttachmentStorageStatistics
+
+	err := database.QueryRow(context.Background(), preparedStatement, projectUUID).Scan(&statistics.Objects, &statistics.References, &statistics.StoredSize, &statistics.ReferredSize)
+
+	return statistics, err
+}
+
+// MigrateAttachmentStorage moves the attachments of the project stored before deduplication (keyed by UUID) to storage keyed by hash.
+// The messages are updated to reference the hash before the old objects are removed, so it can be run again after a failure.
+// Returns the amount of migrated attachments.
+func MigrateAttachmentStorage(projectUUID string, userUUID string, database *pgx.Conn) (int, error) {
+	logger := Logger.WithFields(LogFields{"project_uuid": projectUUID})
+
+	if err := CheckPermission(userUUID, projectUUID, ActionManageProject, database); err != nil {
+		return 0, err
+	}
+
+	if err := updateMessagesMapping(); err != nil {
+		return 0, err
+	}
+
+	scratchSpace, err := NewScratchSpace(projectUUID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer scratchSpace.cleanup()
+
+	query := esquery.Bool().
+		Filter(esquery.Term("project_uuid", projectUUID), esquery.Exists("attachments.uuid")).
+		MustNot(esquery.Exists("attachments.hash"))
+
+	var migrated int
+
+	err = forEachMessageBatch(query, func(messages []Message) error {
+		for _, message := range messages {
+			var legacyObjectNames []string
+
+			for i, attachment := range message.Attachments {
+				if attachment.Hash != "" {
+					continue
+				}
+
+				legacyObjectName := getAttachmentObjectName(attachment, projectUUID)
+				filePath := scratchSpace.FilePath(attachment.UUID)
+
+				hash, size, err := migrateAttachmentObject(legacyObjectName, filePath, projectUUID, database)
+
+				if err != nil {
+					return err
+				}
+
+				if hash == "" {
+					// One of the parsers didn't upload the attachment to MinIO.
+					logger.Warnf("Failed to migrate attachment (%s - %s): object does not exist", attachment.UUID, attachment.Name)
+					continue
+				}
+
+				message.Attachments[i].Hash = hash
+				message.Attachments[i].Size = size
+
+				legacyObjectNames = append(legacyObjectNames, legacyObjectName)
+			}
+
+			if len(legacyObjectNames) == 0 {
+				continue
+			}
+
+			if err := updateMessageFields([]string{message.UUID}, projectUUID, map[string]interface{}{"attachments": message.Attachments}); err != nil {
+				return err
+			}
+
+			for _, legacyObjectName := range legacyObjectNames {
+				if err := RemoveObject(legacyObjectName); err != nil {
+					return err
+				}
+			}
+
+			migrated += len(legacyObjectNames)
+		}
+
+		return nil
+	}, database)
+
+	if err != nil {
+		return migrated, err
+	}
+
+	logger.Infof("Migrated %d attachments to deduplicated storage", migrated)
+
+	return migrated, nil
+}
+
+// migrateAttachmentObject downloads the legacy attachment object to the file path and stores it by hash.
+// Returns the hash and size, the hash is empty if the legacy object doesn't exist.
+func migrateAttachmentObject(legacyObjectName string, filePath string, projectUUID string, database *pgx.Conn) (string, int64, error) {
+	bucketName, err := getObjectBucket(legacyObjectName)
+
+	if err != nil {
+		return "", 0, err
+	}
+
+	getObjectOptions, err := getObjectOptions(legacyObjectName)
+
+	if err != nil {
+		return "", 0, err
+	}
+
+	err = retry(context.Background(), ExternalServiceRetryOptions, func() error {
+		err := MinIOClient.FGetObject(context.Background(), bucketName, legacyObjectName, filePath, getObjectOptions)
+
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return retryPermanent(err)
+		}
+
+		return err
+	})
+
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return "", 0, nil
+	} else if err != nil {
+		return "", 0, err
+	}
+
+	defer func() {
+		if err := os.Remove(filePath); err != nil {
+			Logger.Errorf("Failed to remove attachment file: %s", err)
+		}
+	}()
+
+	fileInfo, err := os.Stat(filePath)
+
+	if err != nil {
+		return "", 0, err
+	}
+
+	hash, err := storeAttachment(filePath, fileInfo.Size(), projectUUID, database)
+
+	return hash, fileInfo.Size(), err
+}
+
+// runMigrateAttachmentsJob runs MigrateAttachmentStorage, the job has no parameters.
+func runMigrateAttachmentsJob(ctx context.Context, job Job, reportProgress func(progress int), database *pgx.Conn) (string, error) {
+	_, err := MigrateAttachmentStorage(job.ProjectUUID, job.UserUUID, database)
+
+	return "", err
+}
@@ -0,0 +1,76 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"github.com/jackc/pgx/v4"
+	"time"
+)
+
+// AuditLog represents an action performed on a project.
+// Audit logs are kept after a project is purged so the deletion itself remains traceable.
+type AuditLog struct {
+	UUID         string `json:"uuid"`
+	ProjectUUID  string `json:"project_uuid"`
+	UserUUID     string `json:"user_uuid"`
+	Action       string `json:"action"`
+	Details      string `json:"details"`
+	CreationDate int    `json:"creation_date"`
+}
+
+// Save saves the audit log to the database.
+func (auditLog *AuditLog) Save(database *pgx.Conn) error {
+	preparedStatement := `
+	INSERT INTO audit_log(uuid, projectUUID, userUUID, action, details, creationDate) VALUES ($1, $2, $3, $4, $5, $6)
+	`
+	_, err := database.Exec(context.Background(), preparedStatement, auditLog.UUID, auditLog.ProjectUUID, auditLog.UserUUID, auditLog.Action, auditLog.Details, auditLog.CreationDate)
+
+	return err
+}
+
+// AddAuditLog records the action performed by the user on the project.
+// Use an empty userUUID for actions performed by the system (e.g. the retention cleanup job).
+func AddAuditLog(projectUUID string, userUUID string, action string, details string, database *pgx.Conn) error {
+	auditLog := AuditLog{
+		UUID:         NewUUID(),
+		ProjectUUID:  projectUUID,
+		UserUUID:     userUUID,
+		Action:       action,
+		Details:      details,
+		CreationDate: int(time.Now().Unix()),
+	}
+
+	return auditLog.Save(database)
+}
+
+// GetAuditLogsByProject returns all audit logs of the project, oldest first.
+func GetAuditLogsByProject(projectUUID string, database *pgx.Conn) ([]AuditLog, error) {
+	preparedStatement := `
+	SELECT uuid, projectUUID, userUUID, action, details, creationDate FROM audit_log WHERE projectUUID = $1 ORDER BY creationDate ASC
+	`
+	rows, err := database.Query(context.Background(), preparedStatement, projectUUID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var auditLogs []AuditLog
+
+	for rows.Next() {
+		var auditLog AuditLog
+
+		err := rows.Scan(&auditLog.UUID, &auditLog.ProjectUUID, &auditLog.UserUUID, &auditLog.Action, &auditLog.Details, &auditLog.CreationDate)
+
+		if err != nil {
+			return nil, err
+		}
+
+		auditLogs = append(auditLogs, auditLog)
+	}
+
+	rows.Close()
+
+	return auditLogs, rows.Err()
+}
@@ -0,0 +1,638 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"time"
+)
+
+// Batch operation types.
+const (
+	BatchOperationTag          = "tag"
+	BatchOperationUntag        = "untag"
+	BatchOperationMoveToBinder = "move_to_binder"
+	BatchOperationReviewStatus = "review_status"
+)
+
+// BatchOperation represents a change to many messages at once, recorded so it can be undone (see UndoLastBatchOperation).
+type BatchOperation struct {
+	UUID        string `json:"uuid"`
+	ProjectUUID string `json:"project_uuid"`
+	UserUUID    string `json:"user_uuid"`
+	Type        string `json:"type"`
+	// Target is the tag or binder UUID or the review status of the operation.
+	Target string `json:"target"`
+	// Source is the binder the messages were moved from (BatchOperationMoveToBinder), empty if they were only added.
+	Source       string                `json:"source,omitempty"`
+	Changes      BatchOperationChanges `json:"changes"`
+	CreationDate int                   `json:"creation_date"`
+	UndoneDate   int                   `json:"undone_date,omitempty"` // Zero if the operation wasn't undone.
+}
+
+// BatchOperationChanges represents the messages changed by a batch operation.
+// Messages which already had the new state (e.g. the tag) aren't changed, so undo leaves them untouched.
+type BatchOperationChanges struct {
+	MessageUUIDs []string `json:"message_uuids"`
+	// PreviousStatuses are the review statuses before a BatchOperationReviewStatus, empty for messages without a review.
+	PreviousStatuses map[string]string `json:"previous_statuses,omitempty"`
+	// RemovedMessageUUIDs are the messages removed from the source binder by BatchOperationMoveToBinder.
+	RemovedMessageUUIDs []string `json:"removed_message_uuids,omitempty"`
+}
+
+// BatchSelection selects the messages of a batch operation: the message UUIDs or, if none are specified,
+// all messages matching the search query and filters (see GetMessagesFromFilteredQuery).
+type BatchSelection struct {
+	MessageUUIDs []string      `json:"message_uuids"`
+	Query        string        `json:"query"`
+	Filters      SearchFilters `json:"filters"`
+}
+
+// ErrNothingToUndo is returned by UndoLastBatchOperation if the last batch operation of the user was already undone.
+var ErrNothingToUndo = errors.New("no batch operation to undo")
+
+// Save saves the batch operation to the database.
+func (operation *BatchOperation) Save(database *pgx.Conn) error {
+	encodedChanges, err := json.Marshal(operation.Changes)
+
+	if err != nil {
+		return err
+	}
+
+	preparedStatement := `
+	INSERT INTO batch_operations(uuid, projectUUID, userUUID, type, target, source, changes, creationDate, undoneDate) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	ON CONFLICT(uuid) DO UPDATE SET undoneDate = $9
+	`
+	_, err = database.Exec(context.Background(), preparedStatement, operation.UUID, operation.ProjectUUID, operation.UserUUID, operation.Type, operation.Target, operation.Source, string(encodedChanges), operation.CreationDate, operation.UndoneDate)
+
+	return err
+}
+
+// newBatchOperation returns a batch operation of the user, saved once its changes are made.
+func newBatchOperation(operationType string, target string, projectUUID string, userUUID string) BatchOperation {
+	return BatchOperation{
+		UUID:         NewUUID(),
+		ProjectUUID:  projectUUID,
+		UserUUID:     userUUID,
+		Type:         operationType,
+		Target:       target,
+		CreationDate: int(time.Now().Unix()),
+	}
+}
+
+// getBatchSelectionUUIDs returns the UUIDs of the messages of the project in the selection.
+func getBatchSelectionUUIDs(selection BatchSelection, projectUUID string) ([]string, error) {
+	var messageUUIDs []string
+
+	collect := func(batchUUIDs []string) error {
+		messageUUIDs = append(messageUUIDs, batchUUIDs...)
+
+		return nil
+	}
+
+	if len(selection.MessageUUIDs) == 0 {
+		if err := forEachMessageUUIDBatch(selection.Filters.apply(newSearchQuery(selection.Query, projectUUID)), collect); err != nil {
+			return nil, err
+		}
+
+		return messageUUIDs, nil
+	}
+
+	// Only the messages of the project are selected.
+	err := forEachStringBatch(selection.MessageUUIDs, func(batchUUIDs []string) error {
+		return forEachMessageUUIDBatch(newMessageUUIDsQuery(batchUUIDs, projectUUID), collect)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return messageUUIDs, nil
+}
+
+// queryMessageUUIDSet returns the message UUIDs returned by the query.
+func queryMessageUUIDSet(preparedStatement string, database *pgx.Conn, arguments ...interface{}) (map[string]bool, error) {
+	rows, err := database.Query(context.Background(), preparedStatement, arguments...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	messageUUIDs := map[string]bool{}
+
+	for rows.Next() {
+		var messageUUID string
+
+		if err := rows.Scan(&messageUUID); err != nil {
+			return nil, err
+		}
+
+		messageUUIDs[messageUUID] = true
+	}
+
+	rows.Close()
+
+	return messageUUIDs, rows.Err()
+}
+
+// BatchTagMessages adds the tag to the selected messages.
+func BatchTagMessages(tagUUID string, selection BatchSelection, projectUUID string, userUUID string, database *pgx.Conn) (BatchOperation, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionReview, database); err != nil {
+		return BatchOperation{}, err
+	}
+
+	if _, err := GetTagByUUID(tagUUID, projectUUID, database); err != nil {
+		return BatchOperation{}, err
+	}
+
+	messageUUIDs, err := getBatchSelectionUUIDs(selection, projectUUID)
+
+	if err != nil {
+		return BatchOperation{}, err
+	}
+
+	operation := newBatchOperation(BatchOperationTag, tagUUID, projectUUID, userUUID)
+
+	err = forEachStringBatch(messageUUIDs, func(batchUUIDs []string) error {
+		preparedStatement := `
+		SELECT messageUUID FROM message_tags WHERE tagUUID = $1 AND projectUUID = $2 AND messageUUID = ANY($3)
+		`
+		tagged, err := queryMessageUUIDSet(preparedStatement, database, tagUUID, projectUUID, batchUUIDs)
+
+		if err != nil {
+			return err
+		}
+
+		var untagged []string
+
+		for _, messageUUID := range batchUUIDs {
+			if !tagged[messageUUID] {
+				untagged = append(untagged, messageUUID)
+			}
+		}
+
+		if err := tagMessages(tagUUID, untagged, projectUUID, database); err != nil {
+			return err
+		}
+
+		operation.Changes.MessageUUIDs = append(operation.Changes.MessageUUIDs, untagged...)
+
+		return nil
+	})
+
+	if err != nil {
+		return BatchOperation{}, err
+	}
+
+	return operation, operation.Save(database)
+}
+
+// BatchUntagMessages removes the tag from the selected messages.
+func BatchUntagMessages(tagUUID string, selection BatchSelection, projectUUID string, userUUID string, database *pgx.Conn) (BatchOperation, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionReview, database); err != nil {
+		return BatchOperation{}, err
+	}
+
+	messageUUIDs, err := getBatchSelectionUUIDs(selection, projectUUID)
+
+	if err != nil {
+		return BatchOperation{}, err
+	}
+
+	operation := newBatchOperation(BatchOperationUntag, tagUUID, projectUUID, userUUID)
+
+	err = forEachStringBatch(messageUUIDs, func(batchUUIDs []string) error {
+		preparedStatement := `
+		DELETE FROM message_tags WHERE tagUUID = $1 AND projectUUID = $2 AND messageUUID = ANY($3) RETURNING messageUUID
+		`
+		untagged, err := queryMessageUUIDSet(preparedStatement, database, tagUUID, projectUUID, batchUUIDs)
+
+		if err != nil {
+			return err
+		}
+
+		var untaggedUUIDs []string
+
+		for _, messageUUID := range batchUUIDs {
+			if untagged[messageUUID] {
+				untaggedUUIDs = append(untaggedUUIDs, messageUUID)
+			}
+		}
+
+		if len(untaggedUUIDs) == 0 {
+			return nil
+		}
+
+		if err := removeMessageFieldValue(newMessageUUIDsQuery(untaggedUUIDs, projectUUID), "tag_uuids", tagUUID); err != nil {
+			return err
+		}
+
+		operation.Changes.MessageUUIDs = append(operation.Changes.MessageUUIDs, untaggedUUIDs...)
+
+		return nil
+	})
+
+	if err != nil {
+		return BatchOperation{}, err
+	}
+
+	return operation, operation.Save(database)
+}
+
+// tagMessages adds the tag to the messages.
+func tagMessages(tagUUID string, messageUUIDs []string, projectUUID string, database *pgx.Conn) error {
+	if len(messageUUIDs) == 0 {
+		return nil
+	}
+
+	preparedStatement := `
+	INSERT INTO message_tags(messageUUID, tagUUID, projectUUID) VALUES ($1, $2, $3)
+	ON CONFLICT(messageUUID, tagUUID) DO NOTHING
+	`
+	batch := &pgx.Batch{}
+
+	for _, messageUUID := range messageUUIDs {
+		batch.Queue(preparedStatement, messageUUID, tagUUID, projectUUID)
+	}
+
+	if err := database.SendBatch(context.Background(), batch).Close(); err != nil {
+		return err
+	}
+
+	return addMessageFieldValue(newMessageUUIDsQuery(messageUUIDs, projectUUID), "tag_uuids", tagUUID)
+}
+
+// BatchMoveToBinder adds the selected messages to the end of the binder and, if a source binder is specified, removes them from the source binder.
+func BatchMoveToBinder(binderUUID string, sourceBinderUUID string, selection BatchSelection, projectUUID string, userUUID string, database *pgx.Conn) (BatchOperation, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionReview, database); err != nil {
+		return BatchOperation{}, err
+	}
+
+	if _, err := GetBinderByUUID(binderUUID, projectUUID, database); err != nil {
+		return BatchOperation{}, err
+	}
+
+	if sourceBinderUUID == binderUUID {
+		return BatchOperation{}, errors.New("source and target binder are the same")
+	}
+
+	messageUUIDs, err := getBatchSelectionUUIDs(selection, projectUUID)
+
+	if err != nil {
+		return BatchOperation{}, err
+	}
+
+	operation := newBatchOperation(BatchOperationMoveToBinder, binderUUID, projectUUID, userUUID)
+	operation.Source = sourceBinderUUID
+
+	err = forEachStringBatch(messageUUIDs, func(batchUUIDs []string) error {
+		preparedStatement := `
+		SELECT messageUUID FROM binder_messages WHERE binderUUID = $1 AND projectUUID = $2 AND messageUUID = ANY($3)
+		`
+		inBinder, err := queryMessageUUIDSet(preparedStatement, database, binderUUID, projectUUID, batchUUIDs)
+
+		if err != nil {
+			return err
+		}
+
+		var added []string
+
+		for _, messageUUID := range batchUUIDs {
+			if !inBinder[messageUUID] {
+				added = append(added, messageUUID)
+			}
+		}
+
+		if err := addMessagesToBinder(binderUUID, added, projectUUID, database); err != nil {
+			return err
+		}
+
+		operation.Changes.MessageUUIDs = append(operation.Changes.MessageUUIDs, added...)
+
+		if sourceBinderUUID == "" {
+			return nil
+		}
+
+		preparedStatement = `
+		DELETE FROM binder_messages WHERE binderUUID = $1 AND projectUUID = $2 AND messageUUID = ANY($3) RETURNING messageUUID
+		`
+		removedSet, err := queryMessageUUIDSet(preparedStatement, database, sourceBinderUUID, projectUUID, batchUUIDs)
+
+		if err != nil {
+			return err
+		}
+
+		var removed []string
+
+		for _, messageUUID := range batchUUIDs {
+			if removedSet[messageUUID] {
+				removed = append(removed, messageUUID)
+			}
+		}
+
+		if len(removed) == 0 {
+			return nil
+		}
+
+		if err := removeMessageFieldValue(newMessageUUIDsQuery(removed, projectUUID), "binder_uuids", sourceBinderUUID); err != nil {
+			return err
+		}
+
+		operation.Changes.RemovedMessageUUIDs = append(operation.Changes.RemovedMessageUUIDs, removed...)
+
+		return nil
+	})
+
+	if err != nil {
+		return BatchOperation{}, err
+	}
+
+	// The moved messages are in the target binder so they stay bookmarked.
+	return operation, operation.Save(database)
+}
+
+// BatchSetReviewStatus sets the review status of the selected messages, it doesn't assign the messages to the user (see AssignMessages).
+func BatchSetReviewStatus(status string, selection BatchSelection, projectUUID string, userUUID string, database *pgx.Conn) (BatchOperation, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionReview, database); err != nil {
+		return BatchOperation{}, err
+	}
+
+	if !IsValidReviewStatus(status) {
+		return BatchOperation{}, fmt.Errorf("invalid review status: %s", status)
+	}
+
+	messageUUIDs, err := getBatchSelectionUUIDs(selection, projectUUID)
+
+	if err != nil {
+		return BatchOperation{}, err
+	}
+
+	operation := newBatchOperation(BatchOperationReviewStatus, status, projectUUID, userUUID)
+	operation.Changes.PreviousStatuses = map[string]string{}
+
+	err = forEachStringBatch(messageUUIDs, func(batchUUIDs []string) error {
+		preparedStatement := `
+		SELECT messageUUID, status FROM message_review WHERE projectUUID = $1 AND messageUUID = ANY($2)
+		`
+		rows, err := database.Query(context.Background(), preparedStatement, projectUUID, batchUUIDs)
+
+		if err != nil {
+			return err
+		}
+
+		previousStatuses := map[string]string{}
+
+		for rows.Next() {
+			var messageUUID string
+			var previousStatus string
+
+			if err := rows.Scan(&messageUUID, &previousStatus); err != nil {
+				return err
+			}
+
+			previousStatuses[messageUUID] = previousStatus
+		}
+
+		rows.Close()
+
+		if rows.Err() != nil {
+			return rows.Err()
+		}
+
+		var changed []string
+
+		for _, messageUUID := range batchUUIDs {
+			previousStatus, ok := previousStatuses[messageUUID]
+
+			if ok && previousStatus == status {
+				continue
+			}
+
+			changed = append(changed, messageUUID)
+			operation.Changes.PreviousStatuses[messageUUID] = previousStatus
+		}
+
+		if len(changed) == 0 {
+			return nil
+		}
+
+		preparedStatement = `
+		INSERT INTO message_review(messageUUID, projectUUID, reviewerUUID, status, reviewedBy, reviewedDate) VALUES ($1, $2, '', $4, $3, $5)
+		ON CONFLICT(messageUUID) DO UPDATE SET status = $4, reviewedBy = $3, reviewedDate = $5 WHERE message_review.projectUUID = EXCLUDED.projectUUID
+		`
+		batch := &pgx.Batch{}
+		reviewedDate := time.Now().Unix()
+
+		for _, messageUUID := range changed {
+			batch.Queue(preparedStatement, messageUUID, projectUUID, userUUID, status, reviewedDate)
+		}
+
+		if err := database.SendBatch(context.Background(), batch).Close(); err != nil {
+			return err
+		}
+
+		if err := updateMessageFields(changed, projectUUID, map[string]interface{}{"review_status": status}); err != nil {
+			return err
+		}
+
+		operation.Changes.MessageUUIDs = append(operation.Changes.MessageUUIDs, changed...)
+
+		return nil
+	})
+
+	if err != nil {
+		return BatchOperation{}, err
+	}
+
+	return operation, operation.Save(database)
+}
+
+// GetBatchOperations returns the batch operations of the project, newest first.
+func GetBatchOperations(projectUUID string, userUUID string, database *pgx.Conn) ([]BatchOperation, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return nil, err
+	}
+
+	preparedStatement := `
+	SELECT uuid, projectUUID, userUUID, type, target, source, changes, creationDate, undoneDate FROM batch_operations WHERE projectUUID = $1 ORDER BY creationDate DESC
+	`
+	rows, err := database.Query(context.Background(), preparedStatement, projectUUID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var operations []BatchOperation
+
+	for rows.Next() {
+		operation, err := scanBatchOperation(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		operations = append(operations, operation)
+	}
+
+	rows.Close()
+
+	return operations, rows.Err()
+}
+
+// scanBatchOperation scans the batch operation row.
+func scanBatchOperation(row pgx.Row) (BatchOperation, error) {
+	var operation BatchOperation
+	var encodedChanges string
+
+	if err := row.Scan(&operation.UUID, &operation.ProjectUUID, &operation.UserUUID, &operation.Type, &operation.Target, &operation.Source, &encodedChanges, &operation.CreationDate, &operation.UndoneDate); err != nil {
+		return BatchOperation{}, err
+	}
+
+	if err := json.Unmarshal([]byte(encodedChanges), &operation.Changes); err != nil {
+		return BatchOperation{}, err
+	}
+
+	return operation, nil
+}
+
+// UndoLastBatchOperation reverts the changes of the last batch operation of the user in the project.
+// Only a single step can be undone: returns ErrNothingToUndo if the last operation was already undone.
+// Changes made to the same messages after the operation are overwritten.
+func UndoLastBatchOperation(projectUUID string, userUUID string, database *pgx.Conn) (BatchOperation, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionReview, database); err != nil {
+		return BatchOperation{}, err
+	}
+
+	preparedStatement := `
+	SELECT uuid, projectUUID, userUUID, type, target, source, changes, creationDate, undoneDate FROM batch_operations
+	WHERE projectUUID = $1 AND userUUID = $2 ORDER BY creationDate DESC LIMIT 1
+	`
+	operation, err := scanBatchOperation(database.QueryRow(context.Background(), preparedStatement, projectUUID, userUUID))
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return BatchOperation{}, ErrNothingToUndo
+	} else if err != nil {
+		return BatchOperation{}, err
+	}
+
+	if operation.UndoneDate > 0 {
+		return BatchOperation{}, ErrNothingToUndo
+	}
+
+	switch operation.Type {
+	case BatchOperationTag:
+		err = forEachStringBatch(operation.Changes.MessageUUIDs, func(batchUUIDs []string) error {
+			preparedStatement := `
+			DELETE FROM message_tags WHERE tagUUID = $1 AND projectUUID = $2 AND messageUUID = ANY($3)
+			`
+			if _, err := database.Exec(context.Background(), preparedStatement, operation.Target, projectUUID, batchUUIDs); err != nil {
+				return err
+			}
+
+			return removeMessageFieldValue(newMessageUUIDsQuery(batchUUIDs, projectUUID), "tag_uuids", operation.Target)
+		})
+	case BatchOperationUntag:
+		// The tag may have been deleted since.
+		if _, err := GetTagByUUID(operation.Target, projectUUID, database); err != nil {
+			return BatchOperation{}, err
+		}
+
+		err = forEachStringBatch(operation.Changes.MessageUUIDs, func(batchUUIDs []string) error {
+			return tagMessages(operation.Target, batchUUIDs, projectUUID, database)
+		})
+	case BatchOperationMoveToBinder:
+		err = undoBatchMoveToBinder(operation, database)
+	case BatchOperationReviewStatus:
+		err = undoBatchReviewStatus(operation, database)
+	default:
+		return BatchOperation{}, fmt.Errorf("unknown batch operation: %s", operation.Type)
+	}
+
+	if err != nil {
+		return BatchOperation{}, err
+	}
+
+	operation.UndoneDate = int(time.Now().Unix())
+
+	return operation, operation.Save(database)
+}
+
+// undoBatchMoveToBinder removes the added messages from the target binder and adds the removed messages back to the end of the source binder.
+func undoBatchMoveToBinder(operation BatchOperation, database *pgx.Conn) error {
+	if len(operation.Changes.RemovedMessageUUIDs) > 0 {
+		if _, err := GetBinderByUUID(operation.Source, operation.ProjectUUID, database); err != nil {
+			return err
+		}
+
+		err := forEachStringBatch(operation.Changes.RemovedMessageUUIDs, func(batchUUIDs []string) error {
+			return addMessagesToBinder(operation.Source, batchUUIDs, operation.ProjectUUID, database)
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return forEachStringBatch(operation.Changes.MessageUUIDs, func(batchUUIDs []string) error {
+		preparedStatement := `
+		DELETE FROM binder_messages WHERE binderUUID = $1 AND projectUUID = $2 AND messageUUID = ANY($3)
+		`
+		if _, err := database.Exec(context.Background(), preparedStatement, operation.Target, operation.ProjectUUID, batchUUIDs); err != nil {
+			return err
+		}
+
+		if err := removeMessageFieldValue(newMessageUUIDsQuery(batchUUIDs, operation.ProjectUUID), "binder_uuids", operation.Target); err != nil {
+			return err
+		}
+
+		return updateBookmarkFlags(batchUUIDs, operation.ProjectUUID, database)
+	})
+}
+
+// undoBatchReviewStatus restores the previous review statuses, messages which weren't reviewed lose their review.
+func undoBatchReviewStatus(operation BatchOperation, database *pgx.Conn) error {
+	messagesByStatus := map[string][]string{}
+
+	for _, messageUUID := range operation.Changes.MessageUUIDs {
+		previousStatus := operation.Changes.PreviousStatuses[messageUUID]
+
+		messagesByStatus[previousStatus] = append(messagesByStatus[previousStatus], messageUUID)
+	}
+
+	for previousStatus, messageUUIDs := range messagesByStatus {
+		previousStatus := previousStatus
+
+		err := forEachStringBatch(messageUUIDs, func(batchUUIDs []string) error {
+			if previousStatus == "" {
+				preparedStatement := `
+				DELETE FROM message_review WHERE projectUUID = $1 AND messageUUID = ANY($2)
+				`
+				if _, err := database.Exec(context.Background(), preparedStatement, operation.ProjectUUID, batchUUIDs); err != nil {
+					return err
+				}
+
+				return updateMessageFields(batchUUIDs, operation.ProjectUUID, map[string]interface{}{"review_status": nil})
+			}
+
+			preparedStatement := `
+			UPDATE message_review SET status = $1 WHERE projectUUID = $2 AND messageUUID = ANY($3)
+			`
+			if _, err := database.Exec(context.Background(), preparedStatement, previousStatus, operation.ProjectUUID, batchUUIDs); err != nil {
+				return err
+			}
+
+			return updateMessageFields(batchUUIDs, operation.ProjectUUID, map[string]interface{}{"review_status": previousStatus})
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,621 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"errors"
+	"github.com/aquasecurity/esquery"
+	"github.com/jackc/pgx/v4"
+	"strings"
+	"time"
+)
+
+// Binder represents a named collection of bookmarked messages (e.g. "Key exhibits" or "Follow up") in the order set by the examiner.
+// Messages can be in multiple binders, a message is bookmarked (see Message.IsBookmarked) while it is in any binder.
+type Binder struct {
+	UUID        string `json:"uuid"`
+	ProjectUUID string `json:"project_uuid"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// IsDefault is set for the binder of the messages bookmarked with AddBookmark, see DefaultBinderName.
+	IsDefault    bool `json:"is_default"`
+	MessageCount int  `json:"message_count"`
+	CreationDate int  `json:"creation_date"`
+}
+
+// DefaultBinderName defines the name of the default binder of a project.
+const DefaultBinderName = "Bookmarks"
+
+// Binder errors.
+var (
+	ErrMessageNotInBinder = errors.New("message is not in the binder")
+	ErrDefaultBinder      = errors.New("the default binder can't be deleted")
+)
+
+// Save saves the binder to the database.
+func (binder *Binder) Save(database *pgx.Conn) error {
+	preparedStatement := `
+	INSERT INTO binders(uuid, projectUUID, name, description, isDefault, creationDate) VALUES ($1, $2, $3, $4, $5, $6)
+	ON CONFLICT(uuid) DO UPDATE SET name = $3, description = $4
+	`
+	_, err := database.Exec(context.Background(), preparedStatement, binder.UUID, binder.ProjectUUID, binder.Name, binder.Description, binder.IsDefault, binder.CreationDate)
+
+	return err
+}
+
+// CreateBinder creates a new binder in the project.
+func CreateBinder(name string, description string, projectUUID string, userUUID string, database *pgx.Conn) (Binder, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionReview, database); err != nil {
+		return Binder{}, err
+	}
+
+	name = strings.TrimSpace(name)
+
+	if name == "" {
+		return Binder{}, errors.New("binder name is empty")
+	}
+
+	binder := Binder{
+		UUID:         NewUUID(),
+		ProjectUUID:  projectUUID,
+		Name:         name,
+		Description:  description,
+		CreationDate: int(time.Now().Unix()),
+	}
+
+	if err := binder.Save(database); err != nil {
+		return Binder{}, err
+	}
+
+	return binder, nil
+}
+
+// UpdateBinder updates the name and description of the binder.
+func UpdateBinder(binder Binder, userUUID string, database *pgx.Conn) error {
+	if err := CheckPermission(userUUID, binder.ProjectUUID, ActionReview, database); err != nil {
+		return err
+	}
+
+	binder.Name = strings.TrimSpace(binder.Name)
+
+	if binder.Name == "" {
+		return errors.New("binder name is empty")
+	}
+
+	if _, err := GetBinderByUUID(binder.UUID, binder.ProjectUUID, database); err != nil {
+		return err
+	}
+
+	return binder.Save(database)
+}
+
+// DeleteBinder removes the binder and its messages from it, the default binder can't be deleted (ErrDefaultBinder).
+// Messages which aren't in any other binder are no longer bookmarked.
+func DeleteBinder(binderUUID string, projectUUID string, userUUID string, database *pgx.Conn) error {
+	if err := CheckPermission(userUUID, projectUUID, ActionReview, database); err != nil {
+		return err
+	}
+
+	if err := checkProjectNotOnHold(projectUUID, userUUID, AuditActionDeleteBinder, database); err != nil {
+		return err
+	}
+
+	binder, err := GetBinderByUUID(binderUUID, projectUUID, database)
+
+	if err != nil {
+		return err
+	}
+
+	if binder.IsDefault {
+		return ErrDefaultBinder
+	}
+
+	messageUUIDs, err := getBinderMessageUUIDs(binderUUID, projectUUID, database)
+
+	if err != nil {
+		return err
+	}
+
+	preparedStatements := []string{
+		"DELETE FROM binder_messages WHERE binderUUID = $1 AND projectUUID = $2",
+		"DELETE FROM binders WHERE uuid = $1 AND projectUUID = $2",
+	}
+
+	for _, preparedStatement := range preparedStatements {
+		if _, err := database.Exec(context.Background(), preparedStatement, binderUUID, projectUUID); err != nil {
+			return err
+		}
+	}
+
+	binderMessagesQuery := esquery.
+		Bool().
+		Must(esquery.Term("project_uuid", projectUUID)).
+		Must(esquery.Term("binder_uuids", binderUUID))
+
+	if err := removeMessageFieldValue(binderMessagesQuery, "binder_uuids", binderUUID); err != nil {
+		return err
+	}
+
+	return updateBookmarkFlags(messageUUIDs, projectUUID, database)
+}
+
+// GetBinderByUUID returns the binder with the specified UUID.
+func GetBinderByUUID(binderUUID string, projectUUID string, database *pgx.Conn) (Binder, error) {
+	preparedStatement := `
+	SELECT b.uuid, b.projectUUID, b.name, b.description, b.isDefault, b.creationDate,
+		(SELECT COUNT(*) FROM binder_messages bm WHERE bm.binderUUID = b.uuid)
+	FROM binders b WHERE b.uuid = $1 AND b.projectUUID = $2
+	`
+	binders, err := queryBinders(preparedStatement, database, binderUUID, projectUUID)
+
+	if err != nil {
+		return Binder{}, err
+	}
+
+	if len(binders) == 0 {
+		return Binder{}, pgx.ErrNoRows
+	}
+
+	return binders[0], nil
+}
+
+// GetBindersByProject returns the binders of the project, the default binder first and the others by name.
+func GetBindersByProject(projectUUID string, userUUID string, database *pgx.Conn) ([]Binder, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return nil, err
+	}
+
+	if _, err := getDefaultBinder(projectUUID, database); err != nil {
+		return nil, err
+	}
+
+	preparedStatement := `
+	SELECT b.uuid, b.projectUUID, b.name, b.description, b.isDefault, b.creationDate,
+		(SELECT COUNT(*) FROM binder_messages bm WHERE bm.binderUUID = b.uuid)
+	FROM binders b WHERE b.projectUUID = $1
+	ORDER BY b.isDefault DESC, LOWER(b.name)
+	`
+
+	return queryBinders(preparedStatement, database, projectUUID)
+}
+
+// GetMessageBinders returns the binders the message is in, by name.
+func GetMessageBinders(messageUUID string, projectUUID string, database *pgx.Conn) ([]Binder, error) {
+	preparedStatement := `
+	SELECT b.uuid, b.projectUUID, b.name, b.description, b.isDefault, b.creationDate,
+		(SELECT COUNT(*) FROM binder_messages bm WHERE bm.binderUUID = b.uuid)
+	FROM binders b
+	INNER JOIN binder_messages mb ON mb.binderUUID = b.uuid
+	WHERE mb.messageUUID = $1 AND mb.projectUUID = $2
+	ORDER BY LOWER(b.name)
+	`
+
+	return queryBinders(preparedStatement, database, messageUUID, projectUUID)
+}
+
+// queryBinders returns the binders from the query.
+func queryBinders(preparedStatement string, database *pgx.Conn, arguments ...interface{}) ([]Binder, error) {
+	rows, err := database.Query(context.Background(), preparedStatement, arguments...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var binders []Binder
+
+	for rows.Next() {
+		var binder Binder
+
+		if err := rows.Scan(&binder.UUID, &binder.ProjectUUID, &binder.Name, &binder.Description, &binder.IsDefault, &binder.CreationDate, &binder.MessageCount); err != nil {
+			return nil, err
+		}
+
+		binders = append(binders, binder)
+	}
+
+	rows.Close()
+
+	return binders, rows.Err()
+}
+
+// getDefaultBinder returns the default binder of the project, see DefaultBinderName.
+// The default binder is created on first use with the messages bookmarked before binders existed.
+func getDefaultBinder(projectUUID string, database *pgx.Conn) (Binder, error) {
+	preparedStatement := `
+	SELECT b.uuid, b.projectUUID, b.name, b.description, b.isDefault, b.creationDate,
+		(SELECT COUNT(*) FROM binder_messages bm WHERE bm.binderUUID = b.uuid)
+	FROM binders b WHERE b.projectUUID = $1 AND b.isDefault
+	`
+	binders, err := queryBinders(preparedStatement, database, projectUUID)
+
+	if err != nil {
+		return Binder{}, err
+	}
+
+	if len(binders) > 0 {
+		return binders[0], nil
+	}
+
+	binder := Binder{
+		UUID:         NewUUID(),
+		ProjectUUID:  projectUUID,
+		Name:         DefaultBinderName,
+		IsDefault:    true,
+		CreationDate: int(time.Now().Unix()),
+	}
+
+	if err := binder.Save(database); err != nil {
+		return Binder{}, err
+	}
+
+	preparedStatement = `
+	SELECT messageUUID FROM message_metadata WHERE projectUUID = $1 AND isBookmarked ORDER BY messageUUID
+	`
+	rows, err := database.Query(context.Background(), preparedStatement, projectUUID)
+
+	if err != nil {
+		return Binder{}, err
+	}
+
+	var bookmarkedMessageUUIDs []string
+
+	for rows.Next() {
+		var messageUUID string
+
+		if err := rows.Scan(&messageUUID); err != nil {
+			return Binder{}, err
+		}
+
+		bookmarkedMessageUUIDs = append(bookmarkedMessageUUIDs, messageUUID)
+	}
+
+	rows.Close()
+
+	if rows.Err() != nil {
+		return Binder{}, rows.Err()
+	}
+
+	if err := addMessagesToBinder(binder.UUID, bookmarkedMessageUUIDs, projectUUID, database); err != nil {
+		return Binder{}, err
+	}
+
+	binder.MessageCount = len(bookmarkedMessageUUIDs)
+
+	return binder, nil
+}
+
+// AddMessagesToBinder adds the messages to the end of the binder and bookmarks them.
+// Messages already in the binder keep their position.
+func AddMessagesToBinder(binderUUID string, messageUUIDs []string, projectUUID string, userUUID string, database *pgx.Conn) error {
+	if err := CheckPermission(userUUID, projectUUID, ActionReview, database); err != nil {
+		return err
+	}
+
+	if _, err := GetBinderByUUID(binderUUID, projectUUID, database); err != nil {
+		return err
+	}
+
+	return addMessagesToBinder(binderUUID, messageUUIDs, projectUUID, database)
+}
+
+// addMessagesToBinder adds the messages to the end of the binder and bookmarks them.
+func addMessagesToBinder(binderUUID string, messageUUIDs []string, projectUUID string, database *pgx.Conn) error {
+	if len(messageUUIDs) == 0 {
+		return nil
+	}
+
+	if err := updateMessagesMapping(); err != nil {
+		return err
+	}
+
+	preparedStatement := `
+	SELECT COALESCE(MAX(position), -1) FROM binder_messages WHERE binderUUID = $1
+	`
+	var lastPosition int
+
+	if err := database.QueryRow(context.Background(), preparedStatement, binderUUID).Scan(&lastPosition); err != nil {
+		return err
+	}
+
+	preparedStatement = `
+	INSERT INTO binder_messages(binderUUID, messageUUID, projectUUID, position) VALUES ($1, $2, $3, $4)
+	ON CONFLICT(binderUUID, messageUUID) DO NOTHING
+	`
+	batch := &pgx.Batch{}
+
+	for i, messageUUID := range messageUUIDs {
+		batch.Queue(preparedStatement, binderUUID, messageUUID, projectUUID, lastPosition+i+1)
+	}
+
+	if err := database.SendBatch(context.Background(), batch).Close(); err != nil {
+		return err
+	}
+
+	if err := addMessageFieldValue(newMessageUUIDsQuery(messageUUIDs, projectUUID), "binder_uuids", binderUUID); err != nil {
+		return err
+	}
+
+	return setMessagesBookmarked(messageUUIDs, true, projectUUID, database)
+}
+
+// RemoveMessagesFromBinder removes the messages from the binder.
+// Messages which aren't in any other binder are no longer bookmarked.
+func RemoveMessagesFromBinder(binderUUID string, messageUUIDs []string, projectUUID string, userUUID string, database *pgx.Conn) error {
+	if err := CheckPermission(userUUID, projectUUID, ActionReview, database); err != nil {
+		return err
+	}
+
+	if err := checkProjectNotOnHold(projectUUID, userUUID, AuditActionRemoveBinderMessages, database); err != nil {
+		return err
+	}
+
+	if len(messageUUIDs) == 0 {
+		return nil
+	}
+
+	preparedStatement := `
+	DELETE FROM binder_messages WHERE binderUUID = $1 AND projectUUID = $2 AND messageUUID = ANY($3)
+	`
+	if _, err := database.Exec(context.Background(), preparedStatement, binderUUID, projectUUID, messageUUIDs); err != nil {
+		return err
+	}
+
+	if err := removeMessageFieldValue(newMessageUUIDsQuery(messageUUIDs, projectUUID), "binder_uuids", binderUUID); err != nil {
+		return err
+	}
+
+	return updateBookmarkFlags(messageUUIDs, projectUUID, database)
+}
+
+// MoveBinderMessage moves the message to the position (zero based) in the binder, the other messages keep their order.
+// Positions beyond the end of the binder move the message to the end.
+func MoveBinderMessage(binderUUID string, messageUUID string, position int, projectUUID string, userUUID string, database *pgx.Conn) error {
+	if err := CheckPermission(userUUID, projectUUID, ActionReview, database); err != nil {
+		return err
+	}
+
+	messageUUIDs, err := getBinderMessageUUIDs(binderUUID, projectUUID, database)
+
+	if err != nil {
+		return err
+	}
+
+	currentPosition := -1
+
+	for i, binderMessageUUID := range messageUUIDs {
+		if binderMessageUUID == messageUUID {
+			currentPosition = i
+			break
+		}
+	}
+
+	if currentPosition == -1 {
+		return ErrMessageNotInBinder
+	}
+
+	if position < 0 {
+		position = 0
+	} else if position >= len(messageUUIDs) {
+		position = len(messageUUIDs) - 1
+	}
+
+	messageUUIDs = append(messageUUIDs[:currentPosition], messageUUIDs[currentPosition+1:]...)
+	messageUUIDs = append(messageUUIDs[:position], append([]string{messageUUID}, messageUUIDs[position:]...)...)
+
+	preparedStatement := `
+	UPDATE binder_messages SET position = $1 WHERE binderUUID = $2 AND messageUUID = $3
+	`
+	batch := &pgx.Batch{}
+
+	for i, binderMessageUUID := range messageUUIDs {
+		batch.Queue(preparedStatement, i, binderUUID, binderMessageUUID)
+	}
+
+	return database.SendBatch(context.Background(), batch).Close()
+}
+
+// GetBinderMessages returns the messages of the binder in their order.
+func GetBinderMessages(binderUUID string, projectUUID string, userUUID string, database *pgx.Conn) ([]Message, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return nil, err
+	}
+
+	return getBinderMessages(binderUUID, projectUUID, database)
+}
+
+// getBinderMessages returns the messages of the binder in their order.
+func getBinderMessages(binderUUID string, projectUUID string, database *pgx.Conn) ([]Message, error) {
+	messageUUIDs, err := getBinderMessageUUIDs(binderUUID, projectUUID, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return getMessagesByUUIDs(messageUUIDs, projectUUID, database)
+}
+
+// getBinderMessageUUIDs returns the UUIDs of the messages of the binder in their order.
+func getBinderMessageUUIDs(binderUUID string, projectUUID string, database *pgx.Conn) ([]string, error) {
+	preparedStatement := `
+	SELECT messageUUID FROM binder_messages WHERE binderUUID = $1 AND projectUUID = $2 ORDER BY position, messageUUID
+	`
+	rows, err := database.Query(context.Background(), preparedStatement, binderUUID, projectUUID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var messageUUIDs []string
+
+	for rows.Next() {
+		var messageUUID string
+
+		if err := rows.Scan(&messageUUID); err != nil {
+			return nil, err
+		}
+
+		messageUUIDs = append(messageUUIDs, messageUUID)
+	}
+
+	rows.Close()
+
+	return messageUUIDs, rows.Err()
+}
+
+// updateBookmarkFlags bookmarks the messages which are in any binder and removes the bookmark of the others.
+func updateBookmarkFlags(messageUUIDs []string, projectUUID string, database *pgx.Conn) error {
+	if len(messageUUIDs) == 0 {
+		return nil
+	}
+
+	preparedStatement := `
+	SELECT DISTINCT messageUUID FROM binder_messages WHERE projectUUID = $1 AND messageUUID = ANY($2)
+	`
+	rows, err := database.Query(context.Background(), preparedStatement, projectUUID, messageUUIDs)
+
+	if err != nil {
+		return err
+	}
+
+	inBinder := map[string]bool{}
+
+	for rows.Next() {
+		var messageUUID string
+
+		if err := rows.Scan(&messageUUID); err != nil {
+			return err
+		}
+
+		inBinder[messageUUID] = true
+	}
+
+	rows.Close()
+
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+
+	var notBookmarked []string
+
+	for _, messageUUID := range messageUUIDs {
+		if !inBinder[messageUUID] {
+			notBookmarked = append(notBookmarked, messageUUID)
+		}
+	}
+
+	return setMessagesBookmarked(notBookmarked, false, projectUUID, database)
+}
+
+// setMessagesBookmarked sets the bookmark flag of the messages in the message metadata and Elasticsearch.
+func setMessagesBookmarked(messageUUIDs []string, isBookmarked bool, projectUUID string, database *pgx.Conn) error {
+	if len(messageUUIDs) == 0 {
+		return nil
+	}
+
+	preparedStatement := `
+	INSERT INTO message_metadata(messageUUID, projectUUID, isBookmarked, tag) VALUES ($1, $2, $3, $4)
+	ON CONFLICT(messageUUID) DO UPDATE SET isBookmarked = $3 WHERE message_metadata.projectUUID = EXCLUDED.projectUUID
+	`
+	batch := &pgx.Batch{}
+
+	for _, messageUUID := range messageUUIDs {
+		batch.Queue(preparedStatement, messageUUID, projectUUID, isBookmarked, "")
+	}
+
+	if err := database.SendBatch(context.Background(), batch).Close(); err != nil {
+		return err
+	}
+
+	return updateMessageFields(messageUUIDs, projectUUID, map[string]interface{}{
+		"is_bookmarked": isBookmarked,
+	})
+}
+
+// CreateBinderReport creates a report of the messages of the binder in their order, the binder is available as .binder in the template.
+// The branding of the project is used if the options have no branding, see SetProjectReportBranding.
+// Returns the path to the created report ZIP file (stored in MinIO).
+func CreateBinderReport(binderUUID string, options ReportOptions, projectUUID string, userUUID string, database *pgx.Conn) (string, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionExport, database); err != nil {
+		return "", err
+	}
+
+	project, err := GetProjectByUUID(projectUUID, database)
+
+	if err != nil {
+		return "", err
+	}
+
+	binder, err := GetBinderByUUID(binderUUID, projectUUID, database)
+
+	if err != nil {
+		return "", err
+	}
+
+	if options.Branding == (ReportBranding{}) {
+		if options.Branding, err = getProjectReportBranding(projectUUID, database); err != nil {
+			return "", err
+		}
+	}
+
+	location, err := getProjectLocation(projectUUID, database)
+
+	if err != nil {
+		return "", err
+	}
+
+	options.Functions = withDisplayDateFunction(options.Functions, location)
+
+	messages, err := getBinderMessages(binderUUID, projectUUID, database)
+
+	if err != nil {
+		return "", err
+	}
+
+	if options.Pseudonymizer != nil {
+		messages, err = pseudonymizeMessages(messages, options.Pseudonymizer)
+
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if options.Template == "" {
+		options.Template = reportTemplate
+	}
+
+	return createHTMLReport(messages, project, map[string]interface{}{
+		"binder": binder,
+	}, options)
+}
+
+// BinderReportJobParameters represents the parameters of the JobTypeBinderReport job.
+type BinderReportJobParameters struct {
+	BinderUUID   string        `json:"binder_uuid"`
+	Options      ReportOptions `json:"options"`
+	Pseudonymize bool          `json:"pseudonymize"`
+}
+
+// runBinderReportJob runs CreateBinderReport.
+func runBinderReportJob(ctx context.Context, job Job, reportProgress func(progress int), database *pgx.Conn) (string, error) {
+	var parameters BinderReportJobParameters
+
+	if err := decodeJobParameters(job, &parameters); err != nil {
+		return "", err
+	}
+
+	if parameters.Pseudonymize {
+		pseudonymizer, err := NewPseudonymizer(job.ProjectUUID, database)
+
+		if err != nil {
+			return "", err
+		}
+
+		parameters.Options.Pseudonymizer = pseudonymizer
+	}
+
+	parameters.Options.Progress = reportProgress
+
+	return CreateBinderReport(parameters.BinderUUID, parameters.Options, job.ProjectUUID, job.UserUUID, database)
+}
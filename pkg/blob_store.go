@@ -0,0 +1,137 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BlobStore stores the objects (evidence, attachments, bodies and job results) instead of MinIO, see Config.Lightweight.
+// Object names are the MinIO object names, e.g. "<project UUID>/<file name>" or the hash of the evidence.
+type BlobStore interface {
+	PutObject(objectName string, reader io.Reader) error
+	GetObject(objectName string) (io.ReadCloser, error)
+	RemoveObject(objectName string) error
+	RemoveObjectsByPrefix(prefix string) error
+}
+
+// ObjectStore stores the objects instead of MinIO if set, see Config.Lightweight.
+//
+// Deprecated: use Core.BlobStore.
+var ObjectStore BlobStore
+
+// fileBlobStore stores the objects as files in a directory.
+type fileBlobStore struct {
+	directory string
+}
+
+// NewFileBlobStore creates a blob store of the directory, the directory is created if it doesn't exist.
+func NewFileBlobStore(directory string) (BlobStore, error) {
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, err
+	}
+
+	return &fileBlobStore{directory: filepath.Clean(directory)}, nil
+}
+
+// getObjectPath returns the file path of the object, object names can't leave the directory.
+func (store *fileBlobStore) getObjectPath(objectName string) (string, error) {
+	objectPath := filepath.Join(store.directory, filepath.FromSlash(objectName))
+
+	if objectPath == store.directory || !strings.HasPrefix(objectPath, store.directory+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid object name: %s", objectName)
+	}
+
+	return objectPath, nil
+}
+
+// PutObject writes the object file, an existing object is replaced.
+func (store *fileBlobStore) PutObject(objectName string, reader io.Reader) error {
+	objectPath, err := store.getObjectPath(objectName)
+
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(objectPath), 0755); err != nil {
+		return err
+	}
+
+	// Written to a temporary file first so readers never see a partial object.
+	objectFile, err := os.CreateTemp(filepath.Dir(objectPath), ".upload-*")
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(objectFile, reader); err != nil {
+		_ = objectFile.Close()
+		_ = os.Remove(objectFile.Name())
+
+		return err
+	}
+
+	if err := objectFile.Close(); err != nil {
+		_ = os.Remove(objectFile.Name())
+
+		return err
+	}
+
+	return os.Rename(objectFile.Name(), objectPath)
+}
+
+// GetObject opens the object file, the caller must close it.
+func (store *fileBlobStore) GetObject(objectName string) (io.ReadCloser, error) {
+	objectPath, err := store.getObjectPath(objectName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Open(objectPath)
+}
+
+// RemoveObject removes the object file, removing an object which doesn't exist isn't an error (like MinIO).
+func (store *fileBlobStore) RemoveObject(objectName string) error {
+	objectPath, err := store.getObjectPath(objectName)
+
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(objectPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// RemoveObjectsByPrefix removes all object files of which the name starts with the prefix.
+func (store *fileBlobStore) RemoveObjectsByPrefix(prefix string) error {
+	return filepath.WalkDir(store.directory, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() {
+			return nil
+		}
+
+		relativePath, err := filepath.Rel(store.directory, path)
+
+		if err != nil {
+			return err
+		}
+
+		if !strings.HasPrefix(filepath.ToSlash(relativePath), prefix) {
+			return nil
+		}
+
+		return os.Remove(path)
+	})
+}
@@ -0,0 +1,170 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/lifecycle"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MinIOBucketPerProject defines if new projects get their own MinIO bucket instead of a prefix in the shared bucket.
+// Projects created before it was enabled keep using the shared bucket, it must not be disabled once projects have their own bucket.
+//
+// Deprecated: use Core.Config.MinIOBucketPerProject.
+var MinIOBucketPerProject bool
+
+// projectBucketIncompleteUploadDays defines the days after which the lifecycle of project buckets aborts incomplete multipart uploads,
+// e.g. of streamed exports interrupted by a crash.
+const projectBucketIncompleteUploadDays = 1
+
+// projectBucketCache holds the bucket name per project UUID, so the database isn't queried for each object.
+var projectBucketCache sync.Map
+
+// getProjectBucketName returns the name of the own bucket of the project, "<minio_bucket>-<projectUUID>".
+func getProjectBucketName(projectUUID string) string {
+	return fmt.Sprintf("%s-%s", MinIOBucketName, strings.ToLower(projectUUID))
+}
+
+// createProjectBucket creates the own bucket of the new project, including its lifecycle configuration.
+// The objects of the project keep their "<projectUUID>/" prefix so the MinIO paths are the same as in the shared bucket.
+func createProjectBucket(projectUUID string, database *pgx.Conn) error {
+	bucketName := getProjectBucketName(projectUUID)
+
+	// Bucket names are limited to 63 characters.
+	if len(bucketName) > 63 {
+		return fmt.Errorf("project bucket name too long: %s", bucketName)
+	}
+
+	err := retry(context.Background(), ExternalServiceRetryOptions, func() error {
+		err := MinIOClient.MakeBucket(context.Background(), bucketName, minio.MakeBucketOptions{})
+
+		// A previous attempt may have created the bucket.
+		if minio.ToErrorResponse(err).Code == "BucketAlreadyOwnedByYou" {
+			return nil
+		}
+
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	lifecycleConfiguration := lifecycle.NewConfiguration()
+	lifecycleConfiguration.Rules = []lifecycle.Rule{
+		{
+			ID:     "abort-incomplete-uploads",
+			Status: "Enabled",
+			AbortIncompleteMultipartUpload: lifecycle.AbortIncompleteMultipartUpload{
+				DaysAfterInitiation: projectBucketIncompleteUploadDays,
+			},
+		},
+	}
+
+	err = retry(context.Background(), ExternalServiceRetryOptions, func() error {
+		return MinIOClient.SetBucketLifecycle(context.Background(), bucketName, lifecycleConfiguration)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	preparedStatement := `
+	INSERT INTO project_buckets(projectUUID, bucket, creationDate) VALUES ($1, $2, $3)
+	`
+	if _, err := database.Exec(context.Background(), preparedStatement, projectUUID, bucketName, time.Now().Unix()); err != nil {
+		return err
+	}
+
+	projectBucketCache.Store(projectUUID, bucketName)
+
+	return nil
+}
+
+// getProjectBucket returns the bucket of the project, the shared bucket if the project has no own bucket.
+func getProjectBucket(projectUUID string, database *pgx.Conn) (string, error) {
+	if cachedBucket, ok := projectBucketCache.Load(projectUUID); ok {
+		return cachedBucket.(string), nil
+	}
+
+	preparedStatement := `
+	SELECT bucket FROM project_buckets WHERE projectUUID = $1
+	`
+	var bucketName string
+
+	err := database.QueryRow(context.Background(), preparedStatement, projectUUID).Scan(&bucketName)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		bucketName = MinIOBucketName
+	} else if err != nil {
+		return "", err
+	}
+
+	projectBucketCache.Store(projectUUID, bucketName)
+
+	return bucketName, nil
+}
+
+// getObjectBucket returns the bucket of the MinIO object (or prefix).
+// Objects in a project prefix are stored in the bucket of the project, evidence files (stored by their hash) in the shared bucket.
+// A database connection is only opened if the bucket of the project isn't cached, since the MinIO helpers don't take one.
+func getObjectBucket(objectName string) (string, error) {
+	if !MinIOBucketPerProject {
+		return MinIOBucketName, nil
+	}
+
+	projectUUID, _, hasPrefix := strings.Cut(objectName, "/")
+
+	if !hasPrefix {
+		return MinIOBucketName, nil
+	}
+
+	if cachedBucket, ok := projectBucketCache.Load(projectUUID); ok {
+		return cachedBucket.(string), nil
+	}
+
+	database, err := NewDatabase()
+
+	if err != nil {
+		return "", err
+	}
+
+	defer func() {
+		if err := database.Close(context.Background()); err != nil {
+			Logger.Errorf("Failed to close database: %s", err)
+		}
+	}()
+
+	return getProjectBucket(projectUUID, database)
+}
+
+// removeProjectBucket removes the own bucket of the project (if any), the objects of the project must be removed first.
+func removeProjectBucket(projectUUID string, database *pgx.Conn) error {
+	bucketName, err := getProjectBucket(projectUUID, database)
+
+	if err != nil {
+		return err
+	}
+
+	projectBucketCache.Delete(projectUUID)
+
+	if bucketName == MinIOBucketName {
+		return nil
+	}
+
+	err = MinIOClient.RemoveBucket(context.Background(), bucketName)
+
+	if minio.ToErrorResponse(err).Code == "NoSuchBucket" {
+		return nil
+	}
+
+	return err
+}
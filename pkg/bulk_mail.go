@@ -0,0 +1,176 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"github.com/aquasecurity/esquery"
+	"github.com/jackc/pgx/v4"
+	"strings"
+)
+
+// BulkMailThreshold defines the bulk score (0 to 100) from which a message is flagged as bulk mail.
+const BulkMailThreshold = 50
+
+// BulkMailDomains defines the sender domains of newsletter and mailing services, subdomains match as well.
+// Add the domains of known newsletters of a case before parsing, or run FlagProjectBulkMail afterwards.
+var BulkMailDomains = []string{
+	"mailchimp.com", "mcsv.net", "mcdlv.net", "rsgsv.net", "list-manage.com", "sendgrid.net", "sendgrid.com",
+	"amazonses.com", "constantcontact.com", "mailgun.org", "mailgun.net", "mandrillapp.com", "sparkpostmail.com",
+	"exacttarget.com", "mktomail.com", "hubspotemail.net", "hs-email.net", "cmail19.com", "cmail20.com", "createsend.com",
+	"emarsys.net", "mailjet.com", "sendinblue.com", "bounces.google.com", "facebookmail.com", "linkedin.com", "twitter.com",
+}
+
+// bulkMailSenderPrefixes defines the local parts of the addresses of automated senders.
+var bulkMailSenderPrefixes = []string{"noreply", "no-reply", "no_reply", "donotreply", "do-not-reply", "newsletter", "news", "mailer-daemon", "postmaster", "notifications", "notification", "marketing", "info", "bounce"}
+
+// Bulk score of each heuristic, the scores are added up to at most 100.
+const (
+	bulkScoreListUnsubscribe = 50
+	bulkScorePrecedence      = 50
+	bulkScoreSpamFlag        = 60
+	bulkScoreListID          = 30
+	bulkScoreAutoSubmitted   = 40
+	bulkScoreFeedbackID      = 20
+	bulkScoreSenderDomain    = 40
+	bulkScoreSenderPrefix    = 30
+)
+
+// getBulkMailScore returns the likelihood (0 to 100) that the message is bulk or automated mail,
+// based on the mailing list headers, the Precedence and Auto-Submitted headers and the sender address.
+func getBulkMailScore(message Message) int {
+	var score int
+
+	headers := message.Headers
+
+	if headers == messageNullValue {
+		headers = ""
+	}
+
+	if getHeaderValue(headers, "List-Unsubscribe") != "" {
+		score += bulkScoreListUnsubscribe
+	}
+
+	if getHeaderValue(headers, "List-Id") != "" {
+		score += bulkScoreListID
+	}
+
+	switch strings.ToLower(getHeaderValue(headers, "Precedence")) {
+	case "bulk", "list", "junk":
+		score += bulkScorePrecedence
+	}
+
+	if autoSubmitted := strings.ToLower(getHeaderValue(headers, "Auto-Submitted")); autoSubmitted != "" && autoSubmitted != "no" {
+		score += bulkScoreAutoSubmitted
+	}
+
+	if getHeaderValue(headers, "Feedback-ID") != "" || getHeaderValue(headers, "X-Campaign") != "" || getHeaderValue(headers, "X-MC-User") != "" {
+		score += bulkScoreFeedbackID
+	}
+
+	if strings.EqualFold(getHeaderValue(headers, "X-Spam-Flag"), "yes") {
+		score += bulkScoreSpamFlag
+	}
+
+	for _, address := range normalizeAddresses(getAddressesFromHeader(message.From)) {
+		if isDomainInList(getAddressDomain(address), BulkMailDomains) {
+			score += bulkScoreSenderDomain
+		}
+
+		localPart := strings.SplitN(address, "@", 2)[0]
+
+		for _, prefix := range bulkMailSenderPrefixes {
+			if localPart == prefix || strings.HasPrefix(localPart, prefix+"+") || strings.HasPrefix(localPart, prefix+".") {
+				score += bulkScoreSenderPrefix
+				break
+			}
+		}
+
+		// Only the first sender is scored.
+		break
+	}
+
+	if score > 100 {
+		score = 100
+	}
+
+	return score
+}
+
+// setBulkMailFlags sets the bulk score and flag of the message.
+func setBulkMailFlags(message *Message) {
+	message.BulkScore = getBulkMailScore(*message)
+	message.IsBulk = message.BulkScore >= BulkMailThreshold
+}
+
+// FlagProjectBulkMail scores and flags the bulk mail of the messages of the project which were indexed before bulk mail was flagged.
+// Use rescore after changing the BulkMailDomains. Returns the amount of messages flagged as bulk mail.
+func FlagProjectBulkMail(projectUUID string, rescore bool, userUUID string, database *pgx.Conn) (int, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionManageProject, database); err != nil {
+		return 0, err
+	}
+
+	if err := updateMessagesMapping(); err != nil {
+		return 0, err
+	}
+
+	query := esquery.Bool().Filter(esquery.Term("project_uuid", projectUUID))
+
+	if !rescore {
+		query = query.MustNot(esquery.Exists("bulk_score"))
+	}
+
+	var flagged int
+
+	err := forEachMessageBatch(query, func(messages []Message) error {
+		messageUUIDs := make([]string, len(messages))
+		bulkScores := make(map[string]interface{}, len(messages))
+
+		for i, message := range messages {
+			setBulkMailFlags(&message)
+
+			messageUUIDs[i] = message.UUID
+			bulkScores[message.UUID] = message.BulkScore
+
+			if message.IsBulk {
+				flagged++
+			}
+		}
+
+		return updateMessagesByScript(
+			newMessageUUIDsQuery(messageUUIDs, projectUUID),
+			"ctx._source.bulk_score = params.scores[ctx._source.uuid]; ctx._source.is_bulk = ctx._source.bulk_score >= params.threshold;",
+			map[string]interface{}{
+				"scores":    bulkScores,
+				"threshold": BulkMailThreshold,
+			},
+		)
+	}, database)
+
+	if err != nil {
+		return flagged, err
+	}
+
+	Logger.WithFields(LogFields{"project_uuid": projectUUID}).Infof("Flagged %d messages as bulk mail", flagged)
+
+	return flagged, nil
+}
+
+// FlagBulkMailJobParameters represents the parameters of the JobTypeFlagBulkMail job.
+type FlagBulkMailJobParameters struct {
+	Rescore bool `json:"rescore"`
+}
+
+// runFlagBulkMailJob runs FlagProjectBulkMail.
+func runFlagBulkMailJob(ctx context.Context, job Job, reportProgress func(progress int), database *pgx.Conn) (string, error) {
+	var parameters FlagBulkMailJobParameters
+
+	if err := decodeJobParameters(job, &parameters); err != nil {
+		return "", err
+	}
+
+	_, err := FlagProjectBulkMail(job.ProjectUUID, parameters.Rescore, job.UserUUID, database)
+
+	return "", err
+}
@@ -0,0 +1,99 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"bytes"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/charset"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"io"
+	"io/ioutil"
+	"unicode/utf8"
+)
+
+// init replaces the charset reader of go-message so unknown or broken charset declarations don't fail parsing.
+func init() {
+	message.CharsetReader = lenientCharsetReader
+}
+
+// lenientCharsetReader decodes the declared charset, the charset is detected if it is unknown to go-message.
+// Never returns an error so legacy messages are ingested instead of dropped.
+func lenientCharsetReader(declaredCharset string, input io.Reader) (io.Reader, error) {
+	if reader, err := charset.Reader(declaredCharset, input); err == nil {
+		return reader, nil
+	}
+
+	data, err := ioutil.ReadAll(input)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader([]byte(decodeText(data))), nil
+}
+
+// decodeText returns the text as UTF-8 using the detected charset.
+// Bytes which can't be decoded are replaced by the replacement character.
+func decodeText(data []byte) string {
+	detectedCharset := detectCharset(data)
+
+	if detectedCharset == nil {
+		return string(data)
+	}
+
+	decoded, err := detectedCharset.NewDecoder().Bytes(data)
+
+	if err != nil {
+		return string(bytes.ToValidUTF8(data, []byte(string(utf8.RuneError))))
+	}
+
+	return string(decoded)
+}
+
+// decodeHeaderField returns the decoded text of the header field (RFC 2047 encoded-words and undeclared 8-bit charsets).
+func decodeHeaderField(field message.HeaderFields) string {
+	text, err := field.Text()
+
+	if err != nil {
+		text = field.Value()
+	}
+
+	return decodeText([]byte(text))
+}
+
+// detectCharset detects the charset of the text, nil is returned for UTF-8 (and ASCII).
+// Detects ISO-2022-JP by its escape sequences (it is 7-bit so also valid UTF-8) and Windows-1251 (Cyrillic)
+// by the share of high bytes, otherwise Windows-1252 is used which decodes every byte.
+func detectCharset(data []byte) encoding.Encoding {
+	if bytes.Contains(data, []byte("\x1b$B")) || bytes.Contains(data, []byte("\x1b$@")) || bytes.Contains(data, []byte("\x1b(J")) {
+		return japanese.ISO2022JP
+	}
+
+	if utf8.Valid(data) {
+		return nil
+	}
+
+	var letters int
+	var cyrillicLetters int
+
+	for _, b := range data {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') {
+			letters++
+		} else if b >= 0xC0 {
+			// А-я in Windows-1251, accented letters in Windows-1252.
+			letters++
+			cyrillicLetters++
+		}
+	}
+
+	// Cyrillic text mostly consists of high bytes, Western European text only has a few accented letters.
+	if letters > 0 && cyrillicLetters*2 > letters {
+		return charmap.Windows1251
+	}
+
+	return charmap.Windows1252
+}
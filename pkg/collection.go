@@ -0,0 +1,185 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/jackc/pgx/v4"
+	"time"
+)
+
+// Collection statuses.
+const (
+	CollectionStatusRunning   = "running"
+	CollectionStatusCompleted = "completed"
+	CollectionStatusFailed    = "failed"
+)
+
+// Collection represents a cloud mailbox collection, recorded for defensibility.
+type Collection struct {
+	UUID        string              `json:"uuid"`
+	ProjectUUID string              `json:"project_uuid"`
+	UserUUID    string              `json:"user_uuid"` // The user who started the collection.
+	Provider    string              `json:"provider"`
+	Account     string              `json:"account"` // The collected mailbox account (custodian).
+	Status      string              `json:"status"`
+	Error       string              `json:"error"`
+	Mailboxes   []CollectionMailbox `json:"mailboxes"`
+	StartDate   int                 `json:"start_date"`
+	EndDate     int                 `json:"end_date"`
+}
+
+// CollectionMailbox represents the message counts of a collected mailbox.
+type CollectionMailbox struct {
+	Name      string `json:"name"`
+	Collected int    `json:"collected"`
+	Skipped   int    `json:"skipped"`
+	Failed    int    `json:"failed"`
+	StartDate int    `json:"start_date"`
+	EndDate   int    `json:"end_date"`
+}
+
+// CollectionReport represents the collection with the totals of all mailboxes.
+type CollectionReport struct {
+	Collection Collection `json:"collection"`
+	Collected  int        `json:"collected"`
+	Skipped    int        `json:"skipped"`
+	Failed     int        `json:"failed"`
+}
+
+// newCollection creates the running collection of the account.
+func newCollection(provider string, account string, projectUUID string, userUUID string) *Collection {
+	return &Collection{
+		UUID:        NewUUID(),
+		ProjectUUID: projectUUID,
+		UserUUID:    userUUID,
+		Provider:    provider,
+		Account:     account,
+		Status:      CollectionStatusRunning,
+		StartDate:   int(time.Now().Unix()),
+	}
+}
+
+// Save saves the collection to the database, replacing the previously saved state.
+func (collection *Collection) Save(database *pgx.Conn) error {
+	encodedMailboxes, err := json.Marshal(collection.Mailboxes)
+
+	if err != nil {
+		return err
+	}
+
+	preparedStatement := `
+	INSERT INTO collections(uuid, projectUUID, userUUID, provider, account, status, error, mailboxes, startDate, endDate) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	ON CONFLICT (uuid) DO UPDATE SET status = EXCLUDED.status, error = EXCLUDED.error, mailboxes = EXCLUDED.mailboxes, endDate = EXCLUDED.endDate
+	`
+	_, err = database.Exec(context.Background(), preparedStatement, collection.UUID, collection.ProjectUUID, collection.UserUUID, collection.Provider, collection.Account, collection.Status, collection.Error, string(encodedMailboxes), collection.StartDate, collection.EndDate)
+
+	return err
+}
+
+// startMailbox adds the mailbox to the collection and returns it to count its messages.
+// The returned mailbox is only valid until the next call.
+// Safe to call on a nil collection (collections which aren't recorded).
+func (collection *Collection) startMailbox(name string) *CollectionMailbox {
+	mailbox := CollectionMailbox{
+		Name:      name,
+		StartDate: int(time.Now().Unix()),
+	}
+
+	if collection == nil {
+		return &mailbox
+	}
+
+	collection.Mailboxes = append(collection.Mailboxes, mailbox)
+
+	return &collection.Mailboxes[len(collection.Mailboxes)-1]
+}
+
+// finish sets the status and end date of the collection.
+func (collection *Collection) finish(err error) {
+	collection.Status = CollectionStatusCompleted
+	collection.EndDate = int(time.Now().Unix())
+
+	if err != nil {
+		collection.Status = CollectionStatusFailed
+		collection.Error = err.Error()
+	}
+}
+
+// GetCollectionsByProject returns the collections of the project.
+func GetCollectionsByProject(projectUUID string, userUUID string, database *pgx.Conn) ([]Collection, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return nil, err
+	}
+
+	preparedStatement := `
+	SELECT uuid, projectUUID, userUUID, provider, account, status, error, mailboxes, startDate, endDate FROM collections WHERE projectUUID = $1 ORDER BY startDate DESC
+	`
+	rows, err := database.Query(context.Background(), preparedStatement, projectUUID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var collections []Collection
+
+	for rows.Next() {
+		collection, err := scanCollection(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		collections = append(collections, collection)
+	}
+
+	rows.Close()
+
+	return collections, rows.Err()
+}
+
+// GetCollectionReport returns the collection with the totals of all mailboxes.
+func GetCollectionReport(collectionUUID string, projectUUID string, userUUID string, database *pgx.Conn) (CollectionReport, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return CollectionReport{}, err
+	}
+
+	preparedStatement := `
+	SELECT uuid, projectUUID, userUUID, provider, account, status, error, mailboxes, startDate, endDate FROM collections WHERE uuid = $1 AND projectUUID = $2
+	`
+	collection, err := scanCollection(database.QueryRow(context.Background(), preparedStatement, collectionUUID, projectUUID))
+
+	if err != nil {
+		return CollectionReport{}, err
+	}
+
+	report := CollectionReport{
+		Collection: collection,
+	}
+
+	for _, mailbox := range collection.Mailboxes {
+		report.Collected += mailbox.Collected
+		report.Skipped += mailbox.Skipped
+		report.Failed += mailbox.Failed
+	}
+
+	return report, nil
+}
+
+// scanCollection scans the collection row.
+func scanCollection(row pgx.Row) (Collection, error) {
+	var collection Collection
+	var encodedMailboxes string
+
+	if err := row.Scan(&collection.UUID, &collection.ProjectUUID, &collection.UserUUID, &collection.Provider, &collection.Account, &collection.Status, &collection.Error, &encodedMailboxes, &collection.StartDate, &collection.EndDate); err != nil {
+		return Collection{}, err
+	}
+
+	if err := json.Unmarshal([]byte(encodedMailboxes), &collection.Mailboxes); err != nil {
+		return Collection{}, err
+	}
+
+	return collection, nil
+}
@@ -0,0 +1,181 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v4"
+	"time"
+)
+
+// Comment represents a comment on a message.
+// Replies reference the comment they reply to via ParentCommentUUID.
+type Comment struct {
+	UUID              string `json:"uuid"`
+	MessageUUID       string `json:"message_uuid"`
+	ProjectUUID       string `json:"project_uuid"`
+	ParentCommentUUID string `json:"parent_comment_uuid,omitempty"`
+	AuthorUUID        string `json:"author_uuid"`
+	Body              string `json:"body"`
+	CreationDate      int    `json:"creation_date"`
+}
+
+// Save saves the comment to the database.
+func (comment *Comment) Save(database *pgx.Conn) error {
+	preparedStatement := `
+	INSERT INTO comments(uuid, messageUUID, projectUUID, parentCommentUUID, authorUUID, body, creationDate) VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`
+	_, err := database.Exec(context.Background(), preparedStatement, comment.UUID, comment.MessageUUID, comment.ProjectUUID, comment.ParentCommentUUID, comment.AuthorUUID, comment.Body, comment.CreationDate)
+
+	return err
+}
+
+// AddComment adds a comment by the user to the message.
+// Use an empty parentCommentUUID for top-level comments.
+func AddComment(body string, parentCommentUUID string, messageUUID string, projectUUID string, userUUID string, database *pgx.Conn) (Comment, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionReview, database); err != nil {
+		return Comment{}, err
+	}
+
+	if body == "" {
+		return Comment{}, errors.New("comment body is empty")
+	}
+
+	if parentCommentUUID != "" {
+		parentComment, err := GetCommentByUUID(parentCommentUUID, projectUUID, database)
+
+		if err != nil {
+			return Comment{}, err
+		}
+
+		if parentComment.MessageUUID != messageUUID {
+			return Comment{}, errors.New("parent comment belongs to another message")
+		}
+	}
+
+	comment := Comment{
+		UUID:              NewUUID(),
+		MessageUUID:       messageUUID,
+		ProjectUUID:       projectUUID,
+		ParentCommentUUID: parentCommentUUID,
+		AuthorUUID:        userUUID,
+		Body:              body,
+		CreationDate:      int(time.Now().Unix()),
+	}
+
+	if err := comment.Save(database); err != nil {
+		return Comment{}, err
+	}
+
+	return comment, nil
+}
+
+// GetCommentByUUID returns the comment with the specified UUID.
+func GetCommentByUUID(commentUUID string, projectUUID string, database *pgx.Conn) (Comment, error) {
+	preparedStatement := `
+	SELECT uuid, messageUUID, projectUUID, parentCommentUUID, authorUUID, body, creationDate FROM comments WHERE uuid = $1 AND projectUUID = $2
+	`
+	row := database.QueryRow(context.Background(), preparedStatement, commentUUID, projectUUID)
+
+	var comment Comment
+
+	if err := row.Scan(&comment.UUID, &comment.MessageUUID, &comment.ProjectUUID, &comment.ParentCommentUUID, &comment.AuthorUUID, &comment.Body, &comment.CreationDate); err != nil {
+		return Comment{}, err
+	}
+
+	return comment, nil
+}
+
+// GetComments returns all comments of the message, oldest first.
+func GetComments(messageUUID string, projectUUID string, database *pgx.Conn) ([]Comment, error) {
+	preparedStatement := `
+	SELECT uuid, messageUUID, projectUUID, parentCommentUUID, authorUUID, body, creationDate FROM comments WHERE messageUUID = $1 AND projectUUID = $2 ORDER BY creationDate ASC
+	`
+	rows, err := database.Query(context.Background(), preparedStatement, messageUUID, projectUUID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var comments []Comment
+
+	for rows.Next() {
+		var comment Comment
+
+		if err := rows.Scan(&comment.UUID, &comment.MessageUUID, &comment.ProjectUUID, &comment.ParentCommentUUID, &comment.AuthorUUID, &comment.Body, &comment.CreationDate); err != nil {
+			return nil, err
+		}
+
+		comments = append(comments, comment)
+	}
+
+	rows.Close()
+
+	return comments, rows.Err()
+}
+
+// getCommentsForUUIDs returns the comments of the messages in the project (oldest first), keyed by message UUID.
+func getCommentsForUUIDs(messageUUIDs []string, projectUUID string, database *pgx.Conn) (map[string][]Comment, error) {
+	preparedStatement := `
+	SELECT uuid, messageUUID, projectUUID, parentCommentUUID, authorUUID, body, creationDate FROM comments WHERE messageUUID = ANY($1) AND projectUUID = $2 ORDER BY creationDate ASC
+	`
+	rows, err := database.Query(context.Background(), preparedStatement, messageUUIDs, projectUUID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	messageComments := map[string][]Comment{}
+
+	for rows.Next() {
+		var comment Comment
+
+		if err := rows.Scan(&comment.UUID, &comment.MessageUUID, &comment.ProjectUUID, &comment.ParentCommentUUID, &comment.AuthorUUID, &comment.Body, &comment.CreationDate); err != nil {
+			return nil, err
+		}
+
+		messageComments[comment.MessageUUID] = append(messageComments[comment.MessageUUID], comment)
+	}
+
+	rows.Close()
+
+	return messageComments, rows.Err()
+}
+
+// DeleteComment removes the comment and its replies.
+// Only the author or a user who can manage the project is allowed to delete a comment.
+func DeleteComment(commentUUID string, projectUUID string, userUUID string, database *pgx.Conn) error {
+	if err := CheckPermission(userUUID, projectUUID, ActionReview, database); err != nil {
+		return err
+	}
+
+	if err := checkProjectNotOnHold(projectUUID, userUUID, AuditActionDeleteComment, database); err != nil {
+		return err
+	}
+
+	comment, err := GetCommentByUUID(commentUUID, projectUUID, database)
+
+	if err != nil {
+		return err
+	}
+
+	if comment.AuthorUUID != userUUID {
+		if err := CheckPermission(userUUID, projectUUID, ActionManageProject, database); err != nil {
+			return err
+		}
+	}
+
+	preparedStatement := `
+	WITH RECURSIVE thread AS (
+		SELECT uuid FROM comments WHERE uuid = $1 AND projectUUID = $2
+		UNION
+		SELECT c.uuid FROM comments c INNER JOIN thread t ON c.parentCommentUUID = t.uuid
+	)
+	DELETE FROM comments WHERE uuid IN (SELECT uuid FROM thread)
+	`
+	_, err = database.Exec(context.Background(), preparedStatement, commentUUID, projectUUID)
+
+	return err
+}
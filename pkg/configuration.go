@@ -3,25 +3,199 @@
 // Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
 package core
 
-import "github.com/spf13/viper"
+import (
+	"errors"
+	"fmt"
+	"github.com/spf13/viper"
+)
 
+// GoForensicsAPIURL defines the URL of the Go Forensics API.
+//
+// Deprecated: use Core.Config.GoForensicsAPIURL.
 var GoForensicsAPIURL string
 
-// init initializes our configuration.
-func init() {
+// Config represents the configuration of Go Forensics, see New.
+// The mapstructure tags are the variables of the goforensics.yaml configuration file.
+type Config struct {
+	GoForensicsAPIURL      string   `mapstructure:"go_forensics_api_url"`
+	DatabaseURL            string   `mapstructure:"database_url"`
+	ElasticsearchAddresses []string `mapstructure:"elasticsearch_addresses"`
+	ElasticsearchIndex     string   `mapstructure:"elasticsearch_index"`
+	KafkaAddress           string   `mapstructure:"kafka_address"`
+	KafkaTopic             string   `mapstructure:"kafka_topic"`
+	MinIOBucket            string   `mapstructure:"minio_bucket"`
+	MinIOEndpoint          string   `mapstructure:"minio_endpoint"`
+	MinIOAccessKey         string   `mapstructure:"minio_access_key"`
+	MinIOSecretKey         string   `mapstructure:"minio_secret_key"`
+	MinIOSecure            bool     `mapstructure:"minio_secure"`
+	PostmarkToken          string   `mapstructure:"postmark_token"`
+	MicrosoftClientID      string   `mapstructure:"microsoft_client_id"`
+	MicrosoftClientSecret  string   `mapstructure:"microsoft_client_secret"`
+	GoogleClientID         string   `mapstructure:"google_client_id"`     // Optional.
+	GoogleClientSecret     string   `mapstructure:"google_client_secret"` // Optional.
+	PseudonymizationKey    string   `mapstructure:"pseudonymization_key"` // Optional, base64 encoded 32 bytes.
+	NotificationSender     string   `mapstructure:"notification_sender"`  // Optional.
+	TokenEncryptionKey     string   `mapstructure:"token_encryption_key"` // Optional, base64 encoded 32 bytes.
+	// MailProviders are the OAuth2 credentials per mail provider name, e.g. of providers added with RegisterMailProvider.
+	MailProviders map[string]MailProviderCredentials `mapstructure:"mail_providers"`
+	// SASLMechanisms is the IMAP SASL mechanism (XOAUTH2 or OAUTHBEARER) per OAuth2 provider, XOAUTH2 is used if unset.
+	SASLMechanisms map[string]string `mapstructure:"sasl_mechanisms"`
+	// Retry is the backoff of MinIO, Kafka, Postmark and Microsoft calls, DefaultRetryOptions is used if unset.
+	Retry RetryOptions `mapstructure:"retry"`
+	// MailboxRateLimit is the rate of IMAP and Microsoft Graph requests, DefaultMailboxRateLimitOptions is used if unset.
+	MailboxRateLimit RateLimitOptions `mapstructure:"mailbox_rate_limit"`
+	// LowPriorityIngestRate is the rate of messages parsed by low priority jobs while higher priority parse jobs are active,
+	// DefaultLowPriorityIngestRateOptions is used if unset.
+	LowPriorityIngestRate RateLimitOptions `mapstructure:"low_priority_ingest_rate"`
+	// LowPriorityJobLimit is the maximum amount of running low priority jobs of all workers, zero (the default) for no limit.
+	// Keep it below the amount of workers so higher priority jobs aren't queued behind a batch import.
+	LowPriorityJobLimit int `mapstructure:"low_priority_job_limit"`
+	// Elasticsearch authentication (username and password or API key) and TLS options, all optional.
+	// The CA certificate and client certificate variables are paths to PEM encoded files.
+	ElasticsearchUsername               string `mapstructure:"elasticsearch_username"`
+	ElasticsearchPassword               string `mapstructure:"elasticsearch_password"`
+	ElasticsearchAPIKey                 string `mapstructure:"elasticsearch_api_key"` // Base64 encoded, overrides the username and password.
+	ElasticsearchCACert                 string `mapstructure:"elasticsearch_ca_cert"`
+	ElasticsearchClientCert             string `mapstructure:"elasticsearch_client_cert"`
+	ElasticsearchClientKey              string `mapstructure:"elasticsearch_client_key"`
+	ElasticsearchInsecureSkipVerify     bool   `mapstructure:"elasticsearch_insecure_skip_verify"` // Only for testing.
+	ElasticsearchCertificateFingerprint string `mapstructure:"elasticsearch_certificate_fingerprint"`
+	// KafkaBatch is the batching of messages written to Kafka, DefaultKafkaBatchOptions is used for unset options.
+	KafkaBatch KafkaBatchOptions `mapstructure:"kafka_batch"`
+	// KafkaCompression is the compression of Kafka messages: none (the default), gzip, snappy, lz4 or zstd.
+	KafkaCompression string `mapstructure:"kafka_compression"`
+	// BodyOffloadSize is the body size in bytes above which the body is stored in MinIO and only its text is indexed.
+	// Zero (the default) disables offloading, see GetMessageBody.
+	BodyOffloadSize int `mapstructure:"body_offload_size"`
+	// TempDirectory is the directory of the temporary files of all projects, the project directories are used if unset.
+	TempDirectory string `mapstructure:"temp_directory"`
+	// TempQuota is the maximum size in bytes of the temporary files of all projects, zero (the default) for no limit.
+	TempQuota int64 `mapstructure:"temp_quota"`
+	// ProjectQuota is the quota of projects without their own quota (see SetProjectQuota), zero values (the default) for no limit.
+	// Enforced when evidence is added and parsed, see CheckEvidenceQuota.
+	ProjectQuota ProjectQuota `mapstructure:"project_quota"`
+	// MinIOBucketPerProject stores the objects of new projects in their own bucket "<minio_bucket>-<project UUID>", which is removed with the project.
+	// Projects created before it was enabled keep using minio_bucket, don't disable it once projects have their own bucket.
+	MinIOBucketPerProject bool `mapstructure:"minio_bucket_per_project"`
+	// MasterKeys are the master keys (base64 encoded, 32 bytes) wrapping the data encryption keys of the projects, optional.
+	// The first key wraps new keys, add the previous keys after it until RotateDataKeys re-wrapped their keys.
+	// Requires minio_secure since the object encryption keys are sent to MinIO (SSE-C).
+	MasterKeys []string `mapstructure:"master_keys"`
+	// KeyWrappers are used instead of the master keys if set, e.g. to wrap the data encryption keys with a KMS.
+	KeyWrappers []KeyWrapper `mapstructure:"-"`
+	// Logger is used instead of the default logrus logger if set, see NewLogrusLogger and NewDiscardLogger.
+	Logger StructuredLogger `mapstructure:"-"`
+	// SentimentAPIURL is the external API scoring the sentiment of messages (see NewHTTPSentimentProvider), optional.
+	// SentimentAPIKey is sent as bearer token if set.
+	SentimentAPIURL string `mapstructure:"sentiment_api_url"`
+	SentimentAPIKey string `mapstructure:"sentiment_api_key"`
+	// SentimentProvider is used instead of the sentiment API if set, e.g. NewLexiconSentimentProvider or a local model.
+	SentimentProvider SentimentProvider `mapstructure:"-"`
+	// EmbeddingAPIURL is the external API computing the embeddings of messages for semantic search (see NewHTTPEmbeddingProvider), optional.
+	// EmbeddingDimensions is the size of its embeddings and EmbeddingAPIKey is sent as bearer token if set.
+	EmbeddingAPIURL     string `mapstructure:"embedding_api_url"`
+	EmbeddingAPIKey     string `mapstructure:"embedding_api_key"`
+	EmbeddingDimensions int    `mapstructure:"embedding_dimensions"`
+	// EmbeddingProvider is used instead of the embedding API if set, e.g. a local model.
+	EmbeddingProvider EmbeddingProvider `mapstructure:"-"`
+	// URLReputationAPIURL is the external API checking the reputation of URLs in messages (see NewHTTPURLReputationProvider), optional.
+	// URLReputationAPIKey is sent as bearer token if set.
+	URLReputationAPIURL string `mapstructure:"url_reputation_api_url"`
+	URLReputationAPIKey string `mapstructure:"url_reputation_api_key"`
+	// URLReputationProvider is used instead of the URL reputation API if set, e.g. a threat intelligence feed.
+	URLReputationProvider URLReputationProvider `mapstructure:"-"`
+	// Lightweight runs without PostgreSQL, Elasticsearch, Kafka and MinIO, e.g. for tests: see Core.Repositories, Core.Messages and Core.BlobStore.
+	// Only parsing and the metadata are available, none of the service variables are required.
+	Lightweight bool `mapstructure:"lightweight"`
+	// BlobDirectory is the directory of the objects in the lightweight mode, "data/blobs" if unset.
+	BlobDirectory string `mapstructure:"blob_directory"`
+}
+
+// LoadConfig reads the configuration from the goforensics.yaml file in the working directory.
+func LoadConfig() (Config, error) {
 	viper.SetConfigName("goforensics")
 	viper.SetConfigType("yaml")
 	viper.AddConfigPath(".")
 
-	err := viper.ReadInConfig()
+	if err := viper.ReadInConfig(); err != nil {
+		return Config{}, err
+	}
+
+	var config Config
+
+	if err := viper.Unmarshal(&config); err != nil {
+		return Config{}, err
+	}
+
+	return config, nil
+}
+
+// validate returns an error if a required configuration variable is unset.
+func (config Config) validate() error {
+	if config.Lightweight {
+		return nil
+	}
+
+	requiredVariables := []struct {
+		Name  string
+		IsSet bool
+	}{
+		{Name: "go_forensics_api_url", IsSet: config.GoForensicsAPIURL != ""},
+		{Name: "database_url", IsSet: config.DatabaseURL != ""},
+		{Name: "elasticsearch_addresses", IsSet: len(config.ElasticsearchAddresses) > 0},
+		{Name: "elasticsearch_index", IsSet: config.ElasticsearchIndex != ""},
+		{Name: "kafka_address", IsSet: config.KafkaAddress != ""},
+		{Name: "kafka_topic", IsSet: config.KafkaTopic != ""},
+		{Name: "minio_bucket", IsSet: config.MinIOBucket != ""},
+		{Name: "minio_endpoint", IsSet: config.MinIOEndpoint != ""},
+		{Name: "minio_access_key", IsSet: config.MinIOAccessKey != ""},
+		{Name: "minio_secret_key", IsSet: config.MinIOSecretKey != ""},
+		{Name: "postmark_token", IsSet: config.PostmarkToken != ""},
+		{Name: "microsoft_client_id", IsSet: config.MicrosoftClientID != ""},
+		{Name: "microsoft_client_secret", IsSet: config.MicrosoftClientSecret != ""},
+	}
+
+	for _, requiredVariable := range requiredVariables {
+		if !requiredVariable.IsSet {
+			return fmt.Errorf("unset %s configuration variable", requiredVariable.Name)
+		}
+	}
+
+	if (len(config.MasterKeys) > 0 || len(config.KeyWrappers) > 0) && !config.MinIOSecure {
+		return errors.New("master_keys requires minio_secure")
+	}
+
+	if config.EmbeddingAPIURL != "" && config.EmbeddingDimensions <= 0 {
+		return errors.New("embedding_api_url requires embedding_dimensions")
+	}
+
+	if (config.ElasticsearchClientCert == "") != (config.ElasticsearchClientKey == "") {
+		return errors.New("elasticsearch_client_cert and elasticsearch_client_key must be set together")
+	}
+
+	return nil
+}
+
+// init initializes the deprecated globals from the goforensics.yaml configuration file.
+// Nothing is initialized if the configuration file doesn't exist so the package can be embedded, see New.
+func init() {
+	config, err := LoadConfig()
 
 	if err != nil {
+		var configFileNotFoundError viper.ConfigFileNotFoundError
+
+		if errors.As(err, &configFileNotFoundError) {
+			return
+		}
+
 		Logger.Fatalf("Failed to initialize configuration file: %s", err)
 	}
 
-	if viper.IsSet("go_forensics_api_url") {
-		GoForensicsAPIURL = viper.GetString("go_forensics_api_url")
-	} else {
-		Logger.Fatal("unset go_forensics_api_url configuration variable")
+	core, err := newCore(config)
+
+	if err != nil {
+		Logger.Fatalf("Failed to initialize: %s", err)
 	}
+
+	core.setGlobals()
 }
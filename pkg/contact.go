@@ -0,0 +1,187 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"github.com/aquasecurity/esquery"
+	"github.com/jackc/pgx/v4"
+	"sort"
+	"strings"
+)
+
+// ContactProfile represents the communication statistics of a contact (address).
+type ContactProfile struct {
+	Address                 string      `json:"address"`
+	SentMessages            int         `json:"sent_messages"`
+	ReceivedMessages        int         `json:"received_messages"`
+	FirstContactDate        int         `json:"first_contact_date"`
+	LastContactDate         int         `json:"last_contact_date"`
+	TopCorrespondents       []TermCount `json:"top_correspondents"`
+	TotalAttachments        int         `json:"total_attachments"`
+	MessagesWithAttachments int         `json:"messages_with_attachments"`
+	RecentMessages          []Message   `json:"recent_messages"`
+}
+
+// Constants defining the size of the contact profile lists.
+const (
+	contactProfileTopCorrespondentsSize = 10
+	contactProfileRecentMessagesSize    = 10
+)
+
+// GetContactProfile returns the profile of the address (messages sent and received, correspondents, etc.).
+func GetContactProfile(projectUUID string, address string, userUUID string, database *pgx.Conn) (ContactProfile, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return ContactProfile{}, err
+	}
+
+	// Addresses are indexed in lowercase, see initializeAddressValues.
+	address = strings.ToLower(strings.TrimSpace(address))
+
+	query := esquery.
+		Bool().
+		Must(esquery.Term("project_uuid", projectUUID)).
+		Should(
+			esquery.Term("from_addresses", address),
+			esquery.Term("recipient_addresses", address),
+		).
+		MinimumShouldMatch(1)
+
+	// One extra correspondent since the address itself may be one of them (messages to self).
+	correspondentsSize := uint64(contactProfileTopCorrespondentsSize + 1)
+
+	aggregations, _, err := runAggregationSearch(
+		query,
+		esquery.FilterAgg("sent", esquery.Term("from_addresses", address)).Aggs(
+			esquery.TermsAgg("correspondents", "recipient_addresses").Size(correspondentsSize),
+		),
+		esquery.FilterAgg("received", esquery.Term("recipient_addresses", address)).Aggs(
+			esquery.TermsAgg("correspondents", "from_addresses").Size(correspondentsSize),
+		),
+		esquery.FilterAgg("dated", esquery.Range("received").Gt(0)).Aggs(
+			esquery.Min("first_contact_date", "received"),
+			esquery.Max("last_contact_date", "received"),
+		),
+		esquery.ValueCount("total_attachments", "attachments.uuid"),
+		esquery.FilterAgg("with_attachments", esquery.Exists("attachments.uuid")),
+	)
+
+	if err != nil {
+		return ContactProfile{}, err
+	}
+
+	contactProfile := ContactProfile{
+		Address: address,
+	}
+
+	correspondents := map[string]int{}
+
+	sentBucket, err := aggregations.Bucket("sent")
+
+	if err != nil {
+		return ContactProfile{}, err
+	}
+
+	receivedBucket, err := aggregations.Bucket("received")
+
+	if err != nil {
+		return ContactProfile{}, err
+	}
+
+	contactProfile.SentMessages = sentBucket.DocCount
+	contactProfile.ReceivedMessages = receivedBucket.DocCount
+
+	for _, bucket := range []aggregationBucket{sentBucket, receivedBucket} {
+		correspondentBuckets, err := bucket.Aggregations.Buckets("correspondents")
+
+		if err != nil {
+			return ContactProfile{}, err
+		}
+
+		for _, correspondentBucket := range correspondentBuckets {
+			if correspondentBucket.KeyString() != address {
+				correspondents[correspondentBucket.KeyString()] += correspondentBucket.DocCount
+			}
+		}
+	}
+
+	for correspondent, count := range correspondents {
+		contactProfile.TopCorrespondents = append(contactProfile.TopCorrespondents, TermCount{
+			Term:  correspondent,
+			Count: count,
+		})
+	}
+
+	sort.Slice(contactProfile.TopCorrespondents, func(i, j int) bool {
+		if contactProfile.TopCorrespondents[i].Count != contactProfile.TopCorrespondents[j].Count {
+			return contactProfile.TopCorrespondents[i].Count > contactProfile.TopCorrespondents[j].Count
+		}
+
+		return contactProfile.TopCorrespondents[i].Term < contactProfile.TopCorrespondents[j].Term
+	})
+
+	if len(contactProfile.TopCorrespondents) > contactProfileTopCorrespondentsSize {
+		contactProfile.TopCorrespondents = contactProfile.TopCorrespondents[:contactProfileTopCorrespondentsSize]
+	}
+
+	datedBucket, err := aggregations.Bucket("dated")
+
+	if err != nil {
+		return ContactProfile{}, err
+	}
+
+	// Date aggregations return milliseconds.
+	firstContactDate, err := datedBucket.Aggregations.Value("first_contact_date")
+
+	if err != nil {
+		return ContactProfile{}, err
+	}
+
+	lastContactDate, err := datedBucket.Aggregations.Value("last_contact_date")
+
+	if err != nil {
+		return ContactProfile{}, err
+	}
+
+	contactProfile.FirstContactDate = int(firstContactDate / 1000)
+	contactProfile.LastContactDate = int(lastContactDate / 1000)
+
+	totalAttachments, err := aggregations.Value("total_attachments")
+
+	if err != nil {
+		return ContactProfile{}, err
+	}
+
+	contactProfile.TotalAttachments = int(totalAttachments)
+
+	withAttachmentsBucket, err := aggregations.Bucket("with_attachments")
+
+	if err != nil {
+		return ContactProfile{}, err
+	}
+
+	contactProfile.MessagesWithAttachments = withAttachmentsBucket.DocCount
+
+	response, err := esquery.Search().
+		Query(query).
+		Sort("received", esquery.OrderDesc).
+		Size(contactProfileRecentMessagesSize).
+		Run(
+			Elasticsearch,
+			Elasticsearch.Search.WithContext(context.Background()),
+			Elasticsearch.Search.WithIndex("messages"),
+		)
+
+	if err != nil {
+		return ContactProfile{}, err
+	}
+
+	contactProfile.RecentMessages, err = getMessagesFromSearchResult(response.Body, database)
+
+	if err != nil {
+		return ContactProfile{}, err
+	}
+
+	return contactProfile, nil
+}
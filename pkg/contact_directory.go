@@ -0,0 +1,396 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aquasecurity/esquery"
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/jackc/pgx/v4"
+	"regexp"
+	"strings"
+)
+
+// Contact represents a contact record parsed from the evidence (a PST contact or a vCard), see GetContacts.
+type Contact struct {
+	UUID                string      `json:"uuid"`
+	ProjectUUID         string      `json:"project_uuid"`
+	EvidenceUUID        string      `json:"evidence_uuid"`
+	FolderUUID          string      `json:"folder_uuid"`
+	Source              string      `json:"source"` // ContactSourcePST or ContactSourceVCard.
+	DisplayName         string      `json:"display_name"`
+	GivenName           string      `json:"given_name,omitempty"`
+	Surname             string      `json:"surname,omitempty"`
+	EmailAddresses      []string    `json:"email_addresses,omitempty"` // Lowercase.
+	CompanyName         string      `json:"company_name,omitempty"`
+	BusinessPhoneNumber string      `json:"business_phone_number,omitempty"`
+	MobilePhoneNumber   string      `json:"mobile_phone_number,omitempty"`
+	Provenance          *Provenance `json:"provenance,omitempty"`
+}
+
+// Sources of contacts.
+const (
+	ContactSourcePST   = "pst"   // An IPM.Contact item.
+	ContactSourceVCard = "vcard" // A .vcf file.
+)
+
+// contactsIndex defines the Elasticsearch index of the contacts.
+const contactsIndex = "contacts"
+
+// maxContactsSize defines the maximum amount of contacts returned by GetContacts.
+const maxContactsSize = 10000
+
+// messageClassContact defines the message class of contacts.
+const messageClassContact = "IPM.Contact"
+
+// contactEmailPattern matches the email addresses in a contact field, e.g. "John Doe (john@example.com)".
+var contactEmailPattern = regexp.MustCompile(`[^\s()<>;,:"']+@[^\s()<>;,:"']+`)
+
+// contactsIndexMappings returns the mappings of the contacts index.
+func contactsIndexMappings() map[string]interface{} {
+	keyword := map[string]interface{}{
+		"type": "keyword",
+	}
+
+	searchableText := map[string]interface{}{
+		"type": "text",
+		"fields": map[string]interface{}{
+			"keyword": map[string]interface{}{
+				"type":         "keyword",
+				"ignore_above": 1024,
+			},
+		},
+	}
+
+	return map[string]interface{}{
+		"properties": map[string]interface{}{
+			"uuid":                  keyword,
+			"project_uuid":          keyword,
+			"evidence_uuid":         keyword,
+			"folder_uuid":           keyword,
+			"source":                keyword,
+			"display_name":          searchableText,
+			"given_name":            searchableText,
+			"surname":               searchableText,
+			"email_addresses":       searchableText,
+			"company_name":          searchableText,
+			"business_phone_number": keyword,
+			"mobile_phone_number":   keyword,
+			"provenance": map[string]interface{}{
+				"properties": map[string]interface{}{
+					"parser":         keyword,
+					"parser_version": keyword,
+					"core_version":   keyword,
+					"evidence_hash":  keyword,
+					"extracted_at": map[string]interface{}{
+						"type":   "date",
+						"format": "epoch_second",
+					},
+				},
+			},
+		},
+	}
+}
+
+// createContactsIndex creates the Elasticsearch index of the contacts.
+func createContactsIndex(client *elasticsearch.Client) error {
+	var requestBody bytes.Buffer
+
+	err := json.NewEncoder(&requestBody).Encode(map[string]interface{}{
+		"mappings": contactsIndexMappings(),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Indices.Create(contactsIndex, client.Indices.Create.WithBody(&requestBody))
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// contactSearchFields defines the fields matched by the query of GetContacts.
+var contactSearchFields = []string{"display_name", "given_name", "surname", "email_addresses", "company_name"}
+
+// GetContacts returns the contacts parsed from the evidence of the project ordered by display name.
+// An empty query returns all contacts, otherwise the name, email address or company name must match.
+func GetContacts(projectUUID string, query string, userUUID string, database *pgx.Conn) ([]Contact, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return nil, err
+	}
+
+	searchQuery := esquery.Bool().Filter(esquery.Term("project_uuid", projectUUID))
+
+	if query != "" {
+		var shouldMatch []esquery.Mappable
+
+		for _, field := range contactSearchFields {
+			shouldMatch = append(shouldMatch, esquery.Match(field, query))
+		}
+
+		searchQuery = searchQuery.MinimumShouldMatch(1).Should(shouldMatch...)
+	}
+
+	response, err := esquery.Search().
+		Query(searchQuery).
+		Size(maxContactsSize).
+		Sort("display_name.keyword", esquery.OrderAsc).
+		Run(
+			Elasticsearch,
+			Elasticsearch.Search.WithContext(context.Background()),
+			Elasticsearch.Search.WithIndex(contactsIndex),
+		)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err := response.Body.Close(); err != nil {
+			Logger.Errorf("Failed to close Elasticsearch response: %s", err)
+		}
+	}()
+
+	if response.IsError() {
+		return nil, fmt.Errorf("failed to search contacts: %s", response.String())
+	}
+
+	var searchResponse struct {
+		Hits struct {
+			Hits []struct {
+				Source Contact `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+
+	if err := json.NewDecoder(response.Body).Decode(&searchResponse); err != nil {
+		return nil, err
+	}
+
+	contacts := make([]Contact, 0, len(searchResponse.Hits.Hits))
+
+	for _, hit := range searchResponse.Hits.Hits {
+		contacts = append(contacts, hit.Source)
+	}
+
+	return contacts, nil
+}
+
+// indexContacts adds the contacts to the contacts index with a single bulk request.
+func indexContacts(contacts []Contact) error {
+	// The lightweight mode has no contacts index.
+	if len(contacts) == 0 || lightweightMessages != nil {
+		return nil
+	}
+
+	var requestBody bytes.Buffer
+
+	encoder := json.NewEncoder(&requestBody)
+
+	for _, contact := range contacts {
+		action := map[string]interface{}{
+			"index": map[string]interface{}{
+				"_index": contactsIndex,
+				"_id":    contact.UUID,
+			},
+		}
+
+		if err := encoder.Encode(action); err != nil {
+			return err
+		}
+
+		if err := encoder.Encode(contact); err != nil {
+			return err
+		}
+	}
+
+	response, err := Elasticsearch.Bulk(&requestBody, Elasticsearch.Bulk.WithContext(context.Background()))
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := response.Body.Close(); err != nil {
+			Logger.Errorf("Failed to close Elasticsearch response: %s", err)
+		}
+	}()
+
+	if response.IsError() {
+		return fmt.Errorf("failed to index contacts: %s", response.String())
+	}
+
+	var bulkResponse struct {
+		Errors bool `json:"errors"`
+	}
+
+	if err := json.NewDecoder(response.Body).Decode(&bulkResponse); err != nil {
+		return err
+	}
+
+	if bulkResponse.Errors {
+		return errors.New("failed to index some contacts")
+	}
+
+	return nil
+}
+
+// DeleteContactsByProject deletes all contacts of the project from Elasticsearch.
+func DeleteContactsByProject(projectUUID string) error {
+	response, err := esquery.Delete().
+		Index(contactsIndex).
+		Query(esquery.Bool().Must(esquery.Term("project_uuid", projectUUID))).
+		Run(
+			Elasticsearch,
+			Elasticsearch.DeleteByQuery.WithContext(context.Background()),
+		)
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := response.Body.Close(); err != nil {
+			Logger.Errorf("Failed to close Elasticsearch response: %s", err)
+		}
+	}()
+
+	// The index doesn't exist if no contacts were ever parsed.
+	if response.IsError() && response.StatusCode != 404 {
+		return fmt.Errorf("failed to delete contacts: %s", response.String())
+	}
+
+	return nil
+}
+
+// getContactEmailAddresses returns the lowercase email addresses in the contact fields.
+func getContactEmailAddresses(fields ...string) []string {
+	var emailAddresses []string
+
+	for _, field := range fields {
+		for _, emailAddress := range contactEmailPattern.FindAllString(field, -1) {
+			emailAddress = strings.ToLower(emailAddress)
+
+			hasEmailAddress := false
+
+			for _, existingEmailAddress := range emailAddresses {
+				if existingEmailAddress == emailAddress {
+					hasEmailAddress = true
+					break
+				}
+			}
+
+			if !hasEmailAddress {
+				emailAddresses = append(emailAddresses, emailAddress)
+			}
+		}
+	}
+
+	return emailAddresses
+}
+
+// parseVCards returns the contacts of the vCard file (versions 2.1, 3.0 and 4.0), a file may contain multiple vCards.
+func parseVCards(data []byte) ([]Contact, error) {
+	var contacts []Contact
+	var contact *Contact
+	var lines []string
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+
+	// Photos are inlined as base64.
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+
+		// Folded lines continue with a space or tab.
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+
+		lines = append(lines, line)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, line := range lines {
+		property, value, ok := strings.Cut(line, ":")
+
+		if !ok {
+			continue
+		}
+
+		name, parameters, _ := strings.Cut(property, ";")
+		name = strings.ToUpper(name)
+
+		// Grouped properties, e.g. "item1.EMAIL".
+		if _, ungroupedName, isGrouped := strings.Cut(name, "."); isGrouped {
+			name = ungroupedName
+		}
+
+		if name == "BEGIN" && strings.EqualFold(value, "VCARD") {
+			contact = &Contact{Source: ContactSourceVCard}
+			continue
+		}
+
+		if contact == nil {
+			continue
+		}
+
+		switch name {
+		case "END":
+			if contact.DisplayName == "" {
+				contact.DisplayName = strings.TrimSpace(fmt.Sprintf("%s %s", contact.GivenName, contact.Surname))
+			}
+
+			contacts = append(contacts, *contact)
+			contact = nil
+		case "FN":
+			contact.DisplayName = unescapeVCardValue(value)
+		case "N":
+			// Family name; given name; additional names; prefixes; suffixes.
+			nameParts := strings.Split(value, ";")
+
+			contact.Surname = unescapeVCardValue(nameParts[0])
+
+			if len(nameParts) > 1 {
+				contact.GivenName = unescapeVCardValue(nameParts[1])
+			}
+		case "EMAIL":
+			contact.EmailAddresses = append(contact.EmailAddresses, getContactEmailAddresses(value)...)
+		case "ORG":
+			organization, _, _ := strings.Cut(value, ";")
+
+			contact.CompanyName = unescapeVCardValue(organization)
+		case "TEL":
+			phoneNumber := strings.TrimPrefix(unescapeVCardValue(value), "tel:")
+			upperParameters := strings.ToUpper(parameters)
+
+			if strings.Contains(upperParameters, "CELL") && contact.MobilePhoneNumber == "" {
+				contact.MobilePhoneNumber = phoneNumber
+			} else if contact.BusinessPhoneNumber == "" && (strings.Contains(upperParameters, "WORK") || !strings.Contains(upperParameters, "CELL")) {
+				contact.BusinessPhoneNumber = phoneNumber
+			}
+		}
+	}
+
+	return contacts, nil
+}
+
+// unescapeVCardValue returns the vCard text value without escaping.
+func unescapeVCardValue(value string) string {
+	return strings.TrimSpace(strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(value))
+}
@@ -0,0 +1,296 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aquasecurity/esquery"
+	"github.com/jackc/pgx/v4"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Conversation represents a thread of messages, see GetConversations.
+type Conversation struct {
+	ThreadID      string   `json:"thread_id"`
+	Participants  []string `json:"participants"` // The addresses of the senders and recipients.
+	MessageCount  int      `json:"message_count"`
+	FirstReceived int      `json:"first_received"`
+	LastReceived  int      `json:"last_received"`
+	LatestSubject string   `json:"latest_subject"`
+	LatestUUID    string   `json:"latest_uuid"` // The UUID of the latest message.
+}
+
+// ConversationList represents a page of conversations.
+type ConversationList struct {
+	Conversations []Conversation `json:"conversations"`
+	Total         int            `json:"total"` // The (approximate) amount of conversations on all pages.
+	Page          int            `json:"page"`
+	PageSize      int            `json:"page_size"`
+}
+
+// Conversation list limits.
+const (
+	// maxConversationListWindow defines the maximum amount of conversations which can be paged through.
+	maxConversationListWindow = 10000
+	// conversationParticipantsSize defines the maximum amount of senders and recipients per conversation.
+	conversationParticipantsSize = 50
+)
+
+// ErrConversationListTooDeep is returned by GetConversations if the page is beyond the first 10,000 conversations, use filters to narrow them.
+var ErrConversationListTooDeep = errors.New("page is too deep, narrow the conversations with filters")
+
+// subjectPrefixPattern matches the reply and forward prefixes of a subject, e.g. "Re: Fwd: ".
+var subjectPrefixPattern = regexp.MustCompile(`(?i)^\s*((re|fw|fwd|aw|wg|sv|vs|antw)(\[\d+\])?\s*:\s*)+`)
+
+// messageIDPattern matches the message IDs in the Message-ID, In-Reply-To and References headers.
+var messageIDPattern = regexp.MustCompile(`<[^<>\s]+>`)
+
+// getThreadID returns the thread ID of the message: the hash of the root message ID (the first of the References header,
+// otherwise the In-Reply-To header, otherwise its own message ID). Messages without message IDs are threaded by their normalized subject.
+func getThreadID(message Message) string {
+	var rootMessageID string
+
+	for _, header := range []string{"References", "In-Reply-To", "Message-ID"} {
+		if messageIDs := messageIDPattern.FindAllString(getHeaderValue(message.Headers, header), -1); len(messageIDs) > 0 {
+			rootMessageID = strings.ToLower(messageIDs[0])
+			break
+		}
+	}
+
+	if rootMessageID == "" && message.MessageID != "" && message.MessageID != messageNullValue {
+		rootMessageID = strings.ToLower(message.MessageID)
+	}
+
+	if rootMessageID == "" {
+		rootMessageID = fmt.Sprintf("subject:%s", strings.ToLower(strings.TrimSpace(subjectPrefixPattern.ReplaceAllString(message.Subject, ""))))
+	}
+
+	threadHash := sha256.Sum256([]byte(rootMessageID))
+
+	return hex.EncodeToString(threadHash[:16])
+}
+
+// GetConversations returns the page (starting at 1) of threads with messages matching the filters, the most recently active first.
+// Messages indexed before threading have no thread, use ThreadProjectMessages to thread them.
+// Returns ErrConversationListTooDeep for pages beyond the first 10,000 conversations.
+func GetConversations(projectUUID string, filters SearchFilters, page int, pageSize int, userUUID string, database *pgx.Conn) (ConversationList, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return ConversationList{}, err
+	}
+
+	if page < 1 {
+		return ConversationList{}, fmt.Errorf("invalid page: %d", page)
+	}
+
+	if err := checkMessageListPageSize(pageSize); err != nil {
+		return ConversationList{}, err
+	}
+
+	from := (page - 1) * pageSize
+
+	if from+pageSize > maxConversationListWindow {
+		return ConversationList{}, ErrConversationListTooDeep
+	}
+
+	query := filters.apply(esquery.Bool().Filter(esquery.Term("project_uuid", projectUUID), esquery.Exists("thread_id")))
+
+	// Terms aggregations can't skip buckets, so the buckets of the previous pages are skipped below.
+	aggregations, _, err := runAggregationSearch(
+		query,
+		esquery.Cardinality("thread_count", "thread_id"),
+		esquery.TermsAgg("threads", "thread_id").
+			Size(uint64(from+pageSize)).
+			Order(map[string]string{"last_received": "desc"}).
+			Aggs(
+				esquery.Min("first_received", "received"),
+				esquery.Max("last_received", "received"),
+				esquery.TermsAgg("senders", "from_addresses").Size(conversationParticipantsSize),
+				esquery.TermsAgg("recipients", "recipient_addresses").Size(conversationParticipantsSize),
+				esquery.TopHits("latest").Size(1).Sort("received", esquery.OrderDesc).SourceIncludes("uuid", "subject"),
+			),
+	)
+
+	if err != nil {
+		return ConversationList{}, err
+	}
+
+	threadCount, err := aggregations.Value("thread_count")
+
+	if err != nil {
+		return ConversationList{}, err
+	}
+
+	threadBuckets, err := aggregations.Buckets("threads")
+
+	if err != nil {
+		return ConversationList{}, err
+	}
+
+	conversationList := ConversationList{
+		Conversations: []Conversation{},
+		Total:         int(threadCount),
+		Page:          page,
+		PageSize:      pageSize,
+	}
+
+	if from >= len(threadBuckets) {
+		return conversationList, nil
+	}
+
+	for _, threadBucket := range threadBuckets[from:] {
+		conversation, err := getConversationFromBucket(threadBucket)
+
+		if err != nil {
+			return ConversationList{}, err
+		}
+
+		conversationList.Conversations = append(conversationList.Conversations, conversation)
+	}
+
+	return conversationList, nil
+}
+
+// getConversationFromBucket returns the conversation of the thread bucket of GetConversations.
+func getConversationFromBucket(threadBucket aggregationBucket) (Conversation, error) {
+	conversation := Conversation{
+		ThreadID:     threadBucket.KeyString(),
+		MessageCount: threadBucket.DocCount,
+	}
+
+	firstReceived, err := threadBucket.Aggregations.Value("first_received")
+
+	if err != nil {
+		return Conversation{}, err
+	}
+
+	lastReceived, err := threadBucket.Aggregations.Value("last_received")
+
+	if err != nil {
+		return Conversation{}, err
+	}
+
+	conversation.FirstReceived = int(firstReceived)
+	conversation.LastReceived = int(lastReceived)
+
+	participants := map[string]bool{}
+
+	for _, participantAggregation := range []string{"senders", "recipients"} {
+		participantBuckets, err := threadBucket.Aggregations.Buckets(participantAggregation)
+
+		if err != nil {
+			return Conversation{}, err
+		}
+
+		for _, participantBucket := range participantBuckets {
+			participants[participantBucket.KeyString()] = true
+		}
+	}
+
+	for participant := range participants {
+		conversation.Participants = append(conversation.Participants, participant)
+	}
+
+	sort.Strings(conversation.Participants)
+
+	var latestHits struct {
+		Hits struct {
+			Hits []struct {
+				Source struct {
+					UUID    string `json:"uuid"`
+					Subject string `json:"subject"`
+				} `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+
+	if err := json.Unmarshal(threadBucket.Aggregations["latest"], &latestHits); err != nil {
+		return Conversation{}, err
+	}
+
+	if len(latestHits.Hits.Hits) > 0 {
+		conversation.LatestUUID = latestHits.Hits.Hits[0].Source.UUID
+		conversation.LatestSubject = latestHits.Hits.Hits[0].Source.Subject
+	}
+
+	return conversation, nil
+}
+
+// GetConversationMessages returns the messages of the thread ordered by received date, see GetConversations.
+func GetConversationMessages(projectUUID string, threadID string, userUUID string, database *pgx.Conn) ([]Message, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return nil, err
+	}
+
+	query := esquery.Bool().Filter(esquery.Term("project_uuid", projectUUID), esquery.Term("thread_id", threadID))
+
+	var messages []Message
+
+	err := forEachMessageBatch(query, func(batch []Message) error {
+		messages = append(messages, batch...)
+
+		return nil
+	}, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Received < messages[j].Received
+	})
+
+	return messages, nil
+}
+
+// ThreadProjectMessages sets the thread ID of the messages of the project which were indexed before threading.
+// Returns the amount of threaded messages.
+func ThreadProjectMessages(projectUUID string, userUUID string, database *pgx.Conn) (int, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionManageProject, database); err != nil {
+		return 0, err
+	}
+
+	if err := updateMessagesMapping(); err != nil {
+		return 0, err
+	}
+
+	query := esquery.Bool().
+		Filter(esquery.Term("project_uuid", projectUUID)).
+		MustNot(esquery.Exists("thread_id"))
+
+	var threaded int
+
+	err := forEachMessageBatch(query, func(messages []Message) error {
+		threadMessageUUIDs := map[string][]string{}
+
+		for _, message := range messages {
+			threadID := getThreadID(message)
+
+			threadMessageUUIDs[threadID] = append(threadMessageUUIDs[threadID], message.UUID)
+		}
+
+		for threadID, messageUUIDs := range threadMessageUUIDs {
+			if err := updateMessageFields(messageUUIDs, projectUUID, map[string]interface{}{"thread_id": threadID}); err != nil {
+				return err
+			}
+		}
+
+		threaded += len(messages)
+
+		return nil
+	}, database)
+
+	if err != nil {
+		return threaded, err
+	}
+
+	Logger.WithFields(LogFields{"project_uuid": projectUUID}).Infof("Threaded %d messages", threaded)
+
+	return threaded, nil
+}
@@ -0,0 +1,207 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/jackc/pgx/v4"
+	"github.com/mattevans/postmark-go"
+	"github.com/minio/minio-go/v7"
+	"github.com/segmentio/kafka-go"
+)
+
+// Core holds the clients of all dependencies.
+// The package level globals (Elasticsearch, KafkaWriter, MinIOClient, etc.) are set by New and are deprecated.
+// Database connections aren't shared since a *pgx.Conn isn't safe for concurrent use, see NewDatabase.
+type Core struct {
+	Config         Config
+	Elasticsearch  *elasticsearch.Client
+	KafkaWriter    *kafka.Writer
+	MinIOClient    *minio.Client
+	PostmarkClient *postmark.Client
+	Logger         StructuredLogger
+	// MailboxRateLimiter limits the requests of the IMAP and Microsoft Graph collectors.
+	MailboxRateLimiter *RateLimiter
+	// LowPriorityIngestLimiter limits the messages of low priority parse jobs while higher priority parse jobs are active.
+	LowPriorityIngestLimiter *RateLimiter
+	// Repositories, Messages and BlobStore replace the services in the lightweight mode (see Config.Lightweight), they are unset otherwise.
+	// Functions called without a database connection (nil) use these repositories.
+	Repositories Repositories
+	Messages     *MemoryMessageStore
+	BlobStore    BlobStore
+	// pseudonymizationKey is the decoded Config.PseudonymizationKey.
+	pseudonymizationKey []byte
+	// tokenEncryptionKey is the decoded Config.TokenEncryptionKey.
+	tokenEncryptionKey []byte
+	// keyWrappers are the Config.KeyWrappers or the decoded Config.MasterKeys.
+	keyWrappers []KeyWrapper
+	// sentimentProvider is the Config.SentimentProvider or the provider of Config.SentimentAPIURL, nil if disabled.
+	sentimentProvider SentimentProvider
+	// embeddingProvider is the Config.EmbeddingProvider or the provider of Config.EmbeddingAPIURL, nil if disabled.
+	embeddingProvider EmbeddingProvider
+	// urlReputationProvider is the Config.URLReputationProvider or the provider of Config.URLReputationAPIURL, nil if disabled.
+	urlReputationProvider URLReputationProvider
+}
+
+// New creates the clients from the configuration.
+// Returns an error instead of exiting the process so the package can be embedded, use LoadConfig to read goforensics.yaml.
+func New(config Config) (*Core, error) {
+	core, err := newCore(config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	core.setGlobals()
+
+	return core, nil
+}
+
+// NewDatabase creates a database connection, use a connection per goroutine.
+func (core *Core) NewDatabase(ctx context.Context) (*pgx.Conn, error) {
+	return pgx.Connect(ctx, core.Config.DatabaseURL)
+}
+
+// newCore creates the clients from the configuration.
+func newCore(config Config) (*Core, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	core := &Core{
+		Config:         config,
+		PostmarkClient: newPostmarkClient(config.PostmarkToken),
+		Logger:         Logger,
+	}
+
+	if config.Logger != nil {
+		core.Logger = config.Logger
+	}
+
+	if config.MailboxRateLimit.RequestsPerSecond > 0 {
+		core.MailboxRateLimiter = NewRateLimiter(config.MailboxRateLimit)
+	} else {
+		core.MailboxRateLimiter = NewRateLimiter(DefaultMailboxRateLimitOptions)
+	}
+
+	if config.LowPriorityIngestRate.RequestsPerSecond > 0 {
+		core.LowPriorityIngestLimiter = NewRateLimiter(config.LowPriorityIngestRate)
+	} else {
+		core.LowPriorityIngestLimiter = NewRateLimiter(DefaultLowPriorityIngestRateOptions)
+	}
+
+	var err error
+
+	core.pseudonymizationKey, err = decodePseudonymizationKey(config.PseudonymizationKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	core.tokenEncryptionKey, err = decodeEncryptionKey("token_encryption_key", config.TokenEncryptionKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	core.keyWrappers, err = newKeyWrappers(config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	core.sentimentProvider = newSentimentProvider(config)
+	core.embeddingProvider = newEmbeddingProvider(config)
+	core.urlReputationProvider = newURLReputationProvider(config)
+
+	if config.Lightweight {
+		if err := newLightweightCore(core); err != nil {
+			return nil, err
+		}
+
+		return core, nil
+	}
+
+	core.KafkaWriter, err = newKafkaWriter(config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	core.Elasticsearch, err = newElasticsearchClient(config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := createMessagesIndex(core.Elasticsearch, config.ElasticsearchIndex); err != nil {
+		return nil, err
+	}
+
+	if err := createContactsIndex(core.Elasticsearch); err != nil {
+		return nil, err
+	}
+
+	core.MinIOClient, err = newMinIOClient(config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return core, nil
+}
+
+// setGlobals sets the deprecated package level globals used by the package functions.
+func (core *Core) setGlobals() {
+	Logger = core.Logger
+	GoForensicsAPIURL = core.Config.GoForensicsAPIURL
+	DatabaseURL = core.Config.DatabaseURL
+	Elasticsearch = core.Elasticsearch
+	ElasticsearchIndex = core.Config.ElasticsearchIndex
+	KafkaWriter = core.KafkaWriter
+	KafkaBatchSize = getKafkaBatchOptions(core.Config).Size
+	MinIOClient = core.MinIOClient
+	MinIOBucketName = core.Config.MinIOBucket
+	MinIOBucketPerProject = core.Config.MinIOBucketPerProject
+	PostmarkClient = core.PostmarkClient
+	PseudonymizationKey = core.pseudonymizationKey
+	TokenEncryptionKey = core.tokenEncryptionKey
+	KeyWrappers = core.keyWrappers
+	SentimentAnalyzer = core.sentimentProvider
+	EmbeddingGenerator = core.embeddingProvider
+	URLReputationChecker = core.urlReputationProvider
+	SASLMechanisms = core.Config.SASLMechanisms
+	NotificationSender = core.Config.NotificationSender
+	BodyOffloadSize = core.Config.BodyOffloadSize
+	TempDirectory = core.Config.TempDirectory
+	TempQuota = core.Config.TempQuota
+	DefaultProjectQuota = core.Config.ProjectQuota
+	MailboxRateLimiter = core.MailboxRateLimiter
+	LowPriorityIngestLimiter = core.LowPriorityIngestLimiter
+	LowPriorityJobLimit = core.Config.LowPriorityJobLimit
+	ObjectStore = core.BlobStore
+	lightweightMessages = core.Messages
+	lightweightRepositories = nil
+
+	if core.Config.Lightweight {
+		lightweightRepositories = &core.Repositories
+	}
+	ExternalServiceRetryOptions = DefaultRetryOptions
+
+	if core.Config.Retry.MaxAttempts > 0 {
+		ExternalServiceRetryOptions = core.Config.Retry
+	}
+
+	setMailProviderCredentials(core.Config)
+}
+
+// Close flushes and closes the Kafka writer.
+func (core *Core) Close() error {
+	if core.KafkaWriter == nil {
+		return nil
+	}
+
+	return core.KafkaWriter.Close()
+}
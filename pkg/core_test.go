@@ -0,0 +1,139 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"errors"
+	"github.com/jackc/pgx/v4"
+	"testing"
+	"time"
+)
+
+// TestDefaultProjectQuota tests that the Config.ProjectQuota is enforced by the package functions for projects without their own quota.
+func TestDefaultProjectQuota(t *testing.T) {
+	core := useTestCore(t, Config{
+		ProjectQuota: ProjectQuota{MaxEvidenceSize: 1024},
+	})
+
+	if DefaultProjectQuota != core.Config.ProjectQuota {
+		t.Fatalf("DefaultProjectQuota = %+v, want %+v", DefaultProjectQuota, core.Config.ProjectQuota)
+	}
+
+	database := newTestDatabase(t)
+
+	projectUUID := NewUUID()
+	userUUID := NewUUID()
+
+	t.Cleanup(func() {
+		if err := deleteProjectRows(projectUUID, database); err != nil {
+			t.Errorf("Failed to remove test project: %s", err)
+		}
+	})
+
+	mustExec(t, database, "INSERT INTO project(uuid, name, creationDate) VALUES ($1, $2, $3)", projectUUID, "Default quota", time.Now().Unix())
+
+	if err := AddProjectUser(projectUUID, userUUID, RoleOwner, database); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CheckEvidenceQuota(2048, projectUUID, userUUID, database); !errors.Is(err, ErrEvidenceSizeQuotaExceeded) {
+		t.Errorf("CheckEvidenceQuota of a too large file returned %v, want ErrEvidenceSizeQuotaExceeded", err)
+	}
+
+	if err := CheckEvidenceQuota(512, projectUUID, userUUID, database); err != nil {
+		t.Errorf("CheckEvidenceQuota of a small file returned %v, want nil", err)
+	}
+}
+
+// TestLowPriorityJobLimit tests that the package job worker limits the running low priority jobs to the Config.LowPriorityJobLimit.
+func TestLowPriorityJobLimit(t *testing.T) {
+	core := useTestCore(t, Config{
+		LowPriorityJobLimit:   1,
+		LowPriorityIngestRate: RateLimitOptions{RequestsPerSecond: 10, Burst: 5},
+	})
+
+	if LowPriorityJobLimit != core.Config.LowPriorityJobLimit {
+		t.Fatalf("LowPriorityJobLimit = %d, want %d", LowPriorityJobLimit, core.Config.LowPriorityJobLimit)
+	}
+
+	if LowPriorityIngestLimiter != core.LowPriorityIngestLimiter {
+		t.Fatal("LowPriorityIngestLimiter isn't the limiter of the Config.LowPriorityIngestRate")
+	}
+
+	database := newTestDatabase(t)
+
+	projectUUID := NewUUID()
+
+	t.Cleanup(func() {
+		if err := deleteProjectRows(projectUUID, database); err != nil {
+			t.Errorf("Failed to remove test project: %s", err)
+		}
+	})
+
+	mustExec(t, database, "INSERT INTO project(uuid, name, creationDate) VALUES ($1, $2, $3)", projectUUID, "Low priority job limit", time.Now().Unix())
+
+	// Purge jobs of a project which isn't expired, these jobs aren't run.
+	newJob := func(status string) Job {
+		return Job{
+			UUID:         NewUUID(),
+			ProjectUUID:  projectUUID,
+			Type:         JobTypePurgeProject,
+			Status:       status,
+			Priority:     JobPriorityLow,
+			Parameters:   "{}",
+			MaxAttempts:  jobMaximumAttempts,
+			CreationDate: int(time.Now().Unix()),
+		}
+	}
+
+	runningJob := newJob(JobStatusRunning)
+	queuedJob := newJob(JobStatusQueued)
+
+	for _, job := range []Job{runningJob, queuedJob} {
+		if err := job.Save(database); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if job, err := claimNextJob(database); err == nil && job.UUID == queuedJob.UUID {
+		t.Fatal("claimed a low priority job while the limit of low priority jobs is running")
+	} else if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		t.Fatal(err)
+	}
+
+	mustExec(t, database, "UPDATE jobs SET status = $1 WHERE uuid = $2", JobStatusCompleted, runningJob.UUID)
+
+	if job, err := claimNextJob(database); err != nil || job.UUID != queuedJob.UUID {
+		t.Fatalf("claimed %s (%v) after the running job completed, want %s", job.UUID, err, queuedJob.UUID)
+	}
+}
+
+// useTestCore creates a lightweight Core with the configuration like New, so its settings are used by the package functions.
+// The globals set by New are restored when the test finishes, the globals of the services stay unset in the lightweight mode.
+func useTestCore(t *testing.T, config Config) *Core {
+	t.Helper()
+
+	config.Lightweight = true
+	config.BlobDirectory = t.TempDir()
+
+	previousObjectStore, previousTempDirectory, previousTempQuota := ObjectStore, TempDirectory, TempQuota
+	previousMailboxRateLimiter, previousDefaultProjectQuota := MailboxRateLimiter, DefaultProjectQuota
+	previousLowPriorityIngestLimiter, previousLowPriorityJobLimit := LowPriorityIngestLimiter, LowPriorityJobLimit
+	previousMessages, previousRepositories := lightweightMessages, lightweightRepositories
+
+	t.Cleanup(func() {
+		ObjectStore, TempDirectory, TempQuota = previousObjectStore, previousTempDirectory, previousTempQuota
+		MailboxRateLimiter, DefaultProjectQuota = previousMailboxRateLimiter, previousDefaultProjectQuota
+		LowPriorityIngestLimiter, LowPriorityJobLimit = previousLowPriorityIngestLimiter, previousLowPriorityJobLimit
+		lightweightMessages, lightweightRepositories = previousMessages, previousRepositories
+	})
+
+	core, err := New(config)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return core
+}
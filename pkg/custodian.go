@@ -0,0 +1,497 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aquasecurity/esquery"
+	"github.com/jackc/pgx/v4"
+	"sort"
+	"strings"
+)
+
+// Audit log actions of the custodian configuration.
+const (
+	AuditActionSetCustodianDomains   = "set_custodian_domains"
+	AuditActionSetCustodianAddresses = "set_custodian_addresses"
+)
+
+// CustodianConfiguration represents the internal domains (e.g. the company domains) and the addresses of the custodians of a project.
+// Addresses are used for custodians outside the internal domains, e.g. a personal mailbox.
+type CustodianConfiguration struct {
+	Domains   []string `json:"domains"`
+	Addresses []string `json:"addresses"`
+}
+
+// ErrNoCustodianConfiguration is returned by GetExternalCommunicationReport if the project has no custodian domains or addresses.
+var ErrNoCustodianConfiguration = errors.New("project has no custodian domains or addresses")
+
+// isEmpty returns true if there are no custodian domains or addresses.
+func (custodians CustodianConfiguration) isEmpty() bool {
+	return len(custodians.Domains) == 0 && len(custodians.Addresses) == 0
+}
+
+// isCustodianAddress returns true if the address is a custodian address or in a custodian domain.
+func (custodians CustodianConfiguration) isCustodianAddress(address string) bool {
+	address = strings.ToLower(strings.TrimSpace(address))
+
+	if address == "" {
+		return false
+	}
+
+	for _, custodianAddress := range custodians.Addresses {
+		if address == strings.ToLower(custodianAddress) {
+			return true
+		}
+	}
+
+	domain := getAddressDomain(address)
+
+	for _, custodianDomain := range custodians.Domains {
+		if domain != "" && domain == strings.ToLower(custodianDomain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetCustodianConfiguration returns the custodian domains and addresses of the project.
+func GetCustodianConfiguration(projectUUID string, userUUID string, database *pgx.Conn) (CustodianConfiguration, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return CustodianConfiguration{}, err
+	}
+
+	return getCustodianConfiguration(projectUUID, database)
+}
+
+// getCustodianConfiguration returns the custodian domains and addresses of the project.
+func getCustodianConfiguration(projectUUID string, database *pgx.Conn) (CustodianConfiguration, error) {
+	custodianDomains, err := getCustodianDomains(projectUUID, database)
+
+	if err != nil {
+		return CustodianConfiguration{}, err
+	}
+
+	custodianAddresses, err := getCustodianAddresses(projectUUID, database)
+
+	if err != nil {
+		return CustodianConfiguration{}, err
+	}
+
+	return CustodianConfiguration{
+		Domains:   custodianDomains,
+		Addresses: custodianAddresses,
+	}, nil
+}
+
+// GetCustodianDomains returns the email domains of the custodians of the project (e.g. the company domains).
+func GetCustodianDomains(projectUUID string, userUUID string, database *pgx.Conn) ([]string, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return nil, err
+	}
+
+	return getCustodianDomains(projectUUID, database)
+}
+
+// getCustodianDomains returns the email domains of the custodians of the project.
+func getCustodianDomains(projectUUID string, database *pgx.Conn) ([]string, error) {
+	preparedStatement := `
+	SELECT domain FROM custodian_domains WHERE projectUUID = $1 ORDER BY domain ASC
+	`
+	rows, err := database.Query(context.Background(), preparedStatement, projectUUID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var custodianDomains []string
+
+	for rows.Next() {
+		var custodianDomain string
+
+		if err := rows.Scan(&custodianDomain); err != nil {
+			return nil, err
+		}
+
+		custodianDomains = append(custodianDomains, custodianDomain)
+	}
+
+	rows.Close()
+
+	return custodianDomains, rows.Err()
+}
+
+// SetCustodianDomains replaces the email domains of the custodians of the project.
+// The direction (inbound, outbound, internal or external) of all messages of the project is updated,
+// newly parsed evidence uses the custodian domains while parsing.
+func SetCustodianDomains(custodianDomains []string, projectUUID string, userUUID string, database *pgx.Conn) error {
+	if err := CheckPermission(userUUID, projectUUID, ActionManageEvidence, database); err != nil {
+		return err
+	}
+
+	var normalizedDomains []string
+
+	for _, custodianDomain := range custodianDomains {
+		custodianDomain = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(custodianDomain, "@")))
+
+		if custodianDomain != "" {
+			normalizedDomains = append(normalizedDomains, custodianDomain)
+		}
+	}
+
+	preparedStatement := `
+	DELETE FROM custodian_domains WHERE projectUUID = $1
+	`
+	_, err := database.Exec(context.Background(), preparedStatement, projectUUID)
+
+	if err != nil {
+		return err
+	}
+
+	for _, custodianDomain := range normalizedDomains {
+		preparedStatement := `
+		INSERT INTO custodian_domains(projectUUID, domain) VALUES ($1, $2) ON CONFLICT DO NOTHING
+		`
+		_, err := database.Exec(context.Background(), preparedStatement, projectUUID, custodianDomain)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := AddAuditLog(projectUUID, userUUID, AuditActionSetCustodianDomains, strings.Join(normalizedDomains, ", "), database); err != nil {
+		return err
+	}
+
+	return updateProjectMessageDirections(projectUUID, database)
+}
+
+// AddCustodianDomain adds the email domain to the custodian domains of the project, see SetCustodianDomains.
+func AddCustodianDomain(custodianDomain string, projectUUID string, userUUID string, database *pgx.Conn) error {
+	if err := CheckPermission(userUUID, projectUUID, ActionManageEvidence, database); err != nil {
+		return err
+	}
+
+	custodianDomains, err := getCustodianDomains(projectUUID, database)
+
+	if err != nil {
+		return err
+	}
+
+	return SetCustodianDomains(append(custodianDomains, custodianDomain), projectUUID, userUUID, database)
+}
+
+// RemoveCustodianDomain removes the email domain from the custodian domains of the project, see SetCustodianDomains.
+func RemoveCustodianDomain(custodianDomain string, projectUUID string, userUUID string, database *pgx.Conn) error {
+	if err := CheckPermission(userUUID, projectUUID, ActionManageEvidence, database); err != nil {
+		return err
+	}
+
+	if err := checkProjectNotOnHold(projectUUID, userUUID, AuditActionRemoveCustodianDomain, database); err != nil {
+		return err
+	}
+
+	custodianDomains, err := getCustodianDomains(projectUUID, database)
+
+	if err != nil {
+		return err
+	}
+
+	custodianDomain = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(custodianDomain, "@")))
+
+	var remainingDomains []string
+
+	for _, existingDomain := range custodianDomains {
+		if existingDomain != custodianDomain {
+			remainingDomains = append(remainingDomains, existingDomain)
+		}
+	}
+
+	return SetCustodianDomains(remainingDomains, projectUUID, userUUID, database)
+}
+
+// GetCustodianAddresses returns the email addresses of the custodians of the project.
+func GetCustodianAddresses(projectUUID string, userUUID string, database *pgx.Conn) ([]string, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return nil, err
+	}
+
+	return getCustodianAddresses(projectUUID, database)
+}
+
+// getCustodianAddresses returns the email addresses of the custodians of the project.
+func getCustodianAddresses(projectUUID string, database *pgx.Conn) ([]string, error) {
+	preparedStatement := `
+	SELECT address FROM custodian_addresses WHERE projectUUID = $1 ORDER BY address ASC
+	`
+	rows, err := database.Query(context.Background(), preparedStatement, projectUUID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var custodianAddresses []string
+
+	for rows.Next() {
+		var custodianAddress string
+
+		if err := rows.Scan(&custodianAddress); err != nil {
+			return nil, err
+		}
+
+		custodianAddresses = append(custodianAddresses, custodianAddress)
+	}
+
+	rows.Close()
+
+	return custodianAddresses, rows.Err()
+}
+
+// SetCustodianAddresses replaces the email addresses of the custodians of the project, e.g. custodians outside the custodian domains.
+// Like SetCustodianDomains the direction of all messages of the project is updated.
+func SetCustodianAddresses(custodianAddresses []string, projectUUID string, userUUID string, database *pgx.Conn) error {
+	if err := CheckPermission(userUUID, projectUUID, ActionManageEvidence, database); err != nil {
+		return err
+	}
+
+	var normalizedAddresses []string
+
+	for _, custodianAddress := range custodianAddresses {
+		custodianAddress = strings.ToLower(strings.TrimSpace(custodianAddress))
+
+		if custodianAddress == "" {
+			continue
+		}
+
+		if getAddressDomain(custodianAddress) == "" {
+			return fmt.Errorf("invalid custodian address: %s", custodianAddress)
+		}
+
+		normalizedAddresses = append(normalizedAddresses, custodianAddress)
+	}
+
+	preparedStatement := `
+	DELETE FROM custodian_addresses WHERE projectUUID = $1
+	`
+	_, err := database.Exec(context.Background(), preparedStatement, projectUUID)
+
+	if err != nil {
+		return err
+	}
+
+	for _, custodianAddress := range normalizedAddresses {
+		preparedStatement := `
+		INSERT INTO custodian_addresses(projectUUID, address) VALUES ($1, $2) ON CONFLICT DO NOTHING
+		`
+		_, err := database.Exec(context.Background(), preparedStatement, projectUUID, custodianAddress)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := AddAuditLog(projectUUID, userUUID, AuditActionSetCustodianAddresses, strings.Join(normalizedAddresses, ", "), database); err != nil {
+		return err
+	}
+
+	return updateProjectMessageDirections(projectUUID, database)
+}
+
+// AddCustodianAddress adds the email address to the custodian addresses of the project, see SetCustodianAddresses.
+func AddCustodianAddress(custodianAddress string, projectUUID string, userUUID string, database *pgx.Conn) error {
+	if err := CheckPermission(userUUID, projectUUID, ActionManageEvidence, database); err != nil {
+		return err
+	}
+
+	custodianAddresses, err := getCustodianAddresses(projectUUID, database)
+
+	if err != nil {
+		return err
+	}
+
+	return SetCustodianAddresses(append(custodianAddresses, custodianAddress), projectUUID, userUUID, database)
+}
+
+// RemoveCustodianAddress removes the email address from the custodian addresses of the project, see SetCustodianAddresses.
+func RemoveCustodianAddress(custodianAddress string, projectUUID string, userUUID string, database *pgx.Conn) error {
+	if err := CheckPermission(userUUID, projectUUID, ActionManageEvidence, database); err != nil {
+		return err
+	}
+
+	if err := checkProjectNotOnHold(projectUUID, userUUID, AuditActionRemoveCustodianAddress, database); err != nil {
+		return err
+	}
+
+	custodianAddresses, err := getCustodianAddresses(projectUUID, database)
+
+	if err != nil {
+		return err
+	}
+
+	custodianAddress = strings.ToLower(strings.TrimSpace(custodianAddress))
+
+	var remainingAddresses []string
+
+	for _, existingAddress := range custodianAddresses {
+		if existingAddress != custodianAddress {
+			remainingAddresses = append(remainingAddresses, existingAddress)
+		}
+	}
+
+	return SetCustodianAddresses(remainingAddresses, projectUUID, userUUID, database)
+}
+
+// updateProjectMessageDirections sets the direction of all messages of the project relative to its custodian configuration.
+func updateProjectMessageDirections(projectUUID string, database *pgx.Conn) error {
+	custodians, err := getCustodianConfiguration(projectUUID, database)
+
+	if err != nil {
+		return err
+	}
+
+	return updateMessageDirections(projectUUID, custodians, database)
+}
+
+// updateMessageDirections sets the direction of all messages of the project relative to the custodian domains and addresses.
+func updateMessageDirections(projectUUID string, custodians CustodianConfiguration, database *pgx.Conn) error {
+	query := esquery.Bool().Filter(esquery.Term("project_uuid", projectUUID))
+
+	return forEachMessageBatch(query, func(messages []Message) error {
+		messageUUIDsByDirection := make(map[string][]string)
+
+		for _, message := range messages {
+			direction := getMessageDirection(message, custodians)
+
+			messageUUIDsByDirection[direction] = append(messageUUIDsByDirection[direction], message.UUID)
+		}
+
+		for direction, messageUUIDs := range messageUUIDsByDirection {
+			if err := updateMessageFields(messageUUIDs, projectUUID, map[string]interface{}{"direction": direction}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}, database)
+}
+
+// ExternalCommunicationReport represents the communication of the custodians with the outside, see GetExternalCommunicationReport.
+type ExternalCommunicationReport struct {
+	Custodians           CustodianConfiguration `json:"custodians"`
+	DirectionCounts      map[string]int         `json:"direction_counts"` // The amount of messages per direction, e.g. MessageDirectionOutbound.
+	TopExternalDomains   []TermCount            `json:"top_external_domains"`
+	TopExternalAddresses []TermCount            `json:"top_external_addresses"`
+}
+
+// External communication report limits.
+const (
+	// externalCommunicationTopSize defines the amount of top external domains and addresses.
+	externalCommunicationTopSize = 25
+	// externalCommunicationCandidateSize defines the amount of domains and addresses aggregated before the custodians are removed.
+	externalCommunicationCandidateSize = 1000
+)
+
+// GetExternalCommunicationReport returns the amount of messages per direction and the external domains and addresses
+// the custodians communicated with most (inbound and outbound messages).
+// Returns ErrNoCustodianConfiguration if the project has no custodian domains or addresses.
+func GetExternalCommunicationReport(projectUUID string, userUUID string, database *pgx.Conn) (ExternalCommunicationReport, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return ExternalCommunicationReport{}, err
+	}
+
+	custodians, err := getCustodianConfiguration(projectUUID, database)
+
+	if err != nil {
+		return ExternalCommunicationReport{}, err
+	}
+
+	if custodians.isEmpty() {
+		return ExternalCommunicationReport{}, ErrNoCustodianConfiguration
+	}
+
+	aggregations, _, err := runAggregationSearch(
+		esquery.Bool().Must(esquery.Term("project_uuid", projectUUID)),
+		esquery.TermsAgg("directions", "direction").Size(4),
+		esquery.FilterAgg("external", esquery.Terms("direction", MessageDirectionInbound, MessageDirectionOutbound)).Aggs(
+			esquery.TermsAgg("domains", "domains").Size(externalCommunicationCandidateSize),
+			esquery.TermsAgg("senders", "from_addresses").Size(externalCommunicationCandidateSize),
+			esquery.TermsAgg("recipients", "recipient_addresses").Size(externalCommunicationCandidateSize),
+		),
+	)
+
+	if err != nil {
+		return ExternalCommunicationReport{}, err
+	}
+
+	report := ExternalCommunicationReport{
+		Custodians:      custodians,
+		DirectionCounts: map[string]int{},
+	}
+
+	directionCounts, err := getTermCounts(aggregations, "directions")
+
+	if err != nil {
+		return ExternalCommunicationReport{}, err
+	}
+
+	for _, directionCount := range directionCounts {
+		report.DirectionCounts[directionCount.Term] = directionCount.Count
+	}
+
+	externalBucket, err := aggregations.Bucket("external")
+
+	if err != nil {
+		return ExternalCommunicationReport{}, err
+	}
+
+	domainCounts, err := getTermCounts(externalBucket.Aggregations, "domains")
+
+	if err != nil {
+		return ExternalCommunicationReport{}, err
+	}
+
+	for _, domainCount := range domainCounts {
+		// The domain itself isn't an address, check it as the domain of an address.
+		if !custodians.isCustodianAddress("@"+domainCount.Term) && len(report.TopExternalDomains) < externalCommunicationTopSize {
+			report.TopExternalDomains = append(report.TopExternalDomains, domainCount)
+		}
+	}
+
+	addressCounts := map[string]int{}
+
+	for _, addressAggregation := range []string{"senders", "recipients"} {
+		counts, err := getTermCounts(externalBucket.Aggregations, addressAggregation)
+
+		if err != nil {
+			return ExternalCommunicationReport{}, err
+		}
+
+		for _, count := range counts {
+			if !custodians.isCustodianAddress(count.Term) {
+				addressCounts[count.Term] += count.Count
+			}
+		}
+	}
+
+	for address, count := range addressCounts {
+		report.TopExternalAddresses = append(report.TopExternalAddresses, TermCount{Term: address, Count: count})
+	}
+
+	sort.Slice(report.TopExternalAddresses, func(i, j int) bool {
+		if report.TopExternalAddresses[i].Count == report.TopExternalAddresses[j].Count {
+			return report.TopExternalAddresses[i].Term < report.TopExternalAddresses[j].Term
+		}
+
+		return report.TopExternalAddresses[i].Count > report.TopExternalAddresses[j].Count
+	})
+
+	if len(report.TopExternalAddresses) > externalCommunicationTopSize {
+		report.TopExternalAddresses = report.TopExternalAddresses[:externalCommunicationTopSize]
+	}
+
+	return report, nil
+}
@@ -6,40 +6,64 @@ package core
 import (
 	"context"
 	"github.com/jackc/pgx/v4"
-	"github.com/spf13/viper"
 )
 
 // DatabaseURL defines our PostgreSQL database URL.
+//
+// Deprecated: use Core.Config.DatabaseURL.
 var DatabaseURL string
 
-func init() {
-	if viper.IsSet("database_url") {
-		DatabaseURL = viper.GetString("database_url")
-	} else {
-		Logger.Fatal("unset database_url configuration variable")
-	}
-}
-
-// NewDatabase creates our Cassandra database session.
+// NewDatabase creates our PostgreSQL database connection.
+//
+// Deprecated: use Core.NewDatabase.
 func NewDatabase() (*pgx.Conn, error) {
-	connection, err := pgx.Connect(context.Background(), DatabaseURL)
-
-	if err != nil {
-		Logger.Fatalf("Failed to connect to database: %s", err)
-	}
-
-	return connection, nil
+	return pgx.Connect(context.Background(), DatabaseURL)
 }
 
 // CreateDatabaseTables creates all our database tables.
+// The tables of existing databases are migrated afterwards, so the migrations must be idempotent.
 func CreateDatabaseTables(database *pgx.Conn) error {
 	tables := []string{
 		"CREATE TABLE IF NOT EXISTS project(uuid TEXT PRIMARY KEY, name TEXT, creationDate INTEGER)",
-		"CREATE TABLE IF NOT EXISTS project_user_junction(id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL, projectUUID TEXT NOT NULL REFERENCES project(uuid), userUUID TEXT NOT NULL)",
-		"CREATE TABLE IF NOT EXISTS evidence(uuid TEXT PRIMARY KEY NOT NULL, fileHash TEXT NOT NULL, fileName TEXT NOT NULL, isParsed BOOLEAN)",
+		"CREATE TABLE IF NOT EXISTS project_user_junction(id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL, projectUUID TEXT NOT NULL REFERENCES project(uuid), userUUID TEXT NOT NULL, role TEXT NOT NULL)",
+		"CREATE TABLE IF NOT EXISTS evidence(uuid TEXT PRIMARY KEY NOT NULL, fileHash TEXT NOT NULL, fileName TEXT NOT NULL, fileSize BIGINT, isParsed BOOLEAN, parser TEXT)",
 		"CREATE TABLE IF NOT EXISTS project_evidence_junction(id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL, projectUUID TEXT NOT NULL REFERENCES project(uuid), evidenceUUID TEXT NOT NULL REFERENCES evidence(uuid))",
-		"CREATE TABLE IF NOT EXISTS tree_node(folderUUID TEXT PRIMARY KEY NOT NULL, projectUUID TEXT NOT NULL REFERENCES project(uuid), evidenceUUID TEXT NOT NULL REFERENCES evidence(uuid), title TEXT, parentFolderUUID TEXT)",
-		"CREATE TABLE IF NOT EXISTS message_metadata(messageUUID TEXT PRIMARY KEY, projectUUID TEXT NOT NULL REFERENCES project(uuid), isBookmarked BOOLEAN, tag TEXT, comment TEXT)",
+		"CREATE TABLE IF NOT EXISTS tree_nodes(folderUUID TEXT PRIMARY KEY NOT NULL, projectUUID TEXT NOT NULL REFERENCES project(uuid), evidenceUUID TEXT NOT NULL REFERENCES evidence(uuid), title TEXT, parent TEXT)",
+		"CREATE TABLE IF NOT EXISTS message_metadata(messageUUID TEXT PRIMARY KEY, projectUUID TEXT NOT NULL REFERENCES project(uuid), isBookmarked BOOLEAN, tag TEXT)",
+		"CREATE TABLE IF NOT EXISTS comments(uuid TEXT PRIMARY KEY NOT NULL, messageUUID TEXT NOT NULL, projectUUID TEXT NOT NULL REFERENCES project(uuid), parentCommentUUID TEXT, authorUUID TEXT NOT NULL, body TEXT NOT NULL, creationDate INTEGER)",
+		"CREATE TABLE IF NOT EXISTS tags(uuid TEXT PRIMARY KEY NOT NULL, projectUUID TEXT NOT NULL REFERENCES project(uuid), name TEXT NOT NULL, color TEXT, description TEXT)",
+		"CREATE TABLE IF NOT EXISTS message_tags(messageUUID TEXT NOT NULL, tagUUID TEXT NOT NULL REFERENCES tags(uuid), projectUUID TEXT NOT NULL REFERENCES project(uuid), PRIMARY KEY(messageUUID, tagUUID))",
+		"CREATE TABLE IF NOT EXISTS message_review(messageUUID TEXT PRIMARY KEY NOT NULL, projectUUID TEXT NOT NULL REFERENCES project(uuid), reviewerUUID TEXT, status TEXT NOT NULL, reviewedBy TEXT, reviewedDate INTEGER)",
+		"CREATE TABLE IF NOT EXISTS retention_policy(projectUUID TEXT PRIMARY KEY NOT NULL REFERENCES project(uuid), isOnHold BOOLEAN NOT NULL, holdReason TEXT, retentionDays INTEGER NOT NULL)",
+		"CREATE TABLE IF NOT EXISTS audit_log(uuid TEXT PRIMARY KEY NOT NULL, projectUUID TEXT NOT NULL, userUUID TEXT, action TEXT NOT NULL, details TEXT, creationDate INTEGER)",
+		"CREATE TABLE IF NOT EXISTS search_history(uuid TEXT PRIMARY KEY NOT NULL, projectUUID TEXT NOT NULL REFERENCES project(uuid), userUUID TEXT, query TEXT, filters TEXT, resultCount INTEGER, creationDate INTEGER)",
+		"CREATE TABLE IF NOT EXISTS pseudonyms(projectUUID TEXT NOT NULL REFERENCES project(uuid), kind TEXT NOT NULL, valueHash TEXT NOT NULL, encryptedValue TEXT NOT NULL, pseudonym TEXT NOT NULL, PRIMARY KEY(projectUUID, kind, valueHash), UNIQUE(projectUUID, pseudonym))",
+		"CREATE TABLE IF NOT EXISTS jobs(uuid TEXT PRIMARY KEY NOT NULL, projectUUID TEXT NOT NULL REFERENCES project(uuid), userUUID TEXT NOT NULL, type TEXT NOT NULL, status TEXT NOT NULL, priority TEXT NOT NULL, parameters TEXT NOT NULL, progress INTEGER NOT NULL, progressEvent TEXT NOT NULL, attempts INTEGER NOT NULL, maxAttempts INTEGER NOT NULL, error TEXT NOT NULL, result TEXT NOT NULL, creationDate INTEGER, startDate INTEGER, endDate INTEGER)",
+		"CREATE TABLE IF NOT EXISTS webhooks(uuid TEXT PRIMARY KEY NOT NULL, projectUUID TEXT NOT NULL REFERENCES project(uuid), url TEXT NOT NULL, secret TEXT NOT NULL, events TEXT NOT NULL, creationDate INTEGER)",
+		"CREATE TABLE IF NOT EXISTS notification_preferences(userUUID TEXT PRIMARY KEY NOT NULL, email TEXT NOT NULL, events TEXT NOT NULL)",
+		"CREATE TABLE IF NOT EXISTS attachment_objects(projectUUID TEXT NOT NULL REFERENCES project(uuid), hash TEXT NOT NULL, size BIGINT NOT NULL, referenceCount INTEGER NOT NULL, PRIMARY KEY (projectUUID, hash))",
+		"CREATE TABLE IF NOT EXISTS data_keys(scope TEXT PRIMARY KEY NOT NULL, keyID TEXT NOT NULL, wrappedKey TEXT NOT NULL, objectEncryption BOOLEAN NOT NULL, creationDate INTEGER)",
+		"CREATE TABLE IF NOT EXISTS project_buckets(projectUUID TEXT PRIMARY KEY NOT NULL REFERENCES project(uuid), bucket TEXT NOT NULL, creationDate INTEGER)",
+		"CREATE TABLE IF NOT EXISTS users(uuid TEXT PRIMARY KEY NOT NULL, email TEXT NOT NULL, displayName TEXT NOT NULL, role TEXT NOT NULL, lastSeen INTEGER, creationDate INTEGER)",
+		"CREATE TABLE IF NOT EXISTS project_templates(uuid TEXT PRIMARY KEY NOT NULL, name TEXT NOT NULL, description TEXT NOT NULL, configuration TEXT NOT NULL, creationDate INTEGER)",
+		"CREATE TABLE IF NOT EXISTS project_report_branding(projectUUID TEXT PRIMARY KEY NOT NULL REFERENCES project(uuid), branding TEXT NOT NULL)",
+		"CREATE TABLE IF NOT EXISTS evidence_custodians(projectUUID TEXT NOT NULL REFERENCES project(uuid), evidenceUUID TEXT NOT NULL, custodian TEXT NOT NULL, PRIMARY KEY (projectUUID, evidenceUUID))",
+		"CREATE TABLE IF NOT EXISTS parse_errors(uuid TEXT PRIMARY KEY NOT NULL, projectUUID TEXT NOT NULL REFERENCES project(uuid), evidenceUUID TEXT NOT NULL, item TEXT NOT NULL, error TEXT NOT NULL, creationDate INTEGER)",
+		"CREATE TABLE IF NOT EXISTS parsed_message_counts(folderUUID TEXT PRIMARY KEY NOT NULL, projectUUID TEXT NOT NULL REFERENCES project(uuid), evidenceUUID TEXT NOT NULL, parsed INTEGER NOT NULL)",
+		"CREATE TABLE IF NOT EXISTS custodian_domains(projectUUID TEXT NOT NULL REFERENCES project(uuid), domain TEXT NOT NULL, PRIMARY KEY (projectUUID, domain))",
+		"CREATE TABLE IF NOT EXISTS custodian_addresses(projectUUID TEXT NOT NULL REFERENCES project(uuid), address TEXT NOT NULL, PRIMARY KEY (projectUUID, address))",
+		"CREATE TABLE IF NOT EXISTS smart_folders(uuid TEXT PRIMARY KEY NOT NULL, projectUUID TEXT NOT NULL REFERENCES project(uuid), title TEXT NOT NULL, query TEXT NOT NULL, filters TEXT NOT NULL, creationDate INTEGER)",
+		"CREATE TABLE IF NOT EXISTS collections(uuid TEXT PRIMARY KEY NOT NULL, projectUUID TEXT NOT NULL REFERENCES project(uuid), userUUID TEXT NOT NULL, provider TEXT NOT NULL, account TEXT NOT NULL, status TEXT NOT NULL, error TEXT NOT NULL, mailboxes TEXT NOT NULL, startDate INTEGER, endDate INTEGER)",
+		"CREATE TABLE IF NOT EXISTS oauth2_tokens(userUUID TEXT NOT NULL, provider TEXT NOT NULL, encryptedToken TEXT NOT NULL, PRIMARY KEY(userUUID, provider))",
+		"CREATE TABLE IF NOT EXISTS hash_lists(uuid TEXT PRIMARY KEY NOT NULL, projectUUID TEXT NOT NULL REFERENCES project(uuid), name TEXT NOT NULL, creationDate INTEGER)",
+		"CREATE TABLE IF NOT EXISTS project_timezones(projectUUID TEXT PRIMARY KEY NOT NULL REFERENCES project(uuid), timezone TEXT NOT NULL)",
+		"CREATE TABLE IF NOT EXISTS hash_list_entries(hashListUUID TEXT NOT NULL REFERENCES hash_lists(uuid), projectUUID TEXT NOT NULL REFERENCES project(uuid), hash TEXT NOT NULL, PRIMARY KEY (hashListUUID, hash))",
+		"CREATE TABLE IF NOT EXISTS message_privilege(messageUUID TEXT PRIMARY KEY NOT NULL, projectUUID TEXT NOT NULL REFERENCES project(uuid), designation TEXT NOT NULL, basis TEXT NOT NULL, designatedBy TEXT NOT NULL, designatedDate INTEGER)",
+		"CREATE TABLE IF NOT EXISTS binders(uuid TEXT PRIMARY KEY NOT NULL, projectUUID TEXT NOT NULL REFERENCES project(uuid), name TEXT NOT NULL, description TEXT NOT NULL, isDefault BOOLEAN NOT NULL, creationDate INTEGER)",
+		"CREATE TABLE IF NOT EXISTS binder_messages(binderUUID TEXT NOT NULL REFERENCES binders(uuid), messageUUID TEXT NOT NULL, projectUUID TEXT NOT NULL REFERENCES project(uuid), position INTEGER NOT NULL, PRIMARY KEY (binderUUID, messageUUID))",
+		"CREATE TABLE IF NOT EXISTS journal_entries(uuid TEXT PRIMARY KEY NOT NULL, projectUUID TEXT NOT NULL REFERENCES project(uuid), authorUUID TEXT NOT NULL, body TEXT NOT NULL, messageUUIDs TEXT NOT NULL, evidenceUUIDs TEXT NOT NULL, creationDate INTEGER, modificationDate INTEGER)",
+		"CREATE TABLE IF NOT EXISTS batch_operations(uuid TEXT PRIMARY KEY NOT NULL, projectUUID TEXT NOT NULL REFERENCES project(uuid), userUUID TEXT NOT NULL, type TEXT NOT NULL, target TEXT NOT NULL, source TEXT NOT NULL, changes TEXT NOT NULL, creationDate INTEGER, undoneDate INTEGER)",
+		"CREATE TABLE IF NOT EXISTS project_quotas(projectUUID TEXT PRIMARY KEY NOT NULL REFERENCES project(uuid), maxEvidenceSize BIGINT NOT NULL, maxStorage BIGINT NOT NULL, maxMessages BIGINT NOT NULL)",
 	}
 
 	for _, table := range tables {
@@ -50,5 +74,23 @@ func CreateDatabaseTables(database *pgx.Conn) error {
 		}
 	}
 
+	migrations := []string{
+		"DO $$ BEGIN IF to_regclass('tree_node') IS NOT NULL THEN INSERT INTO tree_nodes(folderUUID, projectUUID, evidenceUUID, title, parent) SELECT folderUUID, projectUUID, evidenceUUID, title, parentFolderUUID FROM tree_node ON CONFLICT DO NOTHING; DROP TABLE tree_node; END IF; END $$",
+		"ALTER TABLE project_user_junction ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'owner'",
+		"DO $$ BEGIN IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'message_metadata' AND column_name = 'comment') THEN INSERT INTO comments(uuid, messageUUID, projectUUID, parentCommentUUID, authorUUID, body, creationDate) SELECT md5(messageUUID || ':comment')::uuid::text, messageUUID, projectUUID, '', '', comment, 0 FROM message_metadata WHERE comment != '' ON CONFLICT DO NOTHING; ALTER TABLE message_metadata DROP COLUMN comment; END IF; END $$",
+		"ALTER TABLE evidence ADD COLUMN IF NOT EXISTS fileSize BIGINT DEFAULT 0",
+		"ALTER TABLE jobs ADD COLUMN IF NOT EXISTS progressEvent TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE evidence ADD COLUMN IF NOT EXISTS parser TEXT",
+		"ALTER TABLE jobs ADD COLUMN IF NOT EXISTS priority TEXT NOT NULL DEFAULT 'normal'",
+	}
+
+	for _, migration := range migrations {
+		_, err := database.Exec(context.Background(), migration)
+
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
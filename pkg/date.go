@@ -0,0 +1,225 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// obsoleteZones maps the obsolete zone names of RFC 5322 (section 4.3) to numeric offsets.
+// Military zones are unreliable and treated as "-0000" (unknown offset) as RFC 5322 recommends.
+var obsoleteZones = map[string]string{
+	"UT":  "+0000",
+	"UTC": "+0000",
+	"GMT": "+0000",
+	"Z":   "+0000",
+	"EST": "-0500",
+	"EDT": "-0400",
+	"CST": "-0600",
+	"CDT": "-0500",
+	"MST": "-0700",
+	"MDT": "-0600",
+	"PST": "-0800",
+	"PDT": "-0700",
+}
+
+// Regular expressions used to normalize dates.
+var (
+	dateCommentRegexp      = regexp.MustCompile(`\([^)]*\)`)
+	dateZoneRegexp         = regexp.MustCompile(`\s([A-Za-z]{1,5})$`)
+	dateWhitespaceRegexp   = regexp.MustCompile(`\s+`)
+	dateMissingSpaceRegexp = regexp.MustCompile(`,(\S)`)
+	dateTwoDigitYearRegexp = regexp.MustCompile(`\d [A-Za-z]{3,9} \d{2} `)
+)
+
+// fallbackDateLayouts defines the layouts tried if the date isn't RFC 5322, e.g. missing zones or seconds and other standards.
+var fallbackDateLayouts = []string{
+	"Mon, 2 Jan 2006 15:04:05",
+	"Mon, 2 Jan 2006 15:04",
+	"2 Jan 2006 15:04:05",
+	"2 Jan 2006 15:04",
+	"Mon, 2 Jan 06 15:04:05 -0700",
+	"Mon, 2 Jan 06 15:04 -0700",
+	"2 Jan 06 15:04:05 -0700",
+	"2 Jan 06 15:04 -0700",
+	"Mon, 2 Jan 06 15:04:05",
+	"2 Jan 06 15:04:05",
+	"Mon, 2 January 2006 15:04:05 -0700",
+	"2 January 2006 15:04:05 -0700",
+	"Mon, Jan 2 2006 15:04:05 -0700",
+	"Mon Jan 2 15:04:05 2006",
+	"Mon Jan 2 15:04:05 -0700 2006",
+	time.RFC3339,
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+}
+
+// parseMessageDate parses the date of a Date or Received header.
+// Parses RFC 5322 dates including the obsolete syntax (zone names, two-digit years, missing seconds and comments),
+// dates without a zone are UTC.
+func parseMessageDate(value string) (time.Time, error) {
+	normalizedValue := normalizeMessageDate(value)
+
+	date, err := mail.ParseDate(normalizedValue)
+
+	if err != nil {
+		for _, layout := range fallbackDateLayouts {
+			if date, err = time.Parse(layout, normalizedValue); err == nil {
+				break
+			}
+		}
+	}
+
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse date: %s", value)
+	}
+
+	// RFC 5322 (section 4.3) two-digit years: 00-49 are 2000-2049, 50-99 are 1950-1999 (Go uses 1969 as the pivot).
+	if dateTwoDigitYearRegexp.MatchString(normalizedValue) && date.Year() >= 2050 {
+		date = date.AddDate(-100, 0, 0)
+	}
+
+	return date, nil
+}
+
+// normalizeMessageDate removes comments, normalizes whitespace and replaces obsolete zone names with numeric offsets.
+func normalizeMessageDate(value string) string {
+	normalizedValue := dateCommentRegexp.ReplaceAllString(value, " ")
+	normalizedValue = dateMissingSpaceRegexp.ReplaceAllString(normalizedValue, ", $1")
+	normalizedValue = strings.TrimSpace(dateWhitespaceRegexp.ReplaceAllString(normalizedValue, " "))
+
+	if match := dateZoneRegexp.FindStringSubmatch(normalizedValue); match != nil {
+		zone, ok := obsoleteZones[strings.ToUpper(match[1])]
+
+		if !ok && len(match[1]) == 1 {
+			zone = "-0000"
+			ok = true
+		}
+
+		if ok {
+			normalizedValue = strings.TrimSuffix(normalizedValue, match[1]) + zone
+		}
+	}
+
+	return normalizedValue
+}
+
+// getReceivedHeaderDate returns the date of the Received header, the date follows the last semicolon.
+func getReceivedHeaderDate(value string) (time.Time, error) {
+	separatorIndex := strings.LastIndex(value, ";")
+
+	if separatorIndex == -1 {
+		return time.Time{}, fmt.Errorf("failed to find date in received header: %s", value)
+	}
+
+	return parseMessageDate(value[separatorIndex+1:])
+}
+
+// Date anomalies of messages, timestamp manipulation (e.g. a backdated Date header) is a forensic indicator.
+const (
+	DateAnomalySentAfterDelivery  = "sent_after_delivery"   // The Date header is later than the delivery by the receiving server.
+	DateAnomalyDeliveryDelay      = "delivery_delay"        // The message was delivered long after the Date header.
+	DateAnomalyReceivedOutOfOrder = "received_out_of_order" // A server (Received header) received the message before the previous server.
+	DateAnomalyFutureDate         = "future_date"           // The Date header is later than the extraction of the message.
+	DateAnomalyAny                = "any"                   // Matches all date anomalies, see SearchFilters.DateAnomaly.
+	DateAnomalyInvalidOffset      = "invalid_offset"        // The UTC offset of the Date header isn't a real timezone offset.
+)
+
+// Date anomaly thresholds.
+const (
+	// dateAnomalyClockSkew defines the tolerated difference between the clocks of the sender and the servers.
+	dateAnomalyClockSkew = 5 * time.Minute
+	// dateAnomalyMaximumDeliveryTime defines the delivery time above which the delivery is delayed.
+	dateAnomalyMaximumDeliveryTime = 48 * time.Hour
+)
+
+// dateOffsetRegexp matches the numeric UTC offset at the end of a normalized date.
+var dateOffsetRegexp = regexp.MustCompile(`[+-]\d{4}$`)
+
+// getMessageDateOffset returns the UTC offset in minutes of the parsed date, nil if the date has no offset.
+// The offset "-0000" means the offset is unknown (RFC 5322 section 3.3).
+func getMessageDateOffset(value string, date time.Time) *int {
+	offset := dateOffsetRegexp.FindString(normalizeMessageDate(value))
+
+	if offset == "" || offset == "-0000" {
+		return nil
+	}
+
+	_, offsetSeconds := date.Zone()
+	offsetMinutes := offsetSeconds / 60
+
+	return &offsetMinutes
+}
+
+// setMessageDates sets the sent and delivered dates (with their UTC offsets) of the message from its Date and Received headers
+// and the date anomalies, the extraction date is used to detect dates in the future.
+func setMessageDates(message *Message, extractedAt time.Time) {
+	headers := message.Headers
+
+	if headers == messageNullValue {
+		headers = ""
+	}
+
+	message.SentDate, message.SentOffset = 0, nil
+	message.DeliveredDate, message.DeliveredOffset = 0, nil
+	message.DateDiscrepancy, message.DateAnomalies = 0, nil
+
+	anomalies := make(map[string]bool)
+
+	if value := getHeaderValue(headers, "Date"); value != "" {
+		if sentDate, err := parseMessageDate(value); err == nil {
+			message.SentDate = int(sentDate.Unix())
+			message.SentOffset = getMessageDateOffset(value, sentDate)
+
+			if message.SentOffset != nil && (*message.SentOffset%15 != 0 || *message.SentOffset < -12*60 || *message.SentOffset > 14*60) {
+				anomalies[DateAnomalyInvalidOffset] = true
+			}
+
+			if sentDate.After(extractedAt.Add(dateAnomalyClockSkew)) {
+				anomalies[DateAnomalyFutureDate] = true
+			}
+		}
+	}
+
+	// The topmost Received header is added by the last server (the delivery), the servers before it are listed below it.
+	var previousHopDate time.Time
+
+	for i, receivedHeader := range getHeaderValues(headers, "Received") {
+		hopDate, err := getReceivedHeaderDate(receivedHeader)
+
+		if err != nil {
+			continue
+		}
+
+		if i == 0 {
+			message.DeliveredDate = int(hopDate.Unix())
+			message.DeliveredOffset = getMessageDateOffset(receivedHeader[strings.LastIndex(receivedHeader, ";")+1:], hopDate)
+		} else if !previousHopDate.IsZero() && hopDate.After(previousHopDate.Add(dateAnomalyClockSkew)) {
+			anomalies[DateAnomalyReceivedOutOfOrder] = true
+		}
+
+		previousHopDate = hopDate
+	}
+
+	if message.SentDate > 0 && message.DeliveredDate > 0 {
+		message.DateDiscrepancy = message.DeliveredDate - message.SentDate
+
+		if time.Duration(-message.DateDiscrepancy)*time.Second > dateAnomalyClockSkew {
+			anomalies[DateAnomalySentAfterDelivery] = true
+		} else if time.Duration(message.DateDiscrepancy)*time.Second > dateAnomalyMaximumDeliveryTime {
+			anomalies[DateAnomalyDeliveryDelay] = true
+		}
+	}
+
+	for _, anomaly := range []string{DateAnomalySentAfterDelivery, DateAnomalyDeliveryDelay, DateAnomalyReceivedOutOfOrder, DateAnomalyFutureDate, DateAnomalyInvalidOffset} {
+		if anomalies[anomaly] {
+			message.DateAnomalies = append(message.DateAnomalies, anomaly)
+		}
+	}
+}
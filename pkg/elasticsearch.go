@@ -5,47 +5,372 @@ package core
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/elastic/go-elasticsearch/v7"
-	"github.com/spf13/viper"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"github.com/jackc/pgx/v4"
+	"io/ioutil"
+	"net/http"
 	"time"
 )
 
 // Elasticsearch defines our Elasticsearch client.
+//
+// Deprecated: use Core.Elasticsearch.
 var Elasticsearch *elasticsearch.Client
 
-// init initializes our Elasticsearch client.
-func init() {
-	if !viper.IsSet("elasticsearch_addresses") {
-		Logger.Fatal("unset elasticsearch_addresses configuration variable")
-	}
+// ElasticsearchIndex defines the name of the messages index.
+//
+// Deprecated: use Core.Config.ElasticsearchIndex.
+var ElasticsearchIndex string
 
-	elasticSearch, err := elasticsearch.NewClient(elasticsearch.Config{
-		Addresses:     viper.GetStringSlice("elasticsearch_addresses"),
-		RetryOnStatus: []int{502, 503, 504, 429},
+// newElasticsearchClient creates our Elasticsearch client.
+func newElasticsearchClient(config Config) (*elasticsearch.Client, error) {
+	elasticsearchConfig := elasticsearch.Config{
+		Addresses:              config.ElasticsearchAddresses,
+		Username:               config.ElasticsearchUsername,
+		Password:               config.ElasticsearchPassword,
+		APIKey:                 config.ElasticsearchAPIKey,
+		CertificateFingerprint: config.ElasticsearchCertificateFingerprint,
+		RetryOnStatus:          []int{502, 503, 504, 429},
 		RetryBackoff: func(i int) time.Duration {
 			return time.Duration(i) * 100 * time.Millisecond
 		},
 		MaxRetries: 5,
-	})
+	}
 
-	if err != nil {
-		Logger.Fatalf("Failed to initialize Elasticsearch client: %s", err)
+	if config.ElasticsearchCACert != "" || config.ElasticsearchClientCert != "" || config.ElasticsearchInsecureSkipVerify {
+		tlsConfig, err := newElasticsearchTLSConfig(config)
+
+		if err != nil {
+			return nil, err
+		}
+
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+
+		elasticsearchConfig.Transport = transport
 	}
 
-	Elasticsearch = elasticSearch
+	return elasticsearch.NewClient(elasticsearchConfig)
+}
 
-	if err := createMessagesIndex(); err != nil {
-		Logger.Fatalf("Failed to create message mapping: %s", err)
+// newElasticsearchTLSConfig creates the TLS configuration from the CA certificate, client certificate and insecure skip verify options.
+func newElasticsearchTLSConfig(config Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.ElasticsearchInsecureSkipVerify,
 	}
+
+	if config.ElasticsearchCACert != "" {
+		caCert, err := ioutil.ReadFile(config.ElasticsearchCACert)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to read elasticsearch_ca_cert: %s", err)
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+			return nil, errors.New("elasticsearch_ca_cert contains no PEM encoded certificates")
+		}
+	}
+
+	if config.ElasticsearchClientCert != "" {
+		clientCert, err := tls.LoadX509KeyPair(config.ElasticsearchClientCert, config.ElasticsearchClientKey)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to load elasticsearch_client_cert: %s", err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	}
+
+	return tlsConfig, nil
 }
 
-// createMessageMapping creates our Elasticsearch index mapping.
-func createMessagesIndex() error {
-	if !viper.IsSet("elasticsearch_index") {
-		Logger.Fatal("unset elasticsearch_index configuration variable")
+// emailAddressFields returns the mapping of an address header (from, to and cc).
+// The keyword sub-field is used for exact (case insensitive) matches and sorting,
+// the address sub-field contains the email addresses and the domain sub-field only their domains.
+func emailAddressFields() map[string]interface{} {
+	return map[string]interface{}{
+		"type": "text",
+		"fields": map[string]interface{}{
+			"keyword": map[string]interface{}{
+				"type":         "keyword",
+				"normalizer":   "lowercase_normalizer",
+				"ignore_above": 1024,
+			},
+			"address": map[string]interface{}{
+				"type":     "text",
+				"analyzer": "email_address",
+			},
+			"domain": map[string]interface{}{
+				"type":     "text",
+				"analyzer": "email_domain",
+			},
+		},
 	}
+}
 
+// messagesIndexMappings returns the mappings of the messages index.
+// The embedding fields are only mapped if an embedding provider is configured, see addEmbeddingMappings.
+func messagesIndexMappings() map[string]interface{} {
+	mappings := map[string]interface{}{
+		"properties": map[string]interface{}{
+			"uuid": map[string]interface{}{
+				"type": "keyword",
+			},
+			"project_uuid": map[string]interface{}{
+				"type": "keyword",
+			},
+			"message_id": map[string]interface{}{
+				"type": "keyword",
+			},
+			"subject": map[string]interface{}{
+				"type": "text",
+			},
+			"from": emailAddressFields(),
+			"to":   emailAddressFields(),
+			"cc":   emailAddressFields(),
+			"received": map[string]interface{}{
+				"type":   "date",
+				"format": "epoch_second",
+			},
+			"size": map[string]interface{}{
+				"type": "long",
+				// Messages indexed before sizes were computed have the "NULL" size.
+				"ignore_malformed": true,
+			},
+			"attachments_size": map[string]interface{}{
+				"type": "long",
+			},
+			"body": map[string]interface{}{
+				"type": "text",
+			},
+			"headers": map[string]interface{}{
+				"type": "text",
+			},
+			"attachments": map[string]interface{}{
+				"properties": map[string]interface{}{
+					"uuid": map[string]interface{}{
+						"type": "keyword",
+					},
+					"size": map[string]interface{}{
+						"type": "long",
+					},
+					"hash": map[string]interface{}{
+						"type": "keyword",
+					},
+					"is_suppressed": map[string]interface{}{
+						"type": "boolean",
+					},
+					"name": map[string]interface{}{
+						"type": "text",
+						"fields": map[string]interface{}{
+							"keyword": map[string]interface{}{
+								"type":         "keyword",
+								"ignore_above": 1024,
+							},
+						},
+					},
+				},
+			},
+			"from_addresses": map[string]interface{}{
+				"type": "keyword",
+			},
+			"recipient_addresses": map[string]interface{}{
+				"type": "keyword",
+			},
+			"domains": map[string]interface{}{
+				"type": "keyword",
+			},
+			"folder_uuid": map[string]interface{}{
+				"type": "keyword",
+			},
+			"evidence_uuid": map[string]interface{}{
+				"type": "keyword",
+			},
+			"is_bookmarked": map[string]interface{}{
+				"type": "boolean",
+			},
+			"tag": map[string]interface{}{
+				"type": "keyword",
+			},
+			"tag_uuids": map[string]interface{}{
+				"type": "keyword",
+			},
+			"review_status": map[string]interface{}{
+				"type": "keyword",
+			},
+			"reviewer": map[string]interface{}{
+				"type": "keyword",
+			},
+			"message_class": map[string]interface{}{
+				"type": "keyword",
+			},
+			"importance": map[string]interface{}{
+				"type": "keyword",
+			},
+			"sensitivity": map[string]interface{}{
+				"type": "keyword",
+			},
+			"is_read": map[string]interface{}{
+				"type": "boolean",
+			},
+			"read_receipt_requested": map[string]interface{}{
+				"type": "boolean",
+			},
+			"delivery_receipt_requested": map[string]interface{}{
+				"type": "boolean",
+			},
+			"receipt": map[string]interface{}{
+				"type": "keyword",
+			},
+			"mailbox_direction": map[string]interface{}{
+				"type": "keyword",
+			},
+			"topic_cluster": map[string]interface{}{
+				"type": "keyword",
+			},
+			"topic_label": map[string]interface{}{
+				"type": "keyword",
+			},
+			"relevance_score": map[string]interface{}{
+				"type": "float",
+			},
+			"bulk_score": map[string]interface{}{
+				"type": "integer",
+			},
+			"is_bulk": map[string]interface{}{
+				"type": "boolean",
+			},
+			"is_suppressed": map[string]interface{}{
+				"type": "boolean",
+			},
+			"sent_date": map[string]interface{}{
+				"type":   "date",
+				"format": "epoch_second",
+			},
+			"sent_offset": map[string]interface{}{
+				"type": "integer",
+			},
+			"delivered_date": map[string]interface{}{
+				"type":   "date",
+				"format": "epoch_second",
+			},
+			"delivered_offset": map[string]interface{}{
+				"type": "integer",
+			},
+			"date_discrepancy": map[string]interface{}{
+				"type": "long",
+			},
+			"date_anomalies": map[string]interface{}{
+				"type": "keyword",
+			},
+			"privilege_designation": map[string]interface{}{
+				"type": "keyword",
+			},
+			"binder_uuids": map[string]interface{}{
+				"type": "keyword",
+			},
+			"phishing": map[string]interface{}{
+				"properties": map[string]interface{}{
+					"score": map[string]interface{}{
+						"type": "integer",
+					},
+					"indicators": map[string]interface{}{
+						"type": "keyword",
+					},
+				},
+			},
+			"sentiment": map[string]interface{}{
+				"properties": map[string]interface{}{
+					"score": map[string]interface{}{
+						"type": "float",
+					},
+					"tone": map[string]interface{}{
+						"type": "keyword",
+					},
+					"provider": map[string]interface{}{
+						"type": "keyword",
+					},
+				},
+			},
+			"direction": map[string]interface{}{
+				"type": "keyword",
+			},
+			"body_object": map[string]interface{}{
+				"type":  "keyword",
+				"index": false,
+			},
+			"original_object": map[string]interface{}{
+				"type":  "keyword",
+				"index": false,
+			},
+			"original_hash": map[string]interface{}{
+				"type": "keyword",
+			},
+			"thread_id": map[string]interface{}{
+				"type": "keyword",
+			},
+			"appointment": map[string]interface{}{
+				"properties": map[string]interface{}{
+					"start": map[string]interface{}{
+						"type":   "date",
+						"format": "epoch_second",
+					},
+					"end": map[string]interface{}{
+						"type":   "date",
+						"format": "epoch_second",
+					},
+					"location": map[string]interface{}{
+						"type": "text",
+						"fields": map[string]interface{}{
+							"keyword": map[string]interface{}{
+								"type":         "keyword",
+								"ignore_above": 1024,
+							},
+						},
+					},
+					"organizer": emailAddressFields(),
+					"attendees": emailAddressFields(),
+				},
+			},
+			"provenance": map[string]interface{}{
+				"properties": map[string]interface{}{
+					"parser": map[string]interface{}{
+						"type": "keyword",
+					},
+					"parser_version": map[string]interface{}{
+						"type": "keyword",
+					},
+					"core_version": map[string]interface{}{
+						"type": "keyword",
+					},
+					"evidence_hash": map[string]interface{}{
+						"type": "keyword",
+					},
+					"extracted_at": map[string]interface{}{
+						"type":   "date",
+						"format": "epoch_second",
+					},
+				},
+			},
+		},
+	}
+
+	addEmbeddingMappings(mappings["properties"].(map[string]interface{}))
+
+	return mappings
+}
+
+// newMessagesIndexBody returns the settings and mapping of the messages index.
+func newMessagesIndexBody() (*bytes.Buffer, error) {
 	var requestBody bytes.Buffer
 
 	err := json.NewEncoder(&requestBody).Encode(map[string]interface{}{
@@ -54,71 +379,265 @@ func createMessagesIndex() error {
 				"number_of_shards":   3,
 				"number_of_replicas": 1,
 			},
-		},
-		"mappings": map[string]interface{}{
-			"properties": map[string]interface{}{
-				"uuid": map[string]interface{}{
-					"type": "keyword",
-				},
-				"project_uuid": map[string]interface{}{
-					"type": "keyword",
-				},
-				"message_id": map[string]interface{}{
-					"type": "keyword",
-				},
-				"subject": map[string]interface{}{
-					"type": "text",
-				},
-				"from": map[string]interface{}{
-					"type": "text",
-				},
-				"to": map[string]interface{}{
-					"type": "text",
-				},
-				"cc": map[string]interface{}{
-					"type": "text",
-				},
-				"received": map[string]interface{}{
-					"type": "date",
-				},
-				"size": map[string]interface{}{
-					"type": "text",
-				},
-				"body": map[string]interface{}{
-					"type": "text",
-				},
-				"headers": map[string]interface{}{
-					"type": "text",
-				},
-				"attachments": map[string]interface{}{
-					"properties": map[string]interface{}{
-						"uuid": map[string]interface{}{
-							"type": "keyword",
-						},
-						"name": map[string]interface{}{
-							"type": "text",
-						},
+			"analysis": map[string]interface{}{
+				"normalizer": map[string]interface{}{
+					"lowercase_normalizer": map[string]interface{}{
+						"type":   "custom",
+						"filter": []string{"lowercase"},
 					},
 				},
-				"folder_uuid": map[string]interface{}{
-					"type": "keyword",
+				"filter": map[string]interface{}{
+					"email_only": map[string]interface{}{
+						"type":  "keep_types",
+						"types": []string{"<EMAIL>"},
+					},
+					"email_domain": map[string]interface{}{
+						"type":        "pattern_replace",
+						"pattern":     "^.*@",
+						"replacement": "",
+					},
 				},
-				"evidence_uuid": map[string]interface{}{
-					"type": "keyword",
+				"analyzer": map[string]interface{}{
+					"email_address": map[string]interface{}{
+						"type":      "custom",
+						"tokenizer": "uax_url_email",
+						"filter":    []string{"lowercase", "email_only"},
+					},
+					"email_domain": map[string]interface{}{
+						"type":      "custom",
+						"tokenizer": "uax_url_email",
+						"filter":    []string{"lowercase", "email_only", "email_domain"},
+					},
 				},
 			},
 		},
+		"mappings": messagesIndexMappings(),
 	})
 
 	if err != nil {
+		return nil, err
+	}
+
+	return &requestBody, nil
+}
+
+// createMessagesIndex creates our Elasticsearch index mapping.
+func createMessagesIndex(client *elasticsearch.Client, index string) error {
+	requestBody, err := newMessagesIndexBody()
+
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Indices.Create(index, client.Indices.Create.WithBody(requestBody))
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ReindexMessages migrates the messages of all projects to a new index with the current mapping.
+// The new index is named "<elasticsearch_index>-<unix time>" and the configured index name becomes an alias of it,
+// the previous index is removed once the alias is switched. Searches fail while the messages are being reindexed.
+func (core *Core) ReindexMessages(ctx context.Context) error {
+	return reindexMessages(ctx, core.Elasticsearch, core.Config.ElasticsearchIndex, core.Logger)
+}
+
+// reindexMessages creates a new index with the current mapping, copies the messages with the reindex API and swaps the alias atomically.
+// The new index is removed if reindexing fails, so the alias keeps pointing to the previous index.
+func reindexMessages(ctx context.Context, client *elasticsearch.Client, alias string, logger StructuredLogger) (err error) {
+	newIndex := fmt.Sprintf("%s-%d", alias, time.Now().Unix())
+
+	previousIndices, err := getAliasIndices(ctx, client, alias)
+
+	if err != nil {
+		return err
+	}
+
+	requestBody, err := newMessagesIndexBody()
+
+	if err != nil {
+		return err
+	}
+
+	createResponse, err := client.Indices.Create(newIndex, client.Indices.Create.WithContext(ctx), client.Indices.Create.WithBody(requestBody))
+
+	if err := checkElasticsearchResponse(createResponse, err); err != nil {
+		return fmt.Errorf("failed to create index %s: %s", newIndex, err)
+	}
+
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		deleteResponse, deleteErr := client.Indices.Delete([]string{newIndex}, client.Indices.Delete.WithContext(context.Background()))
+
+		if deleteErr := checkElasticsearchResponse(deleteResponse, deleteErr); deleteErr != nil {
+			logger.Errorf("Failed to remove index %s: %s", newIndex, deleteErr)
+		}
+	}()
+
+	var reindexBody bytes.Buffer
+
+	err = json.NewEncoder(&reindexBody).Encode(map[string]interface{}{
+		"source": map[string]interface{}{
+			"index": alias,
+		},
+		"dest": map[string]interface{}{
+			"index": newIndex,
+		},
+	})
+
+	if err != nil {
+		return err
+	}
+
+	reindexResponse, err := client.Reindex(&reindexBody, client.Reindex.WithContext(ctx), client.Reindex.WithWaitForCompletion(true), client.Reindex.WithRefresh(true))
+
+	if err != nil {
+		return err
+	}
+
+	var reindexResult struct {
+		Total    int               `json:"total"`
+		Failures []json.RawMessage `json:"failures"`
+	}
+
+	err = json.NewDecoder(reindexResponse.Body).Decode(&reindexResult)
+
+	if closeErr := reindexResponse.Body.Close(); closeErr != nil {
+		Logger.Errorf("Failed to close Elasticsearch response: %s", closeErr)
+	}
+
+	if reindexResponse.IsError() {
+		return fmt.Errorf("failed to reindex %s: %s", alias, reindexResponse.Status())
+	} else if err != nil {
 		return err
+	} else if len(reindexResult.Failures) > 0 {
+		// The previous index is kept so no messages are lost.
+		return fmt.Errorf("failed to reindex %d messages of %s to %s: %s", len(reindexResult.Failures), alias, newIndex, reindexResult.Failures[0])
 	}
 
-	_, err = Elasticsearch.Indices.Create(viper.GetString("elasticsearch_index"), Elasticsearch.Indices.Create.WithBody(&requestBody))
+	actions := []interface{}{
+		map[string]interface{}{
+			"add": map[string]interface{}{
+				"index": newIndex,
+				"alias": alias,
+			},
+		},
+	}
+
+	for _, previousIndex := range previousIndices {
+		actions = append(actions, map[string]interface{}{
+			"remove_index": map[string]interface{}{
+				"index": previousIndex,
+			},
+		})
+	}
+
+	var aliasesBody bytes.Buffer
+
+	if err := json.NewEncoder(&aliasesBody).Encode(map[string]interface{}{"actions": actions}); err != nil {
+		return err
+	}
+
+	aliasesResponse, err := client.Indices.UpdateAliases(&aliasesBody, client.Indices.UpdateAliases.WithContext(ctx))
+
+	if err := checkElasticsearchResponse(aliasesResponse, err); err != nil {
+		return fmt.Errorf("failed to switch alias %s to %s: %s", alias, newIndex, err)
+	}
+
+	logger.Infof("Reindexed %d messages of %s to %s", reindexResult.Total, alias, newIndex)
+
+	return nil
+}
+
+// getAliasIndices returns the indices of the alias, or the name itself if it is an index instead of an alias.
+func getAliasIndices(ctx context.Context, client *elasticsearch.Client, alias string) ([]string, error) {
+	response, err := client.Indices.GetAlias(client.Indices.GetAlias.WithContext(ctx), client.Indices.GetAlias.WithName(alias))
 
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err := response.Body.Close(); err != nil {
+			Logger.Errorf("Failed to close Elasticsearch response: %s", err)
+		}
+	}()
+
+	if response.StatusCode == http.StatusNotFound {
+		return []string{alias}, nil
+	} else if response.IsError() {
+		return nil, fmt.Errorf("failed to get alias %s: %s", alias, response.String())
+	}
+
+	var aliasResponse map[string]interface{}
+
+	if err := json.NewDecoder(response.Body).Decode(&aliasResponse); err != nil {
+		return nil, err
+	}
+
+	indices := make([]string, 0, len(aliasResponse))
+
+	for index := range aliasResponse {
+		indices = append(indices, index)
+	}
+
+	return indices, nil
+}
+
+// checkElasticsearchResponse closes the response and returns an error if the request failed.
+func checkElasticsearchResponse(response *esapi.Response, err error) error {
 	if err != nil {
 		return err
 	}
 
+	defer func() {
+		if err := response.Body.Close(); err != nil {
+			Logger.Errorf("Failed to close Elasticsearch response: %s", err)
+		}
+	}()
+
+	if response.IsError() {
+		return errors.New(response.String())
+	}
+
 	return nil
 }
+
+// ReindexProject migrates the messages to a new index with the latest mapping, needed whenever indexed fields are added to Message.
+// The messages index is shared by all projects so all messages are migrated like Core.ReindexMessages, which requires an admin.
+// Changed field types can't be applied to an existing index, hence the new index instead of updating the mapping in place.
+func ReindexProject(projectUUID string, userUUID string, database *pgx.Conn) error {
+	if err := CheckPermission(userUUID, projectUUID, ActionManageProject, database); err != nil {
+		return err
+	}
+
+	if err := checkUserAdmin(userUUID, database); err != nil {
+		return err
+	}
+
+	return reindexMessages(context.Background(), Elasticsearch, ElasticsearchIndex, Logger.WithFields(LogFields{"project_uuid": projectUUID}))
+}
+
+// updateMessagesMapping adds the fields of the latest mapping to the messages index.
+// Only new fields can be added in place, changed fields require ReindexProject.
+func updateMessagesMapping() error {
+	var requestBody bytes.Buffer
+
+	if err := json.NewEncoder(&requestBody).Encode(messagesIndexMappings()); err != nil {
+		return err
+	}
+
+	response, err := Elasticsearch.Indices.PutMapping(
+		&requestBody,
+		Elasticsearch.Indices.PutMapping.WithContext(context.Background()),
+		Elasticsearch.Indices.PutMapping.WithIndex("messages"),
+	)
+
+	return checkElasticsearchResponse(response, err)
+}
@@ -6,20 +6,17 @@ package core
 import (
 	_ "embed"
 	"github.com/mattevans/postmark-go"
-	"github.com/spf13/viper"
 	"net/http"
 )
 
 // PostmarkClient defines our Postmark email client.
+//
+// Deprecated: use Core.PostmarkClient.
 var PostmarkClient *postmark.Client
 
-// init initializes our Postmark client.
-func init() {
-	if !viper.IsSet("postmark_token") {
-		Logger.Fatal("unset postmark_token configuration variable")
-	}
-
-	PostmarkClient = postmark.NewClient(&http.Client{
-		Transport: &postmark.AuthTransport{Token: viper.GetString("postmark_token")},
+// newPostmarkClient creates our Postmark email client.
+func newPostmarkClient(token string) *postmark.Client {
+	return postmark.NewClient(&http.Client{
+		Transport: &postmark.AuthTransport{Token: token},
 	})
 }
@@ -0,0 +1,391 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aquasecurity/esquery"
+	"github.com/jackc/pgx/v4"
+	"math"
+	"strings"
+)
+
+// EmbeddingGenerator computes the embeddings of messages for semantic search, semantic search is disabled if nil.
+//
+// Deprecated: use Core.Config.EmbeddingProvider or Core.Config.EmbeddingAPIURL.
+var EmbeddingGenerator EmbeddingProvider
+
+// EmbeddingProvider computes the embeddings (vectors) of texts, e.g. a local model or an external API.
+// Texts with a similar meaning must have similar embeddings (cosine similarity).
+type EmbeddingProvider interface {
+	// GetName identifies the provider (and model), stored with the embeddings of the messages.
+	GetName() string
+	// GetDimensions returns the size of the embeddings.
+	// The dimensions are fixed once the first messages are embedded, changing them requires Core.ReindexMessages.
+	GetDimensions() int
+	// Embed returns the embedding of each text, in the order of the texts.
+	Embed(ctx context.Context, texts []string) ([][]float32, error)
+}
+
+// Embedding limits.
+const (
+	// maxEmbeddingTextLength defines the maximum amount of characters of a message which are embedded.
+	maxEmbeddingTextLength = 8000
+	// embeddingBatchSize defines the amount of texts per call to the embedding provider.
+	embeddingBatchSize = 64
+	// DefaultSemanticSearchSize defines the amount of messages returned by GetMessagesBySemanticQuery if no size is specified.
+	DefaultSemanticSearchSize = 50
+	// MaxSemanticSearchSize defines the maximum amount of messages returned by GetMessagesBySemanticQuery.
+	MaxSemanticSearchSize = 1000
+)
+
+// ErrSemanticSearchDisabled is returned if semantic search is used without a configured embedding provider.
+var ErrSemanticSearchDisabled = errors.New("semantic search is disabled, set the embedding_api_url configuration variable")
+
+// SemanticSearchResult represents a message found by GetMessagesBySemanticQuery.
+type SemanticSearchResult struct {
+	Message
+	Similarity float64 `json:"similarity"` // The cosine similarity (-1 to 1) of the message and the query.
+}
+
+// newEmbeddingProvider returns the embedding provider of the configuration, the configured provider takes precedence over the API.
+// Returns nil if semantic search isn't configured.
+func newEmbeddingProvider(config Config) EmbeddingProvider {
+	if config.EmbeddingProvider != nil {
+		return config.EmbeddingProvider
+	}
+
+	if config.EmbeddingAPIURL != "" {
+		return NewHTTPEmbeddingProvider(config.EmbeddingAPIURL, config.EmbeddingAPIKey, config.EmbeddingDimensions)
+	}
+
+	return nil
+}
+
+// addEmbeddingMappings adds the embedding fields to the messages mapping if an embedding provider is configured.
+// The embeddings are only stored in the index (not in Message) so search results don't include them.
+func addEmbeddingMappings(properties map[string]interface{}) {
+	if EmbeddingGenerator == nil {
+		return
+	}
+
+	properties["embedding"] = map[string]interface{}{
+		"type": "dense_vector",
+		"dims": EmbeddingGenerator.GetDimensions(),
+	}
+	properties["embedding_provider"] = map[string]interface{}{
+		"type": "keyword",
+	}
+}
+
+// embedTexts returns the embeddings of the texts computed by the provider in batches of embeddingBatchSize.
+func embedTexts(ctx context.Context, provider EmbeddingProvider, texts []string) ([][]float32, error) {
+	embeddings := make([][]float32, 0, len(texts))
+
+	for start := 0; start < len(texts); start += embeddingBatchSize {
+		end := start + embeddingBatchSize
+
+		if end > len(texts) {
+			end = len(texts)
+		}
+
+		batchEmbeddings, err := provider.Embed(ctx, texts[start:end])
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(batchEmbeddings) != end-start {
+			return nil, fmt.Errorf("embedding provider %s returned %d embeddings for %d texts", provider.GetName(), len(batchEmbeddings), end-start)
+		}
+
+		for _, embedding := range batchEmbeddings {
+			if len(embedding) != provider.GetDimensions() {
+				return nil, fmt.Errorf("embedding provider %s returned %d dimensions instead of %d", provider.GetName(), len(embedding), provider.GetDimensions())
+			}
+
+			if isZeroEmbedding(embedding) {
+				return nil, fmt.Errorf("embedding provider %s returned a zero embedding", provider.GetName())
+			}
+		}
+
+		embeddings = append(embeddings, batchEmbeddings...)
+	}
+
+	return embeddings, nil
+}
+
+// isZeroEmbedding returns true if all values are zero, the cosine similarity of a zero embedding is undefined.
+func isZeroEmbedding(embedding []float32) bool {
+	for _, value := range embedding {
+		if value != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// EmbedProjectMessages computes the embeddings of the messages of the project which aren't embedded yet (or all messages if reembed is set)
+// so they can be found by GetMessagesBySemanticQuery. Messages without text aren't embedded.
+// The progress (percentage) is reported to reportProgress, which may be nil. Returns the amount of embedded messages.
+func EmbedProjectMessages(ctx context.Context, projectUUID string, reembed bool, reportProgress func(progress int), userUUID string, database *pgx.Conn) (int, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionManageProject, database); err != nil {
+		return 0, err
+	}
+
+	if EmbeddingGenerator == nil {
+		return 0, ErrSemanticSearchDisabled
+	}
+
+	if err := updateMessagesMapping(); err != nil {
+		return 0, fmt.Errorf("failed to add the embedding mapping, use Core.ReindexMessages if the dimensions changed: %s", err)
+	}
+
+	query := esquery.Bool().Filter(esquery.Term("project_uuid", projectUUID))
+
+	if !reembed {
+		query = query.MustNot(esquery.Term("embedding_provider", EmbeddingGenerator.GetName()))
+	}
+
+	total, err := countMessages(query)
+
+	if err != nil {
+		return 0, err
+	}
+
+	var processed int
+	var embedded int
+
+	err = forEachMessageBatch(query, func(messages []Message) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var messageUUIDs []string
+		var texts []string
+
+		for _, message := range messages {
+			if text := getMessageText(message, maxEmbeddingTextLength); text != "" {
+				messageUUIDs = append(messageUUIDs, message.UUID)
+				texts = append(texts, text)
+			}
+		}
+
+		embeddings, err := embedTexts(ctx, EmbeddingGenerator, texts)
+
+		if err != nil {
+			return err
+		}
+
+		messageEmbeddings := make(map[string]interface{}, len(messageUUIDs))
+
+		for i, messageUUID := range messageUUIDs {
+			messageEmbeddings[messageUUID] = embeddings[i]
+		}
+
+		if len(messageUUIDs) > 0 {
+			err = updateMessagesByScript(
+				newMessageUUIDsQuery(messageUUIDs, projectUUID),
+				"ctx._source.embedding = params.embeddings[ctx._source.uuid]; ctx._source.embedding_provider = params.provider;",
+				map[string]interface{}{
+					"embeddings": messageEmbeddings,
+					"provider":   EmbeddingGenerator.GetName(),
+				},
+			)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		processed += len(messages)
+		embedded += len(messageUUIDs)
+
+		if reportProgress != nil && total > 0 {
+			reportProgress(int(math.Min(100, float64(processed)*100/float64(total))))
+		}
+
+		return nil
+	}, database)
+
+	if err != nil {
+		return embedded, err
+	}
+
+	Logger.WithFields(LogFields{"project_uuid": projectUUID}).Infof("Embedded %d messages", embedded)
+
+	return embedded, nil
+}
+
+// GetMessagesBySemanticQuery returns the messages most similar in meaning to the text (exact k-nearest neighbours by cosine similarity),
+// the most similar first. Only messages matching the keyword query (see GetMessagesFromQuery) and the filters are ranked,
+// use an empty keyword query to rank all messages. The size defaults to DefaultSemanticSearchSize if zero.
+// Only embedded messages are found, see EmbedProjectMessages.
+func GetMessagesBySemanticQuery(projectUUID string, text string, keywordQuery string, filters SearchFilters, size int, userUUID string, database *pgx.Conn) ([]SemanticSearchResult, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return nil, err
+	}
+
+	if EmbeddingGenerator == nil {
+		return nil, ErrSemanticSearchDisabled
+	}
+
+	text = strings.TrimSpace(text)
+
+	if text == "" {
+		return nil, errors.New("empty semantic query")
+	}
+
+	if size == 0 {
+		size = DefaultSemanticSearchSize
+	}
+
+	if size < 1 || size > MaxSemanticSearchSize {
+		return nil, fmt.Errorf("invalid size: %d (maximum %d)", size, MaxSemanticSearchSize)
+	}
+
+	embeddings, err := embedTexts(context.Background(), EmbeddingGenerator, []string{text})
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Only messages embedded by the current provider are comparable to the query.
+	query := filters.apply(newSearchQuery(keywordQuery, projectUUID)).
+		Filter(esquery.Term("embedding_provider", EmbeddingGenerator.GetName()))
+
+	// The score is the cosine similarity plus one since Elasticsearch scores can't be negative.
+	scriptScoreQuery := esquery.CustomQuery(map[string]interface{}{
+		"script_score": map[string]interface{}{
+			"query": query.Map(),
+			"script": map[string]interface{}{
+				"source": "cosineSimilarity(params.query_vector, 'embedding') + 1.0",
+				"params": map[string]interface{}{
+					"query_vector": embeddings[0],
+				},
+			},
+		},
+	})
+
+	response, err := esquery.Search().
+		Query(scriptScoreQuery).
+		Size(uint64(size)).
+		SourceExcludes("embedding").
+		Run(
+			Elasticsearch,
+			Elasticsearch.Search.WithContext(context.Background()),
+			Elasticsearch.Search.WithIndex("messages"),
+		)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err := response.Body.Close(); err != nil {
+			Logger.Errorf("Failed to close Elasticsearch response: %s", err)
+		}
+	}()
+
+	if response.IsError() {
+		return nil, fmt.Errorf("failed to run semantic search: %s", response.String())
+	}
+
+	var searchResponse struct {
+		Hits struct {
+			Hits []struct {
+				Score  float64 `json:"_score"`
+				Source Message `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+
+	if err := json.NewDecoder(response.Body).Decode(&searchResponse); err != nil {
+		return nil, err
+	}
+
+	messages := make([]Message, len(searchResponse.Hits.Hits))
+
+	for i, hit := range searchResponse.Hits.Hits {
+		messages[i] = hit.Source
+	}
+
+	hydrateMessages(messages, database)
+
+	results := make([]SemanticSearchResult, len(messages))
+
+	for i, message := range messages {
+		results[i] = SemanticSearchResult{
+			Message:    message,
+			Similarity: searchResponse.Hits.Hits[i].Score - 1,
+		}
+	}
+
+	addSearchHistory(fmt.Sprintf("semantic: %s", text), &filters, len(results), projectUUID, userUUID, database)
+
+	return results, nil
+}
+
+// EmbedMessagesJobParameters represents the parameters of the JobTypeEmbedMessages job.
+type EmbedMessagesJobParameters struct {
+	Reembed bool `json:"reembed"` // Embed the messages which are already embedded by the provider.
+}
+
+// runEmbedMessagesJob runs EmbedProjectMessages.
+func runEmbedMessagesJob(ctx context.Context, job Job, reportProgress func(progress int), database *pgx.Conn) (string, error) {
+	var parameters EmbedMessagesJobParameters
+
+	if err := decodeJobParameters(job, &parameters); err != nil {
+		return "", err
+	}
+
+	_, err := EmbedProjectMessages(ctx, job.ProjectUUID, parameters.Reembed, reportProgress, job.UserUUID, database)
+
+	return "", err
+}
+
+// httpEmbeddingProvider computes the embeddings with an external API.
+type httpEmbeddingProvider struct {
+	url        string
+	apiKey     string
+	dimensions int
+}
+
+// NewHTTPEmbeddingProvider creates the embedding provider of the external API, the API key is sent as bearer token if set.
+// The API receives a JSON body {"texts": [...]} and must respond with {"embeddings": [[...], ...]},
+// an embedding of the dimensions per text in the same order.
+func NewHTTPEmbeddingProvider(url string, apiKey string, dimensions int) EmbeddingProvider {
+	return &httpEmbeddingProvider{
+		url:        url,
+		apiKey:     apiKey,
+		dimensions: dimensions,
+	}
+}
+
+// GetName returns the name of the provider.
+func (provider *httpEmbeddingProvider) GetName() string {
+	return "api"
+}
+
+// GetDimensions returns the size of the embeddings.
+func (provider *httpEmbeddingProvider) GetDimensions() int {
+	return provider.dimensions
+}
+
+// Embed posts the texts to the API.
+func (provider *httpEmbeddingProvider) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	var embeddingsResponse struct {
+		Embeddings [][]float32 `json:"embeddings"`
+	}
+
+	if err := postAnalysisRequest(ctx, provider.url, provider.apiKey, map[string]interface{}{"texts": texts}, &embeddingsResponse); err != nil {
+		return nil, err
+	}
+
+	return embeddingsResponse.Embeddings, nil
+}
@@ -0,0 +1,89 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// decodeEncryptionKey decodes the key (base64 encoded, 32 bytes) of the configuration variable.
+// Returns nil if the key is empty.
+func decodeEncryptionKey(variable string, encodedKey string) ([]byte, error) {
+	if encodedKey == "" {
+		return nil, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", variable, err)
+	}
+
+	if len(key) != 32 {
+		return nil, fmt.Errorf("%s must be 32 bytes", variable)
+	}
+
+	return key, nil
+}
+
+// encryptValue encrypts the value with AES-GCM, the nonce is prepended to the base64 encoded ciphertext.
+func encryptValue(key []byte, value string) (string, error) {
+	gcm, err := newGCMCipher(key)
+
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(value), nil)), nil
+}
+
+// decryptValue decrypts the value encrypted by encryptValue.
+func decryptValue(key []byte, encryptedValue string) (string, error) {
+	gcm, err := newGCMCipher(key)
+
+	if err != nil {
+		return "", err
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(encryptedValue)
+
+	if err != nil {
+		return "", err
+	}
+
+	if len(ciphertext) < gcm.NonceSize() {
+		return "", errors.New("encrypted value is too short")
+	}
+
+	value, err := gcm.Open(nil, ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():], nil)
+
+	if err != nil {
+		return "", err
+	}
+
+	return string(value), nil
+}
+
+// newGCMCipher returns the AES-GCM cipher using the key.
+func newGCMCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
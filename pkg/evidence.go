@@ -6,8 +6,9 @@ package core
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/jackc/pgx/v4"
-	"path/filepath"
+	"strings"
 )
 
 // Evidence represents a PST file.
@@ -15,54 +16,250 @@ type Evidence struct {
 	UUID     string `json:"uuid"`
 	FileHash string `json:"file_hash"`
 	FileName string `json:"file_name"`
+	FileSize int64  `json:"file_size"`
 	IsParsed bool   `json:"is_parsed"`
+	// Parser pins the parser by its name (see Parser.GetName), the parser is detected from the file signature if empty.
+	Parser string `json:"parser"`
 }
 
 // Save saves the evidence to the database.
 // To assign the evidence to a project call AddProjectEvidence.
 func (evidence *Evidence) Save(database *pgx.Conn) error {
 	preparedStatement := `
-	INSERT INTO evidence(uuid, fileHash, fileName, isParsed) VALUES ($1, $2, $3, $4)
-	ON CONFLICT(uuid) DO UPDATE SET isParsed = $4
+	INSERT INTO evidence(uuid, fileHash, fileName, fileSize, isParsed, parser) VALUES ($1, $2, $3, $4, $5, $6)
+	ON CONFLICT(uuid) DO UPDATE SET isParsed = $5, parser = $6
 	`
-	if _, err := database.Exec(context.Background(), preparedStatement, evidence.UUID, evidence.FileHash, evidence.FileName, evidence.IsParsed); err != nil {
+	if _, err := database.Exec(context.Background(), preparedStatement, evidence.UUID, evidence.FileHash, evidence.FileName, evidence.FileSize, evidence.IsParsed, evidence.Parser); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-// Parse calls all supported parsers on the file.
-func (evidence *Evidence) Parse(project Project, database *pgx.Conn) error {
-	if evidence.IsParsed {
-		return errors.New("evidence is already parsed")
+// GetProjectEvidenceSize returns the total file size of all evidence in the project.
+func GetProjectEvidenceSize(projectUUID string, database *pgx.Conn) (int64, error) {
+	preparedStatement := `
+	SELECT COALESCE(SUM(e.fileSize), 0) FROM evidence e
+	INNER JOIN project_evidence_junction pej ON pej.evidenceUUID = e.uuid
+	WHERE pej.projectUUID = $1
+	`
+	row := database.QueryRow(context.Background(), preparedStatement, projectUUID)
+
+	var evidenceSize int64
+
+	if err := row.Scan(&evidenceSize); err != nil {
+		return 0, err
+	}
+
+	return evidenceSize, nil
+}
+
+// GetEvidenceByProject returns all evidence of the project.
+func GetEvidenceByProject(projectUUID string, database *pgx.Conn) ([]Evidence, error) {
+	preparedStatement := `
+	SELECT e.uuid, e.fileHash, e.fileName, e.fileSize, e.isParsed, COALESCE(e.parser, '') FROM evidence e
+	INNER JOIN project_evidence_junction pej ON pej.evidenceUUID = e.uuid
+	WHERE pej.projectUUID = $1
+	ORDER BY e.fileName
+	`
+	rows, err := database.Query(context.Background(), preparedStatement, projectUUID)
+
+	if err != nil {
+		return nil, err
 	}
 
-	foundParser := false
+	var evidences []Evidence
+
+	for rows.Next() {
+		var evidence Evidence
 
-	for _, parser := range GetParsers() {
-		supportsExtension := false
+		err := rows.Scan(&evidence.UUID, &evidence.FileHash, &evidence.FileName, &evidence.FileSize, &evidence.IsParsed, &evidence.Parser)
 
-		for _, extension := range parser.GetSupportedFileExtensions() {
-			if filepath.Ext(evidence.FileName) == extension {
-				supportsExtension = true
-				foundParser = true
-				break
-			}
+		if err != nil {
+			return nil, err
 		}
 
-		if supportsExtension {
-			err := parser.Parse(evidence, project, database)
+		evidences = append(evidences, evidence)
+	}
+
+	rows.Close()
+
+	return evidences, rows.Err()
+}
+
+// EvidenceListing represents the evidence in the evidence list of a project.
+type EvidenceListing struct {
+	Evidence
+	Custodian       string `json:"custodian"` // See SetEvidenceCustodian.
+	ParseErrorCount int    `json:"parse_error_count"`
+}
+
+// Parse status filters of ListProjectEvidence.
+const (
+	EvidenceFilterAll      = ""
+	EvidenceFilterParsed   = "parsed"
+	EvidenceFilterUnparsed = "unparsed"
+)
+
+// ListProjectEvidence returns the evidence of the project with its custodian and the amount of parse errors (see GetParseErrors).
+// The filter is one of EvidenceFilterAll, EvidenceFilterParsed or EvidenceFilterUnparsed.
+func ListProjectEvidence(projectUUID string, filter string, userUUID string, database *pgx.Conn) ([]EvidenceListing, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return nil, err
+	}
 
-			if err != nil {
-				return err
-			}
+	var parseStatus string
+
+	switch filter {
+	case EvidenceFilterAll:
+	case EvidenceFilterParsed:
+		parseStatus = "AND COALESCE(e.isParsed, FALSE)"
+	case EvidenceFilterUnparsed:
+		parseStatus = "AND NOT COALESCE(e.isParsed, FALSE)"
+	default:
+		return nil, fmt.Errorf("invalid evidence filter: %s", filter)
+	}
+
+	preparedStatement := fmt.Sprintf(`
+	SELECT e.uuid, e.fileHash, e.fileName, e.fileSize, e.isParsed, COALESCE(e.parser, ''), COALESCE(ec.custodian, ''),
+		(SELECT COUNT(*) FROM parse_errors pe WHERE pe.projectUUID = pej.projectUUID AND pe.evidenceUUID = e.uuid)
+	FROM evidence e
+	INNER JOIN project_evidence_junction pej ON pej.evidenceUUID = e.uuid
+	LEFT JOIN evidence_custodians ec ON ec.projectUUID = pej.projectUUID AND ec.evidenceUUID = e.uuid
+	WHERE pej.projectUUID = $1 %s
+	ORDER BY e.fileName
+	`, parseStatus)
+	rows, err := database.Query(context.Background(), preparedStatement, projectUUID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var evidenceListings []EvidenceListing
+
+	for rows.Next() {
+		var evidenceListing EvidenceListing
+
+		err := rows.Scan(&evidenceListing.UUID, &evidenceListing.FileHash, &evidenceListing.FileName, &evidenceListing.FileSize, &evidenceListing.IsParsed, &evidenceListing.Parser, &evidenceListing.Custodian, &evidenceListing.ParseErrorCount)
+
+		if err != nil {
+			return nil, err
 		}
+
+		evidenceListings = append(evidenceListings, evidenceListing)
 	}
 
-	if !foundParser {
-		return errors.New("failed to find supported parser")
+	rows.Close()
+
+	return evidenceListings, rows.Err()
+}
+
+// SetEvidenceCustodian sets the custodian (the person the evidence was collected from) of the evidence, an empty custodian removes it.
+func SetEvidenceCustodian(evidenceUUID string, custodian string, projectUUID string, userUUID string, database *pgx.Conn) error {
+	if err := CheckPermission(userUUID, projectUUID, ActionManageEvidence, database); err != nil {
+		return err
 	}
 
-	return nil
+	if _, err := getEvidenceByUUID(evidenceUUID, projectUUID, database); err != nil {
+		return err
+	}
+
+	custodian = strings.TrimSpace(custodian)
+
+	if custodian == "" {
+		preparedStatement := `
+		DELETE FROM evidence_custodians WHERE projectUUID = $1 AND evidenceUUID = $2
+		`
+		_, err := database.Exec(context.Background(), preparedStatement, projectUUID, evidenceUUID)
+
+		return err
+	}
+
+	preparedStatement := `
+	INSERT INTO evidence_custodians(projectUUID, evidenceUUID, custodian) VALUES ($1, $2, $3)
+	ON CONFLICT (projectUUID, evidenceUUID) DO UPDATE SET custodian = $3
+	`
+	_, err := database.Exec(context.Background(), preparedStatement, projectUUID, evidenceUUID, custodian)
+
+	return err
+}
+
+// getEvidenceCustodian returns the custodian of the evidence or an empty string, see SetEvidenceCustodian.
+func getEvidenceCustodian(evidenceUUID string, projectUUID string, database *pgx.Conn) (string, error) {
+	preparedStatement := `
+	SELECT custodian FROM evidence_custodians WHERE projectUUID = $1 AND evidenceUUID = $2
+	`
+	var custodian string
+
+	err := database.QueryRow(context.Background(), preparedStatement, projectUUID, evidenceUUID).Scan(&custodian)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", nil
+	}
+
+	return custodian, err
+}
+
+// SetEvidenceParser pins the parser (see Parser.GetName) of the unparsed evidence, e.g. when the file signature matches the wrong parser.
+// An empty parser name restores the detection from the file signature.
+func SetEvidenceParser(evidenceUUID string, parserName string, projectUUID string, userUUID string, database *pgx.Conn) error {
+	if err := CheckPermission(userUUID, projectUUID, ActionManageEvidence, database); err != nil {
+		return err
+	}
+
+	if parserName != "" {
+		if _, err := getParserByName(parserName); err != nil {
+			return err
+		}
+	}
+
+	evidence, err := getEvidenceByUUID(evidenceUUID, projectUUID, database)
+
+	if err != nil {
+		return err
+	}
+
+	if evidence.IsParsed {
+		return errors.New("evidence is already parsed")
+	}
+
+	evidence.Parser = parserName
+
+	return evidence.Save(database)
+}
+
+// getEvidenceByUUID returns the evidence of the project.
+func getEvidenceByUUID(evidenceUUID string, projectUUID string, database *pgx.Conn) (Evidence, error) {
+	preparedStatement := `
+	SELECT e.uuid, e.fileHash, e.fileName, e.fileSize, e.isParsed, COALESCE(e.parser, '') FROM evidence e
+	INNER JOIN project_evidence_junction pej ON pej.evidenceUUID = e.uuid
+	WHERE pej.projectUUID = $1 AND e.uuid = $2
+	`
+	row := database.QueryRow(context.Background(), preparedStatement, projectUUID, evidenceUUID)
+
+	var evidence Evidence
+
+	if err := row.Scan(&evidence.UUID, &evidence.FileHash, &evidence.FileName, &evidence.FileSize, &evidence.IsParsed, &evidence.Parser); err != nil {
+		return Evidence{}, err
+	}
+
+	return evidence, nil
+}
+
+// Parse parses the evidence with its parser, see getEvidenceParser, NewJobProgressReporter and NewDiscardProgressReporter.
+// Items which fail to parse are listed by GetParseErrors.
+func (evidence *Evidence) Parse(project Project, options ParseOptions, progressReporter ProgressReporter, database *pgx.Conn) error {
+	if evidence.IsParsed {
+		return errors.New("evidence is already parsed")
+	}
+
+	parser, err := getEvidenceParser(*evidence)
+
+	if err != nil {
+		return err
+	}
+
+	Logger.WithFields(LogFields{"project_uuid": project.UUID, "evidence_uuid": evidence.UUID}).Infof("Parsing evidence with the %s parser", parser.GetName())
+
+	return parser.Parse(evidence, project, options, progressReporter, database)
 }
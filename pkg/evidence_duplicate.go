@@ -0,0 +1,151 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v4"
+)
+
+// AuditActionAddEvidence is the audit log action of AddEvidence.
+const AuditActionAddEvidence = "add_evidence"
+
+// DuplicateEvidence represents existing evidence with the same file hash as an uploaded file.
+type DuplicateEvidence struct {
+	EvidenceUUID string `json:"evidence_uuid"`
+	ProjectUUID  string `json:"project_uuid"`
+	FileName     string `json:"file_name"`
+	IsParsed     bool   `json:"is_parsed"`
+	SameProject  bool   `json:"same_project"`
+}
+
+// AddEvidenceResult represents the result of AddEvidence.
+type AddEvidenceResult struct {
+	// Evidence is the added evidence, or the existing evidence if the file is a duplicate in the same project.
+	Evidence Evidence `json:"evidence"`
+	// Added is false if the file is already evidence of the project, it must not be parsed again.
+	Added bool `json:"added"`
+	// Duplicates contains the evidence with the same file hash in this project and the other projects of the user.
+	Duplicates []DuplicateEvidence `json:"duplicates"`
+}
+
+// AddEvidence saves the uploaded evidence and adds it to the project, unless the project already contains evidence with the same file hash.
+// Duplicates in other projects (which the user can view) are reported but the evidence is still added,
+// since parsed messages belong to a single project the evidence must be parsed again (the MinIO object is shared by its hash).
+// Returns an error if the evidence exceeds the quota of the project, see CheckEvidenceQuota.
+func AddEvidence(evidence Evidence, projectUUID string, userUUID string, database *pgx.Conn) (AddEvidenceResult, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionManageEvidence, database); err != nil {
+		return AddEvidenceResult{}, err
+	}
+
+	if evidence.Parser != "" {
+		if _, err := getParserByName(evidence.Parser); err != nil {
+			return AddEvidenceResult{}, err
+		}
+	}
+
+	duplicates, err := getDuplicateEvidence(evidence.FileHash, projectUUID, userUUID, database)
+
+	if err != nil {
+		return AddEvidenceResult{}, err
+	}
+
+	for _, duplicate := range duplicates {
+		if duplicate.SameProject {
+			existingEvidence, err := getEvidenceByUUID(duplicate.EvidenceUUID, projectUUID, database)
+
+			if err != nil {
+				return AddEvidenceResult{}, err
+			}
+
+			Logger.Infof("Skipping duplicate evidence %s of project %s", evidence.FileHash, projectUUID)
+
+			return AddEvidenceResult{
+				Evidence:   existingEvidence,
+				Duplicates: duplicates,
+			}, nil
+		}
+	}
+
+	if evidence.UUID == "" {
+		evidence.UUID = NewUUID()
+	}
+
+	if err := checkEvidenceQuota(evidence.FileSize, projectUUID, database); err != nil {
+		return AddEvidenceResult{}, err
+	}
+
+	evidence.IsParsed = false
+
+	if err := evidence.Save(database); err != nil {
+		return AddEvidenceResult{}, err
+	}
+
+	if err := AddProjectEvidence(projectUUID, evidence.UUID, database); err != nil {
+		return AddEvidenceResult{}, err
+	}
+
+	if err := AddAuditLog(projectUUID, userUUID, AuditActionAddEvidence, evidence.FileName, database); err != nil {
+		return AddEvidenceResult{}, err
+	}
+
+	return AddEvidenceResult{
+		Evidence:   evidence,
+		Added:      true,
+		Duplicates: duplicates,
+	}, nil
+}
+
+// getDuplicateEvidence returns the evidence with the file hash in the project and the other projects which the user can view.
+func getDuplicateEvidence(fileHash string, projectUUID string, userUUID string, database *pgx.Conn) ([]DuplicateEvidence, error) {
+	preparedStatement := `
+	SELECT e.uuid, pej.projectUUID, e.fileName, COALESCE(e.isParsed, FALSE) FROM evidence e
+	INNER JOIN project_evidence_junction pej ON pej.evidenceUUID = e.uuid
+	WHERE e.fileHash = $1
+	ORDER BY e.fileName
+	`
+	rows, err := database.Query(context.Background(), preparedStatement, fileHash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []DuplicateEvidence
+
+	for rows.Next() {
+		var duplicate DuplicateEvidence
+
+		if err := rows.Scan(&duplicate.EvidenceUUID, &duplicate.ProjectUUID, &duplicate.FileName, &duplicate.IsParsed); err != nil {
+			return nil, err
+		}
+
+		duplicate.SameProject = duplicate.ProjectUUID == projectUUID
+
+		candidates = append(candidates, duplicate)
+	}
+
+	rows.Close()
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	var duplicates []DuplicateEvidence
+
+	for _, duplicate := range candidates {
+		// Don't reveal evidence of projects the user isn't assigned to.
+		if !duplicate.SameProject {
+			if err := CheckPermission(userUUID, duplicate.ProjectUUID, ActionView, database); errors.Is(err, ErrPermissionDenied) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+		}
+
+		duplicates = append(duplicates, duplicate)
+	}
+
+	return duplicates, nil
+}
@@ -0,0 +1,70 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import "github.com/jackc/pgx/v4"
+
+// FolderPreview represents a folder of the evidence as it will be created by parsing.
+type FolderPreview struct {
+	Title    string          `json:"title"`
+	Messages int             `json:"messages"` // The estimated messages directly in this folder.
+	Folders  []FolderPreview `json:"folders"`
+}
+
+// EvidencePreview represents the result of validating the evidence before parsing.
+type EvidencePreview struct {
+	EvidenceUUID      string        `json:"evidence_uuid"`
+	Parser            string        `json:"parser"`
+	IsValidSignature  bool          `json:"is_valid_signature"`
+	EstimatedMessages int           `json:"estimated_messages"`
+	EstimatedFolders  int           `json:"estimated_folders"`
+	RootFolder        FolderPreview `json:"root_folder"`
+	Warnings          []string      `json:"warnings"`
+}
+
+// addFolder adds the counts of the folder and its sub-folders to the estimates.
+func (preview *EvidencePreview) addFolder(folder FolderPreview) {
+	preview.EstimatedFolders++
+	preview.EstimatedMessages += folder.Messages
+
+	for _, subFolder := range folder.Folders {
+		preview.addFolder(subFolder)
+	}
+}
+
+// ValidateEvidence checks the signature of the evidence and previews its folder structure with estimated message counts.
+// Nothing is parsed or saved, so users can confirm they uploaded the right file before parsing it.
+// An invalid signature isn't an error, the preview is returned with IsValidSignature false.
+func ValidateEvidence(evidence Evidence, projectUUID string, userUUID string, database *pgx.Conn) (EvidencePreview, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionManageEvidence, database); err != nil {
+		return EvidencePreview{}, err
+	}
+
+	project, err := GetProjectByUUID(projectUUID, database)
+
+	if err != nil {
+		return EvidencePreview{}, err
+	}
+
+	parser, err := getEvidenceParser(evidence)
+
+	if err != nil {
+		return EvidencePreview{}, err
+	}
+
+	preview, err := parser.Validate(&evidence, project)
+
+	if err != nil {
+		return EvidencePreview{}, err
+	}
+
+	preview.EvidenceUUID = evidence.UUID
+	preview.Parser = parser.GetName()
+
+	if preview.IsValidSignature {
+		preview.addFolder(preview.RootFolder)
+	}
+
+	return preview, nil
+}
@@ -5,11 +5,20 @@ package core
 
 import (
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"github.com/aquasecurity/esquery"
+	"github.com/emersion/go-message/mail"
+	"github.com/jackc/pgx/v4"
 	"github.com/minio/minio-go/v7"
+	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // ExportAttachmentsByProject exports the attachments.
@@ -22,15 +31,11 @@ func ExportAttachmentsByProject(extensions []string, projectUUID string) (string
 	}
 
 	exportUUID := NewUUID()
-	exportDirectory := fmt.Sprintf("%s/%s", GetProjectTempDirectory(projectUUID), exportUUID)
+	zipUploader := NewZipUploader(fmt.Sprintf("%s.zip", exportUUID), projectUUID, ArchiveOptions{})
 
-	err = os.Mkdir(exportDirectory, 0755)
+	defer zipUploader.Abort()
 
-	if err != nil {
-		return "", err
-	}
-
-	// Write the attachments to the temp export directory.
+	// Stream the attachments from MinIO into the ZIP file.
 	for _, attachment := range attachments {
 		hasExtension := false
 
@@ -45,39 +50,679 @@ func ExportAttachmentsByProject(extensions []string, projectUUID string) (string
 		}
 
 		if hasExtension {
-			err := MinIOClient.FGetObject(
-				context.Background(),
-				MinIOBucketName,
-				fmt.Sprintf("%s/%s", projectUUID, attachment.UUID),
-				fmt.Sprintf("%s/%s-%s%s", exportDirectory, strings.TrimSuffix(attachment.Name, filepath.Ext(attachment.Name)), attachment.UUID, filepath.Ext(attachment.Name)),
-				minio.GetObjectOptions{},
-			)
+			if err := addAttachmentToZip(zipUploader, exportUUID, attachment, projectUUID); err != nil {
+				return "", err
+			}
+		}
+	}
 
-			if err != nil {
-				if err.Error() == "The specified key does not exist." {
-					// One of the parsers didn't upload the attachment to MinIO.
-					Logger.Warnf("Failed to export attachment (%s - %s): %s", attachment.UUID, attachment.Name, err)
+	return zipUploader.Close()
+}
+
+// AttachmentExportFilters represents the filters of an attachment export.
+// Empty filters match all attachments of the project.
+type AttachmentExportFilters struct {
+	Query       string   `json:"query"`
+	FolderUUIDs []string `json:"folder_uuids"` // Includes the sub folders.
+	TagUUIDs    []string `json:"tag_uuids"`    // Messages with any of the tags.
+	StartDate   int      `json:"start_date"`   // Unix timestamp, zero for no limit.
+	EndDate     int      `json:"end_date"`     // Unix timestamp, zero for no limit.
+	Extensions  []string `json:"extensions"`   // For example ".pdf".
+	Hashes      []string `json:"hashes"`       // MD5 or SHA-256 (hex) of the attachment.
+	// Archive encrypts and splits the ZIP file.
+	Archive ArchiveOptions `json:"archive"`
+	// SuppressKnownDocuments skips the attachments in the hash lists of the project, see ImportHashList.
+	SuppressKnownDocuments bool `json:"suppress_known_documents"`
+}
+
+// ExportAttachments exports the attachments of the messages matching the filters.
+// The ZIP file is streamed to MinIO, see ZipUploader. Returns the MinIO path to the uploaded ZIP file.
+func ExportAttachments(projectUUID string, filters AttachmentExportFilters, userUUID string, database *pgx.Conn) (string, error) {
+	return exportAttachments(projectUUID, filters, nil, userUUID, database)
+}
+
+// exportAttachments runs ExportAttachments, reportProgress is called with the percentage of the processed messages if set.
+func exportAttachments(projectUUID string, filters AttachmentExportFilters, reportProgress func(progress int), userUUID string, database *pgx.Conn) (string, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionExport, database); err != nil {
+		return "", err
+	}
+
+	// Privileged messages are withheld, see SetPrivilegeDesignation.
+	query := withoutPrivilegedMessages(newSearchQuery(filters.Query, projectUUID)).Filter(esquery.Exists("attachments.uuid"))
+
+	if len(filters.FolderUUIDs) > 0 {
+		folderUUIDs, err := getFolderTreeUUIDs(filters.FolderUUIDs, projectUUID, database)
+
+		if err != nil {
+			return "", err
+		}
+
+		query = query.Filter(esquery.Terms("folder_uuid", folderUUIDs...))
+	}
+
+	if len(filters.TagUUIDs) > 0 {
+		var tagUUIDs []interface{}
+
+		for _, tagUUID := range filters.TagUUIDs {
+			tagUUIDs = append(tagUUIDs, tagUUID)
+		}
+
+		query = query.Filter(esquery.Terms("tag_uuids", tagUUIDs...))
+	}
+
+	if filters.StartDate > 0 || filters.EndDate > 0 {
+		receivedRange := esquery.Range("received")
+
+		if filters.StartDate > 0 {
+			receivedRange = receivedRange.Gte(filters.StartDate)
+		}
+
+		if filters.EndDate > 0 {
+			receivedRange = receivedRange.Lte(filters.EndDate)
+		}
+
+		query = query.Filter(receivedRange)
+	}
+
+	hashes := map[string]bool{}
+	hasMD5Hashes := false
+
+	for _, hash := range filters.Hashes {
+		hashes[strings.ToLower(hash)] = true
+
+		if len(hash) == hex.EncodedLen(md5.Size) {
+			hasMD5Hashes = true
+		}
+	}
+
+	total, err := countMessages(query)
+
+	if err != nil {
+		return "", err
+	}
+
+	progress := newExportProgress(total, reportProgress)
+
+	// Attachments are only downloaded to check their MD5 hash or if they were stored before deduplication.
+	var scratchSpace *ScratchSpace
+
+	if len(hashes) > 0 {
+		scratchSpace, err = NewScratchSpace(projectUUID)
+
+		if err != nil {
+			return "", err
+		}
+
+		defer scratchSpace.cleanup()
+	}
+
+	exportUUID := NewUUID()
+	zipUploader := NewZipUploader(fmt.Sprintf("%s.zip", exportUUID), projectUUID, filters.Archive)
+
+	defer zipUploader.Abort()
+
+	err = forEachMessageBatch(query, func(messages []Message) error {
+		for _, message := range messages {
+			for _, attachment := range message.Attachments {
+				if !hasAttachmentExtension(attachment, filters.Extensions) || (filters.SuppressKnownDocuments && attachment.IsSuppressed) {
 					continue
-				} else {
-					return "", err
 				}
+
+				if len(hashes) == 0 || (attachment.Hash != "" && hashes[attachment.Hash]) {
+					if err := addAttachmentToZip(zipUploader, exportUUID, attachment, projectUUID); err != nil {
+						return err
+					}
+
+					continue
+				}
+
+				if attachment.Hash != "" && !hasMD5Hashes {
+					continue
+				}
+
+				if err := addAttachmentToZipByHash(zipUploader, exportUUID, attachment, projectUUID, hashes, scratchSpace); err != nil {
+					return err
+				}
+			}
+		}
+
+		progress.add(len(messages))
+
+		return nil
+	}, database)
+
+	if err != nil {
+		return "", err
+	}
+
+	return zipUploader.Close()
+}
+
+// hasAttachmentExtension returns true if the attachment has one of the extensions (case-insensitive).
+// Returns true if no extensions are specified.
+func hasAttachmentExtension(attachment Attachment, extensions []string) bool {
+	if len(extensions) == 0 {
+		return true
+	}
+
+	for _, extension := range extensions {
+		if strings.EqualFold(filepath.Ext(attachment.Name), extension) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// fileHasHash returns true if the MD5 or SHA-256 hash of the file is one of the (lowercase hex) hashes.
+func fileHasHash(filePath string, hashes map[string]bool) (bool, error) {
+	inputFile, err := os.Open(filePath)
+
+	if err != nil {
+		return false, err
+	}
+
+	defer func() {
+		if err := inputFile.Close(); err != nil {
+			Logger.Errorf("Failed to close file: %s", err)
+		}
+	}()
+
+	md5Hash := md5.New()
+	sha256Hash := sha256.New()
+
+	if _, err := io.Copy(io.MultiWriter(md5Hash, sha256Hash), inputFile); err != nil {
+		return false, err
+	}
+
+	return hashes[hex.EncodeToString(md5Hash.Sum(nil))] || hashes[hex.EncodeToString(sha256Hash.Sum(nil))], nil
+}
+
+// exportAttachment writes the attachment from MinIO to the export directory and returns the path of the written file.
+// Returns an empty path if the attachment isn't stored in MinIO.
+func exportAttachment(attachment Attachment, projectUUID string, exportDirectory string) (string, error) {
+	logger := Logger.WithFields(LogFields{"project_uuid": projectUUID})
+
+	attachmentPath := fmt.Sprintf("%s/%s", exportDirectory, getExportAttachmentName(attachment))
+	objectName := getAttachmentObjectName(attachment, projectUUID)
+
+	bucketName, err := getObjectBucket(objectName)
+
+	if err != nil {
+		return "", err
+	}
+
+	getObjectOptions, err := getObjectOptions(objectName)
+
+	if err != nil {
+		return "", err
+	}
+
+	err = MinIOClient.FGetObject(
+		context.Background(),
+		bucketName,
+		objectName,
+		attachmentPath,
+		getObjectOptions,
+	)
+
+	if err != nil {
+		if err.Error() == "The specified key does not exist." {
+			// One of the parsers didn't upload the attachment to MinIO.
+			logger.Warnf("Failed to export attachment (%s - %s): %s", attachment.UUID, attachment.Name, err)
+			return "", nil
+		} else {
+			return "", err
+		}
+	}
+
+	return attachmentPath, nil
+}
+
+// getExportAttachmentName returns the file name of the attachment in an export, the UUID keeps the names unique.
+func getExportAttachmentName(attachment Attachment) string {
+	// The attachment name comes from the evidence, don't allow it to point outside the export directory.
+	attachmentName := filepath.Base(attachment.Name)
+
+	return fmt.Sprintf("%s-%s%s", strings.TrimSuffix(attachmentName, filepath.Ext(attachmentName)), attachment.UUID, filepath.Ext(attachmentName))
+}
+
+// addAttachmentToZip streams the attachment from MinIO into the export folder of the ZIP file.
+// Attachments which aren't stored in MinIO are skipped.
+func addAttachmentToZip(zipUploader *ZipUploader, exportUUID string, attachment Attachment, projectUUID string) error {
+	err := zipUploader.AddObject(fmt.Sprintf("%s/%s", exportUUID, getExportAttachmentName(attachment)), getAttachmentObjectName(attachment, projectUUID))
+
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		// One of the parsers didn't upload the attachment to MinIO.
+		Logger.WithFields(LogFields{"project_uuid": projectUUID}).Warnf("Failed to export attachment (%s - %s): %s", attachment.UUID, attachment.Name, err)
+		return nil
+	}
+
+	return err
+}
+
+// addAttachmentToZipByHash adds the attachment to the export folder of the ZIP file if its MD5 or SHA-256 hash is one of the hashes.
+// The attachment is downloaded to the scratch space to calculate the hashes.
+func addAttachmentToZipByHash(zipUploader *ZipUploader, exportUUID string, attachment Attachment, projectUUID string, hashes map[string]bool, scratchSpace *ScratchSpace) error {
+	attachmentPath, err := exportAttachment(attachment, projectUUID, scratchSpace.Path)
+
+	if err != nil || attachmentPath == "" {
+		return err
+	}
+
+	defer func() {
+		if err := os.Remove(attachmentPath); err != nil {
+			Logger.Errorf("Failed to remove file: %s", err)
+		}
+	}()
+
+	hasHash, err := fileHasHash(attachmentPath, hashes)
+
+	if err != nil || !hasHash {
+		return err
+	}
+
+	return zipUploader.AddFile(fmt.Sprintf("%s/%s", exportUUID, filepath.Base(attachmentPath)), attachmentPath)
+}
+
+// uploadExportDirectory ZIPs the export directory in the scratch space while uploading it to MinIO, see ZipUploader.
+// The archive options encrypt and split the ZIP file. Returns the MinIO path to the uploaded file.
+func uploadExportDirectory(exportUUID string, scratchSpace *ScratchSpace, archive ArchiveOptions, projectUUID string) (string, error) {
+	zipUploader := NewZipUploader(fmt.Sprintf("%s.zip", exportUUID), projectUUID, archive)
+
+	defer zipUploader.Abort()
+
+	if err := zipUploader.AddDirectory(scratchSpace.FilePath(exportUUID)); err != nil {
+		return "", err
+	}
+
+	return zipUploader.Close()
+}
+
+// exportProgress reports the progress of an export as the percentage of the processed messages.
+type exportProgress struct {
+	total          int
+	processed      int
+	percent        int
+	reportProgress func(progress int)
+}
+
+// newExportProgress creates the progress of an export of the total messages, reportProgress may be nil.
+func newExportProgress(total int, reportProgress func(progress int)) *exportProgress {
+	return &exportProgress{
+		total:          total,
+		reportProgress: reportProgress,
+	}
+}
+
+// add adds the processed messages, the progress is only reported when the percentage changes.
+func (progress *exportProgress) add(processed int) {
+	if progress.reportProgress == nil || progress.total == 0 {
+		return
+	}
+
+	progress.processed += processed
+
+	percent := progress.processed * 100 / progress.total
+
+	if percent > 100 {
+		percent = 100
+	}
+
+	if percent != progress.percent {
+		progress.percent = percent
+		progress.reportProgress(percent)
+	}
+}
+
+// ExportMessagesAsEML exports the messages as EML (RFC822) files in a ZIP and returns the MinIO path to the uploaded file.
+// Exports the specified messages or, if no message UUIDs are specified, all messages matching the search query.
+// The ZIP file is streamed to MinIO, see ZipUploader. The archive options encrypt and split the ZIP file.
+func ExportMessagesAsEML(projectUUID string, messageUUIDs []string, query string, archive ArchiveOptions, userUUID string, database *pgx.Conn) (string, error) {
+	return exportMessagesAsEML(projectUUID, messageUUIDs, query, archive, nil, userUUID, database)
+}
+
+// exportMessagesAsEML runs ExportMessagesAsEML, reportProgress is called with the percentage of the exported messages if set.
+func exportMessagesAsEML(projectUUID string, messageUUIDs []string, query string, archive ArchiveOptions, reportProgress func(progress int), userUUID string, database *pgx.Conn) (string, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionExport, database); err != nil {
+		return "", err
+	}
+
+	searchQuery := newSearchQuery(query, projectUUID)
+
+	if len(messageUUIDs) > 0 {
+		searchQuery = newMessageUUIDsQuery(messageUUIDs, projectUUID)
+	}
+
+	// Privileged messages are withheld, even if specified, see SetPrivilegeDesignation.
+	searchQuery = withoutPrivilegedMessages(searchQuery)
+
+	total, err := countMessages(searchQuery)
+
+	if err != nil {
+		return "", err
+	}
+
+	progress := newExportProgress(total, reportProgress)
+
+	exportUUID := NewUUID()
+	zipUploader := NewZipUploader(fmt.Sprintf("%s.zip", exportUUID), projectUUID, archive)
+
+	defer zipUploader.Abort()
+
+	err = forEachMessageBatch(searchQuery, func(messages []Message) error {
+		for _, message := range messages {
+			emlFile, err := zipUploader.Create(fmt.Sprintf("%s/%s.eml", exportUUID, message.UUID))
+
+			if err != nil {
+				return err
 			}
+
+			if err := writeMessageAsEML(message, emlFile); err != nil {
+				return err
+			}
+		}
+
+		progress.add(len(messages))
+
+		return nil
+	}, database)
+
+	if err != nil {
+		return "", err
+	}
+
+	return zipUploader.Close()
+}
+
+// writeMessageAsEML reconstructs the message (headers, body and attachments) as RFC822 and writes it to the writer.
+func writeMessageAsEML(message Message, writer io.Writer) error {
+	var header mail.Header
+
+	if message.MessageID != messageNullValue && message.MessageID != "" {
+		header.Set("Message-Id", message.MessageID)
+	}
+
+	if message.Received > 0 {
+		header.SetDate(time.Unix(int64(message.Received), 0))
+	}
+
+	if message.Subject != messageNullValue {
+		header.SetSubject(message.Subject)
+	}
+
+	// The address headers are stored as found in the original message.
+	if message.From != messageNullValue && message.From != "" {
+		header.Set("From", message.From)
+	}
+
+	if message.To != messageNullValue && message.To != "" {
+		header.Set("To", message.To)
+	}
+
+	if message.CC != messageNullValue && message.CC != "" {
+		header.Set("Cc", message.CC)
+	}
+
+	mailWriter, err := mail.CreateWriter(writer, header)
+
+	if err != nil {
+		return err
+	}
+
+	var bodyHeader mail.InlineHeader
+
+	body, err := getOriginalMessageBody(message)
+
+	if err != nil {
+		return err
+	}
+
+	if body == messageNullValue {
+		body = ""
+	}
+
+	if isHTMLBody(body) {
+		bodyHeader.SetContentType("text/html", map[string]string{"charset": "utf-8"})
+	} else {
+		bodyHeader.SetContentType("text/plain", map[string]string{"charset": "utf-8"})
+	}
+
+	bodyWriter, err := mailWriter.CreateSingleInline(bodyHeader)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.WriteString(bodyWriter, body); err != nil {
+		return err
+	}
+
+	if err := bodyWriter.Close(); err != nil {
+		return err
+	}
+
+	for _, attachment := range message.Attachments {
+		if err := writeAttachmentToEML(attachment, message.ProjectUUID, mailWriter); err != nil {
+			return err
+		}
+	}
+
+	return mailWriter.Close()
+}
+
+// writeAttachmentToEML writes the attachment stored in MinIO as part of the EML.
+func writeAttachmentToEML(attachment Attachment, projectUUID string, mailWriter *mail.Writer) error {
+	logger := Logger.WithFields(LogFields{"project_uuid": projectUUID})
+
+	objectReader, err := GetObject(getAttachmentObjectName(attachment, projectUUID))
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := objectReader.Close(); err != nil {
+			logger.Errorf("Failed to close MinIO object: %s", err)
 		}
+	}()
+
+	// GetObject doesn't fail on missing objects, Stat does.
+	if _, err := objectReader.Stat(); err != nil {
+		// One of the parsers didn't upload the attachment to MinIO.
+		logger.Warnf("Failed to export attachment (%s - %s): %s", attachment.UUID, attachment.Name, err)
+		return nil
 	}
 
-	// ZIP the directory.
-	err = ZipDirectory(exportDirectory, fmt.Sprintf("%s/%s.zip", GetProjectTempDirectory(projectUUID), exportUUID))
+	var attachmentHeader mail.AttachmentHeader
+
+	attachmentHeader.SetContentType("application/octet-stream", nil)
+	attachmentHeader.SetFilename(attachment.Name)
+
+	attachmentWriter, err := mailWriter.CreateAttachment(attachmentHeader)
 
 	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(attachmentWriter, objectReader); err != nil {
+		return err
+	}
+
+	return attachmentWriter.Close()
+}
+
+// messageExportFields defines the fields which can be exported by ExportMessagesToCSV.
+var messageExportFields = map[string]func(message Message) string{
+	"uuid":          func(message Message) string { return message.UUID },
+	"message_id":    func(message Message) string { return message.MessageID },
+	"subject":       func(message Message) string { return message.Subject },
+	"from":          func(message Message) string { return message.From },
+	"to":            func(message Message) string { return message.To },
+	"cc":            func(message Message) string { return message.CC },
+	"received":      func(message Message) string { return formatMessageExportDate(message.Received) },
+	"size":          func(message Message) string { return strconv.FormatInt(int64(message.Size), 10) },
+	"body":          func(message Message) string { return message.Body },
+	"headers":       func(message Message) string { return message.Headers },
+	"folder_uuid":   func(message Message) string { return message.FolderUUID },
+	"evidence_uuid": func(message Message) string { return message.EvidenceUUID },
+	"is_bookmarked": func(message Message) string { return strconv.FormatBool(message.IsBookmarked) },
+	"review_status": func(message Message) string { return message.ReviewStatus },
+	"reviewer":      func(message Message) string { return message.Reviewer },
+	"attachments": func(message Message) string {
+		var attachmentNames []string
+
+		for _, attachment := range message.Attachments {
+			attachmentNames = append(attachmentNames, attachment.Name)
+		}
+
+		return strings.Join(attachmentNames, "; ")
+	},
+	"tags": func(message Message) string {
+		var tagNames []string
+
+		for _, tag := range message.Tags {
+			tagNames = append(tagNames, tag.Name)
+		}
+
+		return strings.Join(tagNames, "; ")
+	},
+	"comments": func(message Message) string {
+		var commentBodies []string
+
+		for _, comment := range message.Comments {
+			commentBodies = append(commentBodies, comment.Body)
+		}
+
+		return strings.Join(commentBodies, "\n")
+	},
+	"parser":         func(message Message) string { return message.getProvenance().Parser },
+	"parser_version": func(message Message) string { return message.getProvenance().ParserVersion },
+	"evidence_hash":  func(message Message) string { return message.getProvenance().EvidenceHash },
+	"extracted_at":   func(message Message) string { return formatMessageExportDate(message.getProvenance().ExtractedAt) },
+	"sent": func(message Message) string {
+		return formatMessageExportDateWithOffset(message.SentDate, message.SentOffset)
+	},
+	"delivered": func(message Message) string {
+		return formatMessageExportDateWithOffset(message.DeliveredDate, message.DeliveredOffset)
+	},
+	"date_anomalies": func(message Message) string { return strings.Join(message.DateAnomalies, "; ") },
+}
+
+// DefaultMessageExportFields defines the fields exported by ExportMessagesToCSV if no fields are specified.
+var DefaultMessageExportFields = []string{"uuid", "message_id", "received", "from", "to", "cc", "subject", "attachments", "tags", "review_status"}
+
+// formatMessageExportDate returns the Unix timestamp formatted as RFC3339 or an empty string if there is no date.
+func formatMessageExportDate(timestamp int) string {
+	if timestamp <= 0 {
+		return ""
+	}
+
+	return time.Unix(int64(timestamp), 0).UTC().Format(time.RFC3339)
+}
+
+// formatMessageExportDateWithOffset returns the Unix timestamp formatted as RFC3339 in its original UTC offset (minutes),
+// in UTC if the offset is unknown.
+func formatMessageExportDateWithOffset(timestamp int, offset *int) string {
+	if timestamp <= 0 || offset == nil {
+		return formatMessageExportDate(timestamp)
+	}
+
+	return time.Unix(int64(timestamp), 0).In(time.FixedZone("", *offset*60)).Format(time.RFC3339)
+}
+
+// ExportMessagesToCSV exports the fields of the messages matching the search query and filters to a CSV or XLSX file.
+// Privileged messages are withheld, see SetPrivilegeDesignation.
+// Returns the MinIO path to the uploaded file.
+func ExportMessagesToCSV(projectUUID string, query string, filters SearchFilters, fields []string, format string, userUUID string, database *pgx.Conn) (string, error) {
+	logger := Logger.WithFields(LogFields{"project_uuid": projectUUID})
+
+	if err := CheckPermission(userUUID, projectUUID, ActionExport, database); err != nil {
 		return "", err
 	}
 
-	// Upload the ZIP file to MinIO.
-	uploadedFilePath, err := UploadFile(fmt.Sprintf("%s.zip", exportUUID), fmt.Sprintf("%s/%s.zip", GetProjectTempDirectory(projectUUID), exportUUID), projectUUID)
+	if format != SpreadsheetFormatCSV && format != SpreadsheetFormatXLSX {
+		return "", fmt.Errorf("unsupported spreadsheet format: %s", format)
+	}
+
+	if len(fields) == 0 {
+		fields = DefaultMessageExportFields
+	}
+
+	for _, field := range fields {
+		if _, ok := messageExportFields[field]; !ok {
+			return "", fmt.Errorf("unknown export field: %s", field)
+		}
+	}
+
+	scratchSpace, err := NewScratchSpace(projectUUID)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer scratchSpace.cleanup()
+
+	exportUUID := NewUUID()
+	exportPath := scratchSpace.FilePath(fmt.Sprintf("%s.%s", exportUUID, format))
+
+	exportFile, err := os.Create(exportPath)
 
 	if err != nil {
 		return "", err
 	}
 
-	return uploadedFilePath, nil
+	if err := writeMessagesToSpreadsheet(filters.apply(withoutPrivilegedMessages(newSearchQuery(query, projectUUID))), fields, format, filters.SuppressKnownDocuments, exportFile, database); err != nil {
+		if closeErr := exportFile.Close(); closeErr != nil {
+			logger.Errorf("Failed to close file: %s", closeErr)
+		}
+
+		return "", err
+	}
+
+	if err := exportFile.Close(); err != nil {
+		return "", err
+	}
+
+	return UploadFile(fmt.Sprintf("%s.%s", exportUUID, format), exportPath, projectUUID)
+}
+
+// writeMessagesToSpreadsheet writes the fields of the messages matching the query as spreadsheet rows, preceded by a header row.
+// Suppressed attachments are left out if suppressKnownDocuments is set, see SearchFilters.SuppressKnownDocuments.
+func writeMessagesToSpreadsheet(query esquery.Mappable, fields []string, format string, suppressKnownDocuments bool, writer io.Writer, database *pgx.Conn) error {
+	spreadsheet, err := newSpreadsheetWriter(format, writer)
+
+	if err != nil {
+		return err
+	}
+
+	if err := spreadsheet.WriteRow(fields); err != nil {
+		return err
+	}
+
+	err = forEachMessageBatch(query, func(messages []Message) error {
+		if suppressKnownDocuments {
+			removeSuppressedAttachments(messages)
+		}
+
+		for _, message := range messages {
+			row := make([]string, 0, len(fields))
+
+			for _, field := range fields {
+				row = append(row, messageExportFields[field](message))
+			}
+
+			if err := spreadsheet.WriteRow(row); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}, database)
+
+	if err != nil {
+		return err
+	}
+
+	return spreadsheet.Close()
 }
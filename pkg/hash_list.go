@@ -0,0 +1,402 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/aquasecurity/esquery"
+	"github.com/jackc/pgx/v4"
+	"io"
+	"strings"
+	"time"
+)
+
+// Audit actions of the hash lists.
+const (
+	AuditActionImportHashList = "import_hash_list"
+	AuditActionDeleteHashList = "delete_hash_list"
+)
+
+// HashList represents a list of known documents (e.g. privileged or previously produced documents) of a project.
+// Messages and attachments with a hash in any of the lists are suppressed, see SearchFilters.SuppressKnownDocuments.
+type HashList struct {
+	UUID         string `json:"uuid"`
+	ProjectUUID  string `json:"project_uuid"`
+	Name         string `json:"name"`
+	HashCount    int    `json:"hash_count"`
+	CreationDate int    `json:"creation_date"`
+}
+
+// HashListImport represents the result of ImportHashList.
+type HashListImport struct {
+	HashList HashList `json:"hash_list"`
+	Imported int      `json:"imported"` // The amount of unique hashes.
+	Skipped  int      `json:"skipped"`  // The amount of rows without a SHA-256 hash, e.g. the header row or MD5 hashes.
+}
+
+// SuppressionCounts represents the amount of suppressed items, see GetSuppressionCounts.
+type SuppressionCounts struct {
+	Messages    int `json:"messages"`
+	Attachments int `json:"attachments"`
+}
+
+// suppressionHashesPerQuery defines the maximum amount of hashes per Elasticsearch terms query (below index.max_terms_count).
+const suppressionHashesPerQuery = 10000
+
+// ErrEmptyHashList is returned by ImportHashList if the CSV file contains no SHA-256 hashes.
+var ErrEmptyHashList = errors.New("hash list contains no SHA-256 hashes")
+
+// ImportHashList imports the CSV file of SHA-256 (hex) hashes as hash list of the project and suppresses the matching messages and attachments.
+// The first column containing a SHA-256 hash is used, so exports of other tools (with e.g. a file name column) can be imported as is.
+// Only SHA-256 is supported since it is the hash stored for the original messages and attachments.
+func ImportHashList(name string, reader io.Reader, projectUUID string, userUUID string, database *pgx.Conn) (HashListImport, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionManageEvidence, database); err != nil {
+		return HashListImport{}, err
+	}
+
+	if strings.TrimSpace(name) == "" {
+		return HashListImport{}, errors.New("hash list name is empty")
+	}
+
+	hashes, skipped, err := readHashListCSV(reader)
+
+	if err != nil {
+		return HashListImport{}, err
+	}
+
+	if len(hashes) == 0 {
+		return HashListImport{}, ErrEmptyHashList
+	}
+
+	hashList := HashList{
+		UUID:         NewUUID(),
+		ProjectUUID:  projectUUID,
+		Name:         strings.TrimSpace(name),
+		HashCount:    len(hashes),
+		CreationDate: int(time.Now().Unix()),
+	}
+
+	preparedStatement := `
+	INSERT INTO hash_lists(uuid, projectUUID, name, creationDate) VALUES ($1, $2, $3, $4)
+	`
+	_, err = database.Exec(context.Background(), preparedStatement, hashList.UUID, hashList.ProjectUUID, hashList.Name, hashList.CreationDate)
+
+	if err != nil {
+		return HashListImport{}, err
+	}
+
+	for _, hash := range hashes {
+		preparedStatement := `
+		INSERT INTO hash_list_entries(hashListUUID, projectUUID, hash) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING
+		`
+		_, err := database.Exec(context.Background(), preparedStatement, hashList.UUID, projectUUID, hash)
+
+		if err != nil {
+			return HashListImport{}, err
+		}
+	}
+
+	if err := AddAuditLog(projectUUID, userUUID, AuditActionImportHashList, fmt.Sprintf("%s (%d hashes)", hashList.Name, len(hashes)), database); err != nil {
+		return HashListImport{}, err
+	}
+
+	if err := updateProjectSuppression(projectUUID, database); err != nil {
+		return HashListImport{}, err
+	}
+
+	return HashListImport{
+		HashList: hashList,
+		Imported: len(hashes),
+		Skipped:  skipped,
+	}, nil
+}
+
+// readHashListCSV returns the unique, lowercase SHA-256 hashes of the CSV file and the amount of rows without a hash.
+func readHashListCSV(reader io.Reader) ([]string, int, error) {
+	csvReader := csv.NewReader(reader)
+	csvReader.FieldsPerRecord = -1
+	csvReader.LazyQuotes = true
+	csvReader.TrimLeadingSpace = true
+
+	var hashes []string
+	var skipped int
+
+	uniqueHashes := make(map[string]bool)
+
+	for {
+		record, err := csvReader.Read()
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, 0, err
+		}
+
+		hash := getRecordSHA256(record)
+
+		if hash == "" {
+			skipped++
+			continue
+		}
+
+		if !uniqueHashes[hash] {
+			uniqueHashes[hash] = true
+			hashes = append(hashes, hash)
+		}
+	}
+
+	return hashes, skipped, nil
+}
+
+// getRecordSHA256 returns the first field of the CSV record which is a SHA-256 (hex) hash, lowercase, or an empty string.
+func getRecordSHA256(record []string) string {
+	for _, field := range record {
+		field = strings.ToLower(strings.TrimSpace(field))
+
+		if len(field) != hex.EncodedLen(32) {
+			continue
+		}
+
+		if _, err := hex.DecodeString(field); err == nil {
+			return field
+		}
+	}
+
+	return ""
+}
+
+// GetHashLists returns the hash lists of the project.
+func GetHashLists(projectUUID string, userUUID string, database *pgx.Conn) ([]HashList, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return nil, err
+	}
+
+	preparedStatement := `
+	SELECT l.uuid, l.projectUUID, l.name, l.creationDate, (SELECT COUNT(*) FROM hash_list_entries e WHERE e.hashListUUID = l.uuid)
+	FROM hash_lists l
+	WHERE l.projectUUID = $1
+	ORDER BY l.name ASC
+	`
+	rows, err := database.Query(context.Background(), preparedStatement, projectUUID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var hashLists []HashList
+
+	for rows.Next() {
+		var hashList HashList
+
+		if err := rows.Scan(&hashList.UUID, &hashList.ProjectUUID, &hashList.Name, &hashList.CreationDate, &hashList.HashCount); err != nil {
+			return nil, err
+		}
+
+		hashLists = append(hashLists, hashList)
+	}
+
+	rows.Close()
+
+	return hashLists, rows.Err()
+}
+
+// DeleteHashList removes the hash list, its messages and attachments are no longer suppressed unless they are in another hash list.
+func DeleteHashList(hashListUUID string, projectUUID string, userUUID string, database *pgx.Conn) error {
+	if err := CheckPermission(userUUID, projectUUID, ActionManageEvidence, database); err != nil {
+		return err
+	}
+
+	if err := checkProjectNotOnHold(projectUUID, userUUID, AuditActionDeleteHashList, database); err != nil {
+		return err
+	}
+
+	var name string
+
+	preparedStatement := `
+	SELECT name FROM hash_lists WHERE uuid = $1 AND projectUUID = $2
+	`
+	if err := database.QueryRow(context.Background(), preparedStatement, hashListUUID, projectUUID).Scan(&name); err != nil {
+		return err
+	}
+
+	for _, preparedStatement := range []string{
+		"DELETE FROM hash_list_entries WHERE hashListUUID = $1 AND projectUUID = $2",
+		"DELETE FROM hash_lists WHERE uuid = $1 AND projectUUID = $2",
+	} {
+		if _, err := database.Exec(context.Background(), preparedStatement, hashListUUID, projectUUID); err != nil {
+			return err
+		}
+	}
+
+	if err := AddAuditLog(projectUUID, userUUID, AuditActionDeleteHashList, name, database); err != nil {
+		return err
+	}
+
+	return updateProjectSuppression(projectUUID, database)
+}
+
+// getSuppressedHashes returns the hashes of all hash lists of the project.
+func getSuppressedHashes(projectUUID string, database *pgx.Conn) (map[string]bool, error) {
+	preparedStatement := `
+	SELECT DISTINCT hash FROM hash_list_entries WHERE projectUUID = $1
+	`
+	rows, err := database.Query(context.Background(), preparedStatement, projectUUID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make(map[string]bool)
+
+	for rows.Next() {
+		var hash string
+
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+
+		hashes[hash] = true
+	}
+
+	rows.Close()
+
+	return hashes, rows.Err()
+}
+
+// setSuppressionFlags suppresses the message and its attachments if their hash is in the hashes.
+func setSuppressionFlags(message *Message, hashes map[string]bool) {
+	message.IsSuppressed = message.OriginalHash != "" && hashes[message.OriginalHash]
+
+	for i, attachment := range message.Attachments {
+		message.Attachments[i].IsSuppressed = attachment.Hash != "" && hashes[attachment.Hash]
+	}
+}
+
+// removeSuppressedAttachments removes the suppressed attachments from the messages.
+func removeSuppressedAttachments(messages []Message) {
+	for i, message := range messages {
+		var attachments []Attachment
+
+		for _, attachment := range message.Attachments {
+			if !attachment.IsSuppressed {
+				attachments = append(attachments, attachment)
+			}
+		}
+
+		messages[i].Attachments = attachments
+	}
+}
+
+// updateProjectSuppression updates the suppression of the messages and attachments of the project to the current hash lists.
+func updateProjectSuppression(projectUUID string, database *pgx.Conn) error {
+	if err := updateMessagesMapping(); err != nil {
+		return err
+	}
+
+	hashes, err := getSuppressedHashes(projectUUID, database)
+
+	if err != nil {
+		return err
+	}
+
+	suppressedQuery := esquery.Bool().
+		Filter(esquery.Term("project_uuid", projectUUID)).
+		MinimumShouldMatch(1).
+		Should(esquery.Term("is_suppressed", true), esquery.Term("attachments.is_suppressed", true))
+
+	err = updateMessagesByScript(
+		suppressedQuery,
+		"ctx._source.remove('is_suppressed'); if (ctx._source.attachments != null) { for (attachment in ctx._source.attachments) { attachment.remove('is_suppressed'); } }",
+		map[string]interface{}{},
+	)
+
+	if err != nil {
+		return err
+	}
+
+	var hashValues []interface{}
+	hashParameters := make(map[string]interface{})
+
+	for hash := range hashes {
+		hashValues = append(hashValues, hash)
+		hashParameters[hash] = true
+
+		if len(hashValues) < suppressionHashesPerQuery {
+			continue
+		}
+
+		if err := suppressMessagesByHashes(hashValues, hashParameters, projectUUID); err != nil {
+			return err
+		}
+
+		hashValues = nil
+		hashParameters = make(map[string]interface{})
+	}
+
+	if len(hashValues) > 0 {
+		return suppressMessagesByHashes(hashValues, hashParameters, projectUUID)
+	}
+
+	return nil
+}
+
+// suppressMessagesByHashes suppresses the messages and attachments of the project with one of the hashes.
+func suppressMessagesByHashes(hashValues []interface{}, hashParameters map[string]interface{}, projectUUID string) error {
+	query := esquery.Bool().
+		Filter(esquery.Term("project_uuid", projectUUID)).
+		MinimumShouldMatch(1).
+		Should(esquery.Terms("original_hash", hashValues...), esquery.Terms("attachments.hash", hashValues...))
+
+	return updateMessagesByScript(
+		query,
+		"if (ctx._source.original_hash != null && params.hashes.containsKey(ctx._source.original_hash)) { ctx._source.is_suppressed = true; } if (ctx._source.attachments != null) { for (attachment in ctx._source.attachments) { if (attachment.hash != null && params.hashes.containsKey(attachment.hash)) { attachment.is_suppressed = true; } } }",
+		map[string]interface{}{
+			"hashes": hashParameters,
+		},
+	)
+}
+
+// GetSuppressionCounts returns the amount of messages and attachments matching the search query and filters which are
+// suppressed by the hash lists of the project. SearchFilters.SuppressKnownDocuments is ignored so the counts show what is suppressed.
+func GetSuppressionCounts(query string, filters SearchFilters, projectUUID string, userUUID string, database *pgx.Conn) (SuppressionCounts, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return SuppressionCounts{}, err
+	}
+
+	filters.SuppressKnownDocuments = false
+
+	searchQuery := filters.apply(newSearchQuery(query, projectUUID))
+
+	var suppressionCounts SuppressionCounts
+	var err error
+
+	suppressionCounts.Messages, err = countMessages(esquery.Bool().Filter(searchQuery, esquery.Term("is_suppressed", true)))
+
+	if err != nil {
+		return SuppressionCounts{}, err
+	}
+
+	// The attachments aren't nested documents so the suppressed attachments of the matching messages are counted here.
+	err = forEachMessageBatch(esquery.Bool().Filter(searchQuery, esquery.Term("attachments.is_suppressed", true)), func(messages []Message) error {
+		for _, message := range messages {
+			for _, attachment := range message.Attachments {
+				if attachment.IsSuppressed {
+					suppressionCounts.Attachments++
+				}
+			}
+		}
+
+		return nil
+	}, database)
+
+	if err != nil {
+		return SuppressionCounts{}, err
+	}
+
+	return suppressionCounts, nil
+}
@@ -0,0 +1,166 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"github.com/segmentio/kafka-go"
+	"time"
+)
+
+// HealthReport represents the health of all dependencies.
+// Healthy is only true if all checks are healthy.
+type HealthReport struct {
+	Healthy bool                `json:"healthy"`
+	Checks  []HealthCheckResult `json:"checks"`
+}
+
+// HealthCheckResult represents the health of a dependency.
+type HealthCheckResult struct {
+	Name     string `json:"name"`
+	Healthy  bool   `json:"healthy"`
+	Duration int64  `json:"duration"` // Milliseconds.
+	Error    string `json:"error,omitempty"`
+}
+
+// healthChecks defines the dependency health checks.
+var healthChecks = []struct {
+	Name  string
+	Check func(ctx context.Context) error
+}{
+	{Name: "postgres", Check: checkPostgresHealth},
+	{Name: "elasticsearch", Check: checkElasticsearchHealth},
+	{Name: "kafka", Check: checkKafkaHealth},
+	{Name: "minio", Check: checkMinIOHealth},
+}
+
+// HealthCheck verifies the connectivity to Postgres, Elasticsearch, Kafka and MinIO.
+// The Elasticsearch index, Kafka topic and MinIO bucket must exist as well.
+// Use a context with a timeout so unreachable dependencies don't block the check.
+func HealthCheck(ctx context.Context) HealthReport {
+	healthReport := HealthReport{
+		Healthy: true,
+	}
+
+	for _, healthCheck := range healthChecks {
+		startTime := time.Now()
+
+		err := healthCheck.Check(ctx)
+
+		result := HealthCheckResult{
+			Name:     healthCheck.Name,
+			Healthy:  err == nil,
+			Duration: time.Since(startTime).Milliseconds(),
+		}
+
+		if err != nil {
+			result.Error = err.Error()
+			healthReport.Healthy = false
+		}
+
+		healthReport.Checks = append(healthReport.Checks, result)
+	}
+
+	return healthReport
+}
+
+// checkPostgresHealth connects to the database and pings it.
+func checkPostgresHealth(ctx context.Context) error {
+	connection, err := pgx.Connect(ctx, DatabaseURL)
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := connection.Close(context.Background()); err != nil {
+			Logger.Errorf("Failed to close database connection: %s", err)
+		}
+	}()
+
+	return connection.Ping(ctx)
+}
+
+// checkElasticsearchHealth pings the cluster and checks the index exists.
+func checkElasticsearchHealth(ctx context.Context) error {
+	pingResponse, err := Elasticsearch.Ping(Elasticsearch.Ping.WithContext(ctx))
+
+	if err != nil {
+		return err
+	}
+
+	if err := pingResponse.Body.Close(); err != nil {
+		Logger.Errorf("Failed to close response body: %s", err)
+	}
+
+	if pingResponse.IsError() {
+		return fmt.Errorf("ping failed: %s", pingResponse.Status())
+	}
+
+	existsResponse, err := Elasticsearch.Indices.Exists([]string{ElasticsearchIndex}, Elasticsearch.Indices.Exists.WithContext(ctx))
+
+	if err != nil {
+		return err
+	}
+
+	if err := existsResponse.Body.Close(); err != nil {
+		Logger.Errorf("Failed to close response body: %s", err)
+	}
+
+	if existsResponse.StatusCode != 200 {
+		return fmt.Errorf("index %s does not exist", ElasticsearchIndex)
+	}
+
+	return nil
+}
+
+// checkKafkaHealth connects to the broker and checks the topic exists.
+func checkKafkaHealth(ctx context.Context) error {
+	connection, err := kafka.DialContext(ctx, "tcp", KafkaWriter.Addr.String())
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := connection.Close(); err != nil {
+			Logger.Errorf("Failed to close Kafka connection: %s", err)
+		}
+	}()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := connection.SetDeadline(deadline); err != nil {
+			return err
+		}
+	}
+
+	partitions, err := connection.ReadPartitions(KafkaWriter.Topic)
+
+	if err != nil {
+		return err
+	}
+
+	if len(partitions) == 0 {
+		return fmt.Errorf("topic %s does not exist", KafkaWriter.Topic)
+	}
+
+	return nil
+}
+
+// checkMinIOHealth checks the bucket exists.
+func checkMinIOHealth(ctx context.Context) error {
+	bucketExists, err := MinIOClient.BucketExists(ctx, MinIOBucketName)
+
+	if err != nil {
+		return err
+	}
+
+	if !bucketExists {
+		return fmt.Errorf("bucket %s does not exist", MinIOBucketName)
+	}
+
+	return nil
+}
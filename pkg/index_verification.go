@@ -0,0 +1,139 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"io/ioutil"
+	"time"
+)
+
+// FolderIndexVerification represents the message counts of a folder with an indexing gap.
+type FolderIndexVerification struct {
+	FolderUUID string `json:"folder_uuid"`
+	Title      string `json:"title"`
+	Parsed     int    `json:"parsed"`  // The messages the parser sent to Kafka.
+	Indexed    int    `json:"indexed"` // The messages in Elasticsearch.
+}
+
+// IndexVerification represents the comparison of the parsed and indexed messages of an evidence.
+type IndexVerification struct {
+	EvidenceUUID string                    `json:"evidence_uuid"`
+	Parsed       int                       `json:"parsed"`
+	Indexed      int                       `json:"indexed"`
+	Folders      []FolderIndexVerification `json:"folders"` // Only the folders with a gap.
+	IsComplete   bool                      `json:"is_complete"`
+}
+
+// saveParsedMessageCount stores the amount of messages the parser sent to Kafka for the folder, see VerifyProjectIndex.
+func saveParsedMessageCount(folderUUID string, projectUUID string, evidenceUUID string, parsed int, database *pgx.Conn) error {
+	preparedStatement := `
+	INSERT INTO parsed_message_counts(folderUUID, projectUUID, evidenceUUID, parsed) VALUES ($1, $2, $3, $4)
+	ON CONFLICT (folderUUID) DO UPDATE SET parsed = EXCLUDED.parsed
+	`
+	_, err := database.Exec(context.Background(), preparedStatement, folderUUID, projectUUID, evidenceUUID, parsed)
+
+	return err
+}
+
+// VerifyProjectIndex compares the messages the parsers reported per folder with the messages in Elasticsearch.
+// Gaps are messages dropped between Kafka and Elasticsearch (or duplicated), so incomplete indexing is detected.
+// Messages are indexed asynchronously so run this once ingestion has settled, a recent gap may be ingestion lag.
+// Collected cloud mailboxes aren't verified, see GetCollectionReport.
+func VerifyProjectIndex(projectUUID string, userUUID string, database *pgx.Conn) ([]IndexVerification, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionManageEvidence, database); err != nil {
+		return nil, err
+	}
+
+	indexedCounts, err := getTreeNodeMessageCounts(projectUUID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	preparedStatement := `
+	SELECT c.folderUUID, c.evidenceUUID, c.parsed, COALESCE(t.title, '') FROM parsed_message_counts c
+	LEFT JOIN tree_nodes t ON t.folderUUID = c.folderUUID
+	WHERE c.projectUUID = $1 ORDER BY c.evidenceUUID
+	`
+	rows, err := database.Query(context.Background(), preparedStatement, projectUUID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var indexVerifications []IndexVerification
+
+	for rows.Next() {
+		var folder FolderIndexVerification
+		var evidenceUUID string
+
+		if err := rows.Scan(&folder.FolderUUID, &evidenceUUID, &folder.Parsed, &folder.Title); err != nil {
+			return nil, err
+		}
+
+		folder.Indexed = indexedCounts[folder.FolderUUID]
+
+		if len(indexVerifications) == 0 || indexVerifications[len(indexVerifications)-1].EvidenceUUID != evidenceUUID {
+			indexVerifications = append(indexVerifications, IndexVerification{
+				EvidenceUUID: evidenceUUID,
+				IsComplete:   true,
+			})
+		}
+
+		indexVerification := &indexVerifications[len(indexVerifications)-1]
+		indexVerification.Parsed += folder.Parsed
+		indexVerification.Indexed += folder.Indexed
+
+		if folder.Parsed != folder.Indexed {
+			indexVerification.Folders = append(indexVerification.Folders, folder)
+			indexVerification.IsComplete = false
+		}
+	}
+
+	rows.Close()
+
+	return indexVerifications, rows.Err()
+}
+
+// runVerifyIndexJob runs VerifyProjectIndex and returns the MinIO path of the JSON encoded verifications.
+func runVerifyIndexJob(ctx context.Context, job Job, reportProgress func(progress int), database *pgx.Conn) (string, error) {
+	logger := Logger.WithFields(LogFields{"project_uuid": job.ProjectUUID})
+
+	indexVerifications, err := VerifyProjectIndex(job.ProjectUUID, job.UserUUID, database)
+
+	if err != nil {
+		return "", err
+	}
+
+	for _, indexVerification := range indexVerifications {
+		if !indexVerification.IsComplete {
+			logger.Warnf("Evidence %s is incompletely indexed: %d parsed, %d indexed", indexVerification.EvidenceUUID, indexVerification.Parsed, indexVerification.Indexed)
+		}
+	}
+
+	encodedVerifications, err := json.Marshal(indexVerifications)
+
+	if err != nil {
+		return "", err
+	}
+
+	scratchSpace, err := getJobScratchSpace(job)
+
+	if err != nil {
+		return "", err
+	}
+
+	fileName := fmt.Sprintf("index-verification-%d.json", time.Now().Unix())
+	filePath := scratchSpace.FilePath(fileName)
+
+	if err := ioutil.WriteFile(filePath, encodedVerifications, 0644); err != nil {
+		return "", err
+	}
+
+	return UploadFile(fileName, filePath, job.ProjectUUID)
+}
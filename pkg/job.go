@@ -0,0 +1,683 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"sync"
+	"time"
+)
+
+// Job represents a long-running operation (parsing, exporting, reporting) processed by RunJobWorker.
+type Job struct {
+	UUID          string `json:"uuid"`
+	ProjectUUID   string `json:"project_uuid"`
+	UserUUID      string `json:"user_uuid"` // The user who submitted the job, the job runs with their permissions.
+	Type          string `json:"type"`
+	Status        string `json:"status"`
+	Priority      string `json:"priority"`       // See JobPriorityHigh, JobPriorityNormal and JobPriorityLow.
+	Parameters    string `json:"parameters"`     // JSON encoded parameters of the job type.
+	Progress      int    `json:"progress"`       // Percentage.
+	ProgressEvent string `json:"progress_event"` // JSON encoded last ProgressEvent, see NewJobProgressReporter.
+	Attempts      int    `json:"attempts"`
+	MaxAttempts   int    `json:"max_attempts"`
+	Error         string `json:"error"`
+	Result        string `json:"result"` // MinIO path of the result, if any.
+	CreationDate  int    `json:"creation_date"`
+	StartDate     int    `json:"start_date"`
+	EndDate       int    `json:"end_date"`
+}
+
+// Job statuses.
+const (
+	JobStatusQueued    = "queued"
+	JobStatusRunning   = "running"
+	JobStatusCompleted = "completed"
+	JobStatusFailed    = "failed"
+	JobStatusCancelled = "cancelled"
+)
+
+// Job types.
+const (
+	JobTypeParseEvidence             = "parse_evidence"
+	JobTypeExportAttachments         = "export_attachments"
+	JobTypeExportMessagesEML         = "export_messages_eml"
+	JobTypeExportMessagesSpreadsheet = "export_messages_spreadsheet"
+	JobTypeExportNetwork             = "export_network"
+	JobTypeForensicReport            = "forensic_report"
+	JobTypeReindexProject            = "reindex_project"
+	JobTypeVerifyIndex               = "verify_index"
+	JobTypeMigrateAttachments        = "migrate_attachments"
+	JobTypeKeywordReport             = "keyword_report"
+	JobTypeSearchMethodologyReport   = "search_methodology_report"
+	JobTypeAnalyzeSentiment          = "analyze_sentiment"
+	JobTypeClusterMessages           = "cluster_messages"
+	JobTypeEmbedMessages             = "embed_messages"
+	JobTypeTrainRelevance            = "train_relevance"
+	JobTypeFlagBulkMail              = "flag_bulk_mail"
+	JobTypeScorePhishing             = "score_phishing"
+	JobTypeAnalyzeDates              = "analyze_dates"
+	JobTypePrivilegeLog              = "privilege_log"
+	JobTypeBinderReport              = "binder_report"
+	JobTypePurgeProject              = "purge_project" // Queued by RunJobWorker for the projects whose retention period has expired.
+)
+
+// Constants defining the job processing.
+const (
+	jobMaximumAttempts = 3
+	jobPollInterval    = 5 * time.Second
+)
+
+// ErrJobCancelled is returned when the job was cancelled while running.
+var ErrJobCancelled = errors.New("job is cancelled")
+
+// JobHandler runs a job type.
+type JobHandler struct {
+	// Action is the permission required to submit and cancel the job.
+	Action string
+	// Run runs the job and returns the MinIO path of the result (empty if there is none).
+	// Long-running handlers should call reportProgress, which cancels the context when the job is cancelled.
+	Run func(ctx context.Context, job Job, reportProgress func(progress int), database *pgx.Conn) (string, error)
+}
+
+// jobHandlers defines the handlers of the job types.
+var jobHandlers = map[string]JobHandler{
+	JobTypeParseEvidence: {
+		Action: ActionManageEvidence,
+		Run:    runParseEvidenceJob,
+	},
+	JobTypeExportAttachments: {
+		Action: ActionExport,
+		Run:    runExportAttachmentsJob,
+	},
+	JobTypeExportMessagesEML: {
+		Action: ActionExport,
+		Run:    runExportMessagesEMLJob,
+	},
+	JobTypeExportMessagesSpreadsheet: {
+		Action: ActionExport,
+		Run:    runExportMessagesSpreadsheetJob,
+	},
+	JobTypeExportNetwork: {
+		Action: ActionExport,
+		Run:    runExportNetworkJob,
+	},
+	JobTypeForensicReport: {
+		Action: ActionExport,
+		Run:    runForensicReportJob,
+	},
+	JobTypeReindexProject: {
+		Action: ActionManageProject,
+		Run:    runReindexProjectJob,
+	},
+	JobTypeVerifyIndex: {
+		Action: ActionManageEvidence,
+		Run:    runVerifyIndexJob,
+	},
+	JobTypeMigrateAttachments: {
+		Action: ActionManageProject,
+		Run:    runMigrateAttachmentsJob,
+	},
+	JobTypeKeywordReport: {
+		Action: ActionExport,
+		Run:    runKeywordReportJob,
+	},
+	JobTypeSearchMethodologyReport: {
+		Action: ActionExport,
+		Run:    runSearchMethodologyReportJob,
+	},
+	JobTypeAnalyzeSentiment: {
+		Action: ActionManageProject,
+		Run:    runAnalyzeSentimentJob,
+	},
+	JobTypeClusterMessages: {
+		Action: ActionManageProject,
+		Run:    runClusterMessagesJob,
+	},
+	JobTypeEmbedMessages: {
+		Action: ActionManageProject,
+		Run:    runEmbedMessagesJob,
+	},
+	JobTypeTrainRelevance: {
+		Action: ActionManageProject,
+		Run:    runTrainRelevanceJob,
+	},
+	JobTypeFlagBulkMail: {
+		Action: ActionManageProject,
+		Run:    runFlagBulkMailJob,
+	},
+	JobTypeScorePhishing: {
+		Action: ActionManageProject,
+		Run:    runScorePhishingJob,
+	},
+	JobTypeAnalyzeDates: {
+		Action: ActionManageProject,
+		Run:    runAnalyzeDatesJob,
+	},
+	JobTypePrivilegeLog: {
+		Action: ActionExport,
+		Run:    runPrivilegeLogJob,
+	},
+	JobTypeBinderReport: {
+		Action: ActionExport,
+		Run:    runBinderReportJob,
+	},
+	JobTypePurgeProject: {
+		Action: ActionManageProject,
+		Run:    runPurgeProjectJob,
+	},
+}
+
+// RegisterJobHandler registers the handler of the job type, replacing any existing handler.
+// Must be called before RunJobWorker.
+func RegisterJobHandler(jobType string, handler JobHandler) {
+	jobHandlers[jobType] = handler
+}
+
+// runningJobs contains the cancel functions of the jobs running in this process.
+var runningJobs = struct {
+	sync.Mutex
+	cancelFunctions map[string]context.CancelFunc
+}{
+	cancelFunctions: map[string]context.CancelFunc{},
+}
+
+// jobColumns defines the columns selected by the job queries, see scanJob.
+const jobColumns = "uuid, projectUUID, userUUID, type, status, priority, parameters, progress, progressEvent, attempts, maxAttempts, error, result, creationDate, startDate, endDate"
+
+// scanJob scans the job columns.
+func scanJob(row pgx.Row) (Job, error) {
+	var job Job
+
+	err := row.Scan(&job.UUID, &job.ProjectUUID, &job.UserUUID, &job.Type, &job.Status, &job.Priority, &job.Parameters, &job.Progress, &job.ProgressEvent, &job.Attempts, &job.MaxAttempts, &job.Error, &job.Result, &job.CreationDate, &job.StartDate, &job.EndDate)
+
+	return job, err
+}
+
+// Save saves the job to the database.
+func (job *Job) Save(database *pgx.Conn) error {
+	preparedStatement := `
+	INSERT INTO jobs(uuid, projectUUID, userUUID, type, status, priority, parameters, progress, progressEvent, attempts, maxAttempts, error, result, creationDate, startDate, endDate) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
+	`
+	_, err := database.Exec(context.Background(), preparedStatement, job.UUID, job.ProjectUUID, job.UserUUID, job.Type, job.Status, job.Priority, job.Parameters, job.Progress, job.ProgressEvent, job.Attempts, job.MaxAttempts, job.Error, job.Result, job.CreationDate, job.StartDate, job.EndDate)
+
+	return err
+}
+
+// SubmitJob queues the job with the normal priority which is processed by RunJobWorker, see SubmitJobWithPriority.
+// The parameters are encoded as JSON, see the parameter types of the job types (e.g. ParseEvidenceJobParameters).
+func SubmitJob(jobType string, parameters interface{}, projectUUID string, userUUID string, database *pgx.Conn) (Job, error) {
+	return submitJob(jobType, parameters, JobPriorityNormal, projectUUID, userUUID, database)
+}
+
+// submitJob queues the job with the priority.
+func submitJob(jobType string, parameters interface{}, priority string, projectUUID string, userUUID string, database *pgx.Conn) (Job, error) {
+	handler, ok := jobHandlers[jobType]
+
+	if !ok {
+		return Job{}, fmt.Errorf("unsupported job type: %s", jobType)
+	}
+
+	if err := CheckPermission(userUUID, projectUUID, handler.Action, database); err != nil {
+		return Job{}, err
+	}
+
+	encodedParameters, err := json.Marshal(parameters)
+
+	if err != nil {
+		return Job{}, err
+	}
+
+	job := Job{
+		UUID:         NewUUID(),
+		ProjectUUID:  projectUUID,
+		UserUUID:     userUUID,
+		Type:         jobType,
+		Status:       JobStatusQueued,
+		Priority:     priority,
+		Parameters:   string(encodedParameters),
+		MaxAttempts:  jobMaximumAttempts,
+		CreationDate: int(time.Now().Unix()),
+	}
+
+	if err := job.Save(database); err != nil {
+		return Job{}, err
+	}
+
+	return job, nil
+}
+
+// GetJob returns the job.
+func GetJob(jobUUID string, projectUUID string, userUUID string, database *pgx.Conn) (Job, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return Job{}, err
+	}
+
+	return getJob(jobUUID, projectUUID, database)
+}
+
+// getJob returns the job without checking permissions.
+func getJob(jobUUID string, projectUUID string, database *pgx.Conn) (Job, error) {
+	preparedStatement := fmt.Sprintf(`
+	SELECT %s FROM jobs WHERE uuid = $1 AND projectUUID = $2
+	`, jobColumns)
+
+	return scanJob(database.QueryRow(context.Background(), preparedStatement, jobUUID, projectUUID))
+}
+
+// GetJobsByProject returns the jobs of the project, newest first.
+func GetJobsByProject(projectUUID string, userUUID string, database *pgx.Conn) ([]Job, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return nil, err
+	}
+
+	preparedStatement := fmt.Sprintf(`
+	SELECT %s FROM jobs WHERE projectUUID = $1 ORDER BY creationDate DESC
+	`, jobColumns)
+	rows, err := database.Query(context.Background(), preparedStatement, projectUUID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []Job
+
+	for rows.Next() {
+		job, err := scanJob(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		jobs = append(jobs, job)
+	}
+
+	rows.Close()
+
+	return jobs, rows.Err()
+}
+
+// CancelJob cancels the queued or running job.
+// Running jobs are interrupted when their handler reports progress, the result of a cancelled job is discarded.
+func CancelJob(jobUUID string, projectUUID string, userUUID string, database *pgx.Conn) error {
+	job, err := getJob(jobUUID, projectUUID, database)
+
+	if err != nil {
+		return err
+	}
+
+	handler, ok := jobHandlers[job.Type]
+
+	if !ok {
+		return fmt.Errorf("unsupported job type: %s", job.Type)
+	}
+
+	if err := CheckPermission(userUUID, projectUUID, handler.Action, database); err != nil {
+		return err
+	}
+
+	preparedStatement := `
+	UPDATE jobs SET status = $3, endDate = $4 WHERE uuid = $1 AND projectUUID = $2 AND status IN ($5, $6)
+	`
+	commandTag, err := database.Exec(context.Background(), preparedStatement, jobUUID, projectUUID, JobStatusCancelled, time.Now().Unix(), JobStatusQueued, JobStatusRunning)
+
+	if err != nil {
+		return err
+	}
+
+	if commandTag.RowsAffected() == 0 {
+		return fmt.Errorf("job is already %s", job.Status)
+	}
+
+	runningJobs.Lock()
+
+	if cancel, ok := runningJobs.cancelFunctions[jobUUID]; ok {
+		cancel()
+	}
+
+	runningJobs.Unlock()
+
+	return nil
+}
+
+// RunJobWorker processes the queued jobs until the context is done, throttling low priority jobs
+// (see LowPriorityJobLimit and LowPriorityIngestLimiter).
+// Multiple workers (in multiple processes) may run concurrently, each worker needs its own database connection.
+// Temporary files left behind by previous workers are removed first, see SweepTempDirectories.
+// Every hour a JobTypePurgeProject job is queued for each project whose retention period has expired, see SetProjectRetention.
+func RunJobWorker(ctx context.Context, database *pgx.Conn) {
+	if err := SweepTempDirectories(database); err != nil {
+		Logger.Errorf("Failed to sweep temp directories: %s", err)
+	}
+
+	var nextPurgeDate time.Time
+
+	for {
+		if time.Now().After(nextPurgeDate) {
+			if err := queueExpiredProjectPurges(database); err != nil {
+				Logger.Errorf("Failed to queue expired project purges: %s", err)
+			}
+
+			nextPurgeDate = time.Now().Add(retentionPurgeInterval)
+		}
+
+		job, err := claimNextJob(database)
+
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			Logger.Errorf("Failed to claim job: %s", err)
+		}
+
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(jobPollInterval):
+				continue
+			}
+		}
+
+		runJob(ctx, job, database)
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// claimNextJob marks the oldest queued job with the highest priority as running and returns it.
+// Low priority jobs are skipped while LowPriorityJobLimit low priority jobs are running,
+// the limit isn't exact since concurrent workers may claim a low priority job at the same time.
+// Returns pgx.ErrNoRows if there are no queued jobs.
+func claimNextJob(database *pgx.Conn) (Job, error) {
+	preparedStatement := fmt.Sprintf(`
+	UPDATE jobs SET status = $1, attempts = attempts + 1, progress = 0, startDate = $2
+	WHERE uuid = (
+		SELECT uuid FROM jobs WHERE status = $3
+		AND (priority != $4 OR $5 <= 0 OR (SELECT COUNT(*) FROM jobs WHERE status = $1 AND priority = $4) < $5)
+		ORDER BY %s, creationDate ASC LIMIT 1 FOR UPDATE SKIP LOCKED
+	)
+	RETURNING %s
+	`, jobPriorityOrder, jobColumns)
+
+	return scanJob(database.QueryRow(context.Background(), preparedStatement, JobStatusRunning, time.Now().Unix(), JobStatusQueued, JobPriorityLow, LowPriorityJobLimit))
+}
+
+// runJob runs the claimed job and stores the result.
+// Failed jobs are queued again until the maximum attempts are reached.
+func runJob(ctx context.Context, job Job, database *pgx.Conn) {
+	logger := Logger.WithFields(LogFields{"project_uuid": job.ProjectUUID, "job_uuid": job.UUID})
+
+	jobContext, cancel := context.WithCancel(ctx)
+
+	defer cancel()
+
+	runningJobs.Lock()
+	runningJobs.cancelFunctions[job.UUID] = cancel
+	runningJobs.Unlock()
+
+	defer func() {
+		runningJobs.Lock()
+		delete(runningJobs.cancelFunctions, job.UUID)
+		runningJobs.Unlock()
+	}()
+
+	reportProgress := func(progress int) {
+		isRunning, err := updateJobProgress(job.UUID, progress, database)
+
+		if err != nil {
+			logger.Errorf("Failed to update job progress: %s", err)
+		} else if !isRunning {
+			cancel()
+		}
+	}
+
+	result, err := runJobHandler(jobContext, job, reportProgress, database)
+
+	if removeErr := removeJobScratchSpace(job); removeErr != nil {
+		logger.Errorf("Failed to remove job scratch space: %s", removeErr)
+	}
+
+	if err == nil && jobContext.Err() != nil {
+		err = ErrJobCancelled
+	}
+
+	if err != nil {
+		logger.Errorf("Failed to run job %s (attempt %d): %s", job.UUID, job.Attempts, err)
+
+		status := JobStatusFailed
+
+		if job.Attempts < job.MaxAttempts && !errors.Is(err, ErrJobCancelled) && !errors.Is(err, ErrPermissionDenied) {
+			status = JobStatusQueued
+		}
+
+		if err := finishJob(job.UUID, status, "", err.Error(), database); err != nil {
+			logger.Errorf("Failed to update job: %s", err)
+		}
+	} else if err := finishJob(job.UUID, JobStatusCompleted, result, "", database); err != nil {
+		logger.Errorf("Failed to update job: %s", err)
+	}
+
+	// The job is reloaded since cancelled jobs aren't updated by finishJob.
+	finishedJob, err := getJob(job.UUID, job.ProjectUUID, database)
+
+	if errors.Is(err, pgx.ErrNoRows) && job.Type == JobTypePurgeProject {
+		// The job is removed with the purged project.
+		return
+	} else if err != nil {
+		logger.Errorf("Failed to get job: %s", err)
+		return
+	}
+
+	if event := getJobWebhookEvent(finishedJob); event != "" {
+		notifyWebhooks(event, finishedJob, database)
+		notifyUser(event, finishedJob, database)
+	}
+}
+
+// runJobHandler runs the handler of the job type, panics are returned as errors so they don't stop the worker.
+func runJobHandler(ctx context.Context, job Job, reportProgress func(progress int), database *pgx.Conn) (result string, err error) {
+	handler, ok := jobHandlers[job.Type]
+
+	if !ok {
+		return "", fmt.Errorf("unsupported job type: %s", job.Type)
+	}
+
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("job panicked: %v", recovered)
+		}
+	}()
+
+	return handler.Run(ctx, job, reportProgress, database)
+}
+
+// updateJobProgress updates the progress of the running job.
+// Returns false if the job is no longer running (cancelled).
+func updateJobProgress(jobUUID string, progress int, database *pgx.Conn) (bool, error) {
+	preparedStatement := `
+	UPDATE jobs SET progress = $2 WHERE uuid = $1 AND status = $3
+	`
+	commandTag, err := database.Exec(context.Background(), preparedStatement, jobUUID, progress, JobStatusRunning)
+
+	if err != nil {
+		return false, err
+	}
+
+	return commandTag.RowsAffected() > 0, nil
+}
+
+// finishJob stores the status, result and error of the running job.
+// Cancelled jobs are left untouched.
+func finishJob(jobUUID string, status string, result string, errorMessage string, database *pgx.Conn) error {
+	progress := 0
+	endDate := 0
+
+	if status == JobStatusCompleted {
+		progress = 100
+	}
+
+	if status != JobStatusQueued {
+		endDate = int(time.Now().Unix())
+	}
+
+	preparedStatement := `
+	UPDATE jobs SET status = $2, result = $3, error = $4, progress = $5, endDate = $6 WHERE uuid = $1 AND status = $7
+	`
+	_, err := database.Exec(context.Background(), preparedStatement, jobUUID, status, result, errorMessage, progress, endDate, JobStatusRunning)
+
+	return err
+}
+
+// decodeJobParameters decodes the JSON parameters of the job.
+func decodeJobParameters(job Job, parameters interface{}) error {
+	if err := json.Unmarshal([]byte(job.Parameters), parameters); err != nil {
+		return fmt.Errorf("invalid %s job parameters: %w", job.Type, err)
+	}
+
+	return nil
+}
+
+// ParseEvidenceJobParameters represents the parameters of the JobTypeParseEvidence job.
+type ParseEvidenceJobParameters struct {
+	EvidenceUUID string       `json:"evidence_uuid"`
+	Options      ParseOptions `json:"options"`
+}
+
+// runParseEvidenceJob parses the evidence of the project.
+func runParseEvidenceJob(ctx context.Context, job Job, reportProgress func(progress int), database *pgx.Conn) (string, error) {
+	var parameters ParseEvidenceJobParameters
+
+	if err := decodeJobParameters(job, &parameters); err != nil {
+		return "", err
+	}
+
+	if err := CheckPermission(job.UserUUID, job.ProjectUUID, ActionManageEvidence, database); err != nil {
+		return "", err
+	}
+
+	project, err := GetProjectByUUID(job.ProjectUUID, database)
+
+	if err != nil {
+		return "", err
+	}
+
+	evidence, err := getEvidenceByUUID(parameters.EvidenceUUID, job.ProjectUUID, database)
+
+	if err != nil {
+		return "", err
+	}
+
+	progressReporter := &jobProgressReporter{
+		jobUUID:        job.UUID,
+		reportProgress: reportProgress,
+		database:       database,
+	}
+
+	parameters.Options.Priority = job.Priority
+
+	return "", evidence.Parse(project, parameters.Options, progressReporter, database)
+}
+
+// runExportAttachmentsJob runs ExportAttachments, the parameters are AttachmentExportFilters.
+func runExportAttachmentsJob(ctx context.Context, job Job, reportProgress func(progress int), database *pgx.Conn) (string, error) {
+	var filters AttachmentExportFilters
+
+	if err := decodeJobParameters(job, &filters); err != nil {
+		return "", err
+	}
+
+	return exportAttachments(job.ProjectUUID, filters, reportProgress, job.UserUUID, database)
+}
+
+// ExportMessagesEMLJobParameters represents the parameters of the JobTypeExportMessagesEML job.
+type ExportMessagesEMLJobParameters struct {
+	MessageUUIDs []string       `json:"message_uuids"`
+	Query        string         `json:"query"`
+	Archive      ArchiveOptions `json:"archive"`
+}
+
+// runExportMessagesEMLJob runs ExportMessagesAsEML.
+func runExportMessagesEMLJob(ctx context.Context, job Job, reportProgress func(progress int), database *pgx.Conn) (string, error) {
+	var parameters ExportMessagesEMLJobParameters
+
+	if err := decodeJobParameters(job, &parameters); err != nil {
+		return "", err
+	}
+
+	return exportMessagesAsEML(job.ProjectUUID, parameters.MessageUUIDs, parameters.Query, parameters.Archive, reportProgress, job.UserUUID, database)
+}
+
+// ExportMessagesSpreadsheetJobParameters represents the parameters of the JobTypeExportMessagesSpreadsheet job.
+type ExportMessagesSpreadsheetJobParameters struct {
+	Query   string        `json:"query"`
+	Filters SearchFilters `json:"filters"`
+	Fields  []string      `json:"fields"`
+	Format  string        `json:"format"`
+}
+
+// runExportMessagesSpreadsheetJob runs ExportMessagesToCSV.
+func runExportMessagesSpreadsheetJob(ctx context.Context, job Job, reportProgress func(progress int), database *pgx.Conn) (string, error) {
+	var parameters ExportMessagesSpreadsheetJobParameters
+
+	if err := decodeJobParameters(job, &parameters); err != nil {
+		return "", err
+	}
+
+	return ExportMessagesToCSV(job.ProjectUUID, parameters.Query, parameters.Filters, parameters.Fields, parameters.Format, job.UserUUID, database)
+}
+
+// ExportNetworkJobParameters represents the parameters of the JobTypeExportNetwork job.
+type ExportNetworkJobParameters struct {
+	Format  string         `json:"format"`
+	Options NetworkOptions `json:"options"`
+}
+
+// runExportNetworkJob runs ExportNetwork.
+func runExportNetworkJob(ctx context.Context, job Job, reportProgress func(progress int), database *pgx.Conn) (string, error) {
+	var parameters ExportNetworkJobParameters
+
+	if err := decodeJobParameters(job, &parameters); err != nil {
+		return "", err
+	}
+
+	return ExportNetwork(job.ProjectUUID, parameters.Format, parameters.Options, job.UserUUID, database)
+}
+
+// ForensicReportJobParameters represents the parameters of the JobTypeForensicReport job.
+type ForensicReportJobParameters struct {
+	Options      ReportOptions `json:"options"`
+	Pseudonymize bool          `json:"pseudonymize"`
+}
+
+// runForensicReportJob runs CreateForensicReport.
+func runForensicReportJob(ctx context.Context, job Job, reportProgress func(progress int), database *pgx.Conn) (string, error) {
+	var parameters ForensicReportJobParameters
+
+	if err := decodeJobParameters(job, &parameters); err != nil {
+		return "", err
+	}
+
+	if parameters.Pseudonymize {
+		pseudonymizer, err := NewPseudonymizer(job.ProjectUUID, database)
+
+		if err != nil {
+			return "", err
+		}
+
+		parameters.Options.Pseudonymizer = pseudonymizer
+	}
+
+	parameters.Options.Progress = reportProgress
+
+	return CreateForensicReport(job.ProjectUUID, parameters.Options, job.UserUUID, database)
+}
+
+// runReindexProjectJob runs ReindexProject, which migrates the messages of all projects to a new index. The job has no parameters.
+func runReindexProjectJob(ctx context.Context, job Job, reportProgress func(progress int), database *pgx.Conn) (string, error) {
+	return "", ReindexProject(job.ProjectUUID, job.UserUUID, database)
+}
@@ -0,0 +1,150 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"time"
+)
+
+// Job priorities, queued jobs are claimed by priority and then by creation date.
+// Low priority jobs are throttled so a large batch import doesn't starve an urgent case:
+// at most LowPriorityJobLimit low priority jobs run at the same time, and low priority parsing is rate limited
+// by the LowPriorityIngestLimiter while higher priority parse jobs are queued or running, see RunJobWorker.
+const (
+	JobPriorityHigh   = "high"
+	JobPriorityNormal = "normal"
+	JobPriorityLow    = "low"
+)
+
+// jobPriorityOrder defines the SQL expression ordering the queued jobs by priority, see claimNextJob.
+const jobPriorityOrder = "CASE priority WHEN 'high' THEN 0 WHEN 'low' THEN 2 ELSE 1 END"
+
+// IsValidJobPriority returns true if the priority is one of the job priorities.
+func IsValidJobPriority(priority string) bool {
+	return priority == JobPriorityHigh || priority == JobPriorityNormal || priority == JobPriorityLow
+}
+
+// DefaultLowPriorityIngestRateOptions defines the rate of low priority parsing used if the low_priority_ingest_rate configuration variable is unset.
+// The requests are messages written to Kafka.
+var DefaultLowPriorityIngestRateOptions = RateLimitOptions{
+	RequestsPerSecond: 500,
+	Burst:             100,
+}
+
+// LowPriorityIngestLimiter limits the messages of low priority parse jobs while higher priority parse jobs are active.
+// Shared by the low priority jobs of the process so concurrent imports don't multiply the rate.
+//
+// Deprecated: use Core.LowPriorityIngestLimiter.
+var LowPriorityIngestLimiter = NewRateLimiter(DefaultLowPriorityIngestRateOptions)
+
+// LowPriorityJobLimit defines the maximum amount of running low priority jobs of all workers, zero for no limit.
+//
+// Deprecated: use Core.Config.LowPriorityJobLimit.
+var LowPriorityJobLimit int
+
+// ingestThrottleInterval defines how often the ingest throttle checks for higher priority parse jobs.
+const ingestThrottleInterval = 10 * time.Second
+
+// SubmitJobWithPriority queues the job like SubmitJob with the specified priority.
+func SubmitJobWithPriority(jobType string, parameters interface{}, priority string, projectUUID string, userUUID string, database *pgx.Conn) (Job, error) {
+	if !IsValidJobPriority(priority) {
+		return Job{}, fmt.Errorf("invalid job priority: %s", priority)
+	}
+
+	return submitJob(jobType, parameters, priority, projectUUID, userUUID, database)
+}
+
+// SetJobPriority changes the priority of the queued job.
+// Running jobs keep their priority, cancel and submit the job again instead.
+func SetJobPriority(jobUUID string, priority string, projectUUID string, userUUID string, database *pgx.Conn) error {
+	if !IsValidJobPriority(priority) {
+		return fmt.Errorf("invalid job priority: %s", priority)
+	}
+
+	job, err := getJob(jobUUID, projectUUID, database)
+
+	if err != nil {
+		return err
+	}
+
+	handler, ok := jobHandlers[job.Type]
+
+	if !ok {
+		return fmt.Errorf("unsupported job type: %s", job.Type)
+	}
+
+	if err := CheckPermission(userUUID, projectUUID, handler.Action, database); err != nil {
+		return err
+	}
+
+	preparedStatement := `
+	UPDATE jobs SET priority = $3 WHERE uuid = $1 AND projectUUID = $2 AND status = $4
+	`
+	commandTag, err := database.Exec(context.Background(), preparedStatement, jobUUID, projectUUID, priority, JobStatusQueued)
+
+	if err != nil {
+		return err
+	}
+
+	if commandTag.RowsAffected() == 0 {
+		return fmt.Errorf("job is already %s", job.Status)
+	}
+
+	return nil
+}
+
+// hasPriorityParseJobs returns true if parse jobs with a normal or high priority are queued or running.
+func hasPriorityParseJobs(database *pgx.Conn) (bool, error) {
+	preparedStatement := `
+	SELECT EXISTS(SELECT 1 FROM jobs WHERE type = $1 AND priority != $2 AND status IN ($3, $4))
+	`
+	var hasJobs bool
+
+	if err := database.QueryRow(context.Background(), preparedStatement, JobTypeParseEvidence, JobPriorityLow, JobStatusQueued, JobStatusRunning).Scan(&hasJobs); err != nil {
+		return false, err
+	}
+
+	return hasJobs, nil
+}
+
+// ingestThrottle rate limits the messages of a low priority parse job while higher priority parse jobs are active, see MessageBatcher.
+type ingestThrottle struct {
+	limiter     *RateLimiter // Shared by the low priority jobs of the process.
+	database    *pgx.Conn
+	isContended bool      // True if higher priority parse jobs were active at the last check.
+	checkedAt   time.Time // The last check, see ingestThrottleInterval.
+}
+
+// newIngestThrottle creates the ingest throttle of a low priority parse job using the limiter.
+func newIngestThrottle(limiter *RateLimiter, database *pgx.Conn) *ingestThrottle {
+	return &ingestThrottle{
+		limiter:  limiter,
+		database: database,
+	}
+}
+
+// Wait blocks until the next message may be written.
+// If checking for higher priority parse jobs fails the previous result is used so parsing continues.
+func (throttle *ingestThrottle) Wait() error {
+	if time.Since(throttle.checkedAt) >= ingestThrottleInterval {
+		isContended, err := hasPriorityParseJobs(throttle.database)
+
+		if err != nil {
+			Logger.Errorf("Failed to check for higher priority parse jobs: %s", err)
+		} else {
+			throttle.isContended = isContended
+		}
+
+		throttle.checkedAt = time.Now()
+	}
+
+	if !throttle.isContended {
+		return nil
+	}
+
+	return throttle.limiter.Wait(context.Background())
+}
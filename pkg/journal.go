@@ -0,0 +1,269 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"strings"
+	"time"
+)
+
+// JournalEntry represents a contemporaneous case note of an examiner in the journal of a project.
+// The body is Markdown, the entry may link the messages and evidence it is about.
+type JournalEntry struct {
+	UUID          string   `json:"uuid"`
+	ProjectUUID   string   `json:"project_uuid"`
+	AuthorUUID    string   `json:"author_uuid"`
+	Body          string   `json:"body"`
+	MessageUUIDs  []string `json:"message_uuids"`
+	EvidenceUUIDs []string `json:"evidence_uuids"`
+	CreationDate  int      `json:"creation_date"`
+	// ModificationDate is set if the entry was edited after it was written, the creation date is kept.
+	ModificationDate int `json:"modification_date,omitempty"`
+}
+
+// Save saves the journal entry to the database.
+func (entry *JournalEntry) Save(database *pgx.Conn) error {
+	encodedMessageUUIDs, err := json.Marshal(entry.MessageUUIDs)
+
+	if err != nil {
+		return err
+	}
+
+	encodedEvidenceUUIDs, err := json.Marshal(entry.EvidenceUUIDs)
+
+	if err != nil {
+		return err
+	}
+
+	preparedStatement := `
+	INSERT INTO journal_entries(uuid, projectUUID, authorUUID, body, messageUUIDs, evidenceUUIDs, creationDate, modificationDate) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	ON CONFLICT(uuid) DO UPDATE SET body = $4, messageUUIDs = $5, evidenceUUIDs = $6, modificationDate = $8
+	`
+	_, err = database.Exec(context.Background(), preparedStatement, entry.UUID, entry.ProjectUUID, entry.AuthorUUID, entry.Body, string(encodedMessageUUIDs), string(encodedEvidenceUUIDs), entry.CreationDate, entry.ModificationDate)
+
+	return err
+}
+
+// AddJournalEntry adds an entry by the user to the journal of the project.
+// The message and evidence UUIDs are optional, they must belong to the project.
+func AddJournalEntry(body string, messageUUIDs []string, evidenceUUIDs []string, projectUUID string, userUUID string, database *pgx.Conn) (JournalEntry, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionReview, database); err != nil {
+		return JournalEntry{}, err
+	}
+
+	if strings.TrimSpace(body) == "" {
+		return JournalEntry{}, errors.New("journal entry body is empty")
+	}
+
+	if err := checkJournalLinks(messageUUIDs, evidenceUUIDs, projectUUID, database); err != nil {
+		return JournalEntry{}, err
+	}
+
+	entry := JournalEntry{
+		UUID:          NewUUID(),
+		ProjectUUID:   projectUUID,
+		AuthorUUID:    userUUID,
+		Body:          body,
+		MessageUUIDs:  messageUUIDs,
+		EvidenceUUIDs: evidenceUUIDs,
+		CreationDate:  int(time.Now().Unix()),
+	}
+
+	if err := entry.Save(database); err != nil {
+		return JournalEntry{}, err
+	}
+
+	return entry, nil
+}
+
+// UpdateJournalEntry updates the body and links of the journal entry, only the author can edit an entry.
+// The creation date is kept and the modification date is set so edits remain visible.
+func UpdateJournalEntry(entryUUID string, body string, messageUUIDs []string, evidenceUUIDs []string, projectUUID string, userUUID string, database *pgx.Conn) (JournalEntry, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionReview, database); err != nil {
+		return JournalEntry{}, err
+	}
+
+	entry, err := GetJournalEntryByUUID(entryUUID, projectUUID, database)
+
+	if err != nil {
+		return JournalEntry{}, err
+	}
+
+	if entry.AuthorUUID != userUUID {
+		return JournalEntry{}, errors.New("only the author can edit a journal entry")
+	}
+
+	if strings.TrimSpace(body) == "" {
+		return JournalEntry{}, errors.New("journal entry body is empty")
+	}
+
+	if err := checkJournalLinks(messageUUIDs, evidenceUUIDs, projectUUID, database); err != nil {
+		return JournalEntry{}, err
+	}
+
+	entry.Body = body
+	entry.MessageUUIDs = messageUUIDs
+	entry.EvidenceUUIDs = evidenceUUIDs
+	entry.ModificationDate = int(time.Now().Unix())
+
+	if err := entry.Save(database); err != nil {
+		return JournalEntry{}, err
+	}
+
+	return entry, nil
+}
+
+// checkJournalLinks returns an error if a linked message or evidence doesn't belong to the project.
+func checkJournalLinks(messageUUIDs []string, evidenceUUIDs []string, projectUUID string, database *pgx.Conn) error {
+	for _, evidenceUUID := range evidenceUUIDs {
+		if _, err := getEvidenceByUUID(evidenceUUID, projectUUID, database); err != nil {
+			return fmt.Errorf("unknown evidence %s: %w", evidenceUUID, err)
+		}
+	}
+
+	if len(messageUUIDs) == 0 {
+		return nil
+	}
+
+	uniqueMessageUUIDs := map[string]bool{}
+
+	for _, messageUUID := range messageUUIDs {
+		uniqueMessageUUIDs[messageUUID] = true
+	}
+
+	messageCount, err := countMessages(newMessageUUIDsQuery(messageUUIDs, projectUUID))
+
+	if err != nil {
+		return err
+	}
+
+	if messageCount != len(uniqueMessageUUIDs) {
+		return errors.New("journal entry links unknown messages")
+	}
+
+	return nil
+}
+
+// GetJournalEntryByUUID returns the journal entry with the specified UUID.
+func GetJournalEntryByUUID(entryUUID string, projectUUID string, database *pgx.Conn) (JournalEntry, error) {
+	preparedStatement := `
+	SELECT uuid, projectUUID, authorUUID, body, messageUUIDs, evidenceUUIDs, creationDate, modificationDate FROM journal_entries WHERE uuid = $1 AND projectUUID = $2
+	`
+	row := database.QueryRow(context.Background(), preparedStatement, entryUUID, projectUUID)
+
+	return scanJournalEntry(row)
+}
+
+// GetJournal returns the journal entries of the project, oldest first.
+func GetJournal(projectUUID string, userUUID string, database *pgx.Conn) ([]JournalEntry, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return nil, err
+	}
+
+	return getJournal(projectUUID, database)
+}
+
+// getJournal returns the journal entries of the project, oldest first.
+func getJournal(projectUUID string, database *pgx.Conn) ([]JournalEntry, error) {
+	preparedStatement := `
+	SELECT uuid, projectUUID, authorUUID, body, messageUUIDs, evidenceUUIDs, creationDate, modificationDate FROM journal_entries WHERE projectUUID = $1 ORDER BY creationDate ASC
+	`
+
+	return queryJournalEntries(preparedStatement, database, projectUUID)
+}
+
+// GetMessageJournalEntries returns the journal entries linking the message, oldest first.
+func GetMessageJournalEntries(messageUUID string, projectUUID string, userUUID string, database *pgx.Conn) ([]JournalEntry, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return nil, err
+	}
+
+	preparedStatement := `
+	SELECT uuid, projectUUID, authorUUID, body, messageUUIDs, evidenceUUIDs, creationDate, modificationDate FROM journal_entries WHERE projectUUID = $1 AND messageUUIDs::jsonb ? $2 ORDER BY creationDate ASC
+	`
+
+	return queryJournalEntries(preparedStatement, database, projectUUID, messageUUID)
+}
+
+// queryJournalEntries returns the journal entries from the query.
+func queryJournalEntries(preparedStatement string, database *pgx.Conn, arguments ...interface{}) ([]JournalEntry, error) {
+	rows, err := database.Query(context.Background(), preparedStatement, arguments...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []JournalEntry
+
+	for rows.Next() {
+		entry, err := scanJournalEntry(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	rows.Close()
+
+	return entries, rows.Err()
+}
+
+// scanJournalEntry scans the journal entry row.
+func scanJournalEntry(row pgx.Row) (JournalEntry, error) {
+	var entry JournalEntry
+	var encodedMessageUUIDs string
+	var encodedEvidenceUUIDs string
+
+	if err := row.Scan(&entry.UUID, &entry.ProjectUUID, &entry.AuthorUUID, &entry.Body, &encodedMessageUUIDs, &encodedEvidenceUUIDs, &entry.CreationDate, &entry.ModificationDate); err != nil {
+		return JournalEntry{}, err
+	}
+
+	if err := json.Unmarshal([]byte(encodedMessageUUIDs), &entry.MessageUUIDs); err != nil {
+		return JournalEntry{}, err
+	}
+
+	if err := json.Unmarshal([]byte(encodedEvidenceUUIDs), &entry.EvidenceUUIDs); err != nil {
+		return JournalEntry{}, err
+	}
+
+	return entry, nil
+}
+
+// DeleteJournalEntry removes the journal entry.
+// Only the author or a user who can manage the project is allowed to delete an entry.
+func DeleteJournalEntry(entryUUID string, projectUUID string, userUUID string, database *pgx.Conn) error {
+	if err := CheckPermission(userUUID, projectUUID, ActionReview, database); err != nil {
+		return err
+	}
+
+	if err := checkProjectNotOnHold(projectUUID, userUUID, AuditActionDeleteJournalEntry, database); err != nil {
+		return err
+	}
+
+	entry, err := GetJournalEntryByUUID(entryUUID, projectUUID, database)
+
+	if err != nil {
+		return err
+	}
+
+	if entry.AuthorUUID != userUUID {
+		if err := CheckPermission(userUUID, projectUUID, ActionManageProject, database); err != nil {
+			return err
+		}
+	}
+
+	preparedStatement := `
+	DELETE FROM journal_entries WHERE uuid = $1 AND projectUUID = $2
+	`
+	_, err = database.Exec(context.Background(), preparedStatement, entryUUID, projectUUID)
+
+	return err
+}
@@ -4,31 +4,168 @@
 package core
 
 import (
+	"context"
+	"fmt"
 	"github.com/segmentio/kafka-go"
-	"github.com/spf13/viper"
+	"time"
 )
 
 // KafkaWriter defines our Kafka writer.
+//
+// Deprecated: use Core.KafkaWriter.
 var KafkaWriter *kafka.Writer
 
-// init initialize our Kafka writer.
-func init() {
-	if !viper.IsSet("kafka_address") {
-		Logger.Fatal("unset kafka_address configuration variable")
-	}
-	if !viper.IsSet("kafka_topic") {
-		Logger.Fatal("unset kafka_topic configuration variable")
-	}
+// KafkaBatchOptions represents the batching of messages written to Kafka.
+type KafkaBatchOptions struct {
+	// Size is the amount of messages per batch, also used by the parsers, see MessageBatcher.
+	Size int `mapstructure:"size"`
+	// Bytes is the maximum size of a batch in bytes.
+	Bytes int64 `mapstructure:"bytes"`
+	// Timeout is how long an incomplete batch lingers before it is sent.
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+// DefaultKafkaBatchOptions defines the batching used if the kafka_batch configuration variable is unset.
+var DefaultKafkaBatchOptions = KafkaBatchOptions{
+	Size:    100,
+	Bytes:   1048576,
+	Timeout: time.Second,
+}
+
+// KafkaBatchSize defines the amount of messages the parsers write to Kafka at once.
+//
+// Deprecated: use Core.Config.KafkaBatch.
+var KafkaBatchSize = DefaultKafkaBatchOptions.Size
+
+// kafkaCompressions defines the supported values of the kafka_compression configuration variable.
+var kafkaCompressions = map[string]kafka.Compression{
+	"gzip":   kafka.Gzip,
+	"snappy": kafka.Snappy,
+	"lz4":    kafka.Lz4,
+	"zstd":   kafka.Zstd,
+}
+
+// newKafkaWriter creates our Kafka writer.
+func newKafkaWriter(config Config) (*kafka.Writer, error) {
+	batchOptions := getKafkaBatchOptions(config)
 
-	KafkaWriter = &kafka.Writer{
-		Addr:     kafka.TCP(viper.GetString("kafka_address")),
-		Topic:    viper.GetString("kafka_topic"),
-		Balancer: &kafka.LeastBytes{},
-		Async:    true,
+	writer := &kafka.Writer{
+		Addr:         kafka.TCP(config.KafkaAddress),
+		Topic:        config.KafkaTopic,
+		Balancer:     &kafka.LeastBytes{},
+		BatchSize:    batchOptions.Size,
+		BatchBytes:   batchOptions.Bytes,
+		BatchTimeout: batchOptions.Timeout,
+		Async:        true,
 		Completion: func(messages []kafka.Message, err error) {
 			if err != nil {
 				Logger.Errorf("Failed to deliver Kafka message: %s", err)
 			}
 		},
 	}
-}
\ No newline at end of file
+
+	if config.KafkaCompression != "" && config.KafkaCompression != "none" {
+		compression, ok := kafkaCompressions[config.KafkaCompression]
+
+		if !ok {
+			return nil, fmt.Errorf("unsupported kafka_compression: %s", config.KafkaCompression)
+		}
+
+		writer.Compression = compression
+	}
+
+	return writer, nil
+}
+
+// getKafkaBatchOptions returns the configured batch options, unset options use DefaultKafkaBatchOptions.
+func getKafkaBatchOptions(config Config) KafkaBatchOptions {
+	batchOptions := config.KafkaBatch
+
+	if batchOptions.Size <= 0 {
+		batchOptions.Size = DefaultKafkaBatchOptions.Size
+	}
+
+	if batchOptions.Bytes <= 0 {
+		batchOptions.Bytes = DefaultKafkaBatchOptions.Bytes
+	}
+
+	if batchOptions.Timeout <= 0 {
+		batchOptions.Timeout = DefaultKafkaBatchOptions.Timeout
+	}
+
+	return batchOptions
+}
+
+// writeKafkaMessages writes the messages to Kafka, retrying on failure.
+func writeKafkaMessages(messages ...kafka.Message) error {
+	if lightweightMessages != nil {
+		return lightweightMessages.addKafkaMessages(messages)
+	}
+
+	return retry(context.Background(), ExternalServiceRetryOptions, func() error {
+		return KafkaWriter.WriteMessages(context.Background(), messages...)
+	})
+}
+
+// MessageBatcher collects parsed messages and writes them to Kafka in batches of KafkaBatchSize.
+type MessageBatcher struct {
+	messages []kafka.Message
+	// onWrite is called with the amount of messages written after each batch.
+	onWrite func(written int)
+	// throttle rate limits the messages of low priority parse jobs, nil otherwise.
+	throttle *ingestThrottle
+}
+
+// NewMessageBatcher creates a message batcher, onWrite is called after each written batch (e.g. to report progress) and may be nil.
+func NewMessageBatcher(onWrite func(written int)) *MessageBatcher {
+	return &MessageBatcher{
+		onWrite: onWrite,
+	}
+}
+
+// Add adds the message to the batch, the batch is written when it is full.
+// Waits for the throttle first if the batcher is throttled.
+func (batcher *MessageBatcher) Add(message Message) error {
+	if batcher.throttle != nil {
+		if err := batcher.throttle.Wait(); err != nil {
+			return err
+		}
+	}
+
+	batcher.messages = append(batcher.messages, kafka.Message{
+		Key:   []byte(message.UUID),
+		Value: []byte(message.JSON()),
+	})
+
+	if len(batcher.messages) >= KafkaBatchSize {
+		return batcher.Flush()
+	}
+
+	return nil
+}
+
+// Len returns the amount of messages which aren't written yet.
+func (batcher *MessageBatcher) Len() int {
+	return len(batcher.messages)
+}
+
+// Flush writes the remaining messages, the messages are kept if writing fails.
+func (batcher *MessageBatcher) Flush() error {
+	if len(batcher.messages) == 0 {
+		return nil
+	}
+
+	if err := writeKafkaMessages(batcher.messages...); err != nil {
+		return err
+	}
+
+	written := len(batcher.messages)
+
+	batcher.messages = nil
+
+	if batcher.onWrite != nil {
+		batcher.onWrite(written)
+	}
+
+	return nil
+}
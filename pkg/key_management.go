@@ -0,0 +1,347 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeyWrappers defines the wrappers of the data encryption keys, the first wraps new keys and the others only unwrap keys until RotateDataKeys re-wrapped them.
+// Key management is disabled if empty.
+//
+// Deprecated: use Core.Config.MasterKeys or Core.Config.KeyWrappers.
+var KeyWrappers []KeyWrapper
+
+// KeyWrapper wraps (encrypts) the data encryption keys with a master key, e.g. a key from the configuration or a KMS.
+type KeyWrapper interface {
+	// KeyID identifies the master key, stored with the wrapped keys so they can be unwrapped after a rotation.
+	KeyID() string
+	WrapKey(key []byte) (string, error)
+	UnwrapKey(wrappedKey string) ([]byte, error)
+}
+
+// ErrKeyManagementDisabled is returned if data encryption keys are used without a configured master key.
+var ErrKeyManagementDisabled = errors.New("key management is disabled, set the master_keys configuration variable")
+
+// ErrKeyWrapperNotFound is returned if a data encryption key is wrapped by a master key which is no longer configured.
+var ErrKeyWrapperNotFound = errors.New("master key of the data encryption key not found")
+
+// dataKeySize defines the size of the data encryption keys (AES-256).
+const dataKeySize = 32
+
+// tokenDataKeyScope defines the scope of the data encryption key of the stored OAuth2 tokens, which don't belong to a project.
+const tokenDataKeyScope = "oauth2_tokens"
+
+// dataKey represents an unwrapped data encryption key.
+type dataKey struct {
+	key []byte
+	// objectEncryption is true if the MinIO objects of the project are encrypted with the key.
+	// Projects created before key management was enabled keep their objects unencrypted.
+	objectEncryption bool
+}
+
+// dataKeyCache holds the unwrapped data encryption keys per scope, so a KMS isn't called for each object.
+var dataKeyCache sync.Map
+
+// masterKeyWrapper wraps the data encryption keys with AES-GCM using a master key from the configuration.
+type masterKeyWrapper struct {
+	keyID     string
+	masterKey []byte
+}
+
+// NewMasterKeyWrapper creates the key wrapper of the master key (base64 encoded, 32 bytes).
+func NewMasterKeyWrapper(encodedKey string) (KeyWrapper, error) {
+	masterKey, err := decodeEncryptionKey("master_keys", encodedKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if masterKey == nil {
+		return nil, errors.New("empty master key")
+	}
+
+	// The key ID identifies the master key without revealing it.
+	masterKeyHash := sha256.Sum256(masterKey)
+
+	return &masterKeyWrapper{
+		keyID:     fmt.Sprintf("master-%s", hex.EncodeToString(masterKeyHash[:8])),
+		masterKey: masterKey,
+	}, nil
+}
+
+// newKeyWrappers returns the key wrappers of the configuration, the configured wrappers take precedence over the master keys.
+func newKeyWrappers(config Config) ([]KeyWrapper, error) {
+	if len(config.KeyWrappers) > 0 {
+		return config.KeyWrappers, nil
+	}
+
+	var keyWrappers []KeyWrapper
+
+	for _, encodedKey := range config.MasterKeys {
+		keyWrapper, err := NewMasterKeyWrapper(encodedKey)
+
+		if err != nil {
+			return nil, err
+		}
+
+		keyWrappers = append(keyWrappers, keyWrapper)
+	}
+
+	return keyWrappers, nil
+}
+
+// KeyID returns the ID of the master key.
+func (keyWrapper *masterKeyWrapper) KeyID() string {
+	return keyWrapper.keyID
+}
+
+// WrapKey encrypts the key with the master key.
+func (keyWrapper *masterKeyWrapper) WrapKey(key []byte) (string, error) {
+	return encryptValue(keyWrapper.masterKey, string(key))
+}
+
+// UnwrapKey decrypts the key wrapped by WrapKey.
+func (keyWrapper *masterKeyWrapper) UnwrapKey(wrappedKey string) ([]byte, error) {
+	key, err := decryptValue(keyWrapper.masterKey, wrappedKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(key), nil
+}
+
+// getKeyWrapper returns the configured key wrapper of the master key.
+func getKeyWrapper(keyID string) (KeyWrapper, error) {
+	for _, keyWrapper := range KeyWrappers {
+		if keyWrapper.KeyID() == keyID {
+			return keyWrapper, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrKeyWrapperNotFound, keyID)
+}
+
+// createDataKey generates the data encryption key of the scope (a project UUID or tokenDataKeyScope) wrapped by the current master key.
+// Does nothing if the scope already has a key.
+func createDataKey(scope string, objectEncryption bool, database *pgx.Conn) error {
+	if len(KeyWrappers) == 0 {
+		return ErrKeyManagementDisabled
+	}
+
+	key := make([]byte, dataKeySize)
+
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return err
+	}
+
+	wrappedKey, err := KeyWrappers[0].WrapKey(key)
+
+	if err != nil {
+		return err
+	}
+
+	preparedStatement := `
+	INSERT INTO data_keys(scope, keyID, wrappedKey, objectEncryption, creationDate) VALUES ($1, $2, $3, $4, $5)
+	ON CONFLICT (scope) DO NOTHING
+	`
+	_, err = database.Exec(context.Background(), preparedStatement, scope, KeyWrappers[0].KeyID(), wrappedKey, objectEncryption, time.Now().Unix())
+
+	return err
+}
+
+// getDataKey returns the data encryption key of the scope, which is created if the scope has no key yet.
+// Keys created on first use don't encrypt objects, since the existing objects of the project aren't encrypted.
+func getDataKey(scope string, database *pgx.Conn) (dataKey, error) {
+	if len(KeyWrappers) == 0 {
+		return dataKey{}, ErrKeyManagementDisabled
+	}
+
+	if cachedKey, ok := dataKeyCache.Load(scope); ok {
+		return cachedKey.(dataKey), nil
+	}
+
+	preparedStatement := `
+	SELECT keyID, wrappedKey, objectEncryption FROM data_keys WHERE scope = $1
+	`
+	var keyID string
+	var wrappedKey string
+	var objectEncryption bool
+
+	err := database.QueryRow(context.Background(), preparedStatement, scope).Scan(&keyID, &wrappedKey, &objectEncryption)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		if err := createDataKey(scope, false, database); err != nil {
+			return dataKey{}, err
+		}
+
+		// Another process may have created the key concurrently.
+		err = database.QueryRow(context.Background(), preparedStatement, scope).Scan(&keyID, &wrappedKey, &objectEncryption)
+	}
+
+	if err != nil {
+		return dataKey{}, err
+	}
+
+	keyWrapper, err := getKeyWrapper(keyID)
+
+	if err != nil {
+		return dataKey{}, err
+	}
+
+	key, err := keyWrapper.UnwrapKey(wrappedKey)
+
+	if err != nil {
+		return dataKey{}, err
+	}
+
+	unwrappedKey := dataKey{
+		key:              key,
+		objectEncryption: objectEncryption,
+	}
+
+	dataKeyCache.Store(scope, unwrappedKey)
+
+	return unwrappedKey, nil
+}
+
+// RotateDataKeys re-wraps the data encryption keys wrapped by a previous master key with the current master key.
+// Configure the new master key first (followed by the previous keys), the previous keys can be removed once this returns.
+// The data encryption keys themselves don't change, so the encrypted objects and tokens stay readable.
+// Returns the amount of re-wrapped keys.
+func RotateDataKeys(database *pgx.Conn) (int, error) {
+	if len(KeyWrappers) == 0 {
+		return 0, ErrKeyManagementDisabled
+	}
+
+	currentKeyWrapper := KeyWrappers[0]
+
+	preparedStatement := `
+	SELECT scope, keyID, wrappedKey FROM data_keys WHERE keyID != $1
+	`
+	rows, err := database.Query(context.Background(), preparedStatement, currentKeyWrapper.KeyID())
+
+	if err != nil {
+		return 0, err
+	}
+
+	type wrappedDataKey struct {
+		scope      string
+		keyID      string
+		wrappedKey string
+	}
+
+	var wrappedKeys []wrappedDataKey
+
+	for rows.Next() {
+		var wrappedKey wrappedDataKey
+
+		if err := rows.Scan(&wrappedKey.scope, &wrappedKey.keyID, &wrappedKey.wrappedKey); err != nil {
+			return 0, err
+		}
+
+		wrappedKeys = append(wrappedKeys, wrappedKey)
+	}
+
+	rows.Close()
+
+	if rows.Err() != nil {
+		return 0, rows.Err()
+	}
+
+	var rotated int
+
+	for _, wrappedKey := range wrappedKeys {
+		keyWrapper, err := getKeyWrapper(wrappedKey.keyID)
+
+		if err != nil {
+			return rotated, err
+		}
+
+		key, err := keyWrapper.UnwrapKey(wrappedKey.wrappedKey)
+
+		if err != nil {
+			return rotated, err
+		}
+
+		rewrappedKey, err := currentKeyWrapper.WrapKey(key)
+
+		if err != nil {
+			return rotated, err
+		}
+
+		preparedStatement := `
+		UPDATE data_keys SET keyID = $1, wrappedKey = $2 WHERE scope = $3 AND keyID = $4
+		`
+		if _, err := database.Exec(context.Background(), preparedStatement, currentKeyWrapper.KeyID(), rewrappedKey, wrappedKey.scope, wrappedKey.keyID); err != nil {
+			return rotated, err
+		}
+
+		rotated++
+	}
+
+	Logger.Infof("Re-wrapped %d data encryption keys with master key %s", rotated, currentKeyWrapper.KeyID())
+
+	return rotated, nil
+}
+
+// getObjectEncryption returns the server-side encryption (SSE-C) of the MinIO object, nil if the object isn't encrypted.
+// Objects in a project prefix are encrypted with the data encryption key of the project, evidence files (stored by their hash) aren't.
+// A database connection is only opened if the key isn't cached, since the MinIO helpers don't take one.
+func getObjectEncryption(objectName string) (encrypt.ServerSide, error) {
+	if len(KeyWrappers) == 0 {
+		return nil, nil
+	}
+
+	projectUUID, _, hasPrefix := strings.Cut(objectName, "/")
+
+	if !hasPrefix {
+		return nil, nil
+	}
+
+	projectKey, err := getCachedDataKey(projectUUID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !projectKey.objectEncryption {
+		return nil, nil
+	}
+
+	return encrypt.NewSSEC(projectKey.key)
+}
+
+// getCachedDataKey returns the data encryption key of the scope, opening a database connection if it isn't cached.
+func getCachedDataKey(scope string) (dataKey, error) {
+	if cachedKey, ok := dataKeyCache.Load(scope); ok {
+		return cachedKey.(dataKey), nil
+	}
+
+	database, err := NewDatabase()
+
+	if err != nil {
+		return dataKey{}, err
+	}
+
+	defer func() {
+		if err := database.Close(context.Background()); err != nil {
+			Logger.Errorf("Failed to close database: %s", err)
+		}
+	}()
+
+	return getDataKey(scope, database)
+}
@@ -0,0 +1,502 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aquasecurity/esquery"
+	"github.com/jackc/pgx/v4"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed report_keywords.html
+var keywordReportTemplate string
+
+// KeywordReport represents the hits of a keyword list in the messages of a project, see GetKeywordReport.
+type KeywordReport struct {
+	Keywords      []KeywordHits `json:"keywords"`
+	TotalHits     int           `json:"total_hits"` // The amount of messages matching any keyword.
+	TotalMessages int           `json:"total_messages"`
+	CreationDate  int           `json:"creation_date"`
+}
+
+// KeywordHits represents the messages matching a keyword.
+type KeywordHits struct {
+	Keyword    string                 `json:"keyword"`
+	Hits       int                    `json:"hits"` // The amount of matching messages.
+	Custodians []KeywordCustodianHits `json:"custodians"`
+	Excerpts   []KeywordExcerpt       `json:"excerpts"` // Examples of the matching messages, the best matches first.
+}
+
+// KeywordCustodianHits represents the messages of a custodian matching a keyword.
+// Evidence without a custodian is named by its file name, see SetEvidenceCustodian.
+type KeywordCustodianHits struct {
+	Custodian string `json:"custodian"`
+	Hits      int    `json:"hits"`
+}
+
+// KeywordExcerpt represents an example of a message matching a keyword.
+type KeywordExcerpt struct {
+	MessageUUID string `json:"message_uuid"`
+	Subject     string `json:"subject"`
+	From        string `json:"from"`
+	Received    int    `json:"received"`
+	Excerpt     string `json:"excerpt"` // The matching fragment of the body, subject or attachment names.
+}
+
+// Keyword report formats.
+const (
+	KeywordReportFormatHTML = "html"
+	KeywordReportFormatPDF  = "pdf"
+	KeywordReportFormatCSV  = "csv"
+)
+
+// Keyword report limits.
+const (
+	maxKeywordReportKeywords = 100
+	// maxKeywordReportEvidence defines the maximum amount of evidence in the custodian breakdown of a keyword.
+	maxKeywordReportEvidence = 1000
+	// keywordReportExcerptSize defines the amount of excerpts per keyword.
+	keywordReportExcerptSize = 3
+	// keywordReportFragmentSize defines the size (in characters) of an excerpt.
+	keywordReportFragmentSize = 200
+)
+
+// keywordReportCollectedCustodian names the custodian of collected mailboxes, which have no evidence.
+const keywordReportCollectedCustodian = "Collected mailboxes"
+
+// ErrNoKeywords is returned if the keyword list is empty.
+var ErrNoKeywords = errors.New("keyword list is empty")
+
+// keywordReportExcerptFields defines the fields an excerpt is taken from, in order of preference.
+var keywordReportExcerptFields = []string{"body", "subject", "attachments.name"}
+
+// GetKeywordReport returns the amount of messages matching each keyword (like a search query, see GetMessagesFromQuery),
+// broken down per custodian, with example excerpts. Duplicate and empty keywords are ignored.
+func GetKeywordReport(projectUUID string, keywords []string, userUUID string, database *pgx.Conn) (KeywordReport, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return KeywordReport{}, err
+	}
+
+	keywords = normalizeKeywords(keywords)
+
+	if len(keywords) == 0 {
+		return KeywordReport{}, ErrNoKeywords
+	}
+
+	if len(keywords) > maxKeywordReportKeywords {
+		return KeywordReport{}, fmt.Errorf("too many keywords: %d (maximum %d)", len(keywords), maxKeywordReportKeywords)
+	}
+
+	evidenceListings, err := ListProjectEvidence(projectUUID, EvidenceFilterAll, userUUID, database)
+
+	if err != nil {
+		return KeywordReport{}, err
+	}
+
+	custodians := map[string]string{"": keywordReportCollectedCustodian}
+
+	for _, evidenceListing := range evidenceListings {
+		custodians[evidenceListing.UUID] = evidenceListing.Custodian
+
+		if evidenceListing.Custodian == "" {
+			custodians[evidenceListing.UUID] = evidenceListing.FileName
+		}
+	}
+
+	var keywordQueries []esquery.Mappable
+	var aggregations []esquery.Aggregation
+
+	for i, keyword := range keywords {
+		keywordQuery := addSearchQueryMatch(esquery.Bool(), keyword)
+		keywordQueries = append(keywordQueries, keywordQuery)
+
+		aggregations = append(aggregations, esquery.FilterAgg(fmt.Sprintf("keyword_%d", i), keywordQuery).Aggs(
+			esquery.TermsAgg("evidence", "evidence_uuid").Size(maxKeywordReportEvidence),
+		))
+	}
+
+	aggregations = append(aggregations, esquery.FilterAgg("any", esquery.Bool().MinimumShouldMatch(1).Should(keywordQueries...)))
+
+	aggregationResult, totalMessages, err := runAggregationSearch(esquery.Bool().Filter(esquery.Term("project_uuid", projectUUID)), aggregations...)
+
+	if err != nil {
+		return KeywordReport{}, err
+	}
+
+	anyBucket, err := aggregationResult.Bucket("any")
+
+	if err != nil {
+		return KeywordReport{}, err
+	}
+
+	keywordReport := KeywordReport{
+		TotalHits:     anyBucket.DocCount,
+		TotalMessages: totalMessages,
+		CreationDate:  int(time.Now().Unix()),
+	}
+
+	for i, keyword := range keywords {
+		keywordBucket, err := aggregationResult.Bucket(fmt.Sprintf("keyword_%d", i))
+
+		if err != nil {
+			return KeywordReport{}, err
+		}
+
+		evidenceBuckets, err := keywordBucket.Aggregations.Buckets("evidence")
+
+		if err != nil {
+			return KeywordReport{}, err
+		}
+
+		keywordHits := KeywordHits{
+			Keyword: keyword,
+			Hits:    keywordBucket.DocCount,
+		}
+
+		// Multiple evidence files may belong to the same custodian.
+		custodianHits := map[string]int{}
+
+		for _, evidenceBucket := range evidenceBuckets {
+			custodian, ok := custodians[evidenceBucket.KeyString()]
+
+			if !ok {
+				custodian = evidenceBucket.KeyString()
+			}
+
+			custodianHits[custodian] += evidenceBucket.DocCount
+		}
+
+		for custodian, hits := range custodianHits {
+			keywordHits.Custodians = append(keywordHits.Custodians, KeywordCustodianHits{
+				Custodian: custodian,
+				Hits:      hits,
+			})
+		}
+
+		sort.Slice(keywordHits.Custodians, func(i, j int) bool {
+			if keywordHits.Custodians[i].Hits == keywordHits.Custodians[j].Hits {
+				return keywordHits.Custodians[i].Custodian < keywordHits.Custodians[j].Custodian
+			}
+
+			return keywordHits.Custodians[i].Hits > keywordHits.Custodians[j].Hits
+		})
+
+		if keywordHits.Hits > 0 {
+			if keywordHits.Excerpts, err = getKeywordExcerpts(keyword, projectUUID); err != nil {
+				return KeywordReport{}, err
+			}
+		}
+
+		keywordReport.Keywords = append(keywordReport.Keywords, keywordHits)
+	}
+
+	return keywordReport, nil
+}
+
+// normalizeKeywords returns the trimmed keywords without empty and duplicate (case insensitive) keywords.
+func normalizeKeywords(keywords []string) []string {
+	var normalizedKeywords []string
+
+	seenKeywords := map[string]bool{}
+
+	for _, keyword := range keywords {
+		keyword = strings.TrimSpace(keyword)
+
+		if keyword == "" || seenKeywords[strings.ToLower(keyword)] {
+			continue
+		}
+
+		seenKeywords[strings.ToLower(keyword)] = true
+		normalizedKeywords = append(normalizedKeywords, keyword)
+	}
+
+	return normalizedKeywords
+}
+
+// getKeywordExcerpts returns the highlighted fragments of the messages best matching the keyword.
+func getKeywordExcerpts(keyword string, projectUUID string) ([]KeywordExcerpt, error) {
+	highlight := esquery.Highlight().
+		PreTags("").
+		PostTags("").
+		FragmentSize(keywordReportFragmentSize).
+		NumberOfFragments(1)
+
+	for _, field := range keywordReportExcerptFields {
+		highlight = highlight.Field(field)
+	}
+
+	response, err := esquery.Search().
+		Query(newSearchQuery(keyword, projectUUID)).
+		Size(keywordReportExcerptSize).
+		SourceIncludes("uuid", "subject", "from", "received").
+		Highlight(highlight).
+		Run(
+			Elasticsearch,
+			Elasticsearch.Search.WithContext(context.Background()),
+			Elasticsearch.Search.WithIndex("messages"),
+		)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err := response.Body.Close(); err != nil {
+			Logger.Errorf("Failed to close Elasticsearch response: %s", err)
+		}
+	}()
+
+	if response.IsError() {
+		return nil, fmt.Errorf("failed to search keyword excerpts: %s", response.String())
+	}
+
+	var searchResponse struct {
+		Hits struct {
+			Hits []struct {
+				Source    Message             `json:"_source"`
+				Highlight map[string][]string `json:"highlight"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+
+	if err := json.NewDecoder(response.Body).Decode(&searchResponse); err != nil {
+		return nil, err
+	}
+
+	var excerpts []KeywordExcerpt
+
+	for _, hit := range searchResponse.Hits.Hits {
+		excerpt := KeywordExcerpt{
+			MessageUUID: hit.Source.UUID,
+			Subject:     hit.Source.Subject,
+			From:        hit.Source.From,
+			Received:    hit.Source.Received,
+		}
+
+		for _, field := range keywordReportExcerptFields {
+			if fragments := hit.Highlight[field]; len(fragments) > 0 {
+				excerpt.Excerpt = strings.Join(strings.Fields(fragments[0]), " ")
+				break
+			}
+		}
+
+		excerpts = append(excerpts, excerpt)
+	}
+
+	return excerpts, nil
+}
+
+// CreateKeywordReport creates the keyword hit report (see GetKeywordReport) as an HTML, PDF or CSV file.
+// The CSV file has a row per keyword (without custodian), per custodian of the keyword and per excerpt.
+// The branding of the project is shown in the HTML and PDF reports, see SetProjectReportBranding.
+// Returns the MinIO path to the uploaded file.
+func CreateKeywordReport(projectUUID string, keywords []string, format string, userUUID string, database *pgx.Conn) (string, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionExport, database); err != nil {
+		return "", err
+	}
+
+	if format != KeywordReportFormatHTML && format != KeywordReportFormatPDF && format != KeywordReportFormatCSV {
+		return "", fmt.Errorf("unsupported keyword report format: %s", format)
+	}
+
+	project, err := GetProjectByUUID(projectUUID, database)
+
+	if err != nil {
+		return "", err
+	}
+
+	branding, err := getProjectReportBranding(projectUUID, database)
+
+	if err != nil {
+		return "", err
+	}
+
+	location, err := getProjectLocation(projectUUID, database)
+
+	if err != nil {
+		return "", err
+	}
+
+	keywordReport, err := GetKeywordReport(projectUUID, keywords, userUUID, database)
+
+	if err != nil {
+		return "", err
+	}
+
+	scratchSpace, err := NewScratchSpace(projectUUID)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer scratchSpace.cleanup()
+
+	reportFileName := fmt.Sprintf("%s.%s", NewUUID(), format)
+	reportPath := scratchSpace.FilePath(reportFileName)
+
+	switch format {
+	case KeywordReportFormatHTML:
+		reportTemplate, err := parseReportTemplate("keywords", keywordReportTemplate, withDisplayDateFunction(nil, location))
+
+		if err != nil {
+			return "", err
+		}
+
+		// The logo isn't copied since the report is a single file.
+		err = executeReportTemplate(reportTemplate, reportPath, map[string]interface{}{
+			"project":  project,
+			"report":   keywordReport,
+			"branding": branding,
+		})
+
+		if err != nil {
+			return "", err
+		}
+	case KeywordReportFormatPDF:
+		if err := writeKeywordReportFile(reportPath, func(reportFile *os.File) error {
+			return writeKeywordReportPDF(keywordReport, project, branding, location, reportFile)
+		}); err != nil {
+			return "", err
+		}
+	case KeywordReportFormatCSV:
+		if err := writeKeywordReportFile(reportPath, func(reportFile *os.File) error {
+			return writeKeywordReportCSV(keywordReport, reportFile)
+		}); err != nil {
+			return "", err
+		}
+	}
+
+	return UploadFile(reportFileName, reportPath, projectUUID)
+}
+
+// writeKeywordReportFile creates the report file and writes it.
+func writeKeywordReportFile(reportPath string, write func(reportFile *os.File) error) error {
+	reportFile, err := os.Create(reportPath)
+
+	if err != nil {
+		return err
+	}
+
+	if err := write(reportFile); err != nil {
+		if closeErr := reportFile.Close(); closeErr != nil {
+			Logger.Errorf("Failed to close file: %s", closeErr)
+		}
+
+		return err
+	}
+
+	return reportFile.Close()
+}
+
+// writeKeywordReportPDF writes the keyword report as PDF.
+func writeKeywordReportPDF(keywordReport KeywordReport, project Project, branding ReportBranding, location *time.Location, reportFile *os.File) error {
+	document := newPDFDocument()
+
+	document.Title(fmt.Sprintf("Keyword hit report: %s", project.Name))
+
+	var details []string
+
+	for _, detail := range [][2]string{
+		{"Lab", branding.LabName},
+		{"Case number", branding.CaseNumber},
+		{"Examiner", branding.Examiner},
+		{"Created", formatDisplayDate(keywordReport.CreationDate, location)},
+	} {
+		if detail[1] != "" {
+			details = append(details, fmt.Sprintf("%s: %s", detail[0], detail[1]))
+		}
+	}
+
+	document.Paragraph(strings.Join(details, "\n"))
+
+	document.Heading("Summary")
+	document.Paragraph(fmt.Sprintf("%d of %d messages match at least one of the %d keywords.", keywordReport.TotalHits, keywordReport.TotalMessages, len(keywordReport.Keywords)))
+
+	columnWidths := []float64{395, 100}
+
+	document.TableRow([]string{"Keyword", "Messages"}, columnWidths, true)
+
+	for _, keywordHits := range keywordReport.Keywords {
+		document.TableRow([]string{keywordHits.Keyword, strconv.Itoa(keywordHits.Hits)}, columnWidths, false)
+	}
+
+	for _, keywordHits := range keywordReport.Keywords {
+		document.Heading(keywordHits.Keyword)
+		document.Paragraph(fmt.Sprintf("%d messages", keywordHits.Hits))
+
+		if len(keywordHits.Custodians) > 0 {
+			document.TableRow([]string{"Custodian", "Messages"}, columnWidths, true)
+
+			for _, custodianHits := range keywordHits.Custodians {
+				document.TableRow([]string{custodianHits.Custodian, strconv.Itoa(custodianHits.Hits)}, columnWidths, false)
+			}
+		}
+
+		for _, excerpt := range keywordHits.Excerpts {
+			document.Paragraph("")
+			document.Paragraph(fmt.Sprintf("%s\nFrom: %s\nReceived: %s\n%s", excerpt.Subject, excerpt.From, formatDisplayDate(excerpt.Received, location), excerpt.Excerpt))
+		}
+	}
+
+	return document.Write(reportFile)
+}
+
+// writeKeywordReportCSV writes the keyword report as CSV.
+func writeKeywordReportCSV(keywordReport KeywordReport, reportFile *os.File) error {
+	spreadsheet, err := newSpreadsheetWriter(SpreadsheetFormatCSV, reportFile)
+
+	if err != nil {
+		return err
+	}
+
+	if err := spreadsheet.WriteRow([]string{"keyword", "custodian", "hits", "message_uuid", "received", "from", "subject", "excerpt"}); err != nil {
+		return err
+	}
+
+	for _, keywordHits := range keywordReport.Keywords {
+		if err := spreadsheet.WriteRow([]string{keywordHits.Keyword, "", strconv.Itoa(keywordHits.Hits), "", "", "", "", ""}); err != nil {
+			return err
+		}
+
+		for _, custodianHits := range keywordHits.Custodians {
+			if err := spreadsheet.WriteRow([]string{keywordHits.Keyword, custodianHits.Custodian, strconv.Itoa(custodianHits.Hits), "", "", "", "", ""}); err != nil {
+				return err
+			}
+		}
+
+		for _, excerpt := range keywordHits.Excerpts {
+			if err := spreadsheet.WriteRow([]string{keywordHits.Keyword, "", "", excerpt.MessageUUID, formatMessageExportDate(excerpt.Received), excerpt.From, excerpt.Subject, excerpt.Excerpt}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return spreadsheet.Close()
+}
+
+// KeywordReportJobParameters represents the parameters of the JobTypeKeywordReport job.
+type KeywordReportJobParameters struct {
+	Keywords []string `json:"keywords"`
+	Format   string   `json:"format"`
+}
+
+// runKeywordReportJob runs CreateKeywordReport.
+func runKeywordReportJob(ctx context.Context, job Job, reportProgress func(progress int), database *pgx.Conn) (string, error) {
+	var parameters KeywordReportJobParameters
+
+	if err := decodeJobParameters(job, &parameters); err != nil {
+		return "", err
+	}
+
+	return CreateKeywordReport(job.ProjectUUID, parameters.Keywords, parameters.Format, job.UserUUID, database)
+}
@@ -0,0 +1,141 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"encoding/json"
+	"github.com/jackc/pgx/v4"
+	"github.com/segmentio/kafka-go"
+	"sync"
+)
+
+// The lightweight mode (see Config.Lightweight) replaces PostgreSQL, Elasticsearch, Kafka and MinIO:
+// the data is stored in the in-memory repositories, the parsed messages in a MemoryMessageStore and the objects in a file BlobStore.
+// Parsers run without a database connection (nil), functions requiring one of the services aren't available.
+var (
+	// lightweightRepositories are the Core.Repositories of the lightweight mode, nil otherwise.
+	lightweightRepositories *Repositories
+	// lightweightMessages is the Core.Messages of the lightweight mode, nil otherwise.
+	lightweightMessages *MemoryMessageStore
+)
+
+// defaultBlobDirectory defines the directory of the objects in the lightweight mode if Config.BlobDirectory is unset, next to the project directories.
+const defaultBlobDirectory = "data/blobs"
+
+// getRepositories returns the repositories of the database connection, or the lightweight repositories if there is no connection.
+func getRepositories(database *pgx.Conn) Repositories {
+	if database == nil && lightweightRepositories != nil {
+		return *lightweightRepositories
+	}
+
+	return NewRepositories(database)
+}
+
+// newLightweightCore creates the in-memory repositories, message store and file blob store of the lightweight mode.
+func newLightweightCore(core *Core) error {
+	blobDirectory := core.Config.BlobDirectory
+
+	if blobDirectory == "" {
+		blobDirectory = defaultBlobDirectory
+	}
+
+	blobStore, err := NewFileBlobStore(blobDirectory)
+
+	if err != nil {
+		return err
+	}
+
+	core.BlobStore = blobStore
+	core.Repositories = NewMemoryRepositories()
+	core.Messages = NewMemoryMessageStore()
+
+	return nil
+}
+
+// MemoryMessageStore holds the parsed messages in the lightweight mode instead of Kafka and Elasticsearch.
+type MemoryMessageStore struct {
+	mutex    sync.RWMutex
+	messages []Message
+	indices  map[string]int // The index of each message UUID in messages.
+}
+
+// NewMemoryMessageStore creates an empty message store.
+func NewMemoryMessageStore() *MemoryMessageStore {
+	return &MemoryMessageStore{
+		indices: map[string]int{},
+	}
+}
+
+// Add adds the messages, a message with the UUID of a stored message replaces it (like indexing it again).
+func (store *MemoryMessageStore) Add(messages ...Message) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for _, message := range messages {
+		if index, ok := store.indices[message.UUID]; ok {
+			store.messages[index] = message
+			continue
+		}
+
+		store.indices[message.UUID] = len(store.messages)
+		store.messages = append(store.messages, message)
+	}
+}
+
+// addKafkaMessages adds the messages written to Kafka by the MessageBatcher.
+func (store *MemoryMessageStore) addKafkaMessages(kafkaMessages []kafka.Message) error {
+	messages := make([]Message, 0, len(kafkaMessages))
+
+	for _, kafkaMessage := range kafkaMessages {
+		var message Message
+
+		if err := json.Unmarshal(kafkaMessage.Value, &message); err != nil {
+			return err
+		}
+
+		messages = append(messages, message)
+	}
+
+	store.Add(messages...)
+
+	return nil
+}
+
+// GetMessage returns the message with the specified UUID, false if it isn't stored.
+func (store *MemoryMessageStore) GetMessage(messageUUID string) (Message, bool) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	index, ok := store.indices[messageUUID]
+
+	if !ok {
+		return Message{}, false
+	}
+
+	return store.messages[index], true
+}
+
+// GetMessages returns the messages of the project in the order they were added.
+func (store *MemoryMessageStore) GetMessages(projectUUID string) []Message {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	var messages []Message
+
+	for _, message := range store.messages {
+		if message.ProjectUUID == projectUUID {
+			messages = append(messages, message)
+		}
+	}
+
+	return messages
+}
+
+// Len returns the amount of stored messages of all projects.
+func (store *MemoryMessageStore) Len() int {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	return len(store.messages)
+}
@@ -3,6 +3,104 @@
 // Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
 package core
 
-import "github.com/sirupsen/logrus"
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"os"
+)
 
-var Logger = logrus.New()
+// StructuredLogger is the minimal logger used by the package, see Config.Logger.
+// Implement it to use another logging library (zap, zerolog, etc.) or use NewDiscardLogger to silence the logs.
+type StructuredLogger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+	// Fatalf logs the message and exits the process.
+	Fatalf(format string, args ...interface{})
+	// WithFields returns a logger which adds the fields (e.g. project_uuid, evidence_uuid) to all messages.
+	WithFields(fields LogFields) StructuredLogger
+}
+
+// LogFields represents the structured fields of a log message.
+type LogFields map[string]interface{}
+
+// Logger defines our logger, it logs to standard error using logrus by default.
+//
+// Deprecated: use Core.Logger.
+var Logger = NewLogrusLogger(logrus.New())
+
+// logrusLogger implements StructuredLogger using logrus.
+type logrusLogger struct {
+	entry *logrus.Entry
+}
+
+// NewLogrusLogger returns a StructuredLogger which logs to the logrus logger.
+func NewLogrusLogger(logger *logrus.Logger) StructuredLogger {
+	return &logrusLogger{entry: logrus.NewEntry(logger)}
+}
+
+// Debugf logs a debug message.
+func (logger *logrusLogger) Debugf(format string, args ...interface{}) {
+	logger.entry.Debugf(format, args...)
+}
+
+// Infof logs an info message.
+func (logger *logrusLogger) Infof(format string, args ...interface{}) {
+	logger.entry.Infof(format, args...)
+}
+
+// Warnf logs a warning message.
+func (logger *logrusLogger) Warnf(format string, args ...interface{}) {
+	logger.entry.Warnf(format, args...)
+}
+
+// Errorf logs an error message.
+func (logger *logrusLogger) Errorf(format string, args ...interface{}) {
+	logger.entry.Errorf(format, args...)
+}
+
+// Fatalf logs the message and exits the process.
+func (logger *logrusLogger) Fatalf(format string, args ...interface{}) {
+	logger.entry.Fatalf(format, args...)
+}
+
+// WithFields returns a logger with the fields added.
+func (logger *logrusLogger) WithFields(fields LogFields) StructuredLogger {
+	return &logrusLogger{entry: logger.entry.WithFields(logrus.Fields(fields))}
+}
+
+// discardLogger implements StructuredLogger without logging anything.
+type discardLogger struct {
+	fatalWriter io.Writer
+}
+
+// NewDiscardLogger returns a StructuredLogger which discards all messages.
+// Fatal messages are still written to standard error before exiting.
+func NewDiscardLogger() StructuredLogger {
+	return &discardLogger{fatalWriter: os.Stderr}
+}
+
+// Debugf discards the message.
+func (logger *discardLogger) Debugf(format string, args ...interface{}) {}
+
+// Infof discards the message.
+func (logger *discardLogger) Infof(format string, args ...interface{}) {}
+
+// Warnf discards the message.
+func (logger *discardLogger) Warnf(format string, args ...interface{}) {}
+
+// Errorf discards the message.
+func (logger *discardLogger) Errorf(format string, args ...interface{}) {}
+
+// Fatalf writes the message to standard error and exits the process.
+func (logger *discardLogger) Fatalf(format string, args ...interface{}) {
+	_, _ = fmt.Fprintf(logger.fatalWriter, format+"\n", args...)
+	os.Exit(1)
+}
+
+// WithFields returns the same logger.
+func (logger *discardLogger) WithFields(fields LogFields) StructuredLogger {
+	return logger
+}
@@ -0,0 +1,287 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"golang.org/x/oauth2"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// Mail providers.
+const (
+	MailProviderOutlook = "outlook"
+	MailProviderGoogle  = "google"
+)
+
+// MailProvider represents a cloud mailbox provider which is authenticated to with OAuth2.
+type MailProvider struct {
+	Name string
+	// EmailsConfig requests access to the mailbox, ProfileConfig only to the user profile.
+	EmailsConfig    *oauth2.Config
+	ProfileConfig   *oauth2.Config
+	AuthCodeOptions []oauth2.AuthCodeOption
+	// ProfileURL returns the user profile as JSON, the email address is in the ProfileEmailField.
+	ProfileURL        string
+	ProfileEmailField string
+	IMAPHost          string
+	IMAPPort          int
+	// NewCollector creates the collector of the provider, NewIMAPCollector is used if unset.
+	NewCollector func(provider *MailProvider) MailCollector
+}
+
+// MailCollector collects the emails of a mailbox into the project.
+// getAccessToken is called on every (re)authentication so expired tokens are refreshed.
+// The message counts per mailbox are added to the collection if it isn't nil.
+type MailCollector interface {
+	Collect(project Project, email string, getAccessToken func() (string, error), collection *Collection, progressReporter ProgressReporter) error
+}
+
+// MailProviderCredentials represents the OAuth2 client credentials of a mail provider.
+type MailProviderCredentials struct {
+	ClientID     string `mapstructure:"client_id"`
+	ClientSecret string `mapstructure:"client_secret"`
+}
+
+// mailProviders defines the supported mail providers by name.
+var mailProviders = map[string]*MailProvider{
+	MailProviderOutlook: outlookProvider,
+	MailProviderGoogle:  googleProvider,
+}
+
+// Variables defining the credentials applied to registered mail providers, see setMailProviderCredentials.
+var (
+	mailProviderCredentials = map[string]MailProviderCredentials{}
+	mailProviderAPIURL      string
+)
+
+// RegisterMailProvider registers the mail provider, replacing any existing provider with the same name.
+// For example a Yahoo provider only needs its OAuth2 endpoints, scopes, profile URL and IMAP server,
+// the credentials are read from the mail_providers configuration variable.
+func RegisterMailProvider(provider *MailProvider) {
+	if credentials, ok := mailProviderCredentials[provider.Name]; ok {
+		provider.setCredentials(credentials.ClientID, credentials.ClientSecret, mailProviderAPIURL)
+	}
+
+	mailProviders[provider.Name] = provider
+}
+
+// GetMailProvider returns the mail provider by name.
+func GetMailProvider(name string) (*MailProvider, error) {
+	provider, ok := mailProviders[name]
+
+	if !ok {
+		return nil, fmt.Errorf("unsupported mail provider: %s", name)
+	}
+
+	return provider, nil
+}
+
+// CollectEmailsForUser collects the emails of the mailbox using the stored token of the user, see MailProvider.SaveEmailsToken.
+// The collection is recorded with the message counts per mailbox, see GetCollectionReport.
+func CollectEmailsForUser(providerName string, project Project, email string, userUUID string, progressReporter ProgressReporter, database *pgx.Conn) error {
+	provider, err := GetMailProvider(providerName)
+
+	if err != nil {
+		return err
+	}
+
+	collection := newCollection(provider.Name, email, project.UUID, userUUID)
+
+	if err := collection.Save(database); err != nil {
+		return err
+	}
+
+	collectError := provider.newCollector().Collect(project, email, getValidAccessToken(userUUID, provider.Name, database), collection, progressReporter)
+
+	collection.finish(collectError)
+
+	if err := collection.Save(database); err != nil {
+		Logger.WithFields(LogFields{"project_uuid": project.UUID}).Errorf("Failed to save collection %s: %s", collection.UUID, err)
+	}
+
+	return collectError
+}
+
+// setMailProviderCredentials sets the credentials and redirect URLs of the mail providers.
+// The microsoft_client_* and google_client_* configuration variables are used unless set in mail_providers.
+func setMailProviderCredentials(config Config) {
+	MicrosoftClientID = config.MicrosoftClientID
+	MicrosoftClientSecret = config.MicrosoftClientSecret
+
+	mailProviderAPIURL = config.GoForensicsAPIURL
+	mailProviderCredentials = map[string]MailProviderCredentials{
+		MailProviderOutlook: {ClientID: config.MicrosoftClientID, ClientSecret: config.MicrosoftClientSecret},
+		MailProviderGoogle:  {ClientID: config.GoogleClientID, ClientSecret: config.GoogleClientSecret},
+	}
+
+	for name, credentials := range config.MailProviders {
+		mailProviderCredentials[name] = credentials
+	}
+
+	for _, provider := range mailProviders {
+		credentials := mailProviderCredentials[provider.Name]
+
+		provider.setCredentials(credentials.ClientID, credentials.ClientSecret, config.GoForensicsAPIURL)
+	}
+}
+
+// newCollector creates the collector of the provider.
+func (provider *MailProvider) newCollector() MailCollector {
+	if provider.NewCollector != nil {
+		return provider.NewCollector(provider)
+	}
+
+	return NewIMAPCollector(provider)
+}
+
+// setCredentials sets the credentials of the provider, the callbacks are /<provider>/emails/callback and /<provider>/profile/callback.
+func (provider *MailProvider) setCredentials(clientID string, clientSecret string, goForensicsAPIURL string) {
+	provider.EmailsConfig.ClientID = clientID
+	provider.EmailsConfig.ClientSecret = clientSecret
+	provider.EmailsConfig.RedirectURL = fmt.Sprintf("%s/%s/emails/callback", goForensicsAPIURL, provider.Name)
+
+	provider.ProfileConfig.ClientID = clientID
+	provider.ProfileConfig.ClientSecret = clientSecret
+	provider.ProfileConfig.RedirectURL = fmt.Sprintf("%s/%s/profile/callback", goForensicsAPIURL, provider.Name)
+}
+
+// GetEmailsAuthURL returns the authentication URL requesting access to the mailbox.
+func (provider *MailProvider) GetEmailsAuthURL() string {
+	return provider.EmailsConfig.AuthCodeURL("state-token", append([]oauth2.AuthCodeOption{oauth2.AccessTypeOffline}, provider.AuthCodeOptions...)...)
+}
+
+// GetProfileAuthURL returns the authentication URL requesting access to the user profile.
+func (provider *MailProvider) GetProfileAuthURL() string {
+	return provider.ProfileConfig.AuthCodeURL("state-token", append([]oauth2.AuthCodeOption{oauth2.AccessTypeOffline}, provider.AuthCodeOptions...)...)
+}
+
+// ExchangeEmailsToken exchanges the authorization code of the emails callback request for a token.
+func (provider *MailProvider) ExchangeEmailsToken(request *http.Request) (*oauth2.Token, error) {
+	return exchangeOAuth2Code(provider.EmailsConfig, request)
+}
+
+// SaveEmailsToken exchanges the authorization code of the emails callback request and stores the token for the user, see GetValidToken.
+func (provider *MailProvider) SaveEmailsToken(request *http.Request, userUUID string, database *pgx.Conn) error {
+	token, err := provider.ExchangeEmailsToken(request)
+
+	if err != nil {
+		return err
+	}
+
+	return SaveToken(token, provider.Name, userUUID, database)
+}
+
+// ExchangeProfileToken exchanges the authorization code of the profile callback request for a token.
+func (provider *MailProvider) ExchangeProfileToken(request *http.Request) (*oauth2.Token, error) {
+	return exchangeOAuth2Code(provider.ProfileConfig, request)
+}
+
+// GetUserProfile returns the email address of the user.
+func (provider *MailProvider) GetUserProfile(token string) (string, error) {
+	var body []byte
+
+	err := retry(context.Background(), ExternalServiceRetryOptions, func() error {
+		var err error
+
+		body, err = getOAuth2Resource(provider.ProfileURL, token)
+
+		return err
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	var responseMap map[string]interface{}
+
+	if err := json.Unmarshal(body, &responseMap); err != nil {
+		return "", err
+	}
+
+	email, ok := responseMap[provider.ProfileEmailField].(string)
+
+	if !ok {
+		return "", fmt.Errorf("%s profile has no %s", provider.Name, provider.ProfileEmailField)
+	}
+
+	return email, nil
+}
+
+// exchangeOAuth2Code exchanges the authorization code of the callback request for a token.
+func exchangeOAuth2Code(oauth2Config *oauth2.Config, request *http.Request) (*oauth2.Token, error) {
+	queryParts, err := url.ParseQuery(request.URL.RawQuery)
+
+	if err != nil {
+		return nil, err
+	}
+
+	code := queryParts.Get("code")
+
+	if code == "" {
+		return nil, fmt.Errorf("callback has no authorization code: %s", queryParts.Get("error"))
+	}
+
+	return oauth2Config.Exchange(context.Background(), code)
+}
+
+// getOAuth2Resource returns the body of the API resource requested with the access token.
+// Requests are rate limited by MailboxRateLimiter and throttled responses honor the Retry-After header.
+// Client errors other than 429 Too Many Requests are permanent and not retried.
+func getOAuth2Resource(resourceURL string, token string) ([]byte, error) {
+	if err := MailboxRateLimiter.Wait(context.Background()); err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequest("GET", resourceURL, nil)
+
+	if err != nil {
+		return nil, retryPermanent(err)
+	}
+
+	request.Header.Add("Authorization", "Bearer "+token)
+
+	response, err := http.DefaultClient.Do(request)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		err := response.Body.Close()
+
+		if err != nil {
+			Logger.Errorf("Failed to close response body: %s", err)
+		}
+	}()
+
+	body, err := ioutil.ReadAll(response.Body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode == http.StatusTooManyRequests || response.StatusCode == http.StatusServiceUnavailable {
+		throttledError := fmt.Errorf("throttled by %s: %d", request.URL.Host, response.StatusCode)
+
+		if after := parseRetryAfter(response.Header); after > 0 {
+			MailboxRateLimiter.Pause(after)
+
+			return nil, retryAfter(throttledError, after)
+		}
+
+		return nil, throttledError
+	} else if response.StatusCode >= 500 {
+		return nil, fmt.Errorf("unexpected status code: %d", response.StatusCode)
+	} else if response.StatusCode >= 400 {
+		return nil, retryPermanent(fmt.Errorf("unexpected status code: %d", response.StatusCode))
+	}
+
+	return body, nil
+}
@@ -0,0 +1,356 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"sort"
+	"sync"
+)
+
+// memoryStore holds the data of the in-memory repositories, see NewMemoryRepositories.
+type memoryStore struct {
+	mutex           sync.RWMutex
+	projects        map[string]Project
+	projectRoles    map[string]map[string]string // The role per user UUID per project UUID.
+	projectEvidence map[string]map[string]bool   // The evidence UUIDs per project UUID.
+	evidence        map[string]Evidence
+	treeNodes       map[string]TreeNode
+	messageMetadata map[string]MessageMetadata
+}
+
+// NewMemoryRepositories returns repositories storing the data in memory, e.g. for tests or the lightweight mode (see Config.Lightweight).
+// Like PostgreSQL, a missing row is returned as pgx.ErrNoRows. Unlike the pgx repositories they are safe for concurrent use.
+func NewMemoryRepositories() Repositories {
+	store := &memoryStore{
+		projects:        map[string]Project{},
+		projectRoles:    map[string]map[string]string{},
+		projectEvidence: map[string]map[string]bool{},
+		evidence:        map[string]Evidence{},
+		treeNodes:       map[string]TreeNode{},
+		messageMetadata: map[string]MessageMetadata{},
+	}
+
+	return Repositories{
+		Projects: &memoryProjectRepo{store: store},
+		Evidence: &memoryEvidenceRepo{store: store},
+		Tree:     &memoryTreeRepo{store: store},
+		Metadata: &memoryMetadataRepo{store: store},
+	}
+}
+
+// memoryProjectRepo implements ProjectRepo in memory.
+type memoryProjectRepo struct {
+	store *memoryStore
+}
+
+// SaveProject saves the project.
+func (repo *memoryProjectRepo) SaveProject(project Project) error {
+	repo.store.mutex.Lock()
+	defer repo.store.mutex.Unlock()
+
+	repo.store.projects[project.UUID] = project
+
+	return nil
+}
+
+// GetProject returns the project with the specified UUID.
+func (repo *memoryProjectRepo) GetProject(projectUUID string) (Project, error) {
+	repo.store.mutex.RLock()
+	defer repo.store.mutex.RUnlock()
+
+	project, ok := repo.store.projects[projectUUID]
+
+	if !ok {
+		return Project{}, pgx.ErrNoRows
+	}
+
+	return project, nil
+}
+
+// GetProjectsByUser returns all projects of the user, newest first.
+func (repo *memoryProjectRepo) GetProjectsByUser(userUUID string) ([]Project, error) {
+	repo.store.mutex.RLock()
+	defer repo.store.mutex.RUnlock()
+
+	var projects []Project
+
+	for projectUUID, roles := range repo.store.projectRoles {
+		if _, ok := roles[userUUID]; !ok {
+			continue
+		}
+
+		if project, ok := repo.store.projects[projectUUID]; ok {
+			projects = append(projects, project)
+		}
+	}
+
+	sort.Slice(projects, func(i, j int) bool {
+		return projects[i].CreationDate > projects[j].CreationDate
+	})
+
+	return projects, nil
+}
+
+// GetProjectUserRole returns the role of the user in the project.
+func (repo *memoryProjectRepo) GetProjectUserRole(projectUUID string, userUUID string) (string, error) {
+	repo.store.mutex.RLock()
+	defer repo.store.mutex.RUnlock()
+
+	role, ok := repo.store.projectRoles[projectUUID][userUUID]
+
+	if !ok {
+		return "", pgx.ErrNoRows
+	}
+
+	return role, nil
+}
+
+// AddProjectUser adds the user to the project with the specified role.
+// Returns ErrProjectUserExists if the user is already assigned to the project.
+func (repo *memoryProjectRepo) AddProjectUser(projectUUID string, userUUID string, role string) error {
+	if !IsValidRole(role) {
+		return fmt.Errorf("invalid role: %s", role)
+	}
+
+	repo.store.mutex.Lock()
+	defer repo.store.mutex.Unlock()
+
+	if _, ok := repo.store.projects[projectUUID]; !ok {
+		return pgx.ErrNoRows
+	}
+
+	if _, ok := repo.store.projectRoles[projectUUID][userUUID]; ok {
+		return ErrProjectUserExists
+	}
+
+	if repo.store.projectRoles[projectUUID] == nil {
+		repo.store.projectRoles[projectUUID] = map[string]string{}
+	}
+
+	repo.store.projectRoles[projectUUID][userUUID] = role
+
+	return nil
+}
+
+// AddProjectEvidence adds the evidence to the project.
+func (repo *memoryProjectRepo) AddProjectEvidence(projectUUID string, evidenceUUID string) error {
+	repo.store.mutex.Lock()
+	defer repo.store.mutex.Unlock()
+
+	if _, ok := repo.store.projects[projectUUID]; !ok {
+		return pgx.ErrNoRows
+	}
+
+	if repo.store.projectEvidence[projectUUID] == nil {
+		repo.store.projectEvidence[projectUUID] = map[string]bool{}
+	}
+
+	repo.store.projectEvidence[projectUUID][evidenceUUID] = true
+
+	return nil
+}
+
+// memoryEvidenceRepo implements EvidenceRepo in memory.
+type memoryEvidenceRepo struct {
+	store *memoryStore
+}
+
+// SaveEvidence saves the evidence.
+func (repo *memoryEvidenceRepo) SaveEvidence(evidence Evidence) error {
+	repo.store.mutex.Lock()
+	defer repo.store.mutex.Unlock()
+
+	repo.store.evidence[evidence.UUID] = evidence
+
+	return nil
+}
+
+// GetEvidence returns the evidence of the project.
+func (repo *memoryEvidenceRepo) GetEvidence(evidenceUUID string, projectUUID string) (Evidence, error) {
+	repo.store.mutex.RLock()
+	defer repo.store.mutex.RUnlock()
+
+	evidence, ok := repo.store.evidence[evidenceUUID]
+
+	if !ok || !repo.store.projectEvidence[projectUUID][evidenceUUID] {
+		return Evidence{}, pgx.ErrNoRows
+	}
+
+	return evidence, nil
+}
+
+// GetEvidenceByProject returns all evidence of the project, ordered by file name.
+func (repo *memoryEvidenceRepo) GetEvidenceByProject(projectUUID string) ([]Evidence, error) {
+	repo.store.mutex.RLock()
+	defer repo.store.mutex.RUnlock()
+
+	var projectEvidence []Evidence
+
+	for evidenceUUID := range repo.store.projectEvidence[projectUUID] {
+		if evidence, ok := repo.store.evidence[evidenceUUID]; ok {
+			projectEvidence = append(projectEvidence, evidence)
+		}
+	}
+
+	sort.Slice(projectEvidence, func(i, j int) bool {
+		return projectEvidence[i].FileName < projectEvidence[j].FileName
+	})
+
+	return projectEvidence, nil
+}
+
+// GetProjectEvidenceSize returns the total file size of all evidence in the project.
+func (repo *memoryEvidenceRepo) GetProjectEvidenceSize(projectUUID string) (int64, error) {
+	repo.store.mutex.RLock()
+	defer repo.store.mutex.RUnlock()
+
+	var evidenceSize int64
+
+	for evidenceUUID := range repo.store.projectEvidence[projectUUID] {
+		evidenceSize += repo.store.evidence[evidenceUUID].FileSize
+	}
+
+	return evidenceSize, nil
+}
+
+// memoryTreeRepo implements TreeRepo in memory.
+type memoryTreeRepo struct {
+	store *memoryStore
+}
+
+// SaveTreeNode saves the tree node.
+func (repo *memoryTreeRepo) SaveTreeNode(treeNode TreeNode) error {
+	repo.store.mutex.Lock()
+	defer repo.store.mutex.Unlock()
+
+	repo.store.treeNodes[treeNode.FolderUUID] = treeNode
+
+	return nil
+}
+
+// GetTreeNode returns the tree node of the project.
+func (repo *memoryTreeRepo) GetTreeNode(folderUUID string, projectUUID string) (TreeNode, error) {
+	repo.store.mutex.RLock()
+	defer repo.store.mutex.RUnlock()
+
+	treeNode, ok := repo.store.treeNodes[folderUUID]
+
+	if !ok || treeNode.ProjectUUID != projectUUID {
+		return TreeNode{}, pgx.ErrNoRows
+	}
+
+	return treeNode, nil
+}
+
+// GetTreeNodesByParent returns the children of the tree node, ordered by title.
+func (repo *memoryTreeRepo) GetTreeNodesByParent(parentTreeNodeUUID string, projectUUID string) ([]TreeNode, error) {
+	repo.store.mutex.RLock()
+	defer repo.store.mutex.RUnlock()
+
+	return repo.getChildren(parentTreeNodeUUID, projectUUID), nil
+}
+
+// GetTreeNodeDescendants returns all descendants of the tree node.
+func (repo *memoryTreeRepo) GetTreeNodeDescendants(treeNodeUUID string, projectUUID string) ([]TreeNode, error) {
+	repo.store.mutex.RLock()
+	defer repo.store.mutex.RUnlock()
+
+	var descendants []TreeNode
+
+	parents := []string{treeNodeUUID}
+
+	for len(parents) > 0 {
+		children := repo.getChildren(parents[0], projectUUID)
+		parents = parents[1:]
+
+		for _, child := range children {
+			descendants = append(descendants, child)
+			parents = append(parents, child.FolderUUID)
+		}
+	}
+
+	return descendants, nil
+}
+
+// getChildren returns the children of the tree node ordered by title, the caller must hold the lock.
+func (repo *memoryTreeRepo) getChildren(parentTreeNodeUUID string, projectUUID string) []TreeNode {
+	var children []TreeNode
+
+	for _, treeNode := range repo.store.treeNodes {
+		if treeNode.ProjectUUID == projectUUID && treeNode.Parent == parentTreeNodeUUID {
+			children = append(children, treeNode)
+		}
+	}
+
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].Title < children[j].Title
+	})
+
+	return children
+}
+
+// memoryMetadataRepo implements MetadataRepo in memory.
+type memoryMetadataRepo struct {
+	store *memoryStore
+}
+
+// SaveMessageMetadata saves the message metadata.
+func (repo *memoryMetadataRepo) SaveMessageMetadata(messageMetadata MessageMetadata) error {
+	repo.store.mutex.Lock()
+	defer repo.store.mutex.Unlock()
+
+	repo.store.messageMetadata[messageMetadata.MessageUUID] = messageMetadata
+
+	return nil
+}
+
+// GetMessageMetadata returns the metadata of the message.
+func (repo *memoryMetadataRepo) GetMessageMetadata(messageUUID string, projectUUID string) (MessageMetadata, error) {
+	repo.store.mutex.RLock()
+	defer repo.store.mutex.RUnlock()
+
+	messageMetadata, ok := repo.store.messageMetadata[messageUUID]
+
+	if !ok || messageMetadata.ProjectUUID != projectUUID {
+		return MessageMetadata{}, pgx.ErrNoRows
+	}
+
+	return messageMetadata, nil
+}
+
+// GetMessageMetadataForUUIDs returns the metadata of the messages keyed by message UUID.
+func (repo *memoryMetadataRepo) GetMessageMetadataForUUIDs(messageUUIDs []string, projectUUID string) (map[string]MessageMetadata, error) {
+	repo.store.mutex.RLock()
+	defer repo.store.mutex.RUnlock()
+
+	messageMetadata := make(map[string]MessageMetadata, len(messageUUIDs))
+
+	for _, messageUUID := range messageUUIDs {
+		if metadata, ok := repo.store.messageMetadata[messageUUID]; ok && metadata.ProjectUUID == projectUUID {
+			messageMetadata[messageUUID] = metadata
+		}
+	}
+
+	return messageMetadata, nil
+}
+
+// GetBookmarkedMessageUUIDs returns the UUIDs of the bookmarked messages of the project.
+func (repo *memoryMetadataRepo) GetBookmarkedMessageUUIDs(projectUUID string) ([]string, error) {
+	repo.store.mutex.RLock()
+	defer repo.store.mutex.RUnlock()
+
+	var messageUUIDs []string
+
+	for _, messageMetadata := range repo.store.messageMetadata {
+		if messageMetadata.ProjectUUID == projectUUID && messageMetadata.IsBookmarked {
+			messageUUIDs = append(messageUUIDs, messageMetadata.MessageUUID)
+		}
+	}
+
+	sort.Strings(messageUUIDs)
+
+	return messageUUIDs, nil
+}
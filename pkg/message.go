@@ -4,13 +4,17 @@
 package core
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/aquasecurity/esquery"
 	"github.com/jackc/pgx/v4"
 	"io"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // Message represents a message.
@@ -23,20 +27,108 @@ type Message struct {
 	To           string       `json:"to"`
 	CC           string       `json:"cc"`
 	Received     int          `json:"received"`
-	Size         string       `json:"size"`
+	Size         MessageSize  `json:"size"` // The size of the raw message in bytes.
 	Body         string       `json:"body"`
 	Headers      string       `json:"headers"`
 	Attachments  []Attachment `json:"attachments"`
 	IsBookmarked bool         `json:"is_bookmarked,omitempty"`
 	Tag          string       `json:"tag,omitempty"`
-	Comment      string       `json:"comment,omitempty"`
+	Tags         []Tag        `json:"tags,omitempty"`
+	Comments     []Comment    `json:"comments,omitempty"`
+	ReviewStatus string       `json:"review_status,omitempty"`
+	Reviewer     string       `json:"reviewer,omitempty"`
 	FolderUUID   string       `json:"folder_uuid"`
 	EvidenceUUID string       `json:"evidence_uuid"`
+	MessageClass string       `json:"message_class,omitempty"` // For example IPM.Note or IPM.Appointment.
+	Importance   string       `json:"importance,omitempty"`
+	Sensitivity  string       `json:"sensitivity,omitempty"`
+	IsRead       *bool        `json:"is_read,omitempty"`     // Nil if the evidence has no read status (EML).
+	Direction    string       `json:"direction,omitempty"`   // Relative to the custodian domains, see SetCustodianDomains.
+	BodyObject   string       `json:"body_object,omitempty"` // MinIO object of the offloaded body, see GetMessageBody.
+	// OriginalObject is the MinIO object of the original message and OriginalHash its SHA-256 hash, see GetOriginalMessage.
+	OriginalObject string `json:"original_object,omitempty"`
+	OriginalHash   string `json:"original_hash,omitempty"`
+	// Addresses extracted from the headers (lowercase) so they can be aggregated on.
+	FromAddresses      []string `json:"from_addresses,omitempty"`
+	RecipientAddresses []string `json:"recipient_addresses,omitempty"`
+	Domains            []string `json:"domains,omitempty"`
+	// AttachmentsSize is the total size of the attachments in bytes.
+	AttachmentsSize MessageSize `json:"attachments_size"`
+	// ThreadID identifies the conversation of the message, see GetConversations.
+	ThreadID string `json:"thread_id,omitempty"`
+	// Appointment is set if the message is an appointment, see GetAppointments.
+	Appointment *Appointment `json:"appointment,omitempty"`
+	// Provenance is nil for messages indexed before the provenance was stored.
+	Provenance *Provenance `json:"provenance,omitempty"`
+	// ReadReceiptRequested and DeliveryReceiptRequested are set if the sender requested a receipt.
+	ReadReceiptRequested     bool `json:"read_receipt_requested,omitempty"`
+	DeliveryReceiptRequested bool `json:"delivery_receipt_requested,omitempty"`
+	// Receipt is set if the message itself is a receipt, for example MessageReceiptRead.
+	Receipt string `json:"receipt,omitempty"`
+	// MailboxDirection is whether the custodian sent, received or drafted the message, see getMailboxDirection.
+	MailboxDirection string `json:"mailbox_direction,omitempty"`
+	// Sentiment is nil if the sentiment isn't scored, see ScoreProjectSentiment.
+	Sentiment *MessageSentiment `json:"sentiment,omitempty"`
+	// TopicCluster is the ID and TopicLabel the label of the topic cluster of the message, see ClusterMessages.
+	TopicCluster string `json:"topic_cluster,omitempty"`
+	TopicLabel   string `json:"topic_label,omitempty"`
+	// RelevanceScore is the predicted probability (0 to 1) that the message is relevant, see TrainRelevanceModel.
+	RelevanceScore *float64 `json:"relevance_score,omitempty"`
+	// BulkScore is the likelihood (0 to 100) that the message is bulk or automated mail, IsBulk is set from the BulkMailThreshold.
+	BulkScore int  `json:"bulk_score"`
+	IsBulk    bool `json:"is_bulk,omitempty"`
+	// Phishing is nil if the phishing indicators aren't scored, see ScoreProjectPhishing.
+	Phishing *MessagePhishing `json:"phishing,omitempty"`
+	// IsSuppressed is set if the hash of the original message is in a hash list of the project, see ImportHashList.
+	IsSuppressed bool `json:"is_suppressed,omitempty"`
+	// SentDate is the date of the Date header and DeliveredDate the date of the topmost Received header (the delivery),
+	// the offsets are their original UTC offsets in minutes (nil if unknown). See DateAnomalies.
+	SentDate        int  `json:"sent_date,omitempty"`
+	SentOffset      *int `json:"sent_offset,omitempty"`
+	DeliveredDate   int  `json:"delivered_date,omitempty"`
+	DeliveredOffset *int `json:"delivered_offset,omitempty"`
+	// DateDiscrepancy is the delivered minus the sent date in seconds, DateAnomalies are the timestamp manipulation indicators (e.g. DateAnomalySentAfterDelivery).
+	DateDiscrepancy int      `json:"date_discrepancy,omitempty"`
+	DateAnomalies   []string `json:"date_anomalies,omitempty"`
+	// PrivilegeDesignation withholds the message from the exports, see SetPrivilegeDesignation.
+	PrivilegeDesignation string `json:"privilege_designation,omitempty"`
+}
+
+// MessageSize represents a size in bytes.
+// Messages indexed before sizes were computed have the "NULL" size which is decoded as zero.
+type MessageSize int64
+
+// UnmarshalJSON decodes the size from a JSON number or string.
+func (size *MessageSize) UnmarshalJSON(data []byte) error {
+	var value interface{}
+
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	switch value := value.(type) {
+	case float64:
+		*size = MessageSize(value)
+	case string:
+		parsedSize, err := strconv.ParseInt(value, 10, 64)
+
+		if err != nil {
+			*size = 0
+			return nil
+		}
+
+		*size = MessageSize(parsedSize)
+	default:
+		*size = 0
+	}
+
+	return nil
 }
 
 // JSON returns the JSON representation of this message.
 func (message *Message) JSON() string {
 	initializeEmptyMessageValues(message)
+	initializeAddressValues(message)
 
 	var outputString strings.Builder
 
@@ -69,9 +161,6 @@ func initializeEmptyMessageValues(message *Message) {
 	if strings.TrimSpace(message.CC) == "" {
 		message.CC = messageNullValue
 	}
-	if strings.TrimSpace(message.Size) == "" {
-		message.Size = messageNullValue
-	}
 	if strings.TrimSpace(message.Body) == "" {
 		message.Body = messageNullValue
 	}
@@ -80,27 +169,255 @@ func initializeEmptyMessageValues(message *Message) {
 	}
 }
 
+// initializeAddressValues extracts the addresses and domains from the From, To and CC headers.
+func initializeAddressValues(message *Message) {
+	message.FromAddresses = normalizeAddresses(getAddressesFromHeader(message.From))
+	message.RecipientAddresses = normalizeAddresses(append(getAddressesFromHeader(message.To), getAddressesFromHeader(message.CC)...))
+	message.Domains = nil
+
+	for _, address := range append(message.FromAddresses, message.RecipientAddresses...) {
+		domain := getAddressDomain(address)
+
+		if domain == "" {
+			continue
+		}
+
+		hasDomain := false
+
+		for _, existingDomain := range message.Domains {
+			if existingDomain == domain {
+				hasDomain = true
+				break
+			}
+		}
+
+		if !hasDomain {
+			message.Domains = append(message.Domains, domain)
+		}
+	}
+}
+
+// isHTMLBody returns true if the message body is HTML.
+// PST messages prefer the HTML body.
+func isHTMLBody(body string) bool {
+	lowerBody := strings.ToLower(body)
+
+	return strings.Contains(lowerBody, "<html") || strings.Contains(lowerBody, "<body")
+}
+
+// normalizeAddresses returns the trimmed, lowercase addresses.
+func normalizeAddresses(addresses []string) []string {
+	var normalizedAddresses []string
+
+	for _, address := range addresses {
+		address = strings.ToLower(strings.TrimSpace(address))
+
+		if address != "" {
+			normalizedAddresses = append(normalizedAddresses, address)
+		}
+	}
+
+	return normalizedAddresses
+}
+
+// getAddressDomain returns the domain of the address or an empty string if the address has no domain.
+func getAddressDomain(address string) string {
+	atIndex := strings.LastIndex(address, "@")
+
+	if atIndex == -1 || atIndex == len(address)-1 {
+		return ""
+	}
+
+	return strings.ToLower(address[atIndex+1:])
+}
+
 // AllMessageFields defines the message fields.
 var (
 	AllMessageFields = []string{"subject", "from", "to", "cc", "body", "headers", "attachments.name"}
 )
 
-// GetMessagesFromQuery returns all messages from the specified search query.
-func GetMessagesFromQuery(query string, projectUUID string, database *pgx.Conn) ([]Message, error) {
-	var shouldMatch []esquery.Mappable
+// GetMessagesFromQuery returns all messages from the specified search query, excluding bulk mail.
+// Use GetMessagesFromFilteredQuery with SearchFilters.IncludeBulk to include bulk mail.
+func GetMessagesFromQuery(query string, projectUUID string, userUUID string, database *pgx.Conn) ([]Message, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return nil, err
+	}
 
-	for _, field := range AllMessageFields {
-		shouldMatch = append(shouldMatch, esquery.Match(field, query))
+	response, err := esquery.Search().
+		Query(SearchFilters{}.apply(newSearchQuery(query, projectUUID))).
+		Size(10000).
+		Run(
+			Elasticsearch,
+			Elasticsearch.Search.WithContext(context.Background()),
+			Elasticsearch.Search.WithIndex("messages"),
+		)
+
+	if err != nil {
+		return nil, err
+	}
+
+	messages, err := getMessagesFromSearchResult(response.Body, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	addSearchHistory(query, nil, len(messages), projectUUID, userUUID, database)
+
+	return messages, nil
+}
+
+// ProjectMessages represents the messages of a project matching a search across projects.
+type ProjectMessages struct {
+	Project  Project   `json:"project"`
+	Messages []Message `json:"messages"`
+}
+
+// ProjectMessagesPage represents a page of the messages matching a search across projects.
+type ProjectMessagesPage struct {
+	Projects []ProjectMessages `json:"projects"` // The messages of the page grouped by project, projects without messages on the page are omitted.
+	Total    int               `json:"total"`    // The amount of messages on all pages.
+	PageSize int               `json:"page_size"`
+	// Cursor is passed to GetMessagesFromQueryAcrossProjects to get the next page, empty on the last page.
+	Cursor string `json:"cursor"`
+}
+
+// GetMessagesFromQueryAcrossProjects returns the page of messages matching the search query in all projects the user is allowed to view,
+// newest first. Used to find recurring custodians across cases.
+// Use an empty cursor for the first page, the search is recorded in the search history of every project searched when the first page is requested.
+func GetMessagesFromQueryAcrossProjects(query string, cursor string, pageSize int, userUUID string, database *pgx.Conn) (ProjectMessagesPage, error) {
+	if err := checkMessageListPageSize(pageSize); err != nil {
+		return ProjectMessagesPage{}, err
+	}
+
+	var searchAfter []interface{}
+
+	if cursor != "" {
+		var err error
+
+		if searchAfter, err = decodeMessageListCursor(cursor); err != nil {
+			return ProjectMessagesPage{}, err
+		}
+	}
+
+	projectUUIDs, err := getProjectUUIDsWithPermission(userUUID, ActionView, database)
+
+	if err != nil {
+		return ProjectMessagesPage{}, err
+	}
+
+	if len(projectUUIDs) == 0 {
+		return ProjectMessagesPage{Projects: []ProjectMessages{}, PageSize: pageSize}, nil
+	}
+
+	projectUUIDValues := make([]interface{}, 0, len(projectUUIDs))
+
+	for _, projectUUID := range projectUUIDs {
+		projectUUIDValues = append(projectUUIDValues, projectUUID)
+	}
+
+	searchQuery := addSearchQueryMatch(esquery.Bool().Filter(esquery.Terms("project_uuid", projectUUIDValues...)), query)
+
+	messageList, err := listMessages(searchQuery, 0, searchAfter, pageSize, "", database)
+
+	if err != nil {
+		return ProjectMessagesPage{}, err
+	}
+
+	if cursor == "" {
+		messageCounts, err := countMessagesByProject(searchQuery, len(projectUUIDs))
+
+		if err != nil {
+			return ProjectMessagesPage{}, err
+		}
+
+		for _, projectUUID := range projectUUIDs {
+			addSearchHistory(query, nil, messageCounts[projectUUID], projectUUID, userUUID, database)
+		}
+	}
+
+	messagesByProject := make(map[string][]Message)
+
+	for _, message := range messageList.Messages {
+		messagesByProject[message.ProjectUUID] = append(messagesByProject[message.ProjectUUID], message)
+	}
+
+	projectMessagesPage := ProjectMessagesPage{
+		Projects: make([]ProjectMessages, 0, len(messagesByProject)),
+		Total:    messageList.Total,
+		PageSize: pageSize,
+		Cursor:   messageList.Cursor,
+	}
+
+	for _, projectUUID := range projectUUIDs {
+		if len(messagesByProject[projectUUID]) == 0 {
+			continue
+		}
+
+		project, err := GetProjectByUUID(projectUUID, database)
+
+		if err != nil {
+			return ProjectMessagesPage{}, err
+		}
+
+		projectMessagesPage.Projects = append(projectMessagesPage.Projects, ProjectMessages{
+			Project:  project,
+			Messages: messagesByProject[projectUUID],
+		})
+	}
+
+	return projectMessagesPage, nil
+}
+
+// SearchFilters represents the optional filters of a search query.
+// Messages flagged as bulk mail (see JobTypeFlagBulkMail) are excluded by default, even by the zero value.
+// Before bulk mail was flagged every message matched, set IncludeBulk to search all messages like before.
+type SearchFilters struct {
+	IsBookmarked bool     `json:"is_bookmarked"`
+	TagUUIDs     []string `json:"tag_uuids"`
+	ReviewStatus string   `json:"review_status"`
+	MessageClass string   `json:"message_class,omitempty"`
+	Importance   string   `json:"importance,omitempty"`
+	Sensitivity  string   `json:"sensitivity,omitempty"`
+	IsRead       *bool    `json:"is_read,omitempty"`
+	Direction    string   `json:"direction,omitempty"`
+	MinSize      int64    `json:"min_size,omitempty"` // In bytes, zero for no limit.
+	MaxSize      int64    `json:"max_size,omitempty"` // In bytes, zero for no limit.
+	// ReceiptRequested matches the messages with a requested read or delivery receipt.
+	ReceiptRequested bool   `json:"receipt_requested,omitempty"`
+	Receipt          string `json:"receipt,omitempty"`
+	MailboxDirection string `json:"mailbox_direction,omitempty"`
+	// Tone matches the messages with the sentiment tone, e.g. SentimentToneHostile.
+	Tone string `json:"tone,omitempty"`
+	// TopicCluster matches the messages of the topic cluster by its ID, see GetTopicClusters.
+	TopicCluster string `json:"topic_cluster,omitempty"`
+	// MinRelevanceScore matches the messages predicted relevant with at least the probability (0 to 1), zero for no limit.
+	MinRelevanceScore float64 `json:"min_relevance_score,omitempty"`
+	// IncludeBulk includes the messages flagged as bulk mail, which are excluded by default (see Message.IsBulk).
+	IncludeBulk bool `json:"include_bulk,omitempty"`
+	// SuppressKnownDocuments excludes the messages and attachments in the hash lists of the project, see ImportHashList.
+	SuppressKnownDocuments bool `json:"suppress_known_documents,omitempty"`
+	// DateAnomaly matches the messages with the date anomaly (e.g. DateAnomalySentAfterDelivery), "any" matches all anomalies.
+	DateAnomaly string `json:"date_anomaly,omitempty"`
+	// BinderUUID matches the messages in the binder, see AddMessagesToBinder.
+	BinderUUID string `json:"binder_uuid,omitempty"`
+}
+
+// isEmpty returns true if no filter is set.
+func (filters SearchFilters) isEmpty() bool {
+	return !filters.IsBookmarked && len(filters.TagUUIDs) == 0 && filters.ReviewStatus == "" && filters.MessageClass == "" && filters.Importance == "" && filters.Sensitivity == "" && filters.IsRead == nil && filters.Direction == "" && filters.MinSize == 0 && filters.MaxSize == 0 && !filters.ReceiptRequested && filters.Receipt == "" && filters.MailboxDirection == "" && filters.Tone == "" && filters.TopicCluster == "" && filters.MinRelevanceScore == 0 && !filters.SuppressKnownDocuments && filters.DateAnomaly == "" && filters.BinderUUID == ""
+}
+
+// GetMessagesFromFilteredQuery returns all messages from the specified search query matching the filters.
+// Use an empty query to return all messages matching the filters. Bulk mail is excluded unless SearchFilters.IncludeBulk is set.
+// Suppressed attachments are removed from the messages if known documents are suppressed, see SearchFilters.SuppressKnownDocuments.
+func GetMessagesFromFilteredQuery(query string, filters SearchFilters, projectUUID string, userUUID string, database *pgx.Conn) ([]Message, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return nil, err
 	}
 
 	response, err := esquery.Search().
-		Query(
-			esquery.
-				Bool().
-				Must(esquery.Term("project_uuid", projectUUID)).
-				MinimumShouldMatch(1).
-				Should(shouldMatch...),
-		).
+		Query(filters.apply(newSearchQuery(query, projectUUID))).
 		Size(10000).
 		Run(
 			Elasticsearch,
@@ -112,15 +429,182 @@ func GetMessagesFromQuery(query string, projectUUID string, database *pgx.Conn)
 		return nil, err
 	}
 
-	return getMessagesFromSearchResult(response.Body, database)
+	messages, err := getMessagesFromSearchResult(response.Body, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if filters.SuppressKnownDocuments {
+		removeSuppressedAttachments(messages)
+	}
+
+	addSearchHistory(query, &filters, len(messages), projectUUID, userUUID, database)
+
+	return messages, nil
+}
+
+// apply adds the filters to the query.
+func (filters SearchFilters) apply(query *esquery.BoolQuery) *esquery.BoolQuery {
+	if filters.IsBookmarked {
+		query = query.Filter(esquery.Term("is_bookmarked", true))
+	}
+
+	for _, tagUUID := range filters.TagUUIDs {
+		query = query.Filter(esquery.Term("tag_uuids", tagUUID))
+	}
+
+	if filters.ReviewStatus != "" {
+		query = query.Filter(newReviewStatusQuery(filters.ReviewStatus))
+	}
+
+	if filters.MessageClass != "" {
+		query = query.Filter(esquery.Term("message_class", filters.MessageClass))
+	}
+
+	if filters.Importance != "" {
+		query = query.Filter(esquery.Term("importance", filters.Importance))
+	}
+
+	if filters.Sensitivity != "" {
+		query = query.Filter(esquery.Term("sensitivity", filters.Sensitivity))
+	}
+
+	if filters.IsRead != nil {
+		query = query.Filter(esquery.Term("is_read", *filters.IsRead))
+	}
+
+	if filters.Direction != "" {
+		query = query.Filter(esquery.Term("direction", filters.Direction))
+	}
+
+	if filters.MinSize > 0 || filters.MaxSize > 0 {
+		sizeRange := esquery.Range("size")
+
+		if filters.MinSize > 0 {
+			sizeRange = sizeRange.Gte(filters.MinSize)
+		}
+
+		if filters.MaxSize > 0 {
+			sizeRange = sizeRange.Lte(filters.MaxSize)
+		}
+
+		query = query.Filter(sizeRange)
+	}
+
+	if filters.ReceiptRequested {
+		query = query.Filter(esquery.Bool().MinimumShouldMatch(1).Should(esquery.Term("read_receipt_requested", true), esquery.Term("delivery_receipt_requested", true)))
+	}
+
+	if filters.Receipt != "" {
+		query = query.Filter(esquery.Term("receipt", filters.Receipt))
+	}
+
+	if filters.MailboxDirection != "" {
+		query = query.Filter(esquery.Term("mailbox_direction", filters.MailboxDirection))
+	}
+
+	if filters.Tone != "" {
+		query = query.Filter(esquery.Term("sentiment.tone", filters.Tone))
+	}
+
+	if filters.TopicCluster != "" {
+		query = query.Filter(esquery.Term("topic_cluster", filters.TopicCluster))
+	}
+
+	if filters.MinRelevanceScore > 0 {
+		query = query.Filter(esquery.Range("relevance_score").Gte(filters.MinRelevanceScore))
+	}
+
+	if !filters.IncludeBulk {
+		query = query.MustNot(esquery.Term("is_bulk", true))
+	}
+
+	if filters.SuppressKnownDocuments {
+		query = query.MustNot(esquery.Term("is_suppressed", true))
+	}
+
+	if filters.DateAnomaly == DateAnomalyAny {
+		query = query.Filter(esquery.Exists("date_anomalies"))
+	} else if filters.DateAnomaly != "" {
+		query = query.Filter(esquery.Term("date_anomalies", filters.DateAnomaly))
+	}
+
+	if filters.BinderUUID != "" {
+		query = query.Filter(esquery.Term("binder_uuids", filters.BinderUUID))
+	}
+
+	return query
+}
+
+// newSearchQuery returns the Elasticsearch query matching the search query on all message fields.
+// An empty search query matches all messages of the project.
+func newSearchQuery(query string, projectUUID string) *esquery.BoolQuery {
+	searchQuery := esquery.
+		Bool().
+		Must(esquery.Term("project_uuid", projectUUID))
+
+	return addSearchQueryMatch(searchQuery, query)
+}
+
+// addSearchQueryMatch adds matching the search query on all message fields to the Elasticsearch query.
+// An empty search query adds nothing.
+func addSearchQueryMatch(searchQuery *esquery.BoolQuery, query string) *esquery.BoolQuery {
+	if query == "" {
+		return searchQuery
+	}
+
+	var shouldMatch []esquery.Mappable
+
+	for _, field := range AllMessageFields {
+		shouldMatch = append(shouldMatch, esquery.Match(field, query))
+	}
+
+	return searchQuery.
+		MinimumShouldMatch(1).
+		Should(shouldMatch...)
+}
+
+// GetMessagesFromFolderTree returns the messages in the folder and all its descendant folders.
+// The descendants are resolved with a single query and the messages with a single terms filter.
+func GetMessagesFromFolderTree(folderUUID string, projectUUID string, userUUID string, database *pgx.Conn) ([]Message, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return nil, err
+	}
+
+	folderUUIDs, err := getFolderTreeUUIDs([]string{folderUUID}, projectUUID, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	query := esquery.Bool().Filter(esquery.Term("project_uuid", projectUUID), esquery.Terms("folder_uuid", folderUUIDs...))
+
+	var messages []Message
+
+	err = forEachMessageBatch(query, func(batch []Message) error {
+		messages = append(messages, batch...)
+
+		return nil
+	}, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return messages, nil
 }
 
 // GetMessagesFromFolders returns the messages in the specified folders.
-func GetMessagesFromFolders(folderUUIDs []string, projectUUID string, database *pgx.Conn) ([]Message, error) {
-	var shouldTerms []esquery.Mappable
+func GetMessagesFromFolders(folderUUIDs []string, projectUUID string, userUUID string, database *pgx.Conn) ([]Message, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return nil, err
+	}
+
+	var folderTerms []interface{}
 
 	for _, folderUUID := range folderUUIDs {
-		shouldTerms = append(shouldTerms, esquery.Term("folder_uuid", folderUUID))
+		folderTerms = append(folderTerms, folderUUID)
 	}
 
 	response, err := esquery.Search().
@@ -128,8 +612,7 @@ func GetMessagesFromFolders(folderUUIDs []string, projectUUID string, database *
 			esquery.
 				Bool().
 				Must(esquery.Term("project_uuid", projectUUID)).
-				MinimumShouldMatch(1).
-				Should(shouldTerms...),
+				Filter(esquery.Terms("folder_uuid", folderTerms...)),
 		).
 		Size(10000).
 		Run(
@@ -146,7 +629,16 @@ func GetMessagesFromFolders(folderUUIDs []string, projectUUID string, database *
 }
 
 // GetMessageByUUID returns the message with the specified UUID.
-func GetMessageByUUID(messageUUID string, projectUUID string, database *pgx.Conn) (Message, error) {
+func GetMessageByUUID(messageUUID string, projectUUID string, userUUID string, database *pgx.Conn) (Message, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return Message{}, err
+	}
+
+	return getMessageByUUID(messageUUID, projectUUID, database)
+}
+
+// getMessageByUUID returns the message with the specified UUID without checking permissions.
+func getMessageByUUID(messageUUID string, projectUUID string, database *pgx.Conn) (Message, error) {
 	response, err := esquery.Search().
 		Query(
 			esquery.
@@ -179,29 +671,133 @@ func GetMessageByUUID(messageUUID string, projectUUID string, database *pgx.Conn
 }
 
 // GetAllMessages returns a list of all messages from the specified project.
-func GetAllMessages(projectUUID string, database *pgx.Conn) ([]Message, error) {
+// All messages are loaded into memory, use ForEachMessage to process large projects.
+func GetAllMessages(projectUUID string, userUUID string, database *pgx.Conn) ([]Message, error) {
+	var messages []Message
+
+	err := ForEachMessage(projectUUID, userUUID, func(message Message) error {
+		messages = append(messages, message)
+
+		return nil
+	}, database)
+
+	return messages, err
+}
+
+// ForEachMessage calls the function for each message of the specified project.
+// Messages are fetched in batches using the Elasticsearch scroll API so memory usage stays bounded.
+// Iteration stops at the first error returned by the function.
+func ForEachMessage(projectUUID string, userUUID string, fn func(message Message) error, database *pgx.Conn) error {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return err
+	}
+
+	return forEachMessageBatch(esquery.Bool().Must(esquery.Term("project_uuid", projectUUID)), func(messages []Message) error {
+		for _, message := range messages {
+			if err := fn(message); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}, database)
+}
+
+// messageScrollDuration defines how long Elasticsearch keeps the scroll context between batches.
+const messageScrollDuration = time.Minute
+
+// forEachMessageBatch calls the function with batches of messages matching the query.
+func forEachMessageBatch(query esquery.Mappable, fn func(messages []Message) error, database *pgx.Conn) error {
 	response, err := esquery.Search().
-		Query(
-			esquery.
-				Bool().
-				Must(esquery.Term("project_uuid", projectUUID)),
-		).
-		Size(10000).
+		Query(query).
+		Size(messageBatchSize).
 		Run(
 			Elasticsearch,
 			Elasticsearch.Search.WithContext(context.Background()),
 			Elasticsearch.Search.WithIndex("messages"),
+			Elasticsearch.Search.WithScroll(messageScrollDuration),
+			Elasticsearch.Search.WithSort("_doc"),
 		)
 
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return getMessagesFromSearchResult(response.Body, database)
+	var scrollID string
+
+	defer func() {
+		if scrollID == "" {
+			return
+		}
+
+		clearResponse, err := Elasticsearch.ClearScroll(Elasticsearch.ClearScroll.WithScrollID(scrollID))
+
+		if err != nil {
+			Logger.Errorf("Failed to clear Elasticsearch scroll: %s", err)
+			return
+		}
+
+		if err := clearResponse.Body.Close(); err != nil {
+			Logger.Errorf("Failed to close Elasticsearch response: %s", err)
+		}
+	}()
+
+	for {
+		if response.IsError() {
+			errorMessage := response.String()
+
+			if err := response.Body.Close(); err != nil {
+				Logger.Errorf("Failed to close Elasticsearch response: %s", err)
+			}
+
+			return fmt.Errorf("failed to scroll messages: %s", errorMessage)
+		}
+
+		messages, nextScrollID, err := decodeMessageSearchResponse(response.Body)
+
+		if err != nil {
+			return err
+		}
+
+		if nextScrollID != "" {
+			scrollID = nextScrollID
+		}
+
+		if len(messages) == 0 {
+			return nil
+		}
+
+		hydrateMessages(messages, database)
+
+		if err := fn(messages); err != nil {
+			return err
+		}
+
+		response, err = Elasticsearch.Scroll(
+			Elasticsearch.Scroll.WithContext(context.Background()),
+			Elasticsearch.Scroll.WithScrollID(scrollID),
+			Elasticsearch.Scroll.WithScroll(messageScrollDuration),
+		)
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// countMessages returns the amount of messages matching the query.
+func countMessages(query esquery.Mappable) (int, error) {
+	_, total, err := runAggregationSearch(query)
+
+	return total, err
 }
 
 // GetMessagesFromField returns all messages from the specified query and field.
-func GetMessagesFromField(query string, field string, projectUUID string, database *pgx.Conn) ([]Message, error) {
+func GetMessagesFromField(query string, field string, projectUUID string, userUUID string, database *pgx.Conn) ([]Message, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return nil, err
+	}
+
 	response, err := esquery.Search().
 		Query(
 			esquery.
@@ -223,14 +819,314 @@ func GetMessagesFromField(query string, field string, projectUUID string, databa
 	return getMessagesFromSearchResult(response.Body, database)
 }
 
+// GetMessagesByUUIDs returns the messages with the specified UUIDs in the same order.
+// Messages not in the project are skipped.
+func GetMessagesByUUIDs(messageUUIDs []string, projectUUID string, userUUID string, database *pgx.Conn) ([]Message, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return nil, err
+	}
+
+	return getMessagesByUUIDs(messageUUIDs, projectUUID, database)
+}
+
+// getMessagesByUUIDs returns the messages with the specified UUIDs in the same order without checking permissions.
+// Uses a terms query per messageBatchSize UUIDs instead of a search per message.
+func getMessagesByUUIDs(messageUUIDs []string, projectUUID string, database *pgx.Conn) ([]Message, error) {
+	messagesByUUID := make(map[string]Message, len(messageUUIDs))
+
+	err := forEachStringBatch(messageUUIDs, func(batchUUIDs []string) error {
+		response, err := esquery.Search().
+			Query(newMessageUUIDsQuery(batchUUIDs, projectUUID)).
+			Size(uint64(len(batchUUIDs))).
+			Run(
+				Elasticsearch,
+				Elasticsearch.Search.WithContext(context.Background()),
+				Elasticsearch.Search.WithIndex("messages"),
+			)
+
+		if err != nil {
+			return err
+		}
+
+		messages, err := getMessagesFromSearchResult(response.Body, database)
+
+		if err != nil {
+			return err
+		}
+
+		for _, message := range messages {
+			messagesByUUID[message.UUID] = message
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]Message, 0, len(messagesByUUID))
+
+	for _, messageUUID := range messageUUIDs {
+		message, ok := messagesByUUID[messageUUID]
+
+		if !ok {
+			continue
+		}
+
+		messages = append(messages, message)
+		// Duplicate UUIDs return the message once.
+		delete(messagesByUUID, messageUUID)
+	}
+
+	return messages, nil
+}
+
+// messageBatchSize defines the amount of messages fetched per Elasticsearch request.
+const messageBatchSize = 1000
+
+// forEachStringBatch calls the function with batches of at most messageBatchSize values.
+func forEachStringBatch(values []string, fn func(batch []string) error) error {
+	for start := 0; start < len(values); start += messageBatchSize {
+		end := start + messageBatchSize
+
+		if end > len(values) {
+			end = len(values)
+		}
+
+		if err := fn(values[start:end]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// forEachMessageUUIDBatch calls the function with batches of message UUIDs matching the query.
+// Uses search_after so it is not limited to the first 10,000 hits.
+func forEachMessageUUIDBatch(query esquery.Mappable, fn func(messageUUIDs []string) error) error {
+	var searchAfter []interface{}
+
+	for {
+		searchRequest := esquery.Search().
+			Query(query).
+			SourceIncludes("uuid").
+			Sort("uuid", esquery.OrderAsc).
+			Size(messageBatchSize)
+
+		if searchAfter != nil {
+			searchRequest = searchRequest.SearchAfter(searchAfter...)
+		}
+
+		response, err := searchRequest.Run(
+			Elasticsearch,
+			Elasticsearch.Search.WithContext(context.Background()),
+			Elasticsearch.Search.WithIndex("messages"),
+		)
+
+		if err != nil {
+			return err
+		}
+
+		if response.IsError() {
+			errorMessage := response.String()
+
+			if err := response.Body.Close(); err != nil {
+				Logger.Errorf("Failed to close Elasticsearch response: %s", err)
+			}
+
+			return fmt.Errorf("failed to search message UUIDs: %s", errorMessage)
+		}
+
+		var searchResponse struct {
+			Hits struct {
+				Hits []struct {
+					Source struct {
+						UUID string `json:"uuid"`
+					} `json:"_source"`
+					Sort []interface{} `json:"sort"`
+				} `json:"hits"`
+			} `json:"hits"`
+		}
+
+		err = json.NewDecoder(response.Body).Decode(&searchResponse)
+
+		if closeErr := response.Body.Close(); closeErr != nil {
+			Logger.Errorf("Failed to close Elasticsearch response: %s", closeErr)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		hits := searchResponse.Hits.Hits
+
+		if len(hits) == 0 {
+			return nil
+		}
+
+		messageUUIDs := make([]string, 0, len(hits))
+
+		for _, hit := range hits {
+			messageUUIDs = append(messageUUIDs, hit.Source.UUID)
+		}
+
+		if err := fn(messageUUIDs); err != nil {
+			return err
+		}
+
+		if len(hits) < messageBatchSize {
+			return nil
+		}
+
+		searchAfter = hits[len(hits)-1].Sort
+	}
+}
+
+// updateMessageFields sets the fields on the Elasticsearch documents of the messages.
+// Used to mirror metadata stored in PostgreSQL so it can be used in search filters.
+func updateMessageFields(messageUUIDs []string, projectUUID string, fields map[string]interface{}) error {
+	if len(messageUUIDs) == 0 {
+		return nil
+	}
+
+	return updateMessagesByScript(
+		newMessageUUIDsQuery(messageUUIDs, projectUUID),
+		"for (field in params.fields.entrySet()) { ctx._source[field.getKey()] = field.getValue(); }",
+		map[string]interface{}{
+			"fields": fields,
+		},
+	)
+}
+
+// addMessageFieldValue adds the value to the array field of the messages matching the query.
+func addMessageFieldValue(query esquery.Mappable, field string, value interface{}) error {
+	return updateMessagesByScript(
+		query,
+		"if (ctx._source[params.field] == null) { ctx._source[params.field] = []; } if (!ctx._source[params.field].contains(params.value)) { ctx._source[params.field].add(params.value); }",
+		map[string]interface{}{
+			"field": field,
+			"value": value,
+		},
+	)
+}
+
+// removeMessageFieldValue removes the value from the array field of the messages matching the query.
+func removeMessageFieldValue(query esquery.Mappable, field string, value interface{}) error {
+	return updateMessagesByScript(
+		query,
+		"if (ctx._source[params.field] != null) { ctx._source[params.field].removeIf(value -> value == params.value); }",
+		map[string]interface{}{
+			"field": field,
+			"value": value,
+		},
+	)
+}
+
+// newMessageUUIDsQuery returns the Elasticsearch query matching the messages with the specified UUIDs.
+func newMessageUUIDsQuery(messageUUIDs []string, projectUUID string) *esquery.BoolQuery {
+	var uuidTerms []interface{}
+
+	for _, messageUUID := range messageUUIDs {
+		uuidTerms = append(uuidTerms, messageUUID)
+	}
+
+	return esquery.
+		Bool().
+		Must(esquery.Term("project_uuid", projectUUID)).
+		Must(esquery.Terms("uuid", uuidTerms...))
+}
+
+// updateMessagesByScript runs the painless script on all messages matching the query.
+func updateMessagesByScript(query esquery.Mappable, script string, params map[string]interface{}) error {
+	var requestBody bytes.Buffer
+
+	err := json.NewEncoder(&requestBody).Encode(map[string]interface{}{
+		"query": query.Map(),
+		"script": map[string]interface{}{
+			"lang":   "painless",
+			"source": script,
+			"params": params,
+		},
+	})
+
+	if err != nil {
+		return err
+	}
+
+	response, err := Elasticsearch.UpdateByQuery(
+		[]string{"messages"},
+		Elasticsearch.UpdateByQuery.WithContext(context.Background()),
+		Elasticsearch.UpdateByQuery.WithBody(&requestBody),
+		Elasticsearch.UpdateByQuery.WithConflicts("proceed"),
+		Elasticsearch.UpdateByQuery.WithRefresh(true),
+	)
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := response.Body.Close(); err != nil {
+			Logger.Errorf("Failed to close Elasticsearch response: %s", err)
+		}
+	}()
+
+	if response.IsError() {
+		return fmt.Errorf("failed to update messages: %s", response.String())
+	}
+
+	return nil
+}
+
+// DeleteMessagesByProject deletes all messages of the project from Elasticsearch.
+func DeleteMessagesByProject(projectUUID string) error {
+	logger := Logger.WithFields(LogFields{"project_uuid": projectUUID})
+
+	response, err := esquery.Delete().
+		Index("messages").
+		Query(
+			esquery.
+				Bool().
+				Must(esquery.Term("project_uuid", projectUUID)),
+		).
+		Run(
+			Elasticsearch,
+			Elasticsearch.DeleteByQuery.WithContext(context.Background()),
+		)
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := response.Body.Close(); err != nil {
+			logger.Errorf("Failed to close Elasticsearch response: %s", err)
+		}
+	}()
+
+	if response.IsError() {
+		return fmt.Errorf("failed to delete messages: %s", response.String())
+	}
+
+	return nil
+}
+
 // getMessagesFromSearchResult returns the messages from the search response.
 func getMessagesFromSearchResult(responseBody io.ReadCloser, database *pgx.Conn) ([]Message, error) {
-	var responseMap map[string]interface{}
+	messages, _, err := decodeMessageSearchResponse(responseBody)
 
-	if err := json.NewDecoder(responseBody).Decode(&responseMap); err != nil {
+	if err != nil {
 		return nil, err
 	}
 
+	hydrateMessages(messages, database)
+
+	return messages, nil
+}
+
+// decodeMessageSearchResponse returns the messages and scroll ID (if any) from the Elasticsearch search response.
+func decodeMessageSearchResponse(responseBody io.ReadCloser) ([]Message, string, error) {
 	defer func() {
 		err := responseBody.Close()
 
@@ -239,38 +1135,80 @@ func getMessagesFromSearchResult(responseBody io.ReadCloser, database *pgx.Conn)
 		}
 	}()
 
-	var messages []Message
+	var searchResponse struct {
+		ScrollID string `json:"_scroll_id"`
+		Hits     struct {
+			Hits []struct {
+				Source Message `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+
+	if err := json.NewDecoder(responseBody).Decode(&searchResponse); err != nil {
+		return nil, "", err
+	}
+
+	messages := make([]Message, 0, len(searchResponse.Hits.Hits))
 
-	for _, hit := range responseMap["hits"].(map[string]interface{})["hits"].([]interface{}) {
-		var message Message
+	for _, hit := range searchResponse.Hits.Hits {
+		messages = append(messages, hit.Source)
+	}
+
+	return messages, searchResponse.ScrollID, nil
+}
 
-		hitFields := hit.(map[string]interface{})["_source"].(map[string]interface{})
-		hitBytes, err := json.Marshal(hitFields)
+// hydrateMessages sets the metadata, tags and comments stored in PostgreSQL on the messages.
+// Uses a single query per table and project instead of per message, the messages may be of multiple projects.
+func hydrateMessages(messages []Message, database *pgx.Conn) {
+	messageUUIDsByProject := map[string][]string{}
+
+	for _, message := range messages {
+		messageUUIDsByProject[message.ProjectUUID] = append(messageUUIDsByProject[message.ProjectUUID], message.UUID)
+	}
+
+	messageMetadata := map[string]MessageMetadata{}
+	messageTags := map[string][]Tag{}
+	messageComments := map[string][]Comment{}
+
+	for projectUUID, messageUUIDs := range messageUUIDsByProject {
+		logger := Logger.WithFields(LogFields{"project_uuid": projectUUID})
+
+		projectMetadata, err := GetMessageMetadataForUUIDs(messageUUIDs, projectUUID, database)
 
 		if err != nil {
-			return nil, err
+			logger.Errorf("Failed to get message metadata: %s", err)
 		}
 
-		err = json.Unmarshal(hitBytes, &message)
+		projectTags, err := getMessageTagsForUUIDs(messageUUIDs, projectUUID, database)
 
 		if err != nil {
-			return nil, err
+			logger.Errorf("Failed to get message tags: %s", err)
 		}
 
-		messageMetadata, err := GetMessageMetadata(message.UUID, message.ProjectUUID, database)
+		projectComments, err := getCommentsForUUIDs(messageUUIDs, projectUUID, database)
 
-		if err == nil {
-			message.IsBookmarked = messageMetadata.IsBookmarked
-			message.Tag = messageMetadata.Tag
-			message.Comment = messageMetadata.Comment
-		} else if err == pgx.ErrNoRows {
-			// No message metadata.
-		} else {
-			Logger.Errorf("Failed to get message metadata: %s", err)
+		if err != nil {
+			logger.Errorf("Failed to get message comments: %s", err)
 		}
 
-		messages = append(messages, message)
+		// Message UUIDs are unique across projects.
+		for _, messageUUID := range messageUUIDs {
+			if metadata, ok := projectMetadata[messageUUID]; ok {
+				messageMetadata[messageUUID] = metadata
+			}
+
+			messageTags[messageUUID] = projectTags[messageUUID]
+			messageComments[messageUUID] = projectComments[messageUUID]
+		}
 	}
 
-	return messages, nil
+	for i, message := range messages {
+		if metadata, ok := messageMetadata[message.UUID]; ok {
+			messages[i].IsBookmarked = metadata.IsBookmarked
+			messages[i].Tag = metadata.Tag
+		}
+
+		messages[i].Tags = messageTags[message.UUID]
+		messages[i].Comments = messageComments[message.UUID]
+	}
 }
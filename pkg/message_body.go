@@ -0,0 +1,116 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// BodyOffloadSize defines the body size in bytes above which the body is offloaded to MinIO, zero disables offloading.
+//
+// Deprecated: use Core.Config.BodyOffloadSize.
+var BodyOffloadSize int
+
+// Regular expressions used to extract the text of HTML bodies.
+var (
+	htmlInvisibleElementsRegexp = regexp.MustCompile(`(?is)<(script|style|head)[^>]*>.*?</(script|style|head)>`)
+	htmlBlockElementsRegexp     = regexp.MustCompile(`(?i)<(br|/p|/div|/tr|/li|/h[1-6])[^>]*>`)
+	htmlTagsRegexp              = regexp.MustCompile(`(?s)<[^>]*>`)
+	blankLinesRegexp            = regexp.MustCompile(`\n\s*\n+`)
+)
+
+// getMessageBodyObjectName returns the MinIO object name of the offloaded body.
+func getMessageBodyObjectName(messageUUID string, projectUUID string) string {
+	return fmt.Sprintf("%s/bodies/%s", projectUUID, messageUUID)
+}
+
+// offloadMessageBody stores the body in MinIO if it is larger than BodyOffloadSize and replaces it with its text.
+// Keeps Kafka messages and Elasticsearch documents small, GetMessageBody returns the original body.
+func offloadMessageBody(message *Message) error {
+	if BodyOffloadSize <= 0 || len(message.Body) <= BodyOffloadSize {
+		return nil
+	}
+
+	objectName := getMessageBodyObjectName(message.UUID, message.ProjectUUID)
+	contentType := "text/plain; charset=utf-8"
+
+	if isHTMLBody(message.Body) {
+		contentType = "text/html; charset=utf-8"
+	}
+
+	if err := uploadObject(objectName, []byte(message.Body), contentType); err != nil {
+		return err
+	}
+
+	if isHTMLBody(message.Body) {
+		message.Body = extractHTMLText(message.Body)
+	}
+
+	message.BodyObject = objectName
+
+	return nil
+}
+
+// extractHTMLText returns the text of the HTML body, used to index offloaded bodies.
+func extractHTMLText(body string) string {
+	text := htmlInvisibleElementsRegexp.ReplaceAllString(body, "")
+	text = htmlBlockElementsRegexp.ReplaceAllString(text, "\n")
+	text = htmlTagsRegexp.ReplaceAllString(text, "")
+	text = html.UnescapeString(text)
+	text = blankLinesRegexp.ReplaceAllString(text, "\n\n")
+
+	return strings.TrimSpace(text)
+}
+
+// getMessageText returns the subject and the text of the body of the message, truncated to the maximum amount of characters.
+// Used to analyze messages, e.g. to score their sentiment.
+func getMessageText(message Message, maxLength int) string {
+	body := message.Body
+
+	if isHTMLBody(body) {
+		body = extractHTMLText(body)
+	}
+
+	text := []rune(strings.TrimSpace(fmt.Sprintf("%s\n%s", message.Subject, body)))
+
+	if len(text) > maxLength {
+		text = text[:maxLength]
+	}
+
+	return string(text)
+}
+
+// GetMessageBody returns the original body of the message, fetched from MinIO if it was offloaded.
+func GetMessageBody(messageUUID string, projectUUID string, userUUID string, database *pgx.Conn) (string, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return "", err
+	}
+
+	message, err := getMessageByUUID(messageUUID, projectUUID, database)
+
+	if err != nil {
+		return "", err
+	}
+
+	return getOriginalMessageBody(message)
+}
+
+// getOriginalMessageBody returns the original body of the message, fetched from MinIO if it was offloaded.
+func getOriginalMessageBody(message Message) (string, error) {
+	if message.BodyObject == "" {
+		return message.Body, nil
+	}
+
+	body, err := getObjectBytes(message.BodyObject)
+
+	if err != nil {
+		return "", err
+	}
+
+	return string(body), nil
+}
@@ -0,0 +1,267 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aquasecurity/esquery"
+	"github.com/jackc/pgx/v4"
+	"strings"
+)
+
+// Message list sort fields, prefix the field with "-" to sort descending (e.g. "-received").
+const (
+	MessageSortReceived     = "received"
+	MessageSortFrom         = "from"
+	MessageSortTo           = "to"
+	MessageSortReviewStatus = "review_status"
+	MessageSortReviewer     = "reviewer"
+	MessageSortSize         = "size"      // Use "-size" to list the largest messages first.
+	MessageSortSentiment    = "sentiment" // Lists the most negative messages first, unscored messages last.
+	MessageSortRelevance    = "relevance" // Use "-relevance" to list the most likely relevant messages first.
+	MessageSortPhishing     = "phishing"  // Use "-phishing" to list the most suspicious messages first.
+)
+
+// messageSortFields defines the Elasticsearch fields of the message list sort fields.
+var messageSortFields = map[string]string{
+	MessageSortReceived:     "received",
+	MessageSortFrom:         "from.keyword",
+	MessageSortTo:           "to.keyword",
+	MessageSortReviewStatus: "review_status",
+	MessageSortReviewer:     "reviewer",
+	MessageSortSize:         "size",
+	MessageSortSentiment:    "sentiment.score",
+	MessageSortRelevance:    "relevance_score",
+	MessageSortPhishing:     "phishing.score",
+}
+
+// Message list limits.
+const (
+	// MaxMessageListPageSize defines the maximum amount of messages per page.
+	MaxMessageListPageSize = messageBatchSize
+	// maxMessageListWindow defines the Elasticsearch max_result_window, deeper pages must use ListMessagesAfter.
+	maxMessageListWindow = 10000
+)
+
+// ErrMessageListTooDeep is returned by ListMessages if the page is beyond the Elasticsearch result window.
+var ErrMessageListTooDeep = errors.New("page is too deep, use the cursor of the previous page")
+
+// MessageList represents a page of messages.
+type MessageList struct {
+	Messages []Message `json:"messages"`
+	Total    int       `json:"total"` // The amount of messages on all pages.
+	Page     int       `json:"page"`  // Zero if the page was requested with a cursor.
+	PageSize int       `json:"page_size"`
+	// Cursor is passed to ListMessagesAfter to get the next page, empty on the last page.
+	Cursor string `json:"cursor"`
+}
+
+// ListMessages returns the page (starting at 1) of messages in the folder sorted by the sort field.
+// An empty folder UUID lists all messages of the project, an empty sort field sorts by received date descending.
+// Returns ErrMessageListTooDeep for pages beyond the first 10,000 messages, use ListMessagesAfter instead.
+func ListMessages(projectUUID string, folderUUID string, page int, pageSize int, sort string, userUUID string, database *pgx.Conn) (MessageList, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return MessageList{}, err
+	}
+
+	if page < 1 {
+		return MessageList{}, fmt.Errorf("invalid page: %d", page)
+	}
+
+	if err := checkMessageListPageSize(pageSize); err != nil {
+		return MessageList{}, err
+	}
+
+	from := (page - 1) * pageSize
+
+	if from+pageSize > maxMessageListWindow {
+		return MessageList{}, ErrMessageListTooDeep
+	}
+
+	messageList, err := listMessages(newMessageListQuery(projectUUID, folderUUID), from, nil, pageSize, sort, database)
+
+	if err != nil {
+		return MessageList{}, err
+	}
+
+	messageList.Page = page
+
+	return messageList, nil
+}
+
+// ListMessagesAfter returns the page of messages after the cursor returned by ListMessages or ListMessagesAfter.
+// Uses search_after so paging is not limited to the first 10,000 messages.
+// The folder UUID and sort field must be the same as the previous page.
+func ListMessagesAfter(projectUUID string, folderUUID string, cursor string, pageSize int, sort string, userUUID string, database *pgx.Conn) (MessageList, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return MessageList{}, err
+	}
+
+	if err := checkMessageListPageSize(pageSize); err != nil {
+		return MessageList{}, err
+	}
+
+	searchAfter, err := decodeMessageListCursor(cursor)
+
+	if err != nil {
+		return MessageList{}, err
+	}
+
+	return listMessages(newMessageListQuery(projectUUID, folderUUID), 0, searchAfter, pageSize, sort, database)
+}
+
+// checkMessageListPageSize returns an error if the page size is out of range.
+func checkMessageListPageSize(pageSize int) error {
+	if pageSize < 1 || pageSize > MaxMessageListPageSize {
+		return fmt.Errorf("invalid page size: %d (maximum %d)", pageSize, MaxMessageListPageSize)
+	}
+
+	return nil
+}
+
+// newMessageListQuery returns the Elasticsearch query matching the messages in the folder.
+func newMessageListQuery(projectUUID string, folderUUID string) *esquery.BoolQuery {
+	query := esquery.Bool().Filter(esquery.Term("project_uuid", projectUUID))
+
+	if folderUUID != "" {
+		query = query.Filter(esquery.Term("folder_uuid", folderUUID))
+	}
+
+	return query
+}
+
+// listMessages returns the page of messages matching the query.
+// The UUID is used as tiebreaker so the sort order (and the cursor) is stable.
+func listMessages(query esquery.Mappable, from int, searchAfter []interface{}, pageSize int, sort string, database *pgx.Conn) (MessageList, error) {
+	if sort == "" {
+		sort = "-" + MessageSortReceived
+	}
+
+	sortOrder := esquery.OrderAsc
+
+	if strings.HasPrefix(sort, "-") {
+		sortOrder = esquery.OrderDesc
+	}
+
+	sortField, ok := messageSortFields[strings.TrimPrefix(sort, "-")]
+
+	if !ok {
+		return MessageList{}, fmt.Errorf("unsupported sort field: %s", sort)
+	}
+
+	searchRequest := esquery.Search().
+		Query(query).
+		Sort(sortField, sortOrder).
+		Sort("uuid", esquery.OrderAsc).
+		From(uint64(from)).
+		Size(uint64(pageSize))
+
+	if searchAfter != nil {
+		searchRequest = searchRequest.SearchAfter(searchAfter...)
+	}
+
+	response, err := searchRequest.Run(
+		Elasticsearch,
+		Elasticsearch.Search.WithContext(context.Background()),
+		Elasticsearch.Search.WithIndex("messages"),
+		Elasticsearch.Search.WithTrackTotalHits(true),
+	)
+
+	if err != nil {
+		return MessageList{}, err
+	}
+
+	defer func() {
+		if err := response.Body.Close(); err != nil {
+			Logger.Errorf("Failed to close Elasticsearch response: %s", err)
+		}
+	}()
+
+	if response.IsError() {
+		return MessageList{}, fmt.Errorf("failed to list messages: %s", response.String())
+	}
+
+	var searchResponse struct {
+		Hits struct {
+			Total struct {
+				Value int `json:"value"`
+			} `json:"total"`
+			Hits []struct {
+				Source Message           `json:"_source"`
+				Sort   []json.RawMessage `json:"sort"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+
+	if err := json.NewDecoder(response.Body).Decode(&searchResponse); err != nil {
+		return MessageList{}, err
+	}
+
+	hits := searchResponse.Hits.Hits
+
+	messageList := MessageList{
+		Messages: make([]Message, 0, len(hits)),
+		Total:    searchResponse.Hits.Total.Value,
+		PageSize: pageSize,
+	}
+
+	for _, hit := range hits {
+		messageList.Messages = append(messageList.Messages, hit.Source)
+	}
+
+	hydrateMessages(messageList.Messages, database)
+
+	if len(hits) == pageSize {
+		cursor, err := encodeMessageListCursor(hits[len(hits)-1].Sort)
+
+		if err != nil {
+			return MessageList{}, err
+		}
+
+		messageList.Cursor = cursor
+	}
+
+	return messageList, nil
+}
+
+// encodeMessageListCursor encodes the sort values of the last message of a page.
+func encodeMessageListCursor(sortValues []json.RawMessage) (string, error) {
+	encodedSortValues, err := json.Marshal(sortValues)
+
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(encodedSortValues), nil
+}
+
+// decodeMessageListCursor decodes the cursor to the search_after values.
+// Numbers are kept as json.Number so large sort values don't lose precision.
+func decodeMessageListCursor(cursor string) ([]interface{}, error) {
+	encodedSortValues, err := base64.RawURLEncoding.DecodeString(cursor)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor: %s", err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(encodedSortValues))
+	decoder.UseNumber()
+
+	var searchAfter []interface{}
+
+	if err := decoder.Decode(&searchAfter); err != nil {
+		return nil, fmt.Errorf("invalid cursor: %s", err)
+	}
+
+	if len(searchAfter) == 0 {
+		return nil, errors.New("invalid cursor: no sort values")
+	}
+
+	return searchAfter, nil
+}
@@ -8,41 +8,112 @@ import (
 	"github.com/jackc/pgx/v4"
 )
 
-// MessageMetadata represents message metadata (isBookmarked, tag, comment).
+// MessageMetadata represents message metadata (isBookmarked, tag).
+// Comments are stored separately, see AddComment.
 type MessageMetadata struct {
 	MessageUUID  string `json:"message_uuid"`
 	ProjectUUID  string `json:"project_uuid"`
 	IsBookmarked bool   `json:"is_bookmarked"`
 	Tag          string `json:"tag"`
-	Comment      string `json:"comment"`
 }
 
-// AddBookmark sets the message metadata isBookmark to true.
-func AddBookmark(messageUUID string, projectUUID string, database *pgx.Conn) error {
+// Save saves the message metadata to the database.
+func (messageMetadata *MessageMetadata) Save(database *pgx.Conn) error {
 	preparedStatement := `
-	INSERT INTO message_metadata(messageUUID, projectUUID, isBookmarked, tag, comment) VALUES ($1, $2, $3, $4, $5) 
-	ON CONFLICT(messageUUID) DO UPDATE SET isBookmarked = $3
+	INSERT INTO message_metadata(messageUUID, projectUUID, isBookmarked, tag) VALUES ($1, $2, $3, $4)
+	ON CONFLICT(messageUUID) DO UPDATE SET isBookmarked = $3, tag = $4 WHERE message_metadata.projectUUID = EXCLUDED.projectUUID
 	`
-	_, err := database.Exec(context.Background(), preparedStatement, messageUUID, projectUUID, true, "", "")
+	_, err := database.Exec(context.Background(), preparedStatement, messageMetadata.MessageUUID, messageMetadata.ProjectUUID, messageMetadata.IsBookmarked, messageMetadata.Tag)
 
 	return err
 }
 
-// RemoveBookmark sets the message metadata isBookmark to false.
-func RemoveBookmark(messageUUID string, projectUUID string, database *pgx.Conn) error {
+// AddBookmark bookmarks the message by adding it to the default binder, see AddMessagesToBinder.
+func AddBookmark(messageUUID string, projectUUID string, userUUID string, database *pgx.Conn) error {
+	if err := CheckPermission(userUUID, projectUUID, ActionReview, database); err != nil {
+		return err
+	}
+
+	defaultBinder, err := getDefaultBinder(projectUUID, database)
+
+	if err != nil {
+		return err
+	}
+
+	return addMessagesToBinder(defaultBinder.UUID, []string{messageUUID}, projectUUID, database)
+}
+
+// RemoveBookmark removes the bookmark of the message by removing it from all binders.
+func RemoveBookmark(messageUUID string, projectUUID string, userUUID string, database *pgx.Conn) error {
+	if err := CheckPermission(userUUID, projectUUID, ActionReview, database); err != nil {
+		return err
+	}
+
+	if err := checkProjectNotOnHold(projectUUID, userUUID, AuditActionRemoveBookmark, database); err != nil {
+		return err
+	}
+
 	preparedStatement := `
-	INSERT INTO message_metadata(messageUUID, projectUUID, isBookmarked, tag, comment) VALUES ($1, $2, $3, $4, $5) 
-	ON CONFLICT(messageUUID) DO UPDATE SET isBookmarked = $3
+	DELETE FROM binder_messages WHERE messageUUID = $1 AND projectUUID = $2
 	`
-	_, err := database.Exec(context.Background(), preparedStatement, messageUUID, projectUUID, false, "", "")
+	if _, err := database.Exec(context.Background(), preparedStatement, messageUUID, projectUUID); err != nil {
+		return err
+	}
 
-	return err
+	if err := updateMessageFields([]string{messageUUID}, projectUUID, map[string]interface{}{"binder_uuids": []string{}}); err != nil {
+		return err
+	}
+
+	return setMessagesBookmarked([]string{messageUUID}, false, projectUUID, database)
 }
 
-// GetBookmarksByProject returns all bookmarks .
-func GetBookmarksByProject(projectUUID string, database *pgx.Conn) ([]Message, error) {
+// BookmarkMessagesByQuery bookmarks all messages matching the search query by adding them to the default binder.
+// Like GetMessagesFromQuery bulk mail is excluded. Returns the amount of bookmarked messages.
+func BookmarkMessagesByQuery(query string, projectUUID string, userUUID string, database *pgx.Conn) (int, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionReview, database); err != nil {
+		return 0, err
+	}
+
+	defaultBinder, err := getDefaultBinder(projectUUID, database)
+
+	if err != nil {
+		return 0, err
+	}
+
+	bookmarkedMessages := 0
+
+	err = forEachMessageUUIDBatch(SearchFilters{}.apply(newSearchQuery(query, projectUUID)), func(messageUUIDs []string) error {
+		if err := addMessagesToBinder(defaultBinder.UUID, messageUUIDs, projectUUID, database); err != nil {
+			return err
+		}
+
+		bookmarkedMessages += len(messageUUIDs)
+
+		return nil
+	})
+
+	return bookmarkedMessages, err
+}
+
+// GetBookmarksByProject returns all bookmarked messages.
+func GetBookmarksByProject(projectUUID string, userUUID string, database *pgx.Conn) ([]Message, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return nil, err
+	}
+
+	messageUUIDs, err := getBookmarkedMessageUUIDs(projectUUID, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return getMessagesByUUIDs(messageUUIDs, projectUUID, database)
+}
+
+// getBookmarkedMessageUUIDs returns the UUIDs of the bookmarked messages of the project.
+func getBookmarkedMessageUUIDs(projectUUID string, database *pgx.Conn) ([]string, error) {
 	preparedStatement := `
-	SELECT * FROM message_metadata WHERE projectUUID = $1 AND isBookmarked = $2
+	SELECT messageUUID FROM message_metadata WHERE projectUUID = $1 AND isBookmarked = $2
 	`
 	rows, err := database.Query(context.Background(), preparedStatement, projectUUID, true)
 
@@ -50,65 +121,108 @@ func GetBookmarksByProject(projectUUID string, database *pgx.Conn) ([]Message, e
 		return nil, err
 	}
 
-	var messages []Message
+	var messageUUIDs []string
 
 	for rows.Next() {
-		var messageMetadata MessageMetadata
-
-		err := rows.Scan(&messageMetadata.MessageUUID, &messageMetadata.ProjectUUID, &messageMetadata.IsBookmarked, &messageMetadata.Tag, &messageMetadata.Comment)
+		var messageUUID string
 
-		if err != nil {
+		if err := rows.Scan(&messageUUID); err != nil {
 			return nil, err
 		}
 
-		message, err := GetMessageByUUID(messageMetadata.MessageUUID, projectUUID, database)
-
-		if err != nil {
-			return nil, err
-		}
-
-		messages = append(messages, message)
+		messageUUIDs = append(messageUUIDs, messageUUID)
 	}
 
 	rows.Close()
 
-	return messages, rows.Err()
+	return messageUUIDs, rows.Err()
 }
 
 // AddTag sets the message metadata tag.
-func AddTag(tag string, messageUUID string, projectUUID string, database *pgx.Conn) error {
+// Deprecated: use TagMessage which supports multiple tags per message.
+func AddTag(tag string, messageUUID string, projectUUID string, userUUID string, database *pgx.Conn) error {
+	if err := CheckPermission(userUUID, projectUUID, ActionReview, database); err != nil {
+		return err
+	}
+
 	preparedStatement := `
-	INSERT INTO message_metadata(messageUUID, projectUUID, isBookmarked, tag, comment) VALUES ($1, $2, $3, $4, $5) 
-	ON CONFLICT(messageUUID) DO UPDATE SET tag = $4
+	INSERT INTO message_metadata(messageUUID, projectUUID, isBookmarked, tag) VALUES ($1, $2, $3, $4)
+	ON CONFLICT(messageUUID) DO UPDATE SET tag = $4 WHERE message_metadata.projectUUID = EXCLUDED.projectUUID
 	`
-	_, err := database.Exec(context.Background(), preparedStatement, messageUUID, projectUUID, false, tag, "")
+	if _, err := database.Exec(context.Background(), preparedStatement, messageUUID, projectUUID, false, tag); err != nil {
+		return err
+	}
 
-	return err
+	return updateMessageFields([]string{messageUUID}, projectUUID, map[string]interface{}{
+		"tag": tag,
+	})
 }
 
 // RemoveTag removes the message metadata tag.
-func RemoveTag(messageUUID string, projectUUID string, database *pgx.Conn) error {
+// Deprecated: use UntagMessage which supports multiple tags per message.
+func RemoveTag(messageUUID string, projectUUID string, userUUID string, database *pgx.Conn) error {
+	if err := CheckPermission(userUUID, projectUUID, ActionReview, database); err != nil {
+		return err
+	}
+
+	if err := checkProjectNotOnHold(projectUUID, userUUID, AuditActionRemoveTag, database); err != nil {
+		return err
+	}
+
 	preparedStatement := `
-	INSERT INTO message_metadata(messageUUID, projectUUID, isBookmarked, tag, comment) VALUES ($1, $2, $3, $4, $5) 
-	ON CONFLICT(messageUUID) DO UPDATE SET tag = $4
+	INSERT INTO message_metadata(messageUUID, projectUUID, isBookmarked, tag) VALUES ($1, $2, $3, $4)
+	ON CONFLICT(messageUUID) DO UPDATE SET tag = $4 WHERE message_metadata.projectUUID = EXCLUDED.projectUUID
 	`
-	_, err := database.Exec(context.Background(), preparedStatement, messageUUID, projectUUID, false, "", "")
+	if _, err := database.Exec(context.Background(), preparedStatement, messageUUID, projectUUID, false, ""); err != nil {
+		return err
+	}
 
-	return err
+	return updateMessageFields([]string{messageUUID}, projectUUID, map[string]interface{}{
+		"tag": "",
+	})
 }
 
 // GetMessageMetadata returns the message metadata of the message.
 func GetMessageMetadata(messageUUID string, projectUUID string, database *pgx.Conn) (MessageMetadata, error) {
 	preparedStatement := `
-	SELECT * FROM message_metadata WHERE messageUUID = $1 AND projectUUID = $2
+	SELECT messageUUID, projectUUID, isBookmarked, tag FROM message_metadata WHERE messageUUID = $1 AND projectUUID = $2
 	`
 	row := database.QueryRow(context.Background(), preparedStatement, messageUUID, projectUUID)
 
 	var messageMetadata MessageMetadata
 
-	if err := row.Scan(&messageMetadata.MessageUUID, &messageMetadata.ProjectUUID, &messageMetadata.IsBookmarked, &messageMetadata.Tag, &messageMetadata.Comment); err != nil {
+	if err := row.Scan(&messageMetadata.MessageUUID, &messageMetadata.ProjectUUID, &messageMetadata.IsBookmarked, &messageMetadata.Tag); err != nil {
 		return MessageMetadata{}, err
 	}
 
 	return messageMetadata, nil
 }
+
+// GetMessageMetadataForUUIDs returns the message metadata of the messages in the project, keyed by message UUID.
+// Messages without metadata are not included.
+func GetMessageMetadataForUUIDs(messageUUIDs []string, projectUUID string, database *pgx.Conn) (map[string]MessageMetadata, error) {
+	preparedStatement := `
+	SELECT messageUUID, projectUUID, isBookmarked, tag FROM message_metadata WHERE messageUUID = ANY($1) AND projectUUID = $2
+	`
+	rows, err := database.Query(context.Background(), preparedStatement, messageUUIDs, projectUUID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	messageMetadata := make(map[string]MessageMetadata, len(messageUUIDs))
+
+	for rows.Next() {
+		var metadata MessageMetadata
+
+		if err := rows.Scan(&metadata.MessageUUID, &metadata.ProjectUUID, &metadata.IsBookmarked, &metadata.Tag); err != nil {
+			return nil, err
+		}
+
+		messageMetadata[metadata.MessageUUID] = metadata
+	}
+
+	rows.Close()
+
+	return messageMetadata, rows.Err()
+}
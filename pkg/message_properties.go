@@ -0,0 +1,311 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"strconv"
+	"strings"
+)
+
+// MessageClassNote defines the message class of regular emails (EML and IMAP messages).
+const MessageClassNote = "IPM.Note"
+
+// Message importance.
+const (
+	MessageImportanceLow    = "low"
+	MessageImportanceNormal = "normal"
+	MessageImportanceHigh   = "high"
+)
+
+// Message sensitivity.
+const (
+	MessageSensitivityNormal       = "normal"
+	MessageSensitivityPersonal     = "personal"
+	MessageSensitivityPrivate      = "private"
+	MessageSensitivityConfidential = "confidential"
+)
+
+// Message receipts, see Message.Receipt.
+const (
+	MessageReceiptRead        = "read"         // A read receipt (message disposition notification).
+	MessageReceiptDelivery    = "delivery"     // A delivery receipt (delivery status notification).
+	MessageReceiptNonDelivery = "non_delivery" // A non-delivery report (bounce).
+)
+
+// Message directions relative to the custodian's mailbox, see Message.MailboxDirection.
+const (
+	MessageMailboxDirectionSent     = "sent"
+	MessageMailboxDirectionReceived = "received"
+	MessageMailboxDirectionDraft    = "draft" // A draft or an unsent message in the outbox.
+)
+
+// Message directions relative to the custodian domains and addresses, see SetCustodianDomains and SetCustodianAddresses.
+const (
+	// MessageDirectionInbound is a message from outside to a custodian domain.
+	MessageDirectionInbound = "inbound"
+	// MessageDirectionOutbound is a message from a custodian domain to outside.
+	MessageDirectionOutbound = "outbound"
+	// MessageDirectionInternal is a message from a custodian domain to only custodian domains.
+	MessageDirectionInternal = "internal"
+	// MessageDirectionExternal is a message without any custodian domain or address.
+	MessageDirectionExternal = "external"
+)
+
+// MAPI property IDs of the message properties.
+const (
+	pidTagImportance                        = 0x0017
+	pidTagOriginatorDeliveryReportRequested = 0x0023
+	pidTagReadReceiptRequested              = 0x0029
+	pidTagSensitivity                       = 0x0036
+	pidTagMessageFlags                      = 0x0E07
+	pidTagMessageSize                       = 0x0E08
+	// mapiMessageFlagRead is the read flag of PidTagMessageFlags.
+	mapiMessageFlagRead = 0x1
+	// mapiMessageFlagUnsent is the flag of PidTagMessageFlags for drafts and messages in the outbox.
+	mapiMessageFlagUnsent = 0x8
+	// mapiMessageFlagFromMe is the flag of PidTagMessageFlags for messages sent by the mailbox owner.
+	mapiMessageFlagFromMe = 0x20
+)
+
+// mapiImportance defines the importance of the PidTagImportance values.
+var mapiImportance = map[int]string{
+	0: MessageImportanceLow,
+	1: MessageImportanceNormal,
+	2: MessageImportanceHigh,
+}
+
+// mapiSensitivity defines the sensitivity of the PidTagSensitivity values.
+var mapiSensitivity = map[int]string{
+	0: MessageSensitivityNormal,
+	1: MessageSensitivityPersonal,
+	2: MessageSensitivityPrivate,
+	3: MessageSensitivityConfidential,
+}
+
+// mapiMessageClassReceipts defines the receipt of the report message classes (suffixes of REPORT.IPM.Note).
+var mapiMessageClassReceipts = map[string]string{
+	".IPNRN": MessageReceiptRead,
+	".DR":    MessageReceiptDelivery,
+	".NDR":   MessageReceiptNonDelivery,
+}
+
+// Folder names (lowercase) of the drafts and sent items in common languages, see getMailboxDirection.
+var (
+	draftFolderNames = []string{"drafts", "draft", "outbox", "concepten", "postvak uit", "entwürfe", "postausgang", "brouillons", "boîte d'envoi", "borradores", "bozze"}
+	sentFolderNames  = []string{"sent", "sent items", "sent mail", "sent messages", "verzonden items", "gesendete elemente", "gesendete objekte", "éléments envoyés", "elementos enviados", "posta inviata"}
+)
+
+// getMailboxDirection returns the direction of the message relative to the custodian's mailbox.
+// A message is a draft or sent if it's in a drafts or sent items folder (the last segment of IMAP mailbox names, e.g. "[Gmail]/Sent Mail"),
+// otherwise it's sent if the sender is one of the custodian addresses and received if not.
+func getMailboxDirection(message Message, folderTitle string, custodianAddresses []string) string {
+	folderName := strings.ToLower(strings.TrimSpace(folderTitle))
+
+	if separatorIndex := strings.LastIndexAny(folderName, "/."); separatorIndex != -1 {
+		folderName = strings.TrimSpace(folderName[separatorIndex+1:])
+	}
+
+	for _, draftFolderName := range draftFolderNames {
+		if folderName == draftFolderName {
+			return MessageMailboxDirectionDraft
+		}
+	}
+
+	for _, sentFolderName := range sentFolderNames {
+		if folderName == sentFolderName {
+			return MessageMailboxDirectionSent
+		}
+	}
+
+	for _, address := range getAddressesFromHeader(message.From) {
+		for _, custodianAddress := range custodianAddresses {
+			if strings.EqualFold(strings.TrimSpace(address), custodianAddress) {
+				return MessageMailboxDirectionSent
+			}
+		}
+	}
+
+	return MessageMailboxDirectionReceived
+}
+
+// getMessageDirection returns the direction of the message relative to the custodian domains and addresses.
+// Returns an empty string if there are no custodian domains or addresses.
+func getMessageDirection(message Message, custodians CustodianConfiguration) string {
+	if custodians.isEmpty() {
+		return ""
+	}
+
+	isFromCustodian := false
+
+	for _, address := range getAddressesFromHeader(message.From) {
+		if custodians.isCustodianAddress(address) {
+			isFromCustodian = true
+		}
+	}
+
+	hasCustodianRecipient := false
+	hasExternalRecipient := false
+
+	for _, address := range append(getAddressesFromHeader(message.To), getAddressesFromHeader(message.CC)...) {
+		if strings.TrimSpace(address) == "" {
+			continue
+		} else if custodians.isCustodianAddress(address) {
+			hasCustodianRecipient = true
+		} else {
+			hasExternalRecipient = true
+		}
+	}
+
+	if isFromCustodian && !hasExternalRecipient {
+		return MessageDirectionInternal
+	} else if isFromCustodian {
+		return MessageDirectionOutbound
+	} else if hasCustodianRecipient {
+		return MessageDirectionInbound
+	}
+
+	return MessageDirectionExternal
+}
+
+// getHeaderValue returns the value of the first header with the key (case insensitive) or an empty string.
+// Folded values (continued on lines starting with whitespace, e.g. a long References header) are unfolded.
+func getHeaderValue(headers string, key string) string {
+	if values := getHeaderValues(headers, key); len(values) > 0 {
+		return values[0]
+	}
+
+	return ""
+}
+
+// getHeaderValues returns the values of all headers with the key (case insensitive) in the order of the headers.
+// Folded values (continued on lines starting with whitespace, e.g. a long References header) are unfolded.
+func getHeaderValues(headers string, key string) []string {
+	var values []string
+
+	lines := strings.Split(headers, "\n")
+
+	for i, line := range lines {
+		separatorIndex := strings.Index(line, ":")
+
+		if separatorIndex == -1 || strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			continue
+		}
+
+		if !strings.EqualFold(strings.TrimSpace(line[:separatorIndex]), key) {
+			continue
+		}
+
+		value := strings.TrimSpace(line[separatorIndex+1:])
+
+		for _, continuation := range lines[i+1:] {
+			if !strings.HasPrefix(continuation, " ") && !strings.HasPrefix(continuation, "\t") {
+				break
+			}
+
+			value += " " + strings.TrimSpace(continuation)
+		}
+
+		values = append(values, strings.TrimSpace(value))
+	}
+
+	return values
+}
+
+// getHeaderImportance returns the importance from the Importance or X-Priority header.
+// Returns an empty string if the headers don't specify the importance.
+func getHeaderImportance(headers string) string {
+	switch strings.ToLower(getHeaderValue(headers, "Importance")) {
+	case "low":
+		return MessageImportanceLow
+	case "normal":
+		return MessageImportanceNormal
+	case "high":
+		return MessageImportanceHigh
+	}
+
+	// X-Priority is 1 (highest) to 5 (lowest), optionally followed by a description.
+	priority := strings.Fields(getHeaderValue(headers, "X-Priority"))
+
+	if len(priority) == 0 {
+		return ""
+	}
+
+	switch value, _ := strconv.Atoi(priority[0]); {
+	case value == 1 || value == 2:
+		return MessageImportanceHigh
+	case value == 3:
+		return MessageImportanceNormal
+	case value == 4 || value == 5:
+		return MessageImportanceLow
+	}
+
+	return ""
+}
+
+// getHeaderSensitivity returns the sensitivity from the Sensitivity header.
+// Returns an empty string if the headers don't specify the sensitivity.
+func getHeaderSensitivity(headers string) string {
+	switch strings.ToLower(getHeaderValue(headers, "Sensitivity")) {
+	case "personal":
+		return MessageSensitivityPersonal
+	case "private":
+		return MessageSensitivityPrivate
+	case "company-confidential":
+		return MessageSensitivityConfidential
+	}
+
+	return ""
+}
+
+// getRawMessageHeaders returns the headers of the raw (RFC 5322) message, up to the first empty line.
+func getRawMessageHeaders(original []byte) string {
+	headers := string(original)
+
+	for _, separator := range []string{"\r\n\r\n", "\n\n"} {
+		if separatorIndex := strings.Index(headers, separator); separatorIndex != -1 {
+			return headers[:separatorIndex]
+		}
+	}
+
+	return headers
+}
+
+// setHeaderFlags sets the importance, sensitivity and receipts of the message from its headers.
+func setHeaderFlags(message *Message) {
+	message.Importance = getHeaderImportance(message.Headers)
+	message.Sensitivity = getHeaderSensitivity(message.Headers)
+	message.ReadReceiptRequested = getHeaderValue(message.Headers, "Disposition-Notification-To") != "" || getHeaderValue(message.Headers, "X-Confirm-Reading-To") != ""
+	message.DeliveryReceiptRequested = getHeaderValue(message.Headers, "Return-Receipt-To") != ""
+	message.Receipt = getMessageReceipt(message.MessageClass, message.Headers)
+}
+
+// getMessageReceipt returns the receipt from the report message class (PST) or the multipart/report
+// Content-Type header. Returns an empty string if the message isn't a receipt.
+// Delivery status notifications are non-delivery reports if they list failed recipients (X-Failed-Recipients).
+func getMessageReceipt(messageClass string, headers string) string {
+	if upperMessageClass := strings.ToUpper(messageClass); strings.HasPrefix(upperMessageClass, "REPORT.") {
+		for suffix, receipt := range mapiMessageClassReceipts {
+			if strings.HasSuffix(upperMessageClass, suffix) {
+				return receipt
+			}
+		}
+	}
+
+	contentType := strings.ToLower(getHeaderValue(headers, "Content-Type"))
+
+	if !strings.HasPrefix(contentType, "multipart/report") {
+		return ""
+	}
+
+	switch {
+	case strings.Contains(contentType, "disposition-notification"):
+		return MessageReceiptRead
+	case strings.Contains(contentType, "delivery-status") && getHeaderValue(headers, "X-Failed-Recipients") != "":
+		return MessageReceiptNonDelivery
+	case strings.Contains(contentType, "delivery-status"):
+		return MessageReceiptDelivery
+	}
+
+	return ""
+}
@@ -4,49 +4,61 @@
 package core
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
-	"github.com/spf13/viper"
 	"io"
+	"os"
 )
 
 // Variables defining our MinIO client.
+//
+// Deprecated: use Core.MinIOClient and Core.Config.MinIOBucket.
 var (
 	MinIOBucketName string
 	MinIOClient     *minio.Client
 )
 
-// init initializes our MinIO client.
-func init() {
-	minioConfigurationVariables := []string{"minio_bucket", "minio_endpoint", "minio_access_key", "minio_secret_key", "minio_secure"}
+// newMinIOClient creates our MinIO client.
+func newMinIOClient(config Config) (*minio.Client, error) {
+	return minio.New(config.MinIOEndpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(config.MinIOAccessKey, config.MinIOSecretKey, ""),
+		Secure: config.MinIOSecure,
+	})
+}
 
-	for _, configurationVariable := range minioConfigurationVariables {
-		if !viper.IsSet(configurationVariable) {
-			Logger.Fatalf("unset %s configuration variable", configurationVariable)
-		}
+// UploadFile uploads the file to MinIO and returns the MinIO path to the uploaded file.
+func UploadFile(fileName string, filePath string, projectUUID string) (string, error) {
+	objectName := fmt.Sprintf("%s/%s", projectUUID, fileName)
+	contentType := "application/octet-stream"
+
+	if ObjectStore != nil {
+		return objectName, putObjectFile(objectName, filePath)
 	}
 
-	minioClient, err := minio.New(viper.GetString("minio_endpoint"), &minio.Options{
-		Creds:  credentials.NewStaticV4(viper.GetString("minio_access_key"), viper.GetString("minio_secret_key"), ""),
-		Secure: viper.GetBool("minio_secure"),
-	})
+	bucketName, err := getObjectBucket(objectName)
 
 	if err != nil {
-		Logger.Fatalf("Failed to get MinIO client: %s", err)
+		return "", err
 	}
 
-	MinIOClient = minioClient
-	MinIOBucketName = viper.GetString("minio_bucket")
-}
+	serverSideEncryption, err := getObjectEncryption(objectName)
 
-// UploadFile uploads the file to MinIO and returns the MinIO path to the uploaded file.
-func UploadFile(fileName string, filePath string, projectUUID string) (string, error) {
-	objectName := fmt.Sprintf("%s/%s", projectUUID, fileName)
-	contentType := "application/octet-stream"
+	if err != nil {
+		return "", err
+	}
 
-	_, err := MinIOClient.FPutObject(context.Background(), MinIOBucketName, objectName, filePath, minio.PutObjectOptions{ContentType: contentType})
+	err = retry(context.Background(), ExternalServiceRetryOptions, func() error {
+		_, err := MinIOClient.FPutObject(context.Background(), bucketName, objectName, filePath, minio.PutObjectOptions{
+			ContentType:          contentType,
+			ServerSideEncryption: serverSideEncryption,
+		})
+
+		return err
+	})
 
 	if err != nil {
 		return "", err
@@ -55,9 +67,60 @@ func UploadFile(fileName string, filePath string, projectUUID string) (string, e
 	return objectName, nil
 }
 
-// GetObject returns the MinIO object.
+// uploadObject uploads the data to the MinIO object.
+func uploadObject(objectName string, data []byte, contentType string) error {
+	if ObjectStore != nil {
+		return ObjectStore.PutObject(objectName, bytes.NewReader(data))
+	}
+
+	bucketName, err := getObjectBucket(objectName)
+
+	if err != nil {
+		return err
+	}
+
+	serverSideEncryption, err := getObjectEncryption(objectName)
+
+	if err != nil {
+		return err
+	}
+
+	return retry(context.Background(), ExternalServiceRetryOptions, func() error {
+		_, err := MinIOClient.PutObject(context.Background(), bucketName, objectName, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
+			ContentType:          contentType,
+			ServerSideEncryption: serverSideEncryption,
+		})
+
+		return err
+	})
+}
+
+// getObjectBytes returns the content of the MinIO object.
+func getObjectBytes(objectName string) ([]byte, error) {
+	var objectBuffer bytes.Buffer
+
+	if err := WriteFileToWriter(objectName, &objectBuffer); err != nil {
+		return nil, err
+	}
+
+	return objectBuffer.Bytes(), nil
+}
+
+// GetObject returns the MinIO object, decrypted with the data encryption key of the project if encrypted (see getObjectEncryption).
 func GetObject(objectName string) (*minio.Object, error) {
-	objectReader, err := MinIOClient.GetObject(context.Background(), MinIOBucketName, objectName, minio.GetObjectOptions{})
+	bucketName, err := getObjectBucket(objectName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	getObjectOptions, err := getObjectOptions(objectName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	objectReader, err := MinIOClient.GetObject(context.Background(), bucketName, objectName, getObjectOptions)
 
 	if err != nil {
 		return nil, err
@@ -68,12 +131,25 @@ func GetObject(objectName string) (*minio.Object, error) {
 
 // WriteFileToWriter writes the MinIO object to the writer.
 func WriteFileToWriter(objectName string, writer io.Writer) error {
-	objectReader, err := MinIOClient.GetObject(context.Background(), MinIOBucketName, objectName, minio.GetObjectOptions{})
+	var objectReader io.ReadCloser
+	var err error
+
+	if ObjectStore != nil {
+		objectReader, err = ObjectStore.GetObject(objectName)
+	} else {
+		objectReader, err = GetObject(objectName)
+	}
 
 	if err != nil {
 		return err
 	}
 
+	defer func() {
+		if err := objectReader.Close(); err != nil {
+			Logger.Errorf("Failed to close object: %s", err)
+		}
+	}()
+
 	written, err := io.Copy(writer, objectReader)
 
 	if err != nil {
@@ -84,11 +160,191 @@ func WriteFileToWriter(objectName string, writer io.Writer) error {
 	return nil
 }
 
+// putObjectFile stores the file as the object in the ObjectStore.
+func putObjectFile(objectName string, filePath string) error {
+	inputFile, err := os.Open(filePath)
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := inputFile.Close(); err != nil {
+			Logger.Errorf("Failed to close file: %s", err)
+		}
+	}()
+
+	return ObjectStore.PutObject(objectName, inputFile)
+}
+
+// getObjectOptions returns the options to get the MinIO object.
+func getObjectOptions(objectName string) (minio.GetObjectOptions, error) {
+	serverSideEncryption, err := getObjectEncryption(objectName)
+
+	if err != nil {
+		return minio.GetObjectOptions{}, err
+	}
+
+	return minio.GetObjectOptions{ServerSideEncryption: serverSideEncryption}, nil
+}
+
+// RemoveObject removes the MinIO object.
+func RemoveObject(objectName string) error {
+	if ObjectStore != nil {
+		return ObjectStore.RemoveObject(objectName)
+	}
+
+	bucketName, err := getObjectBucket(objectName)
+
+	if err != nil {
+		return err
+	}
+
+	return MinIOClient.RemoveObject(context.Background(), bucketName, objectName, minio.RemoveObjectOptions{})
+}
+
+// RemoveObjectsByPrefix removes all MinIO objects starting with the prefix.
+func RemoveObjectsByPrefix(prefix string) error {
+	if ObjectStore != nil {
+		return ObjectStore.RemoveObjectsByPrefix(prefix)
+	}
+
+	bucketName, err := getObjectBucket(prefix)
+
+	if err != nil {
+		return err
+	}
+
+	objectsChannel := MinIOClient.ListObjects(context.Background(), bucketName, minio.ListObjectsOptions{
+		Prefix:    prefix,
+		Recursive: true,
+	})
+
+	for removeError := range MinIOClient.RemoveObjects(context.Background(), bucketName, objectsChannel, minio.RemoveObjectsOptions{}) {
+		if removeError.Err != nil {
+			return removeError.Err
+		}
+	}
+
+	return nil
+}
+
 // DownloadEvidence downloads the evidence from MinIO to the project temp directory and returns its path.
+// The caller must remove the file, a partially downloaded file is removed on failure.
+// Returns ErrTempQuotaExceeded if the temporary files exceed the quota.
 func DownloadEvidence(evidence Evidence, projectUUID string) (string, error) {
+	if err := checkTempQuota(); err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(GetProjectTempDirectory(projectUUID), 0755); err != nil {
+		return "", err
+	}
+
 	evidencePath := fmt.Sprintf(GetProjectTempDirectory(projectUUID) + "/" + evidence.UUID)
 
-	_, err := MinIOClient.FPutObject(context.Background(), MinIOBucketName, evidence.FileHash, evidencePath, minio.PutObjectOptions{})
+	if ObjectStore != nil {
+		return evidencePath, downloadStoredEvidence(evidence, evidencePath)
+	}
+
+	err := retry(context.Background(), ExternalServiceRetryOptions, func() error {
+		_, err := MinIOClient.FPutObject(context.Background(), MinIOBucketName, evidence.FileHash, evidencePath, minio.PutObjectOptions{})
+
+		return err
+	})
+
+	if err != nil {
+		if removeErr := os.Remove(evidencePath); removeErr != nil && !os.IsNotExist(removeErr) {
+			Logger.Errorf("Failed to remove evidence file: %s", removeErr)
+		}
+
+		return "", err
+	}
+
+	return evidencePath, nil
+}
+
+// downloadStoredEvidence copies the evidence from the ObjectStore to the evidence path, a partially copied file is removed on failure.
+func downloadStoredEvidence(evidence Evidence, evidencePath string) error {
+	evidenceFile, err := os.Create(evidencePath)
+
+	if err != nil {
+		return err
+	}
+
+	if err := WriteFileToWriter(evidence.FileHash, evidenceFile); err != nil {
+		_ = evidenceFile.Close()
+
+		if removeErr := os.Remove(evidencePath); removeErr != nil {
+			Logger.Errorf("Failed to remove evidence file: %s", removeErr)
+		}
+
+		return err
+	}
+
+	return evidenceFile.Close()
+}
+
+// readEvidenceHeader returns the first bytes of the evidence (fewer if the file is smaller), e.g. to detect the file signature.
+func readEvidenceHeader(evidence Evidence, size int) ([]byte, error) {
+	header := make([]byte, size)
+
+	if ObjectStore != nil {
+		objectReader, err := ObjectStore.GetObject(evidence.FileHash)
+
+		if err != nil {
+			return nil, err
+		}
+
+		defer func() {
+			if err := objectReader.Close(); err != nil {
+				Logger.Errorf("Failed to close evidence object: %s", err)
+			}
+		}()
+
+		read, err := io.ReadFull(objectReader, header)
+
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+
+		return header[:read], nil
+	}
+
+	var read int
+
+	err := retry(context.Background(), ExternalServiceRetryOptions, func() error {
+		getObjectOptions := minio.GetObjectOptions{}
+
+		if err := getObjectOptions.SetRange(0, int64(size-1)); err != nil {
+			return err
+		}
+
+		objectReader, err := MinIOClient.GetObject(context.Background(), MinIOBucketName, evidence.FileHash, getObjectOptions)
+
+		if err != nil {
+			return err
+		}
+
+		defer func() {
+			if err := objectReader.Close(); err != nil {
+				Logger.Errorf("Failed to close evidence object: %s", err)
+			}
+		}()
+
+		read, err = io.ReadFull(objectReader, header)
+
+		// The range of an empty file is invalid.
+		if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) || minio.ToErrorResponse(err).Code == "InvalidRange" {
+			return nil
+		}
+
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
 
-	return evidencePath, err
+	return header[:read], nil
 }
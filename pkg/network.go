@@ -4,21 +4,30 @@
 package core
 
 import (
+	"fmt"
+	"github.com/aquasecurity/esquery"
 	"github.com/emersion/go-message/mail"
 	"github.com/jackc/pgx/v4"
 	"strings"
 )
 
 // NetworkNode represents a node (contact) in the network.
+// Centrality and community are computed by analyzeNetwork.
 type NetworkNode struct {
-	ID   string `json:"id"`
-	Size int    `json:"size"`
+	ID                    string  `json:"id"`
+	Size                  int     `json:"size"`
+	Degree                int     `json:"degree"`
+	DegreeCentrality      float64 `json:"degree_centrality"`
+	BetweennessCentrality float64 `json:"betweenness_centrality"`
+	Community             int     `json:"community"`
 }
 
 // NetworkLink represents a link (connection between two contacts) in the network.
+// Weight is the amount of messages sent from the source to the target.
 type NetworkLink struct {
 	Source string `json:"source"`
 	Target string `json:"target"`
+	Weight int    `json:"weight"`
 }
 
 // Network represents a network of contacts and links.
@@ -27,167 +36,225 @@ type Network struct {
 	Links                []NetworkLink `json:"links"`
 	FirstSentMessageDate int           `json:"first_sent_message_data"`
 	LastSentMessageDate  int           `json:"last_sent_message_date"`
+	CommunityCount       int           `json:"community_count"`
 }
 
-// GetNetwork returns the network of nodes (contacts) and links.
-func GetNetwork(projectUUID string, database *pgx.Conn) (Network, error) {
-	// Address X sent to address Y, Z amount of times
-	sentMap := map[string]map[string]int{}
+// Network directions.
+const (
+	// NetworkDirectionMutual only links contacts which sent messages to each other.
+	NetworkDirectionMutual = "mutual"
+	// NetworkDirectionAny links contacts if at least one sent a message to the other.
+	NetworkDirectionAny = "any"
+)
 
-	var firstSentMessageDate int
-	var lastSentMessageDate int
+// NetworkOptions represents the filters used to build the network.
+// The zero value returns the complete network of mutual contacts.
+type NetworkOptions struct {
+	StartDate           int      `json:"start_date"` // Unix timestamp, zero for no limit.
+	EndDate             int      `json:"end_date"`   // Unix timestamp, zero for no limit.
+	MinimumMessageCount int      `json:"minimum_message_count"`
+	Domains             []string `json:"domains"` // Only links with at least one address in these domains.
+	Direction           string   `json:"direction"`
+	// Pseudonymize replaces the addresses with pseudonyms, see Pseudonymizer.
+	Pseudonymize bool `json:"pseudonymize"`
+	// SentOnly only uses the messages sent by the custodians (see Message.MailboxDirection) so incoming bulk mail doesn't add links.
+	// Messages indexed before the mailbox direction was stored are skipped as well.
+	SentOnly bool `json:"sent_only"`
+	// IncludeBulk includes the messages flagged as bulk mail (see Message.IsBulk), newsletters otherwise add many meaningless links.
+	IncludeBulk bool `json:"include_bulk"`
+}
 
-	allMessages, err := GetAllMessages(projectUUID, database)
+// networkMaximumNodeSize defines the maximum size of a node in the network.
+const networkMaximumNodeSize = 30
 
-	if err != nil {
+// GetNetwork returns the network of nodes (contacts) and links.
+// Messages are streamed so memory usage depends on the amount of contacts instead of messages.
+func GetNetwork(projectUUID string, options NetworkOptions, userUUID string, database *pgx.Conn) (Network, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
 		return Network{}, err
 	}
 
-	var messageIDs []string
+	if options.Direction == "" {
+		options.Direction = NetworkDirectionMutual
+	}
+
+	if options.Direction != NetworkDirectionMutual && options.Direction != NetworkDirectionAny {
+		return Network{}, fmt.Errorf("invalid network direction: %s", options.Direction)
+	}
+
+	domains := map[string]bool{}
+
+	for _, domain := range options.Domains {
+		domains[strings.ToLower(domain)] = true
+	}
+
+	// Address X sent to address Y, Z amount of times
+	sentMap := map[string]map[string]int{}
+	messageIDs := map[string]bool{}
 
-	for _, message := range allMessages {
-		// Dedupe based on the Message ID header or else it will inflate the count,
-		// since one email can be stored in multiple mailboxes at the same time.
-		if message.MessageID == messageNullValue || !containsMessageID(messageIDs, message.MessageID) {
+	var firstSentMessageDate int
+	var lastSentMessageDate int
+
+	err := forEachMessageBatch(newNetworkQuery(projectUUID, options), func(messages []Message) error {
+		for _, message := range messages {
+			// Dedupe based on the Message ID header or else it will inflate the count,
+			// since one email can be stored in multiple mailboxes at the same time.
 			if message.MessageID != messageNullValue {
-				messageIDs = append(messageIDs, message.MessageID)
+				if messageIDs[message.MessageID] {
+					continue
+				}
+
+				messageIDs[message.MessageID] = true
 			}
 
 			// Populate first and last sent message time.
-			if firstSentMessageDate == 0 {
+			if firstSentMessageDate == 0 || message.Received < firstSentMessageDate {
 				firstSentMessageDate = message.Received
-			} else {
-				if message.Received < firstSentMessageDate {
-					firstSentMessageDate = message.Received
-				}
 			}
 
-			if lastSentMessageDate == 0 {
+			if lastSentMessageDate == 0 || message.Received > lastSentMessageDate {
 				lastSentMessageDate = message.Received
-			} else {
-				if message.Received > lastSentMessageDate {
-					lastSentMessageDate = message.Received
-				}
 			}
 
 			// Populate the "Sent" map.
-			for _, fromAddress := range getAddressesFromHeader(message.From) {
-				_, hasSentMap := sentMap[fromAddress]
+			recipientAddresses := append(getAddressesFromHeader(message.To), getAddressesFromHeader(message.CC)...)
 
-				if !hasSentMap {
+			for _, fromAddress := range getAddressesFromHeader(message.From) {
+				if _, ok := sentMap[fromAddress]; !ok {
 					sentMap[fromAddress] = map[string]int{}
 				}
 
-				for _, toAddress := range getAddressesFromHeader(message.To) {
-					_, hasSentMapToAddress := sentMap[fromAddress][toAddress]
-
-					if !hasSentMapToAddress {
-						sentMap[fromAddress][toAddress] = 1
-					} else {
-						sentMap[fromAddress][toAddress] = sentMap[fromAddress][toAddress] + 1
-					}
-				}
-
-				for _, ccAddress := range getAddressesFromHeader(message.CC) {
-					_, hasSentMapToAddress := sentMap[fromAddress][ccAddress]
-
-					if !hasSentMapToAddress {
-						sentMap[fromAddress][ccAddress] = 1
-					} else {
-						sentMap[fromAddress][ccAddress] = sentMap[fromAddress][ccAddress] + 1
-					}
+				for _, recipientAddress := range recipientAddresses {
+					sentMap[fromAddress][recipientAddress]++
 				}
 			}
 		}
+
+		return nil
+	}, database)
+
+	if err != nil {
+		return Network{}, err
 	}
 
 	var networkNodes []NetworkNode
 	var networkLinks []NetworkLink
 
-	// Add all nodes that have sent and received at least one message.
+	nodeIDs := map[string]bool{}
+
+	addNode := func(address string, nodeSize int) {
+		if nodeIDs[address] {
+			return
+		}
+
+		nodeIDs[address] = true
+
+		if nodeSize >= networkMaximumNodeSize {
+			nodeSize = networkMaximumNodeSize
+		}
+
+		networkNodes = append(networkNodes, NetworkNode{
+			ID:   address,
+			Size: nodeSize,
+		})
+	}
+
+	// Each (from, to) pair only occurs once in the sent map so links are unique.
 	for fromAddress, toAddresses := range sentMap {
 		for toAddress, sentAmount := range toAddresses {
-			if sentAmount > 0 {
-				receivedAmount := sentMap[toAddress][fromAddress]
-
-				if receivedAmount > 0 {
-					if !containsNode(networkNodes, toAddress) {
-						nodeSize := sentAmount * receivedAmount
-
-						if nodeSize >= 30 {
-							nodeSize = 30
-						}
-
-						networkNodes = append(networkNodes, NetworkNode{
-							ID:   toAddress,
-							Size: nodeSize,
-						})
-					}
-					if !containsNode(networkNodes, fromAddress) {
-						nodeSize := sentAmount * receivedAmount
-
-						if nodeSize >= 30 {
-							nodeSize = 30
-						}
-
-						networkNodes = append(networkNodes, NetworkNode{
-							ID:   fromAddress,
-							Size: nodeSize,
-						})
-					}
-					if !containsLink(networkLinks, fromAddress, toAddress) {
-						networkLinks = append(networkLinks, NetworkLink{
-							Source: fromAddress,
-							Target: toAddress,
-						})
-					}
-				}
+			receivedAmount := sentMap[toAddress][fromAddress]
+
+			if sentAmount == 0 || sentAmount < options.MinimumMessageCount {
+				continue
+			}
+
+			if options.Direction == NetworkDirectionMutual && (receivedAmount == 0 || receivedAmount < options.MinimumMessageCount) {
+				continue
+			}
+
+			if len(domains) > 0 && !domains[getAddressDomain(strings.ToLower(fromAddress))] && !domains[getAddressDomain(strings.ToLower(toAddress))] {
+				continue
 			}
+
+			nodeSize := sentAmount * receivedAmount
+
+			if receivedAmount == 0 {
+				nodeSize = sentAmount
+			}
+
+			addNode(toAddress, nodeSize)
+			addNode(fromAddress, nodeSize)
+
+			networkLinks = append(networkLinks, NetworkLink{
+				Source: fromAddress,
+				Target: toAddress,
+				Weight: sentAmount,
+			})
 		}
 	}
 
-	return Network{
+	network := Network{
 		Nodes:                networkNodes,
 		Links:                networkLinks,
 		FirstSentMessageDate: firstSentMessageDate,
 		LastSentMessageDate:  lastSentMessageDate,
-	}, nil
-}
+	}
 
-func containsMessageID(messageIDs []string, wantedMessageID string) bool {
-	containsMessageID := false
+	analyzeNetwork(&network)
 
-	for _, messageID := range messageIDs {
-		if messageID == wantedMessageID {
-			containsMessageID = true
+	if options.Pseudonymize {
+		pseudonymizer, err := NewPseudonymizer(projectUUID, database)
+
+		if err != nil {
+			return Network{}, err
 		}
+
+		return pseudonymizer.Network(network)
 	}
 
-	return containsMessageID
+	return network, nil
 }
 
-func containsLink(links []NetworkLink, source string, target string) bool {
-	containsLink := false
+// newNetworkQuery returns the Elasticsearch query matching the messages used to build the network.
+// Drafts are never used since they weren't sent.
+func newNetworkQuery(projectUUID string, options NetworkOptions) *esquery.BoolQuery {
+	query := esquery.Bool().
+		Must(esquery.Term("project_uuid", projectUUID)).
+		MustNot(esquery.Term("mailbox_direction", MessageMailboxDirectionDraft))
 
-	for _, link := range links {
-		if link.Source == source && link.Target == target {
-			containsLink = true
-		}
+	if options.SentOnly {
+		query = query.Filter(esquery.Term("mailbox_direction", MessageMailboxDirectionSent))
 	}
 
-	return containsLink
-}
+	if !options.IncludeBulk {
+		query = query.MustNot(esquery.Term("is_bulk", true))
+	}
 
-func containsNode(nodes []NetworkNode, wantedNode string) bool {
-	containsNode := false
+	if options.StartDate > 0 || options.EndDate > 0 {
+		receivedRange := esquery.Range("received")
 
-	for _, node := range nodes {
-		if node.ID == wantedNode {
-			containsNode = true
+		if options.StartDate > 0 {
+			receivedRange = receivedRange.Gte(options.StartDate)
 		}
+
+		if options.EndDate > 0 {
+			receivedRange = receivedRange.Lte(options.EndDate)
+		}
+
+		query = query.Filter(receivedRange)
+	}
+
+	if len(options.Domains) > 0 {
+		var domains []interface{}
+
+		for _, domain := range options.Domains {
+			domains = append(domains, strings.ToLower(domain))
+		}
+
+		query = query.Filter(esquery.Terms("domains", domains...))
 	}
 
-	return containsNode
+	return query
 }
 
 // getAddressesFromHeader returns all addresses from the header.
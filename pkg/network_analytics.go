@@ -0,0 +1,245 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+// analyzeNetwork sets the centrality and community of each node in the network.
+// Links are treated as undirected, weighted by the amount of messages in both directions.
+func analyzeNetwork(network *Network) {
+	nodeIndexes := make(map[string]int, len(network.Nodes))
+
+	for i, node := range network.Nodes {
+		nodeIndexes[node.ID] = i
+	}
+
+	adjacency := make([]map[int]float64, len(network.Nodes))
+
+	for i := range adjacency {
+		adjacency[i] = map[int]float64{}
+	}
+
+	for _, link := range network.Links {
+		source, target := nodeIndexes[link.Source], nodeIndexes[link.Target]
+
+		if source == target {
+			continue
+		}
+
+		adjacency[source][target] += float64(link.Weight)
+		adjacency[target][source] += float64(link.Weight)
+	}
+
+	betweennessCentrality := getBetweennessCentrality(adjacency)
+	communities := getCommunities(adjacency)
+
+	for i := range network.Nodes {
+		network.Nodes[i].Degree = len(adjacency[i])
+
+		if len(network.Nodes) > 1 {
+			network.Nodes[i].DegreeCentrality = float64(len(adjacency[i])) / float64(len(network.Nodes)-1)
+		}
+
+		network.Nodes[i].BetweennessCentrality = betweennessCentrality[i]
+		network.Nodes[i].Community = communities[i]
+
+		if communities[i]+1 > network.CommunityCount {
+			network.CommunityCount = communities[i] + 1
+		}
+	}
+}
+
+// getBetweennessCentrality returns the normalized betweenness centrality of each node.
+// Uses Brandes' algorithm on the unweighted, undirected graph.
+func getBetweennessCentrality(adjacency []map[int]float64) []float64 {
+	nodeCount := len(adjacency)
+	betweenness := make([]float64, nodeCount)
+
+	for source := 0; source < nodeCount; source++ {
+		var stack []int
+
+		predecessors := make([][]int, nodeCount)
+		shortestPaths := make([]float64, nodeCount)
+		distances := make([]int, nodeCount)
+		dependencies := make([]float64, nodeCount)
+
+		for i := range distances {
+			distances[i] = -1
+		}
+
+		shortestPaths[source] = 1
+		distances[source] = 0
+		queue := []int{source}
+
+		for len(queue) > 0 {
+			node := queue[0]
+			queue = queue[1:]
+			stack = append(stack, node)
+
+			for neighbour := range adjacency[node] {
+				if distances[neighbour] < 0 {
+					distances[neighbour] = distances[node] + 1
+					queue = append(queue, neighbour)
+				}
+
+				if distances[neighbour] == distances[node]+1 {
+					shortestPaths[neighbour] += shortestPaths[node]
+					predecessors[neighbour] = append(predecessors[neighbour], node)
+				}
+			}
+		}
+
+		for len(stack) > 0 {
+			node := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+
+			for _, predecessor := range predecessors[node] {
+				dependencies[predecessor] += shortestPaths[predecessor] / shortestPaths[node] * (1 + dependencies[node])
+			}
+
+			if node != source {
+				betweenness[node] += dependencies[node]
+			}
+		}
+	}
+
+	// Every pair is counted twice in an undirected graph, normalize to [0, 1].
+	if nodeCount > 2 {
+		for i := range betweenness {
+			betweenness[i] /= float64((nodeCount - 1) * (nodeCount - 2))
+		}
+	}
+
+	return betweenness
+}
+
+// getCommunities returns the community of each node using the Louvain method.
+// Communities are numbered from zero in order of their first node.
+func getCommunities(adjacency []map[int]float64) []int {
+	communities := make([]int, len(adjacency))
+
+	for i := range communities {
+		communities[i] = i
+	}
+
+	// The graph is aggregated after each level, self-loops hold twice the internal weight.
+	graph := adjacency
+
+	for {
+		graphCommunities, moved := getLouvainLevel(graph)
+
+		if !moved {
+			break
+		}
+
+		renumberedCommunities, communityCount := renumberCommunities(graphCommunities)
+
+		for i := range communities {
+			communities[i] = renumberedCommunities[communities[i]]
+		}
+
+		aggregatedGraph := make([]map[int]float64, communityCount)
+
+		for i := range aggregatedGraph {
+			aggregatedGraph[i] = map[int]float64{}
+		}
+
+		for node, neighbours := range graph {
+			for neighbour, weight := range neighbours {
+				aggregatedGraph[renumberedCommunities[node]][renumberedCommunities[neighbour]] += weight
+			}
+		}
+
+		graph = aggregatedGraph
+	}
+
+	return communities
+}
+
+// louvainMinimumGain defines the minimum modularity gain for moving a node, preventing endless moves due to rounding.
+const louvainMinimumGain = 1e-12
+
+// getLouvainLevel moves nodes to the neighbouring community with the highest modularity gain until no node moves.
+// Returns the community of each node and if any node moved.
+func getLouvainLevel(graph []map[int]float64) ([]int, bool) {
+	communities := make([]int, len(graph))
+	nodeWeights := make([]float64, len(graph))
+	communityWeights := make([]float64, len(graph))
+
+	var totalWeight float64
+
+	for node, neighbours := range graph {
+		communities[node] = node
+
+		for _, weight := range neighbours {
+			nodeWeights[node] += weight
+		}
+
+		communityWeights[node] = nodeWeights[node]
+		totalWeight += nodeWeights[node]
+	}
+
+	if totalWeight == 0 {
+		return communities, false
+	}
+
+	moved := false
+
+	for hasMoved := true; hasMoved; {
+		hasMoved = false
+
+		for node, neighbours := range graph {
+			currentCommunity := communities[node]
+			neighbourCommunityWeights := map[int]float64{}
+
+			for neighbour, weight := range neighbours {
+				if neighbour != node {
+					neighbourCommunityWeights[communities[neighbour]] += weight
+				}
+			}
+
+			communityWeights[currentCommunity] -= nodeWeights[node]
+
+			bestCommunity := currentCommunity
+			bestGain := neighbourCommunityWeights[currentCommunity] - communityWeights[currentCommunity]*nodeWeights[node]/totalWeight
+
+			for community, weight := range neighbourCommunityWeights {
+				gain := weight - communityWeights[community]*nodeWeights[node]/totalWeight
+
+				// Only move on a strict improvement and break ties on the lowest community so the result is deterministic.
+				if gain > bestGain+louvainMinimumGain || (gain == bestGain && bestCommunity != currentCommunity && community < bestCommunity) {
+					bestCommunity = community
+					bestGain = gain
+				}
+			}
+
+			communityWeights[bestCommunity] += nodeWeights[node]
+
+			if bestCommunity != currentCommunity {
+				communities[node] = bestCommunity
+				hasMoved = true
+				moved = true
+			}
+		}
+	}
+
+	return communities, moved
+}
+
+// renumberCommunities returns the communities numbered from zero in order of first occurrence and the amount of communities.
+func renumberCommunities(communities []int) ([]int, int) {
+	communityNumbers := map[int]int{}
+	renumberedCommunities := make([]int, len(communities))
+
+	for i, community := range communities {
+		communityNumber, ok := communityNumbers[community]
+
+		if !ok {
+			communityNumber = len(communityNumbers)
+			communityNumbers[community] = communityNumber
+		}
+
+		renumberedCommunities[i] = communityNumber
+	}
+
+	return renumberedCommunities, len(communityNumbers)
+}
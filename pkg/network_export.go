@@ -0,0 +1,346 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"io"
+	"os"
+	"strconv"
+)
+
+// Network export formats.
+const (
+	NetworkExportFormatGraphML = "graphml"
+	NetworkExportFormatGEXF    = "gexf"
+	NetworkExportFormatCSV     = "csv" // ZIP containing nodes.csv and links.csv.
+)
+
+// ExportNetwork exports the network to the format and returns the MinIO path to the uploaded file.
+// GraphML and GEXF can be imported in Gephi, the CSV files in i2 and Maltego.
+func ExportNetwork(projectUUID string, format string, options NetworkOptions, userUUID string, database *pgx.Conn) (string, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionExport, database); err != nil {
+		return "", err
+	}
+
+	if format != NetworkExportFormatGraphML && format != NetworkExportFormatGEXF && format != NetworkExportFormatCSV {
+		return "", fmt.Errorf("unsupported network export format: %s", format)
+	}
+
+	network, err := GetNetwork(projectUUID, options, userUUID, database)
+
+	if err != nil {
+		return "", err
+	}
+
+	scratchSpace, err := NewScratchSpace(projectUUID)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer scratchSpace.cleanup()
+
+	exportUUID := NewUUID()
+
+	if format == NetworkExportFormatCSV {
+		exportDirectory := scratchSpace.FilePath(exportUUID)
+
+		if err := os.Mkdir(exportDirectory, 0755); err != nil {
+			return "", err
+		}
+
+		if err := writeNetworkFile(fmt.Sprintf("%s/nodes.csv", exportDirectory), network, writeNetworkNodesCSV); err != nil {
+			return "", err
+		}
+
+		if err := writeNetworkFile(fmt.Sprintf("%s/links.csv", exportDirectory), network, writeNetworkLinksCSV); err != nil {
+			return "", err
+		}
+
+		return uploadExportDirectory(exportUUID, scratchSpace, ArchiveOptions{}, projectUUID)
+	}
+
+	exportPath := scratchSpace.FilePath(fmt.Sprintf("%s.%s", exportUUID, format))
+
+	writeNetwork := writeNetworkGraphML
+
+	if format == NetworkExportFormatGEXF {
+		writeNetwork = writeNetworkGEXF
+	}
+
+	if err := writeNetworkFile(exportPath, network, writeNetwork); err != nil {
+		return "", err
+	}
+
+	return UploadFile(fmt.Sprintf("%s.%s", exportUUID, format), exportPath, projectUUID)
+}
+
+// writeNetworkFile creates the file and writes the network to it.
+func writeNetworkFile(filePath string, network Network, writeNetwork func(writer io.Writer, network Network) error) error {
+	outputFile, err := os.Create(filePath)
+
+	if err != nil {
+		return err
+	}
+
+	if err := writeNetwork(outputFile, network); err != nil {
+		if closeErr := outputFile.Close(); closeErr != nil {
+			Logger.Errorf("Failed to close file: %s", closeErr)
+		}
+
+		return err
+	}
+
+	return outputFile.Close()
+}
+
+// writeNetworkNodesCSV writes the nodes of the network as CSV.
+func writeNetworkNodesCSV(writer io.Writer, network Network) error {
+	csvWriter := csv.NewWriter(writer)
+
+	if err := csvWriter.Write([]string{"id", "size", "degree", "degree_centrality", "betweenness_centrality", "community"}); err != nil {
+		return err
+	}
+
+	for _, node := range network.Nodes {
+		err := csvWriter.Write([]string{
+			node.ID,
+			strconv.Itoa(node.Size),
+			strconv.Itoa(node.Degree),
+			strconv.FormatFloat(node.DegreeCentrality, 'f', -1, 64),
+			strconv.FormatFloat(node.BetweennessCentrality, 'f', -1, 64),
+			strconv.Itoa(node.Community),
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	csvWriter.Flush()
+
+	return csvWriter.Error()
+}
+
+// writeNetworkLinksCSV writes the links of the network as CSV.
+func writeNetworkLinksCSV(writer io.Writer, network Network) error {
+	csvWriter := csv.NewWriter(writer)
+
+	if err := csvWriter.Write([]string{"source", "target", "weight"}); err != nil {
+		return err
+	}
+
+	for _, link := range network.Links {
+		if err := csvWriter.Write([]string{link.Source, link.Target, strconv.Itoa(link.Weight)}); err != nil {
+			return err
+		}
+	}
+
+	csvWriter.Flush()
+
+	return csvWriter.Error()
+}
+
+// graphML represents a GraphML document.
+type graphML struct {
+	XMLName xml.Name     `xml:"graphml"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	Keys    []graphMLKey `xml:"key"`
+	Graph   graphMLGraph `xml:"graph"`
+}
+
+// graphMLKey represents a GraphML attribute definition.
+type graphMLKey struct {
+	ID            string `xml:"id,attr"`
+	For           string `xml:"for,attr"`
+	AttributeName string `xml:"attr.name,attr"`
+	AttributeType string `xml:"attr.type,attr"`
+}
+
+// graphMLGraph represents a GraphML graph.
+type graphMLGraph struct {
+	ID          string        `xml:"id,attr"`
+	EdgeDefault string        `xml:"edgedefault,attr"`
+	Nodes       []graphMLNode `xml:"node"`
+	Edges       []graphMLEdge `xml:"edge"`
+}
+
+// graphMLNode represents a GraphML node.
+type graphMLNode struct {
+	ID   string        `xml:"id,attr"`
+	Data []graphMLData `xml:"data"`
+}
+
+// graphMLEdge represents a GraphML edge.
+type graphMLEdge struct {
+	Source string        `xml:"source,attr"`
+	Target string        `xml:"target,attr"`
+	Data   []graphMLData `xml:"data"`
+}
+
+// graphMLData represents a GraphML attribute value.
+type graphMLData struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+// writeNetworkGraphML writes the network as GraphML.
+func writeNetworkGraphML(writer io.Writer, network Network) error {
+	document := graphML{
+		XMLNS: "http://graphml.graphdrawing.org/xmlns",
+		Keys: []graphMLKey{
+			{ID: "size", For: "node", AttributeName: "size", AttributeType: "int"},
+			{ID: "degree", For: "node", AttributeName: "degree", AttributeType: "int"},
+			{ID: "degree_centrality", For: "node", AttributeName: "degree_centrality", AttributeType: "double"},
+			{ID: "betweenness_centrality", For: "node", AttributeName: "betweenness_centrality", AttributeType: "double"},
+			{ID: "community", For: "node", AttributeName: "community", AttributeType: "int"},
+			{ID: "weight", For: "edge", AttributeName: "weight", AttributeType: "int"},
+		},
+		Graph: graphMLGraph{
+			ID:          "network",
+			EdgeDefault: "directed",
+		},
+	}
+
+	for _, node := range network.Nodes {
+		document.Graph.Nodes = append(document.Graph.Nodes, graphMLNode{
+			ID: node.ID,
+			Data: []graphMLData{
+				{Key: "size", Value: strconv.Itoa(node.Size)},
+				{Key: "degree", Value: strconv.Itoa(node.Degree)},
+				{Key: "degree_centrality", Value: strconv.FormatFloat(node.DegreeCentrality, 'f', -1, 64)},
+				{Key: "betweenness_centrality", Value: strconv.FormatFloat(node.BetweennessCentrality, 'f', -1, 64)},
+				{Key: "community", Value: strconv.Itoa(node.Community)},
+			},
+		})
+	}
+
+	for _, link := range network.Links {
+		document.Graph.Edges = append(document.Graph.Edges, graphMLEdge{
+			Source: link.Source,
+			Target: link.Target,
+			Data: []graphMLData{
+				{Key: "weight", Value: strconv.Itoa(link.Weight)},
+			},
+		})
+	}
+
+	return writeXML(writer, document)
+}
+
+// gexf represents a GEXF document.
+type gexf struct {
+	XMLName xml.Name  `xml:"gexf"`
+	XMLNS   string    `xml:"xmlns,attr"`
+	Version string    `xml:"version,attr"`
+	Graph   gexfGraph `xml:"graph"`
+}
+
+// gexfGraph represents a GEXF graph.
+type gexfGraph struct {
+	DefaultEdgeType string         `xml:"defaultedgetype,attr"`
+	Attributes      gexfAttributes `xml:"attributes"`
+	Nodes           []gexfNode     `xml:"nodes>node"`
+	Edges           []gexfEdge     `xml:"edges>edge"`
+}
+
+// gexfAttributes represents the GEXF attribute definitions of a class (node or edge).
+type gexfAttributes struct {
+	Class      string          `xml:"class,attr"`
+	Attributes []gexfAttribute `xml:"attribute"`
+}
+
+// gexfAttribute represents a GEXF attribute definition.
+type gexfAttribute struct {
+	ID    string `xml:"id,attr"`
+	Title string `xml:"title,attr"`
+	Type  string `xml:"type,attr"`
+}
+
+// gexfNode represents a GEXF node.
+type gexfNode struct {
+	ID              string               `xml:"id,attr"`
+	Label           string               `xml:"label,attr"`
+	AttributeValues []gexfAttributeValue `xml:"attvalues>attvalue"`
+}
+
+// gexfAttributeValue represents a GEXF attribute value.
+type gexfAttributeValue struct {
+	For   string `xml:"for,attr"`
+	Value string `xml:"value,attr"`
+}
+
+// gexfEdge represents a GEXF edge.
+type gexfEdge struct {
+	ID     int    `xml:"id,attr"`
+	Source string `xml:"source,attr"`
+	Target string `xml:"target,attr"`
+	Weight int    `xml:"weight,attr"`
+}
+
+// writeNetworkGEXF writes the network as GEXF.
+func writeNetworkGEXF(writer io.Writer, network Network) error {
+	document := gexf{
+		XMLNS:   "http://gexf.net/1.3",
+		Version: "1.3",
+		Graph: gexfGraph{
+			DefaultEdgeType: "directed",
+			Attributes: gexfAttributes{
+				Class: "node",
+				Attributes: []gexfAttribute{
+					{ID: "size", Title: "size", Type: "integer"},
+					{ID: "degree", Title: "degree", Type: "integer"},
+					{ID: "degree_centrality", Title: "degree_centrality", Type: "double"},
+					{ID: "betweenness_centrality", Title: "betweenness_centrality", Type: "double"},
+					{ID: "community", Title: "community", Type: "integer"},
+				},
+			},
+		},
+	}
+
+	for _, node := range network.Nodes {
+		document.Graph.Nodes = append(document.Graph.Nodes, gexfNode{
+			ID:    node.ID,
+			Label: node.ID,
+			AttributeValues: []gexfAttributeValue{
+				{For: "size", Value: strconv.Itoa(node.Size)},
+				{For: "degree", Value: strconv.Itoa(node.Degree)},
+				{For: "degree_centrality", Value: strconv.FormatFloat(node.DegreeCentrality, 'f', -1, 64)},
+				{For: "betweenness_centrality", Value: strconv.FormatFloat(node.BetweennessCentrality, 'f', -1, 64)},
+				{For: "community", Value: strconv.Itoa(node.Community)},
+			},
+		})
+	}
+
+	for i, link := range network.Links {
+		document.Graph.Edges = append(document.Graph.Edges, gexfEdge{
+			ID:     i,
+			Source: link.Source,
+			Target: link.Target,
+			Weight: link.Weight,
+		})
+	}
+
+	return writeXML(writer, document)
+}
+
+// writeXML writes the indented XML document including the XML header.
+func writeXML(writer io.Writer, document interface{}) error {
+	if _, err := io.WriteString(writer, xml.Header); err != nil {
+		return err
+	}
+
+	encoder := xml.NewEncoder(writer)
+	encoder.Indent("", "  ")
+
+	if err := encoder.Encode(document); err != nil {
+		return err
+	}
+
+	return encoder.Flush()
+}
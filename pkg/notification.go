@@ -0,0 +1,210 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"github.com/mattevans/postmark-go"
+	"html/template"
+)
+
+//go:embed notification.html
+var notificationTemplate string
+
+// NotificationSender defines the sender address of notification emails.
+// Notifications are disabled if the notification_sender configuration variable is unset.
+//
+// Deprecated: use Core.Config.NotificationSender.
+var NotificationSender string
+
+// NotificationPreferences represents the notification emails a user wants to receive.
+// Events are the webhook events (e.g. WebhookEventParsingFinished), only jobs submitted by the user are notified.
+type NotificationPreferences struct {
+	UserUUID string   `json:"user_uuid"`
+	Email    string   `json:"email"`
+	Events   []string `json:"events"`
+}
+
+// notificationMessages defines the subject and message of the notification events.
+var notificationMessages = map[string]struct {
+	Subject string
+	Message string
+}{
+	WebhookEventParsingFinished: {
+		Subject: "Your evidence finished parsing",
+		Message: "Your evidence finished parsing and is ready to be reviewed.",
+	},
+	WebhookEventExportReady: {
+		Subject: "Your export is ready",
+		Message: "Your export (or report) is ready to be downloaded.",
+	},
+	WebhookEventJobFailed: {
+		Subject: "Your job failed",
+		Message: "Your job failed after all attempts.",
+	},
+}
+
+// Save saves the notification preferences to the database.
+func (preferences *NotificationPreferences) Save(database *pgx.Conn) error {
+	encodedEvents, err := json.Marshal(preferences.Events)
+
+	if err != nil {
+		return err
+	}
+
+	preparedStatement := `
+	INSERT INTO notification_preferences(userUUID, email, events) VALUES ($1, $2, $3)
+	ON CONFLICT(userUUID) DO UPDATE SET email = $2, events = $3
+	`
+	_, err = database.Exec(context.Background(), preparedStatement, preferences.UserUUID, preferences.Email, string(encodedEvents))
+
+	return err
+}
+
+// SetNotificationPreferences sets the notification preferences of the user.
+// Use no events to disable all notifications.
+func SetNotificationPreferences(email string, events []string, userUUID string, database *pgx.Conn) error {
+	if len(events) > 0 && email == "" {
+		return errors.New("notification email is empty")
+	}
+
+	for _, event := range events {
+		if _, ok := notificationMessages[event]; !ok {
+			return fmt.Errorf("unsupported notification event: %s", event)
+		}
+	}
+
+	preferences := NotificationPreferences{
+		UserUUID: userUUID,
+		Email:    email,
+		Events:   events,
+	}
+
+	return preferences.Save(database)
+}
+
+// GetNotificationPreferences returns the notification preferences of the user.
+// Users without preferences don't receive notifications.
+func GetNotificationPreferences(userUUID string, database *pgx.Conn) (NotificationPreferences, error) {
+	preparedStatement := `
+	SELECT userUUID, email, events FROM notification_preferences WHERE userUUID = $1
+	`
+	row := database.QueryRow(context.Background(), preparedStatement, userUUID)
+
+	preferences := NotificationPreferences{
+		UserUUID: userUUID,
+	}
+
+	var encodedEvents string
+
+	if err := row.Scan(&preferences.UserUUID, &preferences.Email, &encodedEvents); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return preferences, nil
+		}
+
+		return NotificationPreferences{}, err
+	}
+
+	if err := json.Unmarshal([]byte(encodedEvents), &preferences.Events); err != nil {
+		return NotificationPreferences{}, err
+	}
+
+	return preferences, nil
+}
+
+// notifyUser emails the user who submitted the job if they want to receive the event.
+// Failures are logged since notifications must not fail the job.
+func notifyUser(event string, job Job, database *pgx.Conn) {
+	logger := Logger.WithFields(LogFields{"project_uuid": job.ProjectUUID, "job_uuid": job.UUID})
+
+	if NotificationSender == "" || job.UserUUID == "" {
+		return
+	}
+
+	preferences, err := GetNotificationPreferences(job.UserUUID, database)
+
+	if err != nil {
+		logger.Errorf("Failed to get notification preferences: %s", err)
+		return
+	}
+
+	wantsEvent := false
+
+	for _, preferredEvent := range preferences.Events {
+		if preferredEvent == event {
+			wantsEvent = true
+			break
+		}
+	}
+
+	if !wantsEvent || preferences.Email == "" {
+		return
+	}
+
+	project, err := GetProjectByUUID(job.ProjectUUID, database)
+
+	if err != nil {
+		logger.Errorf("Failed to get project: %s", err)
+		return
+	}
+
+	if err := sendNotificationEmail(preferences.Email, event, job, project); err != nil {
+		logger.Errorf("Failed to send notification email: %s", err)
+	}
+}
+
+// sendNotificationEmail sends the notification email of the event via Postmark.
+func sendNotificationEmail(email string, event string, job Job, project Project) error {
+	notificationMessage, ok := notificationMessages[event]
+
+	if !ok {
+		return fmt.Errorf("unsupported notification event: %s", event)
+	}
+
+	emailTemplate, err := template.New("notification").Parse(notificationTemplate)
+
+	if err != nil {
+		return err
+	}
+
+	var htmlBody bytes.Buffer
+
+	err = emailTemplate.Execute(&htmlBody, map[string]interface{}{
+		"subject":     notificationMessage.Subject,
+		"message":     notificationMessage.Message,
+		"projectName": project.Name,
+		"job":         job,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	textBody := fmt.Sprintf("%s\n\nProject: %s\nJob: %s (%s)\n", notificationMessage.Message, project.Name, job.Type, job.UUID)
+
+	if job.Error != "" {
+		textBody += fmt.Sprintf("Error: %s\n", job.Error)
+	}
+
+	notificationEmail := &postmark.Email{
+		From:     NotificationSender,
+		To:       email,
+		Subject:  fmt.Sprintf("%s (%s)", notificationMessage.Subject, project.Name),
+		HTMLBody: htmlBody.String(),
+		TextBody: textBody,
+		Tag:      event,
+	}
+
+	return retry(context.Background(), ExternalServiceRetryOptions, func() error {
+		_, _, err := PostmarkClient.Email.Send(notificationEmail)
+
+		return err
+	})
+}
@@ -0,0 +1,72 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"github.com/jackc/pgx/v4"
+	"golang.org/x/oauth2"
+	"net/http"
+)
+
+// googleEndpoint defines the Google OAuth2 endpoint.
+var googleEndpoint = oauth2.Endpoint{
+	AuthURL:  "https://accounts.google.com/o/oauth2/auth",
+	TokenURL: "https://oauth2.googleapis.com/token",
+}
+
+// googleProvider defines the Google OAuth2 provider used to collect Gmail.
+// Consent is forced since Google only returns a refresh token on the first consent otherwise.
+var googleProvider = &MailProvider{
+	Name: MailProviderGoogle,
+	EmailsConfig: &oauth2.Config{
+		Scopes: []string{
+			"https://mail.google.com/",
+			"email",
+		},
+		Endpoint: googleEndpoint,
+	},
+	ProfileConfig: &oauth2.Config{
+		Scopes: []string{
+			"openid",
+			"email",
+		},
+		Endpoint: googleEndpoint,
+	},
+	AuthCodeOptions:   []oauth2.AuthCodeOption{oauth2.ApprovalForce},
+	ProfileURL:        "https://openidconnect.googleapis.com/v1/userinfo",
+	ProfileEmailField: "email",
+	IMAPHost:          "imap.gmail.com",
+	IMAPPort:          993,
+}
+
+// GetGoogleEmailsAuthURL returns the authentication URL to Google (emails).
+func GetGoogleEmailsAuthURL() string {
+	return googleProvider.GetEmailsAuthURL()
+}
+
+// GetGoogleUserProfileAuthURL returns the authentication URL to Google (profile).
+func GetGoogleUserProfileAuthURL() string {
+	return googleProvider.GetProfileAuthURL()
+}
+
+// SaveGoogleEmailsToken exchanges the authorization code for a token and stores it for the user, see GetValidToken.
+func SaveGoogleEmailsToken(request *http.Request, userUUID string, database *pgx.Conn) error {
+	return googleProvider.SaveEmailsToken(request, userUUID, database)
+}
+
+// GetGoogleUserProfileAccessToken exchanges the authorization code for an access token.
+func GetGoogleUserProfileAccessToken(request *http.Request) (string, error) {
+	token, err := googleProvider.ExchangeProfileToken(request)
+
+	if err != nil {
+		return "", err
+	}
+
+	return token.AccessToken, nil
+}
+
+// GetGoogleUserProfile returns the user email.
+func GetGoogleUserProfile(token string) (string, error) {
+	return googleProvider.GetUserProfile(token)
+}
@@ -4,35 +4,20 @@
 package core
 
 import (
-	"context"
-	"encoding/json"
 	"fmt"
-	"github.com/spf13/viper"
+	"github.com/jackc/pgx/v4"
 	"golang.org/x/oauth2"
-	"io/ioutil"
 	"net/http"
-	"net/url"
 )
 
 // Variables defining our Microsoft OAuth2 credentials.
+//
+// Deprecated: use Core.Config.MicrosoftClientID and Core.Config.MicrosoftClientSecret.
 var (
 	MicrosoftClientID     string
 	MicrosoftClientSecret string
 )
 
-func init() {
-	microsoftConfigurationVariables := []string{"microsoft_client_id", "microsoft_client_secret"}
-
-	for _, configurationVariable := range microsoftConfigurationVariables {
-		if !viper.IsSet(configurationVariable) {
-			Logger.Fatalf("unset %s configuration variable", configurationVariable)
-		}
-	}
-
-	MicrosoftClientID = viper.GetString("microsoft_client_id")
-	MicrosoftClientSecret = viper.GetString("microsoft_client_secret")
-}
-
 var OutlookOAuth2Config = &oauth2.Config{
 	ClientID:     MicrosoftClientID,
 	ClientSecret: MicrosoftClientSecret,
@@ -62,27 +47,31 @@ var OutlookUserProfileOAuth2Config = &oauth2.Config{
 	},
 }
 
+// outlookProvider defines the Outlook OAuth2 provider.
+var outlookProvider = &MailProvider{
+	Name:              MailProviderOutlook,
+	EmailsConfig:      OutlookOAuth2Config,
+	ProfileConfig:     OutlookUserProfileOAuth2Config,
+	ProfileURL:        "https://graph.microsoft.com/v1.0/me",
+	ProfileEmailField: "userPrincipalName",
+	IMAPHost:          "outlook.office365.com",
+	IMAPPort:          993,
+}
+
 // GetOutlookEmailsAuthURL returns the authentication URL to Outlook (emails).
 func GetOutlookEmailsAuthURL() string {
-	return OutlookOAuth2Config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
+	return outlookProvider.GetEmailsAuthURL()
 }
 
 // GetOutlookUserProfileAuthURL returns the authentication URL to Outlook (profile).
 func GetOutlookUserProfileAuthURL() string {
-	return OutlookUserProfileOAuth2Config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
+	return outlookProvider.GetProfileAuthURL()
 }
 
 // GetOutlookEmailsAccessToken exchange the authorization code for an access token.
+// The access token expires during long collections, use SaveOutlookEmailsToken instead.
 func GetOutlookEmailsAccessToken(request *http.Request) (string, error) {
-	queryParts, err := url.ParseQuery(request.URL.RawQuery)
-
-	if err != nil {
-		return "", err
-	}
-
-	code := queryParts["code"][0]
-
-	token, err := OutlookOAuth2Config.Exchange(context.Background(), code)
+	token, err := outlookProvider.ExchangeEmailsToken(request)
 
 	if err != nil {
 		return "", err
@@ -91,17 +80,14 @@ func GetOutlookEmailsAccessToken(request *http.Request) (string, error) {
 	return token.AccessToken, nil
 }
 
+// SaveOutlookEmailsToken exchanges the authorization code for a token and stores it for the user, see GetValidToken.
+func SaveOutlookEmailsToken(request *http.Request, userUUID string, database *pgx.Conn) error {
+	return outlookProvider.SaveEmailsToken(request, userUUID, database)
+}
+
 // GetOutlookUserProfileAccessToken exchange the authorization code for an access token.
 func GetOutlookUserProfileAccessToken(request *http.Request) (string, error) {
-	queryParts, err := url.ParseQuery(request.URL.RawQuery)
-
-	if err != nil {
-		return "", err
-	}
-
-	code := queryParts["code"][0]
-
-	token, err := OutlookUserProfileOAuth2Config.Exchange(context.Background(), code)
+	token, err := outlookProvider.ExchangeProfileToken(request)
 
 	if err != nil {
 		return "", err
@@ -112,37 +98,5 @@ func GetOutlookUserProfileAccessToken(request *http.Request) (string, error) {
 
 // GetOutlookUserProfile returns the user email.
 func GetOutlookUserProfile(token string) (string, error) {
-	request, err := http.NewRequest("GET", "https://graph.microsoft.com/v1.0/me", nil)
-
-	request.Header.Add("Authorization", "Bearer "+token)
-
-	response, err := http.DefaultClient.Do(request)
-
-	if err != nil {
-		return "", err
-	}
-
-	defer func() {
-		err := response.Body.Close()
-
-		if err != nil {
-			Logger.Errorf("Failed to close response body: %s", err)
-		}
-	}()
-
-	body, err := ioutil.ReadAll(response.Body)
-
-	if err != nil {
-		return "", err
-	}
-
-	var responseMap map[string]interface{}
-
-	if err := json.Unmarshal(body, &responseMap); err != nil {
-		return "", err
-	}
-
-	Logger.Infof("Response map: %s", responseMap)
-
-	return responseMap["userPrincipalName"].(string), nil
+	return outlookProvider.GetUserProfile(token)
 }
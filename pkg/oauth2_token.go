@@ -0,0 +1,192 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/jackc/pgx/v4"
+	"golang.org/x/oauth2"
+	"strings"
+)
+
+// TokenEncryptionKey defines the key used to encrypt the stored OAuth2 tokens if key management is disabled (see KeyWrappers).
+// Storing tokens is disabled if neither the token_encryption_key nor the master_keys configuration variable is set.
+//
+// Deprecated: use Core.Config.TokenEncryptionKey.
+var TokenEncryptionKey []byte
+
+// ErrTokenStorageDisabled is returned if tokens are stored without a token encryption key.
+var ErrTokenStorageDisabled = errors.New("token storage is disabled, set the token_encryption_key or master_keys configuration variable")
+
+// ErrTokenNotFound is returned if the user has no stored token for the provider.
+var ErrTokenNotFound = errors.New("no token found, the user must authenticate with the provider")
+
+// dataKeyTokenPrefix defines the prefix of tokens encrypted with a data encryption key instead of the TokenEncryptionKey.
+const dataKeyTokenPrefix = "dek:"
+
+// SaveToken stores the encrypted token of the user, replacing the previous token.
+// The token is encrypted with the data encryption key of the tokens if key management is enabled, otherwise with the TokenEncryptionKey.
+func SaveToken(token *oauth2.Token, provider string, userUUID string, database *pgx.Conn) error {
+	if TokenEncryptionKey == nil && len(KeyWrappers) == 0 {
+		return ErrTokenStorageDisabled
+	}
+
+	encodedToken, err := json.Marshal(token)
+
+	if err != nil {
+		return err
+	}
+
+	encryptedToken, err := encryptToken(string(encodedToken), database)
+
+	if err != nil {
+		return err
+	}
+
+	preparedStatement := `
+	INSERT INTO oauth2_tokens(userUUID, provider, encryptedToken) VALUES ($1, $2, $3)
+	ON CONFLICT (userUUID, provider) DO UPDATE SET encryptedToken = EXCLUDED.encryptedToken
+	`
+	_, err = database.Exec(context.Background(), preparedStatement, userUUID, provider, encryptedToken)
+
+	return err
+}
+
+// getToken returns the stored token of the user.
+func getToken(provider string, userUUID string, database *pgx.Conn) (*oauth2.Token, error) {
+	if TokenEncryptionKey == nil && len(KeyWrappers) == 0 {
+		return nil, ErrTokenStorageDisabled
+	}
+
+	preparedStatement := `
+	SELECT encryptedToken FROM oauth2_tokens WHERE userUUID = $1 AND provider = $2
+	`
+	row := database.QueryRow(context.Background(), preparedStatement, userUUID, provider)
+
+	var encryptedToken string
+
+	if err := row.Scan(&encryptedToken); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrTokenNotFound
+		}
+
+		return nil, err
+	}
+
+	encodedToken, err := decryptToken(encryptedToken, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var token oauth2.Token
+
+	if err := json.Unmarshal([]byte(encodedToken), &token); err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// encryptToken encrypts the encoded token with the data encryption key of the tokens or, if key management is disabled, the TokenEncryptionKey.
+func encryptToken(encodedToken string, database *pgx.Conn) (string, error) {
+	if len(KeyWrappers) == 0 {
+		return encryptValue(TokenEncryptionKey, encodedToken)
+	}
+
+	tokenKey, err := getDataKey(tokenDataKeyScope, database)
+
+	if err != nil {
+		return "", err
+	}
+
+	encryptedToken, err := encryptValue(tokenKey.key, encodedToken)
+
+	if err != nil {
+		return "", err
+	}
+
+	return dataKeyTokenPrefix + encryptedToken, nil
+}
+
+// decryptToken decrypts the token encrypted by encryptToken.
+// Tokens stored before key management was enabled are encrypted with the TokenEncryptionKey, they are re-encrypted when refreshed.
+func decryptToken(encryptedToken string, database *pgx.Conn) (string, error) {
+	if !strings.HasPrefix(encryptedToken, dataKeyTokenPrefix) {
+		if TokenEncryptionKey == nil {
+			return "", ErrTokenStorageDisabled
+		}
+
+		return decryptValue(TokenEncryptionKey, encryptedToken)
+	}
+
+	tokenKey, err := getDataKey(tokenDataKeyScope, database)
+
+	if err != nil {
+		return "", err
+	}
+
+	return decryptValue(tokenKey.key, strings.TrimPrefix(encryptedToken, dataKeyTokenPrefix))
+}
+
+// GetValidToken returns the stored token of the user, refreshed with the refresh token if it has expired.
+// The refreshed token is stored again so the new refresh token isn't lost.
+func GetValidToken(userUUID string, provider string, database *pgx.Conn) (*oauth2.Token, error) {
+	mailProvider, err := GetMailProvider(provider)
+
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := getToken(provider, userUUID, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if token.Valid() {
+		return token, nil
+	}
+
+	var refreshedToken *oauth2.Token
+
+	err = retry(context.Background(), ExternalServiceRetryOptions, func() error {
+		var err error
+
+		refreshedToken, err = mailProvider.EmailsConfig.TokenSource(context.Background(), token).Token()
+
+		var retrieveError *oauth2.RetrieveError
+
+		if errors.As(err, &retrieveError) && retrieveError.Response != nil && retrieveError.Response.StatusCode < 500 {
+			return retryPermanent(err)
+		}
+
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := SaveToken(refreshedToken, provider, userUUID, database); err != nil {
+		return nil, err
+	}
+
+	return refreshedToken, nil
+}
+
+// getValidAccessToken returns a function returning the valid access token of the user, used by collectors to reauthenticate.
+func getValidAccessToken(userUUID string, provider string, database *pgx.Conn) func() (string, error) {
+	return func() (string, error) {
+		token, err := GetValidToken(userUUID, provider, database)
+
+		if err != nil {
+			return "", err
+		}
+
+		return token.AccessToken, nil
+	}
+}
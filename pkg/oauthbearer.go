@@ -0,0 +1,46 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"fmt"
+	"github.com/emersion/go-sasl"
+	"strings"
+)
+
+// OAuthBearer is the RFC 7628 SASL mechanism replacing XOAUTH2.
+const OAuthBearer = sasl.OAuthBearer
+
+// SASLMechanisms defines the SASL mechanism per OAuth2 provider, XOAUTH2 is used for unset providers.
+//
+// Deprecated: use Core.Config.SASLMechanisms.
+var SASLMechanisms map[string]string
+
+// NewOAuthBearerClient returns an OAUTHBEARER client, the host and port are those of the server being authenticated to.
+func NewOAuthBearerClient(username string, token string, host string, port int) sasl.Client {
+	return sasl.NewOAuthBearerClient(&sasl.OAuthBearerOptions{
+		Username: username,
+		Token:    token,
+		Host:     host,
+		Port:     port,
+	})
+}
+
+// newSASLClient returns the SASL client of the mechanism configured for the provider.
+func newSASLClient(provider string, username string, token string, host string, port int) (sasl.Client, error) {
+	mechanism, ok := SASLMechanisms[provider]
+
+	if !ok || mechanism == "" {
+		mechanism = Xoauth2
+	}
+
+	switch strings.ToUpper(mechanism) {
+	case Xoauth2:
+		return NewXoauth2Client(username, token), nil
+	case OAuthBearer:
+		return NewOAuthBearerClient(username, token, host, port), nil
+	default:
+		return nil, fmt.Errorf("unsupported SASL mechanism for %s: %s", provider, mechanism)
+	}
+}
@@ -0,0 +1,69 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+)
+
+// ErrOriginalMessageUnavailable is returned by GetOriginalMessage if the original message wasn't preserved.
+// PST messages aren't preserved individually since go-pst can't extract them as .msg,
+// the PST file itself is preserved as evidence (see Evidence.FileHash).
+var ErrOriginalMessageUnavailable = errors.New("original message is unavailable")
+
+// preserveOriginalMessage stores the exact original bytes of the message in MinIO keyed by the message UUID.
+// The extension is the file type of the original, e.g. ".eml" for MIME messages.
+// The size of the message is the size of the original.
+func preserveOriginalMessage(message *Message, original []byte, extension string) error {
+	objectName := fmt.Sprintf("%s/originals/%s%s", message.ProjectUUID, message.UUID, extension)
+
+	if err := uploadObject(objectName, original, "application/octet-stream"); err != nil {
+		return err
+	}
+
+	originalHash := sha256.Sum256(original)
+
+	message.OriginalObject = objectName
+	message.OriginalHash = hex.EncodeToString(originalHash[:])
+	message.Size = MessageSize(len(original))
+
+	return nil
+}
+
+// GetOriginalMessage returns the exact original bytes of the parsed message (the MIME source of EML and IMAP messages).
+// The bytes are verified against the SHA-256 hash recorded while parsing.
+// Returns ErrOriginalMessageUnavailable if the original wasn't preserved.
+func GetOriginalMessage(messageUUID string, projectUUID string, userUUID string, database *pgx.Conn) ([]byte, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return nil, err
+	}
+
+	message, err := getMessageByUUID(messageUUID, projectUUID, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if message.OriginalObject == "" {
+		return nil, ErrOriginalMessageUnavailable
+	}
+
+	original, err := getObjectBytes(message.OriginalObject)
+
+	if err != nil {
+		return nil, err
+	}
+
+	originalHash := sha256.Sum256(original)
+
+	if hex.EncodeToString(originalHash[:]) != message.OriginalHash {
+		return nil, fmt.Errorf("original message %s does not match its hash %s", messageUUID, message.OriginalHash)
+	}
+
+	return original, nil
+}
@@ -0,0 +1,73 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"github.com/jackc/pgx/v4"
+	"time"
+)
+
+// ParseOptions represents the options of parsing evidence.
+type ParseOptions struct {
+	// BestEffort records unreadable folders and messages as parse errors and continues parsing instead of aborting, see GetParseErrors.
+	BestEffort bool `json:"best_effort"`
+	// AnalyzeSentiment scores the sentiment of the messages while parsing if a sentiment provider is configured.
+	// Messages which fail to score are indexed unscored, see ScoreProjectSentiment.
+	AnalyzeSentiment bool `json:"analyze_sentiment"`
+	// Priority is the priority of the parse job (set by the job worker), low priority parsing is throttled, see JobPriorityLow.
+	Priority string `json:"-"`
+}
+
+// ParseError represents an item of the evidence which failed to parse.
+type ParseError struct {
+	UUID         string `json:"uuid"`
+	EvidenceUUID string `json:"evidence_uuid"`
+	Item         string `json:"item"` // Identifies the item in the evidence, e.g. the folder path of a PST folder or the file path of an EML file.
+	Error        string `json:"error"`
+	CreationDate int    `json:"creation_date"`
+}
+
+// saveParseError stores the parse error of the item.
+func saveParseError(evidenceUUID string, projectUUID string, item string, parseError error, database *pgx.Conn) error {
+	preparedStatement := `
+	INSERT INTO parse_errors(uuid, projectUUID, evidenceUUID, item, error, creationDate) VALUES ($1, $2, $3, $4, $5, $6)
+	`
+	_, err := database.Exec(context.Background(), preparedStatement, NewUUID(), projectUUID, evidenceUUID, item, parseError.Error(), time.Now().Unix())
+
+	return err
+}
+
+// GetParseErrors returns the items of the evidence which failed to parse.
+func GetParseErrors(evidenceUUID string, projectUUID string, userUUID string, database *pgx.Conn) ([]ParseError, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return nil, err
+	}
+
+	preparedStatement := `
+	SELECT uuid, evidenceUUID, item, error, creationDate FROM parse_errors
+	WHERE projectUUID = $1 AND evidenceUUID = $2 ORDER BY creationDate
+	`
+	rows, err := database.Query(context.Background(), preparedStatement, projectUUID, evidenceUUID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var parseErrors []ParseError
+
+	for rows.Next() {
+		var parseError ParseError
+
+		if err := rows.Scan(&parseError.UUID, &parseError.EvidenceUUID, &parseError.Item, &parseError.Error, &parseError.CreationDate); err != nil {
+			return nil, err
+		}
+
+		parseErrors = append(parseErrors, parseError)
+	}
+
+	rows.Close()
+
+	return parseErrors, rows.Err()
+}
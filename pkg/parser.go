@@ -3,16 +3,80 @@
 // Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
 package core
 
-import "github.com/jackc/pgx/v4"
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"path/filepath"
+)
 
 // Parser is an interface for file parsers.
 type Parser interface {
 	GetName() string
 	GetSupportedFileExtensions() []string
-	Parse(evidence *Evidence, project Project, database *pgx.Conn) error
+	// GetVersion returns the version of the parser, stored in the provenance of the parsed messages.
+	GetVersion() string
+	// GetFileSignatures returns the magic bytes at the start of the supported files, see getEvidenceParser.
+	GetFileSignatures() [][]byte
+	// Parse parses the evidence, reporting the progress to the progress reporter.
+	Parse(evidence *Evidence, project Project, options ParseOptions, progressReporter ProgressReporter, database *pgx.Conn) error
+	// Validate checks the signature and previews the folder structure of the evidence without parsing it, see ValidateEvidence.
+	Validate(evidence *Evidence, project Project) (EvidencePreview, error)
 }
 
+// fileSignatureSize defines the bytes read from the start of the evidence to detect its parser.
+const fileSignatureSize = 8
+
 // GetParsers returns a list of all available parsers.
 func GetParsers() []Parser {
-	return []Parser{PSTParser{}, EMLParser{}}
+	return []Parser{PSTParser{}, EMLParser{}, MboxParser{}}
+}
+
+// getParserByName returns the parser with the name (see Parser.GetName).
+func getParserByName(name string) (Parser, error) {
+	for _, parser := range GetParsers() {
+		if parser.GetName() == name {
+			return parser, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown parser: %s", name)
+}
+
+// getEvidenceParser returns the parser of the evidence: the pinned parser (see SetEvidenceParser),
+// otherwise the parser matching the file signature, otherwise the parser supporting the file extension.
+func getEvidenceParser(evidence Evidence) (Parser, error) {
+	if evidence.Parser != "" {
+		return getParserByName(evidence.Parser)
+	}
+
+	header, err := readEvidenceHeader(evidence, fileSignatureSize)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, parser := range GetParsers() {
+		for _, signature := range parser.GetFileSignatures() {
+			if bytes.HasPrefix(header, signature) {
+				return parser, nil
+			}
+		}
+	}
+
+	return getParserByFileName(evidence.FileName)
+}
+
+// getParserByFileName returns the first parser which supports the extension of the file name.
+func getParserByFileName(fileName string) (Parser, error) {
+	for _, parser := range GetParsers() {
+		for _, extension := range parser.GetSupportedFileExtensions() {
+			if filepath.Ext(fileName) == extension {
+				return parser, nil
+			}
+		}
+	}
+
+	return nil, errors.New("failed to find supported parser")
 }
@@ -4,12 +4,12 @@
 package core
 
 import (
+	"archive/zip"
 	"context"
 	"fmt"
 	_ "github.com/emersion/go-message/charset"
 	"github.com/emersion/go-message/mail"
 	"github.com/jackc/pgx/v4"
-	"github.com/segmentio/kafka-go"
 	"golang.org/x/sync/errgroup"
 	"io"
 	"io/fs"
@@ -17,7 +17,6 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
-	"time"
 )
 
 // EMLParser handles parsing EML files using go-message.
@@ -35,36 +34,47 @@ func (parser EMLParser) GetSupportedFileExtensions() []string {
 	return []string{".zip"}
 }
 
+// GetVersion returns the module version of go-message.
+func (parser EMLParser) GetVersion() string {
+	return getModuleVersion(emlModulePath)
+}
+
+// GetFileSignatures returns the magic bytes of ZIP files (including empty ZIP files).
+func (parser EMLParser) GetFileSignatures() [][]byte {
+	return [][]byte{[]byte("PK\x03\x04"), []byte("PK\x05\x06")}
+}
+
 // Parse parses the PST file.
-func (parser EMLParser) Parse(evidence *Evidence, project Project, database *pgx.Conn) error {
+func (parser EMLParser) Parse(evidence *Evidence, project Project, options ParseOptions, progressReporter ProgressReporter, database *pgx.Conn) error {
+	logger := Logger.WithFields(LogFields{"project_uuid": project.UUID, "evidence_uuid": evidence.UUID})
+
 	errorGroup, _ := errgroup.WithContext(context.Background())
 
 	errorGroup.Go(func() error {
+		progressReporter.ReportProgress(ProgressEvent{Stage: ProgressStageDownloading})
+
 		evidencePath, err := DownloadEvidence(*evidence, project.UUID)
 
 		if err != nil {
-			Logger.Errorf("Failed to download evidence: %s", err)
+			logger.Errorf("Failed to download evidence: %s", err)
 			return err
 		}
 
-		unzippedUUID := NewUUID()
-		unzippedDirectory := fmt.Sprintf("%s/%s", GetProjectTempDirectory(project.UUID), unzippedUUID)
+		defer func() {
+			if err := os.Remove(evidencePath); err != nil {
+				logger.Errorf("Failed to cleanup evidence file: %s", err)
+			}
+		}()
 
-		err = os.Mkdir(unzippedDirectory, 0755)
+		scratchSpace, err := NewScratchSpace(project.UUID)
 
 		if err != nil {
 			return err
 		}
 
-		defer func() {
-			if err := os.Remove(evidencePath); err != nil {
-				Logger.Errorf("Failed to cleanup evidence file: %s", err)
-			}
+		defer scratchSpace.cleanup()
 
-			if err := os.RemoveAll(unzippedUUID); err != nil {
-				Logger.Errorf("Failed to cleanup evidence: %s", err)
-			}
-		}()
+		unzippedDirectory := scratchSpace.Path
 
 		// Unzip the evidence.
 		err = Unzip(evidencePath, unzippedDirectory)
@@ -73,45 +83,41 @@ func (parser EMLParser) Parse(evidence *Evidence, project Project, database *pgx
 			return err
 		}
 
-		// Create our root tree node for EML files.
-		rootTreeNode := TreeNode{
-			FolderUUID:   NewUUID(),
-			ProjectUUID:  project.UUID,
-			EvidenceUUID: evidence.UUID,
-			Title:        strings.Split(evidence.FileName, "-")[1],
-			Parent:       "NULL",
+		pipeline, err := newEvidencePipeline(project, evidence, parser, options, progressReporter, database)
+
+		if err != nil {
+			logger.Errorf("Failed to create pipeline: %s", err)
+			return err
 		}
 
-		if err := rootTreeNode.Save(database); err != nil {
-			Logger.Errorf("Failed to save tree node to database: %s", err)
+		// Create our root tree node for EML files.
+		rootTreeNode, err := pipeline.CreateFolder(strings.Split(evidence.FileName, "-")[1], "NULL")
+
+		if err != nil {
+			logger.Errorf("Failed to save tree node to database: %s", err)
 			return err
 		}
 
 		// Walk the EML files.
-		var kafkaMessages []kafka.Message
-
 		err = filepath.WalkDir(unzippedDirectory, func(path string, entry fs.DirEntry, err error) error {
-			if !entry.IsDir() {
-				message, err := parseEMLFile(path, project, rootTreeNode)
+			if !entry.IsDir() && strings.EqualFold(filepath.Ext(path), ".vcf") {
+				if err := parseVCardFile(path, pipeline, rootTreeNode); err != nil {
+					item, _ := filepath.Rel(unzippedDirectory, path)
 
-				if err != nil {
-					Logger.Errorf("Failed to parse EML file: %s", err)
-					return nil
+					return pipeline.EmitFailure(item, err)
 				}
+			} else if !entry.IsDir() {
+				message, err := parseEMLFile(path, pipeline, rootTreeNode)
 
-				kafkaMessages = append(kafkaMessages, kafka.Message{
-					Key:   []byte(message.UUID),
-					Value: []byte(message.JSON()),
-				})
-
-				if len(kafkaMessages) > 100 {
-					err := KafkaWriter.WriteMessages(context.Background(), kafkaMessages...)
+				if err != nil {
+					// Malformed EML files are always skipped.
+					item, _ := filepath.Rel(unzippedDirectory, path)
 
-					if err != nil {
-						return err
-					}
+					return pipeline.EmitFailure(item, err)
+				}
 
-					kafkaMessages = []kafka.Message{}
+				if err := pipeline.EmitMessage(message); err != nil {
+					return err
 				}
 			}
 
@@ -122,45 +128,106 @@ func (parser EMLParser) Parse(evidence *Evidence, project Project, database *pgx
 			return err
 		}
 
-		if len(kafkaMessages) > 0 {
-			err := KafkaWriter.WriteMessages(context.Background(), kafkaMessages...)
+		return pipeline.Close()
+	})
 
-			if err != nil {
-				return err
-			}
+	return errorGroup.Wait()
+}
+
+// Validate checks the ZIP file and previews its EML files using the ZIP entries, nothing is extracted.
+// All files are parsed into the root folder.
+func (parser EMLParser) Validate(evidence *Evidence, project Project) (EvidencePreview, error) {
+	logger := Logger.WithFields(LogFields{"project_uuid": project.UUID, "evidence_uuid": evidence.UUID})
+
+	evidencePath, err := DownloadEvidence(*evidence, project.UUID)
+
+	if err != nil {
+		return EvidencePreview{}, err
+	}
+
+	defer func() {
+		if err := os.Remove(evidencePath); err != nil {
+			logger.Errorf("Failed to cleanup evidence file: %s", err)
 		}
+	}()
 
-		return nil
-	})
+	zipReader, err := zip.OpenReader(evidencePath)
 
-	return errorGroup.Wait()
+	if err != nil {
+		// Not a (valid) ZIP file.
+		return EvidencePreview{}, nil
+	}
+
+	defer func() {
+		if err := zipReader.Close(); err != nil {
+			logger.Errorf("Failed to close ZIP file: %s", err)
+		}
+	}()
+
+	preview := EvidencePreview{
+		IsValidSignature: true,
+		RootFolder: FolderPreview{
+			Title: strings.Split(evidence.FileName, "-")[1],
+		},
+	}
+
+	var otherFiles int
+
+	for _, zipFile := range zipReader.File {
+		if zipFile.FileInfo().IsDir() {
+			continue
+		}
+
+		// vCard files are parsed as contacts.
+		if strings.EqualFold(filepath.Ext(zipFile.Name), ".vcf") {
+			continue
+		}
+
+		preview.RootFolder.Messages++
+
+		if !strings.EqualFold(filepath.Ext(zipFile.Name), ".eml") {
+			otherFiles++
+		}
+	}
+
+	if preview.RootFolder.Messages == 0 {
+		preview.Warnings = append(preview.Warnings, "ZIP file contains no files")
+	}
+
+	if otherFiles > 0 {
+		preview.Warnings = append(preview.Warnings, fmt.Sprintf("%d files aren't .eml files and may fail to parse", otherFiles))
+	}
+
+	return preview, nil
 }
 
-// Taken from  https://github.com/sg3des/eml/blob/master/date.go
-var dateFormats = []string{
-	`Mon, 02 Jan 2006 15:04 -0700`,
-	`02 Jan 2006 15:04 -0700`,
-	`Mon, 02 Jan 2006 15:04:05 -0700`,
-	`02 Jan 2006 15:04:05 -0700`,
-
-	`Mon, 02 Jan 2006 15:04 -0700 (MST)`,
-	`02 Jan 2006 15:04 -0700 (MST)`,
-	`Mon, 02 Jan 2006 15:04:05 -0700 (MST)`,
-	`02 Jan 2006 15:04:05 -0700 (MST)`,
-
-	`Mon, 2 Jan 2006 15:04 -0700`,
-	`2 Jan 2006 15:04 -0700`,
-	`Mon, 2 Jan 2006 15:04:05 -0700`,
-	`2 Jan 2006 15:04:05 -0700`,
-
-	`Mon, 2 Jan 2006 15:04 -0700 (MST)`,
-	`2 Jan 2006 15:04 -0700 (MST)`,
-	`Mon, 2 Jan 2006 15:04:05 -0700 (MST)`,
-	`2 Jan 2006 15:04:05 -0700 (MST)`,
+// parseVCardFile emits the contacts of the vCard file to the pipeline.
+func parseVCardFile(path string, pipeline *Pipeline, folder TreeNode) error {
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return err
+	}
+
+	contacts, err := parseVCards(data)
+
+	if err != nil {
+		return err
+	}
+
+	for _, contact := range contacts {
+		contact.FolderUUID = folder.FolderUUID
+
+		pipeline.EmitContact(contact)
+	}
+
+	return nil
 }
 
-// parseEMLFile parses the EML file.
-func parseEMLFile(path string, project Project, rootTreeNode TreeNode) (Message, error) {
+// parseEMLFile parses the EML file into a message of the folder, attachments are emitted to the pipeline.
+func parseEMLFile(path string, pipeline *Pipeline, folder TreeNode) (Message, error) {
+	logger := Logger.WithFields(LogFields{"project_uuid": pipeline.project.UUID})
+
 	inputFile, err := os.Open(path)
 
 	if err != nil {
@@ -171,7 +238,7 @@ func parseEMLFile(path string, project Project, rootTreeNode TreeNode) (Message,
 		err := inputFile.Close()
 
 		if err != nil {
-			Logger.Errorf("Failed to close file: %s", err)
+			logger.Errorf("Failed to close file: %s", err)
 		}
 	}()
 
@@ -179,6 +246,7 @@ func parseEMLFile(path string, project Project, rootTreeNode TreeNode) (Message,
 	var headerBuilder strings.Builder
 	var bodyBuilder strings.Builder
 	var attachments []Attachment
+	var receivedHeaders []string
 
 	mailReader, err := mail.CreateReader(inputFile)
 
@@ -190,37 +258,29 @@ func parseEMLFile(path string, project Project, rootTreeNode TreeNode) (Message,
 
 	for fields.Next() {
 		if fields.Key() == "Subject" {
-			message.Subject = fields.Value()
+			message.Subject = decodeHeaderField(fields)
 		}
 		if fields.Key() == "To" {
-			message.To = fields.Value()
+			message.To = decodeHeaderField(fields)
 		}
 		if fields.Key() == "From" {
-			message.From = fields.Value()
+			message.From = decodeHeaderField(fields)
 		}
 		if fields.Key() == "CC" {
-			message.CC = fields.Value()
+			message.CC = decodeHeaderField(fields)
 		}
 		if fields.Key() == "Date" {
-			foundDateFormat := false
-
-			for _, dateFormat := range dateFormats {
-				t, err := time.Parse(dateFormat, fields.Value())
-
-				if err == nil {
-					message.Received = int(t.Unix())
-					foundDateFormat = true
-					break
-				}
-			}
-
-			if !foundDateFormat {
-				Logger.Warnf("Failed to parse data format: %s", fields.Value())
-				message.Received = 0
+			if date, err := parseMessageDate(fields.Value()); err == nil {
+				message.Received = int(date.Unix())
+			} else {
+				logger.Warnf("Failed to parse date: %s", fields.Value())
 			}
 		}
+		if fields.Key() == "Received" {
+			receivedHeaders = append(receivedHeaders, fields.Value())
+		}
 
-		headerBuilder.WriteString(fmt.Sprintf("%s: %s\n", fields.Key(), fields.Value()))
+		headerBuilder.WriteString(fmt.Sprintf("%s: %s\n", fields.Key(), decodeHeaderField(fields)))
 	}
 
 	for {
@@ -232,80 +292,145 @@ func parseEMLFile(path string, project Project, rootTreeNode TreeNode) (Message,
 			return Message{}, err
 		}
 
+		// Nested multiparts are flattened and transfer encodings (e.g. base64) are decoded by go-message.
 		switch h := part.Header.(type) {
 		case *mail.InlineHeader:
-			contentDisposition, params, err := part.Header.(*mail.InlineHeader).ContentDisposition()
+			fileName, err := getInlinePartFilename(h)
 
 			if err != nil {
-				continue
+				logger.Warnf("Failed to get inline part filename: %s", err)
 			}
 
-			if contentDisposition == "inline" {
-				// Attachment
-				attachment := Attachment{
-					UUID: NewUUID(),
-					Name: params["filename"],
-				}
-
-				attachments = append(attachments, attachment)
-
-				// Write the attachment to disk then upload it to MinIO.
-				body, err := ioutil.ReadAll(part.Body)
-
-				if err != nil {
-					return Message{}, nil
-				}
-
-				err = ioutil.WriteFile(fmt.Sprintf("%s/%s", GetProjectTempDirectory(project.UUID), attachment.UUID), body, 0755)
-
-				if err != nil {
-					return Message{}, err
-				}
-
-				_, err = UploadFile(attachment.UUID, fmt.Sprintf("%s/%s", GetProjectTempDirectory(project.UUID), attachment.UUID), project.UUID)
+			if fileName != "" {
+				// Inline attachment, e.g. an embedded image.
+				attachment, err := emitEMLAttachment(pipeline, fileName, part.Body)
 
 				if err != nil {
 					return Message{}, err
 				}
 
-				err = os.Remove(fmt.Sprintf("%s/%s", GetProjectTempDirectory(project.UUID), attachment.UUID))
-
-				if err != nil {
-					return Message{}, err
-				}
+				attachments = append(attachments, attachment)
 			} else {
 				body, err := ioutil.ReadAll(part.Body)
 
 				if err != nil {
-					return Message{}, nil
+					return Message{}, err
 				}
 
-				bodyBuilder.WriteString(string(body))
+				// Parts without a charset declaration aren't decoded by go-message.
+				bodyBuilder.WriteString(decodeText(body))
 			}
 
-			fields := part.Header.(*mail.InlineHeader).Fields()
+			fields := h.Fields()
 
 			for fields.Next() {
-				headerBuilder.WriteString(fmt.Sprintf("%s: %s", fields.Key(), fields.Value()))
+				headerBuilder.WriteString(fmt.Sprintf("%s: %s\n", fields.Key(), fields.Value()))
 			}
 		case *mail.AttachmentHeader:
 			fileName, err := h.Filename()
 
 			if err != nil {
-				Logger.Errorf("Failed to get filename.")
-				continue
+				logger.Warnf("Failed to get attachment filename: %s", err)
+			}
+
+			if fileName == "" {
+				fileName = "EMPTY_FILENAME"
 			}
 
-			Logger.Infof("Attachment header: %s", fileName)
+			attachment, err := emitEMLAttachment(pipeline, fileName, part.Body)
+
+			if err != nil {
+				return Message{}, err
+			}
+
+			attachments = append(attachments, attachment)
 		}
 	}
 
+	if message.Received <= 0 {
+		message.Received = getEMLFallbackDate(path, receivedHeaders)
+	}
+
 	message.UUID = NewUUID()
-	message.ProjectUUID = project.UUID
-	message.FolderUUID = rootTreeNode.FolderUUID
+	message.ProjectUUID = pipeline.project.UUID
+	message.FolderUUID = folder.FolderUUID
 	message.Headers = headerBuilder.String()
 	message.Body = bodyBuilder.String()
 	message.Attachments = attachments
+	message.MessageClass = MessageClassNote
+	setHeaderFlags(&message)
+
+	original, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return Message{}, err
+	}
+
+	if err := preserveOriginalMessage(&message, original, ".eml"); err != nil {
+		return Message{}, err
+	}
 
 	return message, nil
 }
+
+// getEMLFallbackDate returns the date of an EML file without a (valid) Date header so it isn't placed at the start of the timeline.
+// Uses the date of the topmost (the last hop, closest to delivery) Received header, otherwise the modification time of the file.
+func getEMLFallbackDate(path string, receivedHeaders []string) int {
+	for _, receivedHeader := range receivedHeaders {
+		if date, err := getReceivedHeaderDate(receivedHeader); err == nil && date.Unix() > 0 {
+			return int(date.Unix())
+		}
+	}
+
+	fileInfo, err := os.Stat(path)
+
+	if err != nil {
+		return 0
+	}
+
+	return int(fileInfo.ModTime().Unix())
+}
+
+// getInlinePartFilename returns the filename of an inline part which is an attachment (e.g. an embedded image).
+// Returns an empty filename for text parts (the body) without a filename.
+func getInlinePartFilename(header *mail.InlineHeader) (string, error) {
+	_, dispositionParams, err := header.ContentDisposition()
+
+	if err == nil && dispositionParams["filename"] != "" {
+		return dispositionParams["filename"], nil
+	}
+
+	mediaType, typeParams, err := header.ContentType()
+
+	if err != nil {
+		return "", err
+	}
+
+	if typeParams["name"] != "" {
+		return typeParams["name"], nil
+	}
+
+	if !strings.HasPrefix(mediaType, "text/") {
+		return "EMPTY_FILENAME", nil
+	}
+
+	return "", nil
+}
+
+// emitEMLAttachment writes the decoded attachment part to disk and uploads it to MinIO using the pipeline.
+func emitEMLAttachment(pipeline *Pipeline, fileName string, body io.Reader) (Attachment, error) {
+	return pipeline.EmitAttachment(fileName, func(filePath string) error {
+		outputFile, err := os.Create(filePath)
+
+		if err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(outputFile, body); err != nil {
+			_ = outputFile.Close()
+			return err
+		}
+
+		return outputFile.Close()
+	})
+}
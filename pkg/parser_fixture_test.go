@@ -0,0 +1,448 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The parser fixtures are sample evidence files (a small PST, a ZIP of EML files and an mbox file) in testdata/parsers parsed in the lightweight mode,
+// the parsed messages are compared to the golden file "<fixture>.golden.json" next to the fixture so parser changes are regression tested.
+// Run "go test -run TestParserFixtures -update" to regenerate the EML fixture and the golden files when the change is intended.
+
+// updateParserFixtures rewrites the golden files instead of comparing them.
+var updateParserFixtures = flag.Bool("update", false, "update the golden files of the parser fixtures")
+
+// parserFixtureDirectory defines the directory of the parser fixtures.
+const parserFixtureDirectory = "testdata/parsers"
+
+// goldenFileExtension defines the extension of the golden file of a fixture.
+const goldenFileExtension = ".golden.json"
+
+// failingParserFixtures defines the error of the fixtures which can't be parsed with the current dependencies, they have no golden file.
+var failingParserFixtures = map[string]error{
+	// The fixture is data/support.pst of go-pst. go-pst v4.0.0 panics on every PST file, GetNameToIDMap assigns to a nil *NameToIDMap
+	// (name_to_id_map.go:259). Remove the entry and run with "-update" once go-pst is upgraded.
+	"sample.pst": ErrPSTPanicked,
+}
+
+// TestParserFixtures parses every parser fixture and compares the messages to the golden files.
+func TestParserFixtures(t *testing.T) {
+	core := newParserFixtureCore(t)
+
+	if *updateParserFixtures {
+		if err := writeEMLFixture(filepath.Join(parserFixtureDirectory, "sample-eml.zip"), emlFixtureMessages...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	core.runParserFixtures(t, parserFixtureDirectory, *updateParserFixtures)
+}
+
+// newParserFixtureCore creates a core in the lightweight mode storing its objects and temporary files in temporary directories.
+func newParserFixtureCore(t *testing.T) *Core {
+	t.Helper()
+
+	core, err := New(Config{
+		Lightweight:   true,
+		BlobDirectory: t.TempDir(),
+		TempDirectory: t.TempDir(),
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The globals are set by New.
+	t.Cleanup(func() {
+		ObjectStore = nil
+		TempDirectory = ""
+		lightweightMessages = nil
+		lightweightRepositories = nil
+	})
+
+	return core
+}
+
+// parseFixture parses the fixture file in the lightweight mode and returns the emitted messages in the order they were emitted.
+// The parser is detected from the file signature like uploaded evidence.
+func (core *Core) parseFixture(fixturePath string) ([]Message, error) {
+	fileHash, err := getFileSHA256(fixturePath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := putObjectFile(fileHash, fixturePath); err != nil {
+		return nil, err
+	}
+
+	fileInfo, err := os.Stat(fixturePath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	project := Project{
+		UUID:         NewUUID(),
+		Name:         filepath.Base(fixturePath),
+		CreationDate: int(time.Now().Unix()),
+	}
+
+	// Parsers use the file name after the upload prefix as the title of the root folder.
+	evidence := Evidence{
+		UUID:     NewUUID(),
+		FileHash: fileHash,
+		FileName: fmt.Sprintf("fixture-%s", filepath.Base(fixturePath)),
+		FileSize: fileInfo.Size(),
+	}
+
+	if err := core.Repositories.Projects.SaveProject(project); err != nil {
+		return nil, err
+	}
+
+	if err := core.Repositories.Evidence.SaveEvidence(evidence); err != nil {
+		return nil, err
+	}
+
+	if err := core.Repositories.Projects.AddProjectEvidence(project.UUID, evidence.UUID); err != nil {
+		return nil, err
+	}
+
+	if err := evidence.Parse(project, ParseOptions{}, NewDiscardProgressReporter(), nil); err != nil {
+		return nil, err
+	}
+
+	return core.Messages.GetMessages(project.UUID), nil
+}
+
+// runParserFixtures parses every fixture in the directory (files without the golden file extension) in a subtest and compares the messages to their golden file.
+// Golden files are (re)written instead if update is set.
+func (core *Core) runParserFixtures(t *testing.T, fixtureDirectory string, update bool) {
+	entries, err := os.ReadDir(fixtureDirectory)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), goldenFileExtension) || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		fixturePath := filepath.Join(fixtureDirectory, entry.Name())
+
+		t.Run(entry.Name(), func(t *testing.T) {
+			messages, err := core.parseFixture(fixturePath)
+
+			if wantErr, ok := failingParserFixtures[entry.Name()]; ok {
+				if !errors.Is(err, wantErr) {
+					t.Fatalf("error = %v, want %v", err, wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(messages) == 0 {
+				t.Fatal("no messages parsed")
+			}
+
+			if err := compareGoldenMessages(messages, core.Repositories.Tree, fixturePath+goldenFileExtension, update); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// compareGoldenMessages compares the normalized messages to the golden file, or writes the golden file if update is set.
+func compareGoldenMessages(messages []Message, treeRepo TreeRepo, goldenPath string, update bool) error {
+	goldenMessages := make([]json.RawMessage, 0, len(messages))
+
+	for _, message := range messages {
+		normalizedMessage, err := normalizeGoldenMessage(message, treeRepo)
+
+		if err != nil {
+			return err
+		}
+
+		goldenMessages = append(goldenMessages, normalizedMessage)
+	}
+
+	encodedMessages, err := json.MarshalIndent(goldenMessages, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	if update {
+		return os.WriteFile(goldenPath, append(encodedMessages, '\n'), 0644)
+	}
+
+	goldenFile, err := os.ReadFile(goldenPath)
+
+	if err != nil {
+		return err
+	}
+
+	var expectedMessages []json.RawMessage
+
+	if err := json.Unmarshal(goldenFile, &expectedMessages); err != nil {
+		return err
+	}
+
+	if len(expectedMessages) != len(goldenMessages) {
+		return fmt.Errorf("parsed %d messages, expected %d", len(goldenMessages), len(expectedMessages))
+	}
+
+	for i := range goldenMessages {
+		var expected bytes.Buffer
+
+		if err := json.Indent(&expected, expectedMessages[i], "", "  "); err != nil {
+			return err
+		}
+
+		var actual bytes.Buffer
+
+		if err := json.Indent(&actual, goldenMessages[i], "", "  "); err != nil {
+			return err
+		}
+
+		if expected.String() != actual.String() {
+			return fmt.Errorf("message %d differs from the golden file:\nexpected: %s\nactual: %s", i, expected.String(), actual.String())
+		}
+	}
+
+	return nil
+}
+
+// normalizeGoldenMessage returns the JSON of the message without the values which differ per run:
+// UUIDs and object paths are cleared, the folder UUID is replaced by the folder path and the extraction time and versions are removed from the provenance.
+func normalizeGoldenMessage(message Message, treeRepo TreeRepo) (json.RawMessage, error) {
+	folderPath, err := getFixtureFolderPath(message.FolderUUID, message.ProjectUUID, treeRepo)
+
+	if err != nil {
+		return nil, err
+	}
+
+	message.UUID = ""
+	message.ProjectUUID = ""
+	message.EvidenceUUID = ""
+	message.FolderUUID = folderPath
+	message.BodyObject = ""
+	message.OriginalObject = ""
+
+	attachments := make([]Attachment, len(message.Attachments))
+
+	for i, attachment := range message.Attachments {
+		attachment.UUID = ""
+		attachments[i] = attachment
+	}
+
+	message.Attachments = attachments
+
+	if message.Provenance != nil {
+		provenance := *message.Provenance
+		provenance.ParserVersion = ""
+		provenance.CoreVersion = ""
+		provenance.ExtractedAt = 0
+		message.Provenance = &provenance
+	}
+
+	return json.Marshal(message)
+}
+
+// getFixtureFolderPath returns the titles of the folder and its parents, e.g. "archive.pst/Inbox".
+func getFixtureFolderPath(folderUUID string, projectUUID string, treeRepo TreeRepo) (string, error) {
+	var titles []string
+
+	for folderUUID != "" && folderUUID != "NULL" {
+		treeNode, err := treeRepo.GetTreeNode(folderUUID, projectUUID)
+
+		if err != nil {
+			return "", fmt.Errorf("unknown folder %s: %w", folderUUID, err)
+		}
+
+		titles = append([]string{treeNode.Title}, titles...)
+		folderUUID = treeNode.Parent
+	}
+
+	return strings.Join(titles, "/"), nil
+}
+
+// fixtureMessage represents a message of a generated EML fixture, see writeEMLFixture.
+type fixtureMessage struct {
+	From        string
+	To          []string
+	CC          []string
+	Subject     string
+	Date        time.Time
+	MessageID   string
+	Body        string
+	Attachments map[string][]byte // The content per file name.
+}
+
+// writeEMLFixture writes a ZIP of EML files (one per message, named by their index) to the fixture path.
+func writeEMLFixture(fixturePath string, messages ...fixtureMessage) error {
+	var archive bytes.Buffer
+
+	zipWriter := zip.NewWriter(&archive)
+
+	for i, message := range messages {
+		emlWriter, err := zipWriter.Create(fmt.Sprintf("%04d.eml", i+1))
+
+		if err != nil {
+			return err
+		}
+
+		eml, err := newFixtureEML(message)
+
+		if err != nil {
+			return err
+		}
+
+		if _, err := emlWriter.Write(eml); err != nil {
+			return err
+		}
+	}
+
+	if err := zipWriter.Close(); err != nil {
+		return err
+	}
+
+	return os.WriteFile(fixturePath, archive.Bytes(), 0644)
+}
+
+// newFixtureEML returns the RFC 5322 message, a multipart/mixed message if the message has attachments.
+func newFixtureEML(message fixtureMessage) ([]byte, error) {
+	var eml bytes.Buffer
+
+	headers := [][2]string{
+		{"From", message.From},
+		{"To", strings.Join(message.To, ", ")},
+		{"Subject", mime.QEncoding.Encode("utf-8", message.Subject)},
+		{"Date", message.Date.Format(time.RFC1123Z)},
+		{"Message-ID", message.MessageID},
+		{"MIME-Version", "1.0"},
+	}
+
+	if len(message.CC) > 0 {
+		headers = append(headers, [2]string{"Cc", strings.Join(message.CC, ", ")})
+	}
+
+	for _, header := range headers {
+		if header[1] != "" {
+			fmt.Fprintf(&eml, "%s: %s\r\n", header[0], header[1])
+		}
+	}
+
+	if len(message.Attachments) == 0 {
+		fmt.Fprintf(&eml, "Content-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n", message.Body)
+
+		return eml.Bytes(), nil
+	}
+
+	var body bytes.Buffer
+
+	multipartWriter := multipart.NewWriter(&body)
+
+	// A fixed boundary so the generated fixture is the same every time.
+	if err := multipartWriter.SetBoundary("goforensics-fixture-boundary"); err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(&eml, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", multipartWriter.Boundary())
+
+	textPart, err := multipartWriter.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := textPart.Write([]byte(message.Body)); err != nil {
+		return nil, err
+	}
+
+	var fileNames []string
+
+	for fileName := range message.Attachments {
+		fileNames = append(fileNames, fileName)
+	}
+
+	sort.Strings(fileNames)
+
+	for _, fileName := range fileNames {
+		attachmentPart, err := multipartWriter.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {"application/octet-stream"},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": fileName})},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := attachmentPart.Write([]byte(base64.StdEncoding.EncodeToString(message.Attachments[fileName]))); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := multipartWriter.Close(); err != nil {
+		return nil, err
+	}
+
+	eml.Write(body.Bytes())
+
+	return eml.Bytes(), nil
+}
+
+// emlFixtureMessages are the messages of the generated EML fixture "sample-eml.zip".
+var emlFixtureMessages = []fixtureMessage{
+	{
+		From:      "Alice Example <alice@example.com>",
+		To:        []string{"Bob Example <bob@example.com>"},
+		Subject:   "Quarterly figures",
+		Date:      time.Date(2022, 3, 14, 9, 30, 0, 0, time.UTC),
+		MessageID: "<quarterly-figures@example.com>",
+		Body:      "Hi Bob,\r\n\r\nThe quarterly figures are attached.\r\n\r\nAlice",
+		Attachments: map[string][]byte{
+			"figures.csv": []byte("quarter,revenue\n2022-Q1,1000\n"),
+		},
+	},
+	{
+		From:      "Bob Example <bob@example.com>",
+		To:        []string{"Alice Example <alice@example.com>"},
+		CC:        []string{"Carol Example <carol@example.com>"},
+		Subject:   "Re: Quarterly figures",
+		Date:      time.Date(2022, 3, 14, 11, 5, 0, 0, time.FixedZone("", 3600)),
+		MessageID: "<re-quarterly-figures@example.com>",
+		Body:      "Thanks Alice, looping in Carol.",
+	},
+	{
+		From:      "Carol Example <carol@example.com>",
+		To:        []string{"Alice Example <alice@example.com>", "Bob Example <bob@example.com>"},
+		Subject:   "Réunion: café ☕",
+		Date:      time.Date(2022, 3, 15, 8, 0, 0, 0, time.UTC),
+		MessageID: "<reunion@example.com>",
+		Body:      "Non-ASCII subject and body: naïve façade.",
+	},
+}
@@ -0,0 +1,313 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"golang.org/x/sync/errgroup"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// MboxParser handles parsing mbox files (e.g. Thunderbird or Google Takeout exports), the messages are parsed like EML files.
+type MboxParser struct {
+	Parser
+}
+
+// GetName returns the name of this parser.
+func (parser MboxParser) GetName() string {
+	return "MBOX"
+}
+
+// GetSupportedFileExtensions returns the supported file extensions.
+func (parser MboxParser) GetSupportedFileExtensions() []string {
+	return []string{".mbox", ".mbx"}
+}
+
+// GetVersion returns the module version of go-message.
+func (parser MboxParser) GetVersion() string {
+	return getModuleVersion(emlModulePath)
+}
+
+// GetFileSignatures returns the "From " line which starts every message of an mbox file.
+func (parser MboxParser) GetFileSignatures() [][]byte {
+	return [][]byte{mboxFromLine}
+}
+
+// mboxFromLine defines the start of the separator line of the messages in an mbox file.
+var mboxFromLine = []byte("From ")
+
+// mboxMaxLineSize defines the maximum size of a line of an mbox file when validating it.
+const mboxMaxLineSize = 1024 * 1024
+
+// Parse parses the mbox file, all messages are parsed into the root folder.
+func (parser MboxParser) Parse(evidence *Evidence, project Project, options ParseOptions, progressReporter ProgressReporter, database *pgx.Conn) error {
+	logger := Logger.WithFields(LogFields{"project_uuid": project.UUID, "evidence_uuid": evidence.UUID})
+
+	errorGroup, _ := errgroup.WithContext(context.Background())
+
+	errorGroup.Go(func() error {
+		progressReporter.ReportProgress(ProgressEvent{Stage: ProgressStageDownloading})
+
+		evidencePath, err := DownloadEvidence(*evidence, project.UUID)
+
+		if err != nil {
+			logger.Errorf("Failed to download evidence: %s", err)
+			return err
+		}
+
+		defer func() {
+			if err := os.Remove(evidencePath); err != nil {
+				logger.Errorf("Failed to cleanup evidence file: %s", err)
+			}
+		}()
+
+		scratchSpace, err := NewScratchSpace(project.UUID)
+
+		if err != nil {
+			return err
+		}
+
+		defer scratchSpace.cleanup()
+
+		pipeline, err := newEvidencePipeline(project, evidence, parser, options, progressReporter, database)
+
+		if err != nil {
+			logger.Errorf("Failed to create pipeline: %s", err)
+			return err
+		}
+
+		rootTreeNode, err := pipeline.CreateFolder(strings.Split(evidence.FileName, "-")[1], "NULL")
+
+		if err != nil {
+			logger.Errorf("Failed to save tree node to database: %s", err)
+			return err
+		}
+
+		err = splitMbox(evidencePath, scratchSpace, func(index int, emlPath string) error {
+			message, err := parseEMLFile(emlPath, pipeline, rootTreeNode)
+
+			if err != nil {
+				// Malformed messages are always skipped.
+				return pipeline.EmitFailure(fmt.Sprintf("message %d", index), err)
+			}
+
+			if err := pipeline.EmitMessage(message); err != nil {
+				return err
+			}
+
+			// The EML file is only needed while parsing it.
+			return os.Remove(emlPath)
+		})
+
+		if err != nil {
+			return err
+		}
+
+		return pipeline.Close()
+	})
+
+	return errorGroup.Wait()
+}
+
+// Validate checks the signature of the mbox file and counts its messages, nothing is parsed.
+func (parser MboxParser) Validate(evidence *Evidence, project Project) (EvidencePreview, error) {
+	logger := Logger.WithFields(LogFields{"project_uuid": project.UUID, "evidence_uuid": evidence.UUID})
+
+	evidencePath, err := DownloadEvidence(*evidence, project.UUID)
+
+	if err != nil {
+		return EvidencePreview{}, err
+	}
+
+	defer func() {
+		if err := os.Remove(evidencePath); err != nil {
+			logger.Errorf("Failed to cleanup evidence file: %s", err)
+		}
+	}()
+
+	inputFile, err := os.Open(evidencePath)
+
+	if err != nil {
+		return EvidencePreview{}, err
+	}
+
+	defer func() {
+		if err := inputFile.Close(); err != nil {
+			logger.Errorf("Failed to close file: %s", err)
+		}
+	}()
+
+	scanner := bufio.NewScanner(inputFile)
+	scanner.Buffer(make([]byte, 64*1024), mboxMaxLineSize)
+
+	preview := EvidencePreview{
+		RootFolder: FolderPreview{
+			Title: strings.Split(evidence.FileName, "-")[1],
+		},
+	}
+
+	for scanner.Scan() {
+		if bytes.HasPrefix(scanner.Bytes(), mboxFromLine) {
+			preview.RootFolder.Messages++
+		} else if preview.RootFolder.Messages == 0 {
+			// Not an mbox file.
+			return EvidencePreview{}, nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return EvidencePreview{}, err
+	}
+
+	if preview.RootFolder.Messages == 0 {
+		return EvidencePreview{}, nil
+	}
+
+	preview.IsValidSignature = true
+
+	return preview, nil
+}
+
+// splitMbox writes each message of the mbox file to an EML file in the scratch space and calls the handler with it.
+// Escaped ">From " lines (mboxrd) are unescaped, the modification time of the EML file is the date of the "From " line (see getEMLFallbackDate).
+func splitMbox(mboxPath string, scratchSpace *ScratchSpace, handler func(index int, emlPath string) error) error {
+	inputFile, err := os.Open(mboxPath)
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := inputFile.Close(); err != nil {
+			Logger.Errorf("Failed to close file: %s", err)
+		}
+	}()
+
+	reader := bufio.NewReaderSize(inputFile, 64*1024)
+
+	var emlFile *os.File
+	var emlWriter *bufio.Writer
+	var fromDate time.Time
+	var index int
+
+	// finishMessage passes the current message to the handler.
+	finishMessage := func() error {
+		if emlFile == nil {
+			return nil
+		}
+
+		if err := emlWriter.Flush(); err != nil {
+			return err
+		}
+
+		if err := emlFile.Close(); err != nil {
+			return err
+		}
+
+		if !fromDate.IsZero() {
+			if err := os.Chtimes(emlFile.Name(), fromDate, fromDate); err != nil {
+				return err
+			}
+		}
+
+		emlPath := emlFile.Name()
+		emlFile = nil
+
+		return handler(index, emlPath)
+	}
+
+	for {
+		line, err := readMboxLine(reader)
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			if emlFile != nil {
+				_ = emlFile.Close()
+			}
+
+			return err
+		}
+
+		if bytes.HasPrefix(line, mboxFromLine) {
+			if err := finishMessage(); err != nil {
+				return err
+			}
+
+			index++
+			fromDate = getMboxFromLineDate(line)
+
+			emlFile, err = os.Create(scratchSpace.FilePath(fmt.Sprintf("%d.eml", index)))
+
+			if err != nil {
+				return err
+			}
+
+			emlWriter = bufio.NewWriter(emlFile)
+
+			continue
+		}
+
+		// Content before the first "From " line isn't part of a message.
+		if emlFile == nil {
+			continue
+		}
+
+		if isEscapedMboxFromLine(line) {
+			line = line[1:]
+		}
+
+		if _, err := emlWriter.Write(line); err != nil {
+			_ = emlFile.Close()
+
+			return err
+		}
+	}
+
+	return finishMessage()
+}
+
+// readMboxLine returns the next line including the line ending, io.EOF after the last line.
+func readMboxLine(reader *bufio.Reader) ([]byte, error) {
+	line, err := reader.ReadBytes('\n')
+
+	// The last line may not end with a line ending.
+	if err == io.EOF && len(line) > 0 {
+		return line, nil
+	}
+
+	return line, err
+}
+
+// isEscapedMboxFromLine returns true if the line is a ">From " line escaped by the mboxrd format, e.g. ">>From " becomes ">From ".
+func isEscapedMboxFromLine(line []byte) bool {
+	unquoted := bytes.TrimLeft(line, ">")
+
+	return len(unquoted) < len(line) && bytes.HasPrefix(unquoted, mboxFromLine)
+}
+
+// getMboxFromLineDate returns the date of the "From sender date" line, the zero time if it has no (valid) date.
+func getMboxFromLineDate(line []byte) time.Time {
+	fields := strings.Fields(string(line))
+
+	// "From", the sender and the asctime date (e.g. "Mon Mar 14 09:30:00 2022") of five fields.
+	if len(fields) < 7 {
+		return time.Time{}
+	}
+
+	date, err := time.Parse(time.ANSIC, strings.Join(fields[2:7], " "))
+
+	if err != nil {
+		return time.Time{}
+	}
+
+	return date
+}
@@ -5,13 +5,65 @@ package core
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
-	"github.com/segmentio/kafka-go"
+	"github.com/jackc/pgx/v4"
+	"io/ioutil"
+	"time"
 )
 
-func ParseOutlookIMAPEmails(project Project, email string, token string, progressPercentageChannel *chan int) error {
-	outlookClient, err := authenticateOutlookIMAP(email, token)
+// imapFetchBatchSize defines the amount of messages fetched per rate limited IMAP request.
+const imapFetchBatchSize = 100
+
+// imapOriginalSection defines the section of the full MIME source, peeked so messages aren't marked as read.
+var imapOriginalSection = &imap.BodySectionName{Peek: true}
+
+// ParseOutlookIMAPEmails parses the emails using the access token, use NewChannelProgressReporter to receive percentages on a channel.
+func ParseOutlookIMAPEmails(project Project, email string, token string, progressReporter ProgressReporter) error {
+	return outlookProvider.newCollector().Collect(project, email, func() (string, error) {
+		return token, nil
+	}, nil, progressReporter)
+}
+
+// imapCollector collects the emails of all mailboxes of the provider over IMAP.
+type imapCollector struct {
+	provider *MailProvider
+}
+
+// NewIMAPCollector returns the IMAP collector of the provider, authenticating with XOAUTH2 or OAUTHBEARER.
+func NewIMAPCollector(provider *MailProvider) MailCollector {
+	return &imapCollector{provider: provider}
+}
+
+// Collect collects the emails of all mailboxes.
+func (collector *imapCollector) Collect(project Project, email string, getAccessToken func() (string, error), collection *Collection, progressReporter ProgressReporter) error {
+	return parseIMAPEmails(collector.provider, project, email, getAccessToken, collection, progressReporter)
+}
+
+// ParseOutlookIMAPEmailsForUser parses the emails using the stored token of the user, see SaveOutlookEmailsToken.
+// The token is refreshed when it expires during the collection.
+func ParseOutlookIMAPEmailsForUser(project Project, email string, userUUID string, progressReporter ProgressReporter, database *pgx.Conn) error {
+	return CollectEmailsForUser(MailProviderOutlook, project, email, userUUID, progressReporter, database)
+}
+
+// ParseGmailIMAPEmailsForUser parses the Gmail emails using the stored token of the user, see SaveGoogleEmailsToken.
+// The token is refreshed when it expires during the collection.
+func ParseGmailIMAPEmailsForUser(project Project, email string, userUUID string, progressReporter ProgressReporter, database *pgx.Conn) error {
+	return CollectEmailsForUser(MailProviderGoogle, project, email, userUUID, progressReporter, database)
+}
+
+// parseIMAPEmails parses the emails of all mailboxes of the provider, getAccessToken is called on every (re)authentication.
+// The message counts per mailbox are added to the collection if it isn't nil.
+func parseIMAPEmails(provider *MailProvider, project Project, email string, getAccessToken func() (string, error), collection *Collection, progressReporter ProgressReporter) error {
+	token, err := getAccessToken()
+
+	if err != nil {
+		return err
+	}
+
+	imapClient, err := authenticateIMAP(provider, email, token)
 
 	if err != nil {
 		return err
@@ -21,7 +73,7 @@ func ParseOutlookIMAPEmails(project Project, email string, token string, progres
 	done := make(chan error)
 
 	go func() {
-		done <- outlookClient.List("", "*", mailboxes)
+		done <- imapClient.List("", "*", mailboxes)
 	}()
 
 	var mailboxNames []string
@@ -34,35 +86,75 @@ func ParseOutlookIMAPEmails(project Project, email string, token string, progres
 		return err
 	}
 
-	return parseMailboxes(outlookClient, mailboxNames, project, progressPercentageChannel, email, token)
+	// The domain of the collected account is the custodian domain.
+	pipeline := NewPipeline(project, nil, imapParserName, getModuleVersion(imapModulePath), ParseOptions{}, CustodianConfiguration{Domains: []string{getAddressDomain(email)}}, progressReporter, nil)
+
+	pipeline.SetCustodianAddresses(email)
+
+	return parseMailboxes(provider, imapClient, mailboxNames, pipeline, collection, email, getAccessToken)
 }
 
-func authenticateOutlookIMAP(email string, token string) (*client.Client, error) {
-	outlookClient, _ := client.DialTLS("outlook.office365.com:993", nil)
-	xoauth2Client := NewXoauth2Client(email, token)
+// authenticateIMAP connects to the IMAP server of the provider and authenticates with the access token.
+func authenticateIMAP(provider *MailProvider, email string, token string) (*client.Client, error) {
+	saslClient, err := newSASLClient(provider.Name, email, token, provider.IMAPHost, provider.IMAPPort)
 
-	err := outlookClient.Authenticate(xoauth2Client)
+	if err != nil {
+		return nil, err
+	}
+
+	var imapClient *client.Client
+
+	err = retry(context.Background(), ExternalServiceRetryOptions, func() error {
+		var err error
+
+		if err := MailboxRateLimiter.Wait(context.Background()); err != nil {
+			return retryPermanent(err)
+		}
+
+		imapClient, err = client.DialTLS(fmt.Sprintf("%s:%d", provider.IMAPHost, provider.IMAPPort), nil)
+
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = imapClient.Authenticate(saslClient)
 
 	if err != nil {
 		return nil, err
 	}
 
-	return outlookClient, nil
+	return imapClient, nil
 }
 
-func parseMailboxes(outlookClient *client.Client, mailboxNames []string, project Project, progressPercentageChannel *chan int, email string, token string) error {
+// parseMailboxes parses the mailboxes, emitting the messages to the pipeline which is closed when done.
+func parseMailboxes(provider *MailProvider, imapClient *client.Client, mailboxNames []string, pipeline *Pipeline, collection *Collection, email string, getAccessToken func() (string, error)) error {
+	logger := Logger.WithFields(LogFields{"project_uuid": pipeline.project.UUID})
+
 	var parsedMailboxes []string
 
-	for _, mailboxName := range mailboxNames {
-		Logger.Infof("Parsing mailbox: %s", mailboxName)
+	for i, mailboxName := range mailboxNames {
+		logger.Infof("Parsing mailbox: %s", mailboxName)
+
+		if err := MailboxRateLimiter.Wait(context.Background()); err != nil {
+			return err
+		}
 
-		mbox, err := outlookClient.Select(mailboxName, true)
+		mbox, err := imapClient.Select(mailboxName, true)
 
 		if err != nil {
 			if err.Error() == "imap: connection closed" {
-				Logger.Warnf("IMAP connection closed, retrying...")
+				logger.Warnf("IMAP connection closed, retrying...")
+
+				token, err := getAccessToken()
+
+				if err != nil {
+					return err
+				}
 
-				outlookClient, err := authenticateOutlookIMAP(email, token)
+				imapClient, err := authenticateIMAP(provider, email, token)
 
 				if err != nil {
 					return err
@@ -84,7 +176,7 @@ func parseMailboxes(outlookClient *client.Client, mailboxNames []string, project
 					}
 				}
 
-				err = parseMailboxes(outlookClient, wantedMailboxes, project, progressPercentageChannel, email, token)
+				err = parseMailboxes(provider, imapClient, wantedMailboxes, pipeline, collection, email, getAccessToken)
 
 				if err != nil {
 					return err
@@ -95,58 +187,75 @@ func parseMailboxes(outlookClient *client.Client, mailboxNames []string, project
 			return err
 		}
 
-		to := mbox.Messages
+		mailbox := collection.startMailbox(mailboxName)
 
-		seqset := new(imap.SeqSet)
-		seqset.AddRange(1, to)
+		pipeline.SetPercent(i * 100 / len(mailboxNames))
+		pipeline.SetFolder(mailboxName)
 
 		messages := make(chan *imap.Message)
 		done := make(chan error)
 
 		go func() {
-			done <- outlookClient.Fetch(seqset, []imap.FetchItem{imap.FetchEnvelope}, messages)
+			done <- fetchIMAPMessages(imapClient, mbox.Messages, messages)
 		}()
 
-		var kafkaMessages []kafka.Message
-
-		totalSentMessages := 0
+		processed := pipeline.Processed()
+		fetched := 0
 
 		for imapMessage := range messages {
-			message := parseIMAPMessage(imapMessage, project)
+			fetched++
+
+			pipeline.SetPercent((i*100 + fetched*100/int(mbox.Messages)) / len(mailboxNames))
+
+			if imapMessage.Envelope == nil {
+				if err := pipeline.EmitFailure(fmt.Sprintf("%s/%d", mailboxName, imapMessage.SeqNum), errors.New("missing envelope")); err != nil {
+					return err
+				}
 
-			kafkaMessages = append(kafkaMessages, kafka.Message{
-				Key:   []byte(message.UUID),
-				Value: []byte(message.JSON()),
-			})
+				mailbox.Failed++
+				continue
+			}
 
-			if len(kafkaMessages) >= 100 {
-				totalSentMessages += len(kafkaMessages)
+			message := parseIMAPMessage(imapMessage, pipeline.project)
 
-				err := KafkaWriter.WriteMessages(context.Background(), kafkaMessages...)
+			if original := imapMessage.GetBody(imapOriginalSection); original != nil {
+				originalBytes, err := ioutil.ReadAll(original)
 
 				if err != nil {
-					return err
+					if err := pipeline.EmitFailure(fmt.Sprintf("%s/%d", mailboxName, imapMessage.SeqNum), fmt.Errorf("failed to read original message: %s", err)); err != nil {
+						return err
+					}
+
+					mailbox.Failed++
+					continue
 				}
 
-				*progressPercentageChannel <- int((float64(totalSentMessages) / float64(mbox.Messages)) * float64(100))
+				message.Headers = getRawMessageHeaders(originalBytes)
+				setHeaderFlags(&message)
 
-				kafkaMessages = []kafka.Message{}
+				if err := preserveOriginalMessage(&message, originalBytes, ".eml"); err != nil {
+					return err
+				}
 			}
-		}
-
-		if len(kafkaMessages) > 0 {
-			err := KafkaWriter.WriteMessages(context.Background(), kafkaMessages...)
 
-			if err != nil {
+			if err := pipeline.EmitMessage(message); err != nil {
+				mailbox.Failed += pipeline.Pending()
 				return err
 			}
+		}
 
-			*progressPercentageChannel <- 100
+		if err := pipeline.Flush(); err != nil {
+			mailbox.Failed += pipeline.Pending()
+			return err
 		}
 
+		mailbox.Collected = pipeline.Processed() - processed
+		mailbox.EndDate = int(time.Now().Unix())
+
 		if err := <-done; err != nil {
 			if err.Error() == "The specified message set is invalid." {
-				Logger.Warnf("Skipping mailbox %s: %s", mailboxName, err)
+				logger.Warnf("Skipping mailbox %s: %s", mailboxName, err)
+				mailbox.Skipped = int(mbox.Messages) - mailbox.Collected - mailbox.Failed
 				parsedMailboxes = append(parsedMailboxes, mailboxName)
 				continue
 			}
@@ -156,21 +265,71 @@ func parseMailboxes(outlookClient *client.Client, mailboxNames []string, project
 		parsedMailboxes = append(parsedMailboxes, mailboxName)
 	}
 
-	close(*progressPercentageChannel)
+	if err := pipeline.Close(); err != nil {
+		return err
+	}
 
-	return outlookClient.Logout()
+	return imapClient.Logout()
+}
+
+// fetchIMAPMessages fetches the envelopes, flags and MIME sources of the selected mailbox in batches rate limited by MailboxRateLimiter.
+// The messages channel is closed when done.
+func fetchIMAPMessages(imapClient *client.Client, total uint32, messages chan *imap.Message) error {
+	defer close(messages)
+
+	for from := uint32(1); from <= total; from += imapFetchBatchSize {
+		to := from + imapFetchBatchSize - 1
+
+		if to > total {
+			to = total
+		}
+
+		if err := MailboxRateLimiter.Wait(context.Background()); err != nil {
+			return err
+		}
+
+		seqset := new(imap.SeqSet)
+		seqset.AddRange(from, to)
+
+		batch := make(chan *imap.Message)
+		batchDone := make(chan error, 1)
+
+		go func() {
+			batchDone <- imapClient.Fetch(seqset, []imap.FetchItem{imap.FetchEnvelope, imap.FetchFlags, imapOriginalSection.FetchItem()}, batch)
+		}()
+
+		for message := range batch {
+			messages <- message
+		}
+
+		if err := <-batchDone; err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func parseIMAPMessage(message *imap.Message, project Project) Message {
+	isRead := false
+
+	for _, flag := range message.Flags {
+		if flag == imap.SeenFlag {
+			isRead = true
+		}
+	}
+
 	return Message{
-		UUID:        NewUUID(),
-		ProjectUUID: project.UUID,
-		MessageID:   message.Envelope.MessageId,
-		Subject:     message.Envelope.Subject,
-		From:        parseAddress(message.Envelope.From),
-		To:          parseAddress(message.Envelope.To),
-		CC:          parseAddress(message.Envelope.Cc),
-		Received:    int(message.Envelope.Date.Unix()),
+		UUID:         NewUUID(),
+		ProjectUUID:  project.UUID,
+		MessageID:    message.Envelope.MessageId,
+		Subject:      message.Envelope.Subject,
+		From:         parseAddress(message.Envelope.From),
+		To:           parseAddress(message.Envelope.To),
+		CC:           parseAddress(message.Envelope.Cc),
+		Received:     int(message.Envelope.Date.Unix()),
+		MessageClass: MessageClassNote,
+		IsRead:       &isRead,
 	}
 }
 
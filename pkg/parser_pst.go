@@ -9,7 +9,6 @@ import (
 	"fmt"
 	"github.com/jackc/pgx/v4"
 	"github.com/mooijtech/go-pst/v4/pkg"
-	"github.com/segmentio/kafka-go"
 	"golang.org/x/sync/errgroup"
 	"os"
 	"strings"
@@ -20,6 +19,9 @@ type PSTParser struct {
 	Parser
 }
 
+// ErrPSTPanicked is returned when go-pst panics while reading a PST file, e.g. on a corrupt or unsupported file.
+var ErrPSTPanicked = errors.New("go-pst panicked")
+
 // GetName returns the name of this parser.
 func (parser PSTParser) GetName() string {
 	return "PST"
@@ -30,248 +32,362 @@ func (parser PSTParser) GetSupportedFileExtensions() []string {
 	return []string{".pst"}
 }
 
-// Parse parses the PST file.
-func (parser PSTParser) Parse(evidence *Evidence, project Project, database *pgx.Conn) error {
+// GetVersion returns the module version of go-pst.
+func (parser PSTParser) GetVersion() string {
+	return getModuleVersion(pstModulePath)
+}
+
+// GetFileSignatures returns the magic bytes of PST files.
+func (parser PSTParser) GetFileSignatures() [][]byte {
+	return [][]byte{[]byte("!BDN")}
+}
+
+// Parse parses the PST file, panics of go-pst are returned as ErrPSTPanicked.
+func (parser PSTParser) Parse(evidence *Evidence, project Project, options ParseOptions, progressReporter ProgressReporter, database *pgx.Conn) error {
+	logger := Logger.WithFields(LogFields{"project_uuid": project.UUID, "evidence_uuid": evidence.UUID})
+
 	errorGroup, _ := errgroup.WithContext(context.Background())
 
-	errorGroup.Go(func() error {
+	errorGroup.Go(func() (err error) {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				logger.Errorf("Failed to parse PST file: %v", recovered)
+				err = fmt.Errorf("%w: %v", ErrPSTPanicked, recovered)
+			}
+		}()
+
+		progressReporter.ReportProgress(ProgressEvent{Stage: ProgressStageDownloading})
+
 		evidencePath, err := DownloadEvidence(*evidence, project.UUID)
 
 		if err != nil {
-			Logger.Errorf("Failed to download evidence: %s", err)
+			logger.Errorf("Failed to download evidence: %s", err)
 			return err
 		}
 
+		defer func() {
+			if err := os.Remove(evidencePath); err != nil {
+				logger.Errorf("Failed to cleanup evidence file: %s", err)
+			}
+		}()
+
 		pstFile, err := pst.NewFromFile(evidencePath)
 
 		if err != nil {
-			Logger.Errorf("Failed to create new PST file: %s", err)
+			logger.Errorf("Failed to create new PST file: %s", err)
 			return err
 		}
 
 		defer func() {
 			if err := pstFile.Close(); err != nil {
-				Logger.Errorf("Failed to close PST file: %s", err)
-			}
-
-			if err := os.Remove(evidencePath); err != nil {
-				Logger.Errorf("Failed to cleanup evidence file: %s", err)
+				logger.Errorf("Failed to close PST file: %s", err)
 			}
 		}()
 
-		Logger.Infof("Parsing file: %s...", evidence.FileHash)
+		logger.Infof("Parsing file: %s...", evidence.FileHash)
 
 		isValidSignature, err := pstFile.IsValidSignature()
 
 		if err != nil {
-			Logger.Errorf("Failed to read signature: %s", err)
+			logger.Errorf("Failed to read signature: %s", err)
 			return errors.New("failed to read signature")
 		}
 
 		if !isValidSignature {
-			Logger.Errorf("Invalid file signature.")
+			logger.Errorf("Invalid file signature.")
 			return errors.New("invalid file signature")
 		}
 
-		contentType, err := pstFile.GetContentType()
+		formatType, encryptionType, err := initializePSTFile(&pstFile, logger)
 
 		if err != nil {
-			Logger.Errorf("Failed to get content type: %s", err)
-			return errors.New("failed to get content type")
+			return err
 		}
 
-		Logger.Infof("Content type: %s", contentType)
-
-		formatType, err := pstFile.GetFormatType()
+		rootFolder, err := pstFile.GetRootFolder(formatType, encryptionType)
 
 		if err != nil {
-			Logger.Errorf("Failed to get format type: %s", err)
-			return errors.New("failed to get format type")
+			logger.Errorf("Failed to get root folder: %s", err)
+			return errors.New("failed to get root folder")
 		}
 
-		Logger.Infof("Format type: %s", formatType)
-
-		encryptionType, err := pstFile.GetEncryptionType(formatType)
+		pipeline, err := newEvidencePipeline(project, evidence, parser, options, progressReporter, database)
 
 		if err != nil {
-			Logger.Errorf("Failed to get encryption type: %s", err)
-			return errors.New("failed to get encryption type")
+			logger.Errorf("Failed to create pipeline: %s", err)
+			return err
 		}
 
-		Logger.Infof("Encryption type: %s", encryptionType)
-		Logger.Info("Initializing B-Trees...")
-
-		err = pstFile.InitializeBTrees(formatType)
+		rootTreeNode, err := pipeline.CreateFolder(strings.Split(evidence.FileName, "-")[1], "NULL")
 
 		if err != nil {
-			Logger.Errorf("Failed to initialize node and block b-tree: %s", err)
-			return errors.New("failed to initialize node and block b-tree")
+			logger.Errorf("Failed to save tree node: %s", err)
+			return errors.New("failed to save tree node")
 		}
 
-		err = pstFile.InitializeNameToIDMap(formatType, encryptionType)
+		err = parseSubFolders(pstFile, rootFolder, rootTreeNode.Title, formatType, encryptionType, pipeline, rootTreeNode)
 
 		if err != nil {
-			Logger.Errorf("Failed to initialize Name-To-ID Map: %s", err)
-			return errors.New("failed to initialize Name-To-ID Map")
+			logger.Errorf("Failed to get sub-folders: %s", err)
+			return errors.New("failed to get sub-folders")
 		}
 
-		rootFolder, err := pstFile.GetRootFolder(formatType, encryptionType)
+		if err := pipeline.Close(); err != nil {
+			logger.Errorf("Failed to close pipeline: %s", err)
+			return err
+		}
+
+		evidence.IsParsed = true
+
+		err = getRepositories(database).Evidence.SaveEvidence(*evidence)
 
 		if err != nil {
-			Logger.Errorf("Failed to get root folder: %s", err)
-			return errors.New("failed to get root folder")
+			logger.Errorf("Failed to save evidence: %s", err)
+			return err
 		}
 
-		rootTreeNode := TreeNode{
-			FolderUUID:   NewUUID(),
-			ProjectUUID:  project.UUID,
-			EvidenceUUID: evidence.UUID,
-			Title:        strings.Split(evidence.FileName, "-")[1],
-			Parent:       "NULL",
+		logger.Infof("Finished parsing file: %s", evidence.FileHash)
+
+		return nil
+	})
+
+	return errorGroup.Wait()
+}
+
+// initializePSTFile initializes the B-Trees and Name-To-ID Map of the PST file with a valid signature.
+// Returns the format type and encryption type.
+func initializePSTFile(pstFile *pst.File, logger StructuredLogger) (string, string, error) {
+	contentType, err := pstFile.GetContentType()
+
+	if err != nil {
+		logger.Errorf("Failed to get content type: %s", err)
+		return "", "", errors.New("failed to get content type")
+	}
+
+	logger.Infof("Content type: %s", contentType)
+
+	formatType, err := pstFile.GetFormatType()
+
+	if err != nil {
+		logger.Errorf("Failed to get format type: %s", err)
+		return "", "", errors.New("failed to get format type")
+	}
+
+	logger.Infof("Format type: %s", formatType)
+
+	encryptionType, err := pstFile.GetEncryptionType(formatType)
+
+	if err != nil {
+		logger.Errorf("Failed to get encryption type: %s", err)
+		return "", "", errors.New("failed to get encryption type")
+	}
+
+	logger.Infof("Encryption type: %s", encryptionType)
+	logger.Infof("Initializing B-Trees...")
+
+	err = pstFile.InitializeBTrees(formatType)
+
+	if err != nil {
+		logger.Errorf("Failed to initialize node and block b-tree: %s", err)
+		return "", "", errors.New("failed to initialize node and block b-tree")
+	}
+
+	err = pstFile.InitializeNameToIDMap(formatType, encryptionType)
+
+	if err != nil {
+		logger.Errorf("Failed to initialize Name-To-ID Map: %s", err)
+		return "", "", errors.New("failed to initialize Name-To-ID Map")
+	}
+
+	return formatType, encryptionType, nil
+}
+
+// Validate checks the signature of the PST file and previews its folders using the B-Trees.
+// The message counts are read from the table contexts of the folders, the messages themselves aren't read.
+// Panics of go-pst are returned as ErrPSTPanicked.
+func (parser PSTParser) Validate(evidence *Evidence, project Project) (preview EvidencePreview, err error) {
+	logger := Logger.WithFields(LogFields{"project_uuid": project.UUID, "evidence_uuid": evidence.UUID})
+
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			logger.Errorf("Failed to validate PST file: %v", recovered)
+			preview, err = EvidencePreview{}, fmt.Errorf("%w: %v", ErrPSTPanicked, recovered)
 		}
+	}()
 
-		err = rootTreeNode.Save(database)
+	evidencePath, err := DownloadEvidence(*evidence, project.UUID)
 
-		if err != nil {
-			Logger.Errorf("Failed to save tree node: %s", err)
-			return errors.New("failed to save tree node")
+	if err != nil {
+		return EvidencePreview{}, err
+	}
+
+	defer func() {
+		if err := os.Remove(evidencePath); err != nil {
+			logger.Errorf("Failed to cleanup evidence file: %s", err)
 		}
+	}()
 
-		err = parseSubFolders(pstFile, rootFolder, formatType, encryptionType, project, evidence, database, rootTreeNode)
+	pstFile, err := pst.NewFromFile(evidencePath)
 
-		if err != nil {
-			Logger.Errorf("Failed to get sub-folders: %s", err)
-			return errors.New("failed to get sub-folders")
+	if err != nil {
+		return EvidencePreview{}, err
+	}
+
+	defer func() {
+		if err := pstFile.Close(); err != nil {
+			logger.Errorf("Failed to close PST file: %s", err)
 		}
+	}()
 
-		evidence.IsParsed = true
+	isValidSignature, err := pstFile.IsValidSignature()
+
+	if err != nil || !isValidSignature {
+		return EvidencePreview{}, nil
+	}
+
+	formatType, encryptionType, err := initializePSTFile(&pstFile, logger)
+
+	if err != nil {
+		return EvidencePreview{}, err
+	}
+
+	rootFolder, err := pstFile.GetRootFolder(formatType, encryptionType)
+
+	if err != nil {
+		return EvidencePreview{}, err
+	}
+
+	subFolders, err := previewSubFolders(pstFile, rootFolder, formatType, encryptionType)
+
+	if err != nil {
+		return EvidencePreview{}, err
+	}
+
+	return EvidencePreview{
+		IsValidSignature: true,
+		RootFolder: FolderPreview{
+			Title:   strings.Split(evidence.FileName, "-")[1],
+			Folders: subFolders,
+		},
+	}, nil
+}
+
+// previewSubFolders is a recursive function which previews all sub-folders for the specified folder, see parseSubFolders.
+func previewSubFolders(pstFile pst.File, folder pst.Folder, formatType string, encryptionType string) ([]FolderPreview, error) {
+	subFolders, err := pstFile.GetSubFolders(folder, formatType, encryptionType)
 
-		err = evidence.Save(database)
+	if err != nil {
+		return nil, err
+	}
+
+	var folderPreviews []FolderPreview
+
+	for _, subFolder := range subFolders {
+		messages, err := pstFile.GetMessages(subFolder, formatType, encryptionType)
 
 		if err != nil {
-			Logger.Errorf("Failed to save evidence: %s", err)
-			return err
+			return nil, err
 		}
 
-		Logger.Infof("Finished parsing file: %s", evidence.FileHash)
+		subFolderPreviews, err := previewSubFolders(pstFile, subFolder, formatType, encryptionType)
 
-		return nil
-	})
+		if err != nil {
+			return nil, err
+		}
 
-	return errorGroup.Wait()
+		folderPreviews = append(folderPreviews, FolderPreview{
+			Title:    subFolder.DisplayName,
+			Messages: len(messages),
+			Folders:  subFolderPreviews,
+		})
+	}
+
+	return folderPreviews, nil
 }
 
 // parseSubFolders is a recursive function which parses all sub-folders for the specified folder.
-func parseSubFolders(pstFile pst.File, folder pst.Folder, formatType string, encryptionType string, project Project, evidence *Evidence, database *pgx.Conn, treeNode TreeNode) error {
+// The folder path identifies the folder in parse errors, unreadable folders and messages are skipped if parsing is best effort.
+// The progress is reported per folder and per batch of messages by the pipeline, its percentage is unknown.
+func parseSubFolders(pstFile pst.File, folder pst.Folder, folderPath string, formatType string, encryptionType string, pipeline *Pipeline, treeNode TreeNode) error {
+	logger := Logger.WithFields(LogFields{"project_uuid": pipeline.project.UUID, "evidence_uuid": pipeline.evidence.UUID})
+
 	subFolders, err := pstFile.GetSubFolders(folder, formatType, encryptionType)
 
 	if err != nil {
-		return err
+		return pipeline.Tolerate(folderPath, err)
 	}
 
 	for _, subFolder := range subFolders {
-		Logger.Infof("Parsing sub-folder: %s", subFolder.DisplayName)
+		logger.Infof("Parsing sub-folder: %s", subFolder.DisplayName)
+
+		subFolderPath := fmt.Sprintf("%s/%s", folderPath, subFolder.DisplayName)
 
 		messages, err := pstFile.GetMessages(subFolder, formatType, encryptionType)
 
 		if err != nil {
-			return err
+			// The sub-folders are still parsed.
+			if err := pipeline.Tolerate(subFolderPath, err); err != nil {
+				return err
+			}
 		}
 
 		// Initialize our tree node (folders presented in the filesystem).
-		subFolderTreeNode := TreeNode{
-			FolderUUID:   NewUUID(),
-			EvidenceUUID: evidence.UUID,
-			Title:        subFolder.DisplayName,
-			Parent:       treeNode.FolderUUID,
-		}
-
-		err = subFolderTreeNode.Save(database)
+		subFolderTreeNode, err := pipeline.CreateFolder(subFolder.DisplayName, treeNode.FolderUUID)
 
 		if err != nil {
 			return err
 		}
 
 		if len(messages) > 0 {
-			Logger.Infof("Found %d messages.", len(messages))
-
-			var kafkaMessages []kafka.Message
+			logger.Infof("Found %d messages.", len(messages))
 
-			for _, message := range messages {
+			for i, message := range messages {
 				attachments, err := message.GetAttachments(&pstFile, formatType, encryptionType)
 
 				if err != nil {
-					return err
+					if err := pipeline.Tolerate(fmt.Sprintf("%s (message %d)", subFolderPath, i+1), err); err != nil {
+						return err
+					}
+
+					continue
 				}
 
 				var pstAttachments []Attachment
 
 				for _, attachment := range attachments {
-					// Write attachment to disk and upload it to MinIO.
 					attachmentFilename, err := attachment.GetFilename()
 
 					if err != nil {
-						Logger.Errorf("Failed to get attachment filename, using default: %s", err)
+						logger.Errorf("Failed to get attachment filename, using default: %s", err)
 						attachmentFilename = "EMPTY_FILENAME"
 					}
 
-					pstAttachment := Attachment{
-						UUID: NewUUID(),
-						Name: attachmentFilename,
-					}
-
-					pstAttachments = append(pstAttachments, pstAttachment)
-
-					err = attachment.WriteToFile(fmt.Sprintf("%s/%s", GetProjectTempDirectory(project.UUID), pstAttachment.UUID), &pstFile, formatType, encryptionType)
+					// Write attachment to disk and upload it to MinIO.
+					pstAttachment, err := pipeline.EmitAttachment(attachmentFilename, func(filePath string) error {
+						return attachment.WriteToFile(filePath, &pstFile, formatType, encryptionType)
+					})
 
 					if err != nil {
-						Logger.Errorf("Failed to write attachment to file: %s", err)
+						logger.Errorf("Failed to upload attachment: %s", err)
 						continue
 					}
 
-					_, err = UploadFile(pstAttachment.UUID, fmt.Sprintf("%s/%s", GetProjectTempDirectory(project.UUID), pstAttachment.UUID), project.UUID)
-
-					if err != nil {
-						Logger.Errorf("Failed to upload evidence: %s", err)
-						return err
-					}
-
-					err = os.Remove(fmt.Sprintf("%s/%s", GetProjectTempDirectory(project.UUID), pstAttachment.UUID))
-
-					if err != nil {
-						Logger.Errorf("Failed to remove file: %s", err)
-						return err
-					}
+					pstAttachments = append(pstAttachments, pstAttachment)
 				}
 
-				pstMessage := createMessage(pstFile, message, project, subFolderTreeNode.FolderUUID, evidence, pstAttachments, formatType, encryptionType)
-
-				kafkaMessages = append(kafkaMessages, kafka.Message{
-					Key:   []byte(pstMessage.UUID),
-					Value: []byte(pstMessage.JSON()),
-				})
-
-				if len(kafkaMessages) >= 100 {
-					err := KafkaWriter.WriteMessages(context.Background(), kafkaMessages...)
+				pstMessage := createMessage(pstFile, message, pipeline.project, subFolderTreeNode.FolderUUID, pstAttachments, formatType, encryptionType)
 
-					if err != nil {
-						return err
-					}
-
-					kafkaMessages = []kafka.Message{}
+				if err := pipeline.EmitMessage(pstMessage); err != nil {
+					return err
 				}
-			}
 
-			if len(kafkaMessages) > 0 {
-				err := KafkaWriter.WriteMessages(context.Background(), kafkaMessages...)
-
-				if err != nil {
-					return err
+				if pstMessage.MessageClass == messageClassContact {
+					pipeline.EmitContact(createContact(pstFile, message, subFolderTreeNode.FolderUUID, formatType, encryptionType))
 				}
 			}
 		}
 
-		err = parseSubFolders(pstFile, subFolder, formatType, encryptionType, project, evidence, database, subFolderTreeNode)
+		err = parseSubFolders(pstFile, subFolder, subFolderPath, formatType, encryptionType, pipeline, subFolderTreeNode)
 
 		if err != nil {
 			return err
@@ -281,8 +397,10 @@ func parseSubFolders(pstFile pst.File, folder pst.Folder, formatType string, enc
 	return nil
 }
 
-// createMessage creates a message from the PST message which can be sent to Apache Kafka.
-func createMessage(pstFile pst.File, message pst.Message, project Project, folderUUID string, evidence *Evidence, attachments []Attachment, formatType string, encryptionType string) Message {
+// createMessage creates a message from the PST message which can be emitted to the pipeline.
+func createMessage(pstFile pst.File, message pst.Message, project Project, folderUUID string, attachments []Attachment, formatType string, encryptionType string) Message {
+	logger := Logger.WithFields(LogFields{"project_uuid": project.UUID})
+
 	var pstMessage Message
 
 	var bodyBuilder strings.Builder
@@ -290,23 +408,40 @@ func createMessage(pstFile pst.File, message pst.Message, project Project, folde
 	messageClass, err := message.GetMessageClass(&pstFile, formatType, encryptionType)
 
 	if err == nil {
-		if messageClass == "IPM.Appointment" {
+		if messageClass == messageClassAppointment {
+			// The fields are also written to the body so they remain searchable.
+			appointment := &Appointment{}
+
 			if allAttendees, err := message.GetAppointmentAllAttendees(&pstFile, formatType, encryptionType); err == nil {
 				bodyBuilder.Write([]byte(fmt.Sprintf("All attendees: %s\n", allAttendees)))
+
+				appointment.Attendees = splitAppointmentAttendees(allAttendees)
 			}
 
 			if location, err := message.GetAppointmentLocation(&pstFile, formatType, encryptionType); err == nil {
 				bodyBuilder.Write([]byte(fmt.Sprintf("Location: %s\n", location)))
+
+				appointment.Location = location
 			}
 
 			if startTime, err := message.GetAppointmentStartTime(&pstFile); err == nil {
 				bodyBuilder.Write([]byte(fmt.Sprintf("Start time: %s\n", startTime.String())))
+
+				appointment.Start = int(startTime.Unix())
 			}
 
 			if endTime, err := message.GetAppointmentEndTime(&pstFile); err == nil {
 				bodyBuilder.Write([]byte(fmt.Sprintf("End time: %s\n", endTime.String())))
+
+				appointment.End = int(endTime.Unix())
+			}
+
+			if appointment.End < appointment.Start {
+				appointment.End = appointment.Start
 			}
-		} else if messageClass == "IPM.Contact" {
+
+			pstMessage.Appointment = appointment
+		} else if messageClass == messageClassContact {
 			if givenName, err := message.GetContactGivenName(&pstFile, formatType, encryptionType); err == nil {
 				bodyBuilder.Write([]byte(fmt.Sprintf("Given name: %s\n", givenName)))
 			}
@@ -349,6 +484,11 @@ func createMessage(pstFile pst.File, message pst.Message, project Project, folde
 		pstMessage.From = from
 	}
 
+	// The sender of an appointment is its organizer.
+	if pstMessage.Appointment != nil {
+		pstMessage.Appointment.Organizer = pstMessage.From
+	}
+
 	if to, err := message.GetTo(&pstFile, formatType, encryptionType); err == nil {
 		pstMessage.To = to
 	}
@@ -361,11 +501,11 @@ func createMessage(pstFile pst.File, message pst.Message, project Project, folde
 		pstMessage.Received = int(received.Unix())
 
 		if pstMessage.Received < 0 {
-			Logger.Error("Negative received date for message!")
+			logger.Errorf("Negative received date for message!")
 			pstMessage.Received = 0
 		}
 	} else {
-		Logger.Errorf("Failed to get received date: %s", err)
+		logger.Errorf("Failed to get received date: %s", err)
 		pstMessage.Received = 0
 	}
 
@@ -373,11 +513,83 @@ func createMessage(pstFile pst.File, message pst.Message, project Project, folde
 		pstMessage.Headers = headers
 	}
 
-	pstMessage.UUID = NewUUID()
-	pstMessage.ProjectUUID = project.UUID
+	pstMessage.MessageClass = messageClass
+
+	if importance, err := message.GetInteger(pidTagImportance); err == nil {
+		pstMessage.Importance = mapiImportance[importance]
+	}
+
+	if sensitivity, err := message.GetInteger(pidTagSensitivity); err == nil {
+		pstMessage.Sensitivity = mapiSensitivity[sensitivity]
+	}
+
+	if messageSize, err := message.GetInteger(pidTagMessageSize); err == nil {
+		pstMessage.Size = MessageSize(messageSize)
+	}
+
+	if messageFlags, err := message.GetInteger(pidTagMessageFlags); err == nil {
+		isRead := messageFlags&mapiMessageFlagRead != 0
+		pstMessage.IsRead = &isRead
+
+		if messageFlags&mapiMessageFlagUnsent != 0 {
+			pstMessage.MailboxDirection = MessageMailboxDirectionDraft
+		} else if messageFlags&mapiMessageFlagFromMe != 0 {
+			pstMessage.MailboxDirection = MessageMailboxDirectionSent
+		}
+	}
+
+	if readReceiptRequested, err := message.GetInteger(pidTagReadReceiptRequested); err == nil {
+		pstMessage.ReadReceiptRequested = readReceiptRequested != 0
+	}
+
+	if deliveryReceiptRequested, err := message.GetInteger(pidTagOriginatorDeliveryReportRequested); err == nil {
+		pstMessage.DeliveryReceiptRequested = deliveryReceiptRequested != 0
+	}
+
+	pstMessage.Receipt = getMessageReceipt(messageClass, pstMessage.Headers)
+
 	pstMessage.Attachments = attachments
 	pstMessage.FolderUUID = folderUUID
-	pstMessage.EvidenceUUID = evidence.UUID
 
 	return pstMessage
 }
+
+// createContact creates the contact record of the PST contact (IPM.Contact) which can be emitted to the pipeline.
+func createContact(pstFile pst.File, message pst.Message, folderUUID string, formatType string, encryptionType string) Contact {
+	contact := Contact{
+		FolderUUID: folderUUID,
+		Source:     ContactSourcePST,
+	}
+
+	if givenName, err := message.GetContactGivenName(&pstFile, formatType, encryptionType); err == nil {
+		contact.GivenName = givenName
+	}
+
+	// The email display name usually contains the email address, e.g. "John Doe (john@example.com)".
+	if emailDisplayName, err := message.GetContactEmailDisplayName(&pstFile, formatType, encryptionType); err == nil {
+		contact.EmailAddresses = getContactEmailAddresses(emailDisplayName)
+	}
+
+	if companyName, err := message.GetContactCompanyName(&pstFile, formatType, encryptionType); err == nil {
+		contact.CompanyName = companyName
+	}
+
+	if businessPhoneNumber, err := message.GetContactBusinessPhoneNumber(&pstFile, formatType, encryptionType); err == nil {
+		contact.BusinessPhoneNumber = businessPhoneNumber
+	}
+
+	if mobilePhoneNumber, err := message.GetContactMobilePhoneNumber(&pstFile, formatType, encryptionType); err == nil {
+		contact.MobilePhoneNumber = mobilePhoneNumber
+	}
+
+	// The subject of a contact is its display name.
+	if subject, err := message.GetSubject(&pstFile, formatType, encryptionType); err == nil {
+		contact.DisplayName = subject
+	}
+
+	if contact.DisplayName == "" {
+		contact.DisplayName = contact.GivenName
+	}
+
+	return contact
+}
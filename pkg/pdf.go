@@ -0,0 +1,313 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Layout of the PDF documents (A4 in points).
+const (
+	pdfPageWidth      = 595.28
+	pdfPageHeight     = 841.89
+	pdfMargin         = 50.0
+	pdfFontSize       = 9.0
+	pdfHeadingSize    = 13.0
+	pdfTitleSize      = 18.0
+	pdfLineSpacing    = 1.4
+	pdfParagraphSpace = 6.0
+)
+
+// PDF fonts, the standard Type 1 fonts don't have to be embedded.
+const (
+	pdfFontRegular = "F1" // Helvetica.
+	pdfFontBold    = "F2" // Helvetica-Bold.
+)
+
+// pdfWinAnsiCharacters defines the WinAnsi codes of the characters outside Latin-1.
+var pdfWinAnsiCharacters = map[rune]byte{
+	'€': 0x80, '‚': 0x82, 'ƒ': 0x83, '„': 0x84, '…': 0x85, '†': 0x86, '‡': 0x87, 'ˆ': 0x88, '‰': 0x89, 'Š': 0x8A,
+	'‹': 0x8B, 'Œ': 0x8C, 'Ž': 0x8E, '‘': 0x91, '’': 0x92, '“': 0x93, '”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97,
+	'˜': 0x98, '™': 0x99, 'š': 0x9A, '›': 0x9B, 'œ': 0x9C, 'ž': 0x9E, 'Ÿ': 0x9F,
+}
+
+// pdfDocument writes a text document (titles, headings, paragraphs and table rows) as PDF.
+// Like the XLSX writer it has no dependencies: text uses the standard Helvetica fonts with the WinAnsi encoding,
+// characters outside the encoding are replaced by a question mark.
+type pdfDocument struct {
+	pages []*bytes.Buffer
+	y     float64 // The baseline of the next line on the current page.
+}
+
+// newPDFDocument creates a document with an empty first page.
+func newPDFDocument() *pdfDocument {
+	document := &pdfDocument{}
+
+	document.newPage()
+
+	return document
+}
+
+// newPage starts a new page.
+func (document *pdfDocument) newPage() {
+	document.pages = append(document.pages, &bytes.Buffer{})
+	document.y = pdfPageHeight - pdfMargin
+}
+
+// reserve starts a new page if the current page doesn't have the height left.
+func (document *pdfDocument) reserve(height float64) {
+	if document.y-height < pdfMargin {
+		document.newPage()
+	}
+}
+
+// writeText writes the text at the position of the current page.
+func (document *pdfDocument) writeText(x float64, y float64, font string, size float64, text string) {
+	page := document.pages[len(document.pages)-1]
+
+	_, _ = fmt.Fprintf(page, "BT /%s %.1f Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, y, encodePDFText(text))
+}
+
+// writeLines writes the text wrapped to the width of the page.
+func (document *pdfDocument) writeLines(font string, size float64, text string) {
+	lineHeight := size * pdfLineSpacing
+
+	for _, paragraph := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		for _, line := range wrapPDFText(paragraph, font, size, pdfPageWidth-2*pdfMargin) {
+			document.reserve(lineHeight)
+			document.y -= lineHeight
+			document.writeText(pdfMargin, document.y, font, size, line)
+		}
+	}
+}
+
+// Title writes the title of the document.
+func (document *pdfDocument) Title(text string) {
+	document.writeLines(pdfFontBold, pdfTitleSize, text)
+	document.y -= pdfParagraphSpace
+}
+
+// Heading writes a section heading, a heading is never the last line of a page.
+func (document *pdfDocument) Heading(text string) {
+	document.reserve(pdfHeadingSize*pdfLineSpacing + pdfParagraphSpace + 3*pdfFontSize*pdfLineSpacing)
+	document.y -= pdfParagraphSpace
+	document.writeLines(pdfFontBold, pdfHeadingSize, text)
+	document.y -= pdfParagraphSpace / 2
+}
+
+// Paragraph writes the wrapped text, newlines start a new line.
+func (document *pdfDocument) Paragraph(text string) {
+	document.writeLines(pdfFontRegular, pdfFontSize, text)
+	document.y -= pdfParagraphSpace / 2
+}
+
+// TableRow writes a row of cells, each cell is truncated to its column width (in points).
+// Header rows are bold.
+func (document *pdfDocument) TableRow(values []string, columnWidths []float64, isHeader bool) {
+	font := pdfFontRegular
+
+	if isHeader {
+		font = pdfFontBold
+	}
+
+	lineHeight := pdfFontSize * pdfLineSpacing
+
+	document.reserve(lineHeight)
+	document.y -= lineHeight
+
+	x := pdfMargin
+
+	for i, value := range values {
+		if i >= len(columnWidths) {
+			break
+		}
+
+		document.writeText(x, document.y, font, pdfFontSize, truncatePDFText(value, font, pdfFontSize, columnWidths[i]-pdfFontSize/2))
+
+		x += columnWidths[i]
+	}
+}
+
+// Write writes the document with the page numbers in the footer.
+func (document *pdfDocument) Write(writer io.Writer) error {
+	var output bytes.Buffer
+	var offsets []int
+
+	startObject := func() int {
+		offsets = append(offsets, output.Len())
+
+		return len(offsets)
+	}
+
+	output.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	// The catalog, page tree and fonts are objects 1 to 4, followed by a page and content object per page.
+	pageObjectNumber := func(page int) int {
+		return 5 + page*2
+	}
+
+	var kids []string
+
+	for page := range document.pages {
+		kids = append(kids, fmt.Sprintf("%d 0 R", pageObjectNumber(page)))
+	}
+
+	startObject()
+	output.WriteString("1 0 obj\n<< /Type /Catalog /Pages 2 0 R >>\nendobj\n")
+
+	startObject()
+	_, _ = fmt.Fprintf(&output, "2 0 obj\n<< /Type /Pages /Kids [%s] /Count %d >>\nendobj\n", strings.Join(kids, " "), len(document.pages))
+
+	startObject()
+	output.WriteString("3 0 obj\n<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>\nendobj\n")
+
+	startObject()
+	output.WriteString("4 0 obj\n<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>\nendobj\n")
+
+	for page, content := range document.pages {
+		_, _ = fmt.Fprintf(content, "BT /%s %.1f Tf %.2f %.2f Td (%s) Tj ET\n", pdfFontRegular, pdfFontSize, pdfMargin, pdfMargin/2, encodePDFText(fmt.Sprintf("Page %d of %d", page+1, len(document.pages))))
+
+		objectNumber := startObject()
+		_, _ = fmt.Fprintf(&output, "%d 0 obj\n<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] /Resources << /Font << /%s 3 0 R /%s 4 0 R >> >> /Contents %d 0 R >>\nendobj\n", objectNumber, pdfPageWidth, pdfPageHeight, pdfFontRegular, pdfFontBold, objectNumber+1)
+
+		objectNumber = startObject()
+		_, _ = fmt.Fprintf(&output, "%d 0 obj\n<< /Length %d >>\nstream\n", objectNumber, content.Len())
+		output.Write(content.Bytes())
+		output.WriteString("\nendstream\nendobj\n")
+	}
+
+	xrefOffset := output.Len()
+
+	_, _ = fmt.Fprintf(&output, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+
+	for _, offset := range offsets {
+		_, _ = fmt.Fprintf(&output, "%010d 00000 n \n", offset)
+	}
+
+	_, _ = fmt.Fprintf(&output, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xrefOffset)
+
+	_, err := writer.Write(output.Bytes())
+
+	return err
+}
+
+// encodePDFText returns the text as an escaped WinAnsi PDF string (without parentheses).
+func encodePDFText(text string) string {
+	var encoded strings.Builder
+
+	for _, character := range text {
+		switch {
+		case character == '(' || character == ')' || character == '\\':
+			encoded.WriteByte('\\')
+			encoded.WriteRune(character)
+		case character == '\t':
+			encoded.WriteByte(' ')
+		case character < 0x20 || character == 0x7F:
+			continue
+		case character < 0x7F:
+			encoded.WriteRune(character)
+		case character >= 0xA0 && character <= 0xFF:
+			encoded.WriteString(fmt.Sprintf("\\%03o", character))
+		default:
+			if code, ok := pdfWinAnsiCharacters[character]; ok {
+				encoded.WriteString(fmt.Sprintf("\\%03o", code))
+			} else {
+				encoded.WriteByte('?')
+			}
+		}
+	}
+
+	return encoded.String()
+}
+
+// getPDFTextWidth returns the approximate width of the text in points, based on the Helvetica glyph widths.
+func getPDFTextWidth(text string, font string, size float64) float64 {
+	var width float64
+
+	for _, character := range text {
+		switch {
+		case strings.ContainsRune("ijlI.,:;'|!", character):
+			width += 0.278
+		case strings.ContainsRune("frt()[]- ", character):
+			width += 0.333
+		case strings.ContainsRune("mwMW@%", character):
+			width += 0.889
+		case character >= 'A' && character <= 'Z':
+			width += 0.667
+		default:
+			width += 0.556
+		}
+	}
+
+	if font == pdfFontBold {
+		width *= 1.06
+	}
+
+	return width * size
+}
+
+// wrapPDFText splits the text into lines which fit the width, words longer than the width are split.
+func wrapPDFText(text string, font string, size float64, width float64) []string {
+	var lines []string
+	var line string
+
+	for _, word := range strings.Fields(text) {
+		for getPDFTextWidth(word, font, size) > width {
+			if line != "" {
+				lines = append(lines, line)
+				line = ""
+			}
+
+			runes := []rune(word)
+			split := len(runes) - 1
+
+			for split > 1 && getPDFTextWidth(string(runes[:split]), font, size) > width {
+				split--
+			}
+
+			if split < 1 {
+				split = 1
+			}
+
+			lines = append(lines, string(runes[:split]))
+			word = string(runes[split:])
+		}
+
+		if line == "" {
+			line = word
+		} else if getPDFTextWidth(line+" "+word, font, size) <= width {
+			line += " " + word
+		} else {
+			lines = append(lines, line)
+			line = word
+		}
+	}
+
+	// Empty paragraphs are kept as empty lines.
+	if line != "" || len(lines) == 0 {
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+// truncatePDFText returns the text truncated with an ellipsis to fit the width.
+func truncatePDFText(text string, font string, size float64, width float64) string {
+	text = strings.Join(strings.Fields(text), " ")
+
+	if getPDFTextWidth(text, font, size) <= width {
+		return text
+	}
+
+	runes := []rune(text)
+
+	for len(runes) > 0 && getPDFTextWidth(string(runes)+"…", font, size) > width {
+		runes = runes[:len(runes)-1]
+	}
+
+	return string(runes) + "…"
+}
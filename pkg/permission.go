@@ -0,0 +1,181 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+)
+
+// ErrPermissionDenied is returned when the user is not allowed to perform the action on the project.
+var ErrPermissionDenied = errors.New("permission denied")
+
+// ErrProjectUserExists is returned when adding a user who is already assigned to the project, use SetProjectUserRole to change their role.
+var ErrProjectUserExists = errors.New("user is already assigned to the project")
+
+// ErrLastProjectOwner is returned when changing the role of the only owner of the project, every project keeps at least one owner.
+var ErrLastProjectOwner = errors.New("project must have at least one owner")
+
+// Project roles which can be assigned to a user via AddProjectUser.
+const (
+	RoleOwner    = "owner"
+	RoleExaminer = "examiner"
+	RoleReviewer = "reviewer"
+	RoleReadOnly = "read-only"
+)
+
+// Actions which are checked by CheckPermission.
+const (
+	// ActionView allows searching and viewing messages, the folder tree and the network.
+	ActionView = "view"
+	// ActionReview allows changing message metadata (bookmarks, tags and comments).
+	ActionReview = "review"
+	// ActionAssignReview allows assigning messages to reviewers.
+	ActionAssignReview = "assign_review"
+	// ActionManageEvidence allows adding and parsing evidence.
+	ActionManageEvidence = "manage_evidence"
+	// ActionExport allows creating exports and reports.
+	ActionExport = "export"
+	// ActionManageUsers allows adding users to the project and changing their role.
+	ActionManageUsers = "manage_users"
+	// ActionManageProject allows changing the retention policy, deleting tags and deleting the project.
+	ActionManageProject = "manage_project"
+)
+
+// rolePermissions defines the actions allowed per role.
+var rolePermissions = map[string][]string{
+	RoleOwner:    {ActionView, ActionReview, ActionAssignReview, ActionManageEvidence, ActionExport, ActionManageUsers, ActionManageProject},
+	RoleExaminer: {ActionView, ActionReview, ActionAssignReview, ActionManageEvidence, ActionExport},
+	RoleReviewer: {ActionView, ActionReview},
+	RoleReadOnly: {ActionView},
+}
+
+// IsValidRole returns true if the role is a known project role.
+func IsValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+
+	return ok
+}
+
+// RoleHasPermission returns true if the role is allowed to perform the action.
+func RoleHasPermission(role string, action string) bool {
+	for _, allowedAction := range rolePermissions[role] {
+		if allowedAction == action {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetProjectUserRole returns the role of the user in the project.
+func GetProjectUserRole(projectUUID string, userUUID string, database *pgx.Conn) (string, error) {
+	preparedStatement := `
+	SELECT role FROM project_user_junction WHERE projectUUID = $1 AND userUUID = $2 LIMIT 1
+	`
+	row := database.QueryRow(context.Background(), preparedStatement, projectUUID, userUUID)
+
+	var role string
+
+	if err := row.Scan(&role); err != nil {
+		return "", err
+	}
+
+	return role, nil
+}
+
+// getProjectUUIDsWithPermission returns the UUIDs of the projects in which the user is allowed to perform the action.
+func getProjectUUIDsWithPermission(userUUID string, action string, database *pgx.Conn) ([]string, error) {
+	preparedStatement := `
+	SELECT projectUUID, role FROM project_user_junction WHERE userUUID = $1
+	`
+	rows, err := database.Query(context.Background(), preparedStatement, userUUID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var projectUUIDs []string
+
+	for rows.Next() {
+		var projectUUID string
+		var role string
+
+		if err := rows.Scan(&projectUUID, &role); err != nil {
+			return nil, err
+		}
+
+		if RoleHasPermission(role, action) {
+			projectUUIDs = append(projectUUIDs, projectUUID)
+		}
+	}
+
+	rows.Close()
+
+	return projectUUIDs, rows.Err()
+}
+
+// CheckPermission returns ErrPermissionDenied if the user is not allowed to perform the action on the project.
+func CheckPermission(userUUID string, projectUUID string, action string, database *pgx.Conn) error {
+	role, err := GetProjectUserRole(projectUUID, userUUID, database)
+
+	if err == pgx.ErrNoRows {
+		return ErrPermissionDenied
+	} else if err != nil {
+		return err
+	}
+
+	if !RoleHasPermission(role, action) {
+		return ErrPermissionDenied
+	}
+
+	return nil
+}
+
+// SetProjectUserRole changes the role of the user in the project.
+// The acting user must be allowed to manage the project users. Returns ErrLastProjectOwner when demoting the only owner.
+func SetProjectUserRole(projectUUID string, actingUserUUID string, userUUID string, role string, database *pgx.Conn) error {
+	if err := CheckPermission(actingUserUUID, projectUUID, ActionManageUsers, database); err != nil {
+		return err
+	}
+
+	if !IsValidRole(role) {
+		return fmt.Errorf("invalid role: %s", role)
+	}
+
+	// Owners are only demoted if another owner remains.
+	preparedStatement := `
+	UPDATE project_user_junction SET role = $3 WHERE projectUUID = $1 AND userUUID = $2
+	AND ($3 = $4 OR role != $4 OR EXISTS (SELECT 1 FROM project_user_junction WHERE projectUUID = $1 AND userUUID != $2 AND role = $4))
+	`
+	commandTag, err := database.Exec(context.Background(), preparedStatement, projectUUID, userUUID, role, RoleOwner)
+
+	if err != nil {
+		return err
+	}
+
+	if commandTag.RowsAffected() > 0 {
+		return nil
+	}
+
+	if _, err := GetProjectUserRole(projectUUID, userUUID, database); err == pgx.ErrNoRows {
+		return errors.New("user is not assigned to the project")
+	} else if err != nil {
+		return err
+	}
+
+	return ErrLastProjectOwner
+}
+
+// ShareProject adds the user to the project with the specified role.
+// The acting user must be allowed to manage the project users. Returns ErrProjectUserExists if the user is already assigned.
+func ShareProject(projectUUID string, actingUserUUID string, userUUID string, role string, database *pgx.Conn) error {
+	if err := CheckPermission(actingUserUUID, projectUUID, ActionManageUsers, database); err != nil {
+		return err
+	}
+
+	return AddProjectUser(projectUUID, userUUID, role, database)
+}
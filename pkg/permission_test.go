@@ -0,0 +1,91 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestMemoryProjectRepoExistingUser tests that adding a user who is already assigned to the project keeps their role.
+func TestMemoryProjectRepoExistingUser(t *testing.T) {
+	projects := NewMemoryRepositories().Projects
+	project := Project{UUID: NewUUID(), Name: "Existing user", CreationDate: int(time.Now().Unix())}
+	userUUID := NewUUID()
+
+	if err := projects.SaveProject(project); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := projects.AddProjectUser(project.UUID, userUUID, RoleOwner); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := projects.AddProjectUser(project.UUID, userUUID, RoleReadOnly); !errors.Is(err, ErrProjectUserExists) {
+		t.Fatalf("adding an existing user returned %v, want ErrProjectUserExists", err)
+	}
+
+	if role, err := projects.GetProjectUserRole(project.UUID, userUUID); err != nil || role != RoleOwner {
+		t.Fatalf("role = %s (%v), want %s", role, err, RoleOwner)
+	}
+}
+
+// TestProjectUsers tests that existing users aren't added again and that the last owner of a project can't be demoted.
+func TestProjectUsers(t *testing.T) {
+	database := newTestDatabase(t)
+
+	projectUUID := NewUUID()
+	ownerUUID := NewUUID()
+	examinerUUID := NewUUID()
+
+	t.Cleanup(func() {
+		if err := deleteProjectRows(projectUUID, database); err != nil {
+			t.Errorf("Failed to remove test project: %s", err)
+		}
+	})
+
+	mustExec(t, database, "INSERT INTO project(uuid, name, creationDate) VALUES ($1, $2, $3)", projectUUID, "Project users", time.Now().Unix())
+
+	if err := AddProjectUser(projectUUID, ownerUUID, RoleOwner, database); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := AddProjectUser(projectUUID, ownerUUID, RoleOwner, database); !errors.Is(err, ErrProjectUserExists) {
+		t.Errorf("AddProjectUser of an existing user returned %v, want ErrProjectUserExists", err)
+	}
+
+	if err := ShareProject(projectUUID, ownerUUID, examinerUUID, RoleExaminer, database); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ShareProject(projectUUID, ownerUUID, examinerUUID, RoleReviewer, database); !errors.Is(err, ErrProjectUserExists) {
+		t.Errorf("ShareProject of an existing user returned %v, want ErrProjectUserExists", err)
+	}
+
+	if role, err := GetProjectUserRole(projectUUID, examinerUUID, database); err != nil || role != RoleExaminer {
+		t.Errorf("examiner role = %s (%v), want %s", role, err, RoleExaminer)
+	}
+
+	if err := SetProjectUserRole(projectUUID, ownerUUID, ownerUUID, RoleExaminer, database); !errors.Is(err, ErrLastProjectOwner) {
+		t.Errorf("demoting the last owner returned %v, want ErrLastProjectOwner", err)
+	}
+
+	// With a second owner the first owner can be demoted, after which the second owner is the last owner.
+	if err := SetProjectUserRole(projectUUID, ownerUUID, examinerUUID, RoleOwner, database); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetProjectUserRole(projectUUID, examinerUUID, ownerUUID, RoleReviewer, database); err != nil {
+		t.Fatalf("demoting an owner with another owner returned %s", err)
+	}
+
+	if err := SetProjectUserRole(projectUUID, examinerUUID, examinerUUID, RoleReadOnly, database); !errors.Is(err, ErrLastProjectOwner) {
+		t.Errorf("demoting the last owner returned %v, want ErrLastProjectOwner", err)
+	}
+
+	if role, err := GetProjectUserRole(projectUUID, examinerUUID, database); err != nil || role != RoleOwner {
+		t.Errorf("last owner role = %s (%v), want %s", role, err, RoleOwner)
+	}
+}
@@ -0,0 +1,658 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"fmt"
+	"github.com/aquasecurity/esquery"
+	"github.com/jackc/pgx/v4"
+	"html"
+	"math"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// URLReputationChecker checks the reputation of the URLs in messages, URL reputation isn't checked if nil.
+//
+// Deprecated: use Core.Config.URLReputationProvider or Core.Config.URLReputationAPIURL.
+var URLReputationChecker URLReputationProvider
+
+// URLReputationProvider checks the reputation of URLs, e.g. a threat intelligence feed or an external API.
+type URLReputationProvider interface {
+	// GetName identifies the provider.
+	GetName() string
+	// CheckURLs returns true for each malicious URL, in the order of the URLs.
+	CheckURLs(ctx context.Context, urls []string) ([]bool, error)
+}
+
+// MessagePhishing represents the phishing score of a message, see ScoreProjectPhishing.
+type MessagePhishing struct {
+	Score      int      `json:"score"`      // From 0 (no indicators) to 100.
+	Indicators []string `json:"indicators"` // The phishing indicators found, e.g. PhishingIndicatorDMARCFail.
+}
+
+// Phishing indicators.
+const (
+	PhishingIndicatorSPFFail             = "spf_fail"
+	PhishingIndicatorDKIMFail            = "dkim_fail"
+	PhishingIndicatorDMARCFail           = "dmarc_fail"
+	PhishingIndicatorDisplayNameMismatch = "display_name_mismatch" // The display name contains another address than the sender.
+	PhishingIndicatorReplyToMismatch     = "reply_to_mismatch"     // Replies go to another domain than the sender.
+	PhishingIndicatorLookalikeDomain     = "lookalike_domain"      // The sender domain imitates a custodian or protected domain.
+	PhishingIndicatorPunycodeDomain      = "punycode_domain"       // The sender or a link uses an internationalized (punycode) domain.
+	PhishingIndicatorLinkTextMismatch    = "link_text_mismatch"    // The text of a link shows another domain than it links to.
+	PhishingIndicatorIPAddressURL        = "ip_address_url"
+	PhishingIndicatorShortenedURL        = "shortened_url"
+	PhishingIndicatorLookalikeURL        = "lookalike_url" // A link points to a domain imitating a custodian or protected domain.
+	PhishingIndicatorMaliciousURL        = "malicious_url" // A link is malicious according to the URLReputationProvider.
+)
+
+// phishingIndicatorScores defines the score of each phishing indicator, the scores are added up to at most 100.
+var phishingIndicatorScores = map[string]int{
+	PhishingIndicatorSPFFail:             20,
+	PhishingIndicatorDKIMFail:            20,
+	PhishingIndicatorDMARCFail:           35,
+	PhishingIndicatorDisplayNameMismatch: 30,
+	PhishingIndicatorReplyToMismatch:     15,
+	PhishingIndicatorLookalikeDomain:     40,
+	PhishingIndicatorPunycodeDomain:      15,
+	PhishingIndicatorLinkTextMismatch:    30,
+	PhishingIndicatorIPAddressURL:        25,
+	PhishingIndicatorShortenedURL:        10,
+	PhishingIndicatorLookalikeURL:        35,
+	PhishingIndicatorMaliciousURL:        60,
+}
+
+// PhishingProtectedDomains defines the domains which are commonly impersonated, lookalikes of these and the custodian domains are phishing indicators.
+var PhishingProtectedDomains = []string{
+	"microsoft.com", "office.com", "office365.com", "outlook.com", "live.com", "google.com", "gmail.com", "apple.com", "icloud.com",
+	"amazon.com", "paypal.com", "docusign.com", "dropbox.com", "linkedin.com", "facebook.com", "netflix.com", "adobe.com", "dhl.com",
+	"fedex.com", "ups.com", "wetransfer.com", "sharepoint.com", "onedrive.com", "ing.nl", "rabobank.nl", "abnamro.nl",
+}
+
+// urlShortenerDomains defines the domains of URL shorteners, which hide the destination of links.
+var urlShortenerDomains = []string{
+	"bit.ly", "tinyurl.com", "t.co", "goo.gl", "ow.ly", "is.gd", "buff.ly", "rebrand.ly", "cutt.ly", "shorturl.at", "tiny.cc", "rb.gy",
+}
+
+// Regular expressions used to find the phishing indicators.
+var (
+	authenticationResultRegexp = regexp.MustCompile(`(?i)\b(spf|dkim|dmarc)\s*=\s*([a-z]+)`)
+	phishingAddressRegexp      = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+	htmlLinkRegexp             = regexp.MustCompile(`(?is)<a\s[^>]*href\s*=\s*["']([^"']+)["'][^>]*>(.*?)</a>`)
+	plainURLRegexp             = regexp.MustCompile(`(?i)\bhttps?://[^\s<>"'()]+`)
+	linkTextDomainRegexp       = regexp.MustCompile(`(?i)^(https?://)?([a-z0-9\-]+\.)+[a-z]{2,}(/\S*)?$`)
+)
+
+// maxPhishingURLs defines the maximum amount of URLs of a message which are checked.
+const maxPhishingURLs = 100
+
+// ErrInvalidPhishingScore is returned by GetSuspiciousMessages if the minimum score isn't between 0 and 100.
+var ErrInvalidPhishingScore = fmt.Errorf("the minimum phishing score must be between 0 and 100")
+
+// newURLReputationProvider returns the URL reputation provider of the configuration, the configured provider takes precedence over the API.
+// Returns nil if URL reputation isn't configured.
+func newURLReputationProvider(config Config) URLReputationProvider {
+	if config.URLReputationProvider != nil {
+		return config.URLReputationProvider
+	}
+
+	if config.URLReputationAPIURL != "" {
+		return NewHTTPURLReputationProvider(config.URLReputationAPIURL, config.URLReputationAPIKey)
+	}
+
+	return nil
+}
+
+// phishingScorer scores the phishing indicators of the messages of a project.
+type phishingScorer struct {
+	// protectedDomains are the PhishingProtectedDomains and the custodian domains.
+	protectedDomains []string
+	// custodianDomains are never lookalikes, messages between custodians are trusted more.
+	custodianDomains []string
+	urlReputation    URLReputationProvider
+}
+
+// newPhishingScorer creates the phishing scorer of the project.
+func newPhishingScorer(projectUUID string, database *pgx.Conn) (*phishingScorer, error) {
+	custodians, err := getCustodianConfiguration(projectUUID, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	custodianDomains := normalizeAddresses(custodians.Domains)
+
+	return &phishingScorer{
+		protectedDomains: append(append([]string{}, PhishingProtectedDomains...), custodianDomains...),
+		custodianDomains: custodianDomains,
+		urlReputation:    URLReputationChecker,
+	}, nil
+}
+
+// score returns the phishing score of the message.
+func (scorer *phishingScorer) score(ctx context.Context, message Message) (MessagePhishing, error) {
+	indicators := make(map[string]bool)
+
+	headers := message.Headers
+
+	if headers == messageNullValue {
+		headers = ""
+	}
+
+	for indicator := range getAuthenticationIndicators(headers) {
+		indicators[indicator] = true
+	}
+
+	// The From header isn't parsed as address list since spoofed display names containing an address are invalid.
+	var senderDomain string
+
+	if senderAddresses := phishingAddressRegexp.FindAllString(message.From, -1); len(senderAddresses) > 0 {
+		senderDomain = getAddressDomain(senderAddresses[len(senderAddresses)-1])
+	}
+
+	if senderDomain != "" {
+		if isDisplayNameMismatch(message.From, senderDomain) {
+			indicators[PhishingIndicatorDisplayNameMismatch] = true
+		}
+
+		for _, replyToAddress := range normalizeAddresses(getAddressesFromHeader(getHeaderValue(headers, "Reply-To"))) {
+			if replyToDomain := getAddressDomain(replyToAddress); replyToDomain != "" && !isSameDomain(replyToDomain, senderDomain) {
+				indicators[PhishingIndicatorReplyToMismatch] = true
+			}
+		}
+
+		if scorer.isLookalikeDomain(senderDomain) {
+			indicators[PhishingIndicatorLookalikeDomain] = true
+		}
+
+		if isPunycodeDomain(senderDomain) {
+			indicators[PhishingIndicatorPunycodeDomain] = true
+		}
+	}
+
+	body, err := getOriginalMessageBody(message)
+
+	if err != nil {
+		Logger.WithFields(LogFields{"project_uuid": message.ProjectUUID}).Errorf("Failed to get the body of message %s: %s", message.UUID, err)
+
+		body = message.Body
+	}
+
+	urls, linkTextMismatch := getMessageURLs(body)
+
+	if linkTextMismatch {
+		indicators[PhishingIndicatorLinkTextMismatch] = true
+	}
+
+	for _, messageURL := range urls {
+		parsedURL, err := url.Parse(messageURL)
+
+		if err != nil {
+			continue
+		}
+
+		host := strings.ToLower(parsedURL.Hostname())
+
+		switch {
+		case net.ParseIP(host) != nil:
+			indicators[PhishingIndicatorIPAddressURL] = true
+		case isDomainInList(host, urlShortenerDomains):
+			indicators[PhishingIndicatorShortenedURL] = true
+		case scorer.isLookalikeDomain(host):
+			indicators[PhishingIndicatorLookalikeURL] = true
+		}
+
+		if isPunycodeDomain(host) {
+			indicators[PhishingIndicatorPunycodeDomain] = true
+		}
+	}
+
+	if scorer.urlReputation != nil && len(urls) > 0 {
+		malicious, err := scorer.urlReputation.CheckURLs(ctx, urls)
+
+		if err != nil {
+			return MessagePhishing{}, err
+		}
+
+		if len(malicious) != len(urls) {
+			return MessagePhishing{}, fmt.Errorf("URL reputation provider %s returned %d results for %d URLs", scorer.urlReputation.GetName(), len(malicious), len(urls))
+		}
+
+		for _, isMalicious := range malicious {
+			if isMalicious {
+				indicators[PhishingIndicatorMaliciousURL] = true
+			}
+		}
+	}
+
+	phishing := MessagePhishing{
+		Indicators: []string{},
+	}
+
+	// Ordered by the indicator constants so the indicators of messages are comparable.
+	for _, indicator := range []string{
+		PhishingIndicatorSPFFail, PhishingIndicatorDKIMFail, PhishingIndicatorDMARCFail, PhishingIndicatorDisplayNameMismatch,
+		PhishingIndicatorReplyToMismatch, PhishingIndicatorLookalikeDomain, PhishingIndicatorPunycodeDomain, PhishingIndicatorLinkTextMismatch,
+		PhishingIndicatorIPAddressURL, PhishingIndicatorShortenedURL, PhishingIndicatorLookalikeURL, PhishingIndicatorMaliciousURL,
+	} {
+		if indicators[indicator] {
+			phishing.Indicators = append(phishing.Indicators, indicator)
+			phishing.Score += phishingIndicatorScores[indicator]
+		}
+	}
+
+	if phishing.Score > 100 {
+		phishing.Score = 100
+	}
+
+	return phishing, nil
+}
+
+// getAuthenticationIndicators returns the failed SPF, DKIM and DMARC checks of the Authentication-Results header.
+// Only the first (top-most) header is used since it is added by the receiving server, senders can add their own.
+// Falls back to the Received-SPF header if the results don't include SPF.
+func getAuthenticationIndicators(headers string) map[string]bool {
+	indicators := make(map[string]bool)
+
+	var hasSPF bool
+
+	for _, match := range authenticationResultRegexp.FindAllStringSubmatch(getHeaderValue(headers, "Authentication-Results"), -1) {
+		method, result := strings.ToLower(match[1]), strings.ToLower(match[2])
+
+		if method == "spf" {
+			hasSPF = true
+		}
+
+		if result != "fail" && result != "softfail" {
+			continue
+		}
+
+		switch method {
+		case "spf":
+			indicators[PhishingIndicatorSPFFail] = true
+		case "dkim":
+			indicators[PhishingIndicatorDKIMFail] = true
+		case "dmarc":
+			indicators[PhishingIndicatorDMARCFail] = true
+		}
+	}
+
+	if !hasSPF {
+		receivedSPF := strings.ToLower(getHeaderValue(headers, "Received-SPF"))
+
+		if strings.HasPrefix(receivedSPF, "fail") || strings.HasPrefix(receivedSPF, "softfail") {
+			indicators[PhishingIndicatorSPFFail] = true
+		}
+	}
+
+	return indicators
+}
+
+// isDisplayNameMismatch returns true if the display name of the From header contains an address of another domain than the sender,
+// e.g. "ceo@company.com <attacker@example.com>".
+func isDisplayNameMismatch(from string, senderDomain string) bool {
+	angleIndex := strings.LastIndex(from, "<")
+
+	if angleIndex == -1 {
+		return false
+	}
+
+	for _, displayAddress := range phishingAddressRegexp.FindAllString(from[:angleIndex], -1) {
+		if !isSameDomain(getAddressDomain(displayAddress), senderDomain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getMessageURLs returns the unique URLs of the body, at most maxPhishingURLs.
+// Also returns true if the text of an HTML link shows another domain than it links to.
+func getMessageURLs(body string) ([]string, bool) {
+	var urls []string
+	var linkTextMismatch bool
+
+	uniqueURLs := make(map[string]bool)
+
+	addURL := func(messageURL string) {
+		messageURL = strings.TrimRight(strings.TrimSpace(html.UnescapeString(messageURL)), ".,;:!?")
+
+		if !uniqueURLs[messageURL] && len(urls) < maxPhishingURLs {
+			uniqueURLs[messageURL] = true
+			urls = append(urls, messageURL)
+		}
+	}
+
+	if isHTMLBody(body) {
+		for _, match := range htmlLinkRegexp.FindAllStringSubmatch(body, -1) {
+			href := strings.TrimSpace(html.UnescapeString(match[1]))
+
+			if !strings.HasPrefix(strings.ToLower(href), "http://") && !strings.HasPrefix(strings.ToLower(href), "https://") {
+				continue
+			}
+
+			addURL(href)
+
+			linkText := strings.TrimSpace(html.UnescapeString(htmlTagsRegexp.ReplaceAllString(match[2], "")))
+
+			if !linkTextDomainRegexp.MatchString(linkText) {
+				continue
+			}
+
+			if !strings.Contains(linkText, "://") {
+				linkText = "http://" + linkText
+			}
+
+			textURL, textErr := url.Parse(linkText)
+			hrefURL, hrefErr := url.Parse(href)
+
+			if textErr == nil && hrefErr == nil && !isSameDomain(strings.ToLower(textURL.Hostname()), strings.ToLower(hrefURL.Hostname())) {
+				linkTextMismatch = true
+			}
+		}
+	}
+
+	for _, messageURL := range plainURLRegexp.FindAllString(body, -1) {
+		addURL(messageURL)
+	}
+
+	return urls, linkTextMismatch
+}
+
+// isLookalikeDomain returns true if the domain imitates a protected domain without being (a subdomain of) it.
+// Matches domains one edit away from a protected domain, homoglyphs (e.g. "rn" for "m" or "0" for "o")
+// and protected domains used as subdomain of another domain (e.g. "paypal.com.example.net").
+func (scorer *phishingScorer) isLookalikeDomain(domain string) bool {
+	if domain == "" || isDomainInList(domain, scorer.custodianDomains) {
+		return false
+	}
+
+	for _, protectedDomain := range scorer.protectedDomains {
+		if isSameDomain(domain, protectedDomain) {
+			return false
+		}
+	}
+
+	for _, protectedDomain := range scorer.protectedDomains {
+		if strings.HasPrefix(domain, protectedDomain+".") || strings.Contains(domain, "."+protectedDomain+".") {
+			return true
+		}
+
+		// Short names are one edit away from too many unrelated domains (e.g. "gmail" and "email").
+		isShortName := len(strings.SplitN(protectedDomain, ".", 2)[0]) < 6
+
+		for _, candidate := range getParentDomains(domain) {
+			if getHomoglyphSkeleton(candidate) == getHomoglyphSkeleton(protectedDomain) || (!isShortName && getEditDistance(candidate, protectedDomain) == 1) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// getParentDomains returns the domain and its parent domains with at least two labels, e.g. "a.example.com" and "example.com".
+func getParentDomains(domain string) []string {
+	labels := strings.Split(domain, ".")
+
+	var domains []string
+
+	for i := 0; i < len(labels)-1; i++ {
+		domains = append(domains, strings.Join(labels[i:], "."))
+	}
+
+	return domains
+}
+
+// homoglyphReplacer replaces the characters which look alike in most fonts.
+var homoglyphReplacer = strings.NewReplacer("rn", "m", "vv", "w", "cl", "d", "0", "o", "1", "l", "i", "l", "3", "e", "5", "s", "-", "")
+
+// getHomoglyphSkeleton returns the domain with look-alike characters replaced, domains with the same skeleton look alike.
+func getHomoglyphSkeleton(domain string) string {
+	return homoglyphReplacer.Replace(strings.ToLower(domain))
+}
+
+// getEditDistance returns the Levenshtein distance between the strings.
+func getEditDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+
+		for j := 1; j <= len(b); j++ {
+			substitution := previous[j-1]
+
+			if a[i-1] != b[j-1] {
+				substitution++
+			}
+
+			current[j] = int(math.Min(float64(substitution), math.Min(float64(previous[j]+1), float64(current[j-1]+1))))
+		}
+
+		previous, current = current, previous
+	}
+
+	return previous[len(b)]
+}
+
+// isSameDomain returns true if the domains are equal or one is a subdomain of the other.
+func isSameDomain(a string, b string) bool {
+	return a == b || strings.HasSuffix(a, "."+b) || strings.HasSuffix(b, "."+a)
+}
+
+// isDomainInList returns true if the domain or its parent domain is in the list.
+func isDomainInList(domain string, domains []string) bool {
+	for _, listDomain := range domains {
+		if domain == listDomain || strings.HasSuffix(domain, "."+listDomain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isPunycodeDomain returns true if a label of the domain is punycode encoded (an internationalized domain).
+func isPunycodeDomain(domain string) bool {
+	for _, label := range strings.Split(domain, ".") {
+		if strings.HasPrefix(label, "xn--") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ScorePhishingJobParameters represents the parameters of the JobTypeScorePhishing job.
+type ScorePhishingJobParameters struct {
+	Rescore bool `json:"rescore"` // Rescore the messages which are already scored, e.g. after changing the custodian domains.
+}
+
+// ScoreProjectPhishing scores the phishing indicators of the messages of the project which aren't scored yet, or all messages if rescore is set.
+// Combines the authentication results, display name and Reply-To mismatches, lookalike domains and the URLs of the messages,
+// including their reputation if a URL reputation provider is configured. The progress (percentage) is reported to reportProgress,
+// which may be nil. Returns the amount of scored messages, see GetSuspiciousMessages.
+func ScoreProjectPhishing(ctx context.Context, projectUUID string, rescore bool, reportProgress func(progress int), userUUID string, database *pgx.Conn) (int, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionManageProject, database); err != nil {
+		return 0, err
+	}
+
+	if err := updateMessagesMapping(); err != nil {
+		return 0, err
+	}
+
+	scorer, err := newPhishingScorer(projectUUID, database)
+
+	if err != nil {
+		return 0, err
+	}
+
+	query := esquery.Bool().Filter(esquery.Term("project_uuid", projectUUID))
+
+	if !rescore {
+		query = query.MustNot(esquery.Exists("phishing.score"))
+	}
+
+	total, err := countMessages(query)
+
+	if err != nil {
+		return 0, err
+	}
+
+	var scored int
+
+	err = forEachMessageBatch(query, func(messages []Message) error {
+		messageUUIDs := make([]string, len(messages))
+		messagePhishing := make(map[string]interface{}, len(messages))
+
+		for i, message := range messages {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			phishing, err := scorer.score(ctx, message)
+
+			if err != nil {
+				return err
+			}
+
+			messageUUIDs[i] = message.UUID
+			messagePhishing[message.UUID] = phishing
+		}
+
+		err := updateMessagesByScript(
+			newMessageUUIDsQuery(messageUUIDs, projectUUID),
+			"ctx._source.phishing = params.phishing[ctx._source.uuid];",
+			map[string]interface{}{
+				"phishing": messagePhishing,
+			},
+		)
+
+		if err != nil {
+			return err
+		}
+
+		scored += len(messages)
+
+		if reportProgress != nil && total > 0 {
+			reportProgress(int(math.Min(100, float64(scored)*100/float64(total))))
+		}
+
+		return nil
+	}, database)
+
+	if err != nil {
+		return scored, err
+	}
+
+	Logger.WithFields(LogFields{"project_uuid": projectUUID}).Infof("Scored the phishing indicators of %d messages", scored)
+
+	return scored, nil
+}
+
+// GetSuspiciousMessages returns at most size messages with at least the phishing score (0 to 100), the most suspicious first.
+// Messages without phishing indicators are never returned, see ScoreProjectPhishing.
+func GetSuspiciousMessages(projectUUID string, minScore int, size int, userUUID string, database *pgx.Conn) ([]Message, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return nil, err
+	}
+
+	if minScore < 0 || minScore > 100 {
+		return nil, ErrInvalidPhishingScore
+	}
+
+	if minScore == 0 {
+		minScore = 1
+	}
+
+	if size <= 0 || size > 10000 {
+		size = 10000
+	}
+
+	query := esquery.Bool().Filter(
+		esquery.Term("project_uuid", projectUUID),
+		esquery.Range("phishing.score").Gte(minScore),
+	)
+
+	response, err := esquery.Search().
+		Query(query).
+		Sort("phishing.score", esquery.OrderDesc).
+		Sort("received", esquery.OrderDesc).
+		Size(uint64(size)).
+		Run(
+			Elasticsearch,
+			Elasticsearch.Search.WithContext(context.Background()),
+			Elasticsearch.Search.WithIndex("messages"),
+		)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if response.IsError() {
+		errorMessage := response.String()
+
+		if err := response.Body.Close(); err != nil {
+			Logger.Errorf("Failed to close Elasticsearch response: %s", err)
+		}
+
+		return nil, fmt.Errorf("failed to search suspicious messages: %s", errorMessage)
+	}
+
+	return getMessagesFromSearchResult(response.Body, database)
+}
+
+// runScorePhishingJob runs ScoreProjectPhishing.
+func runScorePhishingJob(ctx context.Context, job Job, reportProgress func(progress int), database *pgx.Conn) (string, error) {
+	var parameters ScorePhishingJobParameters
+
+	if err := decodeJobParameters(job, &parameters); err != nil {
+		return "", err
+	}
+
+	_, err := ScoreProjectPhishing(ctx, job.ProjectUUID, parameters.Rescore, reportProgress, job.UserUUID, database)
+
+	return "", err
+}
+
+// httpURLReputationProvider checks the reputation of URLs with an external API.
+type httpURLReputationProvider struct {
+	url    string
+	apiKey string
+}
+
+// NewHTTPURLReputationProvider creates the URL reputation provider of the external API, the API key is sent as bearer token if set.
+// The API receives a JSON body {"urls": [...]} and must respond with {"malicious": [true, false, ...]}, a result per URL in the same order.
+func NewHTTPURLReputationProvider(url string, apiKey string) URLReputationProvider {
+	return &httpURLReputationProvider{
+		url:    url,
+		apiKey: apiKey,
+	}
+}
+
+// GetName returns the name of the provider.
+func (provider *httpURLReputationProvider) GetName() string {
+	return "api"
+}
+
+// CheckURLs posts the URLs to the API.
+func (provider *httpURLReputationProvider) CheckURLs(ctx context.Context, urls []string) ([]bool, error) {
+	var reputationResponse struct {
+		Malicious []bool `json:"malicious"`
+	}
+
+	if err := postAnalysisRequest(ctx, provider.url, provider.apiKey, map[string]interface{}{"urls": urls}, &reputationResponse); err != nil {
+		return nil, err
+	}
+
+	return reputationResponse.Malicious, nil
+}
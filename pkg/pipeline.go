@@ -0,0 +1,394 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"os"
+	"strings"
+	"time"
+)
+
+// Pipeline handles the ingestion shared by all parsers so a parser only has to adapt its format:
+// tree nodes, attachment uploads to MinIO, Kafka batching, progress reporting and error accounting.
+// Close must be called when parsing is done.
+type Pipeline struct {
+	project          Project
+	evidence         *Evidence // Nil for collected mailboxes.
+	provenance       Provenance
+	options          ParseOptions
+	custodians       CustodianConfiguration
+	progressReporter ProgressReporter
+	progressEvent    ProgressEvent
+	batcher          *MessageBatcher
+	parsedCounts     map[string]int // The emitted messages per folder UUID, see VerifyProjectIndex.
+	contacts         []Contact      // Indexed by Close.
+	scratchSpace     *ScratchSpace  // Created by the first attachment, removed by Close.
+	database         *pgx.Conn      // Nil for collected mailboxes and in the lightweight mode.
+	treeRepo         TreeRepo
+
+	// The mailbox direction of emitted messages is determined by their folder and the addresses of the custodian.
+	custodianAddresses []string          // Lowercase, see SetCustodianAddresses.
+	folderTitles       map[string]string // The folder titles per folder UUID, see CreateFolder.
+	folderTitle        string            // The current folder, see SetFolder.
+
+	// suppressedHashes are the hashes of the hash lists of the project, see ImportHashList.
+	suppressedHashes map[string]bool
+
+	// remainingMessages is the amount of messages which may still be emitted by the message quota of the project, -1 for no limit.
+	remainingMessages int
+}
+
+// NewPipeline creates the ingestion pipeline of the evidence, the evidence is nil for collected mailboxes.
+// The direction of emitted messages is relative to the custodian domains and addresses.
+// The emitted messages are stamped with the provenance of the parser (name and version of its library), see Provenance.
+func NewPipeline(project Project, evidence *Evidence, parser string, parserVersion string, options ParseOptions, custodians CustodianConfiguration, progressReporter ProgressReporter, database *pgx.Conn) *Pipeline {
+	pipeline := &Pipeline{
+		project:           project,
+		evidence:          evidence,
+		provenance:        newProvenance(parser, parserVersion, evidence),
+		options:           options,
+		custodians:        custodians,
+		progressReporter:  progressReporter,
+		progressEvent:     ProgressEvent{Stage: ProgressStageParsing},
+		parsedCounts:      make(map[string]int),
+		folderTitles:      make(map[string]string),
+		database:          database,
+		treeRepo:          getRepositories(database).Tree,
+		remainingMessages: -1,
+	}
+
+	if evidence == nil {
+		pipeline.progressEvent.Stage = ProgressStageCollecting
+	}
+
+	pipeline.batcher = NewMessageBatcher(func(written int) {
+		pipeline.progressEvent.Processed += written
+
+		pipeline.progressReporter.ReportProgress(pipeline.progressEvent)
+	})
+
+	return pipeline
+}
+
+// newEvidencePipeline creates the ingestion pipeline of the evidence parsed by the parser using the custodian configuration of the project.
+// The lightweight mode has no custodian configuration or hash lists.
+func newEvidencePipeline(project Project, evidence *Evidence, parser Parser, options ParseOptions, progressReporter ProgressReporter, database *pgx.Conn) (*Pipeline, error) {
+	if database == nil {
+		return NewPipeline(project, evidence, parser.GetName(), parser.GetVersion(), options, CustodianConfiguration{}, progressReporter, nil), nil
+	}
+
+	custodians, err := getCustodianConfiguration(project.UUID, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	custodian, err := getEvidenceCustodian(evidence.UUID, project.UUID, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pipeline := NewPipeline(project, evidence, parser.GetName(), parser.GetVersion(), options, custodians, progressReporter, database)
+
+	// The custodian may be a name or include the email address, e.g. "John Doe <john@example.com>".
+	pipeline.SetCustodianAddresses(getContactEmailAddresses(custodian)...)
+
+	pipeline.suppressedHashes, err = getSuppressedHashes(project.UUID, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pipeline.remainingMessages, err = getRemainingMessageQuota(project.UUID, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if options.Priority == JobPriorityLow {
+		pipeline.batcher.throttle = newIngestThrottle(LowPriorityIngestLimiter, database)
+	}
+
+	return pipeline, nil
+}
+
+// SetCustodianAddresses sets the addresses of the custodian, messages from these addresses are sent by the custodian (see Message.MailboxDirection).
+func (pipeline *Pipeline) SetCustodianAddresses(addresses ...string) {
+	pipeline.custodianAddresses = nil
+
+	for _, address := range addresses {
+		pipeline.custodianAddresses = append(pipeline.custodianAddresses, strings.ToLower(strings.TrimSpace(address)))
+	}
+}
+
+// CreateFolder saves the tree node of the folder and reports it as the current folder.
+// The parent is the folder UUID of the parent tree node or "NULL" for the root folder of the evidence.
+func (pipeline *Pipeline) CreateFolder(title string, parent string) (TreeNode, error) {
+	treeNode := TreeNode{
+		FolderUUID:  NewUUID(),
+		ProjectUUID: pipeline.project.UUID,
+		Title:       title,
+		Parent:      parent,
+	}
+
+	if pipeline.evidence != nil {
+		treeNode.EvidenceUUID = pipeline.evidence.UUID
+	}
+
+	if err := pipeline.treeRepo.SaveTreeNode(treeNode); err != nil {
+		return TreeNode{}, err
+	}
+
+	pipeline.parsedCounts[treeNode.FolderUUID] = 0
+	pipeline.folderTitles[treeNode.FolderUUID] = title
+
+	pipeline.SetFolder(title)
+
+	return treeNode, nil
+}
+
+// SetFolder reports the folder or mailbox as the current folder.
+func (pipeline *Pipeline) SetFolder(title string) {
+	pipeline.folderTitle = title
+	pipeline.progressEvent.Folder = title
+
+	pipeline.progressReporter.ReportProgress(pipeline.progressEvent)
+}
+
+// SetPercent sets the percentage reported with the next progress event, parsers which can't count the total leave it zero.
+func (pipeline *Pipeline) SetPercent(percent int) {
+	pipeline.progressEvent.Percent = percent
+}
+
+// EmitAttachment stores the attachment in MinIO (once per project, keyed by its hash), write is called to write the attachment to the temporary file path.
+// The temporary file is removed afterwards.
+func (pipeline *Pipeline) EmitAttachment(name string, write func(filePath string) error) (Attachment, error) {
+	attachment := Attachment{
+		UUID: NewUUID(),
+		Name: name,
+	}
+
+	if pipeline.scratchSpace == nil {
+		scratchSpace, err := NewScratchSpace(pipeline.project.UUID)
+
+		if err != nil {
+			return Attachment{}, err
+		}
+
+		pipeline.scratchSpace = scratchSpace
+	}
+
+	filePath := pipeline.scratchSpace.FilePath(attachment.UUID)
+
+	defer func() {
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			Logger.Errorf("Failed to remove attachment file: %s", err)
+		}
+	}()
+
+	if err := write(filePath); err != nil {
+		return Attachment{}, err
+	}
+
+	fileInfo, err := os.Stat(filePath)
+
+	if err != nil {
+		return Attachment{}, err
+	}
+
+	attachment.Size = fileInfo.Size()
+
+	// Collected mailboxes and the lightweight mode have no database to count the references, their attachments are stored by UUID.
+	if pipeline.database == nil {
+		if _, err := UploadFile(attachment.UUID, filePath, pipeline.project.UUID); err != nil {
+			return Attachment{}, err
+		}
+
+		return attachment, nil
+	}
+
+	attachment.Hash, err = storeAttachment(filePath, attachment.Size, pipeline.project.UUID, pipeline.database)
+
+	if err != nil {
+		return Attachment{}, err
+	}
+
+	return attachment, nil
+}
+
+// EmitMessage completes the message (UUIDs, provenance, directions, thread and sizes), offloads a large body and adds it to the Kafka batch.
+// Parsers which can't determine the size of the raw message leave it zero, it is estimated from the body, headers and attachments.
+// Returns an error wrapping ErrMessageQuotaExceeded once the message quota of the project is reached, which stops the parser.
+func (pipeline *Pipeline) EmitMessage(message Message) error {
+	if pipeline.remainingMessages == 0 {
+		return fmt.Errorf("%w: project %s", ErrMessageQuotaExceeded, pipeline.project.UUID)
+	}
+
+	if message.UUID == "" {
+		message.UUID = NewUUID()
+	}
+
+	message.ProjectUUID = pipeline.project.UUID
+
+	if pipeline.evidence != nil {
+		message.EvidenceUUID = pipeline.evidence.UUID
+	}
+
+	provenance := pipeline.provenance
+	provenance.ExtractedAt = int(time.Now().Unix())
+	message.Provenance = &provenance
+
+	setMessageDates(&message, time.Unix(int64(provenance.ExtractedAt), 0))
+
+	if message.Direction == "" {
+		message.Direction = getMessageDirection(message, pipeline.custodians)
+	}
+
+	if message.MailboxDirection == "" {
+		folderTitle, ok := pipeline.folderTitles[message.FolderUUID]
+
+		if !ok {
+			folderTitle = pipeline.folderTitle
+		}
+
+		message.MailboxDirection = getMailboxDirection(message, folderTitle, pipeline.custodianAddresses)
+	}
+
+	if message.ThreadID == "" {
+		message.ThreadID = getThreadID(message)
+	}
+
+	setBulkMailFlags(&message)
+
+	if len(pipeline.suppressedHashes) > 0 {
+		setSuppressionFlags(&message, pipeline.suppressedHashes)
+	}
+
+	if pipeline.options.AnalyzeSentiment && SentimentAnalyzer != nil && message.Sentiment == nil {
+		sentiments, err := scoreMessagesSentiment(context.Background(), SentimentAnalyzer, []Message{message})
+
+		if err != nil {
+			Logger.WithFields(LogFields{"project_uuid": pipeline.project.UUID}).Errorf("Failed to score the sentiment of message %s: %s", message.UUID, err)
+		} else {
+			message.Sentiment = &sentiments[0]
+		}
+	}
+
+	message.AttachmentsSize = 0
+
+	for _, attachment := range message.Attachments {
+		message.AttachmentsSize += MessageSize(attachment.Size)
+	}
+
+	if message.Size == 0 {
+		message.Size = MessageSize(len(message.Body)+len(message.Headers)) + message.AttachmentsSize
+	}
+
+	if err := offloadMessageBody(&message); err != nil {
+		return err
+	}
+
+	if err := pipeline.batcher.Add(message); err != nil {
+		return err
+	}
+
+	pipeline.parsedCounts[message.FolderUUID]++
+
+	if pipeline.remainingMessages > 0 {
+		pipeline.remainingMessages--
+	}
+
+	return nil
+}
+
+// EmitContact adds the contact record of the evidence to the contacts index (when the pipeline is closed), see GetContacts.
+func (pipeline *Pipeline) EmitContact(contact Contact) {
+	contact.UUID = NewUUID()
+	contact.ProjectUUID = pipeline.project.UUID
+
+	if pipeline.evidence != nil {
+		contact.EvidenceUUID = pipeline.evidence.UUID
+	}
+
+	provenance := pipeline.provenance
+	provenance.ExtractedAt = int(time.Now().Unix())
+	contact.Provenance = &provenance
+
+	pipeline.contacts = append(pipeline.contacts, contact)
+}
+
+// EmitFailure accounts an item (folder or message) which failed to parse and is skipped.
+// The item identifies it in the evidence, the error is recorded as a parse error of the evidence, see GetParseErrors.
+func (pipeline *Pipeline) EmitFailure(item string, err error) error {
+	Logger.WithFields(LogFields{"project_uuid": pipeline.project.UUID}).Errorf("Failed to parse %s: %s", item, err)
+
+	pipeline.progressEvent.Failed++
+
+	if pipeline.evidence == nil || pipeline.database == nil {
+		return nil
+	}
+
+	return saveParseError(pipeline.evidence.UUID, pipeline.project.UUID, item, err, pipeline.database)
+}
+
+// Tolerate returns the error of the item unless parsing is best effort, then the item is skipped using EmitFailure.
+// Parsers wrap the errors of a single folder or message which would otherwise abort parsing the evidence.
+func (pipeline *Pipeline) Tolerate(item string, err error) error {
+	if !pipeline.options.BestEffort {
+		return err
+	}
+
+	return pipeline.EmitFailure(item, err)
+}
+
+// Processed returns the amount of messages written to Kafka.
+func (pipeline *Pipeline) Processed() int {
+	return pipeline.progressEvent.Processed
+}
+
+// Pending returns the amount of emitted messages which aren't written to Kafka yet.
+func (pipeline *Pipeline) Pending() int {
+	return pipeline.batcher.Len()
+}
+
+// Flush writes the pending messages to Kafka.
+func (pipeline *Pipeline) Flush() error {
+	return pipeline.batcher.Flush()
+}
+
+// Close writes the pending messages, indexes the contacts, stores the parsed message counts of the evidence and reports completion.
+func (pipeline *Pipeline) Close() error {
+	if pipeline.scratchSpace != nil {
+		defer pipeline.scratchSpace.cleanup()
+	}
+
+	if err := pipeline.Flush(); err != nil {
+		return err
+	}
+
+	if err := indexContacts(pipeline.contacts); err != nil {
+		return err
+	}
+
+	if pipeline.evidence != nil && pipeline.database != nil {
+		for folderUUID, parsed := range pipeline.parsedCounts {
+			// Stored so the indexed messages can be verified, see VerifyProjectIndex.
+			if err := saveParsedMessageCount(folderUUID, pipeline.project.UUID, pipeline.evidence.UUID, parsed, pipeline.database); err != nil {
+				return err
+			}
+		}
+	}
+
+	pipeline.progressEvent.Stage = ProgressStageCompleted
+	pipeline.progressEvent.Folder = ""
+	pipeline.progressEvent.Percent = 100
+
+	pipeline.progressReporter.ReportProgress(pipeline.progressEvent)
+
+	return nil
+}
@@ -0,0 +1,428 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"fmt"
+	"github.com/aquasecurity/esquery"
+	"github.com/jackc/pgx/v4"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Privilege designations of messages, see SetPrivilegeDesignation.
+// Unlike the privileged review status (see ReviewStatusPrivileged) a designation withholds the message from exports.
+const (
+	PrivilegeDesignationPrivileged  = "privileged"   // Attorney-client privilege.
+	PrivilegeDesignationWorkProduct = "work_product" // Attorney work product.
+)
+
+// PrivilegeDesignations defines all privilege designations.
+var PrivilegeDesignations = []string{PrivilegeDesignationPrivileged, PrivilegeDesignationWorkProduct}
+
+// privilegeDesignationNames defines the names of the privilege designations in the privilege log.
+var privilegeDesignationNames = map[string]string{
+	PrivilegeDesignationPrivileged:  "Attorney-client privilege",
+	PrivilegeDesignationWorkProduct: "Attorney work product",
+}
+
+// IsValidPrivilegeDesignation returns true if the designation is a known privilege designation.
+func IsValidPrivilegeDesignation(designation string) bool {
+	for _, privilegeDesignation := range PrivilegeDesignations {
+		if designation == privilegeDesignation {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MessagePrivilege represents the privilege designation of a message.
+type MessagePrivilege struct {
+	MessageUUID    string `json:"message_uuid"`
+	ProjectUUID    string `json:"project_uuid"`
+	Designation    string `json:"designation"`
+	Basis          string `json:"basis"` // The basis of the privilege claim, shown in the privilege log.
+	DesignatedBy   string `json:"designated_by"`
+	DesignatedDate int    `json:"designated_date"`
+}
+
+// AuditActionExportPrivilegeLog is logged when the privilege log is exported.
+const AuditActionExportPrivilegeLog = "export_privilege_log"
+
+// SetPrivilegeDesignation designates the message as privileged or work product with the basis of the claim,
+// an empty designation removes it. Designated messages are withheld from the exports and listed in the privilege log instead,
+// see CreatePrivilegeLog.
+func SetPrivilegeDesignation(designation string, basis string, messageUUID string, projectUUID string, userUUID string, database *pgx.Conn) error {
+	if err := CheckPermission(userUUID, projectUUID, ActionReview, database); err != nil {
+		return err
+	}
+
+	if designation == "" {
+		preparedStatement := `
+		DELETE FROM message_privilege WHERE messageUUID = $1 AND projectUUID = $2
+		`
+		if _, err := database.Exec(context.Background(), preparedStatement, messageUUID, projectUUID); err != nil {
+			return err
+		}
+
+		return updateMessageFields([]string{messageUUID}, projectUUID, map[string]interface{}{
+			"privilege_designation": nil,
+		})
+	}
+
+	if !IsValidPrivilegeDesignation(designation) {
+		return fmt.Errorf("invalid privilege designation: %s", designation)
+	}
+
+	if err := updateMessagesMapping(); err != nil {
+		return err
+	}
+
+	preparedStatement := `
+	INSERT INTO message_privilege(messageUUID, projectUUID, designation, basis, designatedBy, designatedDate) VALUES ($1, $2, $3, $4, $5, $6)
+	ON CONFLICT(messageUUID) DO UPDATE SET designation = $3, basis = $4, designatedBy = $5, designatedDate = $6 WHERE message_privilege.projectUUID = EXCLUDED.projectUUID
+	`
+	if _, err := database.Exec(context.Background(), preparedStatement, messageUUID, projectUUID, designation, strings.TrimSpace(basis), userUUID, time.Now().Unix()); err != nil {
+		return err
+	}
+
+	return updateMessageFields([]string{messageUUID}, projectUUID, map[string]interface{}{
+		"privilege_designation": designation,
+	})
+}
+
+// GetMessagePrivilege returns the privilege designation of the message, pgx.ErrNoRows if it isn't designated.
+func GetMessagePrivilege(messageUUID string, projectUUID string, userUUID string, database *pgx.Conn) (MessagePrivilege, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return MessagePrivilege{}, err
+	}
+
+	preparedStatement := `
+	SELECT messageUUID, projectUUID, designation, basis, designatedBy, designatedDate FROM message_privilege WHERE messageUUID = $1 AND projectUUID = $2
+	`
+	row := database.QueryRow(context.Background(), preparedStatement, messageUUID, projectUUID)
+
+	var messagePrivilege MessagePrivilege
+
+	if err := row.Scan(&messagePrivilege.MessageUUID, &messagePrivilege.ProjectUUID, &messagePrivilege.Designation, &messagePrivilege.Basis, &messagePrivilege.DesignatedBy, &messagePrivilege.DesignatedDate); err != nil {
+		return MessagePrivilege{}, err
+	}
+
+	return messagePrivilege, nil
+}
+
+// getProjectPrivileges returns the privilege designations of the project by message UUID.
+func getProjectPrivileges(projectUUID string, database *pgx.Conn) (map[string]MessagePrivilege, error) {
+	preparedStatement := `
+	SELECT messageUUID, projectUUID, designation, basis, designatedBy, designatedDate FROM message_privilege WHERE projectUUID = $1
+	`
+	rows, err := database.Query(context.Background(), preparedStatement, projectUUID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	privileges := map[string]MessagePrivilege{}
+
+	for rows.Next() {
+		var messagePrivilege MessagePrivilege
+
+		if err := rows.Scan(&messagePrivilege.MessageUUID, &messagePrivilege.ProjectUUID, &messagePrivilege.Designation, &messagePrivilege.Basis, &messagePrivilege.DesignatedBy, &messagePrivilege.DesignatedDate); err != nil {
+			return nil, err
+		}
+
+		privileges[messagePrivilege.MessageUUID] = messagePrivilege
+	}
+
+	rows.Close()
+
+	return privileges, rows.Err()
+}
+
+// withoutPrivilegedMessages excludes the messages with a privilege designation from the query, used by the exports.
+func withoutPrivilegedMessages(query *esquery.BoolQuery) *esquery.BoolQuery {
+	return query.MustNot(esquery.Exists("privilege_designation"))
+}
+
+// PrivilegeLogEntry represents a withheld message in the privilege log.
+type PrivilegeLogEntry struct {
+	Number      int      `json:"number"` // The entry number, in order of the date of the messages.
+	MessageUUID string   `json:"message_uuid"`
+	Date        int      `json:"date"`
+	From        string   `json:"from"`
+	To          string   `json:"to"`
+	CC          string   `json:"cc"`
+	Subject     string   `json:"subject"`
+	Attachments []string `json:"attachments"` // The names of the withheld attachments.
+	Designation string   `json:"designation"`
+	Basis       string   `json:"basis"`
+}
+
+// Privilege log formats.
+const (
+	PrivilegeLogFormatCSV = "csv"
+	PrivilegeLogFormatPDF = "pdf"
+)
+
+// GetPrivilegeLog returns the messages withheld by a privilege designation with their metadata, oldest first.
+func GetPrivilegeLog(projectUUID string, userUUID string, database *pgx.Conn) ([]PrivilegeLogEntry, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return nil, err
+	}
+
+	privileges, err := getProjectPrivileges(projectUUID, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var privilegeLog []PrivilegeLogEntry
+
+	if len(privileges) == 0 {
+		return privilegeLog, nil
+	}
+
+	query := esquery.Bool().Filter(
+		esquery.Term("project_uuid", projectUUID),
+		esquery.Exists("privilege_designation"),
+	)
+
+	err = forEachMessageBatch(query, func(messages []Message) error {
+		for _, message := range messages {
+			messagePrivilege, ok := privileges[message.UUID]
+
+			if !ok {
+				continue
+			}
+
+			entry := PrivilegeLogEntry{
+				MessageUUID: message.UUID,
+				Date:        message.Received,
+				From:        message.From,
+				To:          message.To,
+				CC:          message.CC,
+				Subject:     message.Subject,
+				Designation: messagePrivilege.Designation,
+				Basis:       messagePrivilege.Basis,
+			}
+
+			for _, attachment := range message.Attachments {
+				entry.Attachments = append(entry.Attachments, attachment.Name)
+			}
+
+			privilegeLog = append(privilegeLog, entry)
+		}
+
+		return nil
+	}, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(privilegeLog, func(i, j int) bool {
+		if privilegeLog[i].Date != privilegeLog[j].Date {
+			return privilegeLog[i].Date < privilegeLog[j].Date
+		}
+
+		return privilegeLog[i].MessageUUID < privilegeLog[j].MessageUUID
+	})
+
+	for i := range privilegeLog {
+		privilegeLog[i].Number = i + 1
+	}
+
+	return privilegeLog, nil
+}
+
+// CreatePrivilegeLog creates the privilege log (see GetPrivilegeLog) as a CSV or PDF file, required when producing the other messages.
+// The branding of the project is shown in the PDF, see SetProjectReportBranding.
+// The export itself is recorded in the audit log. Returns the MinIO path to the uploaded file.
+func CreatePrivilegeLog(projectUUID string, format string, userUUID string, database *pgx.Conn) (string, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionExport, database); err != nil {
+		return "", err
+	}
+
+	if format != PrivilegeLogFormatCSV && format != PrivilegeLogFormatPDF {
+		return "", fmt.Errorf("unsupported privilege log format: %s", format)
+	}
+
+	project, err := GetProjectByUUID(projectUUID, database)
+
+	if err != nil {
+		return "", err
+	}
+
+	branding, err := getProjectReportBranding(projectUUID, database)
+
+	if err != nil {
+		return "", err
+	}
+
+	location, err := getProjectLocation(projectUUID, database)
+
+	if err != nil {
+		return "", err
+	}
+
+	privilegeLog, err := GetPrivilegeLog(projectUUID, userUUID, database)
+
+	if err != nil {
+		return "", err
+	}
+
+	scratchSpace, err := NewScratchSpace(projectUUID)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer scratchSpace.cleanup()
+
+	reportFileName := fmt.Sprintf("%s.%s", NewUUID(), format)
+	reportPath := scratchSpace.FilePath(reportFileName)
+
+	err = writeKeywordReportFile(reportPath, func(reportFile *os.File) error {
+		if format == PrivilegeLogFormatPDF {
+			return writePrivilegeLogPDF(privilegeLog, project, branding, location, reportFile)
+		}
+
+		return writePrivilegeLogCSV(privilegeLog, reportFile)
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	reportMinIOPath, err := UploadFile(reportFileName, reportPath, projectUUID)
+
+	if err != nil {
+		return "", err
+	}
+
+	if err := AddAuditLog(projectUUID, userUUID, AuditActionExportPrivilegeLog, reportMinIOPath, database); err != nil {
+		return "", err
+	}
+
+	return reportMinIOPath, nil
+}
+
+// getPrivilegeDesignationName returns the name of the privilege designation in the privilege log.
+func getPrivilegeDesignationName(designation string) string {
+	if name, ok := privilegeDesignationNames[designation]; ok {
+		return name
+	}
+
+	return designation
+}
+
+// writePrivilegeLogPDF writes the privilege log as PDF.
+func writePrivilegeLogPDF(privilegeLog []PrivilegeLogEntry, project Project, branding ReportBranding, location *time.Location, reportFile *os.File) error {
+	document := newPDFDocument()
+
+	document.Title(fmt.Sprintf("Privilege log: %s", project.Name))
+
+	var details []string
+
+	for _, detail := range [][2]string{
+		{"Lab", branding.LabName},
+		{"Case number", branding.CaseNumber},
+		{"Examiner", branding.Examiner},
+		{"Created", formatDisplayDate(int(time.Now().Unix()), location)},
+	} {
+		if detail[1] != "" {
+			details = append(details, fmt.Sprintf("%s: %s", detail[0], detail[1]))
+		}
+	}
+
+	document.Paragraph(strings.Join(details, "\n"))
+
+	document.Heading("Withheld messages")
+
+	if len(privilegeLog) == 0 {
+		document.Paragraph("No messages were withheld.")
+	}
+
+	// Entries are written in full instead of as table rows so no recipient or basis is truncated.
+	for _, entry := range privilegeLog {
+		lines := []string{
+			fmt.Sprintf("#%d - %s - %s", entry.Number, formatDisplayDate(entry.Date, location), getPrivilegeDesignationName(entry.Designation)),
+			fmt.Sprintf("From: %s", entry.From),
+			fmt.Sprintf("To: %s", entry.To),
+		}
+
+		if entry.CC != "" {
+			lines = append(lines, fmt.Sprintf("CC: %s", entry.CC))
+		}
+
+		lines = append(lines, fmt.Sprintf("Subject: %s", entry.Subject))
+
+		if len(entry.Attachments) > 0 {
+			lines = append(lines, fmt.Sprintf("Attachments: %s", strings.Join(entry.Attachments, ", ")))
+		}
+
+		if entry.Basis != "" {
+			lines = append(lines, fmt.Sprintf("Basis: %s", entry.Basis))
+		}
+
+		document.Paragraph(strings.Join(lines, "\n"))
+	}
+
+	return document.Write(reportFile)
+}
+
+// writePrivilegeLogCSV writes the privilege log as CSV.
+func writePrivilegeLogCSV(privilegeLog []PrivilegeLogEntry, reportFile *os.File) error {
+	spreadsheet, err := newSpreadsheetWriter(SpreadsheetFormatCSV, reportFile)
+
+	if err != nil {
+		return err
+	}
+
+	if err := spreadsheet.WriteRow([]string{"number", "message_uuid", "date", "from", "to", "cc", "subject", "attachments", "designation", "basis"}); err != nil {
+		return err
+	}
+
+	for _, entry := range privilegeLog {
+		row := []string{
+			strconv.Itoa(entry.Number),
+			entry.MessageUUID,
+			formatMessageExportDate(entry.Date),
+			entry.From,
+			entry.To,
+			entry.CC,
+			entry.Subject,
+			strings.Join(entry.Attachments, "; "),
+			getPrivilegeDesignationName(entry.Designation),
+			entry.Basis,
+		}
+
+		if err := spreadsheet.WriteRow(row); err != nil {
+			return err
+		}
+	}
+
+	return spreadsheet.Close()
+}
+
+// PrivilegeLogJobParameters represents the parameters of the JobTypePrivilegeLog job.
+type PrivilegeLogJobParameters struct {
+	Format string `json:"format"`
+}
+
+// runPrivilegeLogJob runs CreatePrivilegeLog.
+func runPrivilegeLogJob(ctx context.Context, job Job, reportProgress func(progress int), database *pgx.Conn) (string, error) {
+	var parameters PrivilegeLogJobParameters
+
+	if err := decodeJobParameters(job, &parameters); err != nil {
+		return "", err
+	}
+
+	return CreatePrivilegeLog(job.ProjectUUID, parameters.Format, job.UserUUID, database)
+}
@@ -0,0 +1,105 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/jackc/pgx/v4"
+)
+
+// Progress stages.
+const (
+	ProgressStageDownloading = "downloading"
+	ProgressStageParsing     = "parsing"
+	ProgressStageCollecting  = "collecting"
+	ProgressStageCompleted   = "completed"
+)
+
+// ProgressEvent represents the progress of a parser or collector.
+type ProgressEvent struct {
+	Stage     string `json:"stage"`
+	Folder    string `json:"folder"`    // The current folder or mailbox.
+	Processed int    `json:"processed"` // The messages processed so far.
+	Failed    int    `json:"failed"`    // The messages which failed to parse.
+	Percent   int    `json:"percent"`   // Zero if the total is unknown.
+}
+
+// ProgressReporter receives the progress events of parsers and collectors.
+// Implementations must be fast, events are reported from the parsing goroutine.
+type ProgressReporter interface {
+	ReportProgress(event ProgressEvent)
+}
+
+// discardProgressReporter discards all progress events.
+type discardProgressReporter struct{}
+
+// ReportProgress discards the event.
+func (reporter discardProgressReporter) ReportProgress(event ProgressEvent) {}
+
+// NewDiscardProgressReporter returns a progress reporter which discards all events.
+func NewDiscardProgressReporter() ProgressReporter {
+	return discardProgressReporter{}
+}
+
+// channelProgressReporter sends the percentage of progress events to a channel.
+type channelProgressReporter struct {
+	channel chan int
+}
+
+// ReportProgress sends the percentage to the channel, the channel is closed when the completed stage is reported.
+func (reporter *channelProgressReporter) ReportProgress(event ProgressEvent) {
+	reporter.channel <- event.Percent
+
+	if event.Stage == ProgressStageCompleted {
+		close(reporter.channel)
+	}
+}
+
+// NewChannelProgressReporter returns a progress reporter which sends the percentages to the channel.
+// Replaces the progress percentage channel previously passed to ParseOutlookIMAPEmails.
+func NewChannelProgressReporter(channel chan int) ProgressReporter {
+	return &channelProgressReporter{channel: channel}
+}
+
+// jobProgressReporter persists the progress events to the job.
+type jobProgressReporter struct {
+	jobUUID        string
+	reportProgress func(progress int)
+	database       *pgx.Conn
+}
+
+// NewJobProgressReporter returns a progress reporter which persists the progress events to the job, see Job.ProgressEvent.
+func NewJobProgressReporter(jobUUID string, database *pgx.Conn) ProgressReporter {
+	return &jobProgressReporter{
+		jobUUID: jobUUID,
+		reportProgress: func(progress int) {
+			if _, err := updateJobProgress(jobUUID, progress, database); err != nil {
+				Logger.Errorf("Failed to update job progress: %s", err)
+			}
+		},
+		database: database,
+	}
+}
+
+// ReportProgress persists the progress event to the job.
+func (reporter *jobProgressReporter) ReportProgress(event ProgressEvent) {
+	encodedEvent, err := json.Marshal(event)
+
+	if err != nil {
+		Logger.Errorf("Failed to encode progress event: %s", err)
+		return
+	}
+
+	preparedStatement := `
+	UPDATE jobs SET progressEvent = $2 WHERE uuid = $1
+	`
+	_, err = reporter.database.Exec(context.Background(), preparedStatement, reporter.jobUUID, string(encodedEvent))
+
+	if err != nil {
+		Logger.Errorf("Failed to update job progress event: %s", err)
+	}
+
+	reporter.reportProgress(event.Percent)
+}
@@ -5,8 +5,11 @@ package core
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"github.com/aquasecurity/esquery"
 	"github.com/jackc/pgx/v4"
+	"path/filepath"
 )
 
 // Project represents a user created project.
@@ -17,36 +20,60 @@ type Project struct {
 }
 
 // Save saves the project to the database.
-// Use AddProjectUser to assign a project to a user.
+// Use AddProjectUser to assign a project to a user (the creator should be assigned RoleOwner).
+// The MinIO objects of the project are stored in its own bucket if MinIOBucketPerProject is enabled
+// and encrypted with its own data encryption key if key management is enabled, see KeyWrappers.
 func (project *Project) Save(database *pgx.Conn) error {
 	preparedStatement := `
 	INSERT INTO project(uuid, name, creationDate) VALUES ($1, $2, $3)
 	`
-	_, err := database.Exec(context.Background(), preparedStatement, project.UUID, project.Name, project.CreationDate)
+	if _, err := database.Exec(context.Background(), preparedStatement, project.UUID, project.Name, project.CreationDate); err != nil {
+		return err
+	}
 
-	return err
+	if MinIOBucketPerProject {
+		if err := createProjectBucket(project.UUID, database); err != nil {
+			return err
+		}
+	}
+
+	if len(KeyWrappers) == 0 {
+		return nil
+	}
+
+	return createDataKey(project.UUID, true, database)
 }
 
-// AddProjectUser adds the user to the project.
-func AddProjectUser(projectUUID string, userUUID string, database *pgx.Conn) error {
+// AddProjectUser adds the user to the project with the specified role (see RoleOwner).
+// Returns ErrProjectUserExists if the user is already assigned to the project.
+func AddProjectUser(projectUUID string, userUUID string, role string, database *pgx.Conn) error {
+	if !IsValidRole(role) {
+		return fmt.Errorf("invalid role: %s", role)
+	}
+
 	preparedStatement := `
-	INSERT INTO project_user_junction(projectUUID, userUUID) VALUES ($1, $2)
+	INSERT INTO project_user_junction(projectUUID, userUUID, role) SELECT $1, $2, $3
+	WHERE NOT EXISTS (SELECT 1 FROM project_user_junction WHERE projectUUID = $1 AND userUUID = $2)
 	`
-	_, err := database.Exec(context.Background(), preparedStatement, projectUUID, userUUID)
+	commandTag, err := database.Exec(context.Background(), preparedStatement, projectUUID, userUUID, role)
 
-	return err
+	if err != nil {
+		return err
+	}
+
+	if commandTag.RowsAffected() == 0 {
+		return ErrProjectUserExists
+	}
+
+	return nil
 }
 
 // ProjectHasUser returns true if the project is assigned to the user.
+// Use CheckPermission to check if the user is allowed to perform a specific action.
 func ProjectHasUser(projectUUID string, userUUID string, database *pgx.Conn) bool {
-	preparedStatement := `
-	SELECT * FROM project_user_junction WHERE projectUUID = $1 AND userUUID = $2 LIMIT 1
-	`
-	row := database.QueryRow(context.Background(), preparedStatement, projectUUID, userUUID)
-
-	var projectUserJunction interface{}
+	_, err := GetProjectUserRole(projectUUID, userUUID, database)
 
-	return row.Scan(&projectUserJunction) == nil
+	return err == nil
 }
 
 // GetProjectByUUID returns the project with the specified UUID.
@@ -68,8 +95,10 @@ func GetProjectByUUID(projectUUID string, database *pgx.Conn) (Project, error) {
 // GetProjectsByUser returns all project from the specified user.
 func GetProjectsByUser(userUUID string, database *pgx.Conn) ([]Project, error) {
 	preparedStatement := `
-	SELECT p.uuid, p.name, p.creationDate FROM project_user_junction puj WHERE puj.userUUID = $1
-	INNER JOIN project p ON p.uuid = puj.projectUUID
+	SELECT DISTINCT p.uuid, p.name, p.creationDate FROM project p
+	INNER JOIN project_user_junction puj ON puj.projectUUID = p.uuid
+	WHERE puj.userUUID = $1
+	ORDER BY p.creationDate DESC
 	`
 	rows, err := database.Query(context.Background(), preparedStatement, userUUID)
 
@@ -95,6 +124,111 @@ func GetProjectsByUser(userUUID string, database *pgx.Conn) ([]Project, error) {
 	return projects, rows.Err()
 }
 
+// ProjectListing represents a project in the project list of a user, see GetProjectListingByUser.
+type ProjectListing struct {
+	Project
+	Role          string `json:"role"` // The role of the user in the project.
+	EvidenceCount int    `json:"evidence_count"`
+	MessageCount  int    `json:"message_count"`
+	LastActivity  int    `json:"last_activity"` // Unix timestamp of the last audit log or job, the creation date if there is none.
+}
+
+// GetProjectListingByUser returns the projects of the user with their role, evidence and message counts and last activity,
+// ordered by the last activity.
+func GetProjectListingByUser(userUUID string, database *pgx.Conn) ([]ProjectListing, error) {
+	preparedStatement := `
+	SELECT p.uuid, p.name, p.creationDate, puj.role,
+		(SELECT COUNT(*) FROM project_evidence_junction pej WHERE pej.projectUUID = p.uuid),
+		GREATEST(
+			COALESCE(p.creationDate, 0),
+			COALESCE((SELECT MAX(a.creationDate) FROM audit_log a WHERE a.projectUUID = p.uuid), 0),
+			COALESCE((SELECT MAX(GREATEST(j.creationDate, j.startDate, j.endDate)) FROM jobs j WHERE j.projectUUID = p.uuid), 0)
+		) AS lastActivity
+	FROM project p
+	INNER JOIN (
+		SELECT DISTINCT ON (projectUUID) projectUUID, role FROM project_user_junction WHERE userUUID = $1 ORDER BY projectUUID, id
+	) puj ON puj.projectUUID = p.uuid
+	ORDER BY lastActivity DESC
+	`
+	rows, err := database.Query(context.Background(), preparedStatement, userUUID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var projectListings []ProjectListing
+
+	for rows.Next() {
+		var projectListing ProjectListing
+
+		if err := rows.Scan(&projectListing.UUID, &projectListing.Name, &projectListing.CreationDate, &projectListing.Role, &projectListing.EvidenceCount, &projectListing.LastActivity); err != nil {
+			return nil, err
+		}
+
+		projectListings = append(projectListings, projectListing)
+	}
+
+	rows.Close()
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	if len(projectListings) == 0 {
+		return projectListings, nil
+	}
+
+	messageCounts, err := getProjectMessageCounts(projectListings)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range projectListings {
+		projectListings[i].MessageCount = messageCounts[projectListings[i].UUID]
+	}
+
+	return projectListings, nil
+}
+
+// getProjectMessageCounts returns the amount of indexed messages per project UUID.
+func getProjectMessageCounts(projectListings []ProjectListing) (map[string]int, error) {
+	var projectUUIDs []interface{}
+
+	for _, projectListing := range projectListings {
+		projectUUIDs = append(projectUUIDs, projectListing.UUID)
+	}
+
+	return countMessagesByProject(esquery.Bool().Filter(esquery.Terms("project_uuid", projectUUIDs...)), len(projectUUIDs))
+}
+
+// countMessagesByProject returns the amount of messages matching the query per project UUID.
+// The query must match the messages of at most the amount of projects.
+func countMessagesByProject(query esquery.Mappable, projectCount int) (map[string]int, error) {
+	aggregations, _, err := runAggregationSearch(
+		query,
+		esquery.TermsAgg("projects", "project_uuid").Size(uint64(projectCount)),
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	buckets, err := aggregations.Buckets("projects")
+
+	if err != nil {
+		return nil, err
+	}
+
+	messageCounts := make(map[string]int, len(buckets))
+
+	for _, bucket := range buckets {
+		messageCounts[bucket.KeyString()] = bucket.DocCount
+	}
+
+	return messageCounts, nil
+}
+
 // AddProjectEvidence adds the evidence to this project.
 func AddProjectEvidence(projectUUID string, evidenceUUID string, database *pgx.Conn) error {
 	preparedStatement := `
@@ -105,12 +239,97 @@ func AddProjectEvidence(projectUUID string, evidenceUUID string, database *pgx.C
 	return err
 }
 
+// DeleteProject removes the project and all of its data (messages, evidence and uploaded files).
+// Returns ErrProjectOnHold if the project is placed on legal hold.
+func DeleteProject(projectUUID string, userUUID string, database *pgx.Conn) error {
+	if err := CheckPermission(userUUID, projectUUID, ActionManageProject, database); err != nil {
+		return err
+	}
+
+	if err := checkProjectNotOnHold(projectUUID, userUUID, AuditActionDeleteProject, database); err != nil {
+		return err
+	}
+
+	if err := purgeProject(projectUUID, database); err != nil {
+		return err
+	}
+
+	return AddAuditLog(projectUUID, userUUID, AuditActionDeleteProject, "", database)
+}
+
+// deleteProjectRows removes all database rows referencing the project.
+func deleteProjectRows(projectUUID string, database *pgx.Conn) error {
+	preparedStatements := []string{
+		"DELETE FROM message_metadata WHERE projectUUID = $1",
+		"DELETE FROM message_tags WHERE projectUUID = $1",
+		"DELETE FROM tags WHERE projectUUID = $1",
+		"DELETE FROM message_review WHERE projectUUID = $1",
+		"DELETE FROM comments WHERE projectUUID = $1",
+		"DELETE FROM tree_nodes WHERE projectUUID = $1",
+		"WITH deleted_junction AS (DELETE FROM project_evidence_junction WHERE projectUUID = $1 RETURNING evidenceUUID) DELETE FROM evidence WHERE uuid IN (SELECT evidenceUUID FROM deleted_junction)",
+		"DELETE FROM project_user_junction WHERE projectUUID = $1",
+		"DELETE FROM retention_policy WHERE projectUUID = $1",
+		"DELETE FROM search_history WHERE projectUUID = $1",
+		"DELETE FROM pseudonyms WHERE projectUUID = $1",
+		"DELETE FROM jobs WHERE projectUUID = $1",
+		"DELETE FROM webhooks WHERE projectUUID = $1",
+		"DELETE FROM collections WHERE projectUUID = $1",
+		"DELETE FROM smart_folders WHERE projectUUID = $1",
+		"DELETE FROM custodian_domains WHERE projectUUID = $1",
+		"DELETE FROM custodian_addresses WHERE projectUUID = $1",
+		"DELETE FROM parsed_message_counts WHERE projectUUID = $1",
+		"DELETE FROM parse_errors WHERE projectUUID = $1",
+		"DELETE FROM attachment_objects WHERE projectUUID = $1",
+		"DELETE FROM data_keys WHERE scope = $1",
+		"DELETE FROM project_buckets WHERE projectUUID = $1",
+		"DELETE FROM project_report_branding WHERE projectUUID = $1",
+		"DELETE FROM evidence_custodians WHERE projectUUID = $1",
+		"DELETE FROM hash_list_entries WHERE projectUUID = $1",
+		"DELETE FROM hash_lists WHERE projectUUID = $1",
+		"DELETE FROM project_timezones WHERE projectUUID = $1",
+		"DELETE FROM message_privilege WHERE projectUUID = $1",
+		"DELETE FROM binder_messages WHERE projectUUID = $1",
+		"DELETE FROM binders WHERE projectUUID = $1",
+		"DELETE FROM journal_entries WHERE projectUUID = $1",
+		"DELETE FROM batch_operations WHERE projectUUID = $1",
+		"DELETE FROM project_quotas WHERE projectUUID = $1",
+		"DELETE FROM project WHERE uuid = $1",
+	}
+
+	// The rows are removed in a transaction so a failed purge doesn't leave a partially deleted project behind.
+	transaction, err := database.Begin(context.Background())
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		// Does nothing once the transaction is committed.
+		if err := transaction.Rollback(context.Background()); err != nil && !errors.Is(err, pgx.ErrTxClosed) {
+			Logger.Errorf("Failed to rollback transaction: %s", err)
+		}
+	}()
+
+	for _, preparedStatement := range preparedStatements {
+		if _, err := transaction.Exec(context.Background(), preparedStatement, projectUUID); err != nil {
+			return err
+		}
+	}
+
+	return transaction.Commit(context.Background())
+}
+
 // GetProjectDirectory returns the directory where the project related data is stored.
 func GetProjectDirectory(projectUUID string) string {
 	return fmt.Sprintf("data/projects/%s", projectUUID)
 }
 
 // GetProjectTempDirectory returns the directory where temporary files are stored.
+// Prefer a ScratchSpace over using the directory directly, see NewScratchSpace.
 func GetProjectTempDirectory(projectUUID string) string {
+	if TempDirectory != "" {
+		return filepath.Join(TempDirectory, projectUUID)
+	}
+
 	return fmt.Sprintf("%s/tmp", GetProjectDirectory(projectUUID))
 }
@@ -0,0 +1,250 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/jackc/pgx/v4"
+	"strings"
+	"time"
+)
+
+// ProjectTemplate represents the default configuration of new projects, see CreateProjectFromTemplate.
+type ProjectTemplate struct {
+	UUID             string         `json:"uuid"`
+	Name             string         `json:"name"`
+	Description      string         `json:"description"`
+	Tags             []TemplateTag  `json:"tags"`
+	KeywordLists     []KeywordList  `json:"keyword_lists"`     // Created as smart folders.
+	CustodianDomains []string       `json:"custodian_domains"` // The internal domains, see SetCustodianDomains.
+	ReportBranding   ReportBranding `json:"report_branding"`   // See SetProjectReportBranding.
+	CreationDate     int            `json:"creation_date"`
+	// CustodianAddresses are the custodian addresses outside the internal domains, see SetCustodianAddresses.
+	CustodianAddresses []string `json:"custodian_addresses"`
+}
+
+// TemplateTag represents a tag created by a project template.
+type TemplateTag struct {
+	Name        string `json:"name"`
+	Color       string `json:"color"`
+	Description string `json:"description"`
+}
+
+// KeywordList represents a list of keywords created as a smart folder by a project template.
+// The smart folder contains the messages matching any of the keywords.
+type KeywordList struct {
+	Title    string   `json:"title"`
+	Keywords []string `json:"keywords"`
+}
+
+// projectTemplateConfiguration represents the stored configuration of a project template.
+type projectTemplateConfiguration struct {
+	Tags             []TemplateTag  `json:"tags"`
+	KeywordLists     []KeywordList  `json:"keyword_lists"`
+	CustodianDomains []string       `json:"custodian_domains"`
+	ReportBranding   ReportBranding `json:"report_branding"`
+	// CustodianAddresses is omitted in templates saved before custodian addresses existed.
+	CustodianAddresses []string `json:"custodian_addresses,omitempty"`
+}
+
+// ErrProjectTemplateNotFound is returned if the project template doesn't exist.
+var ErrProjectTemplateNotFound = errors.New("project template not found")
+
+// Save saves the project template to the database.
+func (projectTemplate *ProjectTemplate) Save(database *pgx.Conn) error {
+	encodedConfiguration, err := json.Marshal(projectTemplateConfiguration{
+		Tags:               projectTemplate.Tags,
+		KeywordLists:       projectTemplate.KeywordLists,
+		CustodianDomains:   projectTemplate.CustodianDomains,
+		ReportBranding:     projectTemplate.ReportBranding,
+		CustodianAddresses: projectTemplate.CustodianAddresses,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	preparedStatement := `
+	INSERT INTO project_templates(uuid, name, description, configuration, creationDate) VALUES ($1, $2, $3, $4, $5)
+	ON CONFLICT(uuid) DO UPDATE SET name = $2, description = $3, configuration = $4
+	`
+	_, err = database.Exec(context.Background(), preparedStatement, projectTemplate.UUID, projectTemplate.Name, projectTemplate.Description, string(encodedConfiguration), projectTemplate.CreationDate)
+
+	return err
+}
+
+// SaveProjectTemplate creates or updates (if the UUID is set) the project template, only admins may manage templates.
+func SaveProjectTemplate(projectTemplate ProjectTemplate, userUUID string, database *pgx.Conn) (ProjectTemplate, error) {
+	if err := checkUserAdmin(userUUID, database); err != nil {
+		return ProjectTemplate{}, err
+	}
+
+	if strings.TrimSpace(projectTemplate.Name) == "" {
+		return ProjectTemplate{}, errors.New("project template name is empty")
+	}
+
+	for _, keywordList := range projectTemplate.KeywordLists {
+		if strings.TrimSpace(keywordList.Title) == "" || len(keywordList.Keywords) == 0 {
+			return ProjectTemplate{}, errors.New("keyword list has no title or keywords")
+		}
+	}
+
+	if projectTemplate.UUID == "" {
+		projectTemplate.UUID = NewUUID()
+		projectTemplate.CreationDate = int(time.Now().Unix())
+	}
+
+	if err := projectTemplate.Save(database); err != nil {
+		return ProjectTemplate{}, err
+	}
+
+	return projectTemplate, nil
+}
+
+// GetProjectTemplate returns the project template, returns ErrProjectTemplateNotFound if it doesn't exist.
+func GetProjectTemplate(templateUUID string, database *pgx.Conn) (ProjectTemplate, error) {
+	preparedStatement := `
+	SELECT uuid, name, description, configuration, creationDate FROM project_templates WHERE uuid = $1
+	`
+	projectTemplate, err := scanProjectTemplate(database.QueryRow(context.Background(), preparedStatement, templateUUID))
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ProjectTemplate{}, ErrProjectTemplateNotFound
+	}
+
+	return projectTemplate, err
+}
+
+// GetProjectTemplates returns all project templates ordered by name.
+func GetProjectTemplates(database *pgx.Conn) ([]ProjectTemplate, error) {
+	preparedStatement := `
+	SELECT uuid, name, description, configuration, creationDate FROM project_templates ORDER BY name
+	`
+	rows, err := database.Query(context.Background(), preparedStatement)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var projectTemplates []ProjectTemplate
+
+	for rows.Next() {
+		projectTemplate, err := scanProjectTemplate(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		projectTemplates = append(projectTemplates, projectTemplate)
+	}
+
+	rows.Close()
+
+	return projectTemplates, rows.Err()
+}
+
+// scanProjectTemplate scans the project template row.
+func scanProjectTemplate(row pgx.Row) (ProjectTemplate, error) {
+	var projectTemplate ProjectTemplate
+	var encodedConfiguration string
+
+	if err := row.Scan(&projectTemplate.UUID, &projectTemplate.Name, &projectTemplate.Description, &encodedConfiguration, &projectTemplate.CreationDate); err != nil {
+		return ProjectTemplate{}, err
+	}
+
+	var configuration projectTemplateConfiguration
+
+	if err := json.Unmarshal([]byte(encodedConfiguration), &configuration); err != nil {
+		return ProjectTemplate{}, err
+	}
+
+	projectTemplate.Tags = configuration.Tags
+	projectTemplate.KeywordLists = configuration.KeywordLists
+	projectTemplate.CustodianDomains = configuration.CustodianDomains
+	projectTemplate.ReportBranding = configuration.ReportBranding
+	projectTemplate.CustodianAddresses = configuration.CustodianAddresses
+
+	return projectTemplate, nil
+}
+
+// DeleteProjectTemplate removes the project template, projects created from it are unaffected. Only admins may manage templates.
+func DeleteProjectTemplate(templateUUID string, userUUID string, database *pgx.Conn) error {
+	if err := checkUserAdmin(userUUID, database); err != nil {
+		return err
+	}
+
+	preparedStatement := `
+	DELETE FROM project_templates WHERE uuid = $1
+	`
+	commandTag, err := database.Exec(context.Background(), preparedStatement, templateUUID)
+
+	if err != nil {
+		return err
+	}
+
+	if commandTag.RowsAffected() == 0 {
+		return ErrProjectTemplateNotFound
+	}
+
+	return nil
+}
+
+// CreateProjectFromTemplate creates a project owned by the user, configured with the tags, keyword lists,
+// custodian domains, custodian addresses and report branding of the template.
+func CreateProjectFromTemplate(templateUUID string, name string, userUUID string, database *pgx.Conn) (Project, error) {
+	projectTemplate, err := GetProjectTemplate(templateUUID, database)
+
+	if err != nil {
+		return Project{}, err
+	}
+
+	project := Project{
+		UUID:         NewUUID(),
+		Name:         name,
+		CreationDate: int(time.Now().Unix()),
+	}
+
+	if err := project.Save(database); err != nil {
+		return Project{}, err
+	}
+
+	if err := AddProjectUser(project.UUID, userUUID, RoleOwner, database); err != nil {
+		return Project{}, err
+	}
+
+	for _, templateTag := range projectTemplate.Tags {
+		if _, err := CreateTag(templateTag.Name, templateTag.Color, templateTag.Description, project.UUID, userUUID, database); err != nil {
+			return Project{}, err
+		}
+	}
+
+	for _, keywordList := range projectTemplate.KeywordLists {
+		// The search query matches any of the keywords.
+		if _, err := CreateSmartFolder(keywordList.Title, strings.Join(keywordList.Keywords, " "), SearchFilters{}, project.UUID, userUUID, database); err != nil {
+			return Project{}, err
+		}
+	}
+
+	if len(projectTemplate.CustodianDomains) > 0 {
+		if err := SetCustodianDomains(projectTemplate.CustodianDomains, project.UUID, userUUID, database); err != nil {
+			return Project{}, err
+		}
+	}
+
+	if len(projectTemplate.CustodianAddresses) > 0 {
+		if err := SetCustodianAddresses(projectTemplate.CustodianAddresses, project.UUID, userUUID, database); err != nil {
+			return Project{}, err
+		}
+	}
+
+	if projectTemplate.ReportBranding != (ReportBranding{}) {
+		if err := SetProjectReportBranding(projectTemplate.ReportBranding, project.UUID, userUUID, database); err != nil {
+			return Project{}, err
+		}
+	}
+
+	return project, nil
+}
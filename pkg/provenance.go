@@ -0,0 +1,82 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import "runtime/debug"
+
+// Provenance represents how and when a message was extracted, so each message in a report can be traced back to its extraction.
+type Provenance struct {
+	Parser        string `json:"parser"`                  // The parser name (see Parser.GetName) or "IMAP" for collected mailboxes.
+	ParserVersion string `json:"parser_version"`          // The module version of the parsing library.
+	CoreVersion   string `json:"core_version"`            // The module version of Go Forensics core.
+	EvidenceHash  string `json:"evidence_hash,omitempty"` // Empty for collected mailboxes.
+	ExtractedAt   int    `json:"extracted_at"`            // Unix timestamp of the extraction.
+}
+
+// Module paths of which the versions are stored in the provenance of messages.
+const (
+	coreModulePath = "github.com/mooijtech/goforensics-core"
+	pstModulePath  = "github.com/mooijtech/go-pst/v4"
+	emlModulePath  = "github.com/emersion/go-message"
+	imapModulePath = "github.com/emersion/go-imap"
+)
+
+// imapParserName defines the parser name in the provenance of collected mailboxes.
+const imapParserName = "IMAP"
+
+// unknownModuleVersion is returned by getModuleVersion if the binary has no build information of the module.
+const unknownModuleVersion = "unknown"
+
+// newProvenance returns the provenance of the messages extracted by the parser, the evidence is nil for collected mailboxes.
+// The extraction timestamp is set per message by Pipeline.EmitMessage.
+func newProvenance(parser string, parserVersion string, evidence *Evidence) Provenance {
+	provenance := Provenance{
+		Parser:        parser,
+		ParserVersion: parserVersion,
+		CoreVersion:   getModuleVersion(coreModulePath),
+	}
+
+	if evidence != nil {
+		provenance.EvidenceHash = evidence.FileHash
+	}
+
+	return provenance
+}
+
+// getProvenance returns the provenance of the message, empty for messages indexed before the provenance was stored.
+func (message Message) getProvenance() Provenance {
+	if message.Provenance == nil {
+		return Provenance{}
+	}
+
+	return *message.Provenance
+}
+
+// getModuleVersion returns the version of the module compiled into the binary, "(devel)" for the main module built from source.
+func getModuleVersion(modulePath string) string {
+	buildInfo, ok := debug.ReadBuildInfo()
+
+	if !ok {
+		return unknownModuleVersion
+	}
+
+	if buildInfo.Main.Path == modulePath {
+		return buildInfo.Main.Version
+	}
+
+	for _, module := range buildInfo.Deps {
+		if module.Path != modulePath {
+			continue
+		}
+
+		// Replaced modules (e.g. a local fork) have the version of the replacement.
+		if module.Replace != nil && module.Replace.Version != "" {
+			return module.Replace.Version
+		}
+
+		return module.Version
+	}
+
+	return unknownModuleVersion
+}
@@ -0,0 +1,438 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/emersion/go-message/mail"
+	"github.com/jackc/pgx/v4"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// PseudonymizationKey defines the key used to encrypt the original values of pseudonyms.
+// Pseudonymization is disabled if the pseudonymization_key configuration variable is unset.
+//
+// Deprecated: use Core.Config.PseudonymizationKey.
+var PseudonymizationKey []byte
+
+// ErrPseudonymizationDisabled is returned if pseudonymization is used without a pseudonymization key.
+var ErrPseudonymizationDisabled = errors.New("pseudonymization is disabled, set the pseudonymization_key configuration variable")
+
+// decodePseudonymizationKey decodes the pseudonymization key (base64 encoded, 32 bytes).
+// Returns nil if the key is empty (pseudonymization disabled).
+func decodePseudonymizationKey(encodedKey string) ([]byte, error) {
+	return decodeEncryptionKey("pseudonymization_key", encodedKey)
+}
+
+// Pseudonym kinds.
+const (
+	PseudonymKindAddress = "address"
+	PseudonymKindName    = "name"
+)
+
+// AuditActionRevealPseudonym is logged when the original value of a pseudonym is revealed.
+const AuditActionRevealPseudonym = "reveal_pseudonym"
+
+// pseudonymAddressRegex matches email addresses in message bodies and headers.
+var pseudonymAddressRegex = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+
+// Pseudonymizer replaces email addresses and names with pseudonyms.
+// The mapping is stable per project so the same address always gets the same pseudonym,
+// the original values are stored encrypted with the PseudonymizationKey.
+type Pseudonymizer struct {
+	projectUUID string
+	database    *pgx.Conn
+	pseudonyms  map[string]string // Cache of kind and original value to pseudonym.
+}
+
+// NewPseudonymizer returns a pseudonymizer for the project.
+func NewPseudonymizer(projectUUID string, database *pgx.Conn) (*Pseudonymizer, error) {
+	if PseudonymizationKey == nil {
+		return nil, ErrPseudonymizationDisabled
+	}
+
+	return &Pseudonymizer{
+		projectUUID: projectUUID,
+		database:    database,
+		pseudonyms:  map[string]string{},
+	}, nil
+}
+
+// Address returns the pseudonym of the email address.
+func (pseudonymizer *Pseudonymizer) Address(address string) (string, error) {
+	return pseudonymizer.getPseudonym(PseudonymKindAddress, strings.ToLower(strings.TrimSpace(address)))
+}
+
+// Name returns the pseudonym of the name.
+func (pseudonymizer *Pseudonymizer) Name(name string) (string, error) {
+	return pseudonymizer.getPseudonym(PseudonymKindName, strings.TrimSpace(name))
+}
+
+// Message returns a copy of the message with the addresses and names replaced by pseudonyms.
+// Names and addresses from the From, To and CC headers are also replaced in the subject, body and headers,
+// any other addresses in the body and headers are replaced as well.
+func (pseudonymizer *Pseudonymizer) Message(message Message) (Message, error) {
+	replacements := map[string]string{}
+
+	for _, header := range []*string{&message.From, &message.To, &message.CC} {
+		pseudonymizedHeader, err := pseudonymizer.header(*header, replacements)
+
+		if err != nil {
+			return Message{}, err
+		}
+
+		*header = pseudonymizedHeader
+	}
+
+	// The address slices are copied so the original message isn't modified.
+	for _, addresses := range []*[]string{&message.FromAddresses, &message.RecipientAddresses} {
+		pseudonymizedAddresses := make([]string, len(*addresses))
+
+		for i, address := range *addresses {
+			pseudonym, err := pseudonymizer.Address(address)
+
+			if err != nil {
+				return Message{}, err
+			}
+
+			pseudonymizedAddresses[i] = pseudonym
+		}
+
+		*addresses = pseudonymizedAddresses
+	}
+
+	message.Domains = nil
+
+	originals := make([]string, 0, len(replacements))
+
+	for original := range replacements {
+		originals = append(originals, original)
+	}
+
+	// Longest first so names containing other names are replaced completely.
+	sort.Slice(originals, func(i, j int) bool {
+		return len(originals[i]) > len(originals[j])
+	})
+
+	var replacementArguments []string
+
+	for _, original := range originals {
+		replacementArguments = append(replacementArguments, original, replacements[original])
+	}
+
+	replacer := strings.NewReplacer(replacementArguments...)
+
+	message.Subject = replacer.Replace(message.Subject)
+
+	for _, field := range []*string{&message.Body, &message.Headers} {
+		replacedField, err := pseudonymizer.text(replacer.Replace(*field))
+
+		if err != nil {
+			return Message{}, err
+		}
+
+		*field = replacedField
+	}
+
+	return message, nil
+}
+
+// Network returns a copy of the network with the node IDs (addresses) replaced by pseudonyms.
+func (pseudonymizer *Pseudonymizer) Network(network Network) (Network, error) {
+	nodes := make([]NetworkNode, len(network.Nodes))
+	links := make([]NetworkLink, len(network.Links))
+
+	for i, node := range network.Nodes {
+		pseudonym, err := pseudonymizer.networkID(node.ID)
+
+		if err != nil {
+			return Network{}, err
+		}
+
+		node.ID = pseudonym
+		nodes[i] = node
+	}
+
+	for i, link := range network.Links {
+		source, err := pseudonymizer.networkID(link.Source)
+
+		if err != nil {
+			return Network{}, err
+		}
+
+		target, err := pseudonymizer.networkID(link.Target)
+
+		if err != nil {
+			return Network{}, err
+		}
+
+		link.Source = source
+		link.Target = target
+		links[i] = link
+	}
+
+	network.Nodes = nodes
+	network.Links = links
+
+	return network, nil
+}
+
+// networkID returns the pseudonym of the network node ID which is an address or a name (PST recipients).
+func (pseudonymizer *Pseudonymizer) networkID(id string) (string, error) {
+	if strings.Contains(id, "@") {
+		return pseudonymizer.Address(id)
+	}
+
+	return pseudonymizer.Name(id)
+}
+
+// header pseudonymizes the From, To or CC header.
+// The original names and addresses are added to the replacements.
+func (pseudonymizer *Pseudonymizer) header(header string, replacements map[string]string) (string, error) {
+	if header == messageNullValue || strings.TrimSpace(header) == "" {
+		return header, nil
+	}
+
+	// PST recipients are separated by "; " and may only contain the display name, see getAddressesFromHeader.
+	if strings.Contains(header, "; ") || !strings.Contains(header, "@") {
+		var pseudonymizedEntries []string
+
+		for _, entry := range strings.Split(header, "; ") {
+			if strings.TrimSpace(entry) == "" {
+				continue
+			}
+
+			pseudonym, err := pseudonymizer.networkID(entry)
+
+			if err != nil {
+				return "", err
+			}
+
+			replacements[strings.TrimSpace(entry)] = pseudonym
+			pseudonymizedEntries = append(pseudonymizedEntries, pseudonym)
+		}
+
+		return strings.Join(pseudonymizedEntries, "; "), nil
+	}
+
+	mailAddresses, err := mail.ParseAddressList(header)
+
+	if err != nil {
+		// Fall back to replacing the addresses so nothing identifying is left.
+		return pseudonymizer.text(header)
+	}
+
+	var pseudonymizedAddresses []string
+
+	for _, mailAddress := range mailAddresses {
+		pseudonymizedAddress := mail.Address{}
+
+		if mailAddress.Name != "" {
+			pseudonymizedAddress.Name, err = pseudonymizer.Name(mailAddress.Name)
+
+			if err != nil {
+				return "", err
+			}
+
+			replacements[mailAddress.Name] = pseudonymizedAddress.Name
+		}
+
+		pseudonymizedAddress.Address, err = pseudonymizer.Address(mailAddress.Address)
+
+		if err != nil {
+			return "", err
+		}
+
+		replacements[mailAddress.Address] = pseudonymizedAddress.Address
+		pseudonymizedAddresses = append(pseudonymizedAddresses, pseudonymizedAddress.String())
+	}
+
+	return strings.Join(pseudonymizedAddresses, ", "), nil
+}
+
+// text replaces all email addresses in the text with pseudonyms.
+func (pseudonymizer *Pseudonymizer) text(text string) (string, error) {
+	var replaceErr error
+
+	replacedText := pseudonymAddressRegex.ReplaceAllStringFunc(text, func(address string) string {
+		if replaceErr != nil {
+			return address
+		}
+
+		pseudonym, err := pseudonymizer.Address(address)
+
+		if err != nil {
+			replaceErr = err
+			return address
+		}
+
+		return pseudonym
+	})
+
+	return replacedText, replaceErr
+}
+
+// getPseudonym returns the pseudonym of the value, creating it if the value has no pseudonym yet.
+// Pseudonyms are numbered in order of creation per project and kind.
+func (pseudonymizer *Pseudonymizer) getPseudonym(kind string, value string) (string, error) {
+	if value == "" || value == messageNullValue {
+		return value, nil
+	}
+
+	cacheKey := fmt.Sprintf("%s:%s", kind, value)
+
+	if pseudonym, ok := pseudonymizer.pseudonyms[cacheKey]; ok {
+		return pseudonym, nil
+	}
+
+	valueHash := getPseudonymValueHash(kind, value)
+
+	pseudonym, err := getPseudonymByValueHash(pseudonymizer.projectUUID, kind, valueHash, pseudonymizer.database)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		pseudonym, err = createPseudonym(pseudonymizer.projectUUID, kind, value, valueHash, pseudonymizer.database)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	pseudonymizer.pseudonyms[cacheKey] = pseudonym
+
+	return pseudonym, nil
+}
+
+// getPseudonymValueHash returns the keyed hash used to look up the pseudonym of a value.
+// The hash is keyed so the original values can't be brute forced without the PseudonymizationKey.
+func getPseudonymValueHash(kind string, value string) string {
+	mac := hmac.New(sha256.New, PseudonymizationKey)
+
+	mac.Write([]byte(kind))
+	mac.Write([]byte{0})
+	mac.Write([]byte(value))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// getPseudonymByValueHash returns the pseudonym of the value hash.
+// Returns pgx.ErrNoRows if the value has no pseudonym.
+func getPseudonymByValueHash(projectUUID string, kind string, valueHash string, database *pgx.Conn) (string, error) {
+	preparedStatement := `
+	SELECT pseudonym FROM pseudonyms WHERE projectUUID = $1 AND kind = $2 AND valueHash = $3
+	`
+	row := database.QueryRow(context.Background(), preparedStatement, projectUUID, kind, valueHash)
+
+	var pseudonym string
+
+	if err := row.Scan(&pseudonym); err != nil {
+		return "", err
+	}
+
+	return pseudonym, nil
+}
+
+// createPseudonym stores the next pseudonym of the kind for the encrypted value.
+func createPseudonym(projectUUID string, kind string, value string, valueHash string, database *pgx.Conn) (string, error) {
+	encryptedValue, err := encryptPseudonymValue(value)
+
+	if err != nil {
+		return "", err
+	}
+
+	preparedStatement := `
+	SELECT COUNT(*) FROM pseudonyms WHERE projectUUID = $1 AND kind = $2
+	`
+	row := database.QueryRow(context.Background(), preparedStatement, projectUUID, kind)
+
+	var pseudonymCount int
+
+	if err := row.Scan(&pseudonymCount); err != nil {
+		return "", err
+	}
+
+	pseudonym := fmt.Sprintf("Contact %d", pseudonymCount+1)
+
+	if kind == PseudonymKindAddress {
+		pseudonym = fmt.Sprintf("contact%d@pseudonymized.invalid", pseudonymCount+1)
+	}
+
+	preparedStatement = `
+	INSERT INTO pseudonyms(projectUUID, kind, valueHash, encryptedValue, pseudonym) VALUES ($1, $2, $3, $4, $5)
+	ON CONFLICT DO NOTHING
+	`
+	if _, err := database.Exec(context.Background(), preparedStatement, projectUUID, kind, valueHash, encryptedValue, pseudonym); err != nil {
+		return "", err
+	}
+
+	// Another export may have created the pseudonym concurrently.
+	return getPseudonymByValueHash(projectUUID, kind, valueHash, database)
+}
+
+// RevealPseudonym returns the original value of the pseudonym.
+func RevealPseudonym(pseudonym string, projectUUID string, userUUID string, database *pgx.Conn) (string, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionManageProject, database); err != nil {
+		return "", err
+	}
+
+	if PseudonymizationKey == nil {
+		return "", ErrPseudonymizationDisabled
+	}
+
+	preparedStatement := `
+	SELECT encryptedValue FROM pseudonyms WHERE projectUUID = $1 AND pseudonym = $2
+	`
+	row := database.QueryRow(context.Background(), preparedStatement, projectUUID, pseudonym)
+
+	var encryptedValue string
+
+	if err := row.Scan(&encryptedValue); err != nil {
+		return "", err
+	}
+
+	value, err := decryptPseudonymValue(encryptedValue)
+
+	if err != nil {
+		return "", err
+	}
+
+	if err := AddAuditLog(projectUUID, userUUID, AuditActionRevealPseudonym, pseudonym, database); err != nil {
+		return "", err
+	}
+
+	return value, nil
+}
+
+// encryptPseudonymValue encrypts the value with the PseudonymizationKey.
+func encryptPseudonymValue(value string) (string, error) {
+	return encryptValue(PseudonymizationKey, value)
+}
+
+// decryptPseudonymValue decrypts the value encrypted by encryptPseudonymValue.
+func decryptPseudonymValue(encryptedValue string) (string, error) {
+	return decryptValue(PseudonymizationKey, encryptedValue)
+}
+
+// pseudonymizeMessages returns copies of the messages with the addresses and names replaced by pseudonyms.
+func pseudonymizeMessages(messages []Message, pseudonymizer *Pseudonymizer) ([]Message, error) {
+	pseudonymizedMessages := make([]Message, len(messages))
+
+	for i, message := range messages {
+		pseudonymizedMessage, err := pseudonymizer.Message(message)
+
+		if err != nil {
+			return nil, err
+		}
+
+		pseudonymizedMessages[i] = pseudonymizedMessage
+	}
+
+	return pseudonymizedMessages, nil
+}
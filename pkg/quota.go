@@ -0,0 +1,220 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aquasecurity/esquery"
+	"github.com/jackc/pgx/v4"
+)
+
+// ProjectQuota represents the resource limits of a project, zero values are unlimited.
+// Quotas are enforced when evidence is added (see AddEvidence and CheckEvidenceQuota) and when evidence is parsed.
+type ProjectQuota struct {
+	MaxEvidenceSize int64 `json:"max_evidence_size" mapstructure:"max_evidence_size"` // The maximum size in bytes of an evidence file.
+	MaxStorage      int64 `json:"max_storage" mapstructure:"max_storage"`             // The maximum storage in bytes, see GetProjectStorageUsage.
+	MaxMessages     int   `json:"max_messages" mapstructure:"max_messages"`           // The maximum amount of parsed messages.
+}
+
+// ProjectQuotaUsage represents the usage of a project compared to its quota.
+type ProjectQuotaUsage struct {
+	Quota    ProjectQuota `json:"quota"`
+	IsCustom bool         `json:"is_custom"` // False if the project uses the Config.ProjectQuota.
+	Storage  StorageUsage `json:"storage"`
+	Messages int          `json:"messages"`
+}
+
+// DefaultProjectQuota defines the quota of projects without their own quota, see SetProjectQuota.
+//
+// Deprecated: use Core.Config.ProjectQuota.
+var DefaultProjectQuota ProjectQuota
+
+// Errors returned if a project quota is exceeded, wrapped with the usage and limit.
+var (
+	ErrEvidenceSizeQuotaExceeded = errors.New("evidence file exceeds the maximum evidence size of the project")
+	ErrStorageQuotaExceeded      = errors.New("storage quota of the project exceeded")
+	ErrMessageQuotaExceeded      = errors.New("message quota of the project exceeded")
+)
+
+// AuditActionSetProjectQuota is the audit log action of SetProjectQuota and ResetProjectQuota.
+const AuditActionSetProjectQuota = "set_project_quota"
+
+// SetProjectQuota sets the quota of the project instead of the Config.ProjectQuota.
+// Only admins may set quotas, so tenants of hosted deployments can't raise their own quota.
+func SetProjectQuota(quota ProjectQuota, projectUUID string, userUUID string, database *pgx.Conn) error {
+	if err := checkUserAdmin(userUUID, database); err != nil {
+		return err
+	}
+
+	if quota.MaxEvidenceSize < 0 || quota.MaxStorage < 0 || quota.MaxMessages < 0 {
+		return errors.New("invalid negative quota")
+	}
+
+	if _, err := GetProjectByUUID(projectUUID, database); err != nil {
+		return err
+	}
+
+	preparedStatement := `
+	INSERT INTO project_quotas(projectUUID, maxEvidenceSize, maxStorage, maxMessages) VALUES ($1, $2, $3, $4)
+	ON CONFLICT(projectUUID) DO UPDATE SET maxEvidenceSize = $2, maxStorage = $3, maxMessages = $4
+	`
+	if _, err := database.Exec(context.Background(), preparedStatement, projectUUID, quota.MaxEvidenceSize, quota.MaxStorage, quota.MaxMessages); err != nil {
+		return err
+	}
+
+	details := fmt.Sprintf("max evidence size %d, max storage %d, max messages %d", quota.MaxEvidenceSize, quota.MaxStorage, quota.MaxMessages)
+
+	return AddAuditLog(projectUUID, userUUID, AuditActionSetProjectQuota, details, database)
+}
+
+// ResetProjectQuota removes the quota of the project so the Config.ProjectQuota applies again.
+func ResetProjectQuota(projectUUID string, userUUID string, database *pgx.Conn) error {
+	if err := checkUserAdmin(userUUID, database); err != nil {
+		return err
+	}
+
+	preparedStatement := `
+	DELETE FROM project_quotas WHERE projectUUID = $1
+	`
+	if _, err := database.Exec(context.Background(), preparedStatement, projectUUID); err != nil {
+		return err
+	}
+
+	return AddAuditLog(projectUUID, userUUID, AuditActionSetProjectQuota, "default quota", database)
+}
+
+// getProjectQuota returns the quota of the project, the DefaultProjectQuota if the project has no quota.
+func getProjectQuota(projectUUID string, database *pgx.Conn) (ProjectQuota, bool, error) {
+	preparedStatement := `
+	SELECT maxEvidenceSize, maxStorage, maxMessages FROM project_quotas WHERE projectUUID = $1
+	`
+	var quota ProjectQuota
+
+	if err := database.QueryRow(context.Background(), preparedStatement, projectUUID).Scan(&quota.MaxEvidenceSize, &quota.MaxStorage, &quota.MaxMessages); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return DefaultProjectQuota, false, nil
+		}
+
+		return ProjectQuota{}, false, err
+	}
+
+	return quota, true, nil
+}
+
+// GetProjectQuotaUsage returns the storage and messages of the project compared to its quota.
+// The storage is measured by listing the MinIO objects of the project.
+func GetProjectQuotaUsage(projectUUID string, userUUID string, database *pgx.Conn) (ProjectQuotaUsage, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return ProjectQuotaUsage{}, err
+	}
+
+	quota, isCustom, err := getProjectQuota(projectUUID, database)
+
+	if err != nil {
+		return ProjectQuotaUsage{}, err
+	}
+
+	storage, err := getProjectStorageUsage(projectUUID, database)
+
+	if err != nil {
+		return ProjectQuotaUsage{}, err
+	}
+
+	messages, err := countProjectMessages(projectUUID)
+
+	if err != nil {
+		return ProjectQuotaUsage{}, err
+	}
+
+	return ProjectQuotaUsage{
+		Quota:    quota,
+		IsCustom: isCustom,
+		Storage:  storage,
+		Messages: messages,
+	}, nil
+}
+
+// countProjectMessages returns the amount of indexed messages of the project.
+func countProjectMessages(projectUUID string) (int, error) {
+	return countMessages(esquery.Bool().Filter(esquery.Term("project_uuid", projectUUID)))
+}
+
+// CheckEvidenceQuota returns an error wrapping ErrEvidenceSizeQuotaExceeded or ErrStorageQuotaExceeded if an evidence file of the size
+// can't be added to the project, call it before accepting an upload.
+func CheckEvidenceQuota(fileSize int64, projectUUID string, userUUID string, database *pgx.Conn) error {
+	if err := CheckPermission(userUUID, projectUUID, ActionManageEvidence, database); err != nil {
+		return err
+	}
+
+	return checkEvidenceQuota(fileSize, projectUUID, database)
+}
+
+// checkEvidenceQuota returns an error if an evidence file of the size can't be added to the project.
+func checkEvidenceQuota(fileSize int64, projectUUID string, database *pgx.Conn) error {
+	quota, _, err := getProjectQuota(projectUUID, database)
+
+	if err != nil {
+		return err
+	}
+
+	if quota.MaxEvidenceSize > 0 && fileSize > quota.MaxEvidenceSize {
+		return fmt.Errorf("%w: %d of at most %d bytes", ErrEvidenceSizeQuotaExceeded, fileSize, quota.MaxEvidenceSize)
+	}
+
+	if quota.MaxStorage <= 0 {
+		return nil
+	}
+
+	storage, err := getProjectStorageUsage(projectUUID, database)
+
+	if err != nil {
+		return err
+	}
+
+	if storage.Total+fileSize > quota.MaxStorage {
+		return fmt.Errorf("%w: %d bytes used, %d bytes added, %d bytes allowed", ErrStorageQuotaExceeded, storage.Total, fileSize, quota.MaxStorage)
+	}
+
+	return nil
+}
+
+// getRemainingMessageQuota returns the amount of messages which may still be parsed into the project, -1 if unlimited.
+// Returns an error if the storage or message quota is already exceeded, so parsing isn't started.
+func getRemainingMessageQuota(projectUUID string, database *pgx.Conn) (int, error) {
+	quota, _, err := getProjectQuota(projectUUID, database)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if quota.MaxStorage > 0 {
+		storage, err := getProjectStorageUsage(projectUUID, database)
+
+		if err != nil {
+			return 0, err
+		}
+
+		if storage.Total >= quota.MaxStorage {
+			return 0, fmt.Errorf("%w: %d of %d bytes used", ErrStorageQuotaExceeded, storage.Total, quota.MaxStorage)
+		}
+	}
+
+	if quota.MaxMessages <= 0 {
+		return -1, nil
+	}
+
+	messages, err := countProjectMessages(projectUUID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if messages >= quota.MaxMessages {
+		return 0, fmt.Errorf("%w: %d of %d messages", ErrMessageQuotaExceeded, messages, quota.MaxMessages)
+	}
+
+	return quota.MaxMessages - messages, nil
+}
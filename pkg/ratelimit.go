@@ -0,0 +1,129 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimitOptions represents the rate of requests to a cloud mailbox service.
+type RateLimitOptions struct {
+	RequestsPerSecond float64 `mapstructure:"requests_per_second"`
+	Burst             int     `mapstructure:"burst"`
+}
+
+// DefaultMailboxRateLimitOptions defines the mailbox rate limit used if the mailbox_rate_limit configuration variable is unset.
+var DefaultMailboxRateLimitOptions = RateLimitOptions{
+	RequestsPerSecond: 4,
+	Burst:             4,
+}
+
+// MailboxRateLimiter limits the requests of the IMAP and Microsoft Graph collectors.
+// Shared by all collections so concurrent pulls don't multiply the rate.
+//
+// Deprecated: use Core.MailboxRateLimiter.
+var MailboxRateLimiter = NewRateLimiter(DefaultMailboxRateLimitOptions)
+
+// RateLimiter is a token bucket allowing bursts of requests up to the burst size.
+type RateLimiter struct {
+	mutex      sync.Mutex
+	options    RateLimitOptions
+	tokens     float64
+	lastRefill time.Time
+	pauseUntil time.Time
+}
+
+// NewRateLimiter creates a rate limiter, a zero requests per second disables rate limiting.
+func NewRateLimiter(options RateLimitOptions) *RateLimiter {
+	if options.Burst <= 0 {
+		options.Burst = 1
+	}
+
+	return &RateLimiter{
+		options:    options,
+		tokens:     float64(options.Burst),
+		lastRefill: time.Now(),
+	}
+}
+
+// Wait blocks until a request is allowed or the context is done.
+func (rateLimiter *RateLimiter) Wait(ctx context.Context) error {
+	for {
+		delay := rateLimiter.reserve()
+
+		if delay <= 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// Pause blocks all requests for the duration, used when the service responds with Retry-After.
+func (rateLimiter *RateLimiter) Pause(duration time.Duration) {
+	rateLimiter.mutex.Lock()
+	defer rateLimiter.mutex.Unlock()
+
+	if pauseUntil := time.Now().Add(duration); pauseUntil.After(rateLimiter.pauseUntil) {
+		rateLimiter.pauseUntil = pauseUntil
+	}
+}
+
+// reserve takes a token and returns zero or returns how long to wait before trying again.
+func (rateLimiter *RateLimiter) reserve() time.Duration {
+	rateLimiter.mutex.Lock()
+	defer rateLimiter.mutex.Unlock()
+
+	now := time.Now()
+
+	if now.Before(rateLimiter.pauseUntil) {
+		return rateLimiter.pauseUntil.Sub(now)
+	}
+
+	if rateLimiter.options.RequestsPerSecond <= 0 {
+		return 0
+	}
+
+	rateLimiter.tokens += now.Sub(rateLimiter.lastRefill).Seconds() * rateLimiter.options.RequestsPerSecond
+	rateLimiter.lastRefill = now
+
+	if rateLimiter.tokens > float64(rateLimiter.options.Burst) {
+		rateLimiter.tokens = float64(rateLimiter.options.Burst)
+	}
+
+	if rateLimiter.tokens >= 1 {
+		rateLimiter.tokens--
+		return 0
+	}
+
+	return time.Duration((1 - rateLimiter.tokens) / rateLimiter.options.RequestsPerSecond * float64(time.Second))
+}
+
+// parseRetryAfter returns the duration of the Retry-After header in seconds or HTTP date format.
+// Returns zero if the header is missing or invalid.
+func parseRetryAfter(header http.Header) time.Duration {
+	value := header.Get("Retry-After")
+
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+
+	return 0
+}
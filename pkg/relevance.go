@@ -0,0 +1,316 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"fmt"
+	"github.com/aquasecurity/esquery"
+	"github.com/jackc/pgx/v4"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RelevanceModel represents a training run of the relevance classifier, see TrainRelevanceModel.
+type RelevanceModel struct {
+	Relevant     int `json:"relevant"`     // The amount of messages reviewed as responsive or privileged.
+	NotRelevant  int `json:"not_relevant"` // The amount of messages reviewed as irrelevant.
+	Scored       int `json:"scored"`       // The amount of unreviewed messages which were scored.
+	CreationDate int `json:"creation_date"`
+}
+
+// Relevance classifier parameters.
+const (
+	// relevanceFeatureBits defines the size (2^bits) of the hashed feature space.
+	relevanceFeatureBits = 18
+	// relevanceTrainingEpochs defines the amount of passes over the review decisions.
+	relevanceTrainingEpochs = 10
+	relevanceLearningRate   = 0.5
+	relevanceRegularization = 1e-6
+	// minRelevanceTrainingExamples defines the minimum amount of relevant and not relevant review decisions.
+	minRelevanceTrainingExamples = 5
+	// maxRelevanceTextLength defines the maximum amount of characters of a message which are classified.
+	maxRelevanceTextLength = 20000
+	// relevanceSeed seeds the order of the training examples so training on the same decisions gives the same model.
+	relevanceSeed = 1
+)
+
+// relevantReviewStatuses and notRelevantReviewStatuses define the review decisions the classifier is trained on.
+// Messages with the "reviewed" status have no decision.
+var (
+	relevantReviewStatuses    = []interface{}{ReviewStatusResponsive, ReviewStatusPrivileged}
+	notRelevantReviewStatuses = []interface{}{ReviewStatusIrrelevant}
+)
+
+// ErrNotEnoughReviewDecisions is returned by TrainRelevanceModel if too few messages are reviewed as relevant or irrelevant.
+var ErrNotEnoughReviewDecisions = fmt.Errorf("at least %d messages must be reviewed as responsive and %d as irrelevant", minRelevanceTrainingExamples, minRelevanceTrainingExamples)
+
+// relevanceClassifier is a logistic regression classifier on hashed term features.
+type relevanceClassifier struct {
+	weights []float64
+	bias    float64
+}
+
+// relevanceExample represents a review decision used to train the classifier.
+type relevanceExample struct {
+	features   map[uint32]float64
+	isRelevant bool
+}
+
+// getRelevanceFeatures returns the L2 normalized, log scaled term frequencies of the message by hashed term.
+func getRelevanceFeatures(message Message) map[uint32]float64 {
+	features := make(map[uint32]float64)
+
+	for term, frequency := range getMessageTerms(message, maxRelevanceTextLength) {
+		termHash := fnv.New32a()
+
+		_, _ = termHash.Write([]byte(term))
+
+		features[termHash.Sum32()&(1<<relevanceFeatureBits-1)] += 1 + math.Log(float64(frequency))
+	}
+
+	var norm float64
+
+	for _, value := range features {
+		norm += value * value
+	}
+
+	if norm > 0 {
+		norm = math.Sqrt(norm)
+
+		for feature := range features {
+			features[feature] /= norm
+		}
+	}
+
+	return features
+}
+
+// newRelevanceClassifier trains the classifier with stochastic gradient descent.
+// The classes are weighted by their inverse frequency since far fewer messages are usually relevant.
+func newRelevanceClassifier(examples []relevanceExample) *relevanceClassifier {
+	classifier := &relevanceClassifier{
+		weights: make([]float64, 1<<relevanceFeatureBits),
+	}
+
+	var relevant int
+
+	for _, example := range examples {
+		if example.isRelevant {
+			relevant++
+		}
+	}
+
+	relevantWeight := float64(len(examples)) / float64(2*relevant)
+	notRelevantWeight := float64(len(examples)) / float64(2*(len(examples)-relevant))
+
+	random := rand.New(rand.NewSource(relevanceSeed))
+	order := random.Perm(len(examples))
+
+	for epoch := 0; epoch < relevanceTrainingEpochs; epoch++ {
+		learningRate := relevanceLearningRate / (1 + float64(epoch))
+
+		random.Shuffle(len(order), func(i, j int) {
+			order[i], order[j] = order[j], order[i]
+		})
+
+		for _, index := range order {
+			example := examples[index]
+
+			label := 0.0
+			classWeight := notRelevantWeight
+
+			if example.isRelevant {
+				label = 1
+				classWeight = relevantWeight
+			}
+
+			gradient := (classifier.predict(example.features) - label) * classWeight
+
+			for feature, value := range example.features {
+				classifier.weights[feature] -= learningRate * (gradient*value + relevanceRegularization*classifier.weights[feature])
+			}
+
+			classifier.bias -= learningRate * gradient
+		}
+	}
+
+	return classifier
+}
+
+// predict returns the probability (0 to 1) that the message of the features is relevant.
+func (classifier *relevanceClassifier) predict(features map[uint32]float64) float64 {
+	score := classifier.bias
+
+	for feature, value := range features {
+		score += classifier.weights[feature] * value
+	}
+
+	return 1 / (1 + math.Exp(-score))
+}
+
+// TrainRelevanceModel trains the relevance classifier on the review decisions (responsive or privileged versus irrelevant)
+// and scores the relevance of the other messages of the project, see GetPredictedRelevant.
+// Run it again as reviewers make decisions so the predictions keep improving (continuous active learning).
+// Returns ErrNotEnoughReviewDecisions if there are too few decisions of either kind.
+func TrainRelevanceModel(ctx context.Context, projectUUID string, reportProgress func(progress int), userUUID string, database *pgx.Conn) (RelevanceModel, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionManageProject, database); err != nil {
+		return RelevanceModel{}, err
+	}
+
+	if err := updateMessagesMapping(); err != nil {
+		return RelevanceModel{}, err
+	}
+
+	decisionStatuses := append(append([]interface{}{}, relevantReviewStatuses...), notRelevantReviewStatuses...)
+
+	decisionsQuery := esquery.Bool().Filter(
+		esquery.Term("project_uuid", projectUUID),
+		esquery.Terms("review_status", decisionStatuses...),
+	)
+
+	var examples []relevanceExample
+
+	relevanceModel := RelevanceModel{
+		CreationDate: int(time.Now().Unix()),
+	}
+
+	err := forEachMessageBatch(decisionsQuery, func(messages []Message) error {
+		for _, message := range messages {
+			example := relevanceExample{
+				features:   getRelevanceFeatures(message),
+				isRelevant: message.ReviewStatus == ReviewStatusResponsive || message.ReviewStatus == ReviewStatusPrivileged,
+			}
+
+			if example.isRelevant {
+				relevanceModel.Relevant++
+			} else {
+				relevanceModel.NotRelevant++
+			}
+
+			examples = append(examples, example)
+		}
+
+		return nil
+	}, database)
+
+	if err != nil {
+		return RelevanceModel{}, err
+	}
+
+	if relevanceModel.Relevant < minRelevanceTrainingExamples || relevanceModel.NotRelevant < minRelevanceTrainingExamples {
+		return RelevanceModel{}, ErrNotEnoughReviewDecisions
+	}
+
+	classifier := newRelevanceClassifier(examples)
+
+	// Messages reviewed since the previous run keep their score, it is ignored by GetPredictedRelevant.
+	scoreQuery := esquery.Bool().
+		Filter(esquery.Term("project_uuid", projectUUID)).
+		MustNot(esquery.Terms("review_status", decisionStatuses...))
+
+	total, err := countMessages(scoreQuery)
+
+	if err != nil {
+		return RelevanceModel{}, err
+	}
+
+	err = forEachMessageBatch(scoreQuery, func(messages []Message) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		messageUUIDs := make([]string, len(messages))
+		relevanceScores := make(map[string]interface{}, len(messages))
+
+		for i, message := range messages {
+			messageUUIDs[i] = message.UUID
+			relevanceScores[message.UUID] = classifier.predict(getRelevanceFeatures(message))
+		}
+
+		err := updateMessagesByScript(
+			newMessageUUIDsQuery(messageUUIDs, projectUUID),
+			"ctx._source.relevance_score = params.scores[ctx._source.uuid];",
+			map[string]interface{}{
+				"scores": relevanceScores,
+			},
+		)
+
+		if err != nil {
+			return err
+		}
+
+		relevanceModel.Scored += len(messages)
+
+		if reportProgress != nil && total > 0 {
+			reportProgress(int(math.Min(100, float64(relevanceModel.Scored)*100/float64(total))))
+		}
+
+		return nil
+	}, database)
+
+	if err != nil {
+		return RelevanceModel{}, err
+	}
+
+	Logger.WithFields(LogFields{"project_uuid": projectUUID}).Infof("Trained the relevance model on %d relevant and %d irrelevant messages, scored %d messages", relevanceModel.Relevant, relevanceModel.NotRelevant, relevanceModel.Scored)
+
+	return relevanceModel, nil
+}
+
+// GetPredictedRelevant returns the messages without a review decision which are predicted relevant with at least the threshold probability (0 to 1),
+// the most likely relevant first. Use it to prioritize the next review batch, see AssignMessages and TrainRelevanceModel.
+func GetPredictedRelevant(projectUUID string, threshold float64, userUUID string, database *pgx.Conn) ([]Message, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return nil, err
+	}
+
+	if threshold < 0 || threshold > 1 {
+		return nil, fmt.Errorf("invalid threshold: %f", threshold)
+	}
+
+	decisionStatuses := append(append([]interface{}{}, relevantReviewStatuses...), notRelevantReviewStatuses...)
+
+	query := esquery.Bool().
+		Filter(
+			esquery.Term("project_uuid", projectUUID),
+			esquery.Range("relevance_score").Gte(threshold),
+		).
+		MustNot(esquery.Terms("review_status", decisionStatuses...))
+
+	response, err := esquery.Search().
+		Query(query).
+		Sort("relevance_score", esquery.OrderDesc).
+		Size(10000).
+		Run(
+			Elasticsearch,
+			Elasticsearch.Search.WithContext(context.Background()),
+			Elasticsearch.Search.WithIndex("messages"),
+		)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if response.IsError() {
+		errorMessage := response.String()
+
+		if err := response.Body.Close(); err != nil {
+			Logger.Errorf("Failed to close Elasticsearch response: %s", err)
+		}
+
+		return nil, fmt.Errorf("failed to search predicted relevant messages: %s", errorMessage)
+	}
+
+	return getMessagesFromSearchResult(response.Body, database)
+}
+
+// runTrainRelevanceJob runs TrainRelevanceModel.
+func runTrainRelevanceJob(ctx context.Context, job Job, reportProgress func(progress int), database *pgx.Conn) (string, error) {
+	_, err := TrainRelevanceModel(ctx, job.ProjectUUID, reportProgress, job.UserUUID, database)
+
+	return "", err
+}
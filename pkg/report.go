@@ -4,10 +4,22 @@
 package core
 
 import (
+	"context"
 	_ "embed"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/jackc/pgx/v4"
 	"html/template"
+	"io"
+	"mime"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
 )
 
 //go:embed report.html
@@ -16,79 +28,500 @@ var reportTemplate string
 //go:embed report_message.html
 var reportMessageTemplate string
 
+//go:embed report_forensic.html
+var forensicReportTemplate string
+
+// ReportBranding represents the branding shown in the report.
+type ReportBranding struct {
+	LabName    string `json:"lab_name"`
+	Examiner   string `json:"examiner"`
+	CaseNumber string `json:"case_number"`
+	LogoPath   string `json:"logo_path"` // Path to the logo file, copied into the report.
+	Logo       string `json:"-"`         // File name of the logo in the report, set by CreateHTMLReport.
+}
+
+// SetProjectReportBranding sets the default branding of the forensic reports of the project, see CreateForensicReport.
+func SetProjectReportBranding(branding ReportBranding, projectUUID string, userUUID string, database *pgx.Conn) error {
+	if err := CheckPermission(userUUID, projectUUID, ActionExport, database); err != nil {
+		return err
+	}
+
+	encodedBranding, err := json.Marshal(branding)
+
+	if err != nil {
+		return err
+	}
+
+	preparedStatement := `
+	INSERT INTO project_report_branding(projectUUID, branding) VALUES ($1, $2)
+	ON CONFLICT(projectUUID) DO UPDATE SET branding = $2
+	`
+	_, err = database.Exec(context.Background(), preparedStatement, projectUUID, string(encodedBranding))
+
+	return err
+}
+
+// GetProjectReportBranding returns the default branding of the forensic reports of the project, empty if not set.
+func GetProjectReportBranding(projectUUID string, userUUID string, database *pgx.Conn) (ReportBranding, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return ReportBranding{}, err
+	}
+
+	return getProjectReportBranding(projectUUID, database)
+}
+
+// getProjectReportBranding returns the default branding of the forensic reports of the project, empty if not set.
+func getProjectReportBranding(projectUUID string, database *pgx.Conn) (ReportBranding, error) {
+	preparedStatement := `
+	SELECT branding FROM project_report_branding WHERE projectUUID = $1
+	`
+	var encodedBranding string
+
+	if err := database.QueryRow(context.Background(), preparedStatement, projectUUID).Scan(&encodedBranding); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ReportBranding{}, nil
+		}
+
+		return ReportBranding{}, err
+	}
+
+	var branding ReportBranding
+
+	err := json.Unmarshal([]byte(encodedBranding), &branding)
+
+	return branding, err
+}
+
+// ReportOptions represents the customization of a report.
+// The zero value uses the embedded templates without branding.
+type ReportOptions struct {
+	Template        string           `json:"template"`         // Overrides the embedded report.html.
+	MessageTemplate string           `json:"message_template"` // Overrides the embedded report_message.html.
+	Functions       template.FuncMap `json:"-"`                // Extra template functions, may override the default functions.
+	Branding        ReportBranding   `json:"branding"`
+	// IncludeAttachments copies all attachments into the report, linked from the message pages.
+	IncludeAttachments bool `json:"include_attachments"`
+	// InlineImages copies the image attachments into the report and replaces the cid: references in HTML bodies.
+	InlineImages bool `json:"inline_images"`
+	// Methodology describes how the examination was performed, shown in the forensic report.
+	Methodology string `json:"methodology"`
+	// Pseudonymizer replaces the addresses and names in the messages with pseudonyms if set, see NewPseudonymizer.
+	Pseudonymizer *Pseudonymizer `json:"-"`
+	// Progress is called with the percentage of the written message pages if set, e.g. by the JobTypeForensicReport job.
+	Progress func(progress int) `json:"-"`
+	// Archive encrypts and splits the ZIP file of the report.
+	Archive ArchiveOptions `json:"archive"`
+	// IncludeJournal includes the case journal of the project in the forensic report, see AddJournalEntry.
+	IncludeJournal bool `json:"include_journal"`
+}
+
+// ReportTagSection represents the messages with a tag in the forensic report.
+type ReportTagSection struct {
+	Tag      Tag       `json:"tag"`
+	Messages []Message `json:"messages"`
+}
+
+// ReportAttachment represents an attachment of a message in the report.
+type ReportAttachment struct {
+	Name string `json:"name"`
+	Path string `json:"path"` // Relative to the report, empty if the attachment isn't included.
+}
+
+// defaultReportFunctions returns the template functions available in all report templates.
+func defaultReportFunctions() template.FuncMap {
+	return template.FuncMap{
+		"formatDate": func(timestamp int) string {
+			return formatDisplayDate(timestamp, time.UTC)
+		},
+	}
+}
+
+// parseReportTemplate parses the template with the default and extra template functions.
+func parseReportTemplate(name string, text string, functions template.FuncMap) (*template.Template, error) {
+	reportFunctions := defaultReportFunctions()
+
+	for functionName, function := range functions {
+		reportFunctions[functionName] = function
+	}
+
+	return template.New(name).Funcs(reportFunctions).Parse(text)
+}
+
 // CreateHTMLReport creates a report from the bookmarks.
 // Returns the path to the created report ZIP file (stored in MinIO).
-func CreateHTMLReport(messages []Message, project Project) (string, error) {
-	reportTemplate, err := template.New("report").Parse(reportTemplate)
+func CreateHTMLReport(messages []Message, project Project, options ReportOptions) (string, error) {
+	if options.Template == "" {
+		options.Template = reportTemplate
+	}
+
+	if options.Pseudonymizer != nil {
+		pseudonymizedMessages, err := pseudonymizeMessages(messages, options.Pseudonymizer)
+
+		if err != nil {
+			return "", err
+		}
+
+		messages = pseudonymizedMessages
+	}
+
+	return createHTMLReport(messages, project, map[string]interface{}{}, options)
+}
+
+// CreateForensicReport creates a report of the bookmarked messages grouped by tag.
+// The report includes the comments, methodology, evidence hashes and search history of the project and optionally the case journal.
+// The branding of the project is used if the options have no branding, see SetProjectReportBranding.
+// Returns the path to the created report ZIP file (stored in MinIO).
+func CreateForensicReport(projectUUID string, options ReportOptions, userUUID string, database *pgx.Conn) (string, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionExport, database); err != nil {
+		return "", err
+	}
+
+	project, err := GetProjectByUUID(projectUUID, database)
 
 	if err != nil {
 		return "", err
 	}
 
-	reportUUID := NewUUID()
-	reportOutputDirectory := fmt.Sprintf("%s/%s", GetProjectTempDirectory(project.UUID), reportUUID)
+	if options.Branding == (ReportBranding{}) {
+		if options.Branding, err = getProjectReportBranding(projectUUID, database); err != nil {
+			return "", err
+		}
+	}
 
-	err = os.Mkdir(reportOutputDirectory, 0755)
+	location, err := getProjectLocation(projectUUID, database)
 
 	if err != nil {
 		return "", err
 	}
 
-	reportOutputFile, err := os.Create(fmt.Sprintf("%s/report.html", reportOutputDirectory))
+	options.Functions = withDisplayDateFunction(options.Functions, location)
+
+	var messages []Message
+
+	bookmarkedQuery := SearchFilters{IsBookmarked: true, IncludeBulk: true}.apply(newSearchQuery("", projectUUID))
+
+	err = forEachMessageBatch(bookmarkedQuery, func(batch []Message) error {
+		messages = append(messages, batch...)
+
+		return nil
+	}, database)
 
 	if err != nil {
 		return "", err
 	}
 
-	err = reportTemplate.Execute(reportOutputFile, map[string]interface{}{
-		"project":  project,
-		"messages": messages,
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Received < messages[j].Received
 	})
 
+	if options.Pseudonymizer != nil {
+		messages, err = pseudonymizeMessages(messages, options.Pseudonymizer)
+
+		if err != nil {
+			return "", err
+		}
+	}
+
+	evidence, err := GetEvidenceByProject(projectUUID, database)
+
+	if err != nil {
+		return "", err
+	}
+
+	searchHistory, err := GetSearchHistoryByProject(projectUUID, userUUID, database)
+
 	if err != nil {
 		return "", err
 	}
 
+	if options.Pseudonymizer != nil {
+		for i := range searchHistory {
+			if searchHistory[i].Query, err = options.Pseudonymizer.text(searchHistory[i].Query); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	var journal []JournalEntry
+
+	if options.IncludeJournal {
+		if journal, err = getJournal(projectUUID, database); err != nil {
+			return "", err
+		}
+
+		if options.Pseudonymizer != nil {
+			for i := range journal {
+				if journal[i].Body, err = options.Pseudonymizer.text(journal[i].Body); err != nil {
+					return "", err
+				}
+			}
+		}
+	}
+
+	if options.Template == "" {
+		options.Template = forensicReportTemplate
+	}
+
+	return createHTMLReport(messages, project, map[string]interface{}{
+		"sections":      getReportTagSections(messages),
+		"methodology":   options.Methodology,
+		"evidence":      evidence,
+		"searchHistory": searchHistory,
+		"journal":       journal,
+	}, options)
+}
+
+// getReportTagSections groups the messages by tag, sorted by tag name.
+// Messages with multiple tags are included in each section, messages without tags are in the last section.
+func getReportTagSections(messages []Message) []ReportTagSection {
+	var tagSections []ReportTagSection
+	var untaggedMessages []Message
+
+	tagSectionIndexes := map[string]int{}
+
 	for _, message := range messages {
-		messageOutputFile, err := os.Create(fmt.Sprintf("%s/message-%s.html", reportOutputDirectory, message.UUID))
+		if len(message.Tags) == 0 {
+			untaggedMessages = append(untaggedMessages, message)
+			continue
+		}
+
+		for _, tag := range message.Tags {
+			tagSectionIndex, ok := tagSectionIndexes[tag.UUID]
+
+			if !ok {
+				tagSectionIndex = len(tagSections)
+				tagSectionIndexes[tag.UUID] = tagSectionIndex
+				tagSections = append(tagSections, ReportTagSection{Tag: tag})
+			}
+
+			tagSections[tagSectionIndex].Messages = append(tagSections[tagSectionIndex].Messages, message)
+		}
+	}
+
+	sort.SliceStable(tagSections, func(i, j int) bool {
+		return strings.ToLower(tagSections[i].Tag.Name) < strings.ToLower(tagSections[j].Tag.Name)
+	})
+
+	if len(untaggedMessages) > 0 {
+		tagSections = append(tagSections, ReportTagSection{
+			Tag:      Tag{Name: "Untagged"},
+			Messages: untaggedMessages,
+		})
+	}
+
+	return tagSections
+}
+
+// createHTMLReport writes the report with the data for the report template and a page per message.
+// The project, messages and branding are added to the report template data.
+func createHTMLReport(messages []Message, project Project, reportData map[string]interface{}, options ReportOptions) (string, error) {
+
+	if options.MessageTemplate == "" {
+		options.MessageTemplate = reportMessageTemplate
+	}
+
+	reportTemplate, err := parseReportTemplate("report", options.Template, options.Functions)
+
+	if err != nil {
+		return "", err
+	}
+
+	reportMessageTemplate, err := parseReportTemplate("message", options.MessageTemplate, options.Functions)
+
+	if err != nil {
+		return "", err
+	}
+
+	scratchSpace, err := NewScratchSpace(project.UUID)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer scratchSpace.cleanup()
+
+	reportUUID := NewUUID()
+	reportOutputDirectory := scratchSpace.FilePath(reportUUID)
+
+	err = os.Mkdir(reportOutputDirectory, 0755)
+
+	if err != nil {
+		return "", err
+	}
+
+	if options.Branding.LogoPath != "" {
+		options.Branding.Logo = fmt.Sprintf("logo%s", filepath.Ext(options.Branding.LogoPath))
+
+		if err := copyFile(options.Branding.LogoPath, fmt.Sprintf("%s/%s", reportOutputDirectory, options.Branding.Logo)); err != nil {
+			return "", err
+		}
+	}
+
+	reportData["project"] = project
+	reportData["messages"] = messages
+	reportData["branding"] = options.Branding
+
+	err = executeReportTemplate(reportTemplate, fmt.Sprintf("%s/report.html", reportOutputDirectory), reportData)
+
+	if err != nil {
+		return "", err
+	}
+
+	progress := newExportProgress(len(messages), options.Progress)
+
+	for _, message := range messages {
+		reportAttachments, err := writeReportAttachments(message, project.UUID, reportOutputDirectory, options)
 
 		if err != nil {
 			return "", err
 		}
 
-		reportMessageTemplate, err := template.New("message").Parse(reportMessageTemplate)
+		// HTML bodies are rendered in a sandboxed iframe by the default template.
+		var htmlBody string
+
+		originalBody, err := getOriginalMessageBody(message)
 
 		if err != nil {
 			return "", err
 		}
 
-		err = reportMessageTemplate.Execute(messageOutputFile, map[string]interface{}{
-			"project": project,
-			"message": message,
+		if isHTMLBody(originalBody) {
+			htmlBody = inlineReportImages(originalBody, reportAttachments)
+		}
+
+		err = executeReportTemplate(reportMessageTemplate, fmt.Sprintf("%s/message-%s.html", reportOutputDirectory, message.UUID), map[string]interface{}{
+			"project":     project,
+			"message":     message,
+			"branding":    options.Branding,
+			"attachments": reportAttachments,
+			"htmlBody":    htmlBody,
 		})
 
 		if err != nil {
 			return "", err
 		}
+
+		progress.add(1)
+	}
+
+	return uploadExportDirectory(reportUUID, scratchSpace, options.Archive, project.UUID)
+}
+
+// writeReportAttachments writes the attachments of the message to the attachments directory of the report.
+// Only image attachments are written if just the inline images are included.
+func writeReportAttachments(message Message, projectUUID string, reportOutputDirectory string, options ReportOptions) ([]ReportAttachment, error) {
+	attachmentDirectory := fmt.Sprintf("%s/attachments", reportOutputDirectory)
+
+	if options.IncludeAttachments || options.InlineImages {
+		if err := os.MkdirAll(attachmentDirectory, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	var reportAttachments []ReportAttachment
+
+	for _, attachment := range message.Attachments {
+		reportAttachment := ReportAttachment{
+			Name: attachment.Name,
+		}
+
+		if options.IncludeAttachments || (options.InlineImages && isImageAttachment(attachment)) {
+			attachmentPath, err := exportAttachment(attachment, projectUUID, attachmentDirectory)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if attachmentPath != "" {
+				reportAttachment.Path = fmt.Sprintf("attachments/%s", filepath.Base(attachmentPath))
+			}
+		}
+
+		reportAttachments = append(reportAttachments, reportAttachment)
 	}
 
-	err = ZipDirectory(reportOutputDirectory, fmt.Sprintf("%s/%s.zip", reportOutputDirectory, reportUUID))
+	return reportAttachments, nil
+}
+
+// isImageAttachment returns true if the attachment is an image based on the extension.
+func isImageAttachment(attachment Attachment) bool {
+	return strings.HasPrefix(mime.TypeByExtension(strings.ToLower(filepath.Ext(attachment.Name))), "image/")
+}
+
+// reportContentIDRegex matches the cid: references to inline images.
+var reportContentIDRegex = regexp.MustCompile(`(?i)cid:([^"'\s)>]+)`)
+
+// inlineReportImages replaces the cid: references in the HTML body with the paths of the included attachments.
+// Attachments don't store their Content-ID so the attachment name is matched against the Content-ID (before the @).
+func inlineReportImages(body string, reportAttachments []ReportAttachment) string {
+	return reportContentIDRegex.ReplaceAllStringFunc(body, func(contentIDReference string) string {
+		contentID := strings.Trim(contentIDReference[len("cid:"):], "<>")
+		contentIDName := contentID
+
+		if atIndex := strings.Index(contentID, "@"); atIndex >= 0 {
+			contentIDName = contentID[:atIndex]
+		}
+
+		for _, reportAttachment := range reportAttachments {
+			if reportAttachment.Path == "" {
+				continue
+			}
+
+			if strings.EqualFold(reportAttachment.Name, contentID) || strings.EqualFold(reportAttachment.Name, contentIDName) {
+				return (&url.URL{Path: reportAttachment.Path}).String()
+			}
+		}
+
+		return contentIDReference
+	})
+}
+
+// executeReportTemplate writes the executed template to the output file.
+func executeReportTemplate(reportTemplate *template.Template, outputPath string, data interface{}) error {
+	outputFile, err := os.Create(outputPath)
 
 	if err != nil {
-		return "", err
+		return err
+	}
+
+	if err := reportTemplate.Execute(outputFile, data); err != nil {
+		if closeErr := outputFile.Close(); closeErr != nil {
+			Logger.Errorf("Failed to close file: %s", closeErr)
+		}
+
+		return err
 	}
 
-	uploadedFilePath, err := UploadFile(fmt.Sprintf("%s.zip", reportUUID), fmt.Sprintf("%s/%s.zip", reportOutputDirectory, reportUUID), project.UUID)
+	return outputFile.Close()
+}
+
+// copyFile copies the source file to the destination path.
+func copyFile(sourcePath string, destinationPath string) error {
+	sourceFile, err := os.Open(sourcePath)
 
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	err = os.RemoveAll(reportOutputDirectory)
+	defer func() {
+		if err := sourceFile.Close(); err != nil {
+			Logger.Errorf("Failed to close file: %s", err)
+		}
+	}()
+
+	destinationFile, err := os.Create(destinationPath)
 
 	if err != nil {
-		return "", err
+		return err
+	}
+
+	if _, err := io.Copy(destinationFile, sourceFile); err != nil {
+		if closeErr := destinationFile.Close(); closeErr != nil {
+			Logger.Errorf("Failed to close file: %s", closeErr)
+		}
+
+		return err
 	}
 
-	return uploadedFilePath, nil
+	return destinationFile.Close()
 }
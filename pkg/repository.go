@@ -0,0 +1,177 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"github.com/jackc/pgx/v4"
+)
+
+// ProjectRepo stores the projects with their users and evidence.
+type ProjectRepo interface {
+	SaveProject(project Project) error
+	GetProject(projectUUID string) (Project, error)
+	GetProjectsByUser(userUUID string) ([]Project, error)
+	// GetProjectUserRole returns the role of the user in the project, an error if the project isn't assigned to the user.
+	GetProjectUserRole(projectUUID string, userUUID string) (string, error)
+	// AddProjectUser adds the user to the project, ErrProjectUserExists if the user is already assigned to the project.
+	AddProjectUser(projectUUID string, userUUID string, role string) error
+	AddProjectEvidence(projectUUID string, evidenceUUID string) error
+}
+
+// EvidenceRepo stores the evidence files.
+type EvidenceRepo interface {
+	SaveEvidence(evidence Evidence) error
+	// GetEvidence returns the evidence of the project, an error if the evidence isn't in the project.
+	GetEvidence(evidenceUUID string, projectUUID string) (Evidence, error)
+	GetEvidenceByProject(projectUUID string) ([]Evidence, error)
+	GetProjectEvidenceSize(projectUUID string) (int64, error)
+}
+
+// TreeRepo stores the folder tree of the evidence files, the root tree nodes have the "NULL" parent.
+type TreeRepo interface {
+	SaveTreeNode(treeNode TreeNode) error
+	GetTreeNode(folderUUID string, projectUUID string) (TreeNode, error)
+	GetTreeNodesByParent(parentTreeNodeUUID string, projectUUID string) ([]TreeNode, error)
+	// GetTreeNodeDescendants returns all descendants of the tree node, not only its children.
+	GetTreeNodeDescendants(treeNodeUUID string, projectUUID string) ([]TreeNode, error)
+}
+
+// MetadataRepo stores the message metadata (isBookmarked, tag).
+type MetadataRepo interface {
+	SaveMessageMetadata(messageMetadata MessageMetadata) error
+	GetMessageMetadata(messageUUID string, projectUUID string) (MessageMetadata, error)
+	// GetMessageMetadataForUUIDs returns the metadata keyed by message UUID, messages without metadata are not included.
+	GetMessageMetadataForUUIDs(messageUUIDs []string, projectUUID string) (map[string]MessageMetadata, error)
+	GetBookmarkedMessageUUIDs(projectUUID string) ([]string, error)
+}
+
+// Repositories holds the repositories of the data stored in PostgreSQL, see NewRepositories.
+// Other implementations (e.g. fakes) can be used by the functions accepting a repository.
+type Repositories struct {
+	Projects ProjectRepo
+	Evidence EvidenceRepo
+	Tree     TreeRepo
+	Metadata MetadataRepo
+}
+
+// NewRepositories returns the repositories of the database connection.
+// The repositories share the connection so, like a *pgx.Conn, they aren't safe for concurrent use.
+func NewRepositories(database *pgx.Conn) Repositories {
+	return Repositories{
+		Projects: &pgxProjectRepo{database: database},
+		Evidence: &pgxEvidenceRepo{database: database},
+		Tree:     &pgxTreeRepo{database: database},
+		Metadata: &pgxMetadataRepo{database: database},
+	}
+}
+
+// pgxProjectRepo implements ProjectRepo using a PostgreSQL connection.
+type pgxProjectRepo struct {
+	database *pgx.Conn
+}
+
+// SaveProject saves the project, see Project.Save.
+func (repo *pgxProjectRepo) SaveProject(project Project) error {
+	return project.Save(repo.database)
+}
+
+// GetProject returns the project with the specified UUID.
+func (repo *pgxProjectRepo) GetProject(projectUUID string) (Project, error) {
+	return GetProjectByUUID(projectUUID, repo.database)
+}
+
+// GetProjectsByUser returns all projects of the user.
+func (repo *pgxProjectRepo) GetProjectsByUser(userUUID string) ([]Project, error) {
+	return GetProjectsByUser(userUUID, repo.database)
+}
+
+// GetProjectUserRole returns the role of the user in the project.
+func (repo *pgxProjectRepo) GetProjectUserRole(projectUUID string, userUUID string) (string, error) {
+	return GetProjectUserRole(projectUUID, userUUID, repo.database)
+}
+
+// AddProjectUser adds the user to the project with the specified role.
+func (repo *pgxProjectRepo) AddProjectUser(projectUUID string, userUUID string, role string) error {
+	return AddProjectUser(projectUUID, userUUID, role, repo.database)
+}
+
+// AddProjectEvidence adds the evidence to the project.
+func (repo *pgxProjectRepo) AddProjectEvidence(projectUUID string, evidenceUUID string) error {
+	return AddProjectEvidence(projectUUID, evidenceUUID, repo.database)
+}
+
+// pgxEvidenceRepo implements EvidenceRepo using a PostgreSQL connection.
+type pgxEvidenceRepo struct {
+	database *pgx.Conn
+}
+
+// SaveEvidence saves the evidence.
+func (repo *pgxEvidenceRepo) SaveEvidence(evidence Evidence) error {
+	return evidence.Save(repo.database)
+}
+
+// GetEvidence returns the evidence of the project.
+func (repo *pgxEvidenceRepo) GetEvidence(evidenceUUID string, projectUUID string) (Evidence, error) {
+	return getEvidenceByUUID(evidenceUUID, projectUUID, repo.database)
+}
+
+// GetEvidenceByProject returns all evidence of the project.
+func (repo *pgxEvidenceRepo) GetEvidenceByProject(projectUUID string) ([]Evidence, error) {
+	return GetEvidenceByProject(projectUUID, repo.database)
+}
+
+// GetProjectEvidenceSize returns the total file size of all evidence in the project.
+func (repo *pgxEvidenceRepo) GetProjectEvidenceSize(projectUUID string) (int64, error) {
+	return GetProjectEvidenceSize(projectUUID, repo.database)
+}
+
+// pgxTreeRepo implements TreeRepo using a PostgreSQL connection.
+type pgxTreeRepo struct {
+	database *pgx.Conn
+}
+
+// SaveTreeNode saves the tree node.
+func (repo *pgxTreeRepo) SaveTreeNode(treeNode TreeNode) error {
+	return treeNode.Save(repo.database)
+}
+
+// GetTreeNode returns the tree node of the project.
+func (repo *pgxTreeRepo) GetTreeNode(folderUUID string, projectUUID string) (TreeNode, error) {
+	return getTreeNode(folderUUID, projectUUID, repo.database)
+}
+
+// GetTreeNodesByParent returns the children of the tree node.
+func (repo *pgxTreeRepo) GetTreeNodesByParent(parentTreeNodeUUID string, projectUUID string) ([]TreeNode, error) {
+	return GetTreeNodesByParent(parentTreeNodeUUID, projectUUID, repo.database)
+}
+
+// GetTreeNodeDescendants returns all descendants of the tree node.
+func (repo *pgxTreeRepo) GetTreeNodeDescendants(treeNodeUUID string, projectUUID string) ([]TreeNode, error) {
+	return getTreeNodeDescendants(treeNodeUUID, projectUUID, repo.database)
+}
+
+// pgxMetadataRepo implements MetadataRepo using a PostgreSQL connection.
+type pgxMetadataRepo struct {
+	database *pgx.Conn
+}
+
+// SaveMessageMetadata saves the message metadata.
+func (repo *pgxMetadataRepo) SaveMessageMetadata(messageMetadata MessageMetadata) error {
+	return messageMetadata.Save(repo.database)
+}
+
+// GetMessageMetadata returns the metadata of the message.
+func (repo *pgxMetadataRepo) GetMessageMetadata(messageUUID string, projectUUID string) (MessageMetadata, error) {
+	return GetMessageMetadata(messageUUID, projectUUID, repo.database)
+}
+
+// GetMessageMetadataForUUIDs returns the metadata of the messages keyed by message UUID.
+func (repo *pgxMetadataRepo) GetMessageMetadataForUUIDs(messageUUIDs []string, projectUUID string) (map[string]MessageMetadata, error) {
+	return GetMessageMetadataForUUIDs(messageUUIDs, projectUUID, repo.database)
+}
+
+// GetBookmarkedMessageUUIDs returns the UUIDs of the bookmarked messages of the project.
+func (repo *pgxMetadataRepo) GetBookmarkedMessageUUIDs(projectUUID string) ([]string, error) {
+	return getBookmarkedMessageUUIDs(projectUUID, repo.database)
+}
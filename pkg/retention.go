@@ -0,0 +1,377 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"time"
+)
+
+// ErrProjectOnHold is returned by the deletion APIs (e.g. DeleteProject, DeleteTag and RemoveBookmark) when the project is placed on legal hold.
+var ErrProjectOnHold = errors.New("project is on legal hold")
+
+// Audit log actions used by the retention subsystem.
+const (
+	AuditActionPlaceHold      = "place_hold"
+	AuditActionReleaseHold    = "release_hold"
+	AuditActionSetRetention   = "set_retention"
+	AuditActionDeleteProject  = "delete_project"
+	AuditActionPurgeProject   = "purge_project"
+	AuditActionDeleteRejected = "delete_rejected"
+)
+
+// Audit log actions of the deletions which are rejected while the project is on legal hold, see checkProjectNotOnHold.
+const (
+	AuditActionDeleteTag              = "delete_tag"
+	AuditActionDeleteComment          = "delete_comment"
+	AuditActionDeleteBinder           = "delete_binder"
+	AuditActionRemoveBinderMessages   = "remove_binder_messages"
+	AuditActionDeleteJournalEntry     = "delete_journal_entry"
+	AuditActionDeleteSmartFolder      = "delete_smart_folder"
+	AuditActionDeleteWebhook          = "delete_webhook"
+	AuditActionRemoveBookmark         = "remove_bookmark"
+	AuditActionRemoveTag              = "remove_tag"
+	AuditActionRemoveCustodianDomain  = "remove_custodian_domain"
+	AuditActionRemoveCustodianAddress = "remove_custodian_address"
+)
+
+// RetentionPolicy represents the legal hold and retention period of a project.
+// A RetentionDays of zero means the project is retained indefinitely.
+type RetentionPolicy struct {
+	ProjectUUID   string `json:"project_uuid"`
+	IsOnHold      bool   `json:"is_on_hold"`
+	HoldReason    string `json:"hold_reason"`
+	RetentionDays int    `json:"retention_days"`
+}
+
+// Save saves the retention policy to the database.
+func (retentionPolicy *RetentionPolicy) Save(database *pgx.Conn) error {
+	preparedStatement := `
+	INSERT INTO retention_policy(projectUUID, isOnHold, holdReason, retentionDays) VALUES ($1, $2, $3, $4)
+	ON CONFLICT(projectUUID) DO UPDATE SET isOnHold = $2, holdReason = $3, retentionDays = $4
+	`
+	_, err := database.Exec(context.Background(), preparedStatement, retentionPolicy.ProjectUUID, retentionPolicy.IsOnHold, retentionPolicy.HoldReason, retentionPolicy.RetentionDays)
+
+	return err
+}
+
+// GetRetentionPolicy returns the retention policy of the project.
+// Projects without a stored policy are not on hold and retained indefinitely.
+func GetRetentionPolicy(projectUUID string, database *pgx.Conn) (RetentionPolicy, error) {
+	preparedStatement := `
+	SELECT projectUUID, isOnHold, holdReason, retentionDays FROM retention_policy WHERE projectUUID = $1
+	`
+	row := database.QueryRow(context.Background(), preparedStatement, projectUUID)
+
+	var retentionPolicy RetentionPolicy
+
+	if err := row.Scan(&retentionPolicy.ProjectUUID, &retentionPolicy.IsOnHold, &retentionPolicy.HoldReason, &retentionPolicy.RetentionDays); err == pgx.ErrNoRows {
+		return RetentionPolicy{ProjectUUID: projectUUID}, nil
+	} else if err != nil {
+		return RetentionPolicy{}, err
+	}
+
+	return retentionPolicy, nil
+}
+
+// PlaceProjectOnHold places the project on legal hold which blocks all deletion APIs.
+func PlaceProjectOnHold(projectUUID string, userUUID string, reason string, database *pgx.Conn) error {
+	if err := CheckPermission(userUUID, projectUUID, ActionManageProject, database); err != nil {
+		return err
+	}
+
+	retentionPolicy, err := GetRetentionPolicy(projectUUID, database)
+
+	if err != nil {
+		return err
+	}
+
+	retentionPolicy.IsOnHold = true
+	retentionPolicy.HoldReason = reason
+
+	if err := retentionPolicy.Save(database); err != nil {
+		return err
+	}
+
+	return AddAuditLog(projectUUID, userUUID, AuditActionPlaceHold, reason, database)
+}
+
+// ReleaseProjectHold releases the legal hold of the project.
+func ReleaseProjectHold(projectUUID string, userUUID string, database *pgx.Conn) error {
+	if err := CheckPermission(userUUID, projectUUID, ActionManageProject, database); err != nil {
+		return err
+	}
+
+	retentionPolicy, err := GetRetentionPolicy(projectUUID, database)
+
+	if err != nil {
+		return err
+	}
+
+	retentionPolicy.IsOnHold = false
+	retentionPolicy.HoldReason = ""
+
+	if err := retentionPolicy.Save(database); err != nil {
+		return err
+	}
+
+	return AddAuditLog(projectUUID, userUUID, AuditActionReleaseHold, "", database)
+}
+
+// SetProjectRetention sets the amount of days after which the project is purged by PurgeExpiredProjects.
+// Use zero to retain the project indefinitely.
+func SetProjectRetention(projectUUID string, userUUID string, retentionDays int, database *pgx.Conn) error {
+	if err := CheckPermission(userUUID, projectUUID, ActionManageProject, database); err != nil {
+		return err
+	}
+
+	if retentionDays < 0 {
+		return errors.New("retention days must not be negative")
+	}
+
+	retentionPolicy, err := GetRetentionPolicy(projectUUID, database)
+
+	if err != nil {
+		return err
+	}
+
+	retentionPolicy.RetentionDays = retentionDays
+
+	if err := retentionPolicy.Save(database); err != nil {
+		return err
+	}
+
+	return AddAuditLog(projectUUID, userUUID, AuditActionSetRetention, fmt.Sprintf("%d days", retentionDays), database)
+}
+
+// checkProjectNotOnHold returns ErrProjectOnHold if the project is on legal hold.
+// Rejected deletions are audited as well.
+func checkProjectNotOnHold(projectUUID string, userUUID string, action string, database *pgx.Conn) error {
+	logger := Logger.WithFields(LogFields{"project_uuid": projectUUID})
+
+	retentionPolicy, err := GetRetentionPolicy(projectUUID, database)
+
+	if err != nil {
+		return err
+	}
+
+	if retentionPolicy.IsOnHold {
+		if err := AddAuditLog(projectUUID, userUUID, AuditActionDeleteRejected, action, database); err != nil {
+			logger.Errorf("Failed to add audit log: %s", err)
+		}
+
+		return ErrProjectOnHold
+	}
+
+	return nil
+}
+
+// retentionPurgeInterval defines how often RunJobWorker queues a JobTypePurgeProject job for each expired project.
+const retentionPurgeInterval = time.Hour
+
+// expiredProjectCondition defines the SQL condition of the projects (p) whose retention period (rp) has expired at $1.
+// Projects on legal hold never expire.
+const expiredProjectCondition = "rp.isOnHold = FALSE AND rp.retentionDays > 0 AND p.creationDate + rp.retentionDays * 86400 < $1"
+
+// PurgeExpiredProjects purges all projects whose retention period has expired.
+// Projects on legal hold are skipped. RunJobWorker purges the expired projects with JobTypePurgeProject jobs instead.
+func PurgeExpiredProjects(database *pgx.Conn) error {
+	expiredProjectUUIDs, err := getExpiredProjectUUIDs(database)
+
+	if err != nil {
+		return err
+	}
+
+	for _, projectUUID := range expiredProjectUUIDs {
+		if err := purgeExpiredProject(projectUUID, database); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getExpiredProjectUUIDs returns the projects whose retention period has expired, projects on legal hold are skipped.
+func getExpiredProjectUUIDs(database *pgx.Conn) ([]string, error) {
+	preparedStatement := fmt.Sprintf(`
+	SELECT p.uuid FROM project p
+	INNER JOIN retention_policy rp ON rp.projectUUID = p.uuid
+	WHERE %s
+	`, expiredProjectCondition)
+	rows, err := database.Query(context.Background(), preparedStatement, time.Now().Unix())
+
+	if err != nil {
+		return nil, err
+	}
+
+	var expiredProjectUUIDs []string
+
+	for rows.Next() {
+		var projectUUID string
+
+		if err := rows.Scan(&projectUUID); err != nil {
+			return nil, err
+		}
+
+		expiredProjectUUIDs = append(expiredProjectUUIDs, projectUUID)
+	}
+
+	rows.Close()
+
+	return expiredProjectUUIDs, rows.Err()
+}
+
+// isProjectExpired returns true if the retention period of the project has expired and it isn't on legal hold.
+func isProjectExpired(projectUUID string, database *pgx.Conn) (bool, error) {
+	preparedStatement := fmt.Sprintf(`
+	SELECT EXISTS (
+		SELECT 1 FROM project p
+		INNER JOIN retention_policy rp ON rp.projectUUID = p.uuid
+		WHERE p.uuid = $2 AND %s
+	)
+	`, expiredProjectCondition)
+
+	var isExpired bool
+
+	err := database.QueryRow(context.Background(), preparedStatement, time.Now().Unix(), projectUUID).Scan(&isExpired)
+
+	return isExpired, err
+}
+
+// purgeExpiredProject purges the expired project and audits it.
+func purgeExpiredProject(projectUUID string, database *pgx.Conn) error {
+	Logger.WithFields(LogFields{"project_uuid": projectUUID}).Infof("Purging expired project")
+
+	if err := purgeProject(projectUUID, database); err != nil {
+		return err
+	}
+
+	return AddAuditLog(projectUUID, "", AuditActionPurgeProject, "retention period expired", database)
+}
+
+// queueExpiredProjectPurges queues a low priority JobTypePurgeProject job for each expired project which doesn't have one yet.
+// The jobs are submitted by the system, so they don't have a user.
+func queueExpiredProjectPurges(database *pgx.Conn) error {
+	expiredProjectUUIDs, err := getExpiredProjectUUIDs(database)
+
+	if err != nil {
+		return err
+	}
+
+	for _, projectUUID := range expiredProjectUUIDs {
+		preparedStatement := `
+		SELECT EXISTS (SELECT 1 FROM jobs WHERE projectUUID = $1 AND type = $2 AND status IN ($3, $4))
+		`
+
+		var isQueued bool
+
+		if err := database.QueryRow(context.Background(), preparedStatement, projectUUID, JobTypePurgeProject, JobStatusQueued, JobStatusRunning).Scan(&isQueued); err != nil {
+			return err
+		}
+
+		if isQueued {
+			continue
+		}
+
+		job := Job{
+			UUID:         NewUUID(),
+			ProjectUUID:  projectUUID,
+			Type:         JobTypePurgeProject,
+			Status:       JobStatusQueued,
+			Priority:     JobPriorityLow,
+			Parameters:   "{}",
+			MaxAttempts:  jobMaximumAttempts,
+			CreationDate: int(time.Now().Unix()),
+		}
+
+		if err := job.Save(database); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// runPurgeProjectJob purges the project of the job if its retention period has (still) expired.
+// The project may have been placed on legal hold since the job was queued, in which case nothing is purged.
+// The job itself is removed with the project.
+func runPurgeProjectJob(ctx context.Context, job Job, reportProgress func(progress int), database *pgx.Conn) (string, error) {
+	isExpired, err := isProjectExpired(job.ProjectUUID, database)
+
+	if err != nil || !isExpired {
+		return "", err
+	}
+
+	return "", purgeExpiredProject(job.ProjectUUID, database)
+}
+
+// purgeProject removes all Elasticsearch documents, PostgreSQL rows and MinIO objects of the project.
+func purgeProject(projectUUID string, database *pgx.Conn) error {
+	if err := DeleteMessagesByProject(projectUUID); err != nil {
+		return err
+	}
+
+	if err := DeleteContactsByProject(projectUUID); err != nil {
+		return err
+	}
+
+	if err := RemoveObjectsByPrefix(fmt.Sprintf("%s/", projectUUID)); err != nil {
+		return err
+	}
+
+	if err := removeProjectBucket(projectUUID, database); err != nil {
+		return err
+	}
+
+	// Evidence files are stored by their file hash, only remove those which aren't used by other projects.
+	preparedStatement := `
+	SELECT DISTINCT e.fileHash FROM evidence e
+	INNER JOIN project_evidence_junction pej ON pej.evidenceUUID = e.uuid
+	WHERE pej.projectUUID = $1 AND NOT EXISTS (
+		SELECT 1 FROM evidence oe
+		INNER JOIN project_evidence_junction opej ON opej.evidenceUUID = oe.uuid
+		WHERE oe.fileHash = e.fileHash AND opej.projectUUID != $1
+	)
+	`
+	rows, err := database.Query(context.Background(), preparedStatement, projectUUID)
+
+	if err != nil {
+		return err
+	}
+
+	var fileHashes []string
+
+	for rows.Next() {
+		var fileHash string
+
+		if err := rows.Scan(&fileHash); err != nil {
+			return err
+		}
+
+		fileHashes = append(fileHashes, fileHash)
+	}
+
+	rows.Close()
+
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+
+	for _, fileHash := range fileHashes {
+		if err := RemoveObject(fileHash); err != nil {
+			return err
+		}
+	}
+
+	if err := deleteProjectRows(projectUUID, database); err != nil {
+		return err
+	}
+
+	dataKeyCache.Delete(projectUUID)
+
+	return nil
+}
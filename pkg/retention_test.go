@@ -0,0 +1,259 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v4"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testDatabaseURLVariable defines the environment variable of the PostgreSQL database (with the Go Forensics tables) used by the database tests.
+const testDatabaseURLVariable = "GOFORENSICS_TEST_DATABASE_URL"
+
+// TestDeletionsCheckLegalHold tests that every deletion API (Delete* and Remove* functions of a project) checks the legal hold
+// before anything else than the permissions.
+func TestDeletionsCheckLegalHold(t *testing.T) {
+	fileSet := token.NewFileSet()
+
+	packages, err := parser.ParseDir(fileSet, ".", func(fileInfo os.FileInfo) bool {
+		return !strings.HasSuffix(fileInfo.Name(), "_test.go")
+	}, 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var checked int
+
+	for _, file := range packages["core"].Files {
+		for _, declaration := range file.Decls {
+			function, ok := declaration.(*ast.FuncDecl)
+
+			if !ok || function.Recv != nil || !isProjectDeletionFunction(function) {
+				continue
+			}
+
+			checked++
+
+			if calledFunction := getFirstCallExcept(function.Body, "CheckPermission"); calledFunction != "checkProjectNotOnHold" {
+				t.Errorf("%s calls %s before checkProjectNotOnHold", function.Name.Name, calledFunction)
+			}
+		}
+	}
+
+	if checked == 0 {
+		t.Fatal("no deletion functions found")
+	}
+}
+
+// isProjectDeletionFunction returns true if the function is an exported Delete* or Remove* function of a project and user.
+func isProjectDeletionFunction(function *ast.FuncDecl) bool {
+	if !strings.HasPrefix(function.Name.Name, "Delete") && !strings.HasPrefix(function.Name.Name, "Remove") {
+		return false
+	}
+
+	parameters := map[string]bool{}
+
+	for _, field := range function.Type.Params.List {
+		for _, name := range field.Names {
+			parameters[name.Name] = true
+		}
+	}
+
+	return parameters["projectUUID"] && parameters["userUUID"]
+}
+
+// getFirstCallExcept returns the name of the first function called by the body which isn't one of the ignored functions.
+func getFirstCallExcept(body *ast.BlockStmt, ignoredFunctions ...string) string {
+	var firstCall string
+
+	ast.Inspect(body, func(node ast.Node) bool {
+		call, ok := node.(*ast.CallExpr)
+
+		if firstCall != "" || !ok {
+			return firstCall == ""
+		}
+
+		var name string
+
+		switch function := call.Fun.(type) {
+		case *ast.Ident:
+			name = function.Name
+		case *ast.SelectorExpr:
+			name = function.Sel.Name
+		}
+
+		for _, ignoredFunction := range ignoredFunctions {
+			if name == ignoredFunction {
+				return true
+			}
+		}
+
+		firstCall = name
+
+		return false
+	})
+
+	return firstCall
+}
+
+// TestLegalHoldPreservesProjectData tests that the deletion APIs leave the data of a project on legal hold untouched.
+func TestLegalHoldPreservesProjectData(t *testing.T) {
+	database := newTestDatabase(t)
+
+	projectUUID := NewUUID()
+	userUUID := NewUUID()
+	messageUUID := NewUUID()
+	tagUUID := NewUUID()
+	commentUUID := NewUUID()
+	binderUUID := NewUUID()
+	hashListUUID := NewUUID()
+	journalEntryUUID := NewUUID()
+	smartFolderUUID := NewUUID()
+	webhookUUID := NewUUID()
+	now := time.Now().Unix()
+
+	t.Cleanup(func() {
+		if err := deleteProjectRows(projectUUID, database); err != nil {
+			t.Errorf("Failed to remove test project: %s", err)
+		}
+
+		if _, err := database.Exec(context.Background(), "DELETE FROM audit_log WHERE projectUUID = $1", projectUUID); err != nil {
+			t.Errorf("Failed to remove test audit logs: %s", err)
+		}
+	})
+
+	mustExec(t, database, "INSERT INTO project(uuid, name, creationDate) VALUES ($1, $2, $3)", projectUUID, "Legal hold", now)
+	mustExec(t, database, "INSERT INTO project_user_junction(projectUUID, userUUID, role) VALUES ($1, $2, $3)", projectUUID, userUUID, RoleOwner)
+	mustExec(t, database, "INSERT INTO tags(uuid, projectUUID, name) VALUES ($1, $2, $3)", tagUUID, projectUUID, "Relevant")
+	mustExec(t, database, "INSERT INTO message_tags(messageUUID, tagUUID, projectUUID) VALUES ($1, $2, $3)", messageUUID, tagUUID, projectUUID)
+	mustExec(t, database, "INSERT INTO message_metadata(messageUUID, projectUUID, isBookmarked, tag) VALUES ($1, $2, $3, $4)", messageUUID, projectUUID, true, "Relevant")
+	mustExec(t, database, "INSERT INTO comments(uuid, messageUUID, projectUUID, parentCommentUUID, authorUUID, body, creationDate) VALUES ($1, $2, $3, $4, $5, $6, $7)", commentUUID, messageUUID, projectUUID, "", userUUID, "Comment", now)
+	mustExec(t, database, "INSERT INTO binders(uuid, projectUUID, name, description, isDefault, creationDate) VALUES ($1, $2, $3, $4, $5, $6)", binderUUID, projectUUID, "Binder", "", false, now)
+	mustExec(t, database, "INSERT INTO binder_messages(binderUUID, messageUUID, projectUUID, position) VALUES ($1, $2, $3, $4)", binderUUID, messageUUID, projectUUID, 0)
+	mustExec(t, database, "INSERT INTO hash_lists(uuid, projectUUID, name, creationDate) VALUES ($1, $2, $3, $4)", hashListUUID, projectUUID, "Hash list", now)
+	mustExec(t, database, "INSERT INTO journal_entries(uuid, projectUUID, authorUUID, body, messageUUIDs, evidenceUUIDs, creationDate, modificationDate) VALUES ($1, $2, $3, $4, $5, $6, $7, $7)", journalEntryUUID, projectUUID, userUUID, "Entry", "[]", "[]", now)
+	mustExec(t, database, "INSERT INTO smart_folders(uuid, projectUUID, title, query, filters, creationDate) VALUES ($1, $2, $3, $4, $5, $6)", smartFolderUUID, projectUUID, "Smart folder", "*", "{}", now)
+	mustExec(t, database, "INSERT INTO webhooks(uuid, projectUUID, url, secret, events, creationDate) VALUES ($1, $2, $3, $4, $5, $6)", webhookUUID, projectUUID, "https://example.com/webhook", "secret", "[]", now)
+	mustExec(t, database, "INSERT INTO custodian_domains(projectUUID, domain) VALUES ($1, $2)", projectUUID, "example.com")
+	mustExec(t, database, "INSERT INTO custodian_addresses(projectUUID, address) VALUES ($1, $2)", projectUUID, "custodian@example.com")
+
+	if err := PlaceProjectOnHold(projectUUID, userUUID, "Litigation", database); err != nil {
+		t.Fatal(err)
+	}
+
+	tables := []string{"project_user_junction", "tags", "message_tags", "message_metadata", "comments", "binders", "binder_messages", "hash_lists", "journal_entries", "smart_folders", "webhooks", "custodian_domains", "custodian_addresses", "retention_policy"}
+	rowCounts := getTestRowCounts(t, database, projectUUID, tables)
+
+	deletions := map[string]func() error{
+		"DeleteProject": func() error { return DeleteProject(projectUUID, userUUID, database) },
+		"DeleteTag":     func() error { return DeleteTag(tagUUID, projectUUID, userUUID, database) },
+		"DeleteComment": func() error { return DeleteComment(commentUUID, projectUUID, userUUID, database) },
+		"DeleteBinder":  func() error { return DeleteBinder(binderUUID, projectUUID, userUUID, database) },
+		"RemoveMessagesFromBinder": func() error {
+			return RemoveMessagesFromBinder(binderUUID, []string{messageUUID}, projectUUID, userUUID, database)
+		},
+		"DeleteHashList":         func() error { return DeleteHashList(hashListUUID, projectUUID, userUUID, database) },
+		"DeleteJournalEntry":     func() error { return DeleteJournalEntry(journalEntryUUID, projectUUID, userUUID, database) },
+		"DeleteSmartFolder":      func() error { return DeleteSmartFolder(smartFolderUUID, projectUUID, userUUID, database) },
+		"DeleteWebhook":          func() error { return DeleteWebhook(webhookUUID, projectUUID, userUUID, database) },
+		"RemoveBookmark":         func() error { return RemoveBookmark(messageUUID, projectUUID, userUUID, database) },
+		"RemoveTag":              func() error { return RemoveTag(messageUUID, projectUUID, userUUID, database) },
+		"RemoveCustodianDomain":  func() error { return RemoveCustodianDomain("example.com", projectUUID, userUUID, database) },
+		"RemoveCustodianAddress": func() error { return RemoveCustodianAddress("custodian@example.com", projectUUID, userUUID, database) },
+	}
+
+	for name, deletion := range deletions {
+		if err := deletion(); !errors.Is(err, ErrProjectOnHold) {
+			t.Errorf("%s returned %v, want ErrProjectOnHold", name, err)
+		}
+	}
+
+	for table, rowCount := range getTestRowCounts(t, database, projectUUID, tables) {
+		if rowCount != rowCounts[table] {
+			t.Errorf("%s has %d rows after the deletions, want %d", table, rowCount, rowCounts[table])
+		}
+	}
+
+	var isProjectKept bool
+
+	if err := database.QueryRow(context.Background(), "SELECT EXISTS (SELECT 1 FROM project WHERE uuid = $1)", projectUUID).Scan(&isProjectKept); err != nil {
+		t.Fatal(err)
+	}
+
+	if !isProjectKept {
+		t.Error("project was deleted")
+	}
+
+	var rejectedDeletions int
+
+	if err := database.QueryRow(context.Background(), "SELECT COUNT(*) FROM audit_log WHERE projectUUID = $1 AND action = $2", projectUUID, AuditActionDeleteRejected).Scan(&rejectedDeletions); err != nil {
+		t.Fatal(err)
+	}
+
+	if rejectedDeletions != len(deletions) {
+		t.Errorf("rejected deletions audited = %d, want %d", rejectedDeletions, len(deletions))
+	}
+}
+
+// newTestDatabase connects to the test database, the test is skipped if there is none.
+func newTestDatabase(t *testing.T) *pgx.Conn {
+	t.Helper()
+
+	databaseURL := os.Getenv(testDatabaseURLVariable)
+
+	if databaseURL == "" {
+		t.Skipf("%s isn't set", testDatabaseURLVariable)
+	}
+
+	database, err := pgx.Connect(context.Background(), databaseURL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		if err := database.Close(context.Background()); err != nil {
+			t.Errorf("Failed to close database: %s", err)
+		}
+	})
+
+	return database
+}
+
+// mustExec executes the statement.
+func mustExec(t *testing.T, database *pgx.Conn, preparedStatement string, arguments ...interface{}) {
+	t.Helper()
+
+	if _, err := database.Exec(context.Background(), preparedStatement, arguments...); err != nil {
+		t.Fatalf("%s: %s", preparedStatement, err)
+	}
+}
+
+// getTestRowCounts returns the amount of rows of the project in each table.
+func getTestRowCounts(t *testing.T, database *pgx.Conn, projectUUID string, tables []string) map[string]int {
+	t.Helper()
+
+	rowCounts := map[string]int{}
+
+	for _, table := range tables {
+		var rowCount int
+
+		if err := database.QueryRow(context.Background(), "SELECT COUNT(*) FROM "+table+" WHERE projectUUID = $1", projectUUID).Scan(&rowCount); err != nil {
+			t.Fatal(err)
+		}
+
+		rowCounts[table] = rowCount
+	}
+
+	return rowCounts
+}
@@ -0,0 +1,138 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RetryOptions represents the exponential backoff of operations on external services.
+type RetryOptions struct {
+	MaxAttempts     int           `mapstructure:"max_attempts"`
+	InitialInterval time.Duration `mapstructure:"initial_interval"`
+	MaxInterval     time.Duration `mapstructure:"max_interval"`
+	Multiplier      float64       `mapstructure:"multiplier"`
+	// Jitter randomizes the interval by this fraction (0.2 is ±20%) so clients don't retry in lockstep.
+	Jitter float64 `mapstructure:"jitter"`
+}
+
+// DefaultRetryOptions defines the retry options used if the retry configuration variable is unset.
+var DefaultRetryOptions = RetryOptions{
+	MaxAttempts:     5,
+	InitialInterval: 500 * time.Millisecond,
+	MaxInterval:     30 * time.Second,
+	Multiplier:      2,
+	Jitter:          0.2,
+}
+
+// ExternalServiceRetryOptions defines the retry options used for MinIO, Kafka, Postmark and Microsoft calls.
+//
+// Deprecated: use Core.Config.Retry.
+var ExternalServiceRetryOptions = DefaultRetryOptions
+
+// permanentError wraps errors which must not be retried.
+type permanentError struct {
+	err error
+}
+
+// Error returns the wrapped error message.
+func (permanentError *permanentError) Error() string {
+	return permanentError.err.Error()
+}
+
+// Unwrap returns the wrapped error.
+func (permanentError *permanentError) Unwrap() error {
+	return permanentError.err
+}
+
+// retryPermanent marks the error as permanent so retry returns it immediately.
+func retryPermanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// retryAfterError wraps errors of services which requested a minimum interval before retrying.
+type retryAfterError struct {
+	err   error
+	after time.Duration
+}
+
+// Error returns the wrapped error message.
+func (retryAfterError *retryAfterError) Error() string {
+	return retryAfterError.err.Error()
+}
+
+// Unwrap returns the wrapped error.
+func (retryAfterError *retryAfterError) Unwrap() error {
+	return retryAfterError.err
+}
+
+// retryAfter makes retry wait at least the duration before the next attempt, e.g. from a Retry-After header.
+func retryAfter(err error, after time.Duration) error {
+	return &retryAfterError{err: err, after: after}
+}
+
+// retry calls the operation until it succeeds, returns a permanent error, the attempts are exhausted or the context is done.
+// The last error is returned, unwrapped from retryPermanent.
+func retry(ctx context.Context, options RetryOptions, operation func() error) error {
+	if options.MaxAttempts <= 0 {
+		options.MaxAttempts = 1
+	}
+
+	var err error
+
+	for attempt := 1; attempt <= options.MaxAttempts; attempt++ {
+		err = operation()
+
+		if err == nil {
+			return nil
+		}
+
+		var permanent *permanentError
+
+		if errors.As(err, &permanent) {
+			return permanent.err
+		}
+
+		if attempt == options.MaxAttempts {
+			break
+		}
+
+		interval := getRetryInterval(options, attempt)
+
+		var throttled *retryAfterError
+
+		if errors.As(err, &throttled) && throttled.after > interval {
+			interval = throttled.after
+		}
+
+		Logger.Warnf("Attempt %d of %d failed, retrying in %s: %s", attempt, options.MaxAttempts, interval, err)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(interval):
+		}
+	}
+
+	return err
+}
+
+// getRetryInterval returns the backoff interval after the attempt including jitter.
+func getRetryInterval(options RetryOptions, attempt int) time.Duration {
+	interval := float64(options.InitialInterval) * math.Pow(options.Multiplier, float64(attempt-1))
+
+	if options.MaxInterval > 0 && interval > float64(options.MaxInterval) {
+		interval = float64(options.MaxInterval)
+	}
+
+	if options.Jitter > 0 {
+		interval += interval * options.Jitter * (rand.Float64()*2 - 1)
+	}
+
+	return time.Duration(interval)
+}
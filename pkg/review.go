@@ -0,0 +1,317 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aquasecurity/esquery"
+	"github.com/jackc/pgx/v4"
+	"time"
+)
+
+// Review statuses of a message.
+const (
+	ReviewStatusUnreviewed = "unreviewed"
+	ReviewStatusReviewed   = "reviewed"
+	ReviewStatusResponsive = "responsive"
+	ReviewStatusPrivileged = "privileged"
+	ReviewStatusIrrelevant = "irrelevant"
+)
+
+// ReviewStatuses defines all review statuses.
+var ReviewStatuses = []string{ReviewStatusUnreviewed, ReviewStatusReviewed, ReviewStatusResponsive, ReviewStatusPrivileged, ReviewStatusIrrelevant}
+
+// IsValidReviewStatus returns true if the status is a known review status.
+func IsValidReviewStatus(status string) bool {
+	for _, reviewStatus := range ReviewStatuses {
+		if status == reviewStatus {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MessageReview represents the review state of a message.
+type MessageReview struct {
+	MessageUUID  string `json:"message_uuid"`
+	ProjectUUID  string `json:"project_uuid"`
+	ReviewerUUID string `json:"reviewer_uuid"`
+	Status       string `json:"status"`
+	ReviewedBy   string `json:"reviewed_by"`
+	ReviewedDate int    `json:"reviewed_date"`
+}
+
+// ReviewerStatistics represents the review progress of a reviewer.
+type ReviewerStatistics struct {
+	ReviewerUUID       string         `json:"reviewer_uuid"`
+	Assigned           int            `json:"assigned"`
+	Reviewed           int            `json:"reviewed"`
+	StatusCounts       map[string]int `json:"status_counts"`
+	ProgressPercentage float64        `json:"progress_percentage"`
+}
+
+// AssignMessages assigns the messages to the reviewer.
+// Messages keep their current review status.
+func AssignMessages(messageUUIDs []string, reviewerUUID string, projectUUID string, userUUID string, database *pgx.Conn) error {
+	if err := CheckPermission(userUUID, projectUUID, ActionAssignReview, database); err != nil {
+		return err
+	}
+
+	if err := CheckPermission(reviewerUUID, projectUUID, ActionReview, database); err != nil {
+		return fmt.Errorf("reviewer is not allowed to review: %s", err)
+	}
+
+	return assignMessages(messageUUIDs, reviewerUUID, projectUUID, database)
+}
+
+// AssignMessagesByQuery distributes the messages matching the search query over the reviewers in batches of batchSize.
+// Like GetMessagesFromQuery bulk mail is excluded. Returns the amount of assigned messages.
+func AssignMessagesByQuery(query string, reviewerUUIDs []string, batchSize int, projectUUID string, userUUID string, database *pgx.Conn) (int, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionAssignReview, database); err != nil {
+		return 0, err
+	}
+
+	if len(reviewerUUIDs) == 0 {
+		return 0, errors.New("no reviewers specified")
+	}
+
+	if batchSize <= 0 {
+		return 0, errors.New("batch size must be positive")
+	}
+
+	for _, reviewerUUID := range reviewerUUIDs {
+		if err := CheckPermission(reviewerUUID, projectUUID, ActionReview, database); err != nil {
+			return 0, fmt.Errorf("reviewer %s is not allowed to review: %s", reviewerUUID, err)
+		}
+	}
+
+	assignedMessages := 0
+	var pendingMessageUUIDs []string
+
+	assignBatch := func(messageUUIDs []string) error {
+		reviewerUUID := reviewerUUIDs[(assignedMessages/batchSize)%len(reviewerUUIDs)]
+
+		if err := assignMessages(messageUUIDs, reviewerUUID, projectUUID, database); err != nil {
+			return err
+		}
+
+		assignedMessages += len(messageUUIDs)
+
+		return nil
+	}
+
+	err := forEachMessageUUIDBatch(SearchFilters{}.apply(newSearchQuery(query, projectUUID)), func(messageUUIDs []string) error {
+		pendingMessageUUIDs = append(pendingMessageUUIDs, messageUUIDs...)
+
+		for len(pendingMessageUUIDs) >= batchSize {
+			if err := assignBatch(pendingMessageUUIDs[:batchSize]); err != nil {
+				return err
+			}
+
+			pendingMessageUUIDs = pendingMessageUUIDs[batchSize:]
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return assignedMessages, err
+	}
+
+	if len(pendingMessageUUIDs) > 0 {
+		if err := assignBatch(pendingMessageUUIDs); err != nil {
+			return assignedMessages, err
+		}
+	}
+
+	return assignedMessages, nil
+}
+
+// assignMessages assigns the messages to the reviewer without checking permissions.
+func assignMessages(messageUUIDs []string, reviewerUUID string, projectUUID string, database *pgx.Conn) error {
+	preparedStatement := `
+	INSERT INTO message_review(messageUUID, projectUUID, reviewerUUID, status, reviewedBy, reviewedDate) VALUES ($1, $2, $3, $4, '', 0)
+	ON CONFLICT(messageUUID) DO UPDATE SET reviewerUUID = $3 WHERE message_review.projectUUID = EXCLUDED.projectUUID
+	`
+	batch := &pgx.Batch{}
+
+	for _, messageUUID := range messageUUIDs {
+		batch.Queue(preparedStatement, messageUUID, projectUUID, reviewerUUID, ReviewStatusUnreviewed)
+	}
+
+	if err := database.SendBatch(context.Background(), batch).Close(); err != nil {
+		return err
+	}
+
+	return updateMessageFields(messageUUIDs, projectUUID, map[string]interface{}{
+		"reviewer": reviewerUUID,
+	})
+}
+
+// SetReviewStatus sets the review status of the message, it doesn't assign the message to the user (see AssignMessages).
+func SetReviewStatus(status string, messageUUID string, projectUUID string, userUUID string, database *pgx.Conn) error {
+	if err := CheckPermission(userUUID, projectUUID, ActionReview, database); err != nil {
+		return err
+	}
+
+	if !IsValidReviewStatus(status) {
+		return fmt.Errorf("invalid review status: %s", status)
+	}
+
+	preparedStatement := `
+	INSERT INTO message_review(messageUUID, projectUUID, reviewerUUID, status, reviewedBy, reviewedDate) VALUES ($1, $2, '', $4, $3, $5)
+	ON CONFLICT(messageUUID) DO UPDATE SET status = $4, reviewedBy = $3, reviewedDate = $5 WHERE message_review.projectUUID = EXCLUDED.projectUUID
+	`
+	if _, err := database.Exec(context.Background(), preparedStatement, messageUUID, projectUUID, userUUID, status, time.Now().Unix()); err != nil {
+		return err
+	}
+
+	return updateMessageFields([]string{messageUUID}, projectUUID, map[string]interface{}{
+		"review_status": status,
+	})
+}
+
+// GetMessageReview returns the review state of the message.
+func GetMessageReview(messageUUID string, projectUUID string, database *pgx.Conn) (MessageReview, error) {
+	preparedStatement := `
+	SELECT messageUUID, projectUUID, reviewerUUID, status, reviewedBy, reviewedDate FROM message_review WHERE messageUUID = $1 AND projectUUID = $2
+	`
+	row := database.QueryRow(context.Background(), preparedStatement, messageUUID, projectUUID)
+
+	var messageReview MessageReview
+
+	if err := row.Scan(&messageReview.MessageUUID, &messageReview.ProjectUUID, &messageReview.ReviewerUUID, &messageReview.Status, &messageReview.ReviewedBy, &messageReview.ReviewedDate); err != nil {
+		return MessageReview{}, err
+	}
+
+	return messageReview, nil
+}
+
+// GetAssignedMessages returns the messages assigned to the reviewer with the specified review status.
+// Use an empty status to return all assigned messages.
+func GetAssignedMessages(reviewerUUID string, status string, projectUUID string, userUUID string, database *pgx.Conn) ([]Message, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return nil, err
+	}
+
+	filters := []esquery.Mappable{
+		esquery.Term("project_uuid", projectUUID),
+		esquery.Term("reviewer", reviewerUUID),
+	}
+
+	if status != "" {
+		filters = append(filters, newReviewStatusQuery(status))
+	}
+
+	var messages []Message
+
+	err := forEachMessageBatch(esquery.Bool().Must(filters...), func(batch []Message) error {
+		messages = append(messages, batch...)
+
+		return nil
+	}, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// GetMessagesByReviewStatus returns the messages with the specified review status.
+func GetMessagesByReviewStatus(status string, projectUUID string, userUUID string, database *pgx.Conn) ([]Message, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return nil, err
+	}
+
+	query := esquery.
+		Bool().
+		Must(esquery.Term("project_uuid", projectUUID)).
+		Must(newReviewStatusQuery(status))
+
+	var messages []Message
+
+	err := forEachMessageBatch(query, func(batch []Message) error {
+		messages = append(messages, batch...)
+
+		return nil
+	}, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// newReviewStatusQuery returns the Elasticsearch query matching messages with the review status.
+func newReviewStatusQuery(status string) esquery.Mappable {
+	if status == ReviewStatusUnreviewed {
+		// Messages which were never reviewed don't have a review status.
+		return esquery.
+			Bool().
+			MinimumShouldMatch(1).
+			Should(
+				esquery.Term("review_status", ReviewStatusUnreviewed),
+				esquery.Bool().MustNot(esquery.Exists("review_status")),
+			)
+	}
+
+	return esquery.Term("review_status", status)
+}
+
+// GetReviewerStatistics returns the review progress per reviewer.
+func GetReviewerStatistics(projectUUID string, userUUID string, database *pgx.Conn) ([]ReviewerStatistics, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return nil, err
+	}
+
+	preparedStatement := `
+	SELECT reviewerUUID, status, COUNT(*) FROM message_review WHERE projectUUID = $1 AND reviewerUUID != '' GROUP BY reviewerUUID, status ORDER BY reviewerUUID
+	`
+	rows, err := database.Query(context.Background(), preparedStatement, projectUUID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var reviewerStatistics []ReviewerStatistics
+
+	for rows.Next() {
+		var reviewerUUID string
+		var status string
+		var count int
+
+		if err := rows.Scan(&reviewerUUID, &status, &count); err != nil {
+			return nil, err
+		}
+
+		if len(reviewerStatistics) == 0 || reviewerStatistics[len(reviewerStatistics)-1].ReviewerUUID != reviewerUUID {
+			reviewerStatistics = append(reviewerStatistics, ReviewerStatistics{
+				ReviewerUUID: reviewerUUID,
+				StatusCounts: map[string]int{},
+			})
+		}
+
+		statistics := &reviewerStatistics[len(reviewerStatistics)-1]
+
+		statistics.Assigned += count
+		statistics.StatusCounts[status] = count
+
+		if status != ReviewStatusUnreviewed {
+			statistics.Reviewed += count
+		}
+	}
+
+	rows.Close()
+
+	for i := range reviewerStatistics {
+		reviewerStatistics[i].ProgressPercentage = float64(reviewerStatistics[i].Reviewed) / float64(reviewerStatistics[i].Assigned) * 100
+	}
+
+	return reviewerStatistics, rows.Err()
+}
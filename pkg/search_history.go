@@ -0,0 +1,95 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/jackc/pgx/v4"
+	"time"
+)
+
+// SearchHistory represents a search performed by a user, used in the report appendix.
+type SearchHistory struct {
+	UUID         string `json:"uuid"`
+	ProjectUUID  string `json:"project_uuid"`
+	UserUUID     string `json:"user_uuid"`
+	Query        string `json:"query"`
+	Filters      string `json:"filters"` // JSON encoded SearchFilters, empty if no filters were used.
+	ResultCount  int    `json:"result_count"`
+	CreationDate int    `json:"creation_date"`
+}
+
+// Save saves the search history to the database.
+func (searchHistory *SearchHistory) Save(database *pgx.Conn) error {
+	preparedStatement := `
+	INSERT INTO search_history(uuid, projectUUID, userUUID, query, filters, resultCount, creationDate) VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`
+	_, err := database.Exec(context.Background(), preparedStatement, searchHistory.UUID, searchHistory.ProjectUUID, searchHistory.UserUUID, searchHistory.Query, searchHistory.Filters, searchHistory.ResultCount, searchHistory.CreationDate)
+
+	return err
+}
+
+// addSearchHistory records the search performed by the user.
+// Failing to record the search is logged instead of failing the search itself.
+func addSearchHistory(query string, filters *SearchFilters, resultCount int, projectUUID string, userUUID string, database *pgx.Conn) {
+	logger := Logger.WithFields(LogFields{"project_uuid": projectUUID})
+
+	searchHistory := SearchHistory{
+		UUID:         NewUUID(),
+		ProjectUUID:  projectUUID,
+		UserUUID:     userUUID,
+		Query:        query,
+		ResultCount:  resultCount,
+		CreationDate: int(time.Now().Unix()),
+	}
+
+	if filters != nil {
+		encodedFilters, err := json.Marshal(filters)
+
+		if err != nil {
+			logger.Errorf("Failed to encode search filters: %s", err)
+		} else {
+			searchHistory.Filters = string(encodedFilters)
+		}
+	}
+
+	if err := searchHistory.Save(database); err != nil {
+		logger.Errorf("Failed to save search history: %s", err)
+	}
+}
+
+// GetSearchHistoryByProject returns the searches performed in the project, oldest first.
+func GetSearchHistoryByProject(projectUUID string, userUUID string, database *pgx.Conn) ([]SearchHistory, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return nil, err
+	}
+
+	preparedStatement := `
+	SELECT uuid, projectUUID, userUUID, query, filters, resultCount, creationDate FROM search_history WHERE projectUUID = $1 ORDER BY creationDate ASC
+	`
+	rows, err := database.Query(context.Background(), preparedStatement, projectUUID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var searchHistories []SearchHistory
+
+	for rows.Next() {
+		var searchHistory SearchHistory
+
+		err := rows.Scan(&searchHistory.UUID, &searchHistory.ProjectUUID, &searchHistory.UserUUID, &searchHistory.Query, &searchHistory.Filters, &searchHistory.ResultCount, &searchHistory.CreationDate)
+
+		if err != nil {
+			return nil, err
+		}
+
+		searchHistories = append(searchHistories, searchHistory)
+	}
+
+	rows.Close()
+
+	return searchHistories, rows.Err()
+}
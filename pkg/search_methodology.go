@@ -0,0 +1,354 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AuditActionExportSearchMethodology is logged when the search methodology report is exported.
+const AuditActionExportSearchMethodology = "export_search_methodology"
+
+// SearchMethodologyReport documents the searches performed in a project and the audit trail, see GetSearchMethodologyReport.
+type SearchMethodologyReport struct {
+	Searches     []SearchMethodologySearch `json:"searches"`
+	AuditTrail   []SearchMethodologyAction `json:"audit_trail"`
+	Users        []string                  `json:"users"` // The users who performed a search or action.
+	CreationDate int                       `json:"creation_date"`
+}
+
+// SearchMethodologySearch represents a search in the search methodology report.
+type SearchMethodologySearch struct {
+	SearchHistory
+	User    string   `json:"user"`    // The display name and email address of the user.
+	Filters []string `json:"filters"` // The filters which were used, e.g. "from: alice@example.com".
+}
+
+// SearchMethodologyAction represents an audit log in the search methodology report.
+type SearchMethodologyAction struct {
+	AuditLog
+	User string `json:"user"` // The display name and email address of the user, "System" for actions performed by the system.
+}
+
+// searchMethodologySystemUser names the user of actions performed by the system, see AddAuditLog.
+const searchMethodologySystemUser = "System"
+
+// GetSearchMethodologyReport returns all searches performed in the project (oldest first) with the used filters,
+// the amount of hits and who performed them, together with the audit trail of the project.
+func GetSearchMethodologyReport(projectUUID string, userUUID string, database *pgx.Conn) (SearchMethodologyReport, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return SearchMethodologyReport{}, err
+	}
+
+	searchHistories, err := GetSearchHistoryByProject(projectUUID, userUUID, database)
+
+	if err != nil {
+		return SearchMethodologyReport{}, err
+	}
+
+	auditLogs, err := GetAuditLogsByProject(projectUUID, database)
+
+	if err != nil {
+		return SearchMethodologyReport{}, err
+	}
+
+	var userUUIDs []string
+
+	for _, searchHistory := range searchHistories {
+		userUUIDs = append(userUUIDs, searchHistory.UserUUID)
+	}
+
+	for _, auditLog := range auditLogs {
+		userUUIDs = append(userUUIDs, auditLog.UserUUID)
+	}
+
+	users, err := GetUsersByUUIDs(userUUIDs, database)
+
+	if err != nil {
+		return SearchMethodologyReport{}, err
+	}
+
+	report := SearchMethodologyReport{
+		Searches:     []SearchMethodologySearch{},
+		AuditTrail:   []SearchMethodologyAction{},
+		CreationDate: int(time.Now().Unix()),
+	}
+
+	reportUsers := map[string]bool{}
+
+	for _, searchHistory := range searchHistories {
+		search := SearchMethodologySearch{
+			SearchHistory: searchHistory,
+			User:          getSearchMethodologyUser(searchHistory.UserUUID, users),
+		}
+
+		if search.Filters, err = describeSearchFilters(searchHistory.Filters); err != nil {
+			return SearchMethodologyReport{}, err
+		}
+
+		report.Searches = append(report.Searches, search)
+		reportUsers[search.User] = true
+	}
+
+	for _, auditLog := range auditLogs {
+		action := SearchMethodologyAction{
+			AuditLog: auditLog,
+			User:     getSearchMethodologyUser(auditLog.UserUUID, users),
+		}
+
+		report.AuditTrail = append(report.AuditTrail, action)
+		reportUsers[action.User] = true
+	}
+
+	for reportUser := range reportUsers {
+		report.Users = append(report.Users, reportUser)
+	}
+
+	sort.Strings(report.Users)
+
+	return report, nil
+}
+
+// getSearchMethodologyUser returns the display name and email address of the user.
+// Users which haven't been synced are named by their UUID.
+func getSearchMethodologyUser(userUUID string, users map[string]User) string {
+	if userUUID == "" {
+		return searchMethodologySystemUser
+	}
+
+	user, ok := users[userUUID]
+
+	if !ok {
+		return userUUID
+	}
+
+	if user.DisplayName == "" {
+		return user.Email
+	}
+
+	return fmt.Sprintf("%s <%s>", user.DisplayName, user.Email)
+}
+
+// describeSearchFilters returns the used filters of the JSON encoded SearchFilters (see SearchHistory) sorted by name.
+// Filters which weren't used (empty values) are omitted.
+func describeSearchFilters(encodedFilters string) ([]string, error) {
+	if encodedFilters == "" {
+		return []string{}, nil
+	}
+
+	var filters map[string]interface{}
+
+	if err := json.Unmarshal([]byte(encodedFilters), &filters); err != nil {
+		return nil, fmt.Errorf("failed to decode search filters: %s", err)
+	}
+
+	descriptions := []string{}
+
+	for name, value := range filters {
+		switch typedValue := value.(type) {
+		case nil:
+			continue
+		case bool:
+			if !typedValue {
+				continue
+			}
+		case string:
+			if typedValue == "" {
+				continue
+			}
+		case float64:
+			if typedValue == 0 {
+				continue
+			}
+		case []interface{}:
+			if len(typedValue) == 0 {
+				continue
+			}
+		case map[string]interface{}:
+			if len(typedValue) == 0 {
+				continue
+			}
+		}
+
+		encodedValue, err := json.Marshal(value)
+
+		if err != nil {
+			return nil, err
+		}
+
+		descriptions = append(descriptions, fmt.Sprintf("%s: %s", name, strings.Trim(string(encodedValue), `"`)))
+	}
+
+	sort.Strings(descriptions)
+
+	return descriptions, nil
+}
+
+// CreateSearchMethodologyReport creates the search methodology report (see GetSearchMethodologyReport) as a PDF file,
+// documenting the searches for court. The branding of the project is shown, see SetProjectReportBranding.
+// The export itself is recorded in the audit log. Returns the MinIO path to the uploaded file.
+func CreateSearchMethodologyReport(projectUUID string, userUUID string, database *pgx.Conn) (string, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionExport, database); err != nil {
+		return "", err
+	}
+
+	project, err := GetProjectByUUID(projectUUID, database)
+
+	if err != nil {
+		return "", err
+	}
+
+	branding, err := getProjectReportBranding(projectUUID, database)
+
+	if err != nil {
+		return "", err
+	}
+
+	location, err := getProjectLocation(projectUUID, database)
+
+	if err != nil {
+		return "", err
+	}
+
+	report, err := GetSearchMethodologyReport(projectUUID, userUUID, database)
+
+	if err != nil {
+		return "", err
+	}
+
+	scratchSpace, err := NewScratchSpace(projectUUID)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer scratchSpace.cleanup()
+
+	reportFileName := fmt.Sprintf("%s.pdf", NewUUID())
+	reportPath := scratchSpace.FilePath(reportFileName)
+
+	reportFile, err := os.Create(reportPath)
+
+	if err != nil {
+		return "", err
+	}
+
+	if err := writeSearchMethodologyPDF(report, project, branding, location, reportFile); err != nil {
+		if closeErr := reportFile.Close(); closeErr != nil {
+			Logger.Errorf("Failed to close file: %s", closeErr)
+		}
+
+		return "", err
+	}
+
+	if err := reportFile.Close(); err != nil {
+		return "", err
+	}
+
+	reportMinIOPath, err := UploadFile(reportFileName, reportPath, projectUUID)
+
+	if err != nil {
+		return "", err
+	}
+
+	if err := AddAuditLog(projectUUID, userUUID, AuditActionExportSearchMethodology, reportMinIOPath, database); err != nil {
+		return "", err
+	}
+
+	return reportMinIOPath, nil
+}
+
+// writeSearchMethodologyPDF writes the search methodology report as PDF.
+func writeSearchMethodologyPDF(report SearchMethodologyReport, project Project, branding ReportBranding, location *time.Location, reportFile *os.File) error {
+	document := newPDFDocument()
+
+	document.Title(fmt.Sprintf("Search methodology: %s", project.Name))
+
+	var details []string
+
+	for _, detail := range [][2]string{
+		{"Lab", branding.LabName},
+		{"Case number", branding.CaseNumber},
+		{"Examiner", branding.Examiner},
+		{"Created", formatDisplayDate(report.CreationDate, location)},
+	} {
+		if detail[1] != "" {
+			details = append(details, fmt.Sprintf("%s: %s", detail[0], detail[1]))
+		}
+	}
+
+	document.Paragraph(strings.Join(details, "\n"))
+
+	document.Heading("Summary")
+
+	summary := fmt.Sprintf("%d searches were performed and %d actions were recorded in the audit trail.", len(report.Searches), len(report.AuditTrail))
+
+	if len(report.Searches) > 0 {
+		summary += fmt.Sprintf("\nThe first search was performed on %s, the last search on %s.",
+			formatDisplayDate(report.Searches[0].CreationDate, location),
+			formatDisplayDate(report.Searches[len(report.Searches)-1].CreationDate, location),
+		)
+	}
+
+	document.Paragraph(summary)
+
+	if len(report.Users) > 0 {
+		document.Paragraph(fmt.Sprintf("Users: %s", strings.Join(report.Users, ", ")))
+	}
+
+	document.Heading("Searches")
+
+	if len(report.Searches) == 0 {
+		document.Paragraph("No searches were performed.")
+	}
+
+	// Searches are written in full instead of as table rows so no query or filter is truncated.
+	for i, search := range report.Searches {
+		query := search.Query
+
+		if query == "" {
+			query = "(all messages)"
+		}
+
+		filters := "none"
+
+		if len(search.Filters) > 0 {
+			filters = strings.Join(search.Filters, "; ")
+		}
+
+		document.Paragraph(fmt.Sprintf("#%d - %s - %s\nQuery: %s\nFilters: %s\nHits: %d",
+			i+1, formatDisplayDate(search.CreationDate, location), search.User, query, filters, search.ResultCount,
+		))
+	}
+
+	document.Heading("Audit trail")
+
+	if len(report.AuditTrail) == 0 {
+		document.Paragraph("No actions were recorded.")
+	}
+
+	for _, action := range report.AuditTrail {
+		line := fmt.Sprintf("%s - %s - %s", formatDisplayDate(action.CreationDate, location), action.User, action.Action)
+
+		if action.Details != "" {
+			line += fmt.Sprintf(": %s", action.Details)
+		}
+
+		document.Paragraph(line)
+	}
+
+	return document.Write(reportFile)
+}
+
+// runSearchMethodologyReportJob runs CreateSearchMethodologyReport.
+func runSearchMethodologyReportJob(ctx context.Context, job Job, reportProgress func(progress int), database *pgx.Conn) (string, error) {
+	return CreateSearchMethodologyReport(job.ProjectUUID, job.UserUUID, database)
+}
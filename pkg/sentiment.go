@@ -0,0 +1,336 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aquasecurity/esquery"
+	"github.com/jackc/pgx/v4"
+	"math"
+	"strings"
+	"unicode"
+)
+
+// SentimentAnalyzer scores the sentiment of messages, sentiment analysis is disabled if nil.
+//
+// Deprecated: use Core.Config.SentimentProvider or Core.Config.SentimentAPIURL.
+var SentimentAnalyzer SentimentProvider
+
+// SentimentProvider scores the sentiment and tone of texts, e.g. a local model or an external API.
+type SentimentProvider interface {
+	// GetName identifies the provider, stored with the sentiment of the messages.
+	GetName() string
+	// ScoreSentiment returns the score of each text, in the order of the texts.
+	ScoreSentiment(ctx context.Context, texts []string) ([]SentimentScore, error)
+}
+
+// SentimentScore represents the sentiment of a text.
+type SentimentScore struct {
+	Score float64 `json:"score"` // From -1 (most negative) to 1 (most positive).
+	Tone  string  `json:"tone"`  // One of the sentiment tones, e.g. SentimentToneHostile.
+}
+
+// MessageSentiment represents the sentiment of a message, see ScoreProjectSentiment.
+type MessageSentiment struct {
+	Score    float64 `json:"score"`
+	Tone     string  `json:"tone"`
+	Provider string  `json:"provider"` // See SentimentProvider.GetName.
+}
+
+// Sentiment tones, hostile and distressed communications should be prioritized.
+const (
+	SentimentToneHostile    = "hostile"
+	SentimentToneDistressed = "distressed"
+	SentimentToneNegative   = "negative"
+	SentimentToneNeutral    = "neutral"
+	SentimentTonePositive   = "positive"
+)
+
+// maxSentimentTextLength defines the maximum amount of characters of a message which are scored.
+const maxSentimentTextLength = 10000
+
+// newSentimentProvider returns the sentiment provider of the configuration, the configured provider takes precedence over the API.
+// Returns nil if sentiment analysis isn't configured.
+func newSentimentProvider(config Config) SentimentProvider {
+	if config.SentimentProvider != nil {
+		return config.SentimentProvider
+	}
+
+	if config.SentimentAPIURL != "" {
+		return NewHTTPSentimentProvider(config.SentimentAPIURL, config.SentimentAPIKey)
+	}
+
+	return nil
+}
+
+// scoreMessagesSentiment returns the sentiment of each message scored by the provider.
+func scoreMessagesSentiment(ctx context.Context, provider SentimentProvider, messages []Message) ([]MessageSentiment, error) {
+	texts := make([]string, len(messages))
+
+	for i, message := range messages {
+		texts[i] = getMessageText(message, maxSentimentTextLength)
+	}
+
+	scores, err := provider.ScoreSentiment(ctx, texts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(scores) != len(texts) {
+		return nil, fmt.Errorf("sentiment provider %s returned %d scores for %d texts", provider.GetName(), len(scores), len(texts))
+	}
+
+	sentiments := make([]MessageSentiment, len(scores))
+
+	for i, score := range scores {
+		sentiments[i] = MessageSentiment{
+			Score:    math.Max(-1, math.Min(1, score.Score)),
+			Tone:     score.Tone,
+			Provider: provider.GetName(),
+		}
+	}
+
+	return sentiments, nil
+}
+
+// ErrSentimentAnalysisDisabled is returned if messages are scored without a configured sentiment provider.
+var ErrSentimentAnalysisDisabled = errors.New("sentiment analysis is disabled, set the sentiment_api_url configuration variable")
+
+// ScoreProjectSentiment scores the sentiment of the messages of the project which aren't scored yet, or all messages if rescore is set.
+// The progress (percentage) is reported to reportProgress, which may be nil. Returns the amount of scored messages.
+func ScoreProjectSentiment(ctx context.Context, projectUUID string, rescore bool, reportProgress func(progress int), userUUID string, database *pgx.Conn) (int, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionManageProject, database); err != nil {
+		return 0, err
+	}
+
+	if SentimentAnalyzer == nil {
+		return 0, ErrSentimentAnalysisDisabled
+	}
+
+	if err := updateMessagesMapping(); err != nil {
+		return 0, err
+	}
+
+	query := esquery.Bool().Filter(esquery.Term("project_uuid", projectUUID))
+
+	if !rescore {
+		query = query.MustNot(esquery.Exists("sentiment.tone"))
+	}
+
+	total, err := countMessages(query)
+
+	if err != nil {
+		return 0, err
+	}
+
+	var scored int
+
+	err = forEachMessageBatch(query, func(messages []Message) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		sentiments, err := scoreMessagesSentiment(ctx, SentimentAnalyzer, messages)
+
+		if err != nil {
+			return err
+		}
+
+		messageUUIDs := make([]string, len(messages))
+		messageSentiments := make(map[string]interface{}, len(messages))
+
+		for i, message := range messages {
+			messageUUIDs[i] = message.UUID
+			messageSentiments[message.UUID] = sentiments[i]
+		}
+
+		err = updateMessagesByScript(
+			newMessageUUIDsQuery(messageUUIDs, projectUUID),
+			"ctx._source.sentiment = params.sentiments[ctx._source.uuid];",
+			map[string]interface{}{
+				"sentiments": messageSentiments,
+			},
+		)
+
+		if err != nil {
+			return err
+		}
+
+		scored += len(messages)
+
+		if reportProgress != nil && total > 0 {
+			reportProgress(int(math.Min(100, float64(scored)*100/float64(total))))
+		}
+
+		return nil
+	}, database)
+
+	if err != nil {
+		return scored, err
+	}
+
+	Logger.WithFields(LogFields{"project_uuid": projectUUID}).Infof("Scored the sentiment of %d messages", scored)
+
+	return scored, nil
+}
+
+// AnalyzeSentimentJobParameters represents the parameters of the JobTypeAnalyzeSentiment job.
+type AnalyzeSentimentJobParameters struct {
+	Rescore bool `json:"rescore"` // Rescore the messages which are already scored, e.g. after changing the provider.
+}
+
+// runAnalyzeSentimentJob runs ScoreProjectSentiment.
+func runAnalyzeSentimentJob(ctx context.Context, job Job, reportProgress func(progress int), database *pgx.Conn) (string, error) {
+	var parameters AnalyzeSentimentJobParameters
+
+	if err := decodeJobParameters(job, &parameters); err != nil {
+		return "", err
+	}
+
+	_, err := ScoreProjectSentiment(ctx, job.ProjectUUID, parameters.Rescore, reportProgress, job.UserUUID, database)
+
+	return "", err
+}
+
+// lexiconSentimentProvider scores the sentiment locally by counting the words of the sentiment lexicon.
+type lexiconSentimentProvider struct{}
+
+// Words of the sentiment lexicon, hostile and distressed words are negative too.
+var (
+	hostileSentimentWords = []string{
+		"kill", "hurt", "destroy", "threaten", "threat", "revenge", "punish", "regret", "idiot", "stupid", "moron", "pathetic",
+		"hate", "shut", "damn", "hell", "bastard", "crap", "screw", "warned", "consequences", "fired", "sue", "lawsuit",
+	}
+	distressedSentimentWords = []string{
+		"help", "scared", "afraid", "frightened", "desperate", "hopeless", "helpless", "panic", "terrified", "worried", "anxious",
+		"overwhelmed", "suicide", "suicidal", "crying", "unbearable", "alone", "trapped", "pressure", "stressed", "urgent", "please",
+	}
+	negativeSentimentWords = []string{
+		"bad", "wrong", "problem", "issue", "fail", "failed", "failure", "angry", "upset", "disappointed", "unacceptable", "terrible",
+		"awful", "horrible", "worst", "complaint", "concern", "concerned", "unfortunately", "sorry", "mistake", "error", "never", "refuse",
+	}
+	positiveSentimentWords = []string{
+		"good", "great", "excellent", "thanks", "thank", "appreciate", "happy", "glad", "pleased", "love", "wonderful", "perfect",
+		"congratulations", "success", "successful", "welcome", "enjoy", "nice", "awesome", "best", "agree", "helpful", "kind", "well",
+	}
+)
+
+// lexiconSentimentWords maps the words of the sentiment lexicon to their tone.
+var lexiconSentimentWords = func() map[string]string {
+	words := make(map[string]string)
+
+	for tone, toneWords := range map[string][]string{
+		SentimentToneHostile:    hostileSentimentWords,
+		SentimentToneDistressed: distressedSentimentWords,
+		SentimentToneNegative:   negativeSentimentWords,
+		SentimentTonePositive:   positiveSentimentWords,
+	} {
+		for _, word := range toneWords {
+			words[word] = tone
+		}
+	}
+
+	return words
+}()
+
+// NewLexiconSentimentProvider creates the local sentiment provider, which needs no model or external API.
+// It only detects English words and is meant to prioritize messages, use a model or an external API for accurate scores.
+func NewLexiconSentimentProvider() SentimentProvider {
+	return lexiconSentimentProvider{}
+}
+
+// GetName returns the name of the provider.
+func (provider lexiconSentimentProvider) GetName() string {
+	return "lexicon"
+}
+
+// ScoreSentiment scores each text by the words of the sentiment lexicon.
+func (provider lexiconSentimentProvider) ScoreSentiment(ctx context.Context, texts []string) ([]SentimentScore, error) {
+	scores := make([]SentimentScore, len(texts))
+
+	for i, text := range texts {
+		scores[i] = scoreLexiconSentiment(text)
+	}
+
+	return scores, nil
+}
+
+// scoreLexiconSentiment returns the score of the text: the positive minus the negative words relative to all sentiment words.
+// The tone is hostile or distressed if such words are used and the text isn't positive.
+func scoreLexiconSentiment(text string) SentimentScore {
+	toneCounts := make(map[string]int)
+
+	words := strings.FieldsFunc(strings.ToLower(text), func(character rune) bool {
+		return !unicode.IsLetter(character) && character != '\''
+	})
+
+	for _, word := range words {
+		if tone, ok := lexiconSentimentWords[word]; ok {
+			toneCounts[tone]++
+		}
+	}
+
+	positive := toneCounts[SentimentTonePositive]
+	negative := toneCounts[SentimentToneNegative] + toneCounts[SentimentToneHostile] + toneCounts[SentimentToneDistressed]
+
+	if positive+negative == 0 {
+		return SentimentScore{Tone: SentimentToneNeutral}
+	}
+
+	score := SentimentScore{
+		Score: float64(positive-negative) / float64(positive+negative),
+	}
+
+	switch {
+	case score.Score > 0.25:
+		score.Tone = SentimentTonePositive
+	case toneCounts[SentimentToneHostile] > 0 && toneCounts[SentimentToneHostile] >= toneCounts[SentimentToneDistressed]:
+		score.Tone = SentimentToneHostile
+	case toneCounts[SentimentToneDistressed] > 0:
+		score.Tone = SentimentToneDistressed
+	case score.Score < -0.25:
+		score.Tone = SentimentToneNegative
+	default:
+		score.Tone = SentimentToneNeutral
+	}
+
+	return score
+}
+
+// httpSentimentProvider scores the sentiment with an external API.
+type httpSentimentProvider struct {
+	url    string
+	apiKey string
+}
+
+// NewHTTPSentimentProvider creates the sentiment provider of the external API, the API key is sent as bearer token if set.
+// The API receives a JSON body {"texts": [...]} and must respond with {"scores": [{"score": -1 to 1, "tone": "..."}, ...]},
+// a score per text in the same order. The tone should be one of the sentiment tones (e.g. SentimentToneHostile).
+func NewHTTPSentimentProvider(url string, apiKey string) SentimentProvider {
+	return &httpSentimentProvider{
+		url:    url,
+		apiKey: apiKey,
+	}
+}
+
+// GetName returns the name of the provider.
+func (provider *httpSentimentProvider) GetName() string {
+	return "api"
+}
+
+// ScoreSentiment posts the texts to the API.
+func (provider *httpSentimentProvider) ScoreSentiment(ctx context.Context, texts []string) ([]SentimentScore, error) {
+	var scoresResponse struct {
+		Scores []SentimentScore `json:"scores"`
+	}
+
+	if err := postAnalysisRequest(ctx, provider.url, provider.apiKey, map[string]interface{}{"texts": texts}, &scoresResponse); err != nil {
+		return nil, err
+	}
+
+	return scoresResponse.Scores, nil
+}
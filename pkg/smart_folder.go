@@ -0,0 +1,206 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/jackc/pgx/v4"
+	"strings"
+	"time"
+)
+
+// SmartFolder represents a saved search shown as a folder in the tree.
+// Its messages are the messages matching the query and filters at the time it is opened.
+type SmartFolder struct {
+	UUID         string        `json:"uuid"`
+	ProjectUUID  string        `json:"project_uuid"`
+	Title        string        `json:"title"`
+	Query        string        `json:"query"`
+	Filters      SearchFilters `json:"filters"`
+	CreationDate int           `json:"creation_date"`
+}
+
+// Save saves the smart folder to the database.
+func (smartFolder *SmartFolder) Save(database *pgx.Conn) error {
+	encodedFilters, err := json.Marshal(smartFolder.Filters)
+
+	if err != nil {
+		return err
+	}
+
+	preparedStatement := `
+	INSERT INTO smart_folders(uuid, projectUUID, title, query, filters, creationDate) VALUES ($1, $2, $3, $4, $5, $6)
+	`
+	_, err = database.Exec(context.Background(), preparedStatement, smartFolder.UUID, smartFolder.ProjectUUID, smartFolder.Title, smartFolder.Query, string(encodedFilters), smartFolder.CreationDate)
+
+	return err
+}
+
+// CreateSmartFolder saves the search query and filters (e.g. a tag) as a smart folder of the project.
+func CreateSmartFolder(title string, query string, filters SearchFilters, projectUUID string, userUUID string, database *pgx.Conn) (SmartFolder, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionManageEvidence, database); err != nil {
+		return SmartFolder{}, err
+	}
+
+	if strings.TrimSpace(title) == "" {
+		return SmartFolder{}, errors.New("smart folder title is empty")
+	}
+
+	if query == "" && filters.isEmpty() {
+		return SmartFolder{}, errors.New("smart folder has no query or filters")
+	}
+
+	smartFolder := SmartFolder{
+		UUID:         NewUUID(),
+		ProjectUUID:  projectUUID,
+		Title:        title,
+		Query:        query,
+		Filters:      filters,
+		CreationDate: int(time.Now().Unix()),
+	}
+
+	if err := smartFolder.Save(database); err != nil {
+		return SmartFolder{}, err
+	}
+
+	return smartFolder, nil
+}
+
+// GetSmartFoldersByProject returns the smart folders of the project.
+func GetSmartFoldersByProject(projectUUID string, userUUID string, database *pgx.Conn) ([]SmartFolder, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return nil, err
+	}
+
+	return getSmartFoldersByProject(projectUUID, database)
+}
+
+// getSmartFoldersByProject returns the smart folders of the project.
+func getSmartFoldersByProject(projectUUID string, database *pgx.Conn) ([]SmartFolder, error) {
+	preparedStatement := `
+	SELECT uuid, projectUUID, title, query, filters, creationDate FROM smart_folders WHERE projectUUID = $1 ORDER BY title ASC
+	`
+	rows, err := database.Query(context.Background(), preparedStatement, projectUUID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var smartFolders []SmartFolder
+
+	for rows.Next() {
+		smartFolder, err := scanSmartFolder(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		smartFolders = append(smartFolders, smartFolder)
+	}
+
+	rows.Close()
+
+	return smartFolders, rows.Err()
+}
+
+// getSmartFolder returns the smart folder of the project.
+func getSmartFolder(smartFolderUUID string, projectUUID string, database *pgx.Conn) (SmartFolder, error) {
+	preparedStatement := `
+	SELECT uuid, projectUUID, title, query, filters, creationDate FROM smart_folders WHERE uuid = $1 AND projectUUID = $2
+	`
+	row := database.QueryRow(context.Background(), preparedStatement, smartFolderUUID, projectUUID)
+
+	return scanSmartFolder(row)
+}
+
+// scanSmartFolder scans the smart folder row.
+func scanSmartFolder(row pgx.Row) (SmartFolder, error) {
+	var smartFolder SmartFolder
+	var encodedFilters string
+
+	if err := row.Scan(&smartFolder.UUID, &smartFolder.ProjectUUID, &smartFolder.Title, &smartFolder.Query, &encodedFilters, &smartFolder.CreationDate); err != nil {
+		return SmartFolder{}, err
+	}
+
+	if err := json.Unmarshal([]byte(encodedFilters), &smartFolder.Filters); err != nil {
+		return SmartFolder{}, err
+	}
+
+	return smartFolder, nil
+}
+
+// DeleteSmartFolder removes the smart folder, its messages are untouched.
+func DeleteSmartFolder(smartFolderUUID string, projectUUID string, userUUID string, database *pgx.Conn) error {
+	if err := CheckPermission(userUUID, projectUUID, ActionManageEvidence, database); err != nil {
+		return err
+	}
+
+	if err := checkProjectNotOnHold(projectUUID, userUUID, AuditActionDeleteSmartFolder, database); err != nil {
+		return err
+	}
+
+	preparedStatement := `
+	DELETE FROM smart_folders WHERE uuid = $1 AND projectUUID = $2
+	`
+	_, err := database.Exec(context.Background(), preparedStatement, smartFolderUUID, projectUUID)
+
+	return err
+}
+
+// GetMessagesFromSmartFolder returns the messages currently matching the smart folder.
+func GetMessagesFromSmartFolder(smartFolderUUID string, projectUUID string, userUUID string, database *pgx.Conn) ([]Message, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return nil, err
+	}
+
+	smartFolder, err := getSmartFolder(smartFolderUUID, projectUUID, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []Message
+
+	err = forEachMessageBatch(smartFolder.Filters.apply(newSearchQuery(smartFolder.Query, projectUUID)), func(batch []Message) error {
+		messages = append(messages, batch...)
+
+		return nil
+	}, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// getSmartFolderTreeNodeDTOs returns the smart folders of the project as root tree nodes with their message counts.
+func getSmartFolderTreeNodeDTOs(projectUUID string, database *pgx.Conn) ([]TreeNodeDTO, error) {
+	smartFolders, err := getSmartFoldersByProject(projectUUID, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var treeNodeDTOs []TreeNodeDTO
+
+	for _, smartFolder := range smartFolders {
+		_, messageCount, err := runAggregationSearch(smartFolder.Filters.apply(newSearchQuery(smartFolder.Query, projectUUID)))
+
+		if err != nil {
+			return nil, err
+		}
+
+		treeNodeDTOs = append(treeNodeDTOs, TreeNodeDTO{
+			Value:         smartFolder.UUID,
+			Label:         smartFolder.Title,
+			MessageCount:  messageCount,
+			IsSmartFolder: true,
+		})
+	}
+
+	return treeNodeDTOs, nil
+}
@@ -0,0 +1,170 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// Spreadsheet formats.
+const (
+	SpreadsheetFormatCSV  = "csv"
+	SpreadsheetFormatXLSX = "xlsx"
+)
+
+// spreadsheetWriter writes rows to a spreadsheet.
+type spreadsheetWriter interface {
+	WriteRow(values []string) error
+	Close() error
+}
+
+// newSpreadsheetWriter returns a spreadsheet writer for the format.
+func newSpreadsheetWriter(format string, writer io.Writer) (spreadsheetWriter, error) {
+	switch format {
+	case SpreadsheetFormatCSV:
+		return &csvSpreadsheetWriter{csvWriter: csv.NewWriter(writer)}, nil
+	case SpreadsheetFormatXLSX:
+		return newXLSXSpreadsheetWriter(writer)
+	default:
+		return nil, fmt.Errorf("unsupported spreadsheet format: %s", format)
+	}
+}
+
+// csvSpreadsheetWriter writes rows as CSV.
+type csvSpreadsheetWriter struct {
+	csvWriter *csv.Writer
+}
+
+// WriteRow writes the row.
+func (writer *csvSpreadsheetWriter) WriteRow(values []string) error {
+	return writer.csvWriter.Write(values)
+}
+
+// Close flushes the CSV.
+func (writer *csvSpreadsheetWriter) Close() error {
+	writer.csvWriter.Flush()
+
+	return writer.csvWriter.Error()
+}
+
+// Limits of the XLSX format.
+const (
+	xlsxMaximumRows       = 1048576
+	xlsxMaximumCellLength = 32767
+)
+
+// xlsxStaticParts defines the parts of the XLSX (ZIP) file which don't depend on the rows.
+var xlsxStaticParts = []struct {
+	Name    string
+	Content string
+}{
+	{
+		Name:    "[Content_Types].xml",
+		Content: `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/></Types>`,
+	},
+	{
+		Name:    "_rels/.rels",
+		Content: `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`,
+	},
+	{
+		Name:    "xl/workbook.xml",
+		Content: `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="Sheet1" sheetId="1" r:id="rId1"/></sheets></workbook>`,
+	},
+	{
+		Name:    "xl/_rels/workbook.xml.rels",
+		Content: `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`,
+	},
+}
+
+// xlsxSpreadsheetWriter writes rows as a single sheet XLSX file.
+// Rows are streamed to the sheet so memory usage doesn't depend on the amount of rows.
+type xlsxSpreadsheetWriter struct {
+	zipWriter   *zip.Writer
+	sheetWriter io.Writer
+	rows        int
+}
+
+// newXLSXSpreadsheetWriter writes the static parts and the start of the sheet.
+func newXLSXSpreadsheetWriter(writer io.Writer) (*xlsxSpreadsheetWriter, error) {
+	zipWriter := zip.NewWriter(writer)
+
+	for _, part := range xlsxStaticParts {
+		partWriter, err := zipWriter.Create(part.Name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := io.WriteString(partWriter, xml.Header+part.Content); err != nil {
+			return nil, err
+		}
+	}
+
+	// The sheet must be the last part since ZIP entries are written sequentially.
+	sheetWriter, err := zipWriter.Create("xl/worksheets/sheet1.xml")
+
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := io.WriteString(sheetWriter, xml.Header+`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`); err != nil {
+		return nil, err
+	}
+
+	return &xlsxSpreadsheetWriter{
+		zipWriter:   zipWriter,
+		sheetWriter: sheetWriter,
+	}, nil
+}
+
+// WriteRow writes the row as inline strings.
+// Values longer than the XLSX cell limit are truncated.
+func (writer *xlsxSpreadsheetWriter) WriteRow(values []string) error {
+	if writer.rows >= xlsxMaximumRows {
+		return errors.New("too many rows for XLSX, use CSV instead")
+	}
+
+	writer.rows++
+
+	var rowBuilder strings.Builder
+
+	rowBuilder.WriteString(fmt.Sprintf(`<row r="%d">`, writer.rows))
+
+	for _, value := range values {
+		if utf8.RuneCountInString(value) > xlsxMaximumCellLength {
+			value = string([]rune(value)[:xlsxMaximumCellLength])
+		}
+
+		rowBuilder.WriteString(`<c t="inlineStr"><is><t xml:space="preserve">`)
+
+		// EscapeText also replaces characters which are invalid in XML.
+		if err := xml.EscapeText(&rowBuilder, []byte(value)); err != nil {
+			return err
+		}
+
+		rowBuilder.WriteString(`</t></is></c>`)
+	}
+
+	rowBuilder.WriteString(`</row>`)
+
+	_, err := io.WriteString(writer.sheetWriter, rowBuilder.String())
+
+	return err
+}
+
+// Close writes the end of the sheet and closes the XLSX file.
+func (writer *xlsxSpreadsheetWriter) Close() error {
+	if _, err := io.WriteString(writer.sheetWriter, `</sheetData></worksheet>`); err != nil {
+		return err
+	}
+
+	return writer.zipWriter.Close()
+}
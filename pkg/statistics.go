@@ -0,0 +1,287 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"github.com/aquasecurity/esquery"
+	"github.com/jackc/pgx/v4"
+)
+
+// TagCount represents the amount of messages with a tag.
+type TagCount struct {
+	Tag   Tag `json:"tag"`
+	Count int `json:"count"`
+}
+
+// ReviewStats represents the review statistics of a set of messages.
+type ReviewStats struct {
+	TotalMessages      int            `json:"total_messages"`
+	Bookmarked         int            `json:"bookmarked"`
+	Reviewed           int            `json:"reviewed"`
+	Unreviewed         int            `json:"unreviewed"`
+	ReviewStatusCounts map[string]int `json:"review_status_counts"`
+	TagCounts          []TagCount     `json:"tag_counts"`
+}
+
+// ProjectReviewStats represents the review statistics of a project including a breakdown per custodian (evidence).
+type ProjectReviewStats struct {
+	ReviewStats
+	Custodians map[string]ReviewStats `json:"custodians"`
+}
+
+// GetProjectReviewStats returns the tag, bookmark and review statistics of the project.
+// Custodians are keyed by evidence UUID.
+func GetProjectReviewStats(projectUUID string, userUUID string, database *pgx.Conn) (ProjectReviewStats, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return ProjectReviewStats{}, err
+	}
+
+	tags, err := GetTagsByProject(projectUUID, userUUID, database)
+
+	if err != nil {
+		return ProjectReviewStats{}, err
+	}
+
+	aggregations, totalMessages, err := runAggregationSearch(
+		esquery.Bool().Must(esquery.Term("project_uuid", projectUUID)),
+		append(newReviewStatsAggregations(), esquery.TermsAgg("custodians", "evidence_uuid").Size(1000).Aggs(newReviewStatsAggregations()...))...,
+	)
+
+	if err != nil {
+		return ProjectReviewStats{}, err
+	}
+
+	reviewStats, err := parseReviewStats(aggregations, totalMessages, tags)
+
+	if err != nil {
+		return ProjectReviewStats{}, err
+	}
+
+	projectReviewStats := ProjectReviewStats{
+		ReviewStats: reviewStats,
+		Custodians:  map[string]ReviewStats{},
+	}
+
+	custodianBuckets, err := aggregations.Buckets("custodians")
+
+	if err != nil {
+		return ProjectReviewStats{}, err
+	}
+
+	for _, custodianBucket := range custodianBuckets {
+		custodianReviewStats, err := parseReviewStats(custodianBucket.Aggregations, custodianBucket.DocCount, tags)
+
+		if err != nil {
+			return ProjectReviewStats{}, err
+		}
+
+		projectReviewStats.Custodians[custodianBucket.KeyString()] = custodianReviewStats
+	}
+
+	return projectReviewStats, nil
+}
+
+// newReviewStatsAggregations returns the aggregations used by parseReviewStats.
+func newReviewStatsAggregations() []esquery.Aggregation {
+	return []esquery.Aggregation{
+		esquery.FilterAgg("bookmarked", esquery.Term("is_bookmarked", true)),
+		esquery.TermsAgg("review_statuses", "review_status").Size(uint64(len(ReviewStatuses))),
+		esquery.TermsAgg("tags", "tag_uuids").Size(1000),
+	}
+}
+
+// parseReviewStats returns the review statistics from the aggregations.
+func parseReviewStats(aggregations aggregationResult, totalMessages int, tags []Tag) (ReviewStats, error) {
+	reviewStats := ReviewStats{
+		TotalMessages:      totalMessages,
+		ReviewStatusCounts: map[string]int{},
+	}
+
+	bookmarkedBucket, err := aggregations.Bucket("bookmarked")
+
+	if err != nil {
+		return ReviewStats{}, err
+	}
+
+	reviewStats.Bookmarked = bookmarkedBucket.DocCount
+
+	reviewStatusBuckets, err := aggregations.Buckets("review_statuses")
+
+	if err != nil {
+		return ReviewStats{}, err
+	}
+
+	for _, reviewStatusBucket := range reviewStatusBuckets {
+		reviewStats.ReviewStatusCounts[reviewStatusBucket.KeyString()] = reviewStatusBucket.DocCount
+
+		if reviewStatusBucket.KeyString() != ReviewStatusUnreviewed {
+			reviewStats.Reviewed += reviewStatusBucket.DocCount
+		}
+	}
+
+	// Messages without a review status are unreviewed as well.
+	reviewStats.Unreviewed = totalMessages - reviewStats.Reviewed
+	reviewStats.ReviewStatusCounts[ReviewStatusUnreviewed] = reviewStats.Unreviewed
+
+	tagBuckets, err := aggregations.Buckets("tags")
+
+	if err != nil {
+		return ReviewStats{}, err
+	}
+
+	for _, tagBucket := range tagBuckets {
+		for _, tag := range tags {
+			if tag.UUID == tagBucket.KeyString() {
+				reviewStats.TagCounts = append(reviewStats.TagCounts, TagCount{
+					Tag:   tag,
+					Count: tagBucket.DocCount,
+				})
+				break
+			}
+		}
+	}
+
+	return reviewStats, nil
+}
+
+// TermCount represents the amount of messages with a term (address, domain, month, etc.).
+type TermCount struct {
+	Term  string `json:"term"`
+	Count int    `json:"count"`
+}
+
+// ProjectStatistics represents the overview statistics of a project.
+type ProjectStatistics struct {
+	TotalMessages     int         `json:"total_messages"`
+	TotalAttachments  int         `json:"total_attachments"`
+	TotalEvidenceSize int64       `json:"total_evidence_size"`
+	FirstMessageDate  int         `json:"first_message_date"`
+	LastMessageDate   int         `json:"last_message_date"`
+	TopSenders        []TermCount `json:"top_senders"`
+	TopRecipients     []TermCount `json:"top_recipients"`
+	TopDomains        []TermCount `json:"top_domains"`
+	MessagesPerMonth  []TermCount `json:"messages_per_month"`
+}
+
+// projectStatisticsTopSize defines the amount of top senders, recipients and domains.
+const projectStatisticsTopSize = 10
+
+// GetProjectStatistics returns the overview statistics of the project.
+func GetProjectStatistics(projectUUID string, userUUID string, database *pgx.Conn) (ProjectStatistics, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return ProjectStatistics{}, err
+	}
+
+	totalEvidenceSize, err := GetProjectEvidenceSize(projectUUID, database)
+
+	if err != nil {
+		return ProjectStatistics{}, err
+	}
+
+	aggregations, totalMessages, err := runAggregationSearch(
+		esquery.Bool().Must(esquery.Term("project_uuid", projectUUID)),
+		esquery.ValueCount("total_attachments", "attachments.uuid"),
+		// Messages without a received date are stored as zero.
+		esquery.FilterAgg("dated", esquery.Range("received").Gt(0)).Aggs(
+			esquery.Min("first_message_date", "received"),
+			esquery.Max("last_message_date", "received"),
+			esquery.CustomAgg("messages_per_month", map[string]interface{}{
+				"date_histogram": map[string]interface{}{
+					"field":             "received",
+					"calendar_interval": "month",
+					"format":            "yyyy-MM",
+				},
+			}),
+		),
+		// Drafts weren't sent.
+		esquery.FilterAgg("not_drafts", esquery.Bool().MustNot(esquery.Term("mailbox_direction", MessageMailboxDirectionDraft))).Aggs(
+			esquery.TermsAgg("top_senders", "from_addresses").Size(projectStatisticsTopSize),
+		),
+		esquery.TermsAgg("top_recipients", "recipient_addresses").Size(projectStatisticsTopSize),
+		esquery.TermsAgg("top_domains", "domains").Size(projectStatisticsTopSize),
+	)
+
+	if err != nil {
+		return ProjectStatistics{}, err
+	}
+
+	projectStatistics := ProjectStatistics{
+		TotalMessages:     totalMessages,
+		TotalEvidenceSize: totalEvidenceSize,
+	}
+
+	totalAttachments, err := aggregations.Value("total_attachments")
+
+	if err != nil {
+		return ProjectStatistics{}, err
+	}
+
+	projectStatistics.TotalAttachments = int(totalAttachments)
+
+	datedBucket, err := aggregations.Bucket("dated")
+
+	if err != nil {
+		return ProjectStatistics{}, err
+	}
+
+	// Date aggregations return milliseconds.
+	firstMessageDate, err := datedBucket.Aggregations.Value("first_message_date")
+
+	if err != nil {
+		return ProjectStatistics{}, err
+	}
+
+	lastMessageDate, err := datedBucket.Aggregations.Value("last_message_date")
+
+	if err != nil {
+		return ProjectStatistics{}, err
+	}
+
+	projectStatistics.FirstMessageDate = int(firstMessageDate / 1000)
+	projectStatistics.LastMessageDate = int(lastMessageDate / 1000)
+
+	if projectStatistics.MessagesPerMonth, err = getTermCounts(datedBucket.Aggregations, "messages_per_month"); err != nil {
+		return ProjectStatistics{}, err
+	}
+
+	notDraftsBucket, err := aggregations.Bucket("not_drafts")
+
+	if err != nil {
+		return ProjectStatistics{}, err
+	}
+
+	if projectStatistics.TopSenders, err = getTermCounts(notDraftsBucket.Aggregations, "top_senders"); err != nil {
+		return ProjectStatistics{}, err
+	}
+
+	if projectStatistics.TopRecipients, err = getTermCounts(aggregations, "top_recipients"); err != nil {
+		return ProjectStatistics{}, err
+	}
+
+	if projectStatistics.TopDomains, err = getTermCounts(aggregations, "top_domains"); err != nil {
+		return ProjectStatistics{}, err
+	}
+
+	return projectStatistics, nil
+}
+
+// getTermCounts returns the term counts from the buckets of the aggregation.
+func getTermCounts(aggregations aggregationResult, name string) ([]TermCount, error) {
+	buckets, err := aggregations.Buckets(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	termCounts := make([]TermCount, 0, len(buckets))
+
+	for _, bucket := range buckets {
+		termCounts = append(termCounts, TermCount{
+			Term:  bucket.KeyString(),
+			Count: bucket.DocCount,
+		})
+	}
+
+	return termCounts, nil
+}
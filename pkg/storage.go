@@ -0,0 +1,262 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"fmt"
+	"github.com/aquasecurity/esquery"
+	"github.com/jackc/pgx/v4"
+	"github.com/minio/minio-go/v7"
+	"strings"
+)
+
+// StorageUsage represents the MinIO storage used in bytes.
+type StorageUsage struct {
+	Evidence    int64 `json:"evidence"` // The uploaded evidence files.
+	Attachments int64 `json:"attachments"`
+	Bodies      int64 `json:"bodies"`    // Offloaded message bodies, see GetMessageBody.
+	Originals   int64 `json:"originals"` // Preserved original messages, see GetOriginalMessage.
+	Exports     int64 `json:"exports"`   // Job results such as exports and reports.
+	Total       int64 `json:"total"`
+}
+
+// addTotal sets the total of the storage usage.
+func (usage *StorageUsage) addTotal() {
+	usage.Total = usage.Evidence + usage.Attachments + usage.Bodies + usage.Originals + usage.Exports
+}
+
+// EvidenceStorageUsage represents the storage used by the evidence and its messages.
+type EvidenceStorageUsage struct {
+	EvidenceUUID string       `json:"evidence_uuid"`
+	FileName     string       `json:"file_name"`
+	Usage        StorageUsage `json:"usage"`
+}
+
+// FolderStorageUsage represents the storage used by the messages of the folder (without its sub-folders).
+type FolderStorageUsage struct {
+	FolderUUID string       `json:"folder_uuid"`
+	Title      string       `json:"title"`
+	Usage      StorageUsage `json:"usage"`
+}
+
+// GetProjectStorageUsage returns the storage used by the project, measured by listing its MinIO objects.
+func GetProjectStorageUsage(projectUUID string, userUUID string, database *pgx.Conn) (StorageUsage, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionManageProject, database); err != nil {
+		return StorageUsage{}, err
+	}
+
+	return getProjectStorageUsage(projectUUID, database)
+}
+
+// getProjectStorageUsage returns the storage used by the project without checking permissions.
+func getProjectStorageUsage(projectUUID string, database *pgx.Conn) (StorageUsage, error) {
+	var usage StorageUsage
+
+	// Evidence objects aren't stored in the project prefix.
+	evidenceSize, err := GetProjectEvidenceSize(projectUUID, database)
+
+	if err != nil {
+		return StorageUsage{}, err
+	}
+
+	usage.Evidence = evidenceSize
+
+	jobResults, err := getProjectJobResults(projectUUID, database)
+
+	if err != nil {
+		return StorageUsage{}, err
+	}
+
+	projectPrefix := fmt.Sprintf("%s/", projectUUID)
+
+	bucketName, err := getProjectBucket(projectUUID, database)
+
+	if err != nil {
+		return StorageUsage{}, err
+	}
+
+	for object := range MinIOClient.ListObjects(context.Background(), bucketName, minio.ListObjectsOptions{Prefix: projectPrefix, Recursive: true}) {
+		if object.Err != nil {
+			return StorageUsage{}, object.Err
+		}
+
+		objectName := strings.TrimPrefix(object.Key, projectPrefix)
+
+		if jobResults[object.Key] || jobResults[getFirstArchiveVolume(object.Key)] {
+			usage.Exports += object.Size
+		} else if strings.HasPrefix(objectName, "bodies/") {
+			usage.Bodies += object.Size
+		} else if strings.HasPrefix(objectName, "originals/") {
+			usage.Originals += object.Size
+		} else {
+			usage.Attachments += object.Size
+		}
+	}
+
+	usage.addTotal()
+
+	return usage, nil
+}
+
+// getProjectJobResults returns the MinIO paths of the job results of the project.
+func getProjectJobResults(projectUUID string, database *pgx.Conn) (map[string]bool, error) {
+	preparedStatement := `
+	SELECT result FROM jobs WHERE projectUUID = $1 AND result != ''
+	`
+	rows, err := database.Query(context.Background(), preparedStatement, projectUUID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	jobResults := make(map[string]bool)
+
+	for rows.Next() {
+		var result string
+
+		if err := rows.Scan(&result); err != nil {
+			return nil, err
+		}
+
+		jobResults[result] = true
+	}
+
+	rows.Close()
+
+	return jobResults, rows.Err()
+}
+
+// GetEvidenceStorageUsage returns the storage used per evidence of the project.
+// The attachments and originals are summed from the indexed message sizes,
+// offloaded bodies and exports are only reported per project, see GetProjectStorageUsage.
+func GetEvidenceStorageUsage(projectUUID string, userUUID string, database *pgx.Conn) ([]EvidenceStorageUsage, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionManageProject, database); err != nil {
+		return nil, err
+	}
+
+	evidences, err := GetEvidenceByProject(projectUUID, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	messageUsages, err := getMessageStorageUsage(esquery.Bool().Filter(esquery.Term("project_uuid", projectUUID)), "evidence_uuid")
+
+	if err != nil {
+		return nil, err
+	}
+
+	var evidenceUsages []EvidenceStorageUsage
+
+	for _, evidence := range evidences {
+		usage := messageUsages[evidence.UUID]
+		usage.Evidence = evidence.FileSize
+		usage.addTotal()
+
+		evidenceUsages = append(evidenceUsages, EvidenceStorageUsage{
+			EvidenceUUID: evidence.UUID,
+			FileName:     evidence.FileName,
+			Usage:        usage,
+		})
+	}
+
+	return evidenceUsages, nil
+}
+
+// GetFolderStorageUsage returns the storage used per folder of the evidence, see GetEvidenceStorageUsage.
+func GetFolderStorageUsage(evidenceUUID string, projectUUID string, userUUID string, database *pgx.Conn) ([]FolderStorageUsage, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionManageProject, database); err != nil {
+		return nil, err
+	}
+
+	messageUsages, err := getMessageStorageUsage(esquery.Bool().Filter(
+		esquery.Term("project_uuid", projectUUID),
+		esquery.Term("evidence_uuid", evidenceUUID),
+	), "folder_uuid")
+
+	if err != nil {
+		return nil, err
+	}
+
+	preparedStatement := `
+	SELECT folderUUID, title FROM tree_nodes WHERE projectUUID = $1 AND evidenceUUID = $2 ORDER BY title
+	`
+	rows, err := database.Query(context.Background(), preparedStatement, projectUUID, evidenceUUID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var folderUsages []FolderStorageUsage
+
+	for rows.Next() {
+		var folderUsage FolderStorageUsage
+
+		if err := rows.Scan(&folderUsage.FolderUUID, &folderUsage.Title); err != nil {
+			return nil, err
+		}
+
+		folderUsage.Usage = messageUsages[folderUsage.FolderUUID]
+		folderUsage.Usage.addTotal()
+
+		folderUsages = append(folderUsages, folderUsage)
+	}
+
+	rows.Close()
+
+	return folderUsages, rows.Err()
+}
+
+// getMessageStorageUsage returns the attachment and original message sizes of the messages matching the query, grouped by the field.
+func getMessageStorageUsage(query esquery.Mappable, field string) (map[string]StorageUsage, error) {
+	aggregations, _, err := runAggregationSearch(
+		query,
+		esquery.TermsAgg("usage", field).Size(treeNodeMessageCountsSize).Aggs(
+			esquery.Sum("attachments", "attachments_size"),
+			esquery.FilterAgg("originals", esquery.Exists("original_hash")).Aggs(
+				esquery.Sum("size", "size"),
+			),
+		),
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	buckets, err := aggregations.Buckets("usage")
+
+	if err != nil {
+		return nil, err
+	}
+
+	usages := make(map[string]StorageUsage, len(buckets))
+
+	for _, bucket := range buckets {
+		attachmentsSize, err := bucket.Aggregations.Value("attachments")
+
+		if err != nil {
+			return nil, err
+		}
+
+		originalsBucket, err := bucket.Aggregations.Bucket("originals")
+
+		if err != nil {
+			return nil, err
+		}
+
+		originalsSize, err := originalsBucket.Aggregations.Value("size")
+
+		if err != nil {
+			return nil, err
+		}
+
+		usages[bucket.KeyString()] = StorageUsage{
+			Attachments: int64(attachmentsSize),
+			Originals:   int64(originalsSize),
+		}
+	}
+
+	return usages, nil
+}
@@ -0,0 +1,311 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"errors"
+	"github.com/aquasecurity/esquery"
+	"github.com/jackc/pgx/v4"
+)
+
+// Tag represents a tag definition of a project.
+// Messages can have multiple tags, see TagMessage.
+type Tag struct {
+	UUID        string `json:"uuid"`
+	ProjectUUID string `json:"project_uuid"`
+	Name        string `json:"name"`
+	Color       string `json:"color"`
+	Description string `json:"description"`
+}
+
+// Save saves the tag to the database.
+func (tag *Tag) Save(database *pgx.Conn) error {
+	preparedStatement := `
+	INSERT INTO tags(uuid, projectUUID, name, color, description) VALUES ($1, $2, $3, $4, $5)
+	ON CONFLICT(uuid) DO UPDATE SET name = $3, color = $4, description = $5
+	`
+	_, err := database.Exec(context.Background(), preparedStatement, tag.UUID, tag.ProjectUUID, tag.Name, tag.Color, tag.Description)
+
+	return err
+}
+
+// CreateTag creates a new tag definition in the project.
+func CreateTag(name string, color string, description string, projectUUID string, userUUID string, database *pgx.Conn) (Tag, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionReview, database); err != nil {
+		return Tag{}, err
+	}
+
+	if name == "" {
+		return Tag{}, errors.New("tag name is empty")
+	}
+
+	tag := Tag{
+		UUID:        NewUUID(),
+		ProjectUUID: projectUUID,
+		Name:        name,
+		Color:       color,
+		Description: description,
+	}
+
+	if err := tag.Save(database); err != nil {
+		return Tag{}, err
+	}
+
+	return tag, nil
+}
+
+// UpdateTag updates the name, color and description of the tag.
+func UpdateTag(tag Tag, userUUID string, database *pgx.Conn) error {
+	if err := CheckPermission(userUUID, tag.ProjectUUID, ActionReview, database); err != nil {
+		return err
+	}
+
+	if _, err := GetTagByUUID(tag.UUID, tag.ProjectUUID, database); err != nil {
+		return err
+	}
+
+	return tag.Save(database)
+}
+
+// DeleteTag removes the tag definition and untags all messages with this tag.
+// Requires ActionManageProject since it changes the messages of all reviewers.
+func DeleteTag(tagUUID string, projectUUID string, userUUID string, database *pgx.Conn) error {
+	if err := CheckPermission(userUUID, projectUUID, ActionManageProject, database); err != nil {
+		return err
+	}
+
+	if err := checkProjectNotOnHold(projectUUID, userUUID, AuditActionDeleteTag, database); err != nil {
+		return err
+	}
+
+	preparedStatements := []string{
+		"DELETE FROM message_tags WHERE tagUUID = $1 AND projectUUID = $2",
+		"DELETE FROM tags WHERE uuid = $1 AND projectUUID = $2",
+	}
+
+	for _, preparedStatement := range preparedStatements {
+		if _, err := database.Exec(context.Background(), preparedStatement, tagUUID, projectUUID); err != nil {
+			return err
+		}
+	}
+
+	taggedMessagesQuery := esquery.
+		Bool().
+		Must(esquery.Term("project_uuid", projectUUID)).
+		Must(esquery.Term("tag_uuids", tagUUID))
+
+	return removeMessageFieldValue(taggedMessagesQuery, "tag_uuids", tagUUID)
+}
+
+// GetTagByUUID returns the tag with the specified UUID.
+func GetTagByUUID(tagUUID string, projectUUID string, database *pgx.Conn) (Tag, error) {
+	preparedStatement := `
+	SELECT uuid, projectUUID, name, color, description FROM tags WHERE uuid = $1 AND projectUUID = $2
+	`
+	row := database.QueryRow(context.Background(), preparedStatement, tagUUID, projectUUID)
+
+	var tag Tag
+
+	if err := row.Scan(&tag.UUID, &tag.ProjectUUID, &tag.Name, &tag.Color, &tag.Description); err != nil {
+		return Tag{}, err
+	}
+
+	return tag, nil
+}
+
+// GetTagsByProject returns all tag definitions of the project.
+func GetTagsByProject(projectUUID string, userUUID string, database *pgx.Conn) ([]Tag, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return nil, err
+	}
+
+	preparedStatement := `
+	SELECT uuid, projectUUID, name, color, description FROM tags WHERE projectUUID = $1 ORDER BY name
+	`
+
+	return queryTags(preparedStatement, database, projectUUID)
+}
+
+// GetMessageTags returns the tags of the message.
+func GetMessageTags(messageUUID string, projectUUID string, database *pgx.Conn) ([]Tag, error) {
+	preparedStatement := `
+	SELECT t.uuid, t.projectUUID, t.name, t.color, t.description FROM message_tags mt
+	INNER JOIN tags t ON t.uuid = mt.tagUUID
+	WHERE mt.messageUUID = $1 AND mt.projectUUID = $2
+	ORDER BY t.name
+	`
+
+	return queryTags(preparedStatement, database, messageUUID, projectUUID)
+}
+
+// getMessageTagsForUUIDs returns the tags of the messages in the project, keyed by message UUID.
+func getMessageTagsForUUIDs(messageUUIDs []string, projectUUID string, database *pgx.Conn) (map[string][]Tag, error) {
+	preparedStatement := `
+	SELECT mt.messageUUID, t.uuid, t.projectUUID, t.name, t.color, t.description FROM message_tags mt
+	INNER JOIN tags t ON t.uuid = mt.tagUUID
+	WHERE mt.messageUUID = ANY($1) AND mt.projectUUID = $2
+	ORDER BY t.name
+	`
+	rows, err := database.Query(context.Background(), preparedStatement, messageUUIDs, projectUUID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	messageTags := map[string][]Tag{}
+
+	for rows.Next() {
+		var messageUUID string
+		var tag Tag
+
+		if err := rows.Scan(&messageUUID, &tag.UUID, &tag.ProjectUUID, &tag.Name, &tag.Color, &tag.Description); err != nil {
+			return nil, err
+		}
+
+		messageTags[messageUUID] = append(messageTags[messageUUID], tag)
+	}
+
+	rows.Close()
+
+	return messageTags, rows.Err()
+}
+
+// queryTags returns the tags from the query.
+func queryTags(preparedStatement string, database *pgx.Conn, arguments ...interface{}) ([]Tag, error) {
+	rows, err := database.Query(context.Background(), preparedStatement, arguments...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var tags []Tag
+
+	for rows.Next() {
+		var tag Tag
+
+		if err := rows.Scan(&tag.UUID, &tag.ProjectUUID, &tag.Name, &tag.Color, &tag.Description); err != nil {
+			return nil, err
+		}
+
+		tags = append(tags, tag)
+	}
+
+	rows.Close()
+
+	return tags, rows.Err()
+}
+
+// TagMessage adds the tag to the message.
+func TagMessage(tagUUID string, messageUUID string, projectUUID string, userUUID string, database *pgx.Conn) error {
+	if err := CheckPermission(userUUID, projectUUID, ActionReview, database); err != nil {
+		return err
+	}
+
+	if _, err := GetTagByUUID(tagUUID, projectUUID, database); err != nil {
+		return err
+	}
+
+	preparedStatement := `
+	INSERT INTO message_tags(messageUUID, tagUUID, projectUUID) VALUES ($1, $2, $3)
+	ON CONFLICT(messageUUID, tagUUID) DO NOTHING
+	`
+	if _, err := database.Exec(context.Background(), preparedStatement, messageUUID, tagUUID, projectUUID); err != nil {
+		return err
+	}
+
+	return addMessageFieldValue(newMessageUUIDsQuery([]string{messageUUID}, projectUUID), "tag_uuids", tagUUID)
+}
+
+// UntagMessage removes the tag from the message.
+func UntagMessage(tagUUID string, messageUUID string, projectUUID string, userUUID string, database *pgx.Conn) error {
+	if err := CheckPermission(userUUID, projectUUID, ActionReview, database); err != nil {
+		return err
+	}
+
+	preparedStatement := `
+	DELETE FROM message_tags WHERE messageUUID = $1 AND tagUUID = $2 AND projectUUID = $3
+	`
+	if _, err := database.Exec(context.Background(), preparedStatement, messageUUID, tagUUID, projectUUID); err != nil {
+		return err
+	}
+
+	return removeMessageFieldValue(newMessageUUIDsQuery([]string{messageUUID}, projectUUID), "tag_uuids", tagUUID)
+}
+
+// GetMessagesByTag returns all messages with the specified tag.
+func GetMessagesByTag(tagUUID string, projectUUID string, userUUID string, database *pgx.Conn) ([]Message, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return nil, err
+	}
+
+	preparedStatement := `
+	SELECT messageUUID FROM message_tags WHERE tagUUID = $1 AND projectUUID = $2
+	`
+	rows, err := database.Query(context.Background(), preparedStatement, tagUUID, projectUUID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var messageUUIDs []string
+
+	for rows.Next() {
+		var messageUUID string
+
+		if err := rows.Scan(&messageUUID); err != nil {
+			return nil, err
+		}
+
+		messageUUIDs = append(messageUUIDs, messageUUID)
+	}
+
+	rows.Close()
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return getMessagesByUUIDs(messageUUIDs, projectUUID, database)
+}
+
+// TagMessagesByQuery adds the tag to all messages matching the search query, like GetMessagesFromQuery bulk mail is excluded.
+// Returns the amount of tagged messages.
+func TagMessagesByQuery(query string, tagUUID string, projectUUID string, userUUID string, database *pgx.Conn) (int, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionReview, database); err != nil {
+		return 0, err
+	}
+
+	if _, err := GetTagByUUID(tagUUID, projectUUID, database); err != nil {
+		return 0, err
+	}
+
+	preparedStatement := `
+	INSERT INTO message_tags(messageUUID, tagUUID, projectUUID) VALUES ($1, $2, $3)
+	ON CONFLICT(messageUUID, tagUUID) DO NOTHING
+	`
+	taggedMessages := 0
+
+	err := forEachMessageUUIDBatch(SearchFilters{}.apply(newSearchQuery(query, projectUUID)), func(messageUUIDs []string) error {
+		batch := &pgx.Batch{}
+
+		for _, messageUUID := range messageUUIDs {
+			batch.Queue(preparedStatement, messageUUID, tagUUID, projectUUID)
+		}
+
+		if err := database.SendBatch(context.Background(), batch).Close(); err != nil {
+			return err
+		}
+
+		if err := addMessageFieldValue(newMessageUUIDsQuery(messageUUIDs, projectUUID), "tag_uuids", tagUUID); err != nil {
+			return err
+		}
+
+		taggedMessages += len(messageUUIDs)
+
+		return nil
+	})
+
+	return taggedMessages, err
+}
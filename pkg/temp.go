@@ -0,0 +1,236 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TempDirectory defines the directory of the temporary files of all projects, empty for the project directories.
+//
+// Deprecated: use Core.Config.TempDirectory.
+var TempDirectory string
+
+// TempQuota defines the maximum size in bytes of the temporary files of all projects, zero for no limit.
+//
+// Deprecated: use Core.Config.TempQuota.
+var TempQuota int64
+
+// ErrTempQuotaExceeded is returned when the temporary files exceed the configured quota.
+var ErrTempQuotaExceeded = errors.New("temp quota exceeded")
+
+// tempOrphanAge defines the age after which temporary files which don't belong to a running job are removed by SweepTempDirectories.
+const tempOrphanAge = 24 * time.Hour
+
+// jobScratchSpacePrefix defines the prefix of the job scratch space directories, followed by the job UUID.
+const jobScratchSpacePrefix = "job-"
+
+// ScratchSpace represents a temporary directory which is removed when the work using it is done.
+type ScratchSpace struct {
+	Path string
+}
+
+// NewScratchSpace creates a scratch space in the temp directory of the project.
+// The caller must call Remove when done, left-over scratch spaces are removed by SweepTempDirectories.
+// Returns ErrTempQuotaExceeded if the temporary files exceed the quota.
+func NewScratchSpace(projectUUID string) (*ScratchSpace, error) {
+	return newScratchSpace(projectUUID, NewUUID())
+}
+
+// newScratchSpace creates the named scratch space in the temp directory of the project.
+func newScratchSpace(projectUUID string, name string) (*ScratchSpace, error) {
+	if err := checkTempQuota(); err != nil {
+		return nil, err
+	}
+
+	scratchSpace := &ScratchSpace{
+		Path: filepath.Join(GetProjectTempDirectory(projectUUID), name),
+	}
+
+	if err := os.MkdirAll(scratchSpace.Path, 0755); err != nil {
+		return nil, err
+	}
+
+	return scratchSpace, nil
+}
+
+// FilePath returns the path of the file in the scratch space.
+func (scratchSpace *ScratchSpace) FilePath(name string) string {
+	return filepath.Join(scratchSpace.Path, name)
+}
+
+// Remove removes the scratch space and all files in it.
+func (scratchSpace *ScratchSpace) Remove() error {
+	return os.RemoveAll(scratchSpace.Path)
+}
+
+// cleanup removes the scratch space and logs failures, used in defer statements.
+func (scratchSpace *ScratchSpace) cleanup() {
+	if err := scratchSpace.Remove(); err != nil {
+		Logger.Errorf("Failed to remove scratch space: %s", err)
+	}
+}
+
+// getJobScratchSpace returns the scratch space of the job, which is removed by the job worker when the job finishes.
+func getJobScratchSpace(job Job) (*ScratchSpace, error) {
+	return newScratchSpace(job.ProjectUUID, jobScratchSpacePrefix+job.UUID)
+}
+
+// removeJobScratchSpace removes the scratch space of the job, if any.
+func removeJobScratchSpace(job Job) error {
+	return os.RemoveAll(filepath.Join(GetProjectTempDirectory(job.ProjectUUID), jobScratchSpacePrefix+job.UUID))
+}
+
+// checkTempQuota returns ErrTempQuotaExceeded if the temporary files of all projects exceed the quota.
+func checkTempQuota() error {
+	if TempQuota <= 0 {
+		return nil
+	}
+
+	tempUsage, err := getTempUsage()
+
+	if err != nil {
+		return err
+	}
+
+	if tempUsage >= TempQuota {
+		return fmt.Errorf("%w: %d of %d bytes used", ErrTempQuotaExceeded, tempUsage, TempQuota)
+	}
+
+	return nil
+}
+
+// getTempUsage returns the size in bytes of the temporary files of all projects.
+func getTempUsage() (int64, error) {
+	tempDirectories, err := getTempDirectories()
+
+	if err != nil {
+		return 0, err
+	}
+
+	var tempUsage int64
+
+	for _, tempDirectory := range tempDirectories {
+		err := filepath.WalkDir(tempDirectory, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				// Files may be removed while walking.
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+
+				return err
+			}
+
+			if entry.IsDir() {
+				return nil
+			}
+
+			fileInfo, err := entry.Info()
+
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+
+				return err
+			}
+
+			tempUsage += fileInfo.Size()
+
+			return nil
+		})
+
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return tempUsage, nil
+}
+
+// getTempDirectories returns the existing temp directories of all projects.
+func getTempDirectories() ([]string, error) {
+	return filepath.Glob(GetProjectTempDirectory("*"))
+}
+
+// SweepTempDirectories removes the temporary files left behind by crashed processes or failed cleanups.
+// Job scratch spaces are removed unless the job is running, other files are removed once they are older than tempOrphanAge.
+// Called when the job worker starts, see RunJobWorker.
+func SweepTempDirectories(database *pgx.Conn) error {
+	tempDirectories, err := getTempDirectories()
+
+	if err != nil {
+		return err
+	}
+
+	for _, tempDirectory := range tempDirectories {
+		entries, err := os.ReadDir(tempDirectory)
+
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			isOrphaned, err := isOrphanedTempEntry(entry, database)
+
+			if err != nil {
+				return err
+			}
+
+			if !isOrphaned {
+				continue
+			}
+
+			if err := os.RemoveAll(filepath.Join(tempDirectory, entry.Name())); err != nil {
+				return err
+			}
+
+			Logger.Infof("Removed orphaned temporary file: %s/%s", tempDirectory, entry.Name())
+		}
+	}
+
+	return nil
+}
+
+// isOrphanedTempEntry returns true if the entry of a project temp directory is no longer used.
+func isOrphanedTempEntry(entry fs.DirEntry, database *pgx.Conn) (bool, error) {
+	if strings.HasPrefix(entry.Name(), jobScratchSpacePrefix) {
+		isRunning, err := isJobRunning(strings.TrimPrefix(entry.Name(), jobScratchSpacePrefix), database)
+
+		return !isRunning, err
+	}
+
+	fileInfo, err := entry.Info()
+
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return time.Since(fileInfo.ModTime()) > tempOrphanAge, nil
+}
+
+// isJobRunning returns true if the job exists and is running.
+func isJobRunning(jobUUID string, database *pgx.Conn) (bool, error) {
+	preparedStatement := `
+	SELECT EXISTS(SELECT 1 FROM jobs WHERE uuid = $1 AND status = $2)
+	`
+
+	var isRunning bool
+
+	err := database.QueryRow(context.Background(), preparedStatement, jobUUID, JobStatusRunning).Scan(&isRunning)
+
+	return isRunning, err
+}
@@ -0,0 +1,175 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"fmt"
+	"github.com/aquasecurity/esquery"
+	"github.com/jackc/pgx/v4"
+	"math"
+	"time"
+)
+
+// TimelineGap represents a period without any messages in the timeline of an evidence file.
+type TimelineGap struct {
+	Start            int     `json:"start"` // The start of the first day without messages.
+	End              int     `json:"end"`   // The start of the next day with messages.
+	Days             int     `json:"days"`
+	ExpectedMessages float64 `json:"expected_messages"` // The amount of messages expected in the gap from the average daily volume.
+}
+
+// EvidenceTimelineGaps represents the suspicious gaps in the timeline of an evidence file, see DetectTimelineGaps.
+type EvidenceTimelineGaps struct {
+	EvidenceUUID     string        `json:"evidence_uuid"`
+	FileName         string        `json:"file_name"`
+	Custodian        string        `json:"custodian"`
+	TotalMessages    int           `json:"total_messages"`
+	FirstMessageDate int           `json:"first_message_date"`
+	LastMessageDate  int           `json:"last_message_date"`
+	Gaps             []TimelineGap `json:"gaps"`
+}
+
+// Timeline gap parameters.
+const (
+	// DefaultTimelineGapDays defines the minimum amount of days without messages of a gap if none is given.
+	DefaultTimelineGapDays = 7
+	// minTimelineGapExpectedMessages defines the minimum amount of messages expected in a gap,
+	// so quiet mailboxes don't report every few days without messages.
+	minTimelineGapExpectedMessages = 10
+)
+
+// DetectTimelineGaps returns the suspicious gaps in the mail timeline of each evidence file of the project:
+// periods of at least minimumDays (DefaultTimelineGapDays if zero) without any messages in an otherwise active mailbox,
+// a common indicator of deleted mail (spoliation). Days are in the display timezone of the project, see SetProjectTimezone.
+// Evidence without suspicious gaps is returned without Gaps.
+func DetectTimelineGaps(projectUUID string, minimumDays int, userUUID string, database *pgx.Conn) ([]EvidenceTimelineGaps, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return nil, err
+	}
+
+	if minimumDays == 0 {
+		minimumDays = DefaultTimelineGapDays
+	}
+
+	if minimumDays < 1 {
+		return nil, fmt.Errorf("invalid minimum gap days: %d", minimumDays)
+	}
+
+	location, err := getProjectLocation(projectUUID, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	evidenceListings, err := ListProjectEvidence(projectUUID, EvidenceFilterParsed, userUUID, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var timelineGaps []EvidenceTimelineGaps
+
+	for _, evidenceListing := range evidenceListings {
+		evidenceTimelineGaps, err := getEvidenceTimelineGaps(evidenceListing, minimumDays, projectUUID, location)
+
+		if err != nil {
+			return nil, err
+		}
+
+		timelineGaps = append(timelineGaps, evidenceTimelineGaps)
+	}
+
+	return timelineGaps, nil
+}
+
+// getEvidenceTimelineGaps returns the gaps of at least minimumDays in the timeline of the evidence.
+func getEvidenceTimelineGaps(evidenceListing EvidenceListing, minimumDays int, projectUUID string, location *time.Location) (EvidenceTimelineGaps, error) {
+	// Messages without a received date are stored as zero.
+	query := esquery.Bool().Filter(
+		esquery.Term("project_uuid", projectUUID),
+		esquery.Term("evidence_uuid", evidenceListing.UUID),
+		esquery.Range("received").Gt(0),
+	)
+
+	aggregations, totalMessages, err := runAggregationSearch(
+		query,
+		esquery.CustomAgg("messages_per_day", map[string]interface{}{
+			"date_histogram": map[string]interface{}{
+				"field":             "received",
+				"calendar_interval": "day",
+				"time_zone":         location.String(),
+				"min_doc_count":     1,
+			},
+		}),
+	)
+
+	if err != nil {
+		return EvidenceTimelineGaps{}, err
+	}
+
+	evidenceTimelineGaps := EvidenceTimelineGaps{
+		EvidenceUUID:  evidenceListing.UUID,
+		FileName:      evidenceListing.FileName,
+		Custodian:     evidenceListing.Custodian,
+		TotalMessages: totalMessages,
+	}
+
+	buckets, err := aggregations.Buckets("messages_per_day")
+
+	if err != nil {
+		return EvidenceTimelineGaps{}, err
+	}
+
+	if len(buckets) == 0 {
+		return evidenceTimelineGaps, nil
+	}
+
+	// Date histogram keys are the start of the day in milliseconds.
+	days := make([]time.Time, len(buckets))
+
+	for i, bucket := range buckets {
+		key, ok := bucket.Key.(float64)
+
+		if !ok {
+			return EvidenceTimelineGaps{}, fmt.Errorf("invalid date histogram key: %v", bucket.Key)
+		}
+
+		days[i] = time.UnixMilli(int64(key)).In(location)
+	}
+
+	evidenceTimelineGaps.FirstMessageDate = int(days[0].Unix())
+	evidenceTimelineGaps.LastMessageDate = int(days[len(days)-1].AddDate(0, 0, 1).Unix()) - 1
+
+	timelineDays := getCalendarDays(days[0], days[len(days)-1]) + 1
+	messagesPerDay := float64(totalMessages) / float64(timelineDays)
+
+	for i := 1; i < len(days); i++ {
+		gapDays := getCalendarDays(days[i-1], days[i]) - 1
+
+		if gapDays < minimumDays {
+			continue
+		}
+
+		expectedMessages := math.Round(messagesPerDay*float64(gapDays)*10) / 10
+
+		if expectedMessages < minTimelineGapExpectedMessages {
+			continue
+		}
+
+		evidenceTimelineGaps.Gaps = append(evidenceTimelineGaps.Gaps, TimelineGap{
+			Start:            int(days[i-1].AddDate(0, 0, 1).Unix()),
+			End:              int(days[i].Unix()),
+			Days:             gapDays,
+			ExpectedMessages: expectedMessages,
+		})
+	}
+
+	return evidenceTimelineGaps, nil
+}
+
+// getCalendarDays returns the amount of calendar days from the start to the end day,
+// days are not always 24 hours because of daylight saving time.
+func getCalendarDays(start time.Time, end time.Time) int {
+	return int(math.Round(end.Sub(start).Hours() / 24))
+}
@@ -0,0 +1,169 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aquasecurity/esquery"
+	"github.com/jackc/pgx/v4"
+	"html/template"
+	"time"
+)
+
+// DefaultProjectTimezone defines the display timezone of projects without a timezone, see SetProjectTimezone.
+const DefaultProjectTimezone = "UTC"
+
+// SetProjectTimezone sets the display timezone (an IANA name, e.g. "Europe/Amsterdam") of the dates in the reports of the project.
+// Dates are always stored as Unix timestamps (UTC), the original UTC offsets of messages are kept in Message.SentOffset.
+func SetProjectTimezone(timezone string, projectUUID string, userUUID string, database *pgx.Conn) error {
+	if err := CheckPermission(userUUID, projectUUID, ActionManageProject, database); err != nil {
+		return err
+	}
+
+	if _, err := time.LoadLocation(timezone); err != nil || timezone == "" || timezone == "Local" {
+		return fmt.Errorf("invalid timezone: %s", timezone)
+	}
+
+	preparedStatement := `
+	INSERT INTO project_timezones(projectUUID, timezone) VALUES ($1, $2)
+	ON CONFLICT(projectUUID) DO UPDATE SET timezone = $2
+	`
+	_, err := database.Exec(context.Background(), preparedStatement, projectUUID, timezone)
+
+	return err
+}
+
+// GetProjectTimezone returns the display timezone of the project, DefaultProjectTimezone if not set.
+func GetProjectTimezone(projectUUID string, userUUID string, database *pgx.Conn) (string, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return "", err
+	}
+
+	return getProjectTimezone(projectUUID, database)
+}
+
+// getProjectTimezone returns the display timezone of the project, DefaultProjectTimezone if not set.
+func getProjectTimezone(projectUUID string, database *pgx.Conn) (string, error) {
+	preparedStatement := `
+	SELECT timezone FROM project_timezones WHERE projectUUID = $1
+	`
+	var timezone string
+
+	if err := database.QueryRow(context.Background(), preparedStatement, projectUUID).Scan(&timezone); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return DefaultProjectTimezone, nil
+		}
+
+		return "", err
+	}
+
+	return timezone, nil
+}
+
+// getProjectLocation returns the location of the display timezone of the project.
+func getProjectLocation(projectUUID string, database *pgx.Conn) (*time.Location, error) {
+	timezone, err := getProjectTimezone(projectUUID, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return time.LoadLocation(timezone)
+}
+
+// formatDisplayDate returns the Unix timestamp formatted in the location (e.g. the display timezone of the project)
+// or an empty string if there is no date.
+func formatDisplayDate(timestamp int, location *time.Location) string {
+	if timestamp <= 0 {
+		return ""
+	}
+
+	return time.Unix(int64(timestamp), 0).In(location).Format("2006-01-02 15:04:05 MST")
+}
+
+// withDisplayDateFunction returns the report template functions with the formatDate function formatting in the location,
+// unless the functions already override formatDate.
+func withDisplayDateFunction(functions template.FuncMap, location *time.Location) template.FuncMap {
+	reportFunctions := template.FuncMap{
+		"formatDate": func(timestamp int) string {
+			return formatDisplayDate(timestamp, location)
+		},
+	}
+
+	for functionName, function := range functions {
+		reportFunctions[functionName] = function
+	}
+
+	return reportFunctions
+}
+
+// AnalyzeProjectDates sets the sent and delivered dates, their UTC offsets and the date anomalies of the messages of the project
+// from their headers, for messages indexed before the dates were analyzed. Returns the amount of messages with date anomalies.
+func AnalyzeProjectDates(projectUUID string, userUUID string, database *pgx.Conn) (int, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionManageProject, database); err != nil {
+		return 0, err
+	}
+
+	if err := updateMessagesMapping(); err != nil {
+		return 0, err
+	}
+
+	query := esquery.Bool().Filter(esquery.Term("project_uuid", projectUUID))
+
+	var anomalous int
+
+	err := forEachMessageBatch(query, func(messages []Message) error {
+		messageUUIDs := make([]string, len(messages))
+		messageDates := make(map[string]interface{}, len(messages))
+
+		for i, message := range messages {
+			extractedAt := time.Now()
+
+			if provenance := message.getProvenance(); provenance.ExtractedAt > 0 {
+				extractedAt = time.Unix(int64(provenance.ExtractedAt), 0)
+			}
+
+			setMessageDates(&message, extractedAt)
+
+			messageUUIDs[i] = message.UUID
+			messageDates[message.UUID] = map[string]interface{}{
+				"sent_date":        message.SentDate,
+				"sent_offset":      message.SentOffset,
+				"delivered_date":   message.DeliveredDate,
+				"delivered_offset": message.DeliveredOffset,
+				"date_discrepancy": message.DateDiscrepancy,
+				"date_anomalies":   message.DateAnomalies,
+			}
+
+			if len(message.DateAnomalies) > 0 {
+				anomalous++
+			}
+		}
+
+		return updateMessagesByScript(
+			newMessageUUIDsQuery(messageUUIDs, projectUUID),
+			"ctx._source.putAll(params.dates[ctx._source.uuid]);",
+			map[string]interface{}{
+				"dates": messageDates,
+			},
+		)
+	}, database)
+
+	if err != nil {
+		return anomalous, err
+	}
+
+	Logger.WithFields(LogFields{"project_uuid": projectUUID}).Infof("Analyzed the dates of the messages, %d messages have date anomalies", anomalous)
+
+	return anomalous, nil
+}
+
+// runAnalyzeDatesJob runs AnalyzeProjectDates.
+func runAnalyzeDatesJob(ctx context.Context, job Job, reportProgress func(progress int), database *pgx.Conn) (string, error) {
+	_, err := AnalyzeProjectDates(job.ProjectUUID, job.UserUUID, database)
+
+	return "", err
+}
@@ -0,0 +1,539 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aquasecurity/esquery"
+	"github.com/jackc/pgx/v4"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// TopicCluster represents a cluster of messages about the same topic, see ClusterMessages.
+type TopicCluster struct {
+	ID           string   `json:"id"`
+	Label        string   `json:"label"` // The most characteristic terms, e.g. "invoice, payment, overdue".
+	Terms        []string `json:"terms"` // The characteristic terms, the most characteristic first.
+	MessageCount int      `json:"message_count"`
+}
+
+// Topic clustering defaults and limits.
+const (
+	DefaultTopicClusterCount = 10
+	MaxTopicClusterCount     = 100
+	// maxTopicClusterSampleSize defines the maximum amount of messages the clusters are computed from, all messages are assigned to a cluster.
+	maxTopicClusterSampleSize = 20000
+	// maxTopicClusterVocabulary defines the maximum amount of terms (the most common) used to cluster.
+	maxTopicClusterVocabulary = 5000
+	// maxTopicClusterIterations defines the maximum amount of k-means iterations.
+	maxTopicClusterIterations = 25
+	// topicClusterLabelTerms defines the amount of terms in the label of a cluster.
+	topicClusterLabelTerms = 3
+	// topicClusterTerms defines the amount of characteristic terms of a cluster.
+	topicClusterTerms = 10
+	// maxTopicClusterTextLength defines the maximum amount of characters of a message which are clustered.
+	maxTopicClusterTextLength = 20000
+)
+
+// topicClusterSeed seeds the k-means initialization so clustering the same messages gives the same clusters.
+const topicClusterSeed = 1
+
+// errTopicClusterSampleComplete stops scrolling the messages once the sample is complete.
+var errTopicClusterSampleComplete = errors.New("topic cluster sample is complete")
+
+// messageTermStopWords defines the (English) words which don't describe a topic.
+var messageTermStopWords = map[string]bool{}
+
+func init() {
+	for _, word := range strings.Fields(`
+		about above after again against all also and any are aren because been before being below between both but can cannot
+		could couldn did didn does doesn doing don down during each few for from further had hadn has hasn have haven having
+		her here hers herself him himself his how into isn its itself just let more most mustn myself nor not now off once only
+		other ought our ours ourselves out over own same shan she should shouldn some such than that the their theirs them
+		themselves then there these they this those through too under until very was wasn were weren what when where which
+		while who whom why will with won would wouldn you your yours yourself yourselves
+		http https www com net org html mailto cid image png jpg gif sent received subject original message forwarded wrote
+		regards kind best thanks thank please dear hello dag beste groet met vriendelijke email mail
+	`) {
+		messageTermStopWords[word] = true
+	}
+}
+
+// getMessageTerms returns the term frequencies of the subject and body text (up to the maximum length) of the message.
+// Terms are lowercase words of at least three letters which aren't stop words.
+func getMessageTerms(message Message, maxLength int) map[string]int {
+	text := getMessageText(message, maxLength)
+
+	terms := make(map[string]int)
+
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(character rune) bool {
+		return !unicode.IsLetter(character)
+	}) {
+		if len([]rune(word)) < 3 || len(word) > 30 || messageTermStopWords[word] {
+			continue
+		}
+
+		terms[word]++
+	}
+
+	return terms
+}
+
+// topicClusterVectorizer converts term frequencies to normalized TF-IDF vectors.
+type topicClusterVectorizer struct {
+	vocabulary map[string]int // The index of each term in the vectors.
+	terms      []string       // The term of each index.
+	idf        []float64      // The inverse document frequency of each term.
+}
+
+// newTopicClusterVectorizer creates the vectorizer of the most common terms of the documents.
+// Terms occurring in a single document or in more than half of the documents don't distinguish topics and are ignored.
+func newTopicClusterVectorizer(documents []map[string]int) *topicClusterVectorizer {
+	documentFrequencies := make(map[string]int)
+
+	for _, document := range documents {
+		for term := range document {
+			documentFrequencies[term]++
+		}
+	}
+
+	var candidates []string
+
+	for term, documentFrequency := range documentFrequencies {
+		if documentFrequency < 2 || (len(documents) > 10 && documentFrequency > len(documents)/2) {
+			continue
+		}
+
+		candidates = append(candidates, term)
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if documentFrequencies[candidates[i]] == documentFrequencies[candidates[j]] {
+			return candidates[i] < candidates[j]
+		}
+
+		return documentFrequencies[candidates[i]] > documentFrequencies[candidates[j]]
+	})
+
+	if len(candidates) > maxTopicClusterVocabulary {
+		candidates = candidates[:maxTopicClusterVocabulary]
+	}
+
+	vectorizer := &topicClusterVectorizer{
+		vocabulary: make(map[string]int, len(candidates)),
+		terms:      candidates,
+		idf:        make([]float64, len(candidates)),
+	}
+
+	for i, term := range candidates {
+		vectorizer.vocabulary[term] = i
+		vectorizer.idf[i] = math.Log(float64(len(documents)+1)/float64(documentFrequencies[term]+1)) + 1
+	}
+
+	return vectorizer
+}
+
+// vectorize returns the L2 normalized TF-IDF vector (sparse, by term index) of the document.
+// Returns nil if the document has no terms of the vocabulary.
+func (vectorizer *topicClusterVectorizer) vectorize(document map[string]int) map[int]float64 {
+	vector := make(map[int]float64)
+
+	var norm float64
+
+	for term, frequency := range document {
+		index, ok := vectorizer.vocabulary[term]
+
+		if !ok {
+			continue
+		}
+
+		weight := (1 + math.Log(float64(frequency))) * vectorizer.idf[index]
+
+		vector[index] = weight
+		norm += weight * weight
+	}
+
+	if norm == 0 {
+		return nil
+	}
+
+	norm = math.Sqrt(norm)
+
+	for index := range vector {
+		vector[index] /= norm
+	}
+
+	return vector
+}
+
+// getCosineSimilarity returns the similarity of the normalized vector and the normalized centroid.
+func getCosineSimilarity(vector map[int]float64, centroid []float64) float64 {
+	var similarity float64
+
+	for index, weight := range vector {
+		similarity += weight * centroid[index]
+	}
+
+	return similarity
+}
+
+// getNearestCentroid returns the index of the centroid most similar to the vector.
+func getNearestCentroid(vector map[int]float64, centroids [][]float64) int {
+	nearest := 0
+	nearestSimilarity := math.Inf(-1)
+
+	for i, centroid := range centroids {
+		if similarity := getCosineSimilarity(vector, centroid); similarity > nearestSimilarity {
+			nearest = i
+			nearestSimilarity = similarity
+		}
+	}
+
+	return nearest
+}
+
+// computeTopicCentroids clusters the normalized vectors with spherical k-means (k-means++ initialization).
+// Returns the normalized centroids, fewer than the cluster count if there are fewer distinct vectors.
+func computeTopicCentroids(vectors []map[int]float64, dimensions int, clusterCount int) [][]float64 {
+	if len(vectors) == 0 || dimensions == 0 {
+		return nil
+	}
+
+	if clusterCount > len(vectors) {
+		clusterCount = len(vectors)
+	}
+
+	random := rand.New(rand.NewSource(topicClusterSeed))
+
+	newCentroid := func(vector map[int]float64) []float64 {
+		centroid := make([]float64, dimensions)
+
+		for index, weight := range vector {
+			centroid[index] = weight
+		}
+
+		return centroid
+	}
+
+	centroids := [][]float64{newCentroid(vectors[random.Intn(len(vectors))])}
+	distances := make([]float64, len(vectors))
+
+	for len(centroids) < clusterCount {
+		var totalDistance float64
+
+		for i, vector := range vectors {
+			distances[i] = 1 - getCosineSimilarity(vector, centroids[getNearestCentroid(vector, centroids)])
+
+			// Rounding errors make equal vectors slightly distant.
+			if distances[i] < 1e-9 {
+				distances[i] = 0
+			}
+
+			totalDistance += distances[i]
+		}
+
+		// All vectors equal a centroid.
+		if totalDistance == 0 {
+			break
+		}
+
+		target := random.Float64() * totalDistance
+
+		for i, distance := range distances {
+			target -= distance
+
+			if target <= 0 || i == len(distances)-1 {
+				centroids = append(centroids, newCentroid(vectors[i]))
+				break
+			}
+		}
+	}
+
+	assignments := make([]int, len(vectors))
+
+	for iteration := 0; iteration < maxTopicClusterIterations; iteration++ {
+		changed := false
+
+		for i, vector := range vectors {
+			nearest := getNearestCentroid(vector, centroids)
+
+			if iteration == 0 || nearest != assignments[i] {
+				changed = true
+			}
+
+			assignments[i] = nearest
+		}
+
+		if !changed {
+			break
+		}
+
+		sums := make([][]float64, len(centroids))
+
+		for i := range sums {
+			sums[i] = make([]float64, dimensions)
+		}
+
+		for i, vector := range vectors {
+			for index, weight := range vector {
+				sums[assignments[i]][index] += weight
+			}
+		}
+
+		for i, sum := range sums {
+			var norm float64
+
+			for _, weight := range sum {
+				norm += weight * weight
+			}
+
+			// Empty clusters keep their centroid.
+			if norm == 0 {
+				continue
+			}
+
+			norm = math.Sqrt(norm)
+
+			for index := range sum {
+				sum[index] /= norm
+			}
+
+			centroids[i] = sum
+		}
+	}
+
+	return centroids
+}
+
+// getCentroidTerms returns the terms with the highest weights of the centroid.
+func getCentroidTerms(centroid []float64, terms []string, count int) []string {
+	indexes := make([]int, 0, len(centroid))
+
+	for index, weight := range centroid {
+		if weight > 0 {
+			indexes = append(indexes, index)
+		}
+	}
+
+	sort.Slice(indexes, func(i, j int) bool {
+		return centroid[indexes[i]] > centroid[indexes[j]]
+	})
+
+	if len(indexes) > count {
+		indexes = indexes[:count]
+	}
+
+	centroidTerms := make([]string, len(indexes))
+
+	for i, index := range indexes {
+		centroidTerms[i] = terms[index]
+	}
+
+	return centroidTerms
+}
+
+// ClusterMessages clusters the messages of the project by topic using TF-IDF and k-means, replacing the previous clusters.
+// The clusters are computed from (a sample of) the messages after which every message is assigned to its nearest cluster,
+// messages without distinguishing terms aren't assigned. The cluster count defaults to DefaultTopicClusterCount if zero.
+// Returns the clusters, the largest first. Use the TopicCluster search filter to list the messages of a cluster.
+func ClusterMessages(projectUUID string, clusterCount int, userUUID string, database *pgx.Conn) ([]TopicCluster, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionManageProject, database); err != nil {
+		return nil, err
+	}
+
+	if clusterCount == 0 {
+		clusterCount = DefaultTopicClusterCount
+	}
+
+	if clusterCount < 1 || clusterCount > MaxTopicClusterCount {
+		return nil, fmt.Errorf("invalid cluster count: %d (maximum %d)", clusterCount, MaxTopicClusterCount)
+	}
+
+	if err := updateMessagesMapping(); err != nil {
+		return nil, err
+	}
+
+	query := esquery.Bool().Filter(esquery.Term("project_uuid", projectUUID))
+
+	var sample []map[string]int
+
+	err := forEachMessageBatch(query, func(messages []Message) error {
+		for _, message := range messages {
+			if len(sample) >= maxTopicClusterSampleSize {
+				return errTopicClusterSampleComplete
+			}
+
+			sample = append(sample, getMessageTerms(message, maxTopicClusterTextLength))
+		}
+
+		return nil
+	}, database)
+
+	if err != nil && !errors.Is(err, errTopicClusterSampleComplete) {
+		return nil, err
+	}
+
+	vectorizer := newTopicClusterVectorizer(sample)
+
+	var vectors []map[int]float64
+
+	for _, document := range sample {
+		if vector := vectorizer.vectorize(document); vector != nil {
+			vectors = append(vectors, vector)
+		}
+	}
+
+	centroids := computeTopicCentroids(vectors, len(vectorizer.terms), clusterCount)
+
+	topicClusters := make([]TopicCluster, len(centroids))
+
+	for i, centroid := range centroids {
+		terms := getCentroidTerms(centroid, vectorizer.terms, topicClusterTerms)
+		labelTerms := terms
+
+		if len(labelTerms) > topicClusterLabelTerms {
+			labelTerms = labelTerms[:topicClusterLabelTerms]
+		}
+
+		topicClusters[i] = TopicCluster{
+			ID:    NewUUID(),
+			Label: strings.Join(labelTerms, ", "),
+			Terms: terms,
+		}
+	}
+
+	err = forEachMessageBatch(query, func(messages []Message) error {
+		messageUUIDs := make([]string, len(messages))
+		messageClusters := make(map[string]interface{}, len(messages))
+
+		for i, message := range messages {
+			messageUUIDs[i] = message.UUID
+			messageClusters[message.UUID] = nil
+
+			if len(centroids) == 0 {
+				continue
+			}
+
+			vector := vectorizer.vectorize(getMessageTerms(message, maxTopicClusterTextLength))
+
+			if vector == nil {
+				continue
+			}
+
+			nearest := getNearestCentroid(vector, centroids)
+
+			topicClusters[nearest].MessageCount++
+
+			messageClusters[message.UUID] = map[string]interface{}{
+				"id":    topicClusters[nearest].ID,
+				"label": topicClusters[nearest].Label,
+			}
+		}
+
+		return updateMessagesByScript(
+			newMessageUUIDsQuery(messageUUIDs, projectUUID),
+			"def cluster = params.clusters[ctx._source.uuid]; if (cluster == null) { ctx._source.remove('topic_cluster'); ctx._source.remove('topic_label'); } else { ctx._source.topic_cluster = cluster.id; ctx._source.topic_label = cluster.label; }",
+			map[string]interface{}{
+				"clusters": messageClusters,
+			},
+		)
+	}, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Clusters of the sample may have no messages.
+	assignedClusters := topicClusters[:0]
+
+	for _, topicCluster := range topicClusters {
+		if topicCluster.MessageCount > 0 {
+			assignedClusters = append(assignedClusters, topicCluster)
+		}
+	}
+
+	topicClusters = assignedClusters
+
+	sort.SliceStable(topicClusters, func(i, j int) bool {
+		return topicClusters[i].MessageCount > topicClusters[j].MessageCount
+	})
+
+	Logger.WithFields(LogFields{"project_uuid": projectUUID}).Infof("Clustered the messages into %d topics", len(topicClusters))
+
+	return topicClusters, nil
+}
+
+// GetTopicClusters returns the topic clusters of the project (see ClusterMessages) with the amount of messages matching the filters, the largest first.
+func GetTopicClusters(projectUUID string, filters SearchFilters, userUUID string, database *pgx.Conn) ([]TopicCluster, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return nil, err
+	}
+
+	query := filters.apply(esquery.Bool().Filter(esquery.Term("project_uuid", projectUUID)))
+
+	aggregations, _, err := runAggregationSearch(
+		query,
+		esquery.TermsAgg("clusters", "topic_cluster").Size(MaxTopicClusterCount).Aggs(
+			esquery.TermsAgg("label", "topic_label").Size(1),
+		),
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	clusterBuckets, err := aggregations.Buckets("clusters")
+
+	if err != nil {
+		return nil, err
+	}
+
+	topicClusters := make([]TopicCluster, 0, len(clusterBuckets))
+
+	for _, clusterBucket := range clusterBuckets {
+		labelBuckets, err := clusterBucket.Aggregations.Buckets("label")
+
+		if err != nil {
+			return nil, err
+		}
+
+		topicCluster := TopicCluster{
+			ID:           clusterBucket.KeyString(),
+			MessageCount: clusterBucket.DocCount,
+		}
+
+		if len(labelBuckets) > 0 {
+			topicCluster.Label = labelBuckets[0].KeyString()
+			topicCluster.Terms = strings.Split(topicCluster.Label, ", ")
+		}
+
+		topicClusters = append(topicClusters, topicCluster)
+	}
+
+	return topicClusters, nil
+}
+
+// ClusterMessagesJobParameters represents the parameters of the JobTypeClusterMessages job.
+type ClusterMessagesJobParameters struct {
+	ClusterCount int `json:"cluster_count"` // Defaults to DefaultTopicClusterCount.
+}
+
+// runClusterMessagesJob runs ClusterMessages.
+func runClusterMessagesJob(ctx context.Context, job Job, reportProgress func(progress int), database *pgx.Conn) (string, error) {
+	var parameters ClusterMessagesJobParameters
+
+	if err := decodeJobParameters(job, &parameters); err != nil {
+		return "", err
+	}
+
+	_, err := ClusterMessages(job.ProjectUUID, parameters.ClusterCount, job.UserUUID, database)
+
+	return "", err
+}
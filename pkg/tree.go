@@ -5,10 +5,15 @@ package core
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"github.com/aquasecurity/esquery"
 	"github.com/jackc/pgx/v4"
+	"strings"
 )
 
 // TreeNode represents a tree node which is presented in the filesystem.
+// Virtual tree nodes (see MergeTreeNodes) have no evidence UUID.
 type TreeNode struct {
 	FolderUUID   string `json:"folder_uuid"`
 	ProjectUUID  string `json:"project_uuid"`
@@ -20,7 +25,7 @@ type TreeNode struct {
 // Save saves the tree node to the database.
 func (treeNode *TreeNode) Save(database *pgx.Conn) error {
 	preparedStatement := `
-	INSERT INTO tree_nodes(folderUUID, projectUUID, evidenceUUID, title, parent) VALUES ($1, $2, $3, $4, %5)
+	INSERT INTO tree_nodes(folderUUID, projectUUID, evidenceUUID, title, parent) VALUES ($1, $2, $3, $4, $5)
 	`
 	_, err := database.Exec(context.Background(), preparedStatement, treeNode.FolderUUID, treeNode.ProjectUUID, treeNode.EvidenceUUID, treeNode.Title, treeNode.Parent)
 
@@ -61,61 +66,391 @@ func GetRootTreeNodes(projectUUID string, database *pgx.Conn) ([]TreeNode, error
 	return GetTreeNodesByParent("NULL", projectUUID, database)
 }
 
+// treeNodeMessageCountsSize defines the maximum amount of folders counted by getTreeNodeMessageCounts.
+const treeNodeMessageCountsSize = 65536
+
 // TreeNodeDTO represents a tree shown in the filesystem (this is a data transfer object).
 type TreeNodeDTO struct {
-	Value    string        `json:"value"`
-	Label    string        `json:"label"`
-	Children []TreeNodeDTO `json:"children"`
+	Value         string        `json:"value"`
+	Label         string        `json:"label"`
+	MessageCount  int           `json:"message_count"` // The messages in this folder, excluding sub-folders.
+	HasChildren   bool          `json:"has_children"`
+	IsSmartFolder bool          `json:"is_smart_folder"` // The value is the smart folder UUID, see GetMessagesFromSmartFolder.
+	Children      []TreeNodeDTO `json:"children"`
 }
 
-// WalkTreeNodeChildren returns all the children of this tree node.
-func WalkTreeNodeChildren(treeNodeUUID string, projectUUID string, database *pgx.Conn) ([]TreeNodeDTO, error) {
+// getTreeNodeDescendants returns all descendants of the tree node using a single recursive query.
+func getTreeNodeDescendants(treeNodeUUID string, projectUUID string, database *pgx.Conn) ([]TreeNode, error) {
+	preparedStatement := `
+	WITH RECURSIVE descendants AS (
+		SELECT folderUUID, projectUUID, evidenceUUID, title, parent FROM tree_nodes WHERE projectUUID = $1 AND parent = $2
+		UNION ALL
+		SELECT child.folderUUID, child.projectUUID, child.evidenceUUID, child.title, child.parent FROM tree_nodes child
+		INNER JOIN descendants ON child.parent = descendants.folderUUID WHERE child.projectUUID = $1
+	)
+	SELECT folderUUID, projectUUID, evidenceUUID, title, parent FROM descendants
+	`
+	rows, err := database.Query(context.Background(), preparedStatement, projectUUID, treeNodeUUID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var treeNodes []TreeNode
+
+	for rows.Next() {
+		var treeNode TreeNode
+
+		if err := rows.Scan(&treeNode.FolderUUID, &treeNode.ProjectUUID, &treeNode.EvidenceUUID, &treeNode.Title, &treeNode.Parent); err != nil {
+			return nil, err
+		}
+
+		treeNodes = append(treeNodes, treeNode)
+	}
+
+	rows.Close()
+
+	return treeNodes, rows.Err()
+}
+
+// GetTreeNodeMessageCounts returns the message count of each folder of the project by folder UUID.
+func GetTreeNodeMessageCounts(projectUUID string, userUUID string, database *pgx.Conn) (map[string]int, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return nil, err
+	}
+
+	return getTreeNodeMessageCounts(projectUUID)
+}
+
+// getTreeNodeMessageCounts returns the message count of each folder of the project using a single aggregation.
+func getTreeNodeMessageCounts(projectUUID string) (map[string]int, error) {
+	aggregations, _, err := runAggregationSearch(
+		esquery.Bool().Filter(esquery.Term("project_uuid", projectUUID)),
+		esquery.TermsAgg("folders", "folder_uuid").Size(treeNodeMessageCountsSize),
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	buckets, err := aggregations.Buckets("folders")
+
+	if err != nil {
+		return nil, err
+	}
+
+	messageCounts := make(map[string]int, len(buckets))
+
+	for _, bucket := range buckets {
+		messageCounts[bucket.KeyString()] = bucket.DocCount
+	}
+
+	return messageCounts, nil
+}
+
+// GetTreeNodeChildren returns the children of the tree node with their message counts, without their children.
+// Used to load the tree lazily, HasChildren tells whether the child can be expanded.
+// The root ("NULL") also contains the smart folders of the project.
+func GetTreeNodeChildren(treeNodeUUID string, projectUUID string, database *pgx.Conn) ([]TreeNodeDTO, error) {
+	preparedStatement := `
+	SELECT folderUUID, title, EXISTS (SELECT 1 FROM tree_nodes child WHERE child.projectUUID = $1 AND child.parent = tree_nodes.folderUUID)
+	FROM tree_nodes WHERE projectUUID = $1 AND parent = $2
+	`
+	rows, err := database.Query(context.Background(), preparedStatement, projectUUID, treeNodeUUID)
+
+	if err != nil {
+		return nil, err
+	}
+
 	var treeNodeDTOs []TreeNodeDTO
 
-	treeNodeChildren, err := GetTreeNodesByParent(treeNodeUUID, projectUUID, database)
+	for rows.Next() {
+		var treeNodeDTO TreeNodeDTO
+
+		if err := rows.Scan(&treeNodeDTO.Value, &treeNodeDTO.Label, &treeNodeDTO.HasChildren); err != nil {
+			return nil, err
+		}
+
+		treeNodeDTOs = append(treeNodeDTOs, treeNodeDTO)
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	messageCounts, err := getTreeNodeMessageCounts(projectUUID)
 
 	if err != nil {
 		return nil, err
 	}
 
-	for _, treeNodeChild := range treeNodeChildren {
-		treeNodeChildChildren, err := WalkTreeNodeChildren(treeNodeChild.FolderUUID, projectUUID, database)
+	for i := range treeNodeDTOs {
+		treeNodeDTOs[i].MessageCount = messageCounts[treeNodeDTOs[i].Value]
+	}
+
+	if treeNodeUUID == "NULL" {
+		smartFolderTreeNodeDTOs, err := getSmartFolderTreeNodeDTOs(projectUUID, database)
 
 		if err != nil {
 			return nil, err
 		}
 
+		treeNodeDTOs = append(treeNodeDTOs, smartFolderTreeNodeDTOs...)
+	}
+
+	return treeNodeDTOs, nil
+}
+
+// WalkTreeNodeChildren returns all the children of this tree node with their message counts.
+// The tree is loaded with a single query, use GetTreeNodeChildren to load large trees lazily.
+// The root ("NULL") also contains the smart folders of the project.
+func WalkTreeNodeChildren(treeNodeUUID string, projectUUID string, database *pgx.Conn) ([]TreeNodeDTO, error) {
+	descendants, err := getTreeNodeDescendants(treeNodeUUID, projectUUID, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	messageCounts, err := getTreeNodeMessageCounts(projectUUID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	childrenByParent := map[string][]TreeNode{}
+
+	for _, descendant := range descendants {
+		childrenByParent[descendant.Parent] = append(childrenByParent[descendant.Parent], descendant)
+	}
+
+	treeNodeDTOs := buildTreeNodeDTOs(treeNodeUUID, childrenByParent, messageCounts)
+
+	if treeNodeUUID == "NULL" {
+		smartFolderTreeNodeDTOs, err := getSmartFolderTreeNodeDTOs(projectUUID, database)
+
+		if err != nil {
+			return nil, err
+		}
+
+		treeNodeDTOs = append(treeNodeDTOs, smartFolderTreeNodeDTOs...)
+	}
+
+	return treeNodeDTOs, nil
+}
+
+// buildTreeNodeDTOs returns the tree of the children of the parent.
+func buildTreeNodeDTOs(parentTreeNodeUUID string, childrenByParent map[string][]TreeNode, messageCounts map[string]int) []TreeNodeDTO {
+	var treeNodeDTOs []TreeNodeDTO
+
+	for _, child := range childrenByParent[parentTreeNodeUUID] {
+		children := buildTreeNodeDTOs(child.FolderUUID, childrenByParent, messageCounts)
+
 		treeNodeDTOs = append(treeNodeDTOs, TreeNodeDTO{
-			Value:    treeNodeChild.FolderUUID,
-			Label:    treeNodeChild.Title,
-			Children: treeNodeChildChildren,
+			Value:        child.FolderUUID,
+			Label:        child.Title,
+			MessageCount: messageCounts[child.FolderUUID],
+			HasChildren:  len(children) > 0,
+			Children:     children,
 		})
 	}
 
-	return treeNodeDTOs, nil
+	return treeNodeDTOs
 }
 
 // WalkTreeNodeChildrenUUIDs returns all the tree node children UUIDs.
 func WalkTreeNodeChildrenUUIDs(treeNodeUUID string, projectUUID string, database *pgx.Conn) ([]string, error) {
-	var treeNodeUUIDs []string
+	return walkTreeNodeChildrenUUIDs(treeNodeUUID, projectUUID, NewRepositories(database).Tree)
+}
 
-	treeNodeChildren, err := GetTreeNodesByParent(treeNodeUUID, projectUUID, database)
+// walkTreeNodeChildrenUUIDs returns all the tree node children UUIDs from the tree repository.
+func walkTreeNodeChildrenUUIDs(treeNodeUUID string, projectUUID string, treeRepo TreeRepo) ([]string, error) {
+	descendants, err := treeRepo.GetTreeNodeDescendants(treeNodeUUID, projectUUID)
 
 	if err != nil {
 		return nil, err
 	}
 
-	for _, treeNodeChild := range treeNodeChildren {
-		treeNodeUUIDs = append(treeNodeUUIDs, treeNodeChild.FolderUUID)
+	treeNodeUUIDs := make([]string, len(descendants))
+
+	for i, descendant := range descendants {
+		treeNodeUUIDs[i] = descendant.FolderUUID
+	}
+
+	return treeNodeUUIDs, nil
+}
+
+// getFolderTreeUUIDs returns the folder UUIDs including all their descendants, as Elasticsearch terms.
+func getFolderTreeUUIDs(folderUUIDs []string, projectUUID string, database *pgx.Conn) ([]interface{}, error) {
+	var folderTreeUUIDs []interface{}
+
+	treeRepo := NewRepositories(database).Tree
 
-		treeNodeChildChildren, err := WalkTreeNodeChildrenUUIDs(treeNodeChild.FolderUUID, projectUUID, database)
+	for _, folderUUID := range folderUUIDs {
+		descendantUUIDs, err := walkTreeNodeChildrenUUIDs(folderUUID, projectUUID, treeRepo)
 
 		if err != nil {
 			return nil, err
 		}
 
-		treeNodeUUIDs = append(treeNodeUUIDs, treeNodeChildChildren...)
+		folderTreeUUIDs = append(folderTreeUUIDs, folderUUID)
+
+		for _, descendantUUID := range descendantUUIDs {
+			folderTreeUUIDs = append(folderTreeUUIDs, descendantUUID)
+		}
 	}
 
-	return treeNodeUUIDs, nil
+	return folderTreeUUIDs, nil
+}
+
+// Audit actions of tree node operations.
+const (
+	AuditActionRenameTreeNode = "rename_tree_node"
+	AuditActionMoveTreeNode   = "move_tree_node"
+	AuditActionMergeTreeNodes = "merge_tree_nodes"
+)
+
+// getTreeNode returns the tree node of the project.
+func getTreeNode(folderUUID string, projectUUID string, database *pgx.Conn) (TreeNode, error) {
+	preparedStatement := `
+	SELECT folderUUID, projectUUID, evidenceUUID, title, parent FROM tree_nodes WHERE folderUUID = $1 AND projectUUID = $2
+	`
+	row := database.QueryRow(context.Background(), preparedStatement, folderUUID, projectUUID)
+
+	var treeNode TreeNode
+
+	err := row.Scan(&treeNode.FolderUUID, &treeNode.ProjectUUID, &treeNode.EvidenceUUID, &treeNode.Title, &treeNode.Parent)
+
+	return treeNode, err
+}
+
+// RenameTreeNode renames the folder, the original title of parsed folders is kept in the audit log.
+func RenameTreeNode(folderUUID string, title string, projectUUID string, userUUID string, database *pgx.Conn) error {
+	if err := CheckPermission(userUUID, projectUUID, ActionManageEvidence, database); err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(title) == "" {
+		return errors.New("tree node title is empty")
+	}
+
+	treeNode, err := getTreeNode(folderUUID, projectUUID, database)
+
+	if err != nil {
+		return err
+	}
+
+	preparedStatement := `
+	UPDATE tree_nodes SET title = $3 WHERE folderUUID = $1 AND projectUUID = $2
+	`
+	_, err = database.Exec(context.Background(), preparedStatement, folderUUID, projectUUID, title)
+
+	if err != nil {
+		return err
+	}
+
+	return AddAuditLog(projectUUID, userUUID, AuditActionRenameTreeNode, fmt.Sprintf("%s: %s -> %s", folderUUID, treeNode.Title, title), database)
+}
+
+// MoveTreeNode re-parents the folder and its subtree, use "NULL" as the parent to move it to the root.
+func MoveTreeNode(folderUUID string, parentFolderUUID string, projectUUID string, userUUID string, database *pgx.Conn) error {
+	if err := CheckPermission(userUUID, projectUUID, ActionManageEvidence, database); err != nil {
+		return err
+	}
+
+	treeNode, err := getTreeNode(folderUUID, projectUUID, database)
+
+	if err != nil {
+		return err
+	}
+
+	if err := moveTreeNode(treeNode, parentFolderUUID, database); err != nil {
+		return err
+	}
+
+	return AddAuditLog(projectUUID, userUUID, AuditActionMoveTreeNode, fmt.Sprintf("%s: %s -> %s", folderUUID, treeNode.Parent, parentFolderUUID), database)
+}
+
+// moveTreeNode re-parents the tree node, moving a tree node into its own subtree is refused.
+func moveTreeNode(treeNode TreeNode, parentFolderUUID string, database *pgx.Conn) error {
+	if parentFolderUUID != "NULL" {
+		if parentFolderUUID == treeNode.FolderUUID {
+			return errors.New("tree node can't be moved into itself")
+		}
+
+		if _, err := getTreeNode(parentFolderUUID, treeNode.ProjectUUID, database); err != nil {
+			return err
+		}
+
+		descendantUUIDs, err := WalkTreeNodeChildrenUUIDs(treeNode.FolderUUID, treeNode.ProjectUUID, database)
+
+		if err != nil {
+			return err
+		}
+
+		for _, descendantUUID := range descendantUUIDs {
+			if descendantUUID == parentFolderUUID {
+				return errors.New("tree node can't be moved into its own subtree")
+			}
+		}
+	}
+
+	preparedStatement := `
+	UPDATE tree_nodes SET parent = $3 WHERE folderUUID = $1 AND projectUUID = $2
+	`
+	_, err := database.Exec(context.Background(), preparedStatement, treeNode.FolderUUID, treeNode.ProjectUUID, parentFolderUUID)
+
+	return err
+}
+
+// MergeTreeNodes creates a virtual folder at the root and moves the folders (e.g. of multiple evidence files) into it.
+// Virtual folders have no evidence UUID, the messages stay in their original folders so nothing is re-parsed.
+func MergeTreeNodes(folderUUIDs []string, title string, projectUUID string, userUUID string, database *pgx.Conn) (TreeNode, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionManageEvidence, database); err != nil {
+		return TreeNode{}, err
+	}
+
+	if len(folderUUIDs) == 0 {
+		return TreeNode{}, errors.New("no tree nodes to merge")
+	}
+
+	if strings.TrimSpace(title) == "" {
+		return TreeNode{}, errors.New("tree node title is empty")
+	}
+
+	var treeNodes []TreeNode
+
+	for _, folderUUID := range folderUUIDs {
+		treeNode, err := getTreeNode(folderUUID, projectUUID, database)
+
+		if err != nil {
+			return TreeNode{}, err
+		}
+
+		treeNodes = append(treeNodes, treeNode)
+	}
+
+	virtualTreeNode := TreeNode{
+		FolderUUID:  NewUUID(),
+		ProjectUUID: projectUUID,
+		Title:       title,
+		Parent:      "NULL",
+	}
+
+	if err := virtualTreeNode.Save(database); err != nil {
+		return TreeNode{}, err
+	}
+
+	for _, treeNode := range treeNodes {
+		if err := moveTreeNode(treeNode, virtualTreeNode.FolderUUID, database); err != nil {
+			return TreeNode{}, err
+		}
+	}
+
+	if err := AddAuditLog(projectUUID, userUUID, AuditActionMergeTreeNodes, fmt.Sprintf("%s: %s", virtualTreeNode.FolderUUID, strings.Join(folderUUIDs, ", ")), database); err != nil {
+		return TreeNode{}, err
+	}
+
+	return virtualTreeNode, nil
 }
@@ -3,7 +3,253 @@
 // Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
 package core
 
-import kratos "github.com/ory/kratos-client-go"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	kratos "github.com/ory/kratos-client-go"
+	"strings"
+	"time"
+)
 
-// User represents a registered user (from Ory Kratos).
-type User = kratos.Session
+// Session represents an authenticated session of a registered user (from Ory Kratos).
+type Session = kratos.Session
+
+// User represents a registered user, synced from Ory Kratos by SyncUser.
+// Audit logs, review assignments and comments reference the user by its UUID.
+type User struct {
+	UUID         string `json:"uuid"` // The Kratos identity ID.
+	Email        string `json:"email"`
+	DisplayName  string `json:"display_name"`
+	Role         string `json:"role"`      // UserRoleAdmin or UserRoleUser, the project roles are assigned using AddProjectUser.
+	LastSeen     int    `json:"last_seen"` // Unix timestamp of the last synced session.
+	CreationDate int    `json:"creation_date"`
+}
+
+// ProjectUser represents a user assigned to a project.
+type ProjectUser struct {
+	User
+	ProjectRole string `json:"project_role"`
+}
+
+// User roles which can be assigned via SetUserRole.
+const (
+	UserRoleAdmin = "admin" // Manages the users.
+	UserRoleUser  = "user"
+)
+
+// ErrUserNotFound is returned if the user hasn't been synced yet.
+var ErrUserNotFound = errors.New("user not found")
+
+// SyncUser creates or updates the user of the Kratos session and returns it, call it on login or on each authenticated request.
+// The email and display name are read from the identity traits ("email" and "name", either a string or "first" and "last").
+// The first synced user becomes UserRoleAdmin.
+func SyncUser(session *Session, database *pgx.Conn) (User, error) {
+	identity := session.GetIdentity()
+
+	user := User{
+		UUID:     identity.GetId(),
+		LastSeen: int(time.Now().Unix()),
+	}
+
+	if user.UUID == "" {
+		return User{}, errors.New("session has no identity")
+	}
+
+	if traits, ok := identity.GetTraits().(map[string]interface{}); ok {
+		user.Email, user.DisplayName = getUserTraits(traits)
+	}
+
+	if user.DisplayName == "" {
+		user.DisplayName = user.Email
+	}
+
+	preparedStatement := `
+	INSERT INTO users(uuid, email, displayName, role, lastSeen, creationDate)
+	VALUES ($1, $2, $3, CASE WHEN EXISTS(SELECT 1 FROM users) THEN $4 ELSE $5 END, $6, $6)
+	ON CONFLICT (uuid) DO UPDATE SET email = EXCLUDED.email, displayName = EXCLUDED.displayName, lastSeen = EXCLUDED.lastSeen
+	RETURNING role, creationDate
+	`
+	err := database.QueryRow(context.Background(), preparedStatement, user.UUID, user.Email, user.DisplayName, UserRoleUser, UserRoleAdmin, user.LastSeen).Scan(&user.Role, &user.CreationDate)
+
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+// getUserTraits returns the email and display name from the Kratos identity traits.
+func getUserTraits(traits map[string]interface{}) (string, string) {
+	email, _ := traits["email"].(string)
+
+	switch name := traits["name"].(type) {
+	case string:
+		return email, name
+	case map[string]interface{}:
+		first, _ := name["first"].(string)
+		last, _ := name["last"].(string)
+
+		return email, strings.TrimSpace(fmt.Sprintf("%s %s", first, last))
+	default:
+		return email, ""
+	}
+}
+
+// GetUser returns the user, returns ErrUserNotFound if the user hasn't been synced yet.
+func GetUser(userUUID string, database *pgx.Conn) (User, error) {
+	preparedStatement := `
+	SELECT uuid, email, displayName, role, lastSeen, creationDate FROM users WHERE uuid = $1
+	`
+	row := database.QueryRow(context.Background(), preparedStatement, userUUID)
+
+	var user User
+
+	if err := row.Scan(&user.UUID, &user.Email, &user.DisplayName, &user.Role, &user.LastSeen, &user.CreationDate); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return User{}, ErrUserNotFound
+		}
+
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+// GetUsers returns all users ordered by display name.
+func GetUsers(database *pgx.Conn) ([]User, error) {
+	preparedStatement := `
+	SELECT uuid, email, displayName, role, lastSeen, creationDate FROM users ORDER BY displayName, email
+	`
+	rows, err := database.Query(context.Background(), preparedStatement)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var users []User
+
+	for rows.Next() {
+		var user User
+
+		if err := rows.Scan(&user.UUID, &user.Email, &user.DisplayName, &user.Role, &user.LastSeen, &user.CreationDate); err != nil {
+			return nil, err
+		}
+
+		users = append(users, user)
+	}
+
+	rows.Close()
+
+	return users, rows.Err()
+}
+
+// GetUsersByUUIDs returns the users by their UUID, e.g. to show the authors of comments or the users of audit logs.
+// Users which haven't been synced are omitted.
+func GetUsersByUUIDs(userUUIDs []string, database *pgx.Conn) (map[string]User, error) {
+	preparedStatement := `
+	SELECT uuid, email, displayName, role, lastSeen, creationDate FROM users WHERE uuid = ANY($1)
+	`
+	rows, err := database.Query(context.Background(), preparedStatement, userUUIDs)
+
+	if err != nil {
+		return nil, err
+	}
+
+	users := make(map[string]User, len(userUUIDs))
+
+	for rows.Next() {
+		var user User
+
+		if err := rows.Scan(&user.UUID, &user.Email, &user.DisplayName, &user.Role, &user.LastSeen, &user.CreationDate); err != nil {
+			return nil, err
+		}
+
+		users[user.UUID] = user
+	}
+
+	rows.Close()
+
+	return users, rows.Err()
+}
+
+// GetProjectUsers returns the users assigned to the project with their project role.
+// Assigned users which haven't been synced only have their UUID set.
+func GetProjectUsers(projectUUID string, userUUID string, database *pgx.Conn) ([]ProjectUser, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionView, database); err != nil {
+		return nil, err
+	}
+
+	preparedStatement := `
+	SELECT puj.userUUID, COALESCE(u.email, ''), COALESCE(u.displayName, ''), COALESCE(u.role, ''), COALESCE(u.lastSeen, 0), COALESCE(u.creationDate, 0), puj.role
+	FROM project_user_junction puj
+	LEFT JOIN users u ON u.uuid = puj.userUUID
+	WHERE puj.projectUUID = $1
+	ORDER BY u.displayName, u.email
+	`
+	rows, err := database.Query(context.Background(), preparedStatement, projectUUID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var projectUsers []ProjectUser
+
+	for rows.Next() {
+		var projectUser ProjectUser
+
+		if err := rows.Scan(&projectUser.UUID, &projectUser.Email, &projectUser.DisplayName, &projectUser.Role, &projectUser.LastSeen, &projectUser.CreationDate, &projectUser.ProjectRole); err != nil {
+			return nil, err
+		}
+
+		projectUsers = append(projectUsers, projectUser)
+	}
+
+	rows.Close()
+
+	return projectUsers, rows.Err()
+}
+
+// SetUserRole changes the role of the user, only admins may change roles.
+func SetUserRole(targetUserUUID string, role string, userUUID string, database *pgx.Conn) error {
+	if role != UserRoleAdmin && role != UserRoleUser {
+		return fmt.Errorf("invalid user role: %s", role)
+	}
+
+	if err := checkUserAdmin(userUUID, database); err != nil {
+		return err
+	}
+
+	preparedStatement := `
+	UPDATE users SET role = $1 WHERE uuid = $2
+	`
+	commandTag, err := database.Exec(context.Background(), preparedStatement, role, targetUserUUID)
+
+	if err != nil {
+		return err
+	}
+
+	if commandTag.RowsAffected() == 0 {
+		return ErrUserNotFound
+	}
+
+	return nil
+}
+
+// checkUserAdmin returns ErrPermissionDenied if the user isn't an admin.
+func checkUserAdmin(userUUID string, database *pgx.Conn) error {
+	user, err := GetUser(userUUID, database)
+
+	if errors.Is(err, ErrUserNotFound) {
+		return ErrPermissionDenied
+	} else if err != nil {
+		return err
+	}
+
+	if user.Role != UserRoleAdmin {
+		return ErrPermissionDenied
+	}
+
+	return nil
+}
@@ -10,7 +10,7 @@ func NewUUID() string {
 	uuid, err := ksuid.NewRandom()
 
 	if err != nil {
-		Logger.Fatal("Failed to create UUID: %s", err)
+		Logger.Fatalf("Failed to create UUID: %s", err)
 	}
 
 	return uuid.String()
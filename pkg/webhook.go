@@ -0,0 +1,313 @@
+// Package core
+// This file is part of Go Forensics (https://www.goforensics.io/)
+// Copyright (C) 2022 Marten Mooij (https://www.mooijtech.com/)
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Webhook represents a URL which is called when events occur in the project.
+// Requests are signed with the secret, see signWebhookPayload.
+type Webhook struct {
+	UUID         string   `json:"uuid"`
+	ProjectUUID  string   `json:"project_uuid"`
+	URL          string   `json:"url"`
+	Secret       string   `json:"secret,omitempty"` // Only returned by RegisterWebhook.
+	Events       []string `json:"events"`
+	CreationDate int      `json:"creation_date"`
+}
+
+// Webhook events.
+const (
+	WebhookEventParsingFinished = "parsing_finished"
+	WebhookEventExportReady     = "export_ready"
+	WebhookEventJobFailed       = "job_failed"
+)
+
+// Webhook request headers.
+const (
+	WebhookHeaderEvent     = "X-GoForensics-Event"
+	WebhookHeaderTimestamp = "X-GoForensics-Timestamp"
+	WebhookHeaderSignature = "X-GoForensics-Signature"
+)
+
+// webhookRetryOptions defines the backoff of webhook deliveries.
+var webhookRetryOptions = RetryOptions{
+	MaxAttempts:     3,
+	InitialInterval: 10 * time.Second,
+	MaxInterval:     time.Minute,
+	Multiplier:      2,
+	Jitter:          0.2,
+}
+
+// webhookClient defines the HTTP client used to deliver webhooks.
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+}
+
+// WebhookPayload represents the JSON body sent to webhooks.
+type WebhookPayload struct {
+	Event       string `json:"event"`
+	ProjectUUID string `json:"project_uuid"`
+	Job         Job    `json:"job"`
+	Date        int    `json:"date"`
+}
+
+// Save saves the webhook to the database.
+func (webhook *Webhook) Save(database *pgx.Conn) error {
+	encodedEvents, err := json.Marshal(webhook.Events)
+
+	if err != nil {
+		return err
+	}
+
+	preparedStatement := `
+	INSERT INTO webhooks(uuid, projectUUID, url, secret, events, creationDate) VALUES ($1, $2, $3, $4, $5, $6)
+	`
+	_, err = database.Exec(context.Background(), preparedStatement, webhook.UUID, webhook.ProjectUUID, webhook.URL, webhook.Secret, string(encodedEvents), webhook.CreationDate)
+
+	return err
+}
+
+// RegisterWebhook registers the URL to be called when the events occur in the project.
+// The returned secret is used to verify the X-GoForensics-Signature header and isn't returned again.
+func RegisterWebhook(webhookURL string, events []string, projectUUID string, userUUID string, database *pgx.Conn) (Webhook, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionManageProject, database); err != nil {
+		return Webhook{}, err
+	}
+
+	parsedURL, err := url.Parse(webhookURL)
+
+	if err != nil {
+		return Webhook{}, err
+	}
+
+	if (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") || parsedURL.Host == "" {
+		return Webhook{}, errors.New("webhook URL must be an absolute HTTP(S) URL")
+	}
+
+	if len(events) == 0 {
+		return Webhook{}, errors.New("webhook has no events")
+	}
+
+	for _, event := range events {
+		if event != WebhookEventParsingFinished && event != WebhookEventExportReady && event != WebhookEventJobFailed {
+			return Webhook{}, fmt.Errorf("unsupported webhook event: %s", event)
+		}
+	}
+
+	secret := make([]byte, 32)
+
+	if _, err := rand.Read(secret); err != nil {
+		return Webhook{}, err
+	}
+
+	webhook := Webhook{
+		UUID:         NewUUID(),
+		ProjectUUID:  projectUUID,
+		URL:          webhookURL,
+		Secret:       hex.EncodeToString(secret),
+		Events:       events,
+		CreationDate: int(time.Now().Unix()),
+	}
+
+	if err := webhook.Save(database); err != nil {
+		return Webhook{}, err
+	}
+
+	return webhook, nil
+}
+
+// GetWebhooksByProject returns the webhooks of the project without their secrets.
+func GetWebhooksByProject(projectUUID string, userUUID string, database *pgx.Conn) ([]Webhook, error) {
+	if err := CheckPermission(userUUID, projectUUID, ActionManageProject, database); err != nil {
+		return nil, err
+	}
+
+	webhooks, err := getWebhooksByProject(projectUUID, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range webhooks {
+		webhooks[i].Secret = ""
+	}
+
+	return webhooks, nil
+}
+
+// getWebhooksByProject returns the webhooks of the project including their secrets.
+func getWebhooksByProject(projectUUID string, database *pgx.Conn) ([]Webhook, error) {
+	preparedStatement := `
+	SELECT uuid, projectUUID, url, secret, events, creationDate FROM webhooks WHERE projectUUID = $1 ORDER BY creationDate ASC
+	`
+	rows, err := database.Query(context.Background(), preparedStatement, projectUUID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var webhooks []Webhook
+
+	for rows.Next() {
+		var webhook Webhook
+		var encodedEvents string
+
+		if err := rows.Scan(&webhook.UUID, &webhook.ProjectUUID, &webhook.URL, &webhook.Secret, &encodedEvents, &webhook.CreationDate); err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal([]byte(encodedEvents), &webhook.Events); err != nil {
+			return nil, err
+		}
+
+		webhooks = append(webhooks, webhook)
+	}
+
+	rows.Close()
+
+	return webhooks, rows.Err()
+}
+
+// DeleteWebhook removes the webhook from the project.
+func DeleteWebhook(webhookUUID string, projectUUID string, userUUID string, database *pgx.Conn) error {
+	if err := CheckPermission(userUUID, projectUUID, ActionManageProject, database); err != nil {
+		return err
+	}
+
+	if err := checkProjectNotOnHold(projectUUID, userUUID, AuditActionDeleteWebhook, database); err != nil {
+		return err
+	}
+
+	preparedStatement := `
+	DELETE FROM webhooks WHERE uuid = $1 AND projectUUID = $2
+	`
+	_, err := database.Exec(context.Background(), preparedStatement, webhookUUID, projectUUID)
+
+	return err
+}
+
+// getJobWebhookEvent returns the webhook event of the finished job or an empty string if there is none.
+// Jobs which are queued again for a retry don't have an event yet.
+func getJobWebhookEvent(job Job) string {
+	switch job.Status {
+	case JobStatusFailed:
+		return WebhookEventJobFailed
+	case JobStatusCompleted:
+		if job.Type == JobTypeParseEvidence {
+			return WebhookEventParsingFinished
+		}
+
+		return WebhookEventExportReady
+	default:
+		return ""
+	}
+}
+
+// notifyWebhooks sends the event to the webhooks of the project which are registered for it.
+// Requests are sent in the background and retried, failures are logged.
+func notifyWebhooks(event string, job Job, database *pgx.Conn) {
+	logger := Logger.WithFields(LogFields{"project_uuid": job.ProjectUUID, "job_uuid": job.UUID})
+
+	webhooks, err := getWebhooksByProject(job.ProjectUUID, database)
+
+	if err != nil {
+		logger.Errorf("Failed to get webhooks: %s", err)
+		return
+	}
+
+	payload, err := json.Marshal(WebhookPayload{
+		Event:       event,
+		ProjectUUID: job.ProjectUUID,
+		Job:         job,
+		Date:        int(time.Now().Unix()),
+	})
+
+	if err != nil {
+		logger.Errorf("Failed to encode webhook payload: %s", err)
+		return
+	}
+
+	for _, webhook := range webhooks {
+		for _, webhookEvent := range webhook.Events {
+			if webhookEvent == event {
+				go deliverWebhook(webhook, event, payload)
+				break
+			}
+		}
+	}
+}
+
+// deliverWebhook posts the payload to the webhook, retrying on failure.
+func deliverWebhook(webhook Webhook, event string, payload []byte) {
+	logger := Logger.WithFields(LogFields{"project_uuid": webhook.ProjectUUID, "webhook_uuid": webhook.UUID})
+
+	err := retry(context.Background(), webhookRetryOptions, func() error {
+		return postWebhook(webhook, event, payload)
+	})
+
+	if err != nil {
+		logger.Errorf("Failed to deliver webhook %s: %s", webhook.UUID, err)
+	}
+}
+
+// postWebhook posts the signed payload to the webhook.
+func postWebhook(webhook Webhook, event string, payload []byte) error {
+	logger := Logger.WithFields(LogFields{"project_uuid": webhook.ProjectUUID, "webhook_uuid": webhook.UUID})
+
+	request, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(payload))
+
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(WebhookHeaderEvent, event)
+	request.Header.Set(WebhookHeaderTimestamp, timestamp)
+	request.Header.Set(WebhookHeaderSignature, signWebhookPayload(webhook.Secret, timestamp, payload))
+
+	response, err := webhookClient.Do(request)
+
+	if err != nil {
+		return err
+	}
+
+	if err := response.Body.Close(); err != nil {
+		logger.Errorf("Failed to close response body: %s", err)
+	}
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code: %d", response.StatusCode)
+	}
+
+	return nil
+}
+
+// signWebhookPayload returns the hex encoded HMAC-SHA256 of the timestamp and payload separated by a dot.
+// Receivers should verify the signature and reject old timestamps to prevent replays.
+func signWebhookPayload(secret string, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
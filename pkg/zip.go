@@ -5,11 +5,17 @@ package core
 
 import (
 	"archive/zip"
+	"context"
+	"errors"
 	"fmt"
+	"github.com/minio/minio-go/v7"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // Unzip unzips the ZIP file.
@@ -82,6 +88,13 @@ func Unzip(src string, dest string) error {
 			if err != nil {
 				return err
 			}
+
+			// Preserve the modification time, parsers may use it as a fallback date.
+			err = os.Chtimes(path, zipFile.Modified, zipFile.Modified)
+
+			if err != nil {
+				return err
+			}
 		}
 
 		return nil
@@ -98,7 +111,7 @@ func Unzip(src string, dest string) error {
 	return nil
 }
 
-// ZipDirectory ZIPs the directory.
+// ZipDirectory ZIPs the directory, the files are stored in a folder named after the directory.
 func ZipDirectory(pathToZip string, destinationPath string) error {
 	destinationFile, err := os.Create(destinationPath)
 
@@ -106,49 +119,456 @@ func ZipDirectory(pathToZip string, destinationPath string) error {
 		return err
 	}
 
+	defer func() {
+		if err := destinationFile.Close(); err != nil {
+			Logger.Errorf("Failed to close file: %s", err)
+		}
+	}()
+
 	zipWriter := zip.NewWriter(destinationFile)
 
-	err = filepath.Walk(pathToZip, func(filePath string, info os.FileInfo, err error) error {
+	err = addDirectoryToZip(pathToZip, func(name string) (io.Writer, error) {
+		return createZipFile(zipWriter, name)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return zipWriter.Close()
+}
+
+// addDirectoryToZip adds the files of the directory in a folder named after the directory, create adds a file to the ZIP file.
+func addDirectoryToZip(pathToZip string, create func(name string) (io.Writer, error)) error {
+	return filepath.Walk(pathToZip, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
 		if info.IsDir() {
 			return nil
 		}
 
+		relPath, err := filepath.Rel(filepath.Dir(pathToZip), filePath)
+
 		if err != nil {
 			return err
 		}
 
-		relPath := strings.TrimPrefix(filePath, filepath.Dir(pathToZip))
+		return addFileToZip(filepath.ToSlash(relPath), filePath, create)
+	})
+}
+
+// addFileToZip adds the file, create adds a file to the ZIP file.
+func addFileToZip(name string, filePath string, create func(name string) (io.Writer, error)) error {
+	inputFile, err := os.Open(filePath)
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := inputFile.Close(); err != nil {
+			Logger.Errorf("Failed to close file: %s", err)
+		}
+	}()
+
+	zipFile, err := create(name)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(zipFile, inputFile)
+
+	return err
+}
+
+// createZipFile adds a compressed file to the ZIP file and returns the writer of its content.
+// The sizes are written after the content, archive/zip switches to Zip64 if they exceed 4GB.
+func createZipFile(zipWriter *zip.Writer, name string) (io.Writer, error) {
+	return zipWriter.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	})
+}
+
+// ZipUploader streams a ZIP file to MinIO using multipart uploads, so exports don't need local disk space.
+// Zip64 records are written when a file or the ZIP file exceeds 4GB or it has more than 65,535 files.
+// The files are encrypted and the ZIP file is split into volumes as configured by the ArchiveOptions.
+// Close must be called to complete the upload, Abort cancels it.
+type ZipUploader struct {
+	projectUUID   string
+	passphrase    string
+	zipWriter     *zip.Writer
+	volumes       *volumeUploader
+	encryptedFile *aesZipFile   // The encrypted file being written, added to the ZIP file when the next file is created.
+	scratchSpace  *ScratchSpace // Created by the first encrypted file.
+}
+
+// NewZipUploader starts the upload of the ZIP file to MinIO, the MinIO path is "<projectUUID>/<fileName>".
+// Split ZIP files are uploaded as numbered volumes, see ArchiveOptions.
+func NewZipUploader(fileName string, projectUUID string, options ArchiveOptions) *ZipUploader {
+	volumes := &volumeUploader{
+		fileName:    fileName,
+		projectUUID: projectUUID,
+		volumeSize:  options.VolumeSize,
+	}
+
+	return &ZipUploader{
+		projectUUID: projectUUID,
+		passphrase:  options.Passphrase,
+		zipWriter:   zip.NewWriter(volumes),
+		volumes:     volumes,
+	}
+}
+
+// Create adds a file to the ZIP file and returns the writer of its content, which is valid until the next file is added.
+func (zipUploader *ZipUploader) Create(name string) (io.Writer, error) {
+	if err := zipUploader.addEncryptedFile(); err != nil {
+		return nil, err
+	}
 
-		zipFile, err := zipWriter.Create(relPath)
+	if zipUploader.passphrase == "" {
+		return createZipFile(zipUploader.zipWriter, name)
+	}
+
+	if zipUploader.scratchSpace == nil {
+		scratchSpace, err := NewScratchSpace(zipUploader.projectUUID)
 
 		if err != nil {
-			return err
+			return nil, err
+		}
+
+		zipUploader.scratchSpace = scratchSpace
+	}
+
+	encryptedFile, err := newAESZipFile(name, zipUploader.passphrase, zipUploader.scratchSpace.FilePath(NewUUID()))
+
+	if err != nil {
+		return nil, err
+	}
+
+	zipUploader.encryptedFile = encryptedFile
+
+	return encryptedFile, nil
+}
+
+// addEncryptedFile adds the encrypted file being written (if any) to the ZIP file.
+func (zipUploader *ZipUploader) addEncryptedFile() error {
+	if zipUploader.encryptedFile == nil {
+		return nil
+	}
+
+	encryptedFile := zipUploader.encryptedFile
+	zipUploader.encryptedFile = nil
+
+	return encryptedFile.addToZip(zipUploader.zipWriter)
+}
+
+// AddFile adds the local file to the ZIP file.
+func (zipUploader *ZipUploader) AddFile(name string, filePath string) error {
+	return addFileToZip(name, filePath, zipUploader.Create)
+}
+
+// AddDirectory adds the files of the local directory to the ZIP file in a folder named after the directory.
+func (zipUploader *ZipUploader) AddDirectory(pathToZip string) error {
+	return addDirectoryToZip(pathToZip, zipUploader.Create)
+}
+
+// AddObject streams the MinIO object into the ZIP file.
+// Returns the MinIO error (see minio.ToErrorResponse) before adding the file if the object doesn't exist.
+func (zipUploader *ZipUploader) AddObject(name string, objectName string) error {
+	objectReader, err := GetObject(objectName)
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := objectReader.Close(); err != nil {
+			Logger.Errorf("Failed to close MinIO object: %s", err)
 		}
+	}()
+
+	// GetObject doesn't fail on missing objects, Stat does.
+	if _, err := objectReader.Stat(); err != nil {
+		return err
+	}
 
-		fsFile, err := os.Open(filePath)
+	zipFile, err := zipUploader.Create(name)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(zipFile, objectReader)
+
+	return err
+}
+
+// Close writes the central directory, completes the upload and returns the MinIO path to the uploaded ZIP file.
+// The path of the first volume is returned for split ZIP files, see GetArchiveVolumes.
+func (zipUploader *ZipUploader) Close() (string, error) {
+	defer zipUploader.removeScratchSpace()
+
+	if err := zipUploader.addEncryptedFile(); err != nil {
+		zipUploader.Abort()
+
+		return "", err
+	}
+
+	if err := zipUploader.zipWriter.Close(); err != nil {
+		zipUploader.Abort()
+
+		return "", err
+	}
+
+	return zipUploader.volumes.Close()
+}
+
+// Abort cancels the upload and removes the uploaded volumes. Does nothing after Close.
+func (zipUploader *ZipUploader) Abort() {
+	if zipUploader.encryptedFile != nil {
+		zipUploader.encryptedFile.remove()
+		zipUploader.encryptedFile = nil
+	}
+
+	zipUploader.removeScratchSpace()
+	zipUploader.volumes.Abort()
+}
+
+// removeScratchSpace removes the scratch space of the encrypted files, if any.
+func (zipUploader *ZipUploader) removeScratchSpace() {
+	if zipUploader.scratchSpace != nil {
+		zipUploader.scratchSpace.cleanup()
+		zipUploader.scratchSpace = nil
+	}
+}
+
+// zipUploadPartSize defines the part size of the multipart upload of streamed ZIP files.
+// MinIO allows 10,000 parts so a streamed ZIP file (or volume) is limited to 640GB.
+const zipUploadPartSize = 64 * 1024 * 1024
+
+// errZipUploadAborted is the error of the upload of an aborted ZipUploader.
+var errZipUploadAborted = errors.New("zip upload aborted")
+
+// volumeUploader uploads the written data to MinIO, split into volumes of the volume size if set.
+// The volumes are named "<fileName>.001", "<fileName>.002" and so on, joining them results in the ZIP file.
+type volumeUploader struct {
+	fileName    string
+	projectUUID string
+	volumeSize  int64    // Zero to upload a single object.
+	objectNames []string // The started uploads.
+	written     int64    // The bytes written to the current volume.
+	pipeWriter  *io.PipeWriter
+	uploadDone  chan error
+	isDone      bool
+}
+
+// Write uploads the data, starting a new volume when the current volume is full.
+func (volumes *volumeUploader) Write(data []byte) (int, error) {
+	var written int
+
+	for len(data) > 0 {
+		if volumes.pipeWriter == nil {
+			if err := volumes.startVolume(); err != nil {
+				return written, err
+			}
+		}
+
+		chunk := data
+
+		if volumes.volumeSize > 0 && int64(len(chunk)) > volumes.volumeSize-volumes.written {
+			chunk = chunk[:volumes.volumeSize-volumes.written]
+		}
+
+		n, err := volumes.pipeWriter.Write(chunk)
+
+		written += n
+		volumes.written += int64(n)
+
+		if err != nil {
+			return written, err
+		}
+
+		data = data[n:]
+
+		if volumes.volumeSize > 0 && volumes.written == volumes.volumeSize {
+			if err := volumes.finishVolume(); err != nil {
+				return written, err
+			}
+		}
+	}
+
+	return written, nil
+}
+
+// startVolume starts the upload of the next volume, volumes are stored in the ObjectStore instead if set.
+func (volumes *volumeUploader) startVolume() error {
+	objectName := fmt.Sprintf("%s/%s", volumes.projectUUID, volumes.fileName)
+
+	if volumes.volumeSize > 0 {
+		objectName = fmt.Sprintf("%s.%03d", objectName, len(volumes.objectNames)+1)
+	}
+
+	upload := func(reader io.Reader) error {
+		return ObjectStore.PutObject(objectName, reader)
+	}
+
+	if ObjectStore == nil {
+		bucketName, err := getObjectBucket(objectName)
 
 		if err != nil {
 			return err
 		}
 
-		_, err = io.Copy(zipFile, fsFile)
+		serverSideEncryption, err := getObjectEncryption(objectName)
 
 		if err != nil {
 			return err
 		}
 
-		return nil
-	})
+		upload = func(reader io.Reader) error {
+			// The size is unknown so the parts are uploaded while the ZIP file is written.
+			_, err := MinIOClient.PutObject(context.Background(), bucketName, objectName, reader, -1, minio.PutObjectOptions{
+				ContentType:          "application/zip",
+				PartSize:             zipUploadPartSize,
+				ServerSideEncryption: serverSideEncryption,
+			})
 
-	if err != nil {
+			return err
+		}
+	}
+
+	pipeReader, pipeWriter := io.Pipe()
+	uploadDone := make(chan error, 1)
+
+	go func() {
+		err := upload(pipeReader)
+
+		// Unblocks the writer if the upload failed.
+		if err != nil {
+			pipeReader.CloseWithError(err)
+		}
+
+		uploadDone <- err
+	}()
+
+	volumes.objectNames = append(volumes.objectNames, objectName)
+	volumes.written = 0
+	volumes.pipeWriter = pipeWriter
+	volumes.uploadDone = uploadDone
+
+	return nil
+}
+
+// finishVolume completes the upload of the current volume.
+func (volumes *volumeUploader) finishVolume() error {
+	if err := volumes.pipeWriter.Close(); err != nil {
 		return err
 	}
 
-	err = zipWriter.Close()
+	volumes.pipeWriter = nil
+
+	return <-volumes.uploadDone
+}
+
+// Close completes the upload and returns the MinIO path of the (first) volume.
+func (volumes *volumeUploader) Close() (string, error) {
+	if volumes.isDone {
+		return "", errors.New("zip upload is closed")
+	}
+
+	volumes.isDone = true
+
+	// The last volume is already uploaded if the size is a multiple of the volume size.
+	if volumes.pipeWriter != nil {
+		if err := volumes.finishVolume(); err != nil {
+			volumes.removeVolumes()
+
+			return "", err
+		}
+	}
+
+	// The ZIP file always has an end of central directory record.
+	if len(volumes.objectNames) == 0 {
+		return "", errors.New("zip upload is empty")
+	}
+
+	return volumes.objectNames[0], nil
+}
+
+// Abort cancels the current upload and removes the uploaded volumes. Does nothing after Close.
+func (volumes *volumeUploader) Abort() {
+	if volumes.isDone {
+		return
+	}
+
+	volumes.isDone = true
+
+	if volumes.pipeWriter != nil {
+		volumes.pipeWriter.CloseWithError(errZipUploadAborted)
+
+		// The upload fails with errZipUploadAborted (or an earlier error).
+		_ = <-volumes.uploadDone
+	}
+
+	volumes.removeVolumes()
+}
+
+// removeVolumes removes the started volumes, MinIO removes the parts of incomplete uploads itself.
+func (volumes *volumeUploader) removeVolumes() {
+	for _, objectName := range volumes.objectNames {
+		if err := RemoveObject(objectName); err != nil {
+			Logger.Errorf("Failed to remove ZIP volume: %s", err)
+		}
+	}
+}
+
+// GetArchiveVolumes returns the MinIO paths of the volumes of the export, the path is the result of the export.
+// Returns the path itself if the export isn't split into volumes.
+func GetArchiveVolumes(objectName string) ([]string, error) {
+	if !strings.HasSuffix(objectName, ".001") {
+		return []string{objectName}, nil
+	}
+
+	prefix := strings.TrimSuffix(objectName, "001")
+
+	bucketName, err := getObjectBucket(prefix)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	var objectNames []string
+
+	for object := range MinIOClient.ListObjects(context.Background(), bucketName, minio.ListObjectsOptions{Prefix: prefix}) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+
+		objectNames = append(objectNames, object.Key)
+	}
+
+	// The volume numbers are zero padded so they sort by name.
+	sort.Strings(objectNames)
+
+	return objectNames, nil
+}
+
+// getFirstArchiveVolume returns the MinIO path of the first volume (the job result) if the path is a volume of a split ZIP file.
+func getFirstArchiveVolume(objectName string) string {
+	extension := filepath.Ext(objectName)
+
+	if len(extension) != 4 || !strings.HasSuffix(strings.TrimSuffix(objectName, extension), ".zip") {
+		return objectName
+	}
+
+	if _, err := strconv.Atoi(extension[1:]); err != nil {
+		return objectName
+	}
+
+	return strings.TrimSuffix(objectName, extension) + ".001"
 }